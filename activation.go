@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd,
+// SD_LISTEN_FDS_START in sd_listen_fds(3).
+const listenFDsStart = 3
+
+// ActivationListeners returns listeners for the sockets passed to
+// the process by systemd socket activation, in the order of the
+// ListenStream= lines of the socket unit. It returns nil if the
+// process was not socket activated. The LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES variables are unset, so child processes do not
+// take them for their own.
+func ActivationListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		// FileListener dups the descriptor, with close-on-exec
+		// set, so the original can go.
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("ssh: activation socket %s: %v", name, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// ServeActivated runs ServeListener on each of the listeners from
+// ActivationListeners, so that an embedded server can be started by
+// a systemd socket unit. It returns an error if there are no
+// activation sockets. When one listener fails, the others are
+// stopped too, and the first error is returned.
+func ServeActivated(ctx context.Context, config *ServerConfig, handler ConnHandler) error {
+	ls, err := ActivationListeners()
+	if err != nil {
+		return err
+	}
+	if len(ls) == 0 {
+		return fmt.Errorf("ssh: no socket activation listeners")
+	}
+	return serveListeners(ctx, ls, config, handler)
+}
+
+// serveListeners runs ServeListener on each of ls, until they all
+// return.
+func serveListeners(ctx context.Context, ls []net.Listener, config *ServerConfig, handler ConnHandler) error {
+	conf := *config
+	if conf.Halt == nil {
+		conf.Halt = NewHalter()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			err := ServeListener(ctx, l, &conf, handler)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(l)
+	}
+	var first error
+	for range ls {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
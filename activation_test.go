@@ -0,0 +1,109 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestActivationHelper is run as a subprocess by TestServeActivated,
+// playing a socket-activated server.
+func TestActivationHelper(t *testing.T) {
+	if os.Getenv("XCRYPTOSSH_ACTIVATION_HELPER") != "1" {
+		t.Skip("only run as a subprocess")
+	}
+	// systemd sets LISTEN_PID to the pid of the service.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	err := ServeActivated(context.Background(), config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+		go DiscardRequests(ctx, reqs, nil)
+		for ch := range chans {
+			ch.Reject(Prohibited, "activation test")
+			config.Halt.RequestStop()
+			return
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ServeActivated:", err)
+		os.Exit(1)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		fmt.Fprintln(os.Stderr, "LISTEN_FDS left in the environment")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestServeActivated(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationHelper$")
+	cmd.Env = append(os.Environ(), "XCRYPTOSSH_ACTIVATION_HELPER=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=ssh")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	f.Close()
+	l.Close() // the helper's copy stays open
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: FixedHostKey(testSigners["rsa"].PublicKey()),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	ctx := context.Background()
+	client, err := Dial(ctx, "tcp", l.Addr().String(), clientConf)
+	if err != nil {
+		cmd.Process.Kill()
+		t.Fatalf("Dial: %v", err)
+	}
+	if _, _, err := client.OpenChannel(ctx, "x", nil, nil); err == nil {
+		t.Error("OpenChannel succeeded")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("helper: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("helper did not stop")
+	}
+}
+
+func TestActivationListenersOtherPid(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	ls, err := ActivationListeners()
+	if err != nil || ls != nil {
+		t.Errorf("got %v, %v for another process's sockets", ls, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS not unset")
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// CertKey is a certificate an agent holds, as ssh-add adds the
+// -cert.pub file next to a key.
+type CertKey struct {
+	// Cert is the certificate, parsed from the identity the agent
+	// lists for it.
+	Cert *ssh.Certificate
+
+	// Comment is the comment of that identity.
+	Comment string
+
+	// Plain is the identity of the bare key the certificate is
+	// for, or nil if the agent holds only the certificate.
+	Plain *Key
+}
+
+// Signer returns a Signer that presents the certificate, and has a
+// sign for it.
+func (k *CertKey) Signer(a Agent) ssh.Signer {
+	return &agentCertSigner{agent: a, cert: k.Cert}
+}
+
+type agentCertSigner struct {
+	agent Agent
+	cert  *ssh.Certificate
+}
+
+func (s *agentCertSigner) PublicKey() ssh.PublicKey {
+	return s.cert
+}
+
+func (s *agentCertSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	// Agents sign for a certificate with the key it certifies.
+	return s.agent.Sign(s.cert, data)
+}
+
+// ListCertificates returns the certificates among the identities of
+// a, each paired with the identity of its bare key, if a has it.
+func ListCertificates(a Agent) ([]*CertKey, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	var certs []*CertKey
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			continue
+		}
+		ck := &CertKey{Cert: cert, Comment: k.Comment}
+		want := cert.Key.Marshal()
+		for _, plain := range keys {
+			if bytes.Equal(plain.Blob, want) {
+				ck.Plain = plain
+				break
+			}
+		}
+		certs = append(certs, ck)
+	}
+	return certs, nil
+}
+
+// CertFilter picks certificates. Its zero value picks all of them.
+type CertFilter struct {
+	// CertType, if not zero, is the type the certificate must
+	// have, ssh.UserCert or ssh.HostCert.
+	CertType uint32
+
+	// Principal, if not empty, must be among the ValidPrincipals
+	// of the certificate, or the certificate must list none, as
+	// ssh.CertChecker has it.
+	Principal string
+
+	// ValidAt, if not zero, is a time the certificate must be
+	// valid at.
+	ValidAt time.Time
+}
+
+// Match reports whether cert passes f. It does not check the
+// signature on cert, which is for the server to do.
+func (f CertFilter) Match(cert *ssh.Certificate) bool {
+	if f.CertType != 0 && cert.CertType != f.CertType {
+		return false
+	}
+	if f.Principal != "" && len(cert.ValidPrincipals) > 0 {
+		found := false
+		for _, p := range cert.ValidPrincipals {
+			if p == f.Principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.ValidAt.IsZero() {
+		now := f.ValidAt.Unix()
+		if after := int64(cert.ValidAfter); after < 0 || now < after {
+			return false
+		}
+		if before := int64(cert.ValidBefore); cert.ValidBefore != ssh.CertTimeInfinity && (now >= before || before < 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// CertSigners returns Signers, presenting the certificate, for the
+// certificates of a that pass f, in the order a lists them. Pass it
+// to ssh.PublicKeysCallback to log in to a server that trusts the
+// CA:
+//
+//	auth := ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+//		return agent.CertSigners(a, agent.CertFilter{
+//			CertType:  ssh.UserCert,
+//			Principal: user,
+//			ValidAt:   time.Now(),
+//		})
+//	})
+func CertSigners(a Agent, f CertFilter) ([]ssh.Signer, error) {
+	certs, err := ListCertificates(a)
+	if err != nil {
+		return nil, err
+	}
+	var signers []ssh.Signer
+	for _, k := range certs {
+		if f.Match(k.Cert) {
+			signers = append(signers, k.Signer(a))
+		}
+	}
+	return signers, nil
+}
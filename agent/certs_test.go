@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+func addTestCert(t *testing.T, a Agent, keyName string, cert *ssh.Certificate) {
+	cert.Key = testPublicKeys[keyName]
+	if err := cert.SignCert(rand.Reader, testSigners["dsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	err := a.Add(AddedKey{
+		PrivateKey:  testPrivateKeys[keyName],
+		Certificate: cert,
+		Comment:     keyName + "-cert",
+	})
+	if err != nil {
+		t.Fatalf("failed to add cert for %q: %v", keyName, err)
+	}
+}
+
+func TestCertSigners(t *testing.T) {
+	now := time.Now()
+	a := NewKeyring()
+	addTestKey(t, a, "ecdsa")
+	addTestCert(t, a, "ecdsa", &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"gopher"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	})
+	addTestCert(t, a, "rsa", &ssh.Certificate{
+		CertType:    ssh.UserCert,
+		ValidBefore: uint64(now.Add(-time.Minute).Unix()),
+	})
+
+	certs, err := ListCertificates(a)
+	if err != nil {
+		t.Fatalf("ListCertificates: %v", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("got %d certificates, want 2", len(certs))
+	}
+	if certs[0].Comment != "ecdsa-cert" || certs[0].Plain == nil || certs[0].Plain.Comment != "ecdsa" {
+		t.Errorf("ecdsa certificate listed as %+v", certs[0])
+	}
+	if certs[1].Comment != "rsa-cert" || certs[1].Plain != nil {
+		t.Errorf("rsa certificate listed as %+v", certs[1])
+	}
+
+	for _, tc := range []struct {
+		filter CertFilter
+		want   []string
+	}{
+		{CertFilter{}, []string{"ecdsa", "rsa"}},
+		{CertFilter{CertType: ssh.HostCert}, nil},
+		{CertFilter{Principal: "gopher"}, []string{"ecdsa", "rsa"}},
+		{CertFilter{Principal: "root"}, []string{"rsa"}},
+		{CertFilter{ValidAt: now}, []string{"ecdsa"}},
+		{CertFilter{Principal: "root", ValidAt: now}, nil},
+	} {
+		signers, err := CertSigners(a, tc.filter)
+		if err != nil {
+			t.Fatalf("CertSigners(%+v): %v", tc.filter, err)
+		}
+		var got []string
+		for _, s := range signers {
+			cert := s.PublicKey().(*ssh.Certificate)
+			for name, pub := range testPublicKeys {
+				if bytes.Equal(cert.Key.Marshal(), pub.Marshal()) {
+					got = append(got, name)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("CertSigners(%+v) certify %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+
+	signers, err := CertSigners(a, CertFilter{Principal: "gopher", ValidAt: now})
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("CertSigners = %d signers, %v; want 1", len(signers), err)
+	}
+	data := []byte("challenge")
+	sig, err := signers[0].Sign(rand.Reader, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := signers[0].PublicKey().Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
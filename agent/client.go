@@ -57,6 +57,50 @@ type Agent interface {
 	Signers() ([]ssh.Signer, error)
 }
 
+// ExtendedAgent is an Agent that also handles extension requests,
+// see [PROTOCOL.agent], section 4.7.
+type ExtendedAgent interface {
+	Agent
+
+	// Extension sends the vendor-specific extension request
+	// extensionType with contents, and returns the raw reply. It
+	// returns ErrExtensionUnsupported if the agent does not know
+	// the extension.
+	Extension(extensionType string, contents []byte) ([]byte, error)
+}
+
+// SmartcardAgent is an Agent that can also load keys from smartcards
+// or other PKCS#11 providers, as ssh-add -s and -e do.
+type SmartcardAgent interface {
+	Agent
+
+	// AddSmartcardKey adds the keys of the provider key.ReaderID.
+	AddSmartcardKey(key SmartcardKey) error
+
+	// RemoveSmartcardKey removes the keys of the provider
+	// readerID.
+	RemoveSmartcardKey(readerID string, pin []byte) error
+}
+
+// SmartcardKey describes a smartcard or PKCS#11 provider whose keys
+// are to be added to a SmartcardAgent.
+type SmartcardKey struct {
+	// ReaderID names the provider, typically the path of a
+	// PKCS#11 library for OpenSSH's ssh-agent.
+	ReaderID string
+	// PIN unlocks the provider, if needed.
+	PIN []byte
+	// LifetimeSecs, ConfirmBeforeUse and ConstraintExtensions
+	// constrain the added keys as in AddedKey.
+	LifetimeSecs         uint32
+	ConfirmBeforeUse     bool
+	ConstraintExtensions []ConstraintExtension
+}
+
+// ErrExtensionUnsupported is returned by ExtendedAgent.Extension for
+// extensions the agent does not support.
+var ErrExtensionUnsupported = errors.New("agent: extension unsupported")
+
 // ConstraintExtension describes an optional constraint defined by users.
 type ConstraintExtension struct {
 	// ExtensionName consist of a UTF-8 string suffixed by the
@@ -107,10 +151,18 @@ const (
 	agentUnlock                     = 23
 	agentAddSmartcardKeyConstrained = 26
 
+	// 4.7 Extension mechanism
+	agentExtension        = 27
+	agentExtensionFailure = 28
+
 	// 3.7 Key constraint identifiers
 	agentConstrainLifetime  = 1
 	agentConstrainConfirm   = 2
-	agentConstrainExtension = 3
+	agentConstrainExtension = 255
+
+	// agentConstrainExtensionV00 is the identifier of constraint
+	// extensions in earlier drafts of the protocol, still accepted.
+	agentConstrainExtensionV00 = 3
 )
 
 // maxAgentResponseBytes is the maximum agent reply size that is accepted. This
@@ -130,6 +182,24 @@ const agentSuccess = 6
 
 type successAgentMsg struct{}
 
+// See [PROTOCOL.agent], section 3.3.
+type addSmartcardKeyAgentMsg struct {
+	ReaderID    string `sshtype:"20|26"`
+	PIN         []byte
+	Constraints []byte `ssh:"rest"`
+}
+
+type removeSmartcardKeyAgentMsg struct {
+	ReaderID string `sshtype:"21"`
+	PIN      []byte
+}
+
+// See [PROTOCOL.agent], section 4.7.
+type extensionAgentMsg struct {
+	ExtensionType string `sshtype:"27"`
+	Contents      []byte `ssh:"rest"`
+}
+
 // See [PROTOCOL.agent], section 2.5.2.
 const agentRequestIdentities = 11
 
@@ -172,7 +242,7 @@ type constrainLifetimeAgentMsg struct {
 }
 
 type constrainExtensionAgentMsg struct {
-	ExtensionName    string `sshtype:"3"`
+	ExtensionName    string `sshtype:"255|3"`
 	ExtensionDetails []byte
 
 	// Rest is a field used for parsing, not part of message
@@ -268,6 +338,20 @@ func NewClient(rw io.ReadWriter) Agent {
 // unmarshaled into reply and replyType is set to the first byte of
 // the reply, which contains the type of the message.
 func (c *client) call(req []byte) (reply interface{}, err error) {
+	buf, err := c.callRaw(req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err = unmarshal(buf)
+	if err != nil {
+		return nil, clientErr(err)
+	}
+	return reply, err
+}
+
+// callRaw sends an RPC to the agent, and returns the reply without
+// unmarshaling it.
+func (c *client) callRaw(req []byte) (reply []byte, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -291,11 +375,7 @@ func (c *client) call(req []byte) (reply interface{}, err error) {
 	if _, err = io.ReadFull(c.conn, buf); err != nil {
 		return nil, clientErr(err)
 	}
-	reply, err = unmarshal(buf)
-	if err != nil {
-		return nil, clientErr(err)
-	}
-	return reply, err
+	return buf, nil
 }
 
 func (c *client) simpleCall(req []byte) error {
@@ -567,21 +647,55 @@ type ed25519CertMsg struct {
 // Add adds a private key to the agent. If a certificate is given,
 // that certificate is added instead as public key.
 func (c *client) Add(key AddedKey) error {
+	constraints := marshalConstraints(key.LifetimeSecs, key.ConfirmBeforeUse, key.ConstraintExtensions)
+
+	if cert := key.Certificate; cert == nil {
+		return c.insertKey(key.PrivateKey, key.Comment, constraints)
+	} else {
+		return c.insertCert(key.PrivateKey, cert, key.Comment, constraints)
+	}
+}
+
+// marshalConstraints encodes key constraints as in
+// SSH_AGENTC_ADD_ID_CONSTRAINED, see [PROTOCOL.agent], section 3.7.
+func marshalConstraints(lifetimeSecs uint32, confirmBeforeUse bool, extensions []ConstraintExtension) []byte {
 	var constraints []byte
 
-	if secs := key.LifetimeSecs; secs != 0 {
-		constraints = append(constraints, ssh.Marshal(constrainLifetimeAgentMsg{secs})...)
+	if lifetimeSecs != 0 {
+		constraints = append(constraints, ssh.Marshal(constrainLifetimeAgentMsg{lifetimeSecs})...)
 	}
 
-	if key.ConfirmBeforeUse {
+	if confirmBeforeUse {
 		constraints = append(constraints, agentConstrainConfirm)
 	}
 
-	if cert := key.Certificate; cert == nil {
-		return c.insertKey(key.PrivateKey, key.Comment, constraints)
-	} else {
-		return c.insertCert(key.PrivateKey, cert, key.Comment, constraints)
+	for _, ext := range extensions {
+		constraints = append(constraints, agentConstrainExtension)
+		constraints = append(constraints, ssh.Marshal(ext)...)
+	}
+	return constraints
+}
+
+// AddSmartcardKey implements SmartcardAgent.
+func (c *client) AddSmartcardKey(key SmartcardKey) error {
+	constraints := marshalConstraints(key.LifetimeSecs, key.ConfirmBeforeUse, key.ConstraintExtensions)
+	req := ssh.Marshal(addSmartcardKeyAgentMsg{
+		ReaderID:    key.ReaderID,
+		PIN:         key.PIN,
+		Constraints: constraints,
+	})
+	if len(constraints) != 0 {
+		req[0] = agentAddSmartcardKeyConstrained
 	}
+	return c.simpleCall(req)
+}
+
+// RemoveSmartcardKey implements SmartcardAgent.
+func (c *client) RemoveSmartcardKey(readerID string, pin []byte) error {
+	return c.simpleCall(ssh.Marshal(removeSmartcardKeyAgentMsg{
+		ReaderID: readerID,
+		PIN:      pin,
+	}))
 }
 
 func (c *client) insertCert(s interface{}, cert *ssh.Certificate, comment string, constraints []byte) error {
@@ -681,3 +795,27 @@ func (s *agentKeyringSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature,
 	// The agent has its own entropy source, so the rand argument is ignored.
 	return s.agent.Sign(s.pub, data)
 }
+
+// Extension implements ExtendedAgent. A plain SSH_AGENT_FAILURE reply
+// means the agent does not know the extension, see [PROTOCOL.agent],
+// section 4.7.
+func (c *client) Extension(extensionType string, contents []byte) ([]byte, error) {
+	req := ssh.Marshal(extensionAgentMsg{
+		ExtensionType: extensionType,
+		Contents:      contents,
+	})
+	buf, err := c.callRaw(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, errors.New("agent: failure; empty response")
+	}
+	switch buf[0] {
+	case agentFailure:
+		return nil, ErrExtensionUnsupported
+	case agentExtensionFailure:
+		return nil, errors.New("agent: extension failure")
+	}
+	return buf, nil
+}
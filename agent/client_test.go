@@ -174,6 +174,115 @@ func testAgentInterface(t *testing.T, agent Agent, key interface{}, cert *ssh.Ce
 
 }
 
+func TestConstraintsOverWire(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	confirmed := 0
+	go ServeAgent(NewKeyringWithConfirm(func(ssh.PublicKey, string) bool {
+		confirmed++
+		return true
+	}), c2)
+	agent := NewClient(c1)
+
+	if err := agent.Add(AddedKey{
+		PrivateKey:           testPrivateKeys["rsa"],
+		ConstraintExtensions: []ConstraintExtension{{ExtensionName: "foo@example.com"}},
+	}); err == nil {
+		t.Error("keyring accepted an unknown constraint extension")
+	}
+	if err := agent.Add(AddedKey{
+		PrivateKey:       testPrivateKeys["rsa"],
+		ConfirmBeforeUse: true,
+		LifetimeSecs:     60,
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := agent.Sign(testPublicKeys["rsa"], []byte("data")); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if confirmed != 1 {
+		t.Errorf("got %d confirmations, want 1", confirmed)
+	}
+}
+
+// smartcardKeyring is a keyring that records smartcard requests.
+type smartcardKeyring struct {
+	Agent
+	added   []SmartcardKey
+	removed []string
+}
+
+func (r *smartcardKeyring) AddSmartcardKey(key SmartcardKey) error {
+	r.added = append(r.added, key)
+	return nil
+}
+
+func (r *smartcardKeyring) RemoveSmartcardKey(readerID string, pin []byte) error {
+	if string(pin) != "1234" {
+		return errors.New("wrong PIN")
+	}
+	r.removed = append(r.removed, readerID)
+	return nil
+}
+
+func TestSmartcardOverWire(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	sc := &smartcardKeyring{Agent: NewKeyring()}
+	go ServeAgent(sc, c2)
+	agent := NewClient(c1).(SmartcardAgent)
+
+	if err := agent.AddSmartcardKey(SmartcardKey{ReaderID: "/usr/lib/opensc-pkcs11.so", PIN: []byte("1234")}); err != nil {
+		t.Fatalf("AddSmartcardKey: %v", err)
+	}
+	ext := ConstraintExtension{ExtensionName: "foo@example.com", ExtensionDetails: []byte("x")}
+	if err := agent.AddSmartcardKey(SmartcardKey{
+		ReaderID:             "reader2",
+		LifetimeSecs:         30,
+		ConfirmBeforeUse:     true,
+		ConstraintExtensions: []ConstraintExtension{ext},
+	}); err != nil {
+		t.Fatalf("AddSmartcardKey constrained: %v", err)
+	}
+	if err := agent.RemoveSmartcardKey("reader2", []byte("0000")); err == nil {
+		t.Error("RemoveSmartcardKey succeeded with the wrong PIN")
+	}
+	if err := agent.RemoveSmartcardKey("reader2", []byte("1234")); err != nil {
+		t.Fatalf("RemoveSmartcardKey: %v", err)
+	}
+
+	if len(sc.added) != 2 {
+		t.Fatalf("got %d added, want 2", len(sc.added))
+	}
+	if k := sc.added[0]; k.ReaderID != "/usr/lib/opensc-pkcs11.so" || string(k.PIN) != "1234" || k.LifetimeSecs != 0 || k.ConfirmBeforeUse {
+		t.Errorf("got %+v", k)
+	}
+	if k := sc.added[1]; k.ReaderID != "reader2" || k.LifetimeSecs != 30 || !k.ConfirmBeforeUse ||
+		len(k.ConstraintExtensions) != 1 || k.ConstraintExtensions[0].ExtensionName != ext.ExtensionName {
+		t.Errorf("got %+v", k)
+	}
+	if len(sc.removed) != 1 || sc.removed[0] != "reader2" {
+		t.Errorf("got removed %q", sc.removed)
+	}
+
+	// A plain keyring has no smartcard support.
+	keyring, cleanup := startKeyringAgent(t)
+	defer cleanup()
+	if err := keyring.(SmartcardAgent).AddSmartcardKey(SmartcardKey{ReaderID: "reader"}); err == nil {
+		t.Error("keyring accepted a smartcard key")
+	}
+}
+
 func TestAgent(t *testing.T) {
 	for _, keyType := range []string{"rsa", "dsa", "ecdsa", "ed25519"} {
 		testOpenSSHAgent(t, testPrivateKeys[keyType], nil, 0)
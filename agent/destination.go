@@ -0,0 +1,363 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// The OpenSSH agent extensions for restricting where keys may be
+// used. See [PROTOCOL.agent], "agent key constraint extensions" and
+// "session-bind@openssh.com extension".
+const (
+	sessionBindExtension       = "session-bind@openssh.com"
+	restrictDestinationExtName = "restrict-destination-v00@openssh.com"
+
+	// maxSessionBindings caps the hops recorded on a single agent
+	// connection, like OpenSSH's AGENT_MAX_SESSION_IDS.
+	maxSessionBindings = 16
+)
+
+// KeySpec identifies a host key in a DestinationHop. If IsCA is set,
+// Key is a certificate authority, and any host certificate it signed
+// matches.
+type KeySpec struct {
+	Key  ssh.PublicKey
+	IsCA bool
+}
+
+// DestinationHop describes one end of a hop. An empty Hostname in
+// DestinationConstraint.From stands for the machine the agent runs
+// on. User, which only applies to DestinationConstraint.To, limits
+// the user names that may be authenticated; empty means any.
+type DestinationHop struct {
+	User     string
+	Hostname string
+	HostKeys []KeySpec
+}
+
+// DestinationConstraint permits the use of a key to go from the
+// host From to the host To, as with ssh-add -h.
+type DestinationConstraint struct {
+	From DestinationHop
+	To   DestinationHop
+}
+
+// RestrictDestination returns the constraint extension that limits
+// a key to the given hops, for AddedKey.ConstraintExtensions. Keys
+// with this constraint can only sign user authentications on agent
+// connections bound with session-bind@openssh.com, see
+// SessionBindCallback.
+func RestrictDestination(constraints ...DestinationConstraint) ConstraintExtension {
+	var list []byte
+	for _, c := range constraints {
+		// Each constraint is a string of its own.
+		list = append(list, ssh.Marshal(struct {
+			Constraint []byte
+		}{ssh.Marshal(struct {
+			From, To, Reserved []byte
+		}{marshalHop(c.From), marshalHop(c.To), nil})})...)
+	}
+	return ConstraintExtension{
+		ExtensionName:    restrictDestinationExtName,
+		ExtensionDetails: list,
+	}
+}
+
+func marshalHop(h DestinationHop) []byte {
+	b := ssh.Marshal(struct {
+		User, Hostname string
+		Reserved       []byte
+	}{h.User, h.Hostname, nil})
+	for _, k := range h.HostKeys {
+		b = append(b, ssh.Marshal(struct {
+			Blob []byte
+			IsCA bool
+		}{k.Key.Marshal(), k.IsCA})...)
+	}
+	return b
+}
+
+// parseDestinationConstraints parses the details of a
+// restrict-destination-v00@openssh.com constraint.
+func parseDestinationConstraints(details []byte) ([]DestinationConstraint, error) {
+	var cs []DestinationConstraint
+	for len(details) > 0 {
+		var wrapped struct {
+			Constraint []byte
+			Rest       []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(details, &wrapped); err != nil {
+			return nil, err
+		}
+		var msg struct {
+			From, To, Reserved []byte
+		}
+		if err := ssh.Unmarshal(wrapped.Constraint, &msg); err != nil {
+			return nil, err
+		}
+		from, err := parseHop(msg.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseHop(msg.To)
+		if err != nil {
+			return nil, err
+		}
+		if from.User != "" {
+			return nil, errors.New("agent: user name in the from hop of a destination constraint")
+		}
+		if to.Hostname == "" {
+			return nil, errors.New("agent: destination constraint without a destination")
+		}
+		cs = append(cs, DestinationConstraint{From: from, To: to})
+		details = wrapped.Rest
+	}
+	if len(cs) == 0 {
+		return nil, errors.New("agent: empty destination constraint")
+	}
+	return cs, nil
+}
+
+func parseHop(b []byte) (DestinationHop, error) {
+	var msg struct {
+		User, Hostname string
+		Reserved       []byte
+		Rest           []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(b, &msg); err != nil {
+		return DestinationHop{}, err
+	}
+	h := DestinationHop{User: msg.User, Hostname: msg.Hostname}
+	for rest := msg.Rest; len(rest) > 0; {
+		var k struct {
+			Blob []byte
+			IsCA bool
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &k); err != nil {
+			return DestinationHop{}, err
+		}
+		key, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return DestinationHop{}, err
+		}
+		h.HostKeys = append(h.HostKeys, KeySpec{Key: key, IsCA: k.IsCA})
+		rest = k.Rest
+	}
+	if h.Hostname != "" && len(h.HostKeys) == 0 {
+		return DestinationHop{}, fmt.Errorf("agent: no host keys for %q in destination constraint", h.Hostname)
+	}
+	return h, nil
+}
+
+// matches reports whether key, a host key or host certificate, is
+// listed for the hop.
+func (h *DestinationHop) matches(key ssh.PublicKey) bool {
+	cert, isCert := key.(*ssh.Certificate)
+	for _, k := range h.HostKeys {
+		if k.IsCA && isCert && cert.CertType == ssh.HostCert &&
+			bytes.Equal(cert.SignatureKey.Marshal(), k.Key.Marshal()) {
+			return true
+		}
+		if !k.IsCA && bytes.Equal(key.Marshal(), k.Key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionBinding is a hop recorded with session-bind@openssh.com.
+type sessionBinding struct {
+	hostKey    ssh.PublicKey
+	sessionID  []byte
+	forwarding bool
+}
+
+type sessionBindMsg struct {
+	HostKey    []byte
+	SessionID  []byte
+	Signature  []byte
+	Forwarding bool
+}
+
+// parseSessionBind parses and verifies a session-bind@openssh.com
+// request.
+func parseSessionBind(contents []byte) (sessionBinding, error) {
+	var msg sessionBindMsg
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return sessionBinding{}, err
+	}
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return sessionBinding{}, err
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(msg.Signature, &sig); err != nil {
+		return sessionBinding{}, err
+	}
+	if err := hostKey.Verify(msg.SessionID, &sig); err != nil {
+		return sessionBinding{}, fmt.Errorf("agent: session-bind signature: %v", err)
+	}
+	return sessionBinding{hostKey, msg.SessionID, msg.Forwarding}, nil
+}
+
+// addBinding records b, unless the same session was bound already.
+func addBinding(bindings []sessionBinding, b sessionBinding) ([]sessionBinding, error) {
+	for _, old := range bindings {
+		if bytes.Equal(old.sessionID, b.sessionID) {
+			if !bytes.Equal(old.hostKey.Marshal(), b.hostKey.Marshal()) {
+				return nil, errors.New("agent: session rebound to a different host key")
+			}
+			return bindings, nil
+		}
+	}
+	if len(bindings) >= maxSessionBindings {
+		return nil, errors.New("agent: too many session bindings")
+	}
+	return append(bindings, b), nil
+}
+
+// parseUserAuthRequest extracts the session ID and user name from
+// data, if it is a publickey SSH_MSG_USERAUTH_REQUEST to be signed.
+func parseUserAuthRequest(data []byte) (sessionID []byte, user string, ok bool) {
+	var msg struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PubKey    []byte
+	}
+	if err := ssh.Unmarshal(data, &msg); err != nil {
+		return nil, "", false
+	}
+	const msgUserAuthRequest = 50
+	if msg.Type != msgUserAuthRequest || msg.Method != "publickey" || !msg.HasSig {
+		return nil, "", false
+	}
+	return msg.SessionID, msg.User, true
+}
+
+// permittedHop reports whether a constraint in cs allows the hop
+// from the host with key from (nil for the local machine) to the
+// host with key to, logging in as user if checkUser is set.
+func permittedHop(cs []DestinationConstraint, from, to ssh.PublicKey, user string, checkUser bool) bool {
+	for _, c := range cs {
+		if from == nil {
+			if c.From.Hostname != "" || len(c.From.HostKeys) != 0 {
+				continue
+			}
+		} else if !c.From.matches(from) {
+			continue
+		}
+		if !c.To.matches(to) {
+			continue
+		}
+		if checkUser && c.To.User != "" && !wildcardMatch(c.To.User, user) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// checkDestination enforces destination constraints cs for signing
+// data on an agent connection with the given bindings, following
+// OpenSSH's ssh-agent: the key may only sign user authentication
+// requests for the last bound session, and every hop recorded on
+// the way there must be permitted.
+func checkDestination(cs []DestinationConstraint, bindings []sessionBinding, data []byte) error {
+	if len(cs) == 0 {
+		return nil
+	}
+	if len(bindings) == 0 {
+		return errors.New("agent: destination-constrained key used on an unbound connection")
+	}
+	sessionID, user, ok := parseUserAuthRequest(data)
+	if !ok {
+		return errors.New("agent: destination-constrained key used to sign something other than user authentication")
+	}
+	last := bindings[len(bindings)-1]
+	if last.forwarding {
+		return errors.New("agent: user authentication on a forwarding session")
+	}
+	if !bytes.Equal(sessionID, last.sessionID) {
+		return errors.New("agent: user authentication for an unbound session")
+	}
+	if !permittedPath(cs, bindings, user, true) {
+		return errors.New("agent: destination not permitted for key")
+	}
+	return nil
+}
+
+// permittedPath reports whether cs allows every hop in bindings.
+// Only the last hop may be a session that is not forwarding the
+// agent, and the user is checked against it if checkUser is set.
+func permittedPath(cs []DestinationConstraint, bindings []sessionBinding, user string, checkUser bool) bool {
+	var from ssh.PublicKey
+	for i, b := range bindings {
+		isLast := i == len(bindings)-1
+		if !isLast && !b.forwarding {
+			return false
+		}
+		if !permittedHop(cs, from, b.hostKey, user, checkUser && isLast) {
+			return false
+		}
+		from = b.hostKey
+	}
+	return true
+}
+
+// wildcardMatch matches str against pat, in which '*' matches any
+// sequence and '?' any single character, as in OpenSSH patterns.
+func wildcardMatch(pat, str string) bool {
+	for len(pat) > 0 {
+		switch pat[0] {
+		case '*':
+			for i := len(str); i >= 0; i-- {
+				if wildcardMatch(pat[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+		default:
+			if len(str) == 0 || str[0] != pat[0] {
+				return false
+			}
+		}
+		pat, str = pat[1:], str[1:]
+	}
+	return len(str) == 0
+}
+
+// SessionBindCallback returns a callback for
+// ssh.ClientConfig.SessionBindCallback that binds agent to the
+// session, as ssh does before using an agent for user
+// authentication. Agents that do not support the extension are
+// left unbound.
+func SessionBindCallback(agent Agent) func(hostKey ssh.PublicKey, sessionID, signature []byte) error {
+	return func(hostKey ssh.PublicKey, sessionID, signature []byte) error {
+		ext, ok := agent.(ExtendedAgent)
+		if !ok {
+			return nil
+		}
+		_, err := ext.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+			HostKey:   hostKey.Marshal(),
+			SessionID: sessionID,
+			Signature: signature,
+		}))
+		if err == ErrExtensionUnsupported {
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,210 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	ssh "github.com/glycerine/xcryptossh"
+)
+
+// userAuthData returns the data signed for a publickey user
+// authentication of user with key in session sessionID.
+func userAuthData(sessionID []byte, user string, key ssh.PublicKey) []byte {
+	return ssh.Marshal(struct {
+		SessionID []byte
+		Type      byte
+		User      string
+		Service   string
+		Method    string
+		HasSig    bool
+		Algo      string
+		PubKey    []byte
+	}{sessionID, 50, user, "ssh-connection", "publickey", true, key.Type(), key.Marshal()})
+}
+
+// bindSession sends a session-bind@openssh.com request for a
+// session with the given host key.
+func bindSession(t *testing.T, agent ExtendedAgent, host ssh.Signer, sessionID []byte, forwarding bool) error {
+	sig, err := host.Sign(rand.Reader, sessionID)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	_, err = agent.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+		HostKey:    host.PublicKey().Marshal(),
+		SessionID:  sessionID,
+		Signature:  ssh.Marshal(sig),
+		Forwarding: forwarding,
+	}))
+	return err
+}
+
+func TestRestrictDestinationRoundTrip(t *testing.T) {
+	want := []DestinationConstraint{
+		{To: DestinationHop{User: "git", Hostname: "a.example", HostKeys: []KeySpec{{Key: testPublicKeys["ecdsa"]}}}},
+		{
+			From: DestinationHop{Hostname: "a.example", HostKeys: []KeySpec{{Key: testPublicKeys["ecdsa"]}}},
+			To:   DestinationHop{Hostname: "*.example", HostKeys: []KeySpec{{Key: testPublicKeys["ca"], IsCA: true}}},
+		},
+	}
+	ext := RestrictDestination(want...)
+	if ext.ExtensionName != "restrict-destination-v00@openssh.com" {
+		t.Errorf("got extension name %q", ext.ExtensionName)
+	}
+	got, err := parseDestinationConstraints(ext.ExtensionDetails)
+	if err != nil {
+		t.Fatalf("parseDestinationConstraints: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d constraints, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(ssh.Marshal(RestrictDestination(got[i])), ssh.Marshal(RestrictDestination(want[i]))) {
+			t.Errorf("constraint %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := parseDestinationConstraints(RestrictDestination(DestinationConstraint{}).ExtensionDetails); err == nil {
+		t.Error("accepted a constraint without a destination")
+	}
+}
+
+// TestRestrictDestinationOpenSSH checks the encoding against the
+// constraint ssh-add sends for "ssh-add -h git@a.example", with the
+// ecdsa test key as the host key of a.example.
+func TestRestrictDestinationOpenSSH(t *testing.T) {
+	details, _ := hex.DecodeString("0000009d0000000c000000000000000000000000000000850000000367697400000009612e6578616d706c6500000000000000680000001365636473612d736861322d6e69737470323536000000086e6973747032353600000041048bd1ddc3a2af65c5b17e0d880e103b524a43b73cede99a895d2b0574b77e2b1e12dd2c787153beebf64e5d19cf98d0252d4aa34a152c501067806d2ed9fa84a80000000000")
+	want := DestinationConstraint{To: DestinationHop{
+		User:     "git",
+		Hostname: "a.example",
+		HostKeys: []KeySpec{{Key: testPublicKeys["ecdsa"]}},
+	}}
+
+	if got := RestrictDestination(want).ExtensionDetails; !bytes.Equal(got, details) {
+		t.Errorf("RestrictDestination: got %x, want %x", got, details)
+	}
+	got, err := parseDestinationConstraints(details)
+	if err != nil {
+		t.Fatalf("parseDestinationConstraints: %v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(ssh.Marshal(RestrictDestination(got[0])), ssh.Marshal(RestrictDestination(want))) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestSessionBindRestrictsKey(t *testing.T) {
+	hostA, hostB := testSigners["ecdsa"], testSigners["ed25519"]
+	userKey := testPublicKeys["rsa"]
+
+	keyring := NewKeyring()
+	err := keyring.Add(AddedKey{
+		PrivateKey: testPrivateKeys["rsa"],
+		ConstraintExtensions: []ConstraintExtension{RestrictDestination(DestinationConstraint{
+			To: DestinationHop{User: "git", Hostname: "a.example", HostKeys: []KeySpec{{Key: hostA.PublicKey()}}},
+		})},
+	})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := keyring.Sign(userKey, userAuthData([]byte("sid"), "git", userKey)); err == nil {
+		t.Error("destination-constrained key signed outside a bound connection")
+	}
+	if signers, _ := keyring.Signers(); len(signers) != 0 {
+		t.Errorf("got %d signers, want none", len(signers))
+	}
+
+	connect := func() (ExtendedAgent, func()) {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		go ServeAgent(keyring, c2)
+		return NewClient(c1).(ExtendedAgent), func() {
+			c1.Close()
+			c2.Close()
+		}
+	}
+
+	agent, done := connect()
+	if _, err := agent.Sign(userKey, userAuthData([]byte("sid"), "git", userKey)); err == nil {
+		t.Error("signed on an unbound connection")
+	}
+	if err := bindSession(t, agent, hostA, []byte("sid"), false); err != nil {
+		t.Fatalf("session-bind: %v", err)
+	}
+	if keys, err := agent.List(); err != nil || len(keys) != 1 {
+		t.Errorf("List: %v, %v", keys, err)
+	}
+	if _, err := agent.Sign(userKey, userAuthData([]byte("sid"), "git", userKey)); err != nil {
+		t.Errorf("Sign for a permitted destination: %v", err)
+	}
+	if _, err := agent.Sign(userKey, userAuthData([]byte("sid"), "root", userKey)); err == nil {
+		t.Error("signed for a user not permitted")
+	}
+	if _, err := agent.Sign(userKey, userAuthData([]byte("other"), "git", userKey)); err == nil {
+		t.Error("signed for an unbound session")
+	}
+	if _, err := agent.Sign(userKey, []byte("not a userauth request")); err == nil {
+		t.Error("signed arbitrary data")
+	}
+	done()
+
+	agent, done = connect()
+	defer done()
+	if err := bindSession(t, agent, hostB, []byte("sid2"), false); err != nil {
+		t.Fatalf("session-bind: %v", err)
+	}
+	if keys, err := agent.List(); err != nil || len(keys) != 0 {
+		t.Errorf("List for an unlisted destination: %v, %v", keys, err)
+	}
+	if _, err := agent.Sign(userKey, userAuthData([]byte("sid2"), "git", userKey)); err == nil {
+		t.Error("signed for a destination not permitted")
+	}
+}
+
+func TestSessionBindBadSignature(t *testing.T) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	go ServeAgent(NewKeyring(), c2)
+	agent := NewClient(c1).(ExtendedAgent)
+
+	sig, err := testSigners["ecdsa"].Sign(rand.Reader, []byte("sid"))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	_, err = agent.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+		HostKey:   testPublicKeys["ecdsa"].Marshal(),
+		SessionID: []byte("another sid"),
+		Signature: ssh.Marshal(sig),
+	}))
+	if err == nil || err == ErrExtensionUnsupported {
+		t.Errorf("got %v for a bad session-bind signature, want extension failure", err)
+	}
+
+	if _, err := agent.Extension("unknown@example.com", nil); err != ErrExtensionUnsupported {
+		t.Errorf("got %v for an unknown extension, want ErrExtensionUnsupported", err)
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, c := range []struct {
+		pat, str string
+		want     bool
+	}{
+		{"git", "git", true},
+		{"git", "gitx", false},
+		{"*", "", true},
+		{"g*t", "gist", true},
+		{"g?t", "gut", true},
+		{"g?t", "gt", false},
+	} {
+		if got := wildcardMatch(c.pat, c.str); got != c.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", c.pat, c.str, got, c.want)
+		}
+	}
+}
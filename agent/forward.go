@@ -29,11 +29,15 @@ func RequestAgentForwarding(session *ssh.Session) error {
 }
 
 // ForwardToAgent routes authentication requests to the given keyring.
+// If keyring came from NewKeyring, the forwarded connections are
+// bound to client's session, so keys added with RestrictDestination
+// are only usable for the hops they allow.
 func ForwardToAgent(ctx context.Context, client *ssh.Client, keyring Agent) error {
 	channels := client.HandleChannelOpen(channelType)
 	if channels == nil {
 		return errors.New("agent: already have handler for " + channelType)
 	}
+	binding, haveBinding := forwardedBinding(client)
 
 	go func() {
 		for ch := range channels {
@@ -43,7 +47,11 @@ func ForwardToAgent(ctx context.Context, client *ssh.Client, keyring Agent) erro
 			}
 			go ssh.DiscardRequests(ctx, reqs, client.Halt)
 			go func() {
-				ServeAgent(keyring, channel)
+				s := &server{agent: keyring}
+				if haveBinding {
+					s.bindings = []sessionBinding{binding}
+				}
+				serveAgent(s, channel)
 				channel.Close()
 			}()
 		}
@@ -73,18 +81,41 @@ func ForwardToRemote(ctx context.Context, client *ssh.Client, addr string) error
 				continue
 			}
 			go ssh.DiscardRequests(ctx, reqs, client.Halt)
-			go forwardUnixSocket(channel, addr)
+			go forwardUnixSocket(client, channel, addr)
 		}
 	}()
 	return nil
 }
 
-func forwardUnixSocket(channel ssh.Channel, addr string) {
+// forwardedBinding returns the session binding for agent
+// connections forwarded over client.
+func forwardedBinding(client *ssh.Client) (sessionBinding, bool) {
+	hostKey, _, err := client.SessionBinding()
+	if err != nil {
+		return sessionBinding{}, false
+	}
+	return sessionBinding{hostKey: hostKey, sessionID: client.SessionID(), forwarding: true}, true
+}
+
+func forwardUnixSocket(client *ssh.Client, channel ssh.Channel, addr string) {
 	conn, err := net.Dial("unix", addr)
 	if err != nil {
 		return
 	}
 
+	// Bind the connection to the session before handing it over.
+	// Agents that predate session-bind@openssh.com refuse it,
+	// which is fine.
+	if hostKey, sig, err := client.SessionBinding(); err == nil {
+		bind := NewClient(conn).(ExtendedAgent)
+		bind.Extension(sessionBindExtension, ssh.Marshal(sessionBindMsg{
+			HostKey:    hostKey.Marshal(),
+			SessionID:  client.SessionID(),
+			Signature:  sig,
+			Forwarding: true,
+		}))
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go func() {
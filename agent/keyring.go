@@ -10,6 +10,7 @@ import (
 	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -20,6 +21,11 @@ type privKey struct {
 	signer  ssh.Signer
 	comment string
 	expire  *time.Time
+	confirm bool
+
+	// dest lists the hops the key may be used for, if it was added
+	// with RestrictDestination.
+	dest []DestinationConstraint
 }
 
 type keyring struct {
@@ -28,16 +34,33 @@ type keyring struct {
 
 	locked     bool
 	passphrase []byte
+
+	// confirm, if non-nil, is asked before keys added with
+	// ConfirmBeforeUse are used.
+	confirm ConfirmFunc
 }
 
 var errLocked = errors.New("agent: locked")
 
+// ConfirmFunc is called before a key added with ConfirmBeforeUse
+// signs data, typically to ask the user, as ssh-agent does through
+// ssh-askpass for keys added with ssh-add -c. It returns true if
+// the signature may be made.
+type ConfirmFunc func(key ssh.PublicKey, comment string) bool
+
 // NewKeyring returns an Agent that holds keys in memory.  It is safe
-// for concurrent use by multiple goroutines.
+// for concurrent use by multiple goroutines. Keys added with
+// ConfirmBeforeUse are refused, see NewKeyringWithConfirm.
 func NewKeyring() Agent {
 	return &keyring{}
 }
 
+// NewKeyringWithConfirm is like NewKeyring, but accepts keys added
+// with ConfirmBeforeUse, and calls confirm before each use of them.
+func NewKeyringWithConfirm(confirm ConfirmFunc) Agent {
+	return &keyring{confirm: confirm}
+}
+
 // RemoveAll removes all identities.
 func (r *keyring) RemoveAll() error {
 	r.mu.Lock()
@@ -115,15 +138,37 @@ func (r *keyring) Unlock(passphrase []byte) error {
 // with a lifetimesecs contraint and seconds >= lifetimesecs seconds have
 // ellapsed, it is removed. The caller *must* be holding the keyring mutex.
 func (r *keyring) expireKeysLocked() {
+	now := time.Now()
+	kept := r.keys[:0]
 	for _, k := range r.keys {
-		if k.expire != nil && time.Now().After(*k.expire) {
-			r.removeLocked(k.signer.PublicKey().Marshal())
+		if k.expire == nil || !now.After(*k.expire) {
+			kept = append(kept, k)
 		}
 	}
+	for i := len(kept); i < len(r.keys); i++ {
+		r.keys[i] = privKey{}
+	}
+	r.keys = kept
+}
+
+// expireKeys sweeps expired keys, so their private halves are
+// dropped when their lifetime ends rather than on next use. It
+// runs even while the keyring is locked.
+func (r *keyring) expireKeys() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireKeysLocked()
 }
 
 // List returns the identities known to the agent.
 func (r *keyring) List() ([]*Key, error) {
+	return r.listBound(nil, false)
+}
+
+// listBound is List for an agent connection with the given session
+// bindings. Keys with destination constraints that do not allow the
+// bound hops are left out.
+func (r *keyring) listBound(bindings []sessionBinding, bindFailed bool) ([]*Key, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
@@ -134,6 +179,9 @@ func (r *keyring) List() ([]*Key, error) {
 	r.expireKeysLocked()
 	var ids []*Key
 	for _, k := range r.keys {
+		if len(k.dest) > 0 && (bindFailed || !permittedPath(k.dest, bindings, "", false)) {
+			continue
+		}
 		pub := k.signer.PublicKey()
 		ids = append(ids, &Key{
 			Format:  pub.Type(),
@@ -144,14 +192,30 @@ func (r *keyring) List() ([]*Key, error) {
 }
 
 // Insert adds a private key to the keyring. If a certificate
-// is given, that certificate is added as public key. Note that
-// any constraints given are ignored.
+// is given, that certificate is added as public key. Keys with a
+// lifetime are removed when it expires. ConfirmBeforeUse is only
+// accepted by keyrings with a ConfirmFunc. The only constraint
+// extension supported is RestrictDestination.
 func (r *keyring) Add(key AddedKey) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
 		return errLocked
 	}
+	if key.ConfirmBeforeUse && r.confirm == nil {
+		return errors.New("agent: confirmation not supported by this keyring")
+	}
+	var dest []DestinationConstraint
+	for _, ext := range key.ConstraintExtensions {
+		if ext.ExtensionName != restrictDestinationExtName {
+			return fmt.Errorf("agent: unsupported constraint extension %q", ext.ExtensionName)
+		}
+		cs, err := parseDestinationConstraints(ext.ExtensionDetails)
+		if err != nil {
+			return err
+		}
+		dest = append(dest, cs...)
+	}
 	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
 
 	if err != nil {
@@ -168,11 +232,16 @@ func (r *keyring) Add(key AddedKey) error {
 	p := privKey{
 		signer:  signer,
 		comment: key.Comment,
+		confirm: key.ConfirmBeforeUse,
+		dest:    dest,
 	}
 
 	if key.LifetimeSecs > 0 {
-		t := time.Now().Add(time.Duration(key.LifetimeSecs) * time.Second)
+		lifetime := time.Duration(key.LifetimeSecs) * time.Second
+		t := time.Now().Add(lifetime)
 		p.expire = &t
+		// Sweep just after expiry, so the After check holds.
+		time.AfterFunc(lifetime+time.Millisecond, r.expireKeys)
 	}
 
 	r.keys = append(r.keys, p)
@@ -180,8 +249,16 @@ func (r *keyring) Add(key AddedKey) error {
 	return nil
 }
 
-// Sign returns a signature for the data.
+// Sign returns a signature for the data. Keys with destination
+// constraints can only sign through ServeAgent, on a connection
+// bound with session-bind@openssh.com.
 func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return r.signBound(key, data, nil, false)
+}
+
+// signBound is Sign for an agent connection with the given session
+// bindings.
+func (r *keyring) signBound(key ssh.PublicKey, data []byte, bindings []sessionBinding, bindFailed bool) (*ssh.Signature, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if r.locked {
@@ -192,13 +269,55 @@ func (r *keyring) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 	wanted := key.Marshal()
 	for _, k := range r.keys {
 		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			if len(k.dest) > 0 {
+				if bindFailed {
+					return nil, errors.New("agent: session bind failed on this connection")
+				}
+				if err := checkDestination(k.dest, bindings, data); err != nil {
+					return nil, err
+				}
+			}
+			if k.confirm {
+				if !r.confirmUnlocked(k) {
+					return nil, errors.New("agent: use of key not confirmed")
+				}
+				if r.locked {
+					return nil, errLocked
+				}
+				// The key may have been removed, or have
+				// expired, while the mutex was released.
+				r.expireKeysLocked()
+				if !r.hasKeyLocked(wanted) {
+					return nil, errors.New("agent: key removed while awaiting confirmation")
+				}
+			}
 			return k.signer.Sign(rand.Reader, data)
 		}
 	}
 	return nil, errors.New("not found")
 }
 
-// Signers returns signers for all the known keys.
+// confirmUnlocked calls the ConfirmFunc for k. It releases the
+// keyring mutex meanwhile, since confirmation can wait on a user.
+func (r *keyring) confirmUnlocked(k privKey) bool {
+	r.mu.Unlock()
+	defer r.mu.Lock()
+	return r.confirm(k.signer.PublicKey(), k.comment)
+}
+
+// hasKeyLocked reports whether the keyring holds the key with the
+// given wire form.
+func (r *keyring) hasKeyLocked(wanted []byte) bool {
+	for _, k := range r.keys {
+		if bytes.Equal(k.signer.PublicKey().Marshal(), wanted) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signers returns signers for all the known keys, except those with
+// destination constraints, which cannot sign outside ServeAgent.
 func (r *keyring) Signers() ([]ssh.Signer, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -209,7 +328,31 @@ func (r *keyring) Signers() ([]ssh.Signer, error) {
 	r.expireKeysLocked()
 	s := make([]ssh.Signer, 0, len(r.keys))
 	for _, k := range r.keys {
+		if len(k.dest) > 0 {
+			continue
+		}
+		if k.confirm {
+			s = append(s, &confirmSigner{k, r.confirm})
+			continue
+		}
 		s = append(s, k.signer)
 	}
 	return s, nil
 }
+
+// confirmSigner asks for confirmation before each signature.
+type confirmSigner struct {
+	key     privKey
+	confirm ConfirmFunc
+}
+
+func (s *confirmSigner) PublicKey() ssh.PublicKey {
+	return s.key.signer.PublicKey()
+}
+
+func (s *confirmSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if !s.confirm(s.key.signer.PublicKey(), s.key.comment) {
+		return nil, errors.New("agent: use of key not confirmed")
+	}
+	return s.key.signer.Sign(rand, data)
+}
@@ -4,7 +4,12 @@
 
 package agent
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
 
 func addTestKey(t *testing.T, a Agent, keyName string) {
 	err := a.Add(AddedKey{
@@ -74,3 +79,81 @@ func TestKeyringAddingAndRemoving(t *testing.T) {
 	}
 	validateListedKeys(t, k, []string{})
 }
+
+func TestKeyringLifetimeSweep(t *testing.T) {
+	k := NewKeyring().(*keyring)
+	if err := k.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"], LifetimeSecs: 1}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	addTestKey(t, k, "rsa")
+
+	// Look at the keys directly, since List would expire them
+	// itself.
+	time.Sleep(1200 * time.Millisecond)
+	k.mu.Lock()
+	n := len(k.keys)
+	k.mu.Unlock()
+	if n != 1 {
+		t.Errorf("got %d keys after lifetime ended, want 1", n)
+	}
+	validateListedKeys(t, k, []string{"rsa"})
+}
+
+func TestKeyringConfirm(t *testing.T) {
+	key := AddedKey{PrivateKey: testPrivateKeys["ecdsa"], Comment: "ecdsa", ConfirmBeforeUse: true}
+	if err := NewKeyring().Add(key); err == nil {
+		t.Error("keyring without ConfirmFunc accepted ConfirmBeforeUse")
+	}
+
+	allow := false
+	var asked []string
+	k := NewKeyringWithConfirm(func(pub ssh.PublicKey, comment string) bool {
+		asked = append(asked, comment)
+		return allow
+	})
+	if err := k.Add(key); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	pub := testPublicKeys["ecdsa"]
+	data := []byte("data")
+	if _, err := k.Sign(pub, data); err == nil {
+		t.Error("Sign succeeded although confirmation was denied")
+	}
+	allow = true
+	sig, err := k.Sign(pub, data)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := pub.Verify(data, sig); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	signers, err := k.Signers()
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("Signers: %v, %v", signers, err)
+	}
+	allow = false
+	if _, err := signers[0].Sign(nil, data); err == nil {
+		t.Error("signer from Signers skipped confirmation")
+	}
+	if len(asked) != 3 || asked[0] != "ecdsa" {
+		t.Errorf("got confirmations %q, want 3 for ecdsa", asked)
+	}
+}
+
+func TestKeyringRemoveDuringConfirm(t *testing.T) {
+	pub := testPublicKeys["ecdsa"]
+	var k Agent
+	k = NewKeyringWithConfirm(func(ssh.PublicKey, string) bool {
+		if err := k.Remove(pub); err != nil {
+			t.Errorf("Remove: %v", err)
+		}
+		return true
+	})
+	if err := k.Add(AddedKey{PrivateKey: testPrivateKeys["ecdsa"], ConfirmBeforeUse: true}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := k.Sign(pub, []byte("data")); err == nil {
+		t.Error("Sign succeeded with a key removed during confirmation")
+	}
+}
@@ -24,21 +24,46 @@ import (
 // the SSH-agent, wire protocol.
 type server struct {
 	agent Agent
+
+	// bindings are the sessions this connection was bound to with
+	// session-bind@openssh.com, oldest first.
+	bindings []sessionBinding
+
+	// bindFailed is set once a session-bind was refused; keys with
+	// destination constraints are unusable from then on.
+	bindFailed bool
+}
+
+var errSmartcardUnsupported = errors.New("agent: smartcard keys not supported by this agent")
+
+// extensionError is a failure of a supported extension, which is
+// answered with SSH_AGENT_EXTENSION_FAILURE.
+type extensionError struct {
+	err error
 }
 
+func (e extensionError) Error() string { return e.err.Error() }
+
 func (s *server) processRequestBytes(reqData []byte) []byte {
 	rep, err := s.processRequest(reqData)
 	if err != nil {
-		if err != errLocked {
+		if err != errLocked && err != ErrExtensionUnsupported {
 			// TODO(hanwen): provide better logging interface?
 			log.Printf("agent %d: %v", reqData[0], err)
 		}
+		if _, ok := err.(extensionError); ok {
+			return []byte{agentExtensionFailure}
+		}
 		return []byte{agentFailure}
 	}
 
 	if err == nil && rep == nil {
 		return []byte{agentSuccess}
 	}
+	if raw, ok := rep.([]byte); ok {
+		// Extension replies are passed on as is.
+		return raw
+	}
 
 	return ssh.Marshal(rep)
 }
@@ -128,14 +153,26 @@ func (s *server) processRequest(data []byte) (interface{}, error) {
 			Blob:   req.KeyBlob,
 		}
 
-		sig, err := s.agent.Sign(k, req.Data) //  TODO(hanwen): flags.
+		var sig *ssh.Signature
+		var err error
+		if r, ok := s.agent.(*keyring); ok {
+			sig, err = r.signBound(k, req.Data, s.bindings, s.bindFailed)
+		} else {
+			sig, err = s.agent.Sign(k, req.Data) //  TODO(hanwen): flags.
+		}
 		if err != nil {
 			return nil, err
 		}
 		return &signResponseAgentMsg{SigBlob: ssh.Marshal(sig)}, nil
 
 	case agentRequestIdentities:
-		keys, err := s.agent.List()
+		var keys []*Key
+		var err error
+		if r, ok := s.agent.(*keyring); ok {
+			keys, err = r.listBound(s.bindings, s.bindFailed)
+		} else {
+			keys, err = s.agent.List()
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -150,6 +187,45 @@ func (s *server) processRequest(data []byte) (interface{}, error) {
 
 	case agentAddIdConstrained, agentAddIdentity:
 		return nil, s.insertIdentity(data)
+
+	case agentAddSmartcardKey, agentAddSmartcardKeyConstrained:
+		var req addSmartcardKeyAgentMsg
+		if err := ssh.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		sc, ok := s.agent.(SmartcardAgent)
+		if !ok {
+			return nil, errSmartcardUnsupported
+		}
+		lifetimeSecs, confirmBeforeUse, extensions, err := parseConstraints(req.Constraints)
+		if err != nil {
+			return nil, err
+		}
+		return nil, sc.AddSmartcardKey(SmartcardKey{
+			ReaderID:             req.ReaderID,
+			PIN:                  req.PIN,
+			LifetimeSecs:         lifetimeSecs,
+			ConfirmBeforeUse:     confirmBeforeUse,
+			ConstraintExtensions: extensions,
+		})
+
+	case agentRemoveSmartcardKey:
+		var req removeSmartcardKeyAgentMsg
+		if err := ssh.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		sc, ok := s.agent.(SmartcardAgent)
+		if !ok {
+			return nil, errSmartcardUnsupported
+		}
+		return nil, sc.RemoveSmartcardKey(req.ReaderID, req.PIN)
+
+	case agentExtension:
+		var req extensionAgentMsg
+		if err := ssh.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		return s.extension(req.ExtensionType, req.Contents)
 	}
 
 	return nil, fmt.Errorf("unknown opcode %d", data[0])
@@ -159,12 +235,15 @@ func parseConstraints(constraints []byte) (lifetimeSecs uint32, confirmBeforeUse
 	for len(constraints) != 0 {
 		switch constraints[0] {
 		case agentConstrainLifetime:
+			if len(constraints) < 5 {
+				return 0, false, nil, errors.New("agent: truncated lifetime constraint")
+			}
 			lifetimeSecs = binary.BigEndian.Uint32(constraints[1:5])
 			constraints = constraints[5:]
 		case agentConstrainConfirm:
 			confirmBeforeUse = true
 			constraints = constraints[1:]
-		case agentConstrainExtension:
+		case agentConstrainExtension, agentConstrainExtensionV00:
 			var msg constrainExtensionAgentMsg
 			if err = ssh.Unmarshal(constraints, &msg); err != nil {
 				return 0, false, nil, err
@@ -486,11 +565,46 @@ func (s *server) insertIdentity(req []byte) error {
 	return s.agent.Add(*addedKey)
 }
 
+// extension handles an SSH_AGENTC_EXTENSION request. Keyrings from
+// NewKeyring handle session-bind@openssh.com themselves; other
+// extensions go to the agent if it is an ExtendedAgent.
+func (s *server) extension(extensionType string, contents []byte) (interface{}, error) {
+	if _, ok := s.agent.(*keyring); ok && extensionType == sessionBindExtension {
+		b, err := parseSessionBind(contents)
+		if err == nil {
+			s.bindings, err = addBinding(s.bindings, b)
+		}
+		if err != nil {
+			s.bindFailed = true
+			return nil, extensionError{err}
+		}
+		return nil, nil
+	}
+
+	ext, ok := s.agent.(ExtendedAgent)
+	if !ok {
+		return nil, ErrExtensionUnsupported
+	}
+	rep, err := ext.Extension(extensionType, contents)
+	if err == ErrExtensionUnsupported {
+		return nil, err
+	}
+	if err != nil {
+		return nil, extensionError{err}
+	}
+	if rep == nil {
+		return nil, nil
+	}
+	return rep, nil
+}
+
 // ServeAgent serves the agent protocol on the given connection. It
 // returns when an I/O error occurs.
 func ServeAgent(agent Agent, c io.ReadWriter) error {
-	s := &server{agent}
+	return serveAgent(&server{agent: agent}, c)
+}
 
+func serveAgent(s *server, c io.ReadWriter) error {
 	var length [4]byte
 	for {
 		if _, err := io.ReadFull(c, length[:]); err != nil {
@@ -0,0 +1,193 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errAuthSkipped is returned by an AuthMethod that has nothing to
+// try, so that clientAuthenticate moves on to the next one without
+// counting its method as tried.
+var errAuthSkipped = errors.New("ssh: authentication method skipped")
+
+// The few messages of the agent protocol that AgentAuth needs, from
+// draft-miller-ssh-agent. The agent package has the full protocol,
+// but it depends on this package.
+const (
+	agentFailure           = 5
+	agentRequestIdentities = 11
+	agentIdentitiesAnswer  = 12
+	agentSignRequest       = 13
+	agentSignResponse      = 14
+
+	// The flags of a sign request that ask for the RSA signatures
+	// of RFC 8332 rather than ssh-rsa.
+	agentRSASHA2256 = 2
+	agentRSASHA2512 = 4
+
+	// maxAgentResponse bounds the replies read from the agent, as
+	// the agent package does.
+	maxAgentResponse = 16 << 20
+)
+
+type agentIdentitiesAnswerMsg struct {
+	NumKeys uint32 `sshtype:"12"`
+	Keys    []byte `ssh:"rest"`
+}
+
+type agentSignRequestMsg struct {
+	KeyBlob []byte `sshtype:"13"`
+	Data    []byte
+	Flags   uint32
+}
+
+type agentSignResponseMsg struct {
+	SigBlob []byte `sshtype:"14"`
+}
+
+// AgentAuth returns an AuthMethod that authenticates with the keys
+// of the local SSH agent, found as ssh(1) finds it: through
+// SSH_AUTH_SOCK, which on Windows may name the pipe of Pageant, and
+// on Windows, when that is unset, the named pipe of the OpenSSH
+// agent service. The agent is only contacted when the server asks
+// for public keys, and the connection to it is closed once
+// authentication is done with it.
+//
+// If there is no agent, or it holds no keys, the method steps aside
+// for the next AuthMethod in ClientConfig.Auth, even another
+// PublicKeys one, rather than failing.
+func AgentAuth() AuthMethod {
+	return agentAuth{}
+}
+
+type agentAuth struct{}
+
+func (agentAuth) method() string {
+	return "publickey"
+}
+
+func (agentAuth) auth(ctx context.Context, session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+	conn, err := dialAgent()
+	if err != nil {
+		return false, nil, errAuthSkipped
+	}
+	defer conn.Close()
+	signers, err := agentSigners(conn)
+	if err != nil || len(signers) == 0 {
+		return false, nil, errAuthSkipped
+	}
+	return publicKeyCallback(func() ([]Signer, error) {
+		return signers, nil
+	}).auth(ctx, session, user, c, rand)
+}
+
+// agentCall sends req to the agent on rw, and returns its reply.
+func agentCall(rw io.ReadWriter, req []byte) ([]byte, error) {
+	msg := make([]byte, 4+len(req))
+	binary.BigEndian.PutUint32(msg, uint32(len(req)))
+	copy(msg[4:], req)
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(rw, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n == 0 || n > maxAgentResponse {
+		return nil, fmt.Errorf("ssh: agent reply of %d bytes", n)
+	}
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] == agentFailure {
+		return nil, errors.New("ssh: agent refused the request")
+	}
+	return reply, nil
+}
+
+// agentSigners lists the keys of the agent on rw, as Signers that
+// sign through it.
+func agentSigners(rw io.ReadWriter) ([]Signer, error) {
+	reply, err := agentCall(rw, []byte{agentRequestIdentities})
+	if err != nil {
+		return nil, err
+	}
+	var answer agentIdentitiesAnswerMsg
+	if err := Unmarshal(reply, &answer); err != nil {
+		return nil, err
+	}
+	var signers []Signer
+	rest := answer.Keys
+	for i := uint32(0); i < answer.NumKeys; i++ {
+		var blob []byte
+		var ok bool
+		if blob, rest, ok = parseString(rest); !ok {
+			return nil, parseError(agentIdentitiesAnswer)
+		}
+		if _, rest, ok = parseString(rest); !ok { // comment
+			return nil, parseError(agentIdentitiesAnswer)
+		}
+		pub, err := ParsePublicKey(blob)
+		if err != nil {
+			// A key type this package does not know.
+			continue
+		}
+		signers = append(signers, &agentSigner{rw: rw, pub: pub})
+	}
+	return signers, nil
+}
+
+// agentSigner is a key held by an agent.
+type agentSigner struct {
+	rw  io.ReadWriter
+	pub PublicKey
+}
+
+func (s *agentSigner) PublicKey() PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+// SignWithAlgorithm asks the agent for a signature with algorithm,
+// which for RSA keys may be one of RFC 8332.
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	var flags uint32
+	switch {
+	case algorithm == "" || algorithm == s.pub.Type():
+	case algorithm == SigAlgoRSASHA2256 && s.pub.Type() == KeyAlgoRSA:
+		flags = agentRSASHA2256
+	case algorithm == SigAlgoRSASHA2512 && s.pub.Type() == KeyAlgoRSA:
+		flags = agentRSASHA2512
+	default:
+		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for key type %s", algorithm, s.pub.Type())
+	}
+	reply, err := agentCall(s.rw, Marshal(&agentSignRequestMsg{
+		KeyBlob: s.pub.Marshal(),
+		Data:    data,
+		Flags:   flags,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	var resp agentSignResponseMsg
+	if err := Unmarshal(reply, &resp); err != nil {
+		return nil, err
+	}
+	sig, _, ok := parseSignatureBody(resp.SigBlob)
+	if !ok {
+		return nil, parseError(agentSignResponse)
+	}
+	if flags != 0 && sig.Format != algorithm {
+		// An agent that predates the flags ignores them.
+		return nil, fmt.Errorf("ssh: agent signed with %s, not %s", sig.Format, algorithm)
+	}
+	return sig, nil
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package ssh
+
+import (
+	"errors"
+	"io"
+)
+
+// dialAgent fails: there is no agent to find on this platform.
+func dialAgent() (io.ReadWriteCloser, error) {
+	return nil, errors.New("ssh: no SSH agent on this platform")
+}
@@ -0,0 +1,200 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveFakeAgent answers identity and sign requests for signer on
+// conn, as an agent would, and sends the flags of the sign requests
+// on flags, if it is not nil.
+func serveFakeAgent(conn net.Conn, signer AlgorithmSigner, flags chan<- uint32) {
+	defer conn.Close()
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(conn, head[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(head[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		reply := []byte{agentFailure}
+		switch req[0] {
+		case agentRequestIdentities:
+			var keys []byte
+			keys = appendString(keys, string(signer.PublicKey().Marshal()))
+			keys = appendString(keys, "test key")
+			reply = Marshal(&agentIdentitiesAnswerMsg{NumKeys: 1, Keys: keys})
+		case agentSignRequest:
+			var msg agentSignRequestMsg
+			if Unmarshal(req, &msg) == nil {
+				if flags != nil {
+					flags <- msg.Flags
+				}
+				algo := ""
+				switch msg.Flags {
+				case agentRSASHA2256:
+					algo = SigAlgoRSASHA2256
+				case agentRSASHA2512:
+					algo = SigAlgoRSASHA2512
+				}
+				if sig, err := signer.SignWithAlgorithm(rand.Reader, msg.Data, algo); err == nil {
+					reply = Marshal(&agentSignResponseMsg{SigBlob: Marshal(sig)})
+				}
+			}
+		}
+		conn.Write(appendU32(nil, uint32(len(reply))))
+		conn.Write(reply)
+	}
+}
+
+// setAuthSock points SSH_AUTH_SOCK at path, and returns a function
+// that restores it.
+func setAuthSock(path string) func() {
+	old, had := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", path)
+	return func() {
+		if had {
+			os.Setenv("SSH_AUTH_SOCK", old)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	dir, err := ioutil.TempDir("", "sshagent")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeAgent(conn, testSigners["rsa"].(AlgorithmSigner), nil)
+		}
+	}()
+	defer setAuthSock(path)()
+
+	config := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{AgentAuth()},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("AgentAuth with the key in the agent: %v", err)
+	}
+}
+
+func TestAgentAuthNoAgent(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	defer setAuthSock(filepath.Join(os.TempDir(), "no-such-agent"))()
+	config := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{AgentAuth(), PublicKeys(testSigners["rsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("PublicKeys after AgentAuth without an agent: %v", err)
+	}
+}
+
+func TestAgentAuthRSASHA2(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	a, b := net.Pipe()
+	flags := make(chan uint32, 1)
+	go serveFakeAgent(b, testSigners["rsa"].(AlgorithmSigner), flags)
+	defer a.Close()
+	signers, err := agentSigners(a)
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("agentSigners: %v, %v", signers, err)
+	}
+	signer, ok := signers[0].(AlgorithmSigner)
+	if !ok {
+		t.Fatalf("%T is not an AlgorithmSigner", signers[0])
+	}
+	for _, tc := range []struct {
+		algo  string
+		flags uint32
+	}{
+		{"", 0},
+		{SigAlgoRSA, 0},
+		{SigAlgoRSASHA2256, agentRSASHA2256},
+		{SigAlgoRSASHA2512, agentRSASHA2512},
+	} {
+		sig, err := signer.SignWithAlgorithm(rand.Reader, []byte("data"), tc.algo)
+		if err != nil {
+			t.Fatalf("SignWithAlgorithm(%q): %v", tc.algo, err)
+		}
+		if got := <-flags; got != tc.flags {
+			t.Errorf("SignWithAlgorithm(%q) sent flags %d, want %d", tc.algo, got, tc.flags)
+		}
+		want := tc.algo
+		if want == "" {
+			want = SigAlgoRSA
+		}
+		if sig.Format != want {
+			t.Errorf("SignWithAlgorithm(%q) signed with %s", tc.algo, sig.Format)
+		}
+	}
+	if _, err := signer.SignWithAlgorithm(rand.Reader, []byte("data"), KeyAlgoED25519); err == nil {
+		t.Error("SignWithAlgorithm with the algorithm of another key type succeeded")
+	}
+
+	// A server that takes RSA keys only with SHA-256 signatures.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			return nil, nil
+		},
+		PublicKeyAuthAlgorithms: []string{SigAlgoRSASHA2256},
+		Config:                  Config{Halt: NewHalter()},
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	defer serverConf.Halt.RequestStop()
+	ctx := context.Background()
+	go newServer(ctx, c1, serverConf)
+
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(signers...)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	if _, _, _, err := NewClientConn(ctx, c2, "", clientConf); err != nil {
+		t.Fatalf("auth with an agent key to an rsa-sha2-256 only server: %v", err)
+	}
+	if got := <-flags; got != agentRSASHA2256 {
+		t.Errorf("auth sent flags %d, want %d", got, agentRSASHA2256)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// dialAgent connects to the agent named by SSH_AUTH_SOCK.
+func dialAgent() (io.ReadWriteCloser, error) {
+	path := os.Getenv("SSH_AUTH_SOCK")
+	if path == "" {
+		return nil, errors.New("ssh: SSH_AUTH_SOCK is not set")
+	}
+	return net.Dial("unix", path)
+}
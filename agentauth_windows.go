@@ -0,0 +1,20 @@
+package ssh
+
+import (
+	"io"
+	"os"
+)
+
+// openSSHAgentPipe is the named pipe of the ssh-agent service that
+// ships with Windows.
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to the named pipe in SSH_AUTH_SOCK, which
+// Pageant can provide, or else to that of the OpenSSH agent service.
+func dialAgent() (io.ReadWriteCloser, error) {
+	path := os.Getenv("SSH_AUTH_SOCK")
+	if path == "" {
+		path = openSSHAgentPipe
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditEventType identifies the kind of an AuditEvent.
+type AuditEventType int
+
+const (
+	// AuditAuthAttempt is emitted for each userauth request.
+	AuditAuthAttempt AuditEventType = iota + 1
+
+	// AuditAuthSuccess and AuditAuthFailure report the
+	// outcome of an authentication attempt.
+	AuditAuthSuccess
+	AuditAuthFailure
+
+	// AuditChannelOpen is emitted when the client opens a
+	// channel, AuditChannelClose when such a channel is closed,
+	// by either side or because the connection ends. Channels
+	// the server opens are not reported.
+	AuditChannelOpen
+	AuditChannelClose
+
+	// AuditExec is emitted for "exec" channel requests.
+	AuditExec
+
+	// AuditForwardRequest is emitted for global requests that
+	// set up or cancel port and socket forwarding.
+	AuditForwardRequest
+
+	// AuditDisconnect is emitted once, when the connection ends.
+	AuditDisconnect
+)
+
+// String returns the event type in human readable form.
+func (t AuditEventType) String() string {
+	switch t {
+	case AuditAuthAttempt:
+		return "auth-attempt"
+	case AuditAuthSuccess:
+		return "auth-success"
+	case AuditAuthFailure:
+		return "auth-failure"
+	case AuditChannelOpen:
+		return "channel-open"
+	case AuditChannelClose:
+		return "channel-close"
+	case AuditExec:
+		return "exec"
+	case AuditForwardRequest:
+		return "forward-request"
+	case AuditDisconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("unknown audit event %d", int(t))
+}
+
+// AuditEvent is a structured record of a security relevant event
+// on a server connection. Fields that do not apply to Type are
+// left at their zero value.
+type AuditEvent struct {
+	Type AuditEventType
+	Time time.Time
+
+	// Conn identifies the connection, and thereby the user
+	// and the remote address, as they were at the event.
+	Conn ConnMetadata
+
+	// Method is the authentication method, for the auth events.
+	Method string
+
+	// ChannelType is the type of the channel, for the channel
+	// events and AuditExec.
+	ChannelType string
+
+	// Command is the command line of an AuditExec event.
+	Command string
+
+	// Request is the global request type of an
+	// AuditForwardRequest event.
+	Request string
+
+	// Addr and Port describe the forwarding target: the
+	// listen address of an AuditForwardRequest, or the
+	// destination of a "direct-tcpip" or
+	// "direct-streamlocal@openssh.com" channel. Port is zero for
+	// Unix sockets.
+	Addr string
+	Port uint32
+
+	// Err is the reason of an AuditAuthFailure or
+	// AuditDisconnect event.
+	Err error
+}
+
+// newAuditFunc returns a function that stamps events with the
+// metadata of s and the current time before passing them to cb, or
+// nil if cb is nil.
+func newAuditFunc(s *connection, cb func(ev *AuditEvent)) func(ev *AuditEvent) {
+	if cb == nil {
+		return nil
+	}
+	return func(ev *AuditEvent) {
+		// The user changes with each authentication attempt, so
+		// the event gets the metadata as it is now.
+		meta := s.sshConn
+		ev.Conn = &meta
+		ev.Time = time.Now()
+		cb(ev)
+	}
+}
+
+// forwardRequests lists the global requests reported as
+// AuditForwardRequest.
+var forwardRequests = map[string]bool{
+	"tcpip-forward":                          true,
+	"cancel-tcpip-forward":                   true,
+	"streamlocal-forward@openssh.com":        true,
+	"cancel-streamlocal-forward@openssh.com": true,
+}
+
+// parseForwardTarget extracts the address and port that lead the
+// payload of forward requests and direct channel opens. Unix
+// socket paths have no port.
+func parseForwardTarget(payload []byte, hasPort bool) (addr string, port uint32) {
+	a, rest, ok := parseString(payload)
+	if !ok {
+		return "", 0
+	}
+	if hasPort {
+		port, _, _ = parseUint32(rest)
+	}
+	return string(a), port
+}
+
+// auditChannelOpen reports a channel opened by the peer.
+func (m *mux) auditChannelOpen(chanType string, extra []byte) {
+	if m.audit == nil {
+		return
+	}
+	ev := &AuditEvent{Type: AuditChannelOpen, ChannelType: chanType}
+	switch chanType {
+	case "direct-tcpip":
+		ev.Addr, ev.Port = parseForwardTarget(extra, true)
+	case "direct-streamlocal@openssh.com":
+		ev.Addr, _ = parseForwardTarget(extra, false)
+	}
+	m.audit(ev)
+}
+
+// auditChannelRequest reports exec requests.
+func (m *mux) auditChannelRequest(c *channel, req string, payload []byte) {
+	if m.audit == nil || req != "exec" {
+		return
+	}
+	cmd, _, _ := parseString(payload)
+	m.audit(&AuditEvent{Type: AuditExec, ChannelType: c.chanType, Command: string(cmd)})
+}
+
+// auditGlobalRequest reports forwarding requests.
+func (m *mux) auditGlobalRequest(req string, payload []byte) {
+	if m.audit == nil || !forwardRequests[req] {
+		return
+	}
+	ev := &AuditEvent{Type: AuditForwardRequest, Request: req}
+	ev.Addr, ev.Port = parseForwardTarget(payload, req == "tcpip-forward" || req == "cancel-tcpip-forward")
+	m.audit(ev)
+}
@@ -0,0 +1,223 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAuditCallback(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx := context.Background()
+	events := make(chan *AuditEvent, 20)
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		AuditCallback: func(ev *AuditEvent) { events <- ev },
+		Config:        Config{Halt: halt},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		for newCh := range chans {
+			ch, inReqs, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go DiscardRequests(ctx, inReqs, halt)
+			defer ch.Close()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{Password("secret")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	}
+	conn, _, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go DiscardRequests(ctx, reqs, halt)
+
+	ch, chReqs, err := conn.OpenChannel(ctx, "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, chReqs, halt)
+	if _, err := ch.SendRequest("exec", true, Marshal(&execMsg{Command: "ls -l"})); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+	fwd := struct {
+		Addr string
+		Port uint32
+	}{"localhost", 2022}
+	if _, _, err := conn.SendRequest(ctx, "tcpip-forward", true, Marshal(&fwd)); err != nil {
+		t.Fatalf("tcpip-forward: %v", err)
+	}
+	ch.Close()
+	// Left open, to be closed with the connection.
+	if _, _, err := conn.OpenChannel(ctx, "session", nil, nil); err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+
+	want := []AuditEvent{
+		{Type: AuditAuthAttempt, Method: "none"},
+		{Type: AuditAuthFailure, Method: "none"},
+		{Type: AuditAuthAttempt, Method: "password"},
+		{Type: AuditAuthSuccess, Method: "password"},
+		{Type: AuditChannelOpen, ChannelType: "session"},
+		{Type: AuditExec, ChannelType: "session", Command: "ls -l"},
+		{Type: AuditForwardRequest, Request: "tcpip-forward", Addr: "localhost", Port: 2022},
+		{Type: AuditChannelClose, ChannelType: "session"},
+		{Type: AuditChannelOpen, ChannelType: "session"},
+		{Type: AuditChannelClose, ChannelType: "session"},
+		{Type: AuditDisconnect},
+	}
+	for i, w := range want {
+		if i == len(want)-2 {
+			conn.Close()
+		}
+		var ev *AuditEvent
+		select {
+		case ev = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %d (%v)", i, w.Type)
+		}
+		if ev.Type != w.Type || ev.Method != w.Method || ev.ChannelType != w.ChannelType ||
+			ev.Command != w.Command || ev.Request != w.Request || ev.Addr != w.Addr || ev.Port != w.Port {
+			t.Errorf("event %d: got %+v, want %+v", i, *ev, w)
+		}
+		if ev.Conn == nil || ev.Conn.User() != "testuser" || ev.Time.IsZero() {
+			t.Errorf("event %d: missing metadata: %+v", i, *ev)
+		}
+		if (w.Type == AuditAuthFailure || w.Type == AuditDisconnect) && ev.Err == nil {
+			t.Errorf("event %d: %v without Err", i, ev.Type)
+		}
+	}
+}
+
+func TestAuditServerChannels(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx := context.Background()
+	events := make(chan *AuditEvent, 20)
+	serverConf := &ServerConfig{
+		NoClientAuth:  true,
+		AuditCallback: func(ev *AuditEvent) { events <- ev },
+		Config:        Config{Halt: halt},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	opened := make(chan error, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			opened <- err
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		// The server opens a channel of its own, and closes it.
+		ch, in, err := conn.OpenChannel(ctx, "x11", nil, nil)
+		if err == nil {
+			go DiscardRequests(ctx, in, halt)
+			err = ch.Close()
+		}
+		opened <- err
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(ctx, in, halt)
+			defer ch.Close()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	}
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	go DiscardRequests(ctx, reqs, halt)
+	go func() {
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(ctx, in, halt)
+			go ioutil.ReadAll(ch)
+		}
+	}()
+	if err := <-opened; err != nil {
+		t.Fatalf("server OpenChannel: %v", err)
+	}
+
+	ch, in, err := conn.OpenChannel(ctx, "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, in, halt)
+	ch.Close()
+
+	// Only the channel the client opened is reported.
+	var got []AuditEvent
+	for len(got) < 2 {
+		select {
+		case ev := <-events:
+			if ev.Type == AuditChannelOpen || ev.Type == AuditChannelClose {
+				got = append(got, *ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for channel events, got %+v", got)
+		}
+	}
+	want := []AuditEvent{
+		{Type: AuditChannelOpen, ChannelType: "session"},
+		{Type: AuditChannelClose, ChannelType: "session"},
+	}
+	for i, w := range want {
+		if got[i].Type != w.Type || got[i].ChannelType != w.ChannelType {
+			t.Errorf("event %d: got %v %q, want %v %q", i, got[i].Type, got[i].ChannelType, w.Type, w.ChannelType)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// padAuthFailure stalls a failed authentication attempt that began
+// at start until delay, plus a random part of up to a quarter of
+// it, has passed by clock, so that the time to reject does not tell
+// apart unknown users from wrong credentials. It returns early if
+// ctx or halt are stopped.
+func padAuthFailure(ctx context.Context, halt *Halter, rand io.Reader, clock Clock, start time.Time, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(rand, b[:]); err == nil {
+		delay += time.Duration(binary.BigEndian.Uint64(b[:]) % uint64(delay/4+1))
+	}
+	wait := delay - clock.Now().Sub(start)
+	if wait <= 0 {
+		return
+	}
+
+	var reqStop chan struct{}
+	if halt != nil {
+		reqStop = halt.ReqStopChan()
+	}
+	timer := clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-reqStop:
+	case <-ctx.Done():
+	}
+}
+
+// PasswordsEqual reports whether the passwords a and b are equal,
+// taking time that depends neither on their contents nor on their
+// lengths. Password callbacks should use it, or a password hash
+// such as bcrypt, rather than bytes.Equal, and should check a dummy
+// password for unknown users; see ServerConfig.AuthFailureDelay.
+func PasswordsEqual(a, b []byte) bool {
+	ha := sha256.Sum256(a)
+	hb := sha256.Sum256(b)
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errWrongPassword = errors.New("wrong password")
+
+func TestAuthFailureDelay(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	const delay = 100 * time.Millisecond
+	for _, user := range []string{"nobody", "testuser"} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		serverConf := &ServerConfig{
+			// Unknown users fail fast, as callbacks tend to do.
+			PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+				if conn.User() != "testuser" {
+					return nil, errWrongPassword
+				}
+				time.Sleep(delay / 10)
+				if !PasswordsEqual(password, []byte("tiger")) {
+					return nil, errWrongPassword
+				}
+				return nil, nil
+			},
+			AuthFailureDelay: delay,
+			Config:           Config{Halt: NewHalter()},
+		}
+		serverConf.AddHostKey(testSigners["rsa"])
+		ctx := context.Background()
+		go newServer(ctx, c1, serverConf)
+
+		clientConf := &ClientConfig{
+			User:            user,
+			Auth:            []AuthMethod{Password("lion")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		}
+		start := time.Now()
+		if _, _, _, err := NewClientConn(ctx, c2, "", clientConf); err == nil {
+			t.Fatalf("%s: wrong password accepted", user)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Errorf("%s: failed after %v, want at least %v", user, elapsed, delay)
+		}
+		clientConf.Halt.RequestStop()
+		serverConf.Halt.RequestStop()
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestPasswordsEqual(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"tiger", "tiger", true},
+		{"tiger", "tige", false},
+		{"tiger", "Tiger", false},
+		{"", "", true},
+	} {
+		if got := PasswordsEqual([]byte(tt.a), []byte(tt.b)); got != tt.want {
+			t.Errorf("PasswordsEqual(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
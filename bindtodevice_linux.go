@@ -0,0 +1,19 @@
+package ssh
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a net.Dialer Control function that binds the
+// socket to the network interface device.
+func bindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), device)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package ssh
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// bindToDevice fails: binding to a device is only supported on Linux.
+func bindToDevice(device string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("ssh: binding to device %q is not supported on %s", device, runtime.GOOS)
+}
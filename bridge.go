@@ -0,0 +1,204 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Bridge relays the channels and global requests between two SSH
+// connections, for gateways that stand between a client and the
+// server it means to reach, such as audited jump hosts. The inbound
+// connection is typically a ServerConn the client connected to, and
+// the outbound one a Client connected to the real server. Each
+// channel one side opens is opened on the other side, and its data,
+// extended data, EOF, close and requests are relayed, replies
+// included. Global requests are relayed the same way, so remote
+// forwards work through the bridge.
+//
+// Data is relayed only as fast as the receiving side takes it: the
+// window of the sending side is only given back once its data is
+// written to the receiving side, so neither side can fill the memory
+// of the bridge, however their windows and packet sizes differ.
+type Bridge struct {
+	// Policy, if non-nil, is called for each channel open, global
+	// request and channel request before it is relayed; msg.Conn
+	// is the connection it arrived on. Returning an error refuses
+	// it: a channel open is rejected with Prohibited and the
+	// error as message, and a request is answered with a failure
+	// if a reply is wanted. Policy may be called from several
+	// goroutines at once, and may block, holding up what it
+	// decides on.
+	Policy Interceptor
+
+	// Tap, if non-nil, is called for each channel relayed, with
+	// the connection that opened it and its type and type
+	// specific data. If it returns a non-nil io.Writer, the
+	// traffic of the channel on the inbound side is mirrored to
+	// it, as TapChannel does: "<-" is data from the inbound peer,
+	// "->" data to it.
+	Tap func(conn ConnMetadata, chanType string, extra []byte) io.Writer
+}
+
+// Run relays between the inbound connection in and the outbound
+// connection out, whose channels and requests are inChans, inReqs,
+// outChans and outReqs, as NewServerConn and NewClientConn return
+// them. It returns when either connection ends, after closing the
+// other, with the error of the one that ended first, or when ctx is
+// done, after closing both.
+func (b *Bridge) Run(ctx context.Context, in Conn, inChans <-chan NewChannel, inReqs <-chan *Request, out Conn, outChans <-chan NewChannel, outReqs <-chan *Request) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go b.relayGlobalRequests(ctx, in, inReqs, out)
+	go b.relayGlobalRequests(ctx, out, outReqs, in)
+	go b.relayChannels(ctx, in, inChans, out, true)
+	go b.relayChannels(ctx, out, outChans, in, false)
+
+	ended := make(chan error, 2)
+	go func() { ended <- in.Wait() }()
+	go func() { ended <- out.Wait() }()
+	var err error
+	select {
+	case err = <-ended:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	in.Close()
+	out.Close()
+	return err
+}
+
+// allow asks the Policy about msg.
+func (b *Bridge) allow(msg *InterceptedMessage) error {
+	if b.Policy == nil {
+		return nil
+	}
+	return b.Policy(msg)
+}
+
+// relayGlobalRequests relays the global requests of from, reqs, to
+// to, and their replies back.
+func (b *Bridge) relayGlobalRequests(ctx context.Context, from Conn, reqs <-chan *Request, to Conn) {
+	for req := range reqs {
+		err := b.allow(&InterceptedMessage{
+			Kind:      InterceptGlobalRequest,
+			Conn:      from,
+			Name:      req.Type,
+			WantReply: req.WantReply,
+			Payload:   req.Payload,
+		})
+		ok, payload := false, []byte(nil)
+		if err == nil {
+			ok, payload, err = to.SendRequest(ctx, req.Type, req.WantReply, req.Payload)
+		}
+		if req.WantReply {
+			req.Reply(ok && err == nil, payload)
+		}
+	}
+}
+
+// relayChannels opens each channel of chans, which from opened, on
+// to, and relays between the two.
+func (b *Bridge) relayChannels(ctx context.Context, from Conn, chans <-chan NewChannel, to Conn, inbound bool) {
+	for newCh := range chans {
+		go b.relayChannel(ctx, from, newCh, to, inbound)
+	}
+}
+
+func (b *Bridge) relayChannel(ctx context.Context, from Conn, newCh NewChannel, to Conn, inbound bool) {
+	chanType, extra := newCh.ChannelType(), newCh.ExtraData()
+	if err := b.allow(&InterceptedMessage{
+		Kind:    InterceptChannelOpen,
+		Conn:    from,
+		Name:    chanType,
+		Payload: extra,
+	}); err != nil {
+		newCh.Reject(Prohibited, err.Error())
+		return
+	}
+	toCh, toReqs, err := to.OpenChannel(ctx, chanType, extra, nil)
+	if err != nil {
+		if oce, ok := err.(*OpenChannelError); ok {
+			newCh.Reject(oce.Reason, oce.Message)
+		} else {
+			newCh.Reject(ConnectionFailed, err.Error())
+		}
+		return
+	}
+	fromCh, fromReqs, err := newCh.Accept()
+	if err != nil {
+		toCh.Close()
+		return
+	}
+
+	var w io.Writer
+	if b.Tap != nil {
+		w = b.Tap(from, chanType, extra)
+	}
+	if w != nil && inbound {
+		fromCh = TapChannel(fromCh, w)
+	} else if w != nil {
+		toCh = TapChannel(toCh, w)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.relayHalf(from, chanType, fromCh, fromReqs, toCh)
+	}()
+	go func() {
+		defer wg.Done()
+		b.relayHalf(to, chanType, toCh, toReqs, fromCh)
+	}()
+	wg.Wait()
+}
+
+// relayHalf relays what the peer of conn sends on src, its data and
+// requests, to dst. Once src is closed and its data relayed, dst is
+// closed too.
+func (b *Bridge) relayHalf(conn Conn, chanType string, src Channel, reqs <-chan *Request, dst Channel) {
+	// The EOF of src ends its stderr too, and once dst is sent
+	// EOF, nothing more can be written to it, so dst is sent EOF
+	// after both streams are relayed.
+	var data sync.WaitGroup
+	data.Add(2)
+	go func() {
+		defer data.Done()
+		io.Copy(dst, src)
+	}()
+	go func() {
+		defer data.Done()
+		if s, d := src.Stderr(), dst.Stderr(); s != nil && d != nil {
+			io.Copy(d, s)
+		}
+	}()
+	eof := make(chan struct{})
+	go func() {
+		data.Wait()
+		dst.CloseWrite()
+		close(eof)
+	}()
+
+	for req := range reqs {
+		err := b.allow(&InterceptedMessage{
+			Kind:        InterceptChannelRequest,
+			Conn:        conn,
+			Name:        req.Type,
+			Channel:     src,
+			ChannelType: chanType,
+			WantReply:   req.WantReply,
+			Payload:     req.Payload,
+		})
+		ok := false
+		if err == nil {
+			ok, err = dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		}
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+	<-eof
+	dst.Close()
+}
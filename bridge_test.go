@@ -0,0 +1,186 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bridgeBackend serves "session" channels, each running a command
+// that echoes its stdin, writes "oops" to stderr and exits with
+// status 3, and answers the global request "ping" with "pong".
+func bridgeBackend(t *testing.T, ctx context.Context, halt *Halter) Conn {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	go func() {
+		conf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: halt}}
+		conf.AddHostKey(testSigners["ecdsa"])
+		_, chans, reqs, err := NewServerConn(ctx, c1, conf)
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				req.Reply(req.Type == "ping", []byte("pong"))
+			}
+		}()
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(UnknownChannelType, "no")
+				continue
+			}
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range in {
+					req.Reply(req.Type == "exec", nil)
+					if req.Type == "exec" {
+						break
+					}
+				}
+				go DiscardRequests(ctx, in, nil)
+				io.Copy(ch, ch)
+				io.WriteString(ch.Stderr(), "oops")
+				sendStatus(3, ch, t)
+			}()
+		}
+	}()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go DiscardRequests(ctx, reqs, nil)
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no")
+		}
+	}()
+	return conn
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBridge(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	ctx := context.Background()
+	out := bridgeBackend(t, ctx, halt)
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	var tap syncBuffer
+	bridge := &Bridge{
+		Policy: func(msg *InterceptedMessage) error {
+			if msg.Name == "forbidden" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+		Tap: func(conn ConnMetadata, chanType string, extra []byte) io.Writer {
+			return &tap
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		// A small packet size on the inbound side, to relay
+		// between mismatched channels.
+		conf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: halt, MaxChannelPacket: 1024}}
+		conf.AddHostKey(testSigners["rsa"])
+		in, chans, reqs, err := NewServerConn(ctx, c1, conf)
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- bridge.Run(ctx, in, chans, reqs, out, nil, nil)
+	}()
+
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go DiscardRequests(ctx, reqs, nil)
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no")
+		}
+	}()
+	client := NewClient(ctx, conn, chans, reqs, halt)
+
+	if ok, payload, err := client.SendRequest(ctx, "ping", true, nil); !ok || err != nil || string(payload) != "pong" {
+		t.Errorf("ping: %v, %q, %v", ok, payload, err)
+	}
+	if ok, _, err := client.SendRequest(ctx, "forbidden", true, nil); ok || err != nil {
+		t.Errorf("forbidden request: %v, %v; want it refused", ok, err)
+	}
+	_, _, err = client.OpenChannel(ctx, "forbidden", nil, nil)
+	var oce *OpenChannelError
+	if !errors.As(err, &oce) || oce.Reason != Prohibited {
+		t.Errorf("forbidden channel: %v, want it prohibited", err)
+	}
+	_, _, err = client.OpenChannel(ctx, "unknown", nil, nil)
+	if !errors.As(err, &oce) || oce.Reason != UnknownChannelType {
+		t.Errorf("unknown channel: %v, want the rejection of the backend", err)
+	}
+
+	session, err := client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	input := strings.Repeat("0123456789abcdef", 1<<14)
+	session.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	session.Stdout, session.Stderr = &stdout, &stderr
+	err = session.Run("echo")
+	if e, ok := err.(*ExitError); !ok || e.ExitStatus() != 3 {
+		t.Errorf("Run: %v, want exit status 3", err)
+	}
+	if stdout.String() != input {
+		t.Errorf("echoed %d bytes, want %d", stdout.Len(), len(input))
+	}
+	if stderr.String() != "oops" {
+		t.Errorf("stderr %q, want %q", stderr.String(), "oops")
+	}
+	if got := tap.String(); !strings.Contains(got, "<- stdout") || !strings.Contains(got, "-> stderr 4 bytes") {
+		t.Errorf("tap missed the traffic of the session")
+	}
+
+	client.Close()
+	if err := <-done; err == nil {
+		t.Error("Run returned nil when the client left")
+	}
+}
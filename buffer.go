@@ -122,3 +122,39 @@ func (b *buffer) Read(buf []byte) (n int, err error) {
 	}
 	return
 }
+
+// next returns the next segment written, without copying it, and
+// blocks as Read does if there is none.
+func (b *buffer) next() (seg []byte, err error) {
+	b.idle.BeginAttempt()
+	b.Cond.L.Lock()
+	defer func() {
+		b.Cond.L.Unlock()
+		if err == nil {
+			b.idle.AttemptOK()
+		}
+	}()
+
+	for {
+		if len(b.head.buf) > 0 {
+			seg, b.head.buf = b.head.buf, nil
+			return seg, nil
+		}
+		if b.head != b.tail {
+			b.head = b.head.next
+			continue
+		}
+		if b.closed {
+			return nil, io.EOF
+		}
+		timedOut := ""
+		select {
+		case timedOut = <-b.idle.TimedOut:
+		case <-b.idle.Halt.ReqStopChan():
+		}
+		if timedOut != "" {
+			return nil, newErrTimeout(timedOut, b.idle)
+		}
+		b.Cond.Wait()
+	}
+}
@@ -91,3 +91,26 @@ func TestBufferClose(t *testing.T) {
 		t.Fatal("Expected written == read == 15", r, r2, r3, r4)
 	}
 }
+
+func TestBufferNext(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	b := newBuffer(testIdle)
+	b.write(alphabet[:10])
+	b.write(alphabet[10:15])
+	b.eof()
+	if r, _ := b.Read(make([]byte, 3)); r != 3 {
+		t.Fatalf("Read: got %d bytes, want 3", r)
+	}
+	// next returns the rest of the segment Read started on, then
+	// the following one.
+	for _, want := range []string{"defghij", "klmno"} {
+		seg, err := b.next()
+		if err != nil || string(seg) != want {
+			t.Fatalf("next: got %q, %v, want %q", seg, err, want)
+		}
+	}
+	if _, err := b.next(); err != io.EOF {
+		t.Fatalf("next at end: got %v, want EOF", err)
+	}
+}
@@ -0,0 +1,371 @@
+// Package ca is a small SSH certificate authority, to embed in a
+// service that issues short-lived user and host certificates: it
+// fills certificates in from templates, gives each a serial of its
+// own, keeps an audit record of every issuance and revocation, and
+// writes the revoked serials as an OpenSSH key revocation list.
+//
+// A typical use is
+//
+//	authority := &ca.CA{
+//		Signer:  caSigner,
+//		Serials: ca.NewSerialCounter(lastSerial + 1),
+//		Audit:   func(r ca.Record) error { log.Print(r); return nil },
+//	}
+//	cert, err := authority.Issue(userKey, &ca.Template{
+//		CertType:   ssh.UserCert,
+//		KeyID:      "alice@example.com",
+//		Principals: []string{"alice"},
+//		Validity:   8 * time.Hour,
+//		Extensions: ca.DefaultUserExtensions(),
+//	})
+//
+// and servers trust the public key of caSigner, and load the list
+// from MarshalKRL into sshd's RevokedKeys, or check IsRevoked in an
+// ssh.CertChecker.
+package ca
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// Template holds the fields of the certificates a CA issues, other
+// than the key, the serial and the validity period, which it fills
+// in for each.
+type Template struct {
+	// CertType is ssh.UserCert or ssh.HostCert.
+	CertType uint32
+
+	// KeyID identifies the certificate in the logs of servers.
+	KeyID string
+
+	// Principals are the user names, or host names, the
+	// certificate is valid for.
+	Principals []string
+
+	// Validity is how long the certificate is valid for. Zero
+	// issues one that never expires.
+	Validity time.Duration
+
+	// Backdate moves the start of the validity period into the
+	// past, for servers with clocks behind that of the CA.
+	Backdate time.Duration
+
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+}
+
+// DefaultUserExtensions returns the extensions ssh-keygen gives user
+// certificates by default.
+func DefaultUserExtensions() map[string]string {
+	return map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          "",
+	}
+}
+
+// A SerialStore hands out certificate serials. It must not hand out
+// the same one twice, also across restarts of the CA, so that
+// revoking a serial revokes a single certificate.
+type SerialStore interface {
+	NextSerial() (uint64, error)
+}
+
+// SerialCounter is a SerialStore that counts up in memory. A CA that
+// restarts should start it after the last serial it issued.
+type SerialCounter struct {
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewSerialCounter returns a SerialCounter that hands out next
+// first. Serial zero means no serial to OpenSSH, so it is skipped.
+func NewSerialCounter(next uint64) *SerialCounter {
+	return &SerialCounter{next: next}
+}
+
+// NextSerial implements SerialStore.
+func (s *SerialCounter) NextSerial() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next == 0 {
+		s.next = 1
+	}
+	serial := s.next
+	s.next++
+	return serial, nil
+}
+
+// RecordType is the kind of a Record.
+type RecordType int
+
+const (
+	// RecordIssue is kept for each certificate issued.
+	RecordIssue RecordType = iota + 1
+
+	// RecordRevoke is kept for each serial revoked.
+	RecordRevoke
+)
+
+// String returns the record type in human readable form.
+func (t RecordType) String() string {
+	switch t {
+	case RecordIssue:
+		return "issue"
+	case RecordRevoke:
+		return "revoke"
+	}
+	return fmt.Sprintf("unknown record type %d", int(t))
+}
+
+// Record is the audit record of an issuance or a revocation. Fields
+// that do not apply to Type are left at their zero value.
+type Record struct {
+	Type   RecordType
+	Time   time.Time
+	Serial uint64
+
+	// The fields of the certificate issued.
+	CertType    uint32
+	KeyID       string
+	Principals  []string
+	ValidAfter  uint64
+	ValidBefore uint64
+
+	// Fingerprint is the SHA256 fingerprint of the key certified.
+	Fingerprint string
+
+	// Reason is the reason given for a revocation.
+	Reason string
+}
+
+// String returns the record as a single line of text, for logs.
+func (r Record) String() string {
+	switch r.Type {
+	case RecordIssue:
+		kind := "user"
+		if r.CertType == ssh.HostCert {
+			kind = "host"
+		}
+		return fmt.Sprintf("%s serial=%d %s id=%q principals=%q key=%s valid=%d-%d",
+			r.Type, r.Serial, kind, r.KeyID, r.Principals, r.Fingerprint, r.ValidAfter, r.ValidBefore)
+	case RecordRevoke:
+		return fmt.Sprintf("%s serial=%d reason=%q", r.Type, r.Serial, r.Reason)
+	}
+	return r.Type.String()
+}
+
+// CA issues and revokes certificates. Its exported fields must not
+// change once it is in use; its methods may be called concurrently.
+type CA struct {
+	// Signer is the key of the CA, whose public key servers
+	// trust.
+	Signer ssh.Signer
+
+	// Serials hands out the serials of certificates. If nil, a
+	// SerialCounter starting at 1 is used, which is only fit for
+	// tests and for CAs that never restart.
+	Serials SerialStore
+
+	// Audit, if not nil, is called with a Record for each
+	// certificate issued and each serial revoked, before the
+	// certificate is returned or the revocation takes effect. An
+	// error it returns fails the issuance or the revocation, so
+	// that nothing happens that was not recorded.
+	Audit func(Record) error
+
+	// OnRevoke, if not nil, is called after a serial is revoked,
+	// for example to publish a new KRL.
+	OnRevoke func(serial uint64)
+
+	// Clock, if not nil, is used for the validity periods instead
+	// of time.Now.
+	Clock func() time.Time
+
+	// Rand, if not nil, is used for the nonces and signatures
+	// instead of crypto/rand.
+	Rand io.Reader
+
+	mu         sync.Mutex
+	counter    *SerialCounter
+	revoked    map[uint64]bool
+	krlVersion uint64
+}
+
+func (c *CA) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
+func (c *CA) rand() io.Reader {
+	if c.Rand != nil {
+		return c.Rand
+	}
+	return rand.Reader
+}
+
+func (c *CA) nextSerial() (uint64, error) {
+	if c.Serials != nil {
+		return c.Serials.NextSerial()
+	}
+	c.mu.Lock()
+	if c.counter == nil {
+		c.counter = NewSerialCounter(1)
+	}
+	counter := c.counter
+	c.mu.Unlock()
+	return counter.NextSerial()
+}
+
+// Issue returns a certificate for key, filled in from t, with the
+// next serial, and valid from now, less t.Backdate, for t.Validity.
+func (c *CA) Issue(key ssh.PublicKey, t *Template) (*ssh.Certificate, error) {
+	if c.Signer == nil {
+		return nil, errors.New("ca: CA has no Signer")
+	}
+	if t.CertType != ssh.UserCert && t.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("ca: unknown certificate type %d", t.CertType)
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("ca: cannot certify a certificate")
+	}
+	if t.Validity < 0 || t.Backdate < 0 {
+		return nil, errors.New("ca: negative Validity or Backdate")
+	}
+	serial, err := c.nextSerial()
+	if err != nil {
+		return nil, fmt.Errorf("ca: no serial: %v", err)
+	}
+
+	now := c.now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        t.CertType,
+		KeyId:           t.KeyID,
+		ValidPrincipals: append([]string(nil), t.Principals...),
+		ValidAfter:      uint64(now.Add(-t.Backdate).Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+		Permissions: ssh.Permissions{
+			CriticalOptions: copyMap(t.CriticalOptions),
+			Extensions:      copyMap(t.Extensions),
+		},
+	}
+	if t.Validity > 0 {
+		cert.ValidBefore = uint64(now.Add(t.Validity).Unix())
+	}
+	if err := cert.SignCert(c.rand(), c.Signer); err != nil {
+		return nil, err
+	}
+
+	if c.Audit != nil {
+		err := c.Audit(Record{
+			Type:        RecordIssue,
+			Time:        now,
+			Serial:      serial,
+			CertType:    cert.CertType,
+			KeyID:       cert.KeyId,
+			Principals:  cert.ValidPrincipals,
+			ValidAfter:  cert.ValidAfter,
+			ValidBefore: cert.ValidBefore,
+			Fingerprint: ssh.FingerprintSHA256(key),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ca: audit failed, certificate not issued: %v", err)
+		}
+	}
+	return cert, nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// Revoke revokes the certificate with serial, for reason.
+func (c *CA) Revoke(serial uint64, reason string) error {
+	if serial == 0 {
+		return errors.New("ca: cannot revoke serial 0")
+	}
+	if c.Audit != nil {
+		err := c.Audit(Record{
+			Type:   RecordRevoke,
+			Time:   c.now(),
+			Serial: serial,
+			Reason: reason,
+		})
+		if err != nil {
+			return fmt.Errorf("ca: audit failed, serial not revoked: %v", err)
+		}
+	}
+	c.mu.Lock()
+	if c.revoked == nil {
+		c.revoked = make(map[uint64]bool)
+	}
+	c.revoked[serial] = true
+	c.mu.Unlock()
+	if c.OnRevoke != nil {
+		c.OnRevoke(serial)
+	}
+	return nil
+}
+
+// IsRevoked reports whether cert was issued by c and then revoked.
+// It suits the IsRevoked field of ssh.CertChecker.
+func (c *CA) IsRevoked(cert *ssh.Certificate) bool {
+	if cert.SignatureKey == nil || c.Signer == nil ||
+		string(cert.SignatureKey.Marshal()) != string(c.Signer.PublicKey().Marshal()) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.revoked[cert.Serial]
+}
+
+// Revoked returns the revoked serials, in increasing order.
+func (c *CA) Revoked() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	serials := make([]uint64, 0, len(c.revoked))
+	for s := range c.revoked {
+		serials = append(serials, s)
+	}
+	sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+	return serials
+}
+
+// MarshalKRL returns the revoked serials as an OpenSSH key revocation
+// list, which sshd loads with RevokedKeys and ssh-keygen -Q checks.
+// The version of the list is the time it is made, in seconds, or one
+// more than that of the last list if that is higher, so that each
+// list is newer than the last, also across restarts.
+func (c *CA) MarshalKRL(comment string) ([]byte, error) {
+	if c.Signer == nil {
+		return nil, errors.New("ca: CA has no Signer")
+	}
+	serials := c.Revoked()
+	now := c.now()
+	c.mu.Lock()
+	version := uint64(now.Unix())
+	if version <= c.krlVersion {
+		version = c.krlVersion + 1
+	}
+	c.krlVersion = version
+	c.mu.Unlock()
+	return marshalKRL(version, now, comment, c.Signer.PublicKey(), serials), nil
+}
@@ -0,0 +1,160 @@
+package ca
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+func newTestCA(t *testing.T) (*CA, *[]Record) {
+	key, err := ssh.GenerateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	var records []Record
+	now := time.Unix(1700000000, 0)
+	return &CA{
+		Signer:  key,
+		Serials: NewSerialCounter(100),
+		Audit: func(r Record) error {
+			records = append(records, r)
+			return nil
+		},
+		Clock: func() time.Time { return now },
+	}, &records
+}
+
+func TestIssue(t *testing.T) {
+	authority, records := newTestCA(t)
+	user, err := ssh.GenerateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &Template{
+		CertType:   ssh.UserCert,
+		KeyID:      "alice@example.com",
+		Principals: []string{"alice"},
+		Validity:   time.Hour,
+		Backdate:   time.Minute,
+		Extensions: DefaultUserExtensions(),
+	}
+	for serial := uint64(100); serial < 102; serial++ {
+		cert, err := authority.Issue(user.PublicKey(), tmpl)
+		if err != nil {
+			t.Fatalf("Issue: %v", err)
+		}
+		if cert.Serial != serial {
+			t.Errorf("serial %d, want %d", cert.Serial, serial)
+		}
+		if cert.ValidAfter != 1700000000-60 || cert.ValidBefore != 1700000000+3600 {
+			t.Errorf("valid %d-%d", cert.ValidAfter, cert.ValidBefore)
+		}
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(k ssh.PublicKey) bool {
+				return string(k.Marshal()) == string(authority.Signer.PublicKey().Marshal())
+			},
+			Clock: authority.Clock,
+		}
+		if err := checker.CheckCert("alice", cert); err != nil {
+			t.Errorf("CheckCert: %v", err)
+		}
+	}
+
+	want := Record{
+		Type:        RecordIssue,
+		Time:        time.Unix(1700000000, 0),
+		Serial:      101,
+		CertType:    ssh.UserCert,
+		KeyID:       "alice@example.com",
+		Principals:  []string{"alice"},
+		ValidAfter:  1700000000 - 60,
+		ValidBefore: 1700000000 + 3600,
+		Fingerprint: ssh.FingerprintSHA256(user.PublicKey()),
+	}
+	if len(*records) != 2 || !reflect.DeepEqual((*records)[1], want) {
+		t.Errorf("audit records %v, want second to be %v", *records, want)
+	}
+
+	authority.Audit = func(Record) error { return errors.New("log full") }
+	if _, err := authority.Issue(user.PublicKey(), tmpl); err == nil {
+		t.Error("Issue succeeded though the audit failed")
+	}
+	if _, err := authority.Issue(user.PublicKey(), &Template{}); err == nil {
+		t.Error("Issue succeeded without a certificate type")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	authority, records := newTestCA(t)
+	host, err := ssh.GenerateKey("ed25519", 0)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &Template{CertType: ssh.HostCert, KeyID: "web", Principals: []string{"web.example.com"}}
+	var certs []*ssh.Certificate
+	for i := 0; i < 3; i++ {
+		cert, err := authority.Issue(host.PublicKey(), tmpl)
+		if err != nil {
+			t.Fatalf("Issue: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	var published []uint64
+	authority.OnRevoke = func(serial uint64) { published = append(published, serial) }
+	if err := authority.Revoke(certs[1].Serial, "key compromised"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if !reflect.DeepEqual(published, []uint64{101}) {
+		t.Errorf("OnRevoke saw %v", published)
+	}
+	if last := (*records)[len(*records)-1]; last.Type != RecordRevoke || last.Serial != 101 || last.Reason != "key compromised" {
+		t.Errorf("last audit record %v", last)
+	}
+	for i, cert := range certs {
+		if got := authority.IsRevoked(cert); got != (i == 1) {
+			t.Errorf("IsRevoked(serial %d) = %v", cert.Serial, got)
+		}
+	}
+
+	krl, err := authority.MarshalKRL("test")
+	if err != nil {
+		t.Fatalf("MarshalKRL: %v", err)
+	}
+	if again, _ := authority.MarshalKRL("test"); string(again[12:20]) <= string(krl[12:20]) {
+		t.Error("KRL version did not go up")
+	}
+
+	bin, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("could not find ssh-keygen")
+	}
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	krlFile := filepath.Join(dir, "krl")
+	if err := ioutil.WriteFile(krlFile, krl, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, cert := range certs {
+		certFile := filepath.Join(dir, "cert.pub")
+		if err := ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(bin, "-Q", "-f", krlFile, certFile).CombinedOutput()
+		revoked := strings.Contains(string(out), "REVOKED")
+		if revoked != (i == 1) || (err != nil) != revoked {
+			t.Errorf("ssh-keygen -Q for serial %d: %v\n%s", cert.Serial, err, out)
+		}
+	}
+}
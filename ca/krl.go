@@ -0,0 +1,62 @@
+package ca
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// The constants of the OpenSSH key revocation list format, see
+// [PROTOCOL.krl].
+const (
+	krlMagic         = 0x5353484b524c0a00
+	krlFormatVersion = 1
+
+	krlSectionCertificates = 1
+	krlSectionSerialList   = 0x20
+)
+
+// marshalKRL returns a KRL revoking the certificates of ca with the
+// given serials.
+func marshalKRL(version uint64, date time.Time, comment string, ca ssh.PublicKey, serials []uint64) []byte {
+	var certs []byte
+	certs = appendString(certs, ca.Marshal())
+	certs = appendString(certs, nil) // reserved
+	if len(serials) > 0 {
+		var list []byte
+		for _, s := range serials {
+			list = appendU64(list, s)
+		}
+		certs = append(certs, krlSectionSerialList)
+		certs = appendString(certs, list)
+	}
+
+	var krl []byte
+	krl = appendU64(krl, krlMagic)
+	krl = appendU32(krl, krlFormatVersion)
+	krl = appendU64(krl, version)
+	krl = appendU64(krl, uint64(date.Unix()))
+	krl = appendU64(krl, 0)      // flags
+	krl = appendString(krl, nil) // reserved
+	krl = appendString(krl, []byte(comment))
+	krl = append(krl, krlSectionCertificates)
+	return appendString(krl, certs)
+}
+
+func appendU32(buf []byte, n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func appendU64(buf []byte, n uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf, s []byte) []byte {
+	buf = appendU32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// A CertFetcher returns a Signer, made with NewCertSigner, for a newly
+// issued certificate, as from a CA that issues short-lived ones on
+// request.
+type CertFetcher func(ctx context.Context) (Signer, error)
+
+// CertAuth returns an AuthMethod that authenticates with the
+// certificate fetch returns, calling it at each handshake so that
+// every connection presents a fresh one. ctx is that of the
+// handshake.
+func CertAuth(fetch CertFetcher) AuthMethod {
+	return certAuth(fetch)
+}
+
+type certAuth CertFetcher
+
+func (certAuth) method() string {
+	return "publickey"
+}
+
+func (fetch certAuth) auth(ctx context.Context, session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+	signer, err := fetch(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	if _, ok := signer.PublicKey().(*Certificate); !ok {
+		return false, nil, fmt.Errorf("ssh: CertAuth got a %s key, not a certificate", signer.PublicKey().Type())
+	}
+	return publicKeyCallback(func() ([]Signer, error) {
+		return []Signer{signer}, nil
+	}).auth(ctx, session, user, c, rand)
+}
+
+// AuthCertificate returns the certificate the client authenticated
+// with, or nil if it did not use one.
+func (c *Client) AuthCertificate() *Certificate {
+	conn, ok := c.Conn.(*connection)
+	if !ok {
+		return nil
+	}
+	return conn.transport.authCertificate()
+}
+
+// ReplaceBeforeCertExpiry waits until margin before the certificate c
+// authenticated with expires, then dials a replacement for c with
+// dial, and returns it. SSH cannot authenticate a connection again,
+// and some servers end connections whose certificates have expired,
+// so a long-lived client moves to a new connection instead; dial
+// should authenticate with CertAuth, to get a fresh certificate. The
+// caller then moves its work to the replacement, and closes c once
+// the work in progress on it is done.
+//
+// It fails right away if c did not authenticate with a certificate,
+// or with one that does not expire, and early if ctx is done or the
+// connection of c is lost first.
+func (c *Client) ReplaceBeforeCertExpiry(ctx context.Context, margin time.Duration, dial func(ctx context.Context) (*Client, error)) (*Client, error) {
+	cert := c.AuthCertificate()
+	if cert == nil {
+		return nil, errors.New("ssh: client did not authenticate with a certificate")
+	}
+	if cert.ValidBefore == CertTimeInfinity || cert.ValidBefore > math.MaxInt64 {
+		return nil, errors.New("ssh: certificate does not expire")
+	}
+	clock := Clock(realClock{})
+	if conn, ok := c.Conn.(*connection); ok {
+		clock = conn.cfg.Clock
+	}
+
+	renewAt := time.Unix(int64(cert.ValidBefore), 0).Add(-margin)
+	timer := clock.NewTimer(renewAt.Sub(clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.Done():
+		return nil, errors.New("ssh: connection lost before its certificate expired")
+	}
+	return dial(ctx)
+}
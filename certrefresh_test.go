@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenCertAuth serves SSH on a local port, letting in users with
+// certificates of the "ecdsa" test key, or with the "rsa" key itself.
+func listenCertAuth(t *testing.T) (string, *Halter) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	checker := &CertChecker{
+		IsUserAuthority: func(k PublicKey) bool {
+			return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		UserKeyFallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			return nil, nil
+		},
+	}
+	config := &ServerConfig{PublicKeyCallback: checker.Authenticate, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	go ServeListener(context.Background(), l, config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+		go DiscardRequests(ctx, reqs, nil)
+		for ch := range chans {
+			ch.Reject(Prohibited, "cert test")
+		}
+	})
+	return l.Addr().String(), config.Halt
+}
+
+func TestCertAuthRefresh(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenCertAuth(t)
+	defer halt.RequestStop()
+
+	start := time.Now()
+	clock := NewFakeClock(start)
+	var serial uint64
+	fetch := func(ctx context.Context) (Signer, error) {
+		cert := &Certificate{
+			Key:             testPublicKeys["rsa"],
+			Serial:          atomic.AddUint64(&serial, 1),
+			CertType:        UserCert,
+			ValidPrincipals: []string{"gopher"},
+			ValidAfter:      uint64(start.Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(clock.Now().Add(time.Hour).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+			return nil, err
+		}
+		return NewCertSigner(cert, testSigners["rsa"])
+	}
+	dial := func(ctx context.Context) (*Client, error) {
+		return Dial(ctx, "tcp", addr, &ClientConfig{
+			User:            "gopher",
+			Auth:            []AuthMethod{CertAuth(fetch)},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter(), Clock: clock},
+		})
+	}
+
+	ctx := context.Background()
+	client, err := dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	cert := client.AuthCertificate()
+	if cert == nil || cert.Serial != 1 {
+		t.Fatalf("AuthCertificate = %v, want serial 1", cert)
+	}
+
+	const margin = 5 * time.Minute
+	type result struct {
+		client *Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		next, err := client.ReplaceBeforeCertExpiry(ctx, margin, dial)
+		done <- result{next, err}
+	}()
+	var res result
+wait:
+	for {
+		select {
+		case res = <-done:
+			break wait
+		case <-time.After(10 * time.Millisecond):
+			clock.Advance(time.Minute)
+		}
+	}
+	if res.err != nil {
+		t.Fatalf("ReplaceBeforeCertExpiry: %v", res.err)
+	}
+	defer res.client.Close()
+	if renewAt := time.Unix(int64(cert.ValidBefore), 0).Add(-margin); clock.Now().Before(renewAt) {
+		t.Errorf("replaced at %v, before %v", clock.Now(), renewAt)
+	}
+	if next := res.client.AuthCertificate(); next == nil || next.Serial != 2 {
+		t.Errorf("replacement authenticated with %v, want serial 2", next)
+	}
+}
+
+func TestReplaceBeforeCertExpiryWithoutCert(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenCertAuth(t)
+	defer halt.RequestStop()
+
+	client, err := Dial(context.Background(), "tcp", addr, &ClientConfig{
+		User:            "gopher",
+		Auth:            []AuthMethod{PublicKeys(testSigners["rsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if cert := client.AuthCertificate(); cert != nil {
+		t.Errorf("AuthCertificate = %v for a plain key", cert)
+	}
+	if _, err := client.ReplaceBeforeCertExpiry(context.Background(), time.Minute, nil); err == nil {
+		t.Error("ReplaceBeforeCertExpiry succeeded without a certificate")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -283,8 +284,52 @@ type CertChecker struct {
 	// is revoked and false otherwise. If nil, no certificates are
 	// considered to have been revoked.
 	IsRevoked func(cert *Certificate) bool
+
+	// AuthorizedPrincipals, if non-nil, returns the principals
+	// that may log in as user, as with sshd's
+	// AuthorizedPrincipalsFile, see AuthorizedPrincipalsFile.
+	// A user certificate must then list one of them, rather than
+	// the user name, and the options of the first one listed
+	// restrict the Permissions returned by Authenticate; the
+	// environment, permitopen, permitlisten and tunnel options
+	// are passed on as critical options, and must be listed in
+	// SupportedCriticalOptions. If it returns nil, the user name
+	// is checked as usual.
+	AuthorizedPrincipals func(user string) ([]AuthorizedPrincipal, error)
+
+	// CriticalOptionValidators check critical options by name, and
+	// count them as supported, as if listed in
+	// SupportedCriticalOptions.
+	CriticalOptionValidators map[string]CertOptionValidator
+
+	// ExtensionValidators check extensions by name. Extensions
+	// without one are accepted as they are.
+	ExtensionValidators map[string]CertOptionValidator
+
+	// HostPrincipalWildcards lets the principals of host
+	// certificates be patterns, as OpenSSH does, in which '*'
+	// matches any run of characters, dots included, and '?' any
+	// one character, so that a CA can issue one certificate for
+	// "*.region.internal".
+	HostPrincipalWildcards bool
+
+	// HostNames, if non-nil, returns the names of the host at addr
+	// that CheckHostKey looks for among the principals of its
+	// certificate, any one of them being enough, such as its
+	// short and fully qualified names, or an alias, as with the
+	// HostKeyAlias of ssh_config. Otherwise the host part of addr
+	// is used. Names are matched without regard to case.
+	HostNames func(addr string) []string
 }
 
+// A CertOptionValidator checks the value of a critical option or an
+// extension that a certificate has. An error rejects the
+// certificate; otherwise the parsed value, if not nil, is put in the
+// CertValues of the Permissions that CertChecker.Authenticate
+// returns. Validators only run for certificates whose other checks,
+// the signature among them, have passed.
+type CertOptionValidator func(cert *Certificate, value string) (parsed interface{}, err error)
+
 // CheckHostKey checks a host key certificate. This method can be
 // plugged into ClientConfig.HostKeyCallback.
 func (c *CertChecker) CheckHostKey(addr string, remote net.Addr, key PublicKey) error {
@@ -302,13 +347,50 @@ func (c *CertChecker) CheckHostKey(addr string, remote net.Addr, key PublicKey)
 		return fmt.Errorf("ssh: no authorities for hostname: %v", addr)
 	}
 
-	hostname, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
+	// Host certificates name hosts without ports, as OpenSSH's do.
+	names := []string{certHostname(addr)}
+	if c.HostNames != nil {
+		names = c.HostNames(addr)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("ssh: no hostnames for %v", addr)
+	}
+	principal := names[0]
+	if len(cert.ValidPrincipals) > 0 {
+		var ok bool
+		if principal, ok = c.matchHostPrincipal(names, cert); !ok {
+			return fmt.Errorf("ssh: hostnames %q not in the set of valid principals for given certificate: %q", names, cert.ValidPrincipals)
+		}
+	}
+	return c.CheckCert(principal, cert)
+}
+
+// certHostname returns the host part of addr, without its port, if
+// it has one, or brackets.
+func certHostname(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
 
-	// Pass hostname only as principal for host certificates (consistent with OpenSSH)
-	return c.CheckCert(hostname, cert)
+// matchHostPrincipal returns the first principal of cert that one of
+// names matches. A principal with wildcards matches no name unless
+// they are allowed, not even itself.
+func (c *CertChecker) matchHostPrincipal(names []string, cert *Certificate) (string, bool) {
+	for _, p := range cert.ValidPrincipals {
+		pattern := strings.ContainsAny(p, "*?")
+		if pattern && !c.HostPrincipalWildcards {
+			continue
+		}
+		for _, name := range names {
+			if pattern && hostPatternMatch(strings.ToLower(p), strings.ToLower(name)) ||
+				!pattern && strings.EqualFold(p, name) {
+				return p, true
+			}
+		}
+	}
+	return "", false
 }
 
 // Authenticate checks a user certificate. Authenticate can be used as
@@ -329,18 +411,55 @@ func (c *CertChecker) Authenticate(conn ConnMetadata, pubKey PublicKey) (*Permis
 		return nil, fmt.Errorf("ssh: certificate signed by unrecognized authority")
 	}
 
-	if err := c.CheckCert(conn.User(), cert); err != nil {
+	principal := conn.User()
+	var authorized *AuthorizedPrincipal
+	if c.AuthorizedPrincipals != nil {
+		ps, err := c.AuthorizedPrincipals(conn.User())
+		if err != nil {
+			return nil, err
+		}
+		if ps != nil {
+			if authorized = matchPrincipal(ps, cert); authorized == nil {
+				return nil, fmt.Errorf("ssh: no authorized principal for %q in certificate: %q", conn.User(), cert.ValidPrincipals)
+			}
+			principal = authorized.Name
+		}
+	}
+
+	values, err := c.checkCert(principal, cert)
+	if err != nil {
 		return nil, err
 	}
+	perms := &cert.Permissions
+	if values != nil {
+		withValues := cert.Permissions
+		withValues.CertValues = values
+		perms = &withValues
+	}
 
-	return &cert.Permissions, nil
+	if authorized != nil {
+		clock := c.Clock
+		if clock == nil {
+			clock = time.Now
+		}
+		return authorized.permissions(conn, perms, clock(), c.SupportedCriticalOptions)
+	}
+	return perms, nil
 }
 
 // CheckCert checks CriticalOptions, ValidPrincipals, revocation, timestamp and
-// the signature of the certificate.
+// the signature of the certificate, and runs the validators of its
+// critical options and extensions.
 func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
+	_, err := c.checkCert(principal, cert)
+	return err
+}
+
+// checkCert is CheckCert, returning the values parsed by the
+// validators, or nil if there are none.
+func (c *CertChecker) checkCert(principal string, cert *Certificate) (map[string]interface{}, error) {
 	if c.IsRevoked != nil && c.IsRevoked(cert) {
-		return fmt.Errorf("ssh: certicate serial %d revoked", cert.Serial)
+		return nil, fmt.Errorf("ssh: certicate serial %d revoked", cert.Serial)
 	}
 
 	for opt, _ := range cert.CriticalOptions {
@@ -350,7 +469,7 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 			continue
 		}
 
-		found := false
+		found := c.CriticalOptionValidators[opt] != nil
 		for _, supp := range c.SupportedCriticalOptions {
 			if supp == opt {
 				found = true
@@ -358,7 +477,7 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 			}
 		}
 		if !found {
-			return fmt.Errorf("ssh: unsupported critical option %q in certificate", opt)
+			return nil, fmt.Errorf("ssh: unsupported critical option %q in certificate", opt)
 		}
 	}
 
@@ -372,7 +491,7 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 			}
 		}
 		if !found {
-			return fmt.Errorf("ssh: principal %q not in the set of valid principals for given certificate: %q", principal, cert.ValidPrincipals)
+			return nil, fmt.Errorf("ssh: principal %q not in the set of valid principals for given certificate: %q", principal, cert.ValidPrincipals)
 		}
 	}
 
@@ -383,16 +502,42 @@ func (c *CertChecker) CheckCert(principal string, cert *Certificate) error {
 
 	unixNow := clock().Unix()
 	if after := int64(cert.ValidAfter); after < 0 || unixNow < int64(cert.ValidAfter) {
-		return fmt.Errorf("ssh: cert is not yet valid")
+		return nil, fmt.Errorf("ssh: cert is not yet valid")
 	}
 	if before := int64(cert.ValidBefore); cert.ValidBefore != uint64(CertTimeInfinity) && (unixNow >= before || before < 0) {
-		return fmt.Errorf("ssh: cert has expired")
+		return nil, fmt.Errorf("ssh: cert has expired")
 	}
 	if err := cert.SignatureKey.Verify(cert.bytesForSigning(), cert.Signature); err != nil {
-		return fmt.Errorf("ssh: certificate signature does not verify")
+		return nil, fmt.Errorf("ssh: certificate signature does not verify")
 	}
 
-	return nil
+	var values map[string]interface{}
+	validate := func(kind string, validators map[string]CertOptionValidator, options map[string]string) error {
+		for name, value := range options {
+			v := validators[name]
+			if v == nil {
+				continue
+			}
+			parsed, err := v(cert, value)
+			if err != nil {
+				return fmt.Errorf("ssh: certificate %s %q rejected: %v", kind, name, err)
+			}
+			if parsed != nil {
+				if values == nil {
+					values = make(map[string]interface{})
+				}
+				values[name] = parsed
+			}
+		}
+		return nil
+	}
+	if err := validate("critical option", c.CriticalOptionValidators, cert.CriticalOptions); err != nil {
+		return nil, err
+	}
+	if err := validate("extension", c.ExtensionValidators, cert.Extensions); err != nil {
+		return nil, err
+	}
+	return values, nil
 }
 
 // SignCert sets c.SignatureKey to the authority's public key and stores a
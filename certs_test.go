@@ -8,7 +8,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -162,6 +168,61 @@ func TestValidateCertTime(t *testing.T) {
 	}
 }
 
+func TestCertCheckerHostPrincipals(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	cert := &Certificate{
+		ValidPrincipals: []string{"*.Region.internal", "db?.example.com", "bastion"},
+		Key:             testPublicKeys["rsa"],
+		ValidBefore:     CertTimeInfinity,
+		CertType:        HostCert,
+	}
+	cert.SignCert(rand.Reader, testSigners["ecdsa"])
+	isCA := func(p PublicKey, addr string) bool {
+		return bytes.Equal(testPublicKeys["ecdsa"].Marshal(), p.Marshal())
+	}
+
+	for _, test := range []struct {
+		addr      string
+		wildcards bool
+		succeed   bool
+	}{
+		{addr: "bastion:22", succeed: true},
+		{addr: "BASTION:2222", succeed: true},
+		{addr: "bastion", succeed: true},
+		{addr: "[bastion]", succeed: true},
+		{addr: "web1.region.internal:22", succeed: false},
+		{addr: "web1.region.internal:22", wildcards: true, succeed: true},
+		{addr: "a.b.region.internal:22", wildcards: true, succeed: true},
+		{addr: "region.internal:22", wildcards: true, succeed: false},
+		{addr: "db1.example.com:22", wildcards: true, succeed: true},
+		{addr: "db12.example.com:22", wildcards: true, succeed: false},
+		{addr: "*.region.internal:22", succeed: false},
+		{addr: "other:22", wildcards: true, succeed: false},
+	} {
+		checker := &CertChecker{IsHostAuthority: isCA, HostPrincipalWildcards: test.wildcards}
+		err := checker.CheckHostKey(test.addr, nil, cert)
+		if (err == nil) != test.succeed {
+			t.Errorf("CheckHostKey(%q) with wildcards %v: %v", test.addr, test.wildcards, err)
+		}
+	}
+
+	// HostNames replaces the host part of the address.
+	checker := &CertChecker{
+		IsHostAuthority: isCA,
+		HostNames: func(addr string) []string {
+			return []string{"10.0.0.5", "bastion"}
+		},
+	}
+	if err := checker.CheckHostKey("10.0.0.5:22", nil, cert); err != nil {
+		t.Errorf("CheckHostKey with HostNames: %v", err)
+	}
+	checker.HostNames = func(addr string) []string { return nil }
+	if err := checker.CheckHostKey("bastion:22", nil, cert); err == nil {
+		t.Error("CheckHostKey without names succeeded")
+	}
+}
+
 // TODO(hanwen): tests for
 //
 // host keys:
@@ -240,3 +301,205 @@ func TestHostKeyCert(t *testing.T) {
 		}
 	}
 }
+
+// certConnMeta is the ConnMetadata of a login from 192.0.2.1.
+type certConnMeta struct{ user string }
+
+func (m certConnMeta) User() string          { return m.user }
+func (m certConnMeta) SessionID() []byte     { return nil }
+func (m certConnMeta) ClientVersion() []byte { return nil }
+func (m certConnMeta) ServerVersion() []byte { return nil }
+func (m certConnMeta) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+}
+func (m certConnMeta) LocalAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22} }
+
+func TestParseAuthorizedPrincipals(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	ps, err := ParseAuthorizedPrincipals([]byte(`# admins
+alice
+from="10.0.0.0/8,192.0.2.0/24",command="echo \"hi\"",no-pty deploy
+
+restrict,pty   ops
+`))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedPrincipals: %v", err)
+	}
+	want := []AuthorizedPrincipal{
+		{Name: "alice"},
+		{Name: "deploy", Options: []string{`from="10.0.0.0/8,192.0.2.0/24"`, `command="echo \"hi\""`, "no-pty"}},
+		{Name: "ops", Options: []string{"restrict", "pty"}},
+	}
+	if !reflect.DeepEqual(ps, want) {
+		t.Errorf("got %q, want %q", ps, want)
+	}
+
+	if _, err := ParseAuthorizedPrincipals([]byte(`command="unterminated deploy`)); err == nil {
+		t.Error("accepted an unmatched quote")
+	}
+	if _, err := ParseAuthorizedPrincipals([]byte("no-pty two words")); err == nil {
+		t.Error("accepted a principal with a space")
+	}
+}
+
+func TestCertCheckerAuthorizedPrincipals(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	dir, err := ioutil.TempDir("", "principals")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	contents := "root-admins\nfrom=\"10.0.0.0/8\" intranet\nno-pty,command=\"backup\" backup\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "root"), []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	checker := &CertChecker{
+		IsUserAuthority: func(k PublicKey) bool {
+			return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		SupportedCriticalOptions: []string{"force-command"},
+		AuthorizedPrincipals:     AuthorizedPrincipalsFile(filepath.Join(dir, "%u")),
+	}
+	cert := func(principals ...string) *Certificate {
+		c := &Certificate{
+			CertType:        UserCert,
+			ValidPrincipals: principals,
+			Key:             testPublicKeys["rsa"],
+			ValidBefore:     CertTimeInfinity,
+			Permissions: Permissions{
+				Extensions: map[string]string{"permit-pty": "", "permit-port-forwarding": ""},
+			},
+		}
+		c.SignCert(rand.Reader, testSigners["ecdsa"])
+		return c
+	}
+
+	for _, tt := range []struct {
+		user       string
+		principals []string
+		ok         bool
+	}{
+		{"root", []string{"root-admins"}, true},
+		{"root", []string{"root"}, false},     // the file replaces the user name
+		{"root", []string{"intranet"}, false}, // from= does not match
+		{"bob", []string{"bob"}, true},        // no file for bob
+		{"bob", []string{"root-admins"}, false},
+	} {
+		_, err := checker.Authenticate(certConnMeta{tt.user}, cert(tt.principals...))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s with %q: got %v, want ok=%v", tt.user, tt.principals, err, tt.ok)
+		}
+	}
+
+	perms, err := checker.Authenticate(certConnMeta{"root"}, cert("backup"))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if _, ok := perms.Extensions["permit-pty"]; ok {
+		t.Error("no-pty did not remove permit-pty")
+	}
+	if _, ok := perms.Extensions["permit-port-forwarding"]; !ok {
+		t.Error("permit-port-forwarding lost")
+	}
+	if perms.CriticalOptions["force-command"] != "backup" {
+		t.Errorf("got critical options %v, want force-command", perms.CriticalOptions)
+	}
+
+	if _, err := checker.Authenticate(certConnMeta{"../etc"}, cert("x")); err == nil {
+		t.Error("user name with a slash accepted")
+	}
+}
+
+func TestAuthorizedPrincipalOptions(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	supported := []string{"permitopen", "environment"}
+	for _, tt := range []struct {
+		options []string
+		ok      bool
+		want    map[string]string
+	}{
+		{[]string{`expiry-time="20200601Z"`}, false, nil},
+		{[]string{`expiry-time="202006021200Z"`}, true, map[string]string{}},
+		{[]string{`expiry-time="2020"`}, false, nil},
+		{[]string{`from="192.0.2.*"`}, true, map[string]string{}},
+		{[]string{`from="192.0.2.?"`}, true, map[string]string{}},
+		{[]string{`from="!192.0.2.1,192.0.2.0/24"`}, false, nil},
+		{[]string{`from="*.example.com"`}, false, nil},
+		{[]string{`permitlisten="8080"`}, false, nil},
+		{[]string{`permitopen="db:5432"`, `permitopen="cache:6379"`}, true, map[string]string{"permitopen": "db:5432,cache:6379"}},
+		{[]string{`environment="A=1"`, `environment="B=2,3"`}, true, map[string]string{"environment": "A=1\nB=2,3"}},
+	} {
+		p := &AuthorizedPrincipal{Name: "ops", Options: tt.options}
+		perms, err := p.permissions(certConnMeta{"root"}, &Permissions{}, now, supported)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got %v, want ok=%v", tt.options, err, tt.ok)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(perms.CriticalOptions, tt.want) {
+			t.Errorf("%q: got critical options %v, want %v", tt.options, perms.CriticalOptions, tt.want)
+		}
+	}
+}
+
+func TestCertCheckerOptionValidators(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	checker := &CertChecker{
+		IsUserAuthority: func(k PublicKey) bool {
+			return bytes.Equal(k.Marshal(), testPublicKeys["ecdsa"].Marshal())
+		},
+		CriticalOptionValidators: map[string]CertOptionValidator{
+			"max-sessions@example.com": func(cert *Certificate, value string) (interface{}, error) {
+				return strconv.Atoi(value)
+			},
+		},
+		ExtensionValidators: map[string]CertOptionValidator{
+			"team@example.com": func(cert *Certificate, value string) (interface{}, error) {
+				if value == "" {
+					return nil, errors.New("no team")
+				}
+				return nil, nil
+			},
+		},
+	}
+	cert := func(options, extensions map[string]string) *Certificate {
+		c := &Certificate{
+			CertType:    UserCert,
+			Key:         testPublicKeys["rsa"],
+			ValidBefore: CertTimeInfinity,
+			Permissions: Permissions{CriticalOptions: options, Extensions: extensions},
+		}
+		c.SignCert(rand.Reader, testSigners["ecdsa"])
+		return c
+	}
+
+	c := cert(map[string]string{"max-sessions@example.com": "3"}, map[string]string{"team@example.com": "ops"})
+	perms, err := checker.Authenticate(certConnMeta{"gopher"}, c)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if want := map[string]interface{}{"max-sessions@example.com": 3}; !reflect.DeepEqual(perms.CertValues, want) {
+		t.Errorf("CertValues = %v, want %v", perms.CertValues, want)
+	}
+	if c.Permissions.CertValues != nil {
+		t.Error("Authenticate changed the Permissions of the certificate")
+	}
+
+	for _, c := range []*Certificate{
+		cert(map[string]string{"max-sessions@example.com": "many"}, nil),
+		cert(nil, map[string]string{"team@example.com": ""}),
+		cert(map[string]string{"verify-required": ""}, nil),
+	} {
+		if _, err := checker.Authenticate(certConnMeta{"gopher"}, c); err == nil {
+			t.Errorf("certificate with %v and %v accepted", c.CriticalOptions, c.Extensions)
+		}
+	}
+	if _, err := checker.Authenticate(certConnMeta{"gopher"}, cert(nil, map[string]string{"permit-pty": ""})); err != nil {
+		t.Errorf("extension without a validator: %v", err)
+	}
+}
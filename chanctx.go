@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"context"
+)
+
+// channelLifetimeKey marks the contexts of WithChannelLifetime.
+type channelLifetimeKey struct{}
+
+// WithChannelLifetime returns a copy of ctx that, passed to
+// OpenChannel or NewSession, bounds the life of the channel it opens
+// as well as the open: once ctx is done, the channel is closed, and
+// its pending and later reads and writes fail with ctx.Err(). Without
+// it, ctx only bounds the open, as the ctx of net.Dialer.DialContext
+// bounds a dial.
+func WithChannelLifetime(ctx context.Context) context.Context {
+	return context.WithValue(ctx, channelLifetimeKey{}, true)
+}
+
+// hasChannelLifetime reports whether ctx came from
+// WithChannelLifetime.
+func hasChannelLifetime(ctx context.Context) bool {
+	on, _ := ctx.Value(channelLifetimeKey{}).(bool)
+	return on
+}
+
+// closeWhenDone closes c once ctx is done, unless c is closed first.
+func (c *channel) closeWhenDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-c.halt.ReqStopChan():
+		return
+	}
+	c.ctxMu.Lock()
+	c.ctxErr = ctx.Err()
+	c.ctxMu.Unlock()
+	c.Close()
+	// Unblock readers and writers now, rather than when the peer
+	// answers the close.
+	c.pending.eof()
+	c.extPending.eof()
+	c.extStreamsDo((*buffer).eof, true)
+	c.remoteWin.close()
+}
+
+// lifetimeErr returns err, or ctx.Err() of the context that closed
+// c, if err is not nil and there is one.
+func (c *channel) lifetimeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	if c.ctxErr != nil {
+		return c.ctxErr
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestWithChannelLifetime(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	c, s := muxPair(halt)
+	defer c.Close()
+	defer s.Close()
+
+	accepted := make(chan Channel, 2)
+	go func() {
+		for newCh := range s.incomingChannels {
+			ch, _, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			accepted <- ch
+		}
+	}()
+
+	// A plain ctx only bounds the open.
+	ctx, cancel := context.WithCancel(context.Background())
+	plain, err := c.openChannel(ctx, "chan", nil, nil)
+	if err != nil {
+		t.Fatalf("openChannel: %v", err)
+	}
+	peer := <-accepted
+	cancel()
+	if _, err := plain.Write([]byte("x")); err != nil {
+		t.Fatalf("Write after cancel of a plain ctx: %v", err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(peer, b[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	bound, err := c.openChannel(WithChannelLifetime(ctx), "chan", nil, nil)
+	if err != nil {
+		t.Fatalf("openChannel: %v", err)
+	}
+	peer = <-accepted
+	read := make(chan error, 1)
+	go func() {
+		_, err := bound.Read(b[:])
+		read <- err
+	}()
+	cancel()
+	if err := <-read; err != context.Canceled {
+		t.Errorf("pending Read: %v, want %v", err, context.Canceled)
+	}
+	if _, err := bound.Write([]byte("x")); err != context.Canceled {
+		t.Errorf("Write: %v, want %v", err, context.Canceled)
+	}
+	if _, err := peer.Read(b[:]); err != io.EOF {
+		t.Errorf("Read of the peer: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"context"
+	"time"
+)
+
+// ChannelKeepalive checks that the peer of a channel is still there,
+// as the ClientAliveInterval of sshd does for sessions: when nothing
+// has been received on the channel for an Interval, it sends a
+// "keepalive@openssh.com" channel request that wants a reply. Any
+// reply, even a failure, counts. This finds a peer that lost a
+// channel, or a program behind it that hung, while the connection
+// itself is kept alive by the traffic of other channels.
+type ChannelKeepalive struct {
+	// Interval is how long the channel may be idle before a
+	// keepalive is sent. If zero, it is 15 seconds.
+	Interval time.Duration
+
+	// Timeout bounds the wait for the reply to a keepalive. If
+	// zero, it is 15 seconds.
+	Timeout time.Duration
+
+	// OnReply, if non-nil, is called with the round trip time of
+	// each keepalive answered.
+	OnReply func(rtt time.Duration)
+
+	// Clock, if non-nil, replaces package time; it is meant for
+	// tests.
+	Clock Clock
+}
+
+func (k *ChannelKeepalive) clock() Clock {
+	if k.Clock == nil {
+		return realClock{}
+	}
+	return k.Clock
+}
+
+// Run sends keepalives on ch while it is idle, until ctx is done, ch
+// is closed, or a keepalive is not answered within Timeout. It
+// returns ctx.Err(), nil, or ErrChannelKeepalive, in that order; it
+// does not close ch. As only one request that wants a reply can be
+// pending on a channel, requests of others that want replies wait
+// for a keepalive to be answered.
+func (k *ChannelKeepalive) Run(ctx context.Context, ch Channel) error {
+	interval := k.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	timeout := k.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	clock := k.clock()
+
+	// The read idle timer of ch notes every packet received, so a
+	// tick that finds its mark unchanged follows an idle Interval.
+	idle := ch.GetReadIdleTimer()
+	lastOK := func() int64 {
+		if idle == nil {
+			return 0
+		}
+		ok, _, _ := idle.LastOKLastStartAndMonoNow()
+		return ok
+	}
+	seen := lastOK()
+
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ch.Done():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if now := lastOK(); idle != nil && now != seen {
+			seen = now
+			continue
+		}
+
+		begin := clock.Now()
+		replied := make(chan error, 1)
+		go func() {
+			_, err := ch.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		timer := clock.NewTimer(timeout)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				// ch was closed.
+				return nil
+			}
+			if k.OnReply != nil {
+				k.OnReply(clock.Now().Sub(begin))
+			}
+		case <-timer.C():
+			return ErrChannelKeepalive
+		case <-ch.Done():
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		seen = lastOK()
+	}
+}
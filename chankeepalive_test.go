@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChannelKeepalive(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	a, b, mux := channelPair(t, halt)
+	defer mux.Close()
+	defer b.Close()
+	defer a.Close()
+
+	var answer int32 = 1
+	received := make(chan string, 10)
+	go func() {
+		for req := range b.incomingRequests {
+			received <- req.Type
+			if atomic.LoadInt32(&answer) != 0 {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	clock := NewFakeClock(time.Now())
+	replies := make(chan time.Duration, 10)
+	k := &ChannelKeepalive{
+		Interval: time.Minute,
+		Timeout:  10 * time.Second,
+		OnReply:  func(rtt time.Duration) { replies <- rtt },
+		Clock:    clock,
+	}
+	done := make(chan error, 1)
+	go func() { done <- k.Run(context.Background(), a) }()
+
+	// An idle channel gets a keepalive, and a refusal counts as a
+	// reply.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	select {
+	case typ := <-received:
+		if typ != "keepalive@openssh.com" {
+			t.Errorf("got request %q", typ)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no keepalive on an idle channel")
+	}
+	select {
+	case <-replies:
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnReply not called")
+	}
+
+	// A channel that received data in the interval does not.
+	if _, err := b.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(a, make([]byte, 1)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	clock.Advance(time.Minute)
+	select {
+	case typ := <-received:
+		t.Errorf("got request %q on a busy channel", typ)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A keepalive that is not answered in time ends Run.
+	atomic.StoreInt32(&answer, 0)
+	clock.Advance(time.Minute)
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no keepalive on an idle channel")
+	}
+	clock.BlockUntil(2)
+	clock.Advance(10 * time.Second)
+	select {
+	case err := <-done:
+		if err != ErrChannelKeepalive {
+			t.Errorf("Run: got %v, want ErrChannelKeepalive", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
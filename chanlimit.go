@@ -0,0 +1,108 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+)
+
+// ChannelOpenLimit caps the channel opens of the peer, to protect a
+// server from being flooded with them. Opens over a limit are
+// rejected with ResourceShortage. It is set as
+// Config.ChannelOpenLimit; connections that share one share
+// MaxPendingTotal, the other limits apply to each connection. Zero
+// fields are unlimited. The limits must not be changed once the
+// ChannelOpenLimit is in use.
+type ChannelOpenLimit struct {
+	// MaxPending caps the channels the peer opened that are not
+	// yet accepted or rejected.
+	MaxPending int
+
+	// MaxPendingTotal caps the pending channels of all the
+	// connections that share the ChannelOpenLimit.
+	MaxPendingTotal int
+
+	// PerSecond caps the rate of channel opens, in bursts of up
+	// to Burst, or one second's worth if Burst is zero.
+	PerSecond float64
+	Burst     int
+
+	mu    sync.Mutex
+	total int
+}
+
+// errTooManyPending and errOpenRate are the messages of the
+// rejections of a ChannelOpenLimit.
+var (
+	errTooManyPending = errors.New("ssh: too many pending channel opens")
+	errOpenRate       = errors.New("ssh: channel opens too fast")
+)
+
+// openLimiter applies a ChannelOpenLimit to one connection.
+type openLimiter struct {
+	limit *ChannelOpenLimit
+	clock Clock
+
+	// rate, if non-nil, holds a token for each channel open
+	// allowed by PerSecond.
+	rate *RateLimiter
+
+	mu      sync.Mutex
+	pending int
+}
+
+func newOpenLimiter(limit *ChannelOpenLimit, clock Clock) *openLimiter {
+	if limit == nil {
+		return nil
+	}
+	o := &openLimiter{limit: limit, clock: clock}
+	if limit.PerSecond > 0 {
+		burst := float64(limit.Burst)
+		if burst <= 0 {
+			burst = limit.PerSecond
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		o.rate = newRateLimiter(limit.PerSecond, burst)
+	}
+	return o
+}
+
+// acquire admits a channel open, and returns the function to call
+// once it is accepted or rejected, which may be called more than
+// once.
+func (o *openLimiter) acquire() (done func(), err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l := o.limit
+	if l.MaxPending > 0 && o.pending >= l.MaxPending {
+		return nil, errTooManyPending
+	}
+
+	// A rate token is only taken if the pending limits admit
+	// the open.
+	l.mu.Lock()
+	if l.MaxPendingTotal > 0 && l.total >= l.MaxPendingTotal {
+		l.mu.Unlock()
+		return nil, errTooManyPending
+	}
+	if o.rate != nil && !o.rate.allow(1, o.clock) {
+		l.mu.Unlock()
+		return nil, errOpenRate
+	}
+	l.total++
+	l.mu.Unlock()
+	o.pending++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			o.mu.Lock()
+			o.pending--
+			o.mu.Unlock()
+			l.mu.Lock()
+			l.total--
+			l.mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wantShortage checks that err rejects a channel open with
+// ResourceShortage.
+func wantShortage(t *testing.T, err error) {
+	var ocf *OpenChannelError
+	if !errors.As(err, &ocf) || ocf.Reason != ResourceShortage {
+		t.Errorf("openChannel: got %v, want ResourceShortage", err)
+	}
+}
+
+func TestChannelOpenLimitPending(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client, server := muxPairConfig(halt, &Config{
+		MaxChannelPacket: channelMaxPacket,
+		ChannelOpenLimit: &ChannelOpenLimit{MaxPending: 2},
+	})
+	defer server.Close()
+	defer client.Close()
+	ctx := context.Background()
+
+	opened := make(chan error, 3)
+	open := func() {
+		_, err := client.openChannel(ctx, "chan", nil, nil)
+		opened <- err
+	}
+	go open()
+	go open()
+	var pending []NewChannel
+	for i := 0; i < 2; i++ {
+		pending = append(pending, <-server.incomingChannels)
+	}
+	_, err := client.openChannel(ctx, "chan", nil, nil)
+	wantShortage(t, err)
+
+	// Deciding on a channel frees its slot.
+	pending[0].Reject(Prohibited, "no")
+	if _, _, err := pending[1].Accept(); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		<-opened
+	}
+	go open()
+	nc := <-server.incomingChannels
+	nc.Accept()
+	if err := <-opened; err != nil {
+		t.Errorf("openChannel after the others were decided: %v", err)
+	}
+}
+
+func TestChannelOpenLimitRate(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	clock := NewFakeClock(time.Unix(0, 0))
+	client, server := muxPairConfig(halt, &Config{
+		MaxChannelPacket: channelMaxPacket,
+		Clock:            clock,
+		ChannelOpenLimit: &ChannelOpenLimit{PerSecond: 1},
+	})
+	defer server.Close()
+	defer client.Close()
+	go func() {
+		for nc := range server.incomingChannels {
+			nc.Accept()
+		}
+	}()
+	ctx := context.Background()
+
+	if _, err := client.openChannel(ctx, "chan", nil, nil); err != nil {
+		t.Fatalf("first openChannel: %v", err)
+	}
+	_, err := client.openChannel(ctx, "chan", nil, nil)
+	wantShortage(t, err)
+	clock.Advance(time.Second)
+	if _, err := client.openChannel(ctx, "chan", nil, nil); err != nil {
+		t.Errorf("openChannel a second later: %v", err)
+	}
+}
@@ -22,17 +22,85 @@ const (
 	// sent in a single packet. As per RFC 4253, section 6.1, 32k is also
 	// the minimum.
 	channelMaxPacket = 1 << 15
-	// We follow OpenSSH here.
+	// maxChannelPayload is the most channel data a packet may
+	// carry, leaving room in maxPacket for the message header, the
+	// padding, and any growth from compressing incompressible data.
+	maxChannelPayload = maxPacket - 4096
+	// channelWindowSize is the default Config.ChannelWindow; we
+	// follow OpenSSH here.
 	channelWindowSize = 64 * channelMaxPacket
+	// maxExtendedStreams caps the extended data streams, other
+	// than stderr, that a channel keeps the data of.
+	maxExtendedStreams = 16
 )
 
 // verify interface satisfied.
 var _ net.Conn = &channel{}
+var _ RateLimited = &channel{}
+var _ ExtendedStreams = &channel{}
+var _ HasWindowStats = &channel{}
+var _ SliceReader = &channel{}
 
 type HasTimeout interface {
 	timeout()
 }
 
+// SliceReader, if implemented by a Channel, hands out the data it
+// received without copying it into a buffer of the caller, for
+// proxies and other high-throughput readers. The channels of this
+// package implement it.
+type SliceReader interface {
+	// ReadSlice returns the next segment of the data received,
+	// at most a packet's worth, blocking as Read does if there is
+	// none. The slice belongs to the channel, and is only valid
+	// until the next call to ReadSlice or Read. The two may be
+	// mixed.
+	ReadSlice() ([]byte, error)
+}
+
+// WindowStats tells how much a channel was held up by flow control,
+// so that slow transfers can be put down to it or to the network.
+type WindowStats struct {
+	// WriteStalls counts the writes that waited for the peer to
+	// grow its window, and WriteStallTime is how long they
+	// waited in all.
+	WriteStalls    int64
+	WriteStallTime time.Duration
+
+	// PeerStalls counts the times the peer used up our window, so
+	// that it had to wait for data to be read, and PeerStallTime
+	// is how long it waited in all, until the window was grown.
+	PeerStalls    int64
+	PeerStallTime time.Duration
+}
+
+// HasWindowStats, if implemented by a Channel, reports its flow
+// control stalls so far. The channels of this package implement it.
+type HasWindowStats interface {
+	WindowStats() WindowStats
+}
+
+// ExtendedStreams, if implemented by a Channel, gives access to the
+// extended data streams of any type code, for channel protocols that
+// multiplex control data besides stderr, which is code 1. The
+// channels of this package implement it, for example:
+//
+//	if x, ok := ch.(ssh.ExtendedStreams); ok {
+//		control := x.Extended(2)
+//		...
+//	}
+type ExtendedStreams interface {
+	// Extended returns an io.ReadWriter that sends and receives
+	// the data of the given extended type code, or of the main
+	// stream for code 0. Like Stderr, it may be used from its own
+	// goroutine. Received data is kept until read, for stderr and
+	// for up to 16 other codes, which counts against the window,
+	// so a stream that is not read eventually stalls the channel.
+	// Data of codes beyond the first 16 is discarded, and reads of
+	// them fail.
+	Extended(code uint32) io.ReadWriter
+}
+
 // NewChannel represents an incoming request to a channel. It must either be
 // accepted for use by calling Accept, or rejected by calling Reject.
 type NewChannel interface {
@@ -84,7 +152,8 @@ type Channel interface {
 	// Stderr returns an io.ReadWriter that writes to this channel
 	// with the extended data type set to stderr. Stderr may
 	// safely be read and written from a different goroutine than
-	// Read and Write respectively.
+	// Read and Write respectively. See ExtendedStreams for other
+	// extended data types.
 	Stderr() io.ReadWriter
 
 	// Done can be used to await connection shutdown. The
@@ -181,6 +250,11 @@ type Request struct {
 
 	ch  *channel
 	mux *mux
+
+	// originalCommand and forced record what force-command
+	// replaced, see OriginalCommand.
+	originalCommand string
+	forced          bool
 }
 
 // Reply sends a response to a request. It must be called for all requests
@@ -280,9 +354,22 @@ type channel struct {
 	pending    *buffer
 	extPending *buffer
 
-	// windowMu protects myWindow, the flow-control window.
-	windowMu sync.Mutex
-	myWindow uint32
+	// extMu protects extStreams, the buffers of extended data
+	// other than stderr, created as data or readers arrive, and
+	// extEOF, which is set once they are all at EOF.
+	extMu      sync.Mutex
+	extStreams map[uint32]*buffer
+	extEOF     bool
+
+	// windowMu protects myWindow, the flow-control window, and
+	// the peer stalls: peerStalls counts the times myWindow ran
+	// out, the last one at exhausted, and peerStallTime is the
+	// time until it was grown again.
+	windowMu      sync.Mutex
+	myWindow      uint32
+	exhausted     time.Time
+	peerStalls    int64
+	peerStallTime time.Duration
 
 	// writeMu serializes calls to mux.conn.writePacket() and
 	// protects sentClose and packetPool. This mutex must be
@@ -313,6 +400,34 @@ type channel struct {
 	idleW *IdleTimer
 
 	halt *Halter
+
+	// release, if non-nil, gives back the Quota slot of the
+	// channel. It may be called more than once.
+	release func()
+
+	// decide, if non-nil, tells the ChannelOpenLimit of the
+	// connection that the channel is no longer pending. It may be
+	// called more than once.
+	decide func()
+
+	// audited is set if the open of the channel was audited, so
+	// that its close is too.
+	audited bool
+
+	// rate, if non-nil, meters the data read and written, for
+	// the Quota of the connection.
+	rate *RateLimiter
+
+	// limitMu protects readLimit and writeLimit, the limiters
+	// set with SetRateLimit.
+	limitMu    sync.Mutex
+	readLimit  *RateLimiter
+	writeLimit *RateLimiter
+
+	// ctxMu protects ctxErr, the error of the context of
+	// WithChannelLifetime that closed the channel.
+	ctxMu  sync.Mutex
+	ctxErr error
 }
 
 // writePacket sends a packet. If the packet is a channel close, it updates
@@ -332,6 +447,49 @@ func (c *channel) writePacket(packet []byte) error {
 	return err
 }
 
+// throttle waits until the limiters that apply to the channel let n
+// bytes through in the given direction.
+func (c *channel) throttle(n int, write bool) error {
+	c.limitMu.Lock()
+	own := c.readLimit
+	if write {
+		own = c.writeLimit
+	}
+	c.limitMu.Unlock()
+	conn := c.mux.rateLimit(write)
+	if c.rate == nil && own == nil && conn == nil {
+		return nil
+	}
+
+	// Data the peer sent before closing the channel is still
+	// metered as it is read, so reads only stop waiting with the
+	// connection.
+	stop := c.halt.ReqStopChan()
+	if !write {
+		stop = nil
+		if c.mux.halt != nil {
+			stop = c.mux.halt.ReqStopChan()
+		}
+	}
+	for _, r := range [...]*RateLimiter{c.rate, own, conn} {
+		if r == nil {
+			continue
+		}
+		if err := r.wait(n, stop, c.mux.clock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRateLimit implements RateLimited. The limits apply on top of
+// any limits of the connection.
+func (c *channel) SetRateLimit(read, write *RateLimiter) {
+	c.limitMu.Lock()
+	c.readLimit, c.writeLimit = read, write
+	c.limitMu.Unlock()
+}
+
 func (c *channel) sendMessage(msg interface{}) error {
 	if debugMux {
 		log.Printf("send(%d): %#v", c.mux.chanList.offset, msg)
@@ -350,6 +508,7 @@ func (c *channel) WriteExtended(data []byte, extendedCode uint32) (n int, err er
 		if err == nil {
 			c.idleW.AttemptOK()
 		}
+		err = c.lifetimeErr(err)
 	}()
 	if c.sentEOF {
 		return 0, io.EOF
@@ -375,6 +534,9 @@ func (c *channel) WriteExtended(data []byte, extendedCode uint32) (n int, err er
 			return n, err
 		}
 		c.idleW.AttemptOK()
+		if err = c.throttle(int(space), true); err != nil {
+			return n, err
+		}
 		if want := headerLength + space; uint32(cap(packet)) < want {
 			packet = make([]byte, want)
 		} else {
@@ -443,24 +605,71 @@ func (c *channel) handleData(packet []byte) error {
 		return errors.New("ssh: remote side wrote too much")
 	}
 	c.myWindow -= length
+	if c.myWindow == 0 {
+		c.exhausted = time.Now()
+		c.peerStalls++
+	}
 	c.windowMu.Unlock()
 
-	if extended == 1 {
-		c.extPending.write(data)
-	} else if extended > 0 {
-		// discard other extended data.
-	} else {
+	if extended == 0 {
 		c.pending.write(data)
+	} else if buf := c.extBuffer(extended); buf != nil {
+		buf.write(data)
+	} else {
+		// Discard the data, but let the peer send more.
+		return c.adjustWindow(length)
 	}
 	return nil
 }
 
+// extBuffer returns the buffer of the extended data of the given
+// code, creating it if need be, or nil if there are too many.
+func (c *channel) extBuffer(code uint32) *buffer {
+	if code == 1 {
+		return c.extPending
+	}
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	if buf, ok := c.extStreams[code]; ok {
+		return buf
+	}
+	if len(c.extStreams) >= maxExtendedStreams {
+		return nil
+	}
+	buf := newBuffer(c.idleR)
+	if c.extEOF {
+		buf.eof()
+	}
+	if c.extStreams == nil {
+		c.extStreams = make(map[uint32]*buffer)
+	}
+	c.extStreams[code] = buf
+	return buf
+}
+
+// extStreamsDo calls f on the buffers of the extended data other
+// than stderr. If eof is set, buffers created later start at EOF.
+func (c *channel) extStreamsDo(f func(*buffer) error, eof bool) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	c.extEOF = c.extEOF || eof
+	for _, buf := range c.extStreams {
+		f(buf)
+	}
+}
+
 func (c *channel) adjustWindow(n uint32) error {
 	c.windowMu.Lock()
 	// Since myWindow is managed on our side, and can never exceed
 	// the initial window setting, we don't worry about overflow.
+	if c.myWindow == 0 && n > 0 {
+		c.peerStallTime += time.Since(c.exhausted)
+	}
 	c.myWindow += uint32(n)
 	c.windowMu.Unlock()
+	if n == 0 && c.mux.quirks&QuirkNoZeroWindowAdjust != 0 {
+		return nil
+	}
 	return c.sendMessage(windowAdjustMsg{
 		AdditionalBytes: uint32(n),
 	})
@@ -468,35 +677,57 @@ func (c *channel) adjustWindow(n uint32) error {
 
 func (c *channel) ReadExtended(data []byte, extended uint32) (n int, err error) {
 	c.idleR.BeginAttempt()
-	switch extended {
-	case 1:
-		n, err = c.extPending.Read(data)
-	case 0:
-		n, err = c.pending.Read(data)
-	default:
-		return 0, fmt.Errorf("ssh: extended code %d unimplemented", extended)
+	buf := c.pending
+	if extended > 0 {
+		if buf = c.extBuffer(extended); buf == nil {
+			return 0, fmt.Errorf("ssh: too many extended data streams for code %d", extended)
+		}
 	}
+	n, err = buf.Read(data)
 	if err == nil {
 		c.idleR.AttemptOK()
 	}
-
 	if n > 0 {
-		err = c.adjustWindow(uint32(n))
-		// sendWindowAdjust can return io.EOF if the remote
-		// peer has closed the connection, however we want to
-		// defer forwarding io.EOF to the caller of Read until
-		// the buffer has been drained.
-		if n > 0 && err == io.EOF {
-			err = nil
-		}
+		err = c.consumed(n)
 	}
+	return n, c.lifetimeErr(err)
+}
 
-	return n, err
+// ReadSlice implements SliceReader.
+func (c *channel) ReadSlice() ([]byte, error) {
+	c.idleR.BeginAttempt()
+	seg, err := c.pending.next()
+	if err == nil {
+		c.idleR.AttemptOK()
+	}
+	if len(seg) > 0 {
+		err = c.consumed(len(seg))
+	}
+	return seg, c.lifetimeErr(err)
+}
+
+// consumed gives the peer back the window for n bytes read.
+func (c *channel) consumed(n int) error {
+	// Holding back the window adjustment slows down
+	// the peer.
+	err := c.throttle(n, false)
+	if err == nil {
+		err = c.adjustWindow(uint32(n))
+	}
+	// sendWindowAdjust can return io.EOF if the remote
+	// peer has closed the connection, however we want to
+	// defer forwarding io.EOF to the caller of Read until
+	// the buffer has been drained.
+	if err == io.EOF {
+		err = nil
+	}
+	return err
 }
 
 func (c *channel) close() {
 	c.pending.eof()
 	c.extPending.eof()
+	c.extStreamsDo((*buffer).eof, true)
 	close(c.msg)
 	close(c.incomingRequests)
 	c.writeMu.Lock()
@@ -510,11 +741,21 @@ func (c *channel) close() {
 	c.halt.MarkDone()
 	c.idleR.Stop()
 	c.idleW.Stop()
+	if c.release != nil {
+		c.release()
+	}
+	if c.decide != nil {
+		c.decide()
+	}
+	if c.audited {
+		c.mux.audit(&AuditEvent{Type: AuditChannelClose, ChannelType: c.chanType})
+	}
 }
 
 func (c *channel) timeout() {
 	c.pending.timeout()
 	c.extPending.timeout()
+	c.extStreamsDo((*buffer).timeout, false)
 	// Unblock writers.
 	c.remoteWin.timeout()
 	mt, ok := c.mux.conn.(HasTimeout)
@@ -551,8 +792,22 @@ func (c *channel) handlePacket(packet []byte) error {
 		// RFC 4254 is mute on how EOF affects dataExt messages but
 		// it is logical to signal EOF at the same time.
 		c.extPending.eof()
+		c.extStreamsDo((*buffer).eof, true)
 		c.pending.eof()
 		return nil
+	case msgChannelWindowAdjust:
+		// Parsed in place, for it comes every few data packets.
+		var msg windowAdjustMsg
+		if err := msg.unmarshal(packet); err != nil {
+			return err
+		}
+		if !c.remoteWin.add(msg.AdditionalBytes) {
+			if c.mux.quirks&QuirkWindowOverflow == 0 {
+				return fmt.Errorf("ssh: invalid window update for %d bytes", msg.AdditionalBytes)
+			}
+			c.remoteWin.fill()
+		}
+		return nil
 	}
 
 	decoded, err := decode(packet)
@@ -587,7 +842,7 @@ func (c *channel) handlePacket(packet []byte) error {
 			return fmt.Errorf("ssh: invalid MaxPacketSize %d from peer", msg.MaxPacketSize)
 		}
 		c.remoteId = msg.MyId
-		c.maxRemotePayload = msg.MaxPacketSize
+		c.maxRemotePayload = min(maxChannelPayload, int(msg.MaxPacketSize))
 		c.remoteWin.add(msg.MyWindow)
 		select {
 		case c.msg <- msg:
@@ -596,17 +851,35 @@ func (c *channel) handlePacket(packet []byte) error {
 		case <-reqStopCh:
 			return io.EOF
 		}
-	case *windowAdjustMsg:
-		if !c.remoteWin.add(msg.AdditionalBytes) {
-			return fmt.Errorf("ssh: invalid window update for %d bytes", msg.AdditionalBytes)
-		}
 	case *channelRequestMsg:
+		c.mux.auditChannelRequest(c, msg.Request, msg.RequestSpecificData)
 		req := Request{
 			Type:      msg.Request,
 			WantReply: msg.WantReply,
 			Payload:   msg.RequestSpecificData,
 			ch:        c,
 		}
+		if c.direction == channelInbound && c.mux.enforce != nil {
+			if err := c.mux.enforce.request(c.chanType, &req); err != nil {
+				if req.WantReply {
+					return c.ackRequest(false)
+				}
+				return nil
+			}
+		}
+		if err := c.mux.intercept(&InterceptedMessage{
+			Kind:        InterceptChannelRequest,
+			Name:        msg.Request,
+			Channel:     c,
+			ChannelType: c.chanType,
+			WantReply:   msg.WantReply,
+			Payload:     msg.RequestSpecificData,
+		}); err != nil {
+			if msg.WantReply {
+				return c.ackRequest(false)
+			}
+			return nil
+		}
 		select {
 		case c.incomingRequests <- &req:
 		case <-reqStopMux:
@@ -627,10 +900,10 @@ func (c *channel) handlePacket(packet []byte) error {
 }
 
 func (m *mux) newChannel(chanType string, direction channelDirection, extraData []byte) *channel {
-	idleR, idleW := NewIdleTimer(nil, 0), NewIdleTimer(nil, 0)
+	idleR, idleW := newIdleTimer(nil, 0, m.clock, m.goroutines), newIdleTimer(nil, 0, m.clock, m.goroutines)
 	ch := &channel{
 		remoteWin:        window{Cond: newCond(), idle: idleR},
-		myWindow:         channelWindowSize,
+		myWindow:         m.window,
 		pending:          newBuffer(idleR),
 		extPending:       newBuffer(idleR),
 		direction:        direction,
@@ -670,7 +943,7 @@ func (c *channel) Accept() (Channel, <-chan *Request, error) {
 	if c.decided {
 		return nil, nil, errDecidedAlready
 	}
-	c.maxIncomingPayload = channelMaxPacket
+	c.maxIncomingPayload = c.mux.maxPacket
 	confirm := channelOpenConfirmMsg{
 		PeersId:       c.remoteId,
 		MyId:          c.localId,
@@ -678,6 +951,9 @@ func (c *channel) Accept() (Channel, <-chan *Request, error) {
 		MaxPacketSize: c.maxIncomingPayload,
 	}
 	c.decided = true
+	if c.decide != nil {
+		c.decide()
+	}
 	if err := c.sendMessage(confirm); err != nil {
 		return nil, nil, err
 	}
@@ -698,6 +974,12 @@ func (ch *channel) Reject(reason RejectionReason, message string) error {
 	ch.decided = true
 	ch.idleR.Halt.RequestStop()
 	ch.idleW.Halt.RequestStop()
+	if ch.release != nil {
+		ch.release()
+	}
+	if ch.decide != nil {
+		ch.decide()
+	}
 
 	return ch.sendMessage(reject)
 }
@@ -743,8 +1025,20 @@ func (ch *channel) Close() error {
 		PeersId: ch.remoteId})
 }
 
-// Extended returns an io.ReadWriter that sends and receives data on the given,
-// SSH extended stream. Such streams are used, for example, for stderr.
+// WindowStats implements HasWindowStats.
+func (ch *channel) WindowStats() WindowStats {
+	var s WindowStats
+	s.WriteStalls, s.WriteStallTime = ch.remoteWin.stats()
+	ch.windowMu.Lock()
+	s.PeerStalls, s.PeerStallTime = ch.peerStalls, ch.peerStallTime
+	if ch.myWindow == 0 && ch.peerStalls > 0 {
+		s.PeerStallTime += time.Since(ch.exhausted)
+	}
+	ch.windowMu.Unlock()
+	return s
+}
+
+// Extended implements ExtendedStreams.
 func (ch *channel) Extended(code uint32) io.ReadWriter {
 	if !ch.decided {
 		return nil
@@ -0,0 +1,95 @@
+package ssh
+
+import "fmt"
+
+// The extra data of the standard channel types, as sent in
+// SSH_MSG_CHANNEL_OPEN and returned by NewChannel.ExtraData.
+// ParseChannelOpen decodes it, and Marshal encodes it for
+// Conn.OpenChannel, for example:
+//
+//	extra := ssh.Marshal(&ssh.DirectTCPIPPayload{
+//		DestAddr: "db.internal",
+//		DestPort: 5432,
+//	})
+//	ch, reqs, err := conn.OpenChannel(ctx, "direct-tcpip", extra, nil)
+
+// SessionPayload is the extra data of a "session" channel, which
+// has none.
+type SessionPayload struct{}
+
+// DirectTCPIPPayload is the extra data of a "direct-tcpip" channel,
+// RFC 4254 section 7.2: a connection to DestAddr, which may be a
+// host name, asked for by the client on behalf of the originator.
+type DirectTCPIPPayload struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ForwardedTCPIPPayload is the extra data of a "forwarded-tcpip"
+// channel, RFC 4254 section 7.2: a connection the server accepted
+// on Addr, the address of a "tcpip-forward" request, from the
+// originator.
+type ForwardedTCPIPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// DirectStreamLocalPayload is the extra data of a
+// "direct-streamlocal@openssh.com" channel, a connection to the Unix
+// socket SocketPath; see PROTOCOL of OpenSSH, section 2.4. The
+// reserved fields are sent empty.
+type DirectStreamLocalPayload struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// ForwardedStreamLocalPayload is the extra data of a
+// "forwarded-streamlocal@openssh.com" channel, a connection the
+// server accepted on the Unix socket SocketPath.
+type ForwardedStreamLocalPayload struct {
+	SocketPath string
+	Reserved0  string
+}
+
+// X11Payload is the extra data of an "x11" channel, RFC 4254
+// section 6.3.2.
+type X11Payload struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ParseChannelOpen decodes the extra data of newCh according to its
+// type, returning one of *SessionPayload, *DirectTCPIPPayload,
+// *ForwardedTCPIPPayload, *DirectStreamLocalPayload,
+// *ForwardedStreamLocalPayload, *X11Payload or *DirectUDPPayload.
+// Other types give an error.
+func ParseChannelOpen(newCh NewChannel) (interface{}, error) {
+	var out interface{}
+	switch newCh.ChannelType() {
+	case "session":
+		return &SessionPayload{}, nil
+	case "direct-tcpip":
+		out = &DirectTCPIPPayload{}
+	case "forwarded-tcpip":
+		out = &ForwardedTCPIPPayload{}
+	case "direct-streamlocal@openssh.com":
+		out = &DirectStreamLocalPayload{}
+	case "forwarded-streamlocal@openssh.com":
+		out = &ForwardedStreamLocalPayload{}
+	case "x11":
+		out = &X11Payload{}
+	case UDPChannelType:
+		out = &DirectUDPPayload{}
+	default:
+		return nil, fmt.Errorf("ssh: unknown channel type %q", newCh.ChannelType())
+	}
+	if err := Unmarshal(newCh.ExtraData(), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
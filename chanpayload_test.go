@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseChannelOpen(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client, server := muxPair(halt)
+	defer server.Close()
+	defer client.Close()
+
+	tests := []struct {
+		chanType string
+		payload  interface{}
+	}{
+		{"direct-tcpip", &DirectTCPIPPayload{"db.internal", 5432, "10.0.0.1", 40000}},
+		{"forwarded-tcpip", &ForwardedTCPIPPayload{"0.0.0.0", 8080, "192.0.2.7", 51000}},
+		{"direct-streamlocal@openssh.com", &DirectStreamLocalPayload{SocketPath: "/run/app.sock"}},
+		{"forwarded-streamlocal@openssh.com", &ForwardedStreamLocalPayload{SocketPath: "/tmp/fwd.sock"}},
+		{"x11", &X11Payload{"127.0.0.1", 6010}},
+		{UDPChannelType, &DirectUDPPayload{"resolver.internal", 53, "0.0.0.0", 0}},
+	}
+	go func() {
+		for _, tt := range tests {
+			client.openChannel(context.Background(), tt.chanType, Marshal(tt.payload), nil)
+		}
+	}()
+	for _, tt := range tests {
+		nc := <-server.incomingChannels
+		got, err := ParseChannelOpen(nc)
+		nc.Reject(Prohibited, "parsed")
+		if err != nil {
+			t.Errorf("%s: %v", tt.chanType, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.payload) {
+			t.Errorf("%s: got %#v, want %#v", tt.chanType, got, tt.payload)
+		}
+	}
+
+	go client.openChannel(context.Background(), "unknown", nil, nil)
+	nc := <-server.incomingChannels
+	if _, err := ParseChannelOpen(nc); err == nil {
+		t.Errorf("ParseChannelOpen of an unknown type succeeded")
+	}
+	nc.Reject(UnknownChannelType, "unknown")
+}
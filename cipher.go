@@ -16,6 +16,7 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
+	"sync"
 )
 
 const (
@@ -131,18 +132,86 @@ var cipherModes = map[string]*streamCipherMode{
 // and number of padding bytes.
 const prefixLen = 5
 
+// The scratch buffers of the packetCiphers come in sizes of
+// packetBufMin, twice that, and so on, up to packetBufSize, the
+// largest packet we accept, each with room for the prefix, padding
+// and MAC of a packet of its size.
+const (
+	packetBufMin     = 4 << 10
+	packetBufClasses = 7
+	packetBufSize    = packetBufMin<<(packetBufClasses-1) + 256
+)
+
+// packetBufPools hold the buffers of each size, so that replacing a
+// cipher at a key change, or a new connection, does not allocate.
+var packetBufPools [packetBufClasses]sync.Pool
+
+func init() {
+	for i := range packetBufPools {
+		size := packetBufMin<<i + 256
+		packetBufPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// packetBuf is the scratch space of a packetCipher. It is taken from
+// packetBufPools on first use, in the smallest size that holds the
+// packet, and traded for a larger one when a larger packet comes, so
+// that a connection holds buffers as large as its packets, and no
+// larger.
+type packetBuf struct {
+	pooled *[]byte
+	class  int
+}
+
+// get returns the first n bytes of the buffer. A buffer traded for a
+// larger one is copied into it, so that what the caller read into
+// the first bytes stays in place.
+func (b *packetBuf) get(n int) []byte {
+	if n > packetBufSize {
+		// Only writes of oversized packets, which fail later.
+		return make([]byte, n)
+	}
+	if b.pooled == nil || len(*b.pooled) < n {
+		class := 0
+		for packetBufMin<<class+256 < n {
+			class++
+		}
+		grown := packetBufPools[class].Get().(*[]byte)
+		if b.pooled != nil {
+			copy(*grown, *b.pooled)
+			b.release()
+		}
+		b.pooled, b.class = grown, class
+	}
+	return (*b.pooled)[:n]
+}
+
+func (b *packetBuf) release() {
+	if b.pooled != nil {
+		packetBufPools[b.class].Put(b.pooled)
+		b.pooled = nil
+	}
+}
+
 // streamPacketCipher is a packetCipher using a stream cipher.
 type streamPacketCipher struct {
+	packetBuf
 	mac    hash.Hash
 	cipher cipher.Stream
 	etm    bool
 
+	// paddingPolicy, if non-nil, lengthens the padding.
+	paddingPolicy PaddingPolicy
+
 	// The following members are to avoid per-packet allocations.
-	prefix      [prefixLen]byte
-	seqNumBytes [4]byte
-	padding     [2 * packetSizeMultiple]byte
-	packetData  []byte
-	macResult   []byte
+	prefix                 [prefixLen]byte
+	seqNumBytes            [4]byte
+	encryptedPaddingLength [1]byte
+	packetData             []byte
+	macResult              []byte
 }
 
 // readPacket reads and decrypt a single packet from the reader argument.
@@ -151,9 +220,8 @@ func (s *streamPacketCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, err
 		return nil, err
 	}
 
-	var encryptedPaddingLength [1]byte
 	if s.mac != nil && s.etm {
-		copy(encryptedPaddingLength[:], s.prefix[4:5])
+		copy(s.encryptedPaddingLength[:], s.prefix[4:5])
 		s.cipher.XORKeyStream(s.prefix[4:5], s.prefix[4:5])
 	} else {
 		s.cipher.XORKeyStream(s.prefix[:], s.prefix[:])
@@ -169,7 +237,7 @@ func (s *streamPacketCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, err
 		s.mac.Write(s.seqNumBytes[:])
 		if s.etm {
 			s.mac.Write(s.prefix[:4])
-			s.mac.Write(encryptedPaddingLength[:])
+			s.mac.Write(s.encryptedPaddingLength[:])
 		} else {
 			s.mac.Write(s.prefix[:])
 		}
@@ -186,11 +254,7 @@ func (s *streamPacketCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, err
 
 	// the maxPacket check above ensures that length-1+macSize
 	// does not overflow.
-	if uint32(cap(s.packetData)) < length-1+macSize {
-		s.packetData = make([]byte, length-1+macSize)
-	} else {
-		s.packetData = s.packetData[:length-1+macSize]
-	}
+	s.packetData = s.get(int(length - 1 + macSize))
 
 	if _, err := io.ReadFull(r, s.packetData); err != nil {
 		return nil, err
@@ -233,75 +297,62 @@ func (s *streamPacketCipher) writePacket(seqNum uint32, w io.Writer, rand io.Rea
 	if paddingLength < 4 {
 		paddingLength += packetSizeMultiple
 	}
+	paddingLength = s.paddingPolicy.pad(len(packet), paddingLength, packetSizeMultiple)
 
 	length := len(packet) + 1 + paddingLength
-	binary.BigEndian.PutUint32(s.prefix[:], uint32(length))
-	s.prefix[4] = byte(paddingLength)
-	padding := s.padding[:paddingLength]
-	if _, err := io.ReadFull(rand, padding); err != nil {
+	macSize := 0
+	if s.mac != nil {
+		macSize = s.mac.Size()
+	}
+
+	// The packet is laid out whole in the buffer, to be encrypted,
+	// MACed and written with a single call each, rather than one
+	// per piece; on small packets the calls cost as much as the
+	// cryptography.
+	s.packetData = s.get(4 + length + macSize)
+	binary.BigEndian.PutUint32(s.packetData, uint32(length))
+	s.packetData[4] = byte(paddingLength)
+	copy(s.packetData[prefixLen:], packet)
+	if _, err := io.ReadFull(rand, s.packetData[prefixLen+len(packet):4+length]); err != nil {
 		return err
 	}
+	body := s.packetData[:4+length]
 
 	if s.mac != nil {
 		s.mac.Reset()
 		binary.BigEndian.PutUint32(s.seqNumBytes[:], seqNum)
 		s.mac.Write(s.seqNumBytes[:])
-
-		if s.etm {
-			// For EtM algorithms, the packet length must stay unencrypted,
-			// but the following data (padding length) must be encrypted
-			s.cipher.XORKeyStream(s.prefix[4:5], s.prefix[4:5])
-		}
-
-		s.mac.Write(s.prefix[:])
-
-		if !s.etm {
-			// For non-EtM algorithms, the algorithm is applied on unencrypted data
-			s.mac.Write(packet)
-			s.mac.Write(padding)
-		}
 	}
-
-	if !(s.mac != nil && s.etm) {
-		// For EtM algorithms, the padding length has already been encrypted
-		// and the packet length must remain unencrypted
-		s.cipher.XORKeyStream(s.prefix[:], s.prefix[:])
-	}
-
-	s.cipher.XORKeyStream(packet, packet)
-	s.cipher.XORKeyStream(padding, padding)
-
 	if s.mac != nil && s.etm {
-		// For EtM algorithms, packet and padding must be encrypted
-		s.mac.Write(packet)
-		s.mac.Write(padding)
-	}
-
-	if _, err := w.Write(s.prefix[:]); err != nil {
-		return err
-	}
-	if _, err := w.Write(packet); err != nil {
-		return err
-	}
-	if _, err := w.Write(padding); err != nil {
-		return err
+		// For EtM algorithms, the packet length stays
+		// unencrypted, and the MAC is of the encrypted packet.
+		s.cipher.XORKeyStream(body[4:], body[4:])
+		s.mac.Write(body)
+	} else {
+		// Otherwise the MAC is of the unencrypted packet.
+		if s.mac != nil {
+			s.mac.Write(body)
+		}
+		s.cipher.XORKeyStream(body, body)
 	}
-
 	if s.mac != nil {
-		s.macResult = s.mac.Sum(s.macResult[:0])
-		if _, err := w.Write(s.macResult); err != nil {
-			return err
-		}
+		// The MAC goes in the room left for it after body.
+		body = s.mac.Sum(body)
 	}
 
-	return nil
+	_, err := w.Write(body)
+	return err
 }
 
 type gcmCipher struct {
+	packetBuf
 	aead   cipher.AEAD
 	prefix [4]byte
 	iv     []byte
 	buf    []byte
+
+	// paddingPolicy, if non-nil, lengthens the padding.
+	paddingPolicy PaddingPolicy
 }
 
 func newGCMCipher(iv, key, macKey []byte) (packetCipher, error) {
@@ -330,26 +381,23 @@ func (c *gcmCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, pack
 	if padding < 4 {
 		padding += packetSizeMultiple
 	}
+	padding = byte(c.paddingPolicy.pad(len(packet), int(padding), packetSizeMultiple))
 
 	length := uint32(len(packet) + int(padding) + 1)
-	binary.BigEndian.PutUint32(c.prefix[:], length)
-	if _, err := w.Write(c.prefix[:]); err != nil {
-		return err
-	}
-
-	if cap(c.buf) < int(length) {
-		c.buf = make([]byte, length)
-	} else {
-		c.buf = c.buf[:length]
-	}
 
-	c.buf[0] = padding
-	copy(c.buf[1:], packet)
-	if _, err := io.ReadFull(rand, c.buf[1+len(packet):]); err != nil {
+	// The length, which is the additional data, the sealed packet
+	// and the tag are laid out in the buffer, to be written at
+	// once.
+	c.buf = c.get(4 + int(length) + gcmTagSize)
+	binary.BigEndian.PutUint32(c.buf, length)
+	plain := c.buf[4 : 4+length]
+	plain[0] = padding
+	copy(plain[1:], packet)
+	if _, err := io.ReadFull(rand, plain[1+len(packet):]); err != nil {
 		return err
 	}
-	c.buf = c.aead.Seal(c.buf[:0], c.iv, c.buf, c.prefix[:])
-	if _, err := w.Write(c.buf); err != nil {
+	sealed := c.aead.Seal(plain[:0], c.iv, plain, c.buf[:4])
+	if _, err := w.Write(c.buf[:4+len(sealed)]); err != nil {
 		return err
 	}
 	c.incIV()
@@ -375,11 +423,7 @@ func (c *gcmCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
 		return nil, errors.New("ssh: max packet length exceeded.")
 	}
 
-	if cap(c.buf) < int(length+gcmTagSize) {
-		c.buf = make([]byte, length+gcmTagSize)
-	} else {
-		c.buf = c.buf[:length+gcmTagSize]
-	}
+	c.buf = c.get(int(length + gcmTagSize))
 
 	if _, err := io.ReadFull(r, c.buf); err != nil {
 		return nil, err
@@ -407,6 +451,7 @@ func (c *gcmCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
 
 // cbcCipher implements aes128-cbc cipher defined in RFC 4253 section 6.1
 type cbcCipher struct {
+	packetBuf
 	mac       hash.Hash
 	macSize   uint32
 	decrypter cipher.BlockMode
@@ -420,14 +465,16 @@ type cbcCipher struct {
 	// Amount of data we should still read to hide which
 	// verification error triggered.
 	oracleCamouflage uint32
+
+	// paddingPolicy, if non-nil, lengthens the padding.
+	paddingPolicy PaddingPolicy
 }
 
 func newCBCCipher(c cipher.Block, iv, key, macKey []byte, algs directionAlgorithms) (packetCipher, error) {
 	cbc := &cbcCipher{
-		mac:        macModes[algs.MAC].new(macKey),
-		decrypter:  cipher.NewCBCDecrypter(c, iv),
-		encrypter:  cipher.NewCBCEncrypter(c, iv),
-		packetData: make([]byte, 1024),
+		mac:       macModes[algs.MAC].new(macKey),
+		decrypter: cipher.NewCBCDecrypter(c, iv),
+		encrypter: cipher.NewCBCEncrypter(c, iv),
 	}
 	if cbc.mac != nil {
 		cbc.macSize = uint32(cbc.mac.Size())
@@ -503,7 +550,7 @@ func (c *cbcCipher) readPacketLeaky(seqNum uint32, r io.Reader) ([]byte, error)
 	// case of block ciphers - this is copied back to the payload later.
 	// How many bytes of payload/padding will be read with this first read.
 	firstBlockLength := uint32((prefixLen + blockSize - 1) / blockSize * blockSize)
-	firstBlock := c.packetData[:firstBlockLength]
+	firstBlock := c.get(int(firstBlockLength))
 	if _, err := io.ReadFull(r, firstBlock); err != nil {
 		return nil, err
 	}
@@ -538,15 +585,8 @@ func (c *cbcCipher) readPacketLeaky(seqNum uint32, r io.Reader) ([]byte, error)
 	// Entire packet size, starting before length, ending at end of mac.
 	entirePacketSize := macStart + c.macSize
 
-	// Ensure c.packetData is large enough for the entire packet data.
-	if uint32(cap(c.packetData)) < entirePacketSize {
-		// Still need to upsize and copy, but this should be rare at runtime, only
-		// on upsizing the packetData buffer.
-		c.packetData = make([]byte, entirePacketSize)
-		copy(c.packetData, firstBlock)
-	} else {
-		c.packetData = c.packetData[:entirePacketSize]
-	}
+	// get keeps firstBlock in place, should it trade the buffer.
+	c.packetData = c.get(int(entirePacketSize))
 
 	if n, err := io.ReadFull(r, c.packetData[firstBlockLength:]); err != nil {
 		return nil, err
@@ -583,15 +623,17 @@ func (c *cbcCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, pack
 
 	length := encLength - 4
 	paddingLength := int(length) - (1 + len(packet))
+	if c.paddingPolicy != nil {
+		padded := c.paddingPolicy.pad(len(packet), paddingLength, int(effectiveBlockSize))
+		encLength += uint32(padded - paddingLength)
+		length += uint32(padded - paddingLength)
+		paddingLength = padded
+	}
 
 	// Overall buffer contains: header, payload, padding, mac.
 	// Space for the MAC is reserved in the capacity but not the slice length.
 	bufferSize := encLength + c.macSize
-	if uint32(cap(c.packetData)) < bufferSize {
-		c.packetData = make([]byte, encLength, bufferSize)
-	} else {
-		c.packetData = c.packetData[:encLength]
-	}
+	c.packetData = c.get(int(bufferSize))[:encLength]
 
 	p := c.packetData
 
@@ -9,6 +9,7 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/rand"
+	"strconv"
 	"testing"
 )
 
@@ -133,3 +134,116 @@ func TestCBCOracleCounterMeasure(t *testing.T) {
 		lastRead = bytesRead
 	}
 }
+
+func TestPacketBuf(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var b packetBuf
+	small := b.get(100)
+	if len(small) != 100 || cap(small) != packetBufMin+256 {
+		t.Fatalf("get(100): len %d, cap %d", len(small), cap(small))
+	}
+	copy(small, "first block")
+
+	// A larger packet trades the buffer for a larger one, and keeps
+	// what is in it.
+	large := b.get(40 << 10)
+	if cap(large) != 64<<10+256 {
+		t.Errorf("get(40KB): cap %d", cap(large))
+	}
+	if string(large[:11]) != "first block" {
+		t.Errorf("grown buffer starts %q", large[:11])
+	}
+	if got := b.get(100); cap(got) != cap(large) {
+		t.Errorf("buffer shrank to %d", cap(got))
+	}
+	if got := b.get(maxPacket + 64); cap(got) != packetBufSize {
+		t.Errorf("get of the largest packet: cap %d, want %d", cap(got), packetBufSize)
+	}
+	b.release()
+	if b.pooled != nil {
+		t.Error("release kept the buffer")
+	}
+}
+
+// BenchmarkPacketCipherRoundTrip writes and reads packets of each
+// cipher. The writes and reads should not allocate, once the
+// buffers have grown.
+func BenchmarkPacketCipherRoundTrip(b *testing.B) {
+	cipherModes[aes128cbcID] = &streamCipherMode{16, aes.BlockSize, 0, nil}
+	defer delete(cipherModes, aes128cbcID)
+
+	kr := &kexResult{Hash: crypto.SHA1}
+	for cipher := range cipherModes {
+		for _, size := range []int{64, 32768} {
+			b.Run(cipher+"/"+strconv.Itoa(size), func(b *testing.B) {
+				algs := directionAlgorithms{Cipher: cipher, MAC: "hmac-sha2-256", Compression: "none"}
+				client, err := newPacketCipher(clientKeys, algs, kr)
+				if err != nil {
+					b.Fatalf("newPacketCipher(client, %q): %v", cipher, err)
+				}
+				defer client.release()
+				server, err := newPacketCipher(clientKeys, algs, kr)
+				if err != nil {
+					b.Fatalf("newPacketCipher(server, %q): %v", cipher, err)
+				}
+				defer server.release()
+
+				buf := bytes.NewBuffer(make([]byte, 0, 2*packetBufSize))
+				packet := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					if err := client.writePacket(uint32(i), buf, rand.Reader, packet); err != nil {
+						b.Fatalf("writePacket(%q): %v", cipher, err)
+					}
+					if _, err := server.readPacket(uint32(i), buf); err != nil {
+						b.Fatalf("readPacket(%q): %v", cipher, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// discardWriter is a packetWriter that drops what is written to it.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriter) Flush() error                { return nil }
+
+func benchmarkPacketCipher(b *testing.B, cipher, mac string, size int) {
+	kr := &kexResult{Hash: crypto.SHA256}
+	algs := directionAlgorithms{Cipher: cipher, MAC: mac, Compression: "none"}
+	client, err := newPacketCipher(clientKeys, algs, kr)
+	if err != nil {
+		b.Fatalf("newPacketCipher: %v", err)
+	}
+	defer client.release()
+	packet := make([]byte, size)
+	var w discardWriter
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.writePacket(uint32(i), w, rand.Reader, packet); err != nil {
+			b.Fatalf("writePacket: %v", err)
+		}
+	}
+}
+
+func BenchmarkPacketCipher(b *testing.B) {
+	for _, c := range []struct{ cipher, mac string }{
+		{"aes128-ctr", "hmac-sha2-256"},
+		{"aes128-ctr", "hmac-sha2-256-etm@openssh.com"},
+		{gcmCipherID, "hmac-sha2-256"},
+	} {
+		for _, size := range []int{64, 1024, 32768} {
+			b.Run(c.cipher+"/"+c.mac+"/"+strconv.Itoa(size), func(b *testing.B) {
+				benchmarkPacketCipher(b, c.cipher, c.mac, size)
+			})
+		}
+	}
+}
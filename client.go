@@ -20,52 +20,149 @@ type Client struct {
 	Conn
 	Halt *Halter
 
-	Forwards        ForwardList // forwarded tcpip connections from the remote side
-	Mu              sync.Mutex
+	Forwards ForwardList // forwarded tcpip connections from the remote side
+
+	// Mu guards ChannelHandlers; the Client guards the rest of
+	// its state itself.
+	Mu sync.Mutex
+
+	// ChannelHandlers maps channel types to the channels that the
+	// NewChannel requests of the peer for them are sent on, for
+	// the types that HandleChannelOpen has no handler for. Hold
+	// Mu to change it. The Client does not close the channels put
+	// here.
+	//
+	// Deprecated: use HandleChannelOpen and ChannelTypes.
 	ChannelHandlers map[string]chan NewChannel
 
+	// TmpCtx is used by Listen, Dial and DialTCP if SetContext
+	// has not been called.
+	//
+	// Deprecated: use SetContext, which is safe to call
+	// while the Client is in use.
 	TmpCtx context.Context
+
+	// mu protects handlers and ctx.
+	mu sync.Mutex
+
+	// handlers holds the channels of HandleChannelOpen, by
+	// channel type. It is nil once the connection is closed.
+	handlers map[string]chan NewChannel
+
+	// ctx is the context of SetContext.
+	ctx context.Context
+
+	// events holds the callbacks of OnDisconnect, OnRekey and
+	// OnHalt.
+	events clientEvents
 }
 
 // HandleChannelOpen returns a channel on which NewChannel requests
 // for the given type are sent. If the type already is being handled,
 // nil is returned. The channel is closed when the connection is closed.
 func (c *Client) HandleChannelOpen(channelType string) <-chan NewChannel {
-	c.Mu.Lock()
-	defer c.Mu.Unlock()
-	if c.ChannelHandlers == nil {
+	legacy := c.legacyHandler(channelType)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers == nil {
 		// The SSH channel has been closed.
 		c := make(chan NewChannel)
 		close(c)
 		return c
 	}
 
-	ch := c.ChannelHandlers[channelType]
-	if ch != nil {
+	if c.handlers[channelType] != nil || legacy != nil {
 		return nil
 	}
 
-	ch = make(chan NewChannel, chanSize)
-	c.ChannelHandlers[channelType] = ch
+	ch := make(chan NewChannel, chanSize)
+	c.handlers[channelType] = ch
 	return ch
 }
 
+// legacyHandler returns the channel of ChannelHandlers for
+// channelType, if any.
+func (c *Client) legacyHandler(channelType string) chan NewChannel {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.ChannelHandlers[channelType]
+}
+
+// ChannelTypes returns the channel types that have a handler from
+// HandleChannelOpen, in no particular order. It returns nil once
+// the connection is closed.
+func (c *Client) ChannelTypes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var types []string
+	for t := range c.handlers {
+		types = append(types, t)
+	}
+	return types
+}
+
+// SetContext sets the context used by the methods that take none:
+// Listen, Dial, DialTCP, and the listeners they return.
+func (c *Client) SetContext(ctx context.Context) {
+	c.mu.Lock()
+	c.ctx = ctx
+	c.mu.Unlock()
+}
+
+// Context returns the context of SetContext, or else TmpCtx, or
+// else context.Background().
+func (c *Client) Context() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.ctx != nil:
+		return c.ctx
+	case c.TmpCtx != nil:
+		return c.TmpCtx
+	}
+	return context.Background()
+}
+
 // NewClient creates a Client on top of the given connection.
 func NewClient(ctx context.Context, c Conn, chans <-chan NewChannel, reqs <-chan *Request, halt *Halter) *Client {
 	conn := &Client{
 		Conn:            c,
-		ChannelHandlers: make(map[string]chan NewChannel, 1),
+		handlers:        make(map[string]chan NewChannel, 1),
+		ChannelHandlers: make(map[string]chan NewChannel),
 		Halt:            halt,
+		events:          clientEvents{lost: make(chan struct{})},
 	}
 
-	go conn.HandleGlobalRequests(ctx, reqs)
-	go conn.HandleChannelOpens(ctx, chans)
-	go func() {
-		conn.Wait()
+	var goroutines *goroutineLedger
+	if sc, ok := c.(*connection); ok {
+		goroutines = sc.cfg.goroutines
+	}
+	goroutines.spawn("client global requests", func() { conn.HandleGlobalRequests(ctx, reqs) })
+	goroutines.spawn("client channel opens", func() { conn.HandleChannelOpens(ctx, chans) })
+	if sc, ok := c.(*connection); ok && sc.transport != nil {
+		sc.transport.setOnRekey(conn.events.rekeyed)
+	}
+	goroutines.spawn("client disconnect watch", func() {
+		err := conn.Wait()
 		conn.Forwards.CloseAll()
-	}()
-	go conn.Forwards.HandleChannels(ctx, conn.HandleChannelOpen("forwarded-tcpip"), c)
-	go conn.Forwards.HandleChannels(ctx, conn.HandleChannelOpen("forwarded-streamlocal@openssh.com"), c)
+		conn.events.disconnected(err)
+	})
+	if halt != nil {
+		goroutines.spawn("client halt watch", func() {
+			select {
+			case <-halt.ReqStopChan():
+			case <-conn.events.lost:
+				if !halt.IsStopRequested() {
+					return
+				}
+			}
+			conn.events.halted()
+		})
+	}
+	tcpForwards := conn.HandleChannelOpen("forwarded-tcpip")
+	unixForwards := conn.HandleChannelOpen("forwarded-streamlocal@openssh.com")
+	goroutines.spawn("client forwards", func() { conn.Forwards.HandleChannels(ctx, tcpForwards, c) })
+	goroutines.spawn("client forwards", func() { conn.Forwards.HandleChannels(ctx, unixForwards, c) })
 	return conn
 }
 
@@ -73,27 +170,44 @@ func NewClient(ctx context.Context, c Conn, chans <-chan NewChannel, reqs <-chan
 // as the underlying transport.  The Request and NewChannel channels
 // must be serviced or the connection will hang.
 func NewClientConn(ctx context.Context, c net.Conn, addr string, config *ClientConfig) (Conn, <-chan NewChannel, <-chan *Request, error) {
+	conn, fullConf, err := newClientConnection(ctx, c, addr, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn.mux = newMux(ctx, conn.transport, conn.halt, &fullConf.Config, muxOptions{meta: conn})
+	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
+}
+
+// newClientConnection runs the handshake of a client connection over
+// c, key exchange and authentication, and returns the connection and
+// the config it uses, with its defaults set.
+func newClientConnection(ctx context.Context, c net.Conn, addr string, config *ClientConfig) (*connection, *ClientConfig, error) {
 	fullConf := *config
 	fullConf.SetDefaults()
 	if fullConf.HostKeyCallback == nil {
 		c.Close()
-		return nil, nil, nil, errors.New("ssh: must specify HostKeyCallback")
+		return nil, nil, errors.New("ssh: must specify HostKeyCallback")
 	}
 	if fullConf.Halt == nil {
 		c.Close()
-		return nil, nil, nil, errors.New("ssh: config must provide Halt")
+		return nil, nil, errors.New("ssh: config must provide Halt")
+	}
+	c, err := wrapConn(&fullConf.Config, c, true)
+	if err != nil {
+		return nil, nil, err
 	}
 	conn := newConnection(c, &fullConf.Config, &fullConf)
 
 	// can block on conn here, we need to get a close
 	// on conn in.
+	start := fullConf.Clock.Now()
 	if err := conn.clientHandshake(ctx, addr, &fullConf); err != nil {
+		reportHandshake(&fullConf.Config, start, err)
 		c.Close()
-		return nil, nil, nil, fmt.Errorf("ssh: handshake failed: %v", err)
+		return nil, nil, &HandshakeError{Err: err}
 	}
-
-	conn.mux = newMux(ctx, conn.transport, conn.halt)
-	return conn, conn.mux.incomingChannels, conn.mux.incomingRequests, nil
+	reportHandshake(&fullConf.Config, start, nil)
+	return conn, &fullConf, nil
 }
 
 // clientHandshake performs the client side key exchange. See RFC 4253 Section
@@ -105,10 +219,13 @@ func (c *connection) clientHandshake(ctx context.Context, dialAddress string, co
 		c.clientVersion = []byte(packageVersion)
 	}
 	var err error
-	c.serverVersion, err = exchangeVersions(c.sshConn.conn, c.clientVersion)
+	c.serverVersion, err = exchangeVersionsConn(c.sshConn.conn, c.clientVersion, &config.Config)
 	if err != nil {
 		return err
 	}
+	if err := checkPeerVersion(&config.Config, c.serverVersion); err != nil {
+		return err
+	}
 
 	c.transport = newClientTransport(ctx,
 		newTransport(c.sshConn.conn, config.Rand, true /* is client */, &config.Config),
@@ -121,9 +238,39 @@ func (c *connection) clientHandshake(ctx context.Context, dialAddress string, co
 	}
 
 	c.sessionID = c.transport.getSessionID()
+	if config.SessionBindCallback != nil {
+		hostKey, signature := c.transport.getSessionBinding()
+		pub, err := ParsePublicKey(hostKey)
+		if err != nil {
+			return err
+		}
+		if err := config.SessionBindCallback(pub, c.sessionID, signature); err != nil {
+			return err
+		}
+	}
 	return c.clientAuthenticate(ctx, config)
 }
 
+// SessionBinding returns the server's host key and its signature
+// over the session ID, from the initial key exchange. Together with
+// SessionID, these let an agent verify which server the client is
+// talking to, see the session-bind@openssh.com agent extension.
+func (c *Client) SessionBinding() (hostKey PublicKey, signature []byte, err error) {
+	conn, ok := c.Conn.(*connection)
+	if !ok || conn.transport == nil {
+		return nil, nil, errors.New("ssh: no session binding for this connection")
+	}
+	hk, sig := conn.transport.getSessionBinding()
+	if hk == nil {
+		return nil, nil, errors.New("ssh: no session binding for this connection")
+	}
+	hostKey, err = ParsePublicKey(hk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hostKey, sig, nil
+}
+
 // verifyHostKeySignature verifies the host key obtained in the key
 // exchange.
 func verifyHostKeySignature(hostKey PublicKey, result *kexResult) error {
@@ -138,7 +285,7 @@ func verifyHostKeySignature(hostKey PublicKey, result *kexResult) error {
 // NewSession opens a new Session for this client. (A session is a remote
 // execution of a program.)
 func (c *Client) NewSession(ctx context.Context) (*Session, error) {
-	ch, in, err := c.OpenChannel(ctx, "session", nil, nil)
+	ch, in, err := c.openChannel(ctx, "session", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -165,8 +312,18 @@ func (c *Client) HandleGlobalRequests(ctx context.Context, incoming <-chan *Requ
 	}
 }
 
-// handleChannelOpens channel open messages from the remote side.
+// HandleChannelOpens passes channel open messages from the remote
+// side to the handlers of HandleChannelOpen, and rejects those of
+// other types. When it returns, the handlers are closed.
 func (c *Client) HandleChannelOpens(ctx context.Context, in <-chan NewChannel) {
+	defer func() {
+		c.mu.Lock()
+		for _, ch := range c.handlers {
+			close(ch)
+		}
+		c.handlers = nil
+		c.mu.Unlock()
+	}()
 
 	for {
 		select {
@@ -178,9 +335,12 @@ func (c *Client) HandleChannelOpens(ctx context.Context, in <-chan NewChannel) {
 			return
 		case ch := <-in:
 			if ch != nil {
-				c.Mu.Lock()
-				handler := c.ChannelHandlers[ch.ChannelType()]
-				c.Mu.Unlock()
+				c.mu.Lock()
+				handler := c.handlers[ch.ChannelType()]
+				c.mu.Unlock()
+				if handler == nil {
+					handler = c.legacyHandler(ch.ChannelType())
+				}
 				if handler != nil {
 					select {
 					case handler <- ch:
@@ -197,12 +357,6 @@ func (c *Client) HandleChannelOpens(ctx context.Context, in <-chan NewChannel) {
 			}
 		}
 	}
-	c.Mu.Lock()
-	for _, ch := range c.ChannelHandlers {
-		close(ch)
-	}
-	c.ChannelHandlers = nil
-	c.Mu.Unlock()
 }
 
 // Dial starts a client connection to the given SSH server. It is a
@@ -211,7 +365,7 @@ func (c *Client) HandleChannelOpens(ctx context.Context, in <-chan NewChannel) {
 // to incoming channels and requests, use net.Dial with NewClientConn
 // instead.
 func Dial(ctx context.Context, network, addr string, config *ClientConfig) (*Client, error) {
-	conn, err := net.DialTimeout(network, addr, config.Timeout)
+	conn, err := config.dialConn(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -269,6 +423,79 @@ type ClientConfig struct {
 	//
 	// A Timeout of zero means no timeout.
 	Timeout time.Duration
+
+	// ConnectionAttemptDelay is how long Dial waits for a
+	// connection attempt before starting one to the next address,
+	// when the host name resolves to several, or with
+	// RaceAlternateAddrs. The attempts race, IPv6 and IPv4
+	// addresses alternating, and the first connection made is
+	// used, as in RFC 8305. Zero means 250ms.
+	ConnectionAttemptDelay time.Duration
+
+	// AlternateAddrs are other addresses of the host Dial is
+	// asked for, such as the other of a pair of bastions, that it
+	// connects to when it cannot connect to the address it is
+	// given, in order. Whichever it reaches, the host key is
+	// checked against that address, so all must have the same
+	// host key identity. Once connected, Dial does not move on if
+	// the handshake fails; see DialRetry.
+	AlternateAddrs []string
+
+	// RaceAlternateAddrs makes Dial race the connection attempts
+	// to all the addresses, AlternateAddrs included, as it does
+	// those of a host name, rather than try them one by one.
+	RaceAlternateAddrs bool
+
+	// LocalAddr, if non-nil, is the local address Dial connects
+	// from, a *net.TCPAddr for TCP networks. With an IP address
+	// set, only remote addresses of the same family are tried.
+	LocalAddr net.Addr
+
+	// DialPolicy, if non-nil, limits the destinations of
+	// Client.Dial, DialWithContext and DialTCP, which fail with a
+	// *DialDeniedError before asking the server.
+	DialPolicy *DialPolicy
+
+	// BindToDevice, if not empty, is the network interface, such
+	// as "eth1", that Dial connects through. It is supported on
+	// Linux only, where it needs CAP_NET_RAW on older kernels.
+	BindToDevice string
+
+	// TCPKeepAlive is the keep-alive period of the TCP connection
+	// made by Dial. Zero means the default of net.Dialer, and a
+	// negative value turns keep-alives off.
+	TCPKeepAlive time.Duration
+
+	// TCPDelay turns on Nagle's algorithm for the connection made
+	// by Dial, which Go turns off by default. Coalescing small
+	// writes suits bulk transfers, not interactive ones.
+	TCPDelay bool
+
+	// TCPReadBuffer and TCPWriteBuffer, if positive, set the
+	// socket buffer sizes of the connection made by Dial.
+	TCPReadBuffer  int
+	TCPWriteBuffer int
+
+	// ConnCallback, if non-nil, is called with the connection
+	// made by Dial, once the TCP options above are applied, and
+	// before the SSH handshake. It may tune the connection
+	// further, or wrap it, and returns the connection to use. An
+	// error aborts Dial.
+	ConnCallback func(conn net.Conn) (net.Conn, error)
+
+	// SessionBindCallback, if non-nil, is called after the initial
+	// key exchange, before user authentication, with the server's
+	// host key and its signature over the session ID. An error
+	// aborts the connection. agent.SessionBindCallback uses it to
+	// bind an agent to the session.
+	SessionBindCallback func(hostKey PublicKey, sessionID, signature []byte) error
+
+	// ChannelOpenRetry, if non-nil, retries the channel opens of
+	// NewSession and of the Dial methods of Client that the
+	// server refuses for a temporary reason, as
+	// IsTemporaryOpenError tells, after delays as it says. Other
+	// refusals are returned at once.
+	ChannelOpenRetry *RetryPolicy
 }
 
 // InsecureIgnoreHostKey returns a function that can be used for
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // clientAuthenticate authenticates with the remote server. See RFC 4252.
@@ -30,19 +31,26 @@ func (c *connection) clientAuthenticate(ctx context.Context, config *ClientConfi
 	// during the authentication phase the client first attempts the "none" method
 	// then any untried methods suggested by the server.
 	tried := make(map[string]bool)
+	// skipped holds the indices in config.Auth of the methods that
+	// had nothing to offer, leaving their method to the others.
+	skipped := make(map[int]bool)
 	var lastMethods []string
 
 	sessionID := c.transport.getSessionID()
+	current := -1
 	for auth := AuthMethod(new(noneAuth)); auth != nil; {
 		ok, methods, err := auth.auth(ctx, sessionID, config.User, c.transport, config.Rand)
-		if err != nil {
+		if err == errAuthSkipped {
+			skipped[current] = true
+			methods = nil
+		} else if err != nil {
 			return err
-		}
-		if ok {
+		} else if ok {
 			// success
 			return nil
+		} else {
+			tried[auth.method()] = true
 		}
-		tried[auth.method()] = true
 		if methods == nil {
 			methods = lastMethods
 		}
@@ -51,20 +59,35 @@ func (c *connection) clientAuthenticate(ctx context.Context, config *ClientConfi
 		auth = nil
 
 	findNext:
-		for _, a := range config.Auth {
+		for i, a := range config.Auth {
 			candidateMethod := a.method()
-			if tried[candidateMethod] {
+			if tried[candidateMethod] || skipped[i] {
 				continue
 			}
 			for _, meth := range methods {
 				if meth == candidateMethod {
 					auth = a
+					current = i
 					break findNext
 				}
 			}
 		}
 	}
-	return fmt.Errorf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", keys(tried))
+	return &authFailedError{tried: keys(tried)}
+}
+
+// authFailedError is the error of a client that ran out of
+// authentication methods.
+type authFailedError struct {
+	tried []string
+}
+
+func (e *authFailedError) Error() string {
+	return fmt.Sprintf("ssh: unable to authenticate, attempted methods %v, no supported methods remain", e.tried)
+}
+
+func (e *authFailedError) Is(target error) bool {
+	return target == ErrAuthFailed
 }
 
 func keys(m map[string]bool) []string {
@@ -191,7 +214,8 @@ func (cb publicKeyCallback) auth(ctx context.Context, session []byte, user strin
 	}
 	var methods []string
 	for _, signer := range signers {
-		ok, err := validateKey(ctx, signer.PublicKey(), user, c)
+		algo := signatureAlgorithm(signer, c)
+		ok, err := validateKey(ctx, signer.PublicKey(), algo, user, c)
 		if err != nil {
 			return false, nil, err
 		}
@@ -199,36 +223,8 @@ func (cb publicKeyCallback) auth(ctx context.Context, session []byte, user strin
 			continue
 		}
 
-		pub := signer.PublicKey()
-		pubKey := pub.Marshal()
-		sign, err := signer.Sign(rand, buildDataSignedForAuth(session, userAuthRequestMsg{
-			User:    user,
-			Service: serviceSSH,
-			Method:  cb.method(),
-		}, []byte(pub.Type()), pubKey))
-		if err != nil {
-			return false, nil, err
-		}
-
-		// manually wrap the serialized signature in a string
-		s := Marshal(sign)
-		sig := make([]byte, stringLength(len(s)))
-		marshalString(sig, s)
-		msg := publickeyAuthMsg{
-			User:     user,
-			Service:  serviceSSH,
-			Method:   cb.method(),
-			HasSig:   true,
-			Algoname: pub.Type(),
-			PubKey:   pubKey,
-			Sig:      sig,
-		}
-		p := Marshal(&msg)
-		if err := c.writePacket(p); err != nil {
-			return false, nil, err
-		}
 		var success bool
-		success, methods, err = handleAuthResponse(ctx, c)
+		success, methods, err = signPublicKeyAuth(ctx, session, user, signer, algo, c, rand)
 		if err != nil {
 			return false, nil, err
 		}
@@ -245,6 +241,56 @@ func (cb publicKeyCallback) auth(ctx context.Context, session []byte, user strin
 	return false, methods, nil
 }
 
+// signPublicKeyAuth authenticates with the key of signer, signing
+// for the algorithm algo.
+func signPublicKeyAuth(ctx context.Context, session []byte, user string, signer Signer, algo string, c packetConn, rand io.Reader) (bool, []string, error) {
+	pub := signer.PublicKey()
+	pubKey := pub.Marshal()
+	data := buildDataSignedForAuth(session, userAuthRequestMsg{
+		User:    user,
+		Service: serviceSSH,
+		Method:  "publickey",
+	}, []byte(algo), pubKey)
+	var sign *Signature
+	var err error
+	if algo != pub.Type() {
+		sign, err = signer.(AlgorithmSigner).SignWithAlgorithm(rand, data, algo)
+	} else {
+		sign, err = signer.Sign(rand, data)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	// manually wrap the serialized signature in a string
+	s := Marshal(sign)
+	sig := make([]byte, stringLength(len(s)))
+	marshalString(sig, s)
+	msg := publickeyAuthMsg{
+		User:     user,
+		Service:  serviceSSH,
+		Method:   "publickey",
+		HasSig:   true,
+		Algoname: algo,
+		PubKey:   pubKey,
+		Sig:      sig,
+	}
+	p := Marshal(&msg)
+	if err := c.writePacket(p); err != nil {
+		return false, nil, err
+	}
+	success, methods, err := handleAuthResponse(ctx, c)
+	if err != nil {
+		return false, nil, err
+	}
+	if cert, ok := pub.(*Certificate); ok && success {
+		if r, ok := c.(interface{ setAuthCert(*Certificate) }); ok {
+			r.setAuthCert(cert)
+		}
+	}
+	return success, methods, nil
+}
+
 func containsMethod(methods []string, method string) bool {
 	for _, m := range methods {
 		if m == method {
@@ -255,27 +301,67 @@ func containsMethod(methods []string, method string) bool {
 	return false
 }
 
-// validateKey validates the key provided is acceptable to the server.
-func validateKey(ctx context.Context, key PublicKey, user string, c packetConn) (bool, error) {
+// signatureAlgorithm returns the algorithm to authenticate with the
+// key of signer: for RSA keys, the best of the RFC 8332 ones the
+// signer can use and the server lists in its server-sig-algs, and
+// otherwise the type of the key.
+func signatureAlgorithm(signer Signer, c packetConn) string {
+	keyType := signer.PublicKey().Type()
+	if _, ok := signer.(AlgorithmSigner); !ok || keyType != KeyAlgoRSA {
+		return keyType
+	}
+	supported := []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, SigAlgoRSA}
+	if m, ok := signer.(MultiAlgorithmSigner); ok {
+		supported = m.Algorithms()
+	}
+	return rsaSignatureAlgorithm(supported, c)
+}
+
+// rsaSignatureAlgorithm returns the algorithm to authenticate with
+// an RSA key whose signer supports the given algorithms.
+func rsaSignatureAlgorithm(supported []string, c packetConn) string {
+	var offered []string
+	if t, ok := c.(interface {
+		peerExtension(name string) ([]byte, bool)
+	}); ok {
+		if v, ok := t.peerExtension(extServerSigAlgs); ok {
+			offered = strings.Split(string(v), ",")
+		}
+	}
+	for _, algo := range []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, SigAlgoRSA} {
+		if contains(supported, algo) && contains(offered, algo) {
+			return algo
+		}
+	}
+	// Without a list, try what the signer can do, "ssh-rsa" first,
+	// as servers that predate RFC 8308 may not know the others.
+	if contains(supported, SigAlgoRSA) || len(supported) == 0 {
+		return SigAlgoRSA
+	}
+	return supported[0]
+}
+
+// validateKey validates the key provided is acceptable to the server,
+// for the signature algorithm algo.
+func validateKey(ctx context.Context, key PublicKey, algo, user string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
 	msg := publickeyAuthMsg{
 		User:     user,
 		Service:  serviceSSH,
 		Method:   "publickey",
 		HasSig:   false,
-		Algoname: key.Type(),
+		Algoname: algo,
 		PubKey:   pubKey,
 	}
 	if err := c.writePacket(Marshal(&msg)); err != nil {
 		return false, err
 	}
 
-	return confirmKeyAck(ctx, key, c)
+	return confirmKeyAck(ctx, key, algo, c)
 }
 
-func confirmKeyAck(ctx context.Context, key PublicKey, c packetConn) (bool, error) {
+func confirmKeyAck(ctx context.Context, key PublicKey, algoname string, c packetConn) (bool, error) {
 	pubKey := key.Marshal()
-	algoname := key.Type()
 
 	for {
 		packet, err := c.readPacket(ctx)
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -116,6 +117,41 @@ func TestClientAuthPublicKey(t *testing.T) {
 	}
 }
 
+func TestClientAuthPublicKeysQuery(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var asked []string
+	keys := []PublicKey{testPublicKeys["ecdsa"], testPublicKeys["dsa"], testPublicKeys["rsa"]}
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []AuthMethod{
+			PublicKeysQuery(keys, func(key PublicKey) (Signer, error) {
+				asked = append(asked, key.Type())
+				return testSigners["rsa"], nil
+			}),
+		},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("unable to dial remote side: %s", err)
+	}
+	// Only the key the server accepts is signed with.
+	if len(asked) != 1 || asked[0] != KeyAlgoRSA {
+		t.Errorf("signers asked for %v, want only %s", asked, KeyAlgoRSA)
+	}
+
+	// Passing on the accepted key fails the method, without
+	// signing.
+	config.Auth = []AuthMethod{
+		PublicKeysQuery(keys, func(key PublicKey) (Signer, error) {
+			return nil, nil
+		}),
+	}
+	if err := tryAuth(t, config); err == nil {
+		t.Error("authenticated without a signer")
+	}
+}
+
 func TestAuthMethodPassword(t *testing.T) {
 	defer xtestend(xtestbegin(t))
 
@@ -320,7 +356,7 @@ func TestClientUnsupportedKex(t *testing.T) {
 			PublicKeys(),
 		},
 		Config: Config{
-			KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}, // not currently supported
+			KeyExchanges: []string{"diffie-hellman-group-exchange-sha1"}, // not currently supported
 			Halt:         NewHalter(),
 		},
 		HostKeyCallback: InsecureIgnoreHostKey(),
@@ -754,3 +790,130 @@ func TestClientAuthErrorList(t *testing.T) {
 		}
 	}
 }
+
+func TestServerAuthHooks(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var methods []string
+	var passwordCalls int
+	serverConfig := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, pass []byte) (*Permissions, error) {
+			passwordCalls++
+			if string(pass) == clientPassword {
+				return &Permissions{Extensions: map[string]string{"via": "password"}}, nil
+			}
+			return nil, errors.New("password auth failed")
+		},
+		BeforeAuthCallback: func(conn ConnMetadata, method string) error {
+			methods = append(methods, method)
+			if conn.User() == "blocked" {
+				return errors.New("user blocked")
+			}
+			return nil
+		},
+		AfterAuthCallback: func(conn ConnMetadata, method string, perms *Permissions, err error) (*Permissions, error) {
+			switch conn.User() {
+			case "vip":
+				return &Permissions{Extensions: map[string]string{"via": "hook"}}, nil
+			case "locked":
+				return nil, errors.New("locked out")
+			}
+			return perms, err
+		},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+
+	for _, tt := range []struct {
+		user, password string
+		wantVia        string
+	}{
+		{"testuser", clientPassword, "password"},
+		{"testuser", "wrong", ""},
+		{"blocked", clientPassword, ""},
+		{"locked", clientPassword, ""},
+		{"vip", "wrong", "hook"},
+	} {
+		methods, passwordCalls = nil, 0
+		serverConfig.Halt = NewHalter()
+		clientConfig := &ClientConfig{
+			User:            tt.user,
+			Auth:            []AuthMethod{Password(tt.password)},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		}
+
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		ctx := context.Background()
+		go NewClientConn(ctx, c2, "", clientConfig)
+		serverConn, err := newServer(ctx, c1, serverConfig)
+		switch {
+		case tt.wantVia == "" && err == nil:
+			t.Errorf("%s/%s: login succeeded", tt.user, tt.password)
+		case tt.wantVia != "" && err != nil:
+			t.Errorf("%s/%s: %v", tt.user, tt.password, err)
+		case err == nil && serverConn.Permissions.Extensions["via"] != tt.wantVia:
+			t.Errorf("%s/%s: got permissions %v, want via %q", tt.user, tt.password, serverConn.Permissions.Extensions, tt.wantVia)
+		}
+		if len(methods) == 0 {
+			t.Errorf("%s/%s: BeforeAuthCallback not called", tt.user, tt.password)
+		}
+		if tt.user == "blocked" && passwordCalls > 0 {
+			t.Errorf("%s/%s: PasswordCallback called despite the veto", tt.user, tt.password)
+		}
+		c1.Close()
+		c2.Close()
+		clientConfig.Halt.RequestStop()
+		serverConfig.Halt.RequestStop()
+	}
+}
+
+func TestServerAuthHooksPublicKeyQuery(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// An AfterAuthCallback that allows every public key attempt
+	// must not let in a vetoed query, which carries no signature.
+	var afterCalls int32
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+			return nil, nil
+		},
+		BeforeAuthCallback: func(conn ConnMetadata, method string) error {
+			return errors.New("vetoed")
+		},
+		AfterAuthCallback: func(conn ConnMetadata, method string, perms *Permissions, err error) (*Permissions, error) {
+			if method != "publickey" {
+				return perms, err
+			}
+			atomic.AddInt32(&afterCalls, 1)
+			return nil, nil
+		},
+		Config: Config{Halt: NewHalter()},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	defer serverConfig.Halt.RequestStop()
+	clientConfig := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(testSigners["rsa"])},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConfig.Halt.RequestStop()
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+	go NewClientConn(ctx, c2, "", clientConfig)
+	if _, err := newServer(ctx, c1, serverConfig); err == nil {
+		t.Fatal("a vetoed public key query logged in")
+	}
+	if n := atomic.LoadInt32(&afterCalls); n != 0 {
+		t.Errorf("AfterAuthCallback called %d times for unsigned public key attempts", n)
+	}
+}
@@ -5,10 +5,15 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"net"
+	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh/terminal"
 )
 
 func testClientVersion(t *testing.T, config *ClientConfig, expected string) {
@@ -17,7 +22,7 @@ func testClientVersion(t *testing.T, config *ClientConfig, expected string) {
 	receivedVersion := make(chan string, 1)
 	config.HostKeyCallback = InsecureIgnoreHostKey()
 	go func() {
-		version, err := readVersion(serverConn)
+		version, err := readVersion(serverConn, maxVersionStringBytes)
 		if err != nil {
 			receivedVersion <- ""
 		} else {
@@ -102,3 +107,265 @@ func TestHostKeyCheck(t *testing.T) {
 		}
 	}
 }
+
+func TestSessionBindCallback(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config: Config{
+			Halt: NewHalter(),
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	ctx := context.Background()
+	go NewServerConn(ctx, c1, serverConf)
+
+	called := false
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		SessionBindCallback: func(hostKey PublicKey, sessionID, signature []byte) error {
+			called = true
+			if !bytes.Equal(hostKey.Marshal(), testSigners["rsa"].PublicKey().Marshal()) {
+				t.Errorf("got host key %s", hostKey.Type())
+			}
+			sig, rest, ok := parseSignatureBody(signature)
+			if !ok || len(rest) > 0 {
+				t.Fatal("bad signature encoding")
+			}
+			if err := hostKey.Verify(sessionID, sig); err != nil {
+				t.Errorf("signature over session ID: %v", err)
+			}
+			return nil
+		},
+		Config: Config{
+			Halt: NewHalter(),
+		},
+	}
+	defer clientConf.Halt.RequestStop()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	if !called {
+		t.Error("SessionBindCallback not called")
+	}
+
+	client := NewClient(ctx, conn, chans, reqs, clientConf.Halt)
+	hostKey, sig, err := client.SessionBinding()
+	if err != nil {
+		t.Fatalf("SessionBinding: %v", err)
+	}
+	parsed, _, _ := parseSignatureBody(sig)
+	if err := hostKey.Verify(client.SessionID(), parsed); err != nil {
+		t.Errorf("SessionBinding signature: %v", err)
+	}
+}
+
+func TestConnPing(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client, server, err := sshPipe(halt)
+	if err != nil {
+		t.Fatalf("sshPipe: %v", err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	ctx := context.Background()
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	// Without the ping@openssh.com extension, Ping must fall back
+	// to a keepalive global request.
+	tr := client.(*connection).transport
+	tr.extMu.Lock()
+	tr.peerExtensions = nil
+	tr.extMu.Unlock()
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatalf("Ping with keepalive fallback: %v", err)
+	}
+}
+
+func TestClientHandlersClosed(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	conn, server, err := sshPipe(halt)
+	if err != nil {
+		t.Fatalf("sshPipe: %v", err)
+	}
+	defer conn.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{Conn: conn, Halt: halt, handlers: map[string]chan NewChannel{}}
+	in := make(chan NewChannel)
+	done := make(chan struct{})
+	go func() {
+		client.HandleChannelOpens(ctx, in)
+		close(done)
+	}()
+
+	handler := client.HandleChannelOpen("x11")
+	if client.HandleChannelOpen("x11") != nil {
+		t.Error("second HandleChannelOpen for a type did not return nil")
+	}
+	if types := client.ChannelTypes(); len(types) != 1 || types[0] != "x11" {
+		t.Errorf("ChannelTypes: got %q, want [x11]", types)
+	}
+
+	cancel()
+	<-done
+	if _, ok := <-handler; ok {
+		t.Error("handler still open after HandleChannelOpens returned")
+	}
+	if _, ok := <-client.HandleChannelOpen("other"); ok {
+		t.Error("HandleChannelOpen after the end returned an open channel")
+	}
+	if types := client.ChannelTypes(); types != nil {
+		t.Errorf("ChannelTypes after the end: got %q, want none", types)
+	}
+
+	if client.Context() != context.Background() {
+		t.Error("Context: want context.Background() by default")
+	}
+	client.SetContext(ctx)
+	if client.Context() != ctx {
+		t.Error("Context did not return the context of SetContext")
+	}
+}
+
+// typedNewChannel is a NewChannel of which only ChannelType works.
+type typedNewChannel struct {
+	NewChannel
+	typ string
+}
+
+func (c typedNewChannel) ChannelType() string { return c.typ }
+
+func TestClientChannelHandlers(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	conn, server, err := sshPipe(halt)
+	if err != nil {
+		t.Fatalf("sshPipe: %v", err)
+	}
+	defer conn.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan NewChannel)
+	client := NewClient(ctx, conn, in, nil, halt)
+
+	legacy := make(chan NewChannel, 1)
+	client.Mu.Lock()
+	client.ChannelHandlers["legacy"] = legacy
+	client.Mu.Unlock()
+	if client.HandleChannelOpen("legacy") != nil {
+		t.Error("HandleChannelOpen for a type in ChannelHandlers did not return nil")
+	}
+
+	in <- typedNewChannel{typ: "legacy"}
+	select {
+	case nc := <-legacy:
+		if nc.ChannelType() != "legacy" {
+			t.Errorf("got a %q channel, want legacy", nc.ChannelType())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the channel of ChannelHandlers got no NewChannel")
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config:       Config{Halt: NewHalter()},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	ctx := context.Background()
+	go NewServerConn(ctx, c1, serverConf)
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, clientConf.Halt)
+
+	rekeyed := make(chan struct{}, 1)
+	halted := make(chan struct{})
+	lost := make(chan error, 1)
+	client.OnRekey(func() { rekeyed <- struct{}{} })
+	client.OnHalt(func() { close(halted) })
+	client.OnDisconnect(func(err error) { lost <- err })
+
+	conn.(*connection).transport.requestKeyExchange()
+	select {
+	case <-rekeyed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnRekey callback not called")
+	}
+
+	clientConf.Halt.RequestStop()
+	select {
+	case <-halted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnHalt callback not called")
+	}
+	select {
+	case err := <-lost:
+		if err == nil {
+			t.Error("OnDisconnect called without a cause")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnDisconnect callback not called")
+	}
+
+	// Late registrations are called at once.
+	var late bool
+	client.OnDisconnect(func(error) { late = true })
+	if !late {
+		t.Error("OnDisconnect after the disconnect was not called")
+	}
+}
+
+func TestRunWithPTYNeedsTerminal(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		t.Skip("standard input is a terminal")
+	}
+	if err := (&Client{}).RunWithPTY(context.Background(), ""); err == nil {
+		t.Error("RunWithPTY without a terminal succeeded")
+	}
+}
@@ -0,0 +1,105 @@
+package ssh
+
+import "sync"
+
+// clientEvents holds the callbacks a Client fires when its
+// connection changes state.
+type clientEvents struct {
+	mu           sync.Mutex
+	onDisconnect []func(err error)
+	onRekey      []func()
+	onHalt       []func()
+
+	// lost is closed, and err set, once the connection is gone.
+	lost     chan struct{}
+	isLost   bool
+	err      error
+	isHalted bool
+}
+
+// OnDisconnect registers f to be called once the connection is
+// lost, with the error that ended it, as Wait returns it. If the
+// connection is already gone, f is called right away.
+func (c *Client) OnDisconnect(f func(err error)) {
+	e := &c.events
+	e.mu.Lock()
+	if !e.isLost {
+		e.onDisconnect = append(e.onDisconnect, f)
+		e.mu.Unlock()
+		return
+	}
+	err := e.err
+	e.mu.Unlock()
+	f(err)
+}
+
+// OnRekey registers f to be called after each completed key
+// re-exchange. The initial key exchange, done before the Client
+// exists, is not reported. f runs on a goroutine of its own.
+func (c *Client) OnRekey(f func()) {
+	e := &c.events
+	e.mu.Lock()
+	e.onRekey = append(e.onRekey, f)
+	e.mu.Unlock()
+}
+
+// OnHalt registers f to be called once the Halter of the Client is
+// asked to stop, which shuts the connection down. If that has
+// happened already, f is called right away. A connection lost for
+// other reasons only calls the OnDisconnect callbacks.
+func (c *Client) OnHalt(f func()) {
+	e := &c.events
+	e.mu.Lock()
+	if !e.isHalted {
+		e.onHalt = append(e.onHalt, f)
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+	f()
+}
+
+// disconnected fires the OnDisconnect callbacks, once.
+func (e *clientEvents) disconnected(err error) {
+	e.mu.Lock()
+	if e.isLost {
+		e.mu.Unlock()
+		return
+	}
+	e.isLost = true
+	e.err = err
+	fs := e.onDisconnect
+	e.onDisconnect = nil
+	close(e.lost)
+	e.mu.Unlock()
+	for _, f := range fs {
+		f(err)
+	}
+}
+
+// rekeyed fires the OnRekey callbacks. It is called by the key
+// exchange, which must not wait for them.
+func (e *clientEvents) rekeyed() {
+	e.mu.Lock()
+	fs := e.onRekey
+	e.mu.Unlock()
+	for _, f := range fs {
+		go f()
+	}
+}
+
+// halted fires the OnHalt callbacks, once.
+func (e *clientEvents) halted() {
+	e.mu.Lock()
+	if e.isHalted {
+		e.mu.Unlock()
+		return
+	}
+	e.isHalted = true
+	fs := e.onHalt
+	e.onHalt = nil
+	e.mu.Unlock()
+	for _, f := range fs {
+		f()
+	}
+}
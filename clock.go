@@ -0,0 +1,218 @@
+package ssh
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and runs timers for a connection: its
+// channels' IdleTimers, Config.RekeyTimeout and VersionTimeout, the
+// round trip times of Ping, the waits of RateLimiters, ServerConfig.AuthFailureDelay and
+// the connection attempts of Dial. Tests can replace it with a
+// FakeClock through Config.Clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is the Clock's version of time.Timer. C returns nil for
+// the Timers of AfterFunc.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// A Ticker is the Clock's version of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the Clock of package time, used when Config.Clock
+// is nil.
+type realClock struct{}
+
+// clockOr returns c, or the realClock if c is nil.
+func clockOr(c Clock) Clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// FakeClock is a Clock whose time only moves when Advance is
+// called, for tests that would otherwise sleep.
+type FakeClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock that starts at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, firing the timers and
+// tickers that come due, in order. The functions of AfterFunc run
+// on the goroutine calling Advance. A ticker fires at most once per
+// call, as a slow reader of a time.Ticker would see.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	fired := make(map[*fakeTimer]bool)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].when.Before(c.timers[j].when)
+		})
+		var t *fakeTimer
+		for _, u := range c.timers {
+			if !u.when.After(end) && !fired[u] {
+				t = u
+				break
+			}
+		}
+		if t == nil {
+			break
+		}
+		fired[t] = true
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+		if t.f != nil {
+			c.mu.Unlock()
+			t.f()
+			c.mu.Lock()
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// BlockUntil waits until n timers and tickers are waiting to fire,
+// so that a test can Advance past a timer that another goroutine
+// starts.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(&fakeTimer{c: make(chan time.Time, 1)}, d)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("ssh: non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{c.add(&fakeTimer{c: make(chan time.Time, 1), period: d}, d)}
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(&fakeTimer{f: f}, d)
+}
+
+func (c *FakeClock) add(t *fakeTimer, d time.Duration) *fakeTimer {
+	t.clock = c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// remove takes t out of the waiting timers, and reports whether it
+// was there. c.mu must be held.
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	for i, u := range c.timers {
+		if u == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is the Timer of a FakeClock, and with a period, the
+// basis of its Tickers.
+type fakeTimer struct {
+	clock  *FakeClock
+	when   time.Time
+	period time.Duration
+	c      chan time.Time
+	f      func()
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.remove(t)
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return active
+}
+
+// fakeTicker is the Ticker of a FakeClock.
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
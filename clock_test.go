@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	timer := c.NewTimer(2 * time.Second)
+	ticker := c.NewTicker(time.Second)
+	var fired []time.Time
+	c.AfterFunc(1500*time.Millisecond, func() { fired = append(fired, c.Now()) })
+	stopped := c.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Stop of a waiting timer returned false")
+	}
+
+	c.Advance(1500 * time.Millisecond)
+	if got := <-ticker.C(); !got.Equal(start.Add(time.Second)) {
+		t.Errorf("ticker fired at %v, want %v", got, start.Add(time.Second))
+	}
+	if len(fired) != 1 || !fired[0].Equal(start.Add(1500*time.Millisecond)) {
+		t.Errorf("AfterFunc ran at %v, want once at 1.5s", fired)
+	}
+	select {
+	case <-timer.C():
+		t.Error("timer fired early")
+	default:
+	}
+
+	c.Advance(time.Second)
+	if got := <-timer.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("timer fired at %v, want %v", got, start.Add(2*time.Second))
+	}
+	if got := <-ticker.C(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("ticker fired at %v, want %v", got, start.Add(2*time.Second))
+	}
+	if now := c.Now(); !now.Equal(start.Add(2500 * time.Millisecond)) {
+		t.Errorf("Now: got %v, want %v", now, start.Add(2500*time.Millisecond))
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+	ticker.Stop()
+	if timer.Reset(time.Second) {
+		t.Error("Reset of a fired timer returned true")
+	}
+	c.BlockUntil(1)
+}
+
+func TestFakeClockIdleTimeout(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	clock := NewFakeClock(time.Now())
+	s, c, mux := channelPairConfig(t, halt, &Config{MaxChannelPacket: channelMaxPacket, Clock: clock})
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	if err := c.SetReadIdleTimeout(time.Minute); err != nil {
+		t.Fatalf("SetReadIdleTimeout: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	// Without the clock moving, the read waits however long it takes.
+	select {
+	case err := <-done:
+		t.Fatalf("Read returned %v with the clock stopped", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		clock.Advance(10 * time.Second)
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("Read succeeded")
+			}
+			if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+				t.Fatalf("Read: got %v, want a timeout", err)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Read did not time out")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"math"
 	"sync"
+	"time"
 
 	_ "crypto/sha1"
 	_ "crypto/sha256"
@@ -38,9 +39,37 @@ var supportedKexAlgos = []string{
 	// P384 and P521 are not constant-time yet, but since we don't
 	// reuse ephemeral keys, using them for ECDH should be OK.
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
+	kexAlgoDHGEXSHA256,
+	kexAlgoDH16SHA512, kexAlgoDH18SHA512,
 	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
 }
 
+// These are the markers of the OpenSSH strict key exchange
+// extension, used as a Terrapin attack countermeasure. They are
+// only advertised in the first kexInit, and never negotiated as a
+// key exchange algorithm. See OpenSSH's PROTOCOL file.
+const (
+	kexStrictClient = "kex-strict-c-v00@openssh.com"
+	kexStrictServer = "kex-strict-s-v00@openssh.com"
+)
+
+// These markers advertise support for SSH_MSG_EXT_INFO, see RFC
+// 8308. Like the strict KEX markers, they only appear in the first
+// kexInit.
+const (
+	extInfoClient = "ext-info-c"
+	extInfoServer = "ext-info-s"
+)
+
+// extPing is the EXT_INFO name of the OpenSSH ping transport
+// extension. Its value is the version, currently "0".
+const extPing = "ping@openssh.com"
+
+// extServerSigAlgs is the EXT_INFO name of the list of signature
+// algorithms the server accepts for publickey authentication, RFC
+// 8308 section 3.1.
+const extServerSigAlgs = "server-sig-algs"
+
 // supportedHostKeyAlgos specifies the supported host-key algorithms (i.e. methods
 // of authenticating servers) in preference order.
 var supportedHostKeyAlgos = []string{
@@ -88,6 +117,15 @@ func parseError(tag uint8) error {
 	return fmt.Errorf("ssh: parse error in message type %d", tag)
 }
 
+func contains(list []string, e string) bool {
+	for _, s := range list {
+		if s == e {
+			return true
+		}
+	}
+	return false
+}
+
 func findCommon(what string, client []string, server []string) (common string, err error) {
 	for _, c := range client {
 		for _, s := range server {
@@ -190,6 +228,37 @@ type Config struct {
 	// unspecified, a size suitable for the chosen cipher is used.
 	RekeyThreshold uint64
 
+	// RekeyTimeout, if positive, caps how long a key exchange
+	// after the first may take, from sending our SSH_MSG_KEXINIT
+	// to receiving the peer's SSH_MSG_NEWKEYS. A peer that takes
+	// longer has its connection closed with ErrRekeyTimeout.
+	RekeyTimeout time.Duration
+
+	// VersionTimeout, if positive, bounds the exchange of the
+	// version lines that starts a connection, so that a peer that
+	// sends nothing, or sends junk slowly, cannot hold the
+	// handshake. A peer that takes longer has the net.Conn closed,
+	// and fails the handshake with ErrVersionTimeout. The deadlines
+	// of the net.Conn are not touched.
+	VersionTimeout time.Duration
+
+	// MaxVersionBytes caps the length of the version line of the
+	// peer. If zero, it is 255, the limit of RFC 4253, section
+	// 4.2.
+	MaxVersionBytes int
+
+	// MaxConnectionAge, if positive, caps how long the connection
+	// lasts, for environments that mandate a periodic refresh of
+	// the transport and credentials. Once it is that old, channel
+	// opens fail with ErrMaxConnectionAge, and those of the peer
+	// are refused as Prohibited; the channels still open get
+	// MaxConnectionAgeGrace to close. The peer is then sent an
+	// SSH_MSG_DISCONNECT, and the connection closed, its Wait
+	// returning ErrMaxConnectionAge; a connection that ends
+	// otherwise during the grace period returns its own error.
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+
 	// The allowed key exchanges algorithms. If unspecified then a
 	// default set of algorithms is used.
 	KeyExchanges []string
@@ -202,10 +271,182 @@ type Config struct {
 	// is used.
 	MACs []string
 
+	// Compressions are the compression methods to offer, in order
+	// of preference, before "none", which is always offered. See
+	// LZ4Compression.
+	Compressions []Compression
+
+	// Obfuscator, if non-nil, transforms the byte stream under
+	// the SSH transport. Both ends must use matching ones.
+	Obfuscator Obfuscator
+
+	// PeerVersionCallback, if non-nil, is called with the version
+	// line of the peer before the key exchange, and may refuse
+	// the peer or adjust this Config for it; see
+	// PeerVersionCallback.
+	PeerVersionCallback PeerVersionCallback
+
+	// Quirks are workarounds to use with the peer whatever its
+	// version, on top of those the table of known implementations
+	// picks for it, unless NoQuirkTable is set; see Quirks. A
+	// PeerVersionCallback can set them too.
+	Quirks       Quirks
+	NoQuirkTable bool
+
+	// quirks are the Quirks in effect, once the version of the
+	// peer is known.
+	quirks Quirks
+
+	// goroutines counts the goroutines of the connection, for
+	// DebugDump.
+	goroutines *goroutineLedger
+
+	// KexProposalCallback, if non-nil, is called during each key
+	// exchange and may reorder or trim the algorithms we propose.
+	// See KexProposalCallback for details.
+	KexProposalCallback KexProposalCallback
+
+	// KeyLogWriter, if non-nil, receives the secrets of each key
+	// exchange, in a format Wireshark can use to decrypt captured
+	// traffic; see writeKeyLog. It is for debugging only: anyone
+	// who reads it can read the connection.
+	KeyLogWriter io.Writer
+
+	// PacketDump, if non-nil, records the packets of the
+	// connection, decrypted. It is for debugging only, like
+	// KeyLogWriter.
+	PacketDump *PacketDump
+
+	// MaxChannelPacket is the most data we accept in a single
+	// channel packet, which we advertise when opening or accepting
+	// a channel. The peer advertises its own limit for the data we
+	// send, so larger packets flow only towards peers that raise
+	// theirs too. The default is 32KB; it is kept between 9 bytes
+	// and 252KB, the most the transport can carry.
+	MaxChannelPacket uint32
+
+	// ChannelWindow is the flow-control window we give the peer
+	// for each channel: how much data it may send that we have
+	// not read yet. A larger window keeps fast links busy across
+	// a long round trip, at the cost of buffering as much per
+	// channel. The default is 2MB, as in OpenSSH; it is at least
+	// MaxChannelPacket.
+	ChannelWindow uint32
+
+	// Clock, if non-nil, replaces package time for the timers of
+	// the connection; see Clock. It is meant for tests.
+	Clock Clock
+
+	// Faults, if non-nil, drops, delays, duplicates or corrupts
+	// packets we send, for testing, in builds with the sshfaults
+	// tag; see FaultInjector.
+	Faults *FaultInjector
+
+	// Interceptors see the channel opens and requests of the
+	// peer, in order, before they are dispatched, and may veto
+	// them; see Interceptor. More can be added to a connection
+	// with Interceptable.
+	Interceptors []Interceptor
+
+	// ChannelOpenLimit, if non-nil, caps the channel opens of the
+	// peer that are pending, or too fast; see ChannelOpenLimit.
+	ChannelOpenLimit *ChannelOpenLimit
+
+	// Metrics, if non-nil, receives the metrics of the
+	// connection; see MetricsSink.
+	Metrics MetricsSink
+
+	// Padding, if non-nil, pads the packets sent beyond the least
+	// the cipher needs, to hide their lengths; see PaddingPolicy.
+	// The peer needs no support for it.
+	Padding PaddingPolicy
+
 	// Halt is for shutdown
 	Halt *Halter
 }
 
+// KexProposal holds the algorithm name-lists of an SSH_MSG_KEXINIT,
+// in order of preference. The strict KEX and ext-info markers are
+// not included.
+type KexProposal struct {
+	KeyExchanges        []string
+	HostKeyAlgorithms   []string
+	CiphersClientServer []string
+	CiphersServerClient []string
+	MACsClientServer    []string
+	MACsServerClient    []string
+}
+
+// KexProposalCallback receives the peer's proposal and ours, and
+// returns the proposal to negotiate with in this key exchange.
+// Both proposals are copies, which the callback may change in place.
+// Returning an error aborts the key exchange, and with it the
+// connection.
+//
+// If the peer's SSH_MSG_KEXINIT arrived before we sent ours, the
+// returned proposal is what we send. Otherwise our proposal is
+// already on the wire and the callback can only veto: the key
+// exchange fails unless every algorithm agreed upon appears in the
+// returned proposal. A server with a KexProposalCallback waits for
+// the client's first SSH_MSG_KEXINIT before sending its own, so the
+// callback can always reorder the initial proposal.
+type KexProposalCallback func(peer, ours KexProposal) (KexProposal, error)
+
+// proposal returns the algorithm lists of m, without the markers
+// for strict KEX and ext-info.
+func (m *kexInitMsg) proposal() KexProposal {
+	// The lists are copies, as those of our own kexInit may be
+	// the Config's.
+	p := KexProposal{
+		HostKeyAlgorithms:   append([]string(nil), m.ServerHostKeyAlgos...),
+		CiphersClientServer: append([]string(nil), m.CiphersClientServer...),
+		CiphersServerClient: append([]string(nil), m.CiphersServerClient...),
+		MACsClientServer:    append([]string(nil), m.MACsClientServer...),
+		MACsServerClient:    append([]string(nil), m.MACsServerClient...),
+	}
+	for _, k := range m.KexAlgos {
+		switch k {
+		case kexStrictClient, kexStrictServer, extInfoClient, extInfoServer:
+		default:
+			p.KeyExchanges = append(p.KeyExchanges, k)
+		}
+	}
+	return p
+}
+
+// setProposal replaces the algorithm lists of m with those of p.
+func (m *kexInitMsg) setProposal(p KexProposal) {
+	m.KexAlgos = p.KeyExchanges
+	m.ServerHostKeyAlgos = p.HostKeyAlgorithms
+	m.CiphersClientServer = p.CiphersClientServer
+	m.CiphersServerClient = p.CiphersServerClient
+	m.MACsClientServer = p.MACsClientServer
+	m.MACsServerClient = p.MACsServerClient
+}
+
+// allows returns an error if one of the agreed algorithms in algs
+// does not appear in p.
+func (p *KexProposal) allows(algs *algorithms) error {
+	checks := []struct {
+		what string
+		list []string
+		alg  string
+	}{
+		{"key exchange", p.KeyExchanges, algs.kex},
+		{"host key", p.HostKeyAlgorithms, algs.hostKey},
+		{"client to server cipher", p.CiphersClientServer, algs.w.Cipher},
+		{"server to client cipher", p.CiphersServerClient, algs.r.Cipher},
+		{"client to server MAC", p.MACsClientServer, algs.w.MAC},
+		{"server to client MAC", p.MACsServerClient, algs.r.MAC},
+	}
+	for _, c := range checks {
+		if !contains(c.list, c.alg) {
+			return fmt.Errorf("ssh: %s %q vetoed by KexProposalCallback", c.what, c.alg)
+		}
+	}
+	return nil
+}
+
 // SetDefaults sets sensible values for unset fields in config. This is
 // exported for testing: Configs passed to SSH functions are copied and have
 // default values set automatically.
@@ -242,6 +483,24 @@ func (c *Config) SetDefaults() {
 		c.RekeyThreshold = math.MaxInt64
 	}
 
+	if c.MaxChannelPacket == 0 {
+		c.MaxChannelPacket = channelMaxPacket
+	} else if c.MaxChannelPacket < minPacketLength {
+		c.MaxChannelPacket = minPacketLength
+	} else if c.MaxChannelPacket > maxChannelPayload {
+		c.MaxChannelPacket = maxChannelPayload
+	}
+
+	if c.ChannelWindow == 0 {
+		c.ChannelWindow = channelWindowSize
+	} else if c.ChannelWindow < c.MaxChannelPacket {
+		c.ChannelWindow = c.MaxChannelPacket
+	}
+
+	if c.Clock == nil {
+		c.Clock = realClock{}
+	}
+
 	if c.Halt == nil {
 		c.Halt = NewHalter()
 	}
@@ -315,6 +574,11 @@ type window struct {
 	writeWaiters int
 	closed       bool
 	idle         *IdleTimer
+
+	// stalls counts the reservations that waited for the window
+	// to grow, and stallTime is how long they waited.
+	stalls    int64
+	stallTime time.Duration
 }
 
 // add adds win to the amount of window available
@@ -338,6 +602,14 @@ func (w *window) add(win uint32) bool {
 	return true
 }
 
+// fill grows the window to its largest size, 2^32-1 bytes.
+func (w *window) fill() {
+	w.L.Lock()
+	w.win = math.MaxUint32
+	w.Broadcast()
+	w.L.Unlock()
+}
+
 // close sets the window to closed, so all reservations fail
 // immediately.
 func (w *window) close() {
@@ -380,6 +652,13 @@ func (w *window) reserve(win uint32) (num uint32, err error) {
 	}
 	w.writeWaiters++
 	w.Broadcast()
+	if w.win == 0 && !w.closed {
+		start := time.Now()
+		defer func() {
+			w.stalls++
+			w.stallTime += time.Since(start)
+		}()
+	}
 	for w.win == 0 && !w.closed {
 		w.Wait()
 		if bye, err := w.reserveShouldReturn(); bye {
@@ -397,6 +676,13 @@ func (w *window) reserve(win uint32) (num uint32, err error) {
 	return win, err
 }
 
+// stats returns the stall count and time of the window.
+func (w *window) stats() (stalls int64, stallTime time.Duration) {
+	w.L.Lock()
+	defer w.L.Unlock()
+	return w.stalls, w.stallTime
+}
+
 // waitWriterBlocked waits until some goroutine is blocked for further
 // writes. It is used in tests only.
 func (w *window) waitWriterBlocked() {
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Private compression methods, for when both ends run this package.
+// Unlike zlib, they compress each packet on its own, so that codecs
+// with block APIs can be used, and a packet never depends on the
+// ones before it. LZ4Compression is the codec of CompressionLZ4;
+// for CompressionZstd, use one from a third-party package, see
+// Compression.
+const (
+	// CompressionZstd compresses each packet payload into a
+	// single Zstandard frame (RFC 8878) that records the content
+	// size.
+	CompressionZstd = "zstd@glycerine.github.io"
+
+	// CompressionLZ4 compresses each packet payload into its
+	// length as a uint32, followed by an LZ4 block.
+	CompressionLZ4 = "lz4@glycerine.github.io"
+)
+
+// Compression is a packet compression method, such as
+// LZ4Compression, or a codec for CompressionZstd from a third-party
+// package. It must be safe for concurrent use, as each connection
+// uses it for both directions.
+type Compression interface {
+	// Name is the name of the method in the key exchange.
+	Name() string
+
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress appends the decompressed form of src to dst, and
+	// fails if it would be longer than limit.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+// compressionNames returns the compression methods to offer, in
+// order of preference, for the given codecs.
+func compressionNames(codecs []Compression) []string {
+	if len(codecs) == 0 {
+		return supportedCompressions
+	}
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return append(names, compressionNone)
+}
+
+// findCompression returns the codec for the negotiated method name,
+// or nil for "none".
+func findCompression(codecs []Compression, name string) (Compression, error) {
+	if name == compressionNone {
+		return nil, nil
+	}
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("ssh: no codec for compression %q", name)
+}
+
+var errDecompressedTooLong = errors.New("ssh: decompressed packet too long")
+
+// compressingCipher compresses the payloads of a packetCipher.
+type compressingCipher struct {
+	packetCipher
+	codec Compression
+	buf   []byte
+}
+
+func (c *compressingCipher) writePacket(seqnum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	var err error
+	c.buf, err = c.codec.Compress(c.buf[:0], packet)
+	if err != nil {
+		return err
+	}
+	return c.packetCipher.writePacket(seqnum, w, rand, c.buf)
+}
+
+func (c *compressingCipher) readPacket(seqnum uint32, r io.Reader) ([]byte, error) {
+	packet, err := c.packetCipher.readPacket(seqnum, r)
+	if err != nil {
+		return nil, err
+	}
+	c.buf, err = c.codec.Decompress(c.buf[:0], packet, maxPacket)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.buf) > maxPacket {
+		return nil, errDecompressedTooLong
+	}
+	return c.buf, nil
+}
+
+// withCompression wraps ciph to compress with the codec, if any, for
+// the negotiated method name.
+func withCompression(ciph packetCipher, codecs []Compression, name string) (packetCipher, error) {
+	codec, err := findCompression(codecs, name)
+	if err != nil || codec == nil {
+		return ciph, err
+	}
+	return &compressingCipher{packetCipher: ciph, codec: codec}, nil
+}
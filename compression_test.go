@@ -0,0 +1,243 @@
+package ssh
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// flateCompression compresses each packet on its own with DEFLATE,
+// and counts the packets.
+type flateCompression struct {
+	compressed, decompressed int64
+}
+
+func (f *flateCompression) Name() string { return "deflate-test@glycerine.github.io" }
+
+func (f *flateCompression) Compress(dst, src []byte) ([]byte, error) {
+	atomic.AddInt64(&f.compressed, 1)
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *flateCompression) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	atomic.AddInt64(&f.decompressed, 1)
+	buf := bytes.NewBuffer(dst)
+	r := flate.NewReader(bytes.NewReader(src))
+	n, err := io.Copy(buf, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(limit) {
+		return nil, errDecompressedTooLong
+	}
+	return buf.Bytes(), nil
+}
+
+// compressedPair connects a client and a server offering the given
+// codecs, and returns the client once it has authenticated.
+func compressedPair(t *testing.T, clientCodecs, serverCodecs []Compression) (*Client, *Halter) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	halt := NewHalter()
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config:       Config{Halt: halt, Compressions: serverCodecs},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	go func() {
+		defer c1.Close()
+		_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(ctx, in, halt)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, Compressions: clientCodecs},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return NewClient(ctx, conn, chans, reqs, halt), halt
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	codec := &flateCompression{}
+	client, halt := compressedPair(t, []Compression{codec}, []Compression{codec})
+	defer halt.RequestStop()
+
+	ch, in, err := client.OpenChannel(context.Background(), "echo", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(context.Background(), in, halt)
+	data := bytes.Repeat([]byte("log line with much repetition\n"), 10000)
+	go func() {
+		ch.Write(data)
+		ch.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echo mangled %d bytes into %d", len(data), len(got))
+	}
+	if atomic.LoadInt64(&codec.compressed) == 0 || atomic.LoadInt64(&codec.decompressed) == 0 {
+		t.Error("packets were not compressed")
+	}
+}
+
+func TestCompressionOneSided(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	codec := &flateCompression{}
+	client, halt := compressedPair(t, []Compression{codec}, nil)
+	defer halt.RequestStop()
+
+	if _, _, err := client.SendRequest(context.Background(), "ping", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if n := atomic.LoadInt64(&codec.compressed); n != 0 {
+		t.Errorf("%d packets compressed without the server offering it", n)
+	}
+}
+
+func TestCompressionNames(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	codec := &flateCompression{}
+	names := compressionNames([]Compression{codec})
+	if len(names) != 2 || names[0] != codec.Name() || names[1] != compressionNone {
+		t.Errorf("got %q", names)
+	}
+	if c, err := findCompression(nil, compressionNone); c != nil || err != nil {
+		t.Errorf("none: got %v, %v", c, err)
+	}
+	if _, err := findCompression(nil, CompressionZstd); err == nil {
+		t.Error("found a codec for zstd without one")
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	rand := rand.New(rand.NewSource(1))
+	random := make([]byte, 70000)
+	rand.Read(random)
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcdefghijklm"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("log line with much repetition\n"), 3000),
+		random,
+		append(bytes.Repeat([]byte("xy"), 40000), random[:100]...),
+	}
+	var codec LZ4Compression
+	for _, in := range inputs {
+		comp, err := codec.Compress([]byte("prefix"), in)
+		if err != nil {
+			t.Fatalf("Compress: %v", err)
+		}
+		comp = comp[len("prefix"):]
+		got, err := codec.Decompress([]byte("prefix"), comp, len(in))
+		if err != nil {
+			t.Fatalf("Decompress of %d bytes: %v", len(in), err)
+		}
+		if !bytes.Equal(got[len("prefix"):], in) {
+			t.Errorf("round trip of %d bytes gave %d", len(in), len(got)-len("prefix"))
+		}
+		if len(in) > 0 {
+			if _, err := codec.Decompress(nil, comp, len(in)-1); err != errDecompressedTooLong {
+				t.Errorf("Decompress past the limit: %v", err)
+			}
+		}
+	}
+	if comp, _ := codec.Compress(nil, inputs[4]); len(comp) > len(inputs[4])/10 {
+		t.Errorf("repetitive text compressed to %d bytes from %d", len(comp), len(inputs[4]))
+	}
+
+	// Corrupt blocks fail, and do not panic.
+	comp, _ := codec.Compress(nil, inputs[6])
+	for i := 0; i < 1000; i++ {
+		bad := append([]byte(nil), comp...)
+		bad[4+rand.Intn(len(bad)-4)] = byte(rand.Intn(256))
+		codec.Decompress(nil, bad[:rand.Intn(len(bad))], maxPacket)
+	}
+}
+
+// countingLZ4 is LZ4Compression, that counts the packets it
+// decompresses.
+type countingLZ4 struct {
+	LZ4Compression
+	decompressed int64
+}
+
+func (c *countingLZ4) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	atomic.AddInt64(&c.decompressed, 1)
+	return c.LZ4Compression.Decompress(dst, src, limit)
+}
+
+func TestLZ4Negotiated(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	codec := &countingLZ4{}
+	client, halt := compressedPair(t, []Compression{codec}, []Compression{LZ4Compression{}})
+	defer halt.RequestStop()
+
+	ch, in, err := client.OpenChannel(context.Background(), "echo", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(context.Background(), in, halt)
+	data := bytes.Repeat([]byte("log line with much repetition\n"), 10000)
+	go func() {
+		ch.Write(data)
+		ch.CloseWrite()
+	}()
+	got, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echo mangled %d bytes into %d", len(data), len(got))
+	}
+	if atomic.LoadInt64(&codec.decompressed) == 0 {
+		t.Error("packets were not compressed")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 // OpenChannelError is returned if the other side rejects an
@@ -22,6 +23,11 @@ func (e *OpenChannelError) Error() string {
 	return fmt.Sprintf("ssh: rejected: %s (%s)", e.Reason, e.Message)
 }
 
+// Is reports whether target is ErrChannelRejected.
+func (e *OpenChannelError) Is(target error) bool {
+	return target == ErrChannelRejected
+}
+
 // ConnMetadata holds metadata for the connection.
 type ConnMetadata interface {
 	// User returns the user ID for this connection.
@@ -61,7 +67,8 @@ type Conn interface {
 	// rejected, it returns *OpenChannelError. On success it returns
 	// the SSH Channel and a Go channel for incoming, out-of-band
 	// requests. The Go channel must be serviced, or the
-	// connection will hang.
+	// connection will hang. The open fails once ctx is done; with
+	// a ctx of WithChannelLifetime, the channel is closed then too.
 	OpenChannel(ctx context.Context, name string, data []byte, parHalt *Halter) (Channel, <-chan *Request, error)
 
 	// Close closes the underlying network connection
@@ -80,13 +87,23 @@ type Conn interface {
 	// that it can be closed.
 	NcCloser() io.Closer
 
+	// Ping checks that the peer is responsive and returns the
+	// round trip time. If the peer announced the
+	// ping@openssh.com transport extension, a transport level
+	// ping is used. Otherwise Ping falls back to a
+	// keepalive@openssh.com global request; any reply, even a
+	// failure, counts as a pong. If ctx is done first, Ping
+	// returns ctx.Err(); io.EOF means the connection is gone.
+	Ping(ctx context.Context) (time.Duration, error)
+
 	// TODO(hanwen): consider exposing:
 	//   RequestKeyChange
 	//   Disconnect
 }
 
 // DiscardRequests consumes and rejects all requests from the
-// passed-in channel.
+// passed-in channel, until it is closed, ctx is done or halt is
+// requested to stop.
 func DiscardRequests(ctx context.Context, in <-chan *Request, halt *Halter) {
 
 	var reqStop chan struct{}
@@ -95,7 +112,10 @@ func DiscardRequests(ctx context.Context, in <-chan *Request, halt *Halter) {
 	}
 	for {
 		select {
-		case req := <-in:
+		case req, ok := <-in:
+			if !ok {
+				return
+			}
 			if req != nil && req.WantReply {
 				req.Reply(false, nil)
 			}
@@ -131,6 +151,11 @@ func newConnection(nc net.Conn, cfg *Config, clicfg *ClientConfig) *connection {
 	if cfg.Halt == nil {
 		panic("assert: cfg.Halt cannot be nil in newConnection()")
 	}
+	side := "server"
+	if clicfg != nil {
+		side = "client"
+	}
+	cfg.goroutines = newGoroutineLedger(side, nc.RemoteAddr())
 	conn := &connection{
 		sshConn: sshConn{conn: nc},
 		halt:    cfg.Halt,
@@ -150,6 +175,20 @@ func (c *connection) Done() <-chan struct{} {
 	return c.halt.ReqStopChan()
 }
 
+func (c *connection) Ping(ctx context.Context) (time.Duration, error) {
+	begin := c.cfg.Clock.Now()
+	var err error
+	if c.transport.peerHasExtension(extPing, "0") {
+		err = c.transport.ping(ctx)
+	} else {
+		_, _, err = c.SendRequest(ctx, "keepalive@openssh.com", true, nil)
+		if err == io.EOF && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return c.cfg.Clock.Now().Sub(begin), err
+}
+
 // sshconn provides net.Conn metadata, but disallows direct reads and
 // writes.
 type sshConn struct {
@@ -0,0 +1,666 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/glycerine/xcryptossh/terminal"
+)
+
+// The connection multiplexing protocol of OpenSSH, as described in
+// PROTOCOL.mux of its sources: the ControlMaster and ControlPath
+// options of ssh(1). Messages are framed by a uint32 length, start
+// with a uint32 type, and are otherwise encoded as SSH messages.
+// File descriptors follow some requests, one per sendmsg(2) with a
+// single byte of data.
+const (
+	muxMsgHello = 0x00000001
+
+	muxCNewSession    = 0x10000002
+	muxCAliveCheck    = 0x10000004
+	muxCTerminate     = 0x10000005
+	muxCNewStdioFwd   = 0x10000008
+	muxCStopListening = 0x10000009
+
+	muxSOK               = 0x80000001
+	muxSPermissionDenied = 0x80000002
+	muxSFailure          = 0x80000003
+	muxSExitMessage      = 0x80000004
+	muxSAlive            = 0x80000005
+	muxSSessionOpened    = 0x80000006
+	muxSTTYAllocFail     = 0x80000008
+)
+
+// muxVersion is the protocol version spoken, that of OpenSSH since
+// 5.8.
+const muxVersion = 4
+
+// maxMuxPacket bounds the control messages accepted.
+const maxMuxPacket = 256 * 1024
+
+type muxHelloMsg struct {
+	Type       uint32
+	Version    uint32
+	Extensions []byte `ssh:"rest"`
+}
+
+// muxRequestMsg is MUX_C_ALIVE_CHECK, MUX_C_TERMINATE,
+// MUX_C_STOP_LISTENING and MUX_S_OK, and the head of every other
+// request.
+type muxRequestMsg struct {
+	Type  uint32
+	ReqID uint32
+	Rest  []byte `ssh:"rest"`
+}
+
+type muxNewSessionMsg struct {
+	Type       uint32
+	ReqID      uint32
+	Reserved   string
+	WantTTY    bool
+	WantX11    bool
+	WantAgent  bool
+	Subsystem  bool
+	EscapeChar uint32
+	Term       string
+	Command    string
+	Env        []byte `ssh:"rest"`
+}
+
+type muxNewStdioFwdMsg struct {
+	Type     uint32
+	ReqID    uint32
+	Reserved string
+	Host     string
+	Port     uint32
+}
+
+type muxFailureMsg struct {
+	Type   uint32
+	ReqID  uint32
+	Reason string
+}
+
+type muxAliveMsg struct {
+	Type  uint32
+	ReqID uint32
+	Pid   uint32
+}
+
+type muxSessionOpenedMsg struct {
+	Type      uint32
+	ReqID     uint32
+	SessionID uint32
+}
+
+type muxExitMsg struct {
+	Type      uint32
+	SessionID uint32
+	ExitValue uint32
+}
+
+// readMuxPacket reads one control message. It reads no further than
+// the message, so that a descriptor sent after it stays queued.
+func readMuxPacket(r io.Reader) ([]byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n < 4 || n > maxMuxPacket {
+		return nil, fmt.Errorf("ssh: control message of %d bytes", n)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writeMuxPacket frames p and writes it.
+func writeMuxPacket(w io.Writer, p []byte) error {
+	buf := make([]byte, 0, 4+len(p))
+	buf = appendU32(buf, uint32(len(p)))
+	_, err := w.Write(append(buf, p...))
+	return err
+}
+
+// muxType returns the type of control message p.
+func muxType(p []byte) uint32 {
+	if len(p) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(p)
+}
+
+// sendFile passes f over conn, as mm_send_fd of OpenSSH does.
+func sendFile(conn *net.UnixConn, f *os.File) error {
+	_, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
+
+// receiveFile takes a descriptor passed over conn by sendFile.
+func receiveFile(conn *net.UnixConn, name string) (*os.File, error) {
+	var buf [1]byte
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("ssh: control client sent no descriptor")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds[1:] {
+		syscall.Close(fd)
+	}
+	return os.NewFile(uintptr(fds[0]), name), nil
+}
+
+// controlSessionID numbers the sessions of all control masters, for
+// MUX_S_SESSION_OPENED.
+var controlSessionID uint32
+
+// ServeControl makes c a control master, as ssh -M would: it serves
+// the connection multiplexing protocol of OpenSSH on l, usually
+// bound to the ControlPath, so that ssh -S path, or a
+// ControlClient, can run commands and stdio forwards (-W) over c
+// without authenticating again. It also answers -O check, -O exit,
+// which closes c, and -O stop, which stops ServeControl. Port
+// forwarding requests (-O forward and -O cancel) and proxy mode are
+// refused. As in OpenSSH, a control client must run as the user of
+// this process, or as root; the connections of others are closed.
+//
+// ServeControl closes l, and returns nil when it is stopped, by
+// -O stop, by ctx or by c.Halt, or the error of Accept.
+func (c *Client) ServeControl(ctx context.Context, l *net.UnixListener) error {
+	stop := NewHalter()
+	c.Halt.AddDownstream(stop)
+	defer c.Halt.RemoveDownstream(stop)
+	if c.Halt.IsStopRequested() {
+		stop.RequestStop()
+	}
+	return acceptLoop(ctx, l, stop.ReqStopChan(), func(nConn net.Conn) {
+		go func() {
+			defer nConn.Close()
+			c.serveControlConn(ctx, nConn.(*net.UnixConn), stop)
+		}()
+	})
+}
+
+// serveControlConn serves one control client, until it is done with
+// the connection.
+func (c *Client) serveControlConn(ctx context.Context, conn *net.UnixConn, stop *Halter) error {
+	if err := checkControlPeer(conn); err != nil {
+		return err
+	}
+	if err := writeMuxPacket(conn, Marshal(&muxHelloMsg{Type: muxMsgHello, Version: muxVersion})); err != nil {
+		return err
+	}
+	p, err := readMuxPacket(conn)
+	if err != nil {
+		return err
+	}
+	var hello muxHelloMsg
+	if err := Unmarshal(p, &hello); err != nil {
+		return err
+	}
+	if hello.Type != muxMsgHello || hello.Version != muxVersion {
+		return fmt.Errorf("ssh: control client speaks version %d, want %d", hello.Version, muxVersion)
+	}
+
+	for {
+		p, err := readMuxPacket(conn)
+		if err != nil {
+			return err
+		}
+		var req muxRequestMsg
+		if err := Unmarshal(p, &req); err != nil {
+			return err
+		}
+		ok := Marshal(&muxRequestMsg{Type: muxSOK, ReqID: req.ReqID})
+		switch req.Type {
+		case muxCAliveCheck:
+			err = writeMuxPacket(conn, Marshal(&muxAliveMsg{
+				Type:  muxSAlive,
+				ReqID: req.ReqID,
+				Pid:   uint32(os.Getpid()),
+			}))
+		case muxCTerminate:
+			writeMuxPacket(conn, ok)
+			return c.Close()
+		case muxCStopListening:
+			stop.RequestStop()
+			err = writeMuxPacket(conn, ok)
+		case muxCNewSession:
+			return c.controlSession(ctx, conn, p)
+		case muxCNewStdioFwd:
+			return c.controlStdioFwd(ctx, conn, p)
+		default:
+			err = writeMuxPacket(conn, Marshal(&muxFailureMsg{
+				Type:   muxSFailure,
+				ReqID:  req.ReqID,
+				Reason: fmt.Sprintf("unsupported request 0x%08x", req.Type),
+			}))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// controlPeerUID returns the uid of the process at the other end of
+// a control connection. It is a variable for tests.
+var controlPeerUID = peerUID
+
+// checkControlPeer fails unless the peer of conn runs as our user or
+// as root.
+func checkControlPeer(conn *net.UnixConn) error {
+	uid, err := controlPeerUID(conn)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() && uid != 0 {
+		return fmt.Errorf("ssh: control client runs as uid %d, not %d", uid, os.Getuid())
+	}
+	return nil
+}
+
+// controlFailure answers request id with a MUX_S_FAILURE for err,
+// and returns err.
+func controlFailure(conn *net.UnixConn, id uint32, err error) error {
+	writeMuxPacket(conn, Marshal(&muxFailureMsg{Type: muxSFailure, ReqID: id, Reason: err.Error()}))
+	return err
+}
+
+// controlSession runs the session requested by MUX_C_NEW_SESSION p
+// on the descriptors that follow it, and reports its exit status.
+func (c *Client) controlSession(ctx context.Context, conn *net.UnixConn, p []byte) error {
+	var msg muxNewSessionMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range []string{"stdin", "stdout", "stderr"} {
+		f, err := receiveFile(conn, "control "+name)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	session, err := c.NewSession(ctx)
+	if err != nil {
+		return controlFailure(conn, msg.ReqID, err)
+	}
+	defer session.Close()
+	for env := msg.Env; len(env) > 0; {
+		var kv []byte
+		var ok bool
+		if kv, env, ok = parseString(env); !ok {
+			break
+		}
+		// Servers commonly refuse variables, as OpenSSH ignores.
+		if i := strings.IndexByte(string(kv), '='); i > 0 {
+			session.Setenv(string(kv[:i]), string(kv[i+1:]))
+		}
+	}
+	ttyFailed := false
+	if msg.WantTTY {
+		width, height := 80, 24
+		if w, h, err := terminal.GetSize(int(files[0].Fd())); err == nil {
+			width, height = w, h
+		}
+		ttyFailed = session.RequestPty(msg.Term, height, width, TerminalModes{}) != nil
+	}
+	session.Stdin = files[0]
+	session.Stdout = files[1]
+	session.Stderr = files[2]
+	switch {
+	case msg.Subsystem:
+		err = session.RequestSubsystem(msg.Command)
+	case msg.Command == "":
+		err = session.Shell()
+	default:
+		err = session.Start(msg.Command)
+	}
+	if err != nil {
+		return controlFailure(conn, msg.ReqID, err)
+	}
+
+	id := atomic.AddUint32(&controlSessionID, 1)
+	if err := writeMuxPacket(conn, Marshal(&muxSessionOpenedMsg{
+		Type:      muxSSessionOpened,
+		ReqID:     msg.ReqID,
+		SessionID: id,
+	})); err != nil {
+		return err
+	}
+	if ttyFailed {
+		writeMuxPacket(conn, Marshal(&muxRequestMsg{Type: muxSTTYAllocFail, ReqID: id}))
+	}
+	// The client going away ends the session.
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		session.Close()
+	}()
+
+	status := 0
+	if err := session.Wait(); err != nil {
+		status = 255
+		if ee, ok := err.(*ExitError); ok && ee.Signal() == "" {
+			status = ee.ExitStatus()
+		}
+	}
+	return writeMuxPacket(conn, Marshal(&muxExitMsg{
+		Type:      muxSExitMessage,
+		SessionID: id,
+		ExitValue: uint32(status),
+	}))
+}
+
+// controlStdioFwd connects the descriptors that follow
+// MUX_C_NEW_STDIO_FWD p to the address it names, until either side
+// closes.
+func (c *Client) controlStdioFwd(ctx context.Context, conn *net.UnixConn, p []byte) error {
+	var msg muxNewStdioFwdMsg
+	if err := Unmarshal(p, &msg); err != nil {
+		return err
+	}
+	in, err := receiveFile(conn, "control stdin")
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := receiveFile(conn, "control stdout")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	addr := net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port)))
+	ch, err := c.DialWithContext(ctx, "tcp", addr)
+	if err != nil {
+		return controlFailure(conn, msg.ReqID, err)
+	}
+	defer ch.Close()
+	if err := writeMuxPacket(conn, Marshal(&muxSessionOpenedMsg{
+		Type:      muxSSessionOpened,
+		ReqID:     msg.ReqID,
+		SessionID: atomic.AddUint32(&controlSessionID, 1),
+	})); err != nil {
+		return err
+	}
+
+	done := make(chan struct{}, 3)
+	go func() {
+		io.Copy(ch, in)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(out, ch)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		done <- struct{}{}
+	}()
+	<-done
+	return nil
+}
+
+// ControlError is a request refused by a control master.
+type ControlError struct {
+	// PermissionDenied tells a refusal by policy from a failure.
+	PermissionDenied bool
+	Reason           string
+}
+
+func (e *ControlError) Error() string {
+	return "ssh: control master refused request: " + e.Reason
+}
+
+// ControlClient speaks the connection multiplexing protocol of
+// OpenSSH to a control master, ssh -M or ServeControl, to use its
+// connection, like ssh -S path does. Check, StopListening and Exit
+// may be called any number of times, but Run and StdioForward hand
+// the control connection over to what they start, so nothing else
+// may follow them.
+type ControlClient struct {
+	conn *net.UnixConn
+
+	mu     sync.Mutex
+	nextID uint32
+}
+
+// DialControl connects to the control master listening on path.
+func DialControl(ctx context.Context, path string) (*ControlClient, error) {
+	var d net.Dialer
+	nConn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	conn := nConn.(*net.UnixConn)
+	p, err := readMuxPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var hello muxHelloMsg
+	if err := Unmarshal(p, &hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if hello.Type != muxMsgHello || hello.Version != muxVersion {
+		conn.Close()
+		return nil, fmt.Errorf("ssh: control master speaks version %d, want %d", hello.Version, muxVersion)
+	}
+	if err := writeMuxPacket(conn, Marshal(&muxHelloMsg{Type: muxMsgHello, Version: muxVersion})); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ControlClient{conn: conn}, nil
+}
+
+// Close closes the control connection. A session started by Run
+// ends with it.
+func (c *ControlClient) Close() error {
+	return c.conn.Close()
+}
+
+// request sends the request made by msg from a fresh request id,
+// and the files after it, and returns the reply.
+func (c *ControlClient) request(msg func(id uint32) interface{}, files ...*os.File) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	if err := writeMuxPacket(c.conn, Marshal(msg(id))); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := sendFile(c.conn, f); err != nil {
+			return nil, err
+		}
+	}
+	p, err := readMuxPacket(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	var reply muxRequestMsg
+	if err := Unmarshal(p, &reply); err != nil {
+		return nil, err
+	}
+	if reply.ReqID != id {
+		return nil, fmt.Errorf("ssh: control master answered request %d, want %d", reply.ReqID, id)
+	}
+	switch reply.Type {
+	case muxSFailure, muxSPermissionDenied:
+		var f muxFailureMsg
+		if err := Unmarshal(p, &f); err != nil {
+			return nil, err
+		}
+		return nil, &ControlError{PermissionDenied: reply.Type == muxSPermissionDenied, Reason: f.Reason}
+	}
+	return p, nil
+}
+
+// simpleRequest sends a request of type typ, with no payload, and
+// expects MUX_S_OK.
+func (c *ControlClient) simpleRequest(typ uint32) error {
+	p, err := c.request(func(id uint32) interface{} {
+		return &muxRequestMsg{Type: typ, ReqID: id}
+	})
+	if err != nil {
+		return err
+	}
+	if t := muxType(p); t != muxSOK {
+		return fmt.Errorf("ssh: unexpected control reply 0x%08x", t)
+	}
+	return nil
+}
+
+// Check asks whether the master is alive, as -O check does, and
+// returns its process id.
+func (c *ControlClient) Check() (pid int, err error) {
+	p, err := c.request(func(id uint32) interface{} {
+		return &muxRequestMsg{Type: muxCAliveCheck, ReqID: id}
+	})
+	if err != nil {
+		return 0, err
+	}
+	var alive muxAliveMsg
+	if err := Unmarshal(p, &alive); err != nil {
+		return 0, err
+	}
+	if alive.Type != muxSAlive {
+		return 0, fmt.Errorf("ssh: unexpected control reply 0x%08x", alive.Type)
+	}
+	return int(alive.Pid), nil
+}
+
+// StopListening asks the master to stop accepting control clients,
+// as -O stop does.
+func (c *ControlClient) StopListening() error {
+	return c.simpleRequest(muxCStopListening)
+}
+
+// Exit asks the master to close its connection, as -O exit does.
+func (c *ControlClient) Exit() error {
+	return c.simpleRequest(muxCTerminate)
+}
+
+// ControlSession is a session for ControlClient.Run.
+type ControlSession struct {
+	// Command is run, or, if Subsystem is set, names the
+	// subsystem. If both are empty, a login shell is started.
+	Command   string
+	Subsystem bool
+
+	// Term, if not empty, requests a pty of that terminal type,
+	// sized as Stdin. Putting the local terminal in raw mode is up
+	// to the caller.
+	Term string
+
+	// Env holds "NAME=value" entries to pass to the command; the
+	// server may ignore them.
+	Env []string
+
+	// Stdin, Stdout and Stderr are passed to the master, which
+	// reads and writes them directly.
+	Stdin, Stdout, Stderr *os.File
+}
+
+// Run has the master run s over its connection, and waits for it to
+// finish. It returns the exit status, 255 if the command was killed
+// by a signal or the connection failed, as ssh(1) does.
+func (c *ControlClient) Run(s *ControlSession) (status int, err error) {
+	var env []byte
+	for _, kv := range s.Env {
+		env = appendString(env, kv)
+	}
+	p, err := c.request(func(id uint32) interface{} {
+		return &muxNewSessionMsg{
+			Type:      muxCNewSession,
+			ReqID:     id,
+			WantTTY:   s.Term != "",
+			Subsystem: s.Subsystem,
+			// No escape character: it is handled locally.
+			EscapeChar: 0xffffffff,
+			Term:       s.Term,
+			Command:    s.Command,
+			Env:        env,
+		}
+	}, s.Stdin, s.Stdout, s.Stderr)
+	if err != nil {
+		return 0, err
+	}
+	if t := muxType(p); t != muxSSessionOpened {
+		return 0, fmt.Errorf("ssh: unexpected control reply 0x%08x", t)
+	}
+	for {
+		p, err := readMuxPacket(c.conn)
+		if err != nil {
+			return 0, err
+		}
+		switch muxType(p) {
+		case muxSTTYAllocFail:
+			// Carry on without a pty, as ssh(1) does.
+		case muxSExitMessage:
+			var exit muxExitMsg
+			if err := Unmarshal(p, &exit); err != nil {
+				return 0, err
+			}
+			return int(exit.ExitValue), nil
+		default:
+			return 0, fmt.Errorf("ssh: unexpected control message 0x%08x", muxType(p))
+		}
+	}
+}
+
+// StdioForward has the master connect stdin and stdout to host:port,
+// as -W does, and waits until the master is done with them.
+func (c *ControlClient) StdioForward(host string, port int, stdin, stdout *os.File) error {
+	p, err := c.request(func(id uint32) interface{} {
+		return &muxNewStdioFwdMsg{
+			Type:  muxCNewStdioFwd,
+			ReqID: id,
+			Host:  host,
+			Port:  uint32(port),
+		}
+	}, stdin, stdout)
+	if err != nil {
+		return err
+	}
+	if t := muxType(p); t != muxSSessionOpened {
+		return fmt.Errorf("ssh: unexpected control reply 0x%08x", t)
+	}
+	_, err = io.Copy(ioutil.Discard, c.conn)
+	return err
+}
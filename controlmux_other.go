@@ -0,0 +1,15 @@
+//go:build dragonfly || netbsd || openbsd || solaris
+// +build dragonfly netbsd openbsd solaris
+
+package ssh
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID fails: the uid of a control client cannot be checked on
+// this platform, so none is served.
+func peerUID(conn *net.UnixConn) (int, error) {
+	return 0, errors.New("ssh: cannot check the uid of a control client on this platform")
+}
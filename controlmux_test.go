@@ -0,0 +1,160 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// controlExecHandler echoes the command of an "exec" request, and
+// exits with status 3.
+func controlExecHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		exec, err := ParseExecRequest(req.Payload)
+		if err != nil {
+			t.Errorf("ParseExecRequest: %v", err)
+			return
+		}
+		io.WriteString(ch, exec.Command)
+		sendStatus(3, ch, t)
+		return
+	}
+}
+
+func TestControlMaster(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client := dial(controlExecHandler, t, halt)
+	defer client.Close()
+
+	// Not t.TempDir: socket paths are short.
+	dir, err := ioutil.TempDir("", "sshctl")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ctl")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("ListenUnix: %v", err)
+	}
+	ctx := context.Background()
+	served := make(chan error, 1)
+	go func() {
+		served <- client.ServeControl(ctx, l)
+	}()
+
+	cc, err := DialControl(ctx, path)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer cc.Close()
+	if pid, err := cc.Check(); err != nil || pid != os.Getpid() {
+		t.Errorf("Check: got %d, %v, want %d", pid, err, os.Getpid())
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	stdinW.Close()
+	defer stdinR.Close()
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+	defer stdoutR.Close()
+	status, err := cc.Run(&ControlSession{
+		Command: "echo hi",
+		Env:     []string{"LANG=C"},
+		Stdin:   stdinR,
+		Stdout:  stdoutW,
+		Stderr:  os.Stderr,
+	})
+	stdoutW.Close()
+	if err != nil || status != 3 {
+		t.Errorf("Run: got %d, %v, want status 3", status, err)
+	}
+	if out, err := ioutil.ReadAll(stdoutR); err != nil || string(out) != "echo hi" {
+		t.Errorf("Run output: got %q, %v", out, err)
+	}
+
+	cc2, err := DialControl(ctx, path)
+	if err != nil {
+		t.Fatalf("DialControl: %v", err)
+	}
+	defer cc2.Close()
+	if err := cc2.StopListening(); err != nil {
+		t.Errorf("StopListening: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeControl: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ServeControl still running after StopListening")
+	}
+	if err := cc2.Exit(); err != nil {
+		t.Errorf("Exit: %v", err)
+	}
+	if _, _, err := client.SendRequest(ctx, "ping", true, nil); err == nil {
+		t.Errorf("client still usable after Exit")
+	}
+}
+
+func TestControlMasterRejectsOtherUsers(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client := dial(controlExecHandler, t, halt)
+	defer client.Close()
+
+	dir, err := ioutil.TempDir("", "sshctl")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ctl")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Skipf("ListenUnix: %v", err)
+	}
+
+	// The test dials itself, so pretend the peer is someone else.
+	other := os.Getuid() + 1
+	checked := make(chan struct{})
+	controlPeerUID = func(*net.UnixConn) (int, error) {
+		close(checked)
+		return other, nil
+	}
+	defer func() {
+		<-checked
+		controlPeerUID = peerUID
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.ServeControl(ctx, l)
+	if cc, err := DialControl(ctx, path); err == nil {
+		cc.Close()
+		t.Fatalf("DialControl as uid %d succeeded", other)
+	}
+}
@@ -0,0 +1,113 @@
+package ssh
+
+const forceCommandCriticalOption = "force-command"
+
+// CriticalOptionHandler enforces a critical option of Permissions on
+// a server connection, for options other than the "source-address"
+// and "force-command" options that the package enforces itself.
+// Either function may be nil. Both receive the value of the option.
+type CriticalOptionHandler struct {
+	// ChannelOpen is called for every channel the client opens,
+	// before it is delivered. An error rejects the channel as
+	// Prohibited, with the error as the message.
+	ChannelOpen func(conn ConnMetadata, value string, chanType string, extraData []byte) error
+
+	// Request is called for every request the client sends on a
+	// channel of type chanType, before it is delivered. It may
+	// change req.Type and req.Payload. An error refuses the
+	// request.
+	Request func(conn ConnMetadata, value string, chanType string, req *Request) error
+}
+
+// optionEnforcer applies the critical options of an authenticated
+// server connection to its channels.
+type optionEnforcer struct {
+	conn     ConnMetadata
+	options  map[string]string
+	handlers map[string]CriticalOptionHandler
+}
+
+// newOptionEnforcer returns the enforcer for the critical options of
+// perms, or nil if there are none.
+func newOptionEnforcer(conn ConnMetadata, perms *Permissions, handlers map[string]CriticalOptionHandler) *optionEnforcer {
+	if perms == nil || len(perms.CriticalOptions) == 0 {
+		return nil
+	}
+	e := &optionEnforcer{
+		conn:     conn,
+		options:  map[string]string{},
+		handlers: handlers,
+	}
+	for k, v := range perms.CriticalOptions {
+		e.options[k] = v
+	}
+	return e
+}
+
+// channelOpen reports whether the client may open a channel.
+func (e *optionEnforcer) channelOpen(chanType string, extraData []byte) error {
+	// Permissions from any auth method can carry source-address,
+	// not only those from PublicKeyCallback, which checks it as
+	// well.
+	if v, ok := e.options[sourceAddressCriticalOption]; ok {
+		if err := checkSourceAddress(e.conn.RemoteAddr(), v); err != nil {
+			return err
+		}
+	}
+	for name, v := range e.options {
+		if h, ok := e.handlers[name]; ok && h.ChannelOpen != nil {
+			if err := h.ChannelOpen(e.conn, v, chanType, extraData); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// request applies the options to a channel request, which it may
+// rewrite. With force-command, whatever a session asks to run, be it
+// a shell, a command or a subsystem, becomes an exec of the forced
+// command, as in sshd, and what was asked is kept for
+// OriginalCommand.
+func (e *optionEnforcer) request(chanType string, req *Request) error {
+	if cmd, ok := e.options[forceCommandCriticalOption]; ok && chanType == "session" {
+		switch req.Type {
+		case "exec":
+			var msg execMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				return err
+			}
+			req.originalCommand = msg.Command
+		case "subsystem":
+			var msg subsystemRequestMsg
+			if err := Unmarshal(req.Payload, &msg); err != nil {
+				return err
+			}
+			req.originalCommand = msg.Subsystem
+		}
+		switch req.Type {
+		case "shell", "exec", "subsystem":
+			req.Type = "exec"
+			req.Payload = Marshal(&execMsg{Command: cmd})
+			req.forced = true
+		}
+	}
+	for name, v := range e.options {
+		if h, ok := e.handlers[name]; ok && h.Request != nil {
+			if err := h.Request(e.conn, v, chanType, req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OriginalCommand returns what the client asked to run, for a
+// session request that force-command turned into an exec of the
+// forced command: the command of an "exec" request, the name of a
+// "subsystem", or "" for a "shell". Programs run as forced commands
+// expect it in the SSH_ORIGINAL_COMMAND environment variable, as
+// sshd sets it. forced is false for requests left alone.
+func (r *Request) OriginalCommand() (cmd string, forced bool) {
+	return r.originalCommand, r.forced
+}
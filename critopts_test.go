@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// dialWithPermissions connects a client to a server whose logins get
+// perms. The requests on the session channels the server accepts are
+// sent to reqs.
+func dialWithPermissions(t *testing.T, perms *Permissions, handlers map[string]CriticalOptionHandler, reqs chan<- *Request) (*Client, *Halter) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	halt := NewHalter()
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			return perms, nil
+		},
+		CriticalOptionHandlers: handlers,
+		Config:                 Config{Halt: halt},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+
+	go func() {
+		defer c1.Close()
+		_, chans, greqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, greqs, halt)
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(UnknownChannelType, "unknown channel type")
+				continue
+			}
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range in {
+					req.Reply(true, nil)
+					reqs <- req
+				}
+			}()
+		}
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("pw")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	}
+	conn, chans, creqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	return NewClient(ctx, conn, chans, creqs, halt), halt
+}
+
+func TestForceCommand(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	reqs := make(chan *Request, 1)
+	client, halt := dialWithPermissions(t, &Permissions{CriticalOptions: map[string]string{"force-command": "/usr/bin/backup"}}, nil, reqs)
+	defer halt.RequestStop()
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		start    func(s *Session) error
+		original string
+	}{
+		{func(s *Session) error { return s.Shell() }, ""},
+		{func(s *Session) error { return s.Start("rm -rf /") }, "rm -rf /"},
+		{func(s *Session) error { return s.RequestSubsystem("sftp") }, "sftp"},
+	} {
+		session, err := client.NewSession(ctx)
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		if err := tt.start(session); err != nil {
+			t.Fatalf("starting session: %v", err)
+		}
+		req := <-reqs
+		var msg execMsg
+		if err := Unmarshal(req.Payload, &msg); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if req.Type != "exec" || msg.Command != "/usr/bin/backup" {
+			t.Errorf("server got %s %q, want the forced command", req.Type, msg.Command)
+		}
+		if cmd, forced := req.OriginalCommand(); !forced || cmd != tt.original {
+			t.Errorf("OriginalCommand: got %q, %v, want %q", cmd, forced, tt.original)
+		}
+		session.Close()
+	}
+}
+
+func TestSourceAddressRejectsChannels(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// PasswordCallback does not check source-address, so the login
+	// succeeds, but the channels are refused.
+	client, halt := dialWithPermissions(t, &Permissions{CriticalOptions: map[string]string{"source-address": "192.0.2.0/24"}}, nil, nil)
+	defer halt.RequestStop()
+
+	_, err := client.NewSession(context.Background())
+	if open, ok := err.(*OpenChannelError); !ok || open.Reason != Prohibited {
+		t.Fatalf("NewSession: got %v, want the channel prohibited", err)
+	}
+}
+
+func TestCriticalOptionHandlers(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var opened []string
+	handlers := map[string]CriticalOptionHandler{
+		"no-env": {
+			ChannelOpen: func(conn ConnMetadata, value, chanType string, extraData []byte) error {
+				opened = append(opened, chanType)
+				return nil
+			},
+			Request: func(conn ConnMetadata, value, chanType string, req *Request) error {
+				if req.Type == "env" {
+					return errors.New("environment refused")
+				}
+				return nil
+			},
+		},
+		"unused": {
+			ChannelOpen: func(conn ConnMetadata, value, chanType string, extraData []byte) error {
+				return errors.New("handler for an absent option called")
+			},
+		},
+	}
+	reqs := make(chan *Request, 1)
+	client, halt := dialWithPermissions(t, &Permissions{CriticalOptions: map[string]string{"no-env": ""}}, handlers, reqs)
+	defer halt.RequestStop()
+
+	session, err := client.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.Setenv("LANG", "C"); err == nil {
+		t.Error("Setenv succeeded")
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	if req := <-reqs; req.Type != "shell" {
+		t.Errorf("server got %s request, want shell", req.Type)
+	}
+	if len(opened) != 1 || opened[0] != "session" {
+		t.Errorf("ChannelOpen saw %q, want one session", opened)
+	}
+}
@@ -0,0 +1,263 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// defaultAttemptDelay is the Connection Attempt Delay recommended by
+// RFC 8305, section 5.
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// dialConn makes the network connection for Dial, with the TCP
+// options of c.
+func (c *ClientConfig) dialConn(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	d, err := c.netDialer()
+	if err != nil {
+		return nil, err
+	}
+	if ip := localIP(c.LocalAddr); ip != nil && network == "tcp" {
+		network = "tcp6"
+		if ip.To4() != nil {
+			network = "tcp4"
+		}
+	}
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	delay := c.ConnectionAttemptDelay
+	if delay <= 0 {
+		delay = defaultAttemptDelay
+	}
+	endpoints := append([]string{addr}, c.AlternateAddrs...)
+	conn, err := dialEndpoints(ctx, network, endpoints, c.RaceAlternateAddrs, dial, delay, clockOr(c.Clock))
+	if err != nil {
+		return nil, err
+	}
+	tuned, err := c.tuneConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tuned, nil
+}
+
+// netDialer returns the dialer for the connection attempts of Dial.
+func (c *ClientConfig) netDialer() (*net.Dialer, error) {
+	d := &net.Dialer{
+		LocalAddr: c.LocalAddr,
+		KeepAlive: c.TCPKeepAlive,
+	}
+	if c.BindToDevice != "" {
+		control, err := bindToDevice(c.BindToDevice)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
+
+// localIP returns the IP address of addr, if it has one.
+func localIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok && a != nil && len(a.IP) > 0 && !a.IP.IsUnspecified() {
+		return a.IP
+	}
+	return nil
+}
+
+// resolveDialAddrs returns the addresses to try for addr, in the
+// order of RFC 8305, section 4: alternating between IPv6 and IPv4,
+// starting with IPv6. Addresses that are not TCP host names are
+// returned as they are.
+func resolveDialAddrs(ctx context.Context, network, addr string) ([]string, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip.IP)
+		} else {
+			v6 = append(v6, ip.IP)
+		}
+	}
+	switch network {
+	case "tcp4":
+		v6 = nil
+	case "tcp6":
+		v4 = nil
+	}
+	addrs := interleaveAddrs(v6, v4, port)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+	return addrs, nil
+}
+
+// interleaveAddrs alternates between the addresses of first and
+// second.
+func interleaveAddrs(first, second []net.IP, port string) []string {
+	var addrs []string
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			addrs = append(addrs, net.JoinHostPort(first[0].String(), port))
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			addrs = append(addrs, net.JoinHostPort(second[0].String(), port))
+			second = second[1:]
+		}
+	}
+	return addrs
+}
+
+// raceDial dials addrs in order, starting the next attempt when the
+// previous one fails or has taken longer than delay by clock, while
+// keeping the earlier ones going. The first connection made wins;
+// the other attempts are canceled, and connections they make anyway
+// closed. If all fail, the first error is returned.
+func raceDial(ctx context.Context, dial func(ctx context.Context, addr string) (net.Conn, error), addrs []string, delay time.Duration, clock Clock) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var timer Timer
+		var tick <-chan time.Time
+		if next < len(addrs) {
+			timer = clock.NewTimer(delay)
+			tick = timer.C()
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-tick:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return nil, firstErr
+}
+
+// dialEndpoints connects to the first of endpoints it can, trying
+// them in order, the addresses of each raced, or, if race is set,
+// racing the addresses of all of them at once, in order. If all
+// fail, the first error is returned.
+func dialEndpoints(ctx context.Context, network string, endpoints []string, race bool, dial func(ctx context.Context, addr string) (net.Conn, error), delay time.Duration, clock Clock) (net.Conn, error) {
+	var all []string
+	var firstErr error
+	for _, endpoint := range endpoints {
+		addrs, err := resolveDialAddrs(ctx, network, endpoint)
+		if err == nil && race {
+			all = append(all, addrs...)
+			continue
+		}
+		if err == nil {
+			var conn net.Conn
+			if conn, err = raceDial(ctx, dial, addrs, delay, clock); err == nil {
+				return conn, nil
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			return nil, firstErr
+		}
+	}
+	if len(all) > 0 {
+		conn, err := raceDial(ctx, dial, all, delay, clock)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// tuneConn applies the TCP options of c to conn, and then
+// ConnCallback.
+func (c *ClientConfig) tuneConn(conn net.Conn) (net.Conn, error) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if c.TCPDelay {
+			if err := tc.SetNoDelay(false); err != nil {
+				return nil, err
+			}
+		}
+		if c.TCPReadBuffer > 0 {
+			if err := tc.SetReadBuffer(c.TCPReadBuffer); err != nil {
+				return nil, err
+			}
+		}
+		if c.TCPWriteBuffer > 0 {
+			if err := tc.SetWriteBuffer(c.TCPWriteBuffer); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.ConnCallback != nil {
+		return c.ConnCallback(conn)
+	}
+	return conn, nil
+}
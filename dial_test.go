@@ -0,0 +1,286 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenSSH runs a server that accepts any client and rejects its
+// channels, and returns its address.
+func listenSSH(t *testing.T, network, addr string) (string, *Halter) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	go ServeListener(context.Background(), l, config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+		go DiscardRequests(ctx, reqs, nil)
+		for ch := range chans {
+			ch.Reject(Prohibited, "dial test")
+		}
+	})
+	return l.Addr().String(), config.Halt
+}
+
+// countingConn counts the bytes written to a net.Conn.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func TestDialTCPOptions(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenSSH(t, "tcp", "127.0.0.1:0")
+	defer halt.RequestStop()
+	ctx := context.Background()
+
+	var counted *countingConn
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		TCPKeepAlive:    -1,
+		TCPDelay:        true,
+		TCPReadBuffer:   1 << 16,
+		TCPWriteBuffer:  1 << 16,
+		ConnCallback: func(conn net.Conn) (net.Conn, error) {
+			if _, ok := conn.(*net.TCPConn); !ok {
+				t.Errorf("ConnCallback got a %T", conn)
+			}
+			counted = &countingConn{Conn: conn}
+			return counted, nil
+		},
+		Config: Config{Halt: NewHalter()},
+	}
+	client, err := Dial(ctx, "tcp", addr, clientConf)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if atomic.LoadInt64(&counted.written) == 0 {
+		t.Error("the handshake did not go through the wrapped conn")
+	}
+
+	refused := errors.New("refused by callback")
+	clientConf = &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		ConnCallback: func(conn net.Conn) (net.Conn, error) {
+			return nil, refused
+		},
+		Config: Config{Halt: NewHalter()},
+	}
+	if _, err := Dial(ctx, "tcp", addr, clientConf); err != refused {
+		t.Errorf("Dial: got %v, want the callback's error", err)
+	}
+}
+
+func TestInterleaveAddrs(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	v6 := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	v4 := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}
+	got := interleaveAddrs(v6, v4, "22")
+	want := []string{"[2001:db8::1]:22", "192.0.2.1:22", "[2001:db8::2]:22", "192.0.2.2:22", "192.0.2.3:22"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// raceDialer dials fake addresses: "hang" blocks until canceled,
+// "fail" fails at once, and anything else connects.
+type raceDialer struct {
+	canceled int32
+}
+
+func (r *raceDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	switch addr {
+	case "hang":
+		<-ctx.Done()
+		atomic.AddInt32(&r.canceled, 1)
+		return nil, ctx.Err()
+	case "fail":
+		return nil, errors.New("connection refused")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestRaceDial(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	ctx := context.Background()
+	const delay = 50 * time.Millisecond
+
+	// A hanging attempt holds up the next address for delay, on
+	// the clock given.
+	r := &raceDialer{}
+	clock := NewFakeClock(time.Unix(1e9, 0))
+	won := make(chan net.Conn, 1)
+	go func() {
+		conn, err := raceDial(ctx, r.dial, []string{"hang", "ok"}, delay, clock)
+		if err != nil {
+			t.Errorf("raceDial: %v", err)
+		}
+		won <- conn
+	}()
+	clock.BlockUntil(1)
+	select {
+	case <-won:
+		t.Fatal("the next attempt did not wait for the delay")
+	case <-time.After(delay):
+	}
+	clock.Advance(delay)
+	if conn := <-won; conn != nil {
+		conn.Close()
+	}
+	time.Sleep(delay)
+	if atomic.LoadInt32(&r.canceled) != 1 {
+		t.Error("losing attempt not canceled")
+	}
+
+	// A failure moves on at once.
+	start := time.Now()
+	conn, err := raceDial(ctx, r.dial, []string{"fail", "ok"}, time.Hour, realClock{})
+	if err != nil {
+		t.Fatalf("raceDial: %v", err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > 20*delay {
+		t.Errorf("fallback after failure took %v", d)
+	}
+
+	if _, err := raceDial(ctx, r.dial, []string{"fail", "fail"}, delay, realClock{}); err == nil || err.Error() != "connection refused" {
+		t.Errorf("got %v, want the first error", err)
+	}
+
+	// The context ends every attempt.
+	ctx, cancel := context.WithTimeout(ctx, delay)
+	defer cancel()
+	if _, err := raceDial(ctx, r.dial, []string{"hang", "hang"}, delay/2, realClock{}); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the context's error", err)
+	}
+}
+
+func TestDialHostName(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenSSH(t, "tcp4", "127.0.0.1:0")
+	defer halt.RequestStop()
+	_, port, _ := net.SplitHostPort(addr)
+	addrs, err := resolveDialAddrs(context.Background(), "tcp4", net.JoinHostPort("localhost", port))
+	if err != nil || len(addrs) == 0 {
+		t.Skipf("localhost does not resolve: %v", err)
+	}
+
+	client, err := Dial(context.Background(), "tcp4", net.JoinHostPort("localhost", port), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client.Close()
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenSSH(t, "tcp4", "127.0.0.1:0")
+	defer halt.RequestStop()
+
+	for _, tt := range []struct {
+		name   string
+		config ClientConfig
+	}{
+		{"LocalAddr", ClientConfig{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}},
+		{"BindToDevice", ClientConfig{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}, BindToDevice: "lo"}},
+	} {
+		if tt.config.BindToDevice != "" && runtime.GOOS != "linux" {
+			continue
+		}
+		var local net.Addr
+		conf := tt.config
+		conf.User = "user"
+		conf.HostKeyCallback = InsecureIgnoreHostKey()
+		conf.Config = Config{Halt: NewHalter()}
+		conf.ConnCallback = func(conn net.Conn) (net.Conn, error) {
+			local = conn.LocalAddr()
+			return conn, nil
+		}
+		client, err := Dial(context.Background(), "tcp", addr, &conf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && os.IsPermission(opErr.Err) {
+				t.Logf("%s: %v", tt.name, err)
+				continue
+			}
+			t.Errorf("%s: Dial: %v", tt.name, err)
+			continue
+		}
+		client.Close()
+		if ip := local.(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 2)) {
+			t.Errorf("%s: connected from %v, want 127.0.0.2", tt.name, ip)
+		}
+	}
+}
+
+func TestDialAlternateAddrs(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenSSH(t, "tcp", "127.0.0.1:0")
+	defer halt.RequestStop()
+
+	// Nothing listens on down.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	for _, race := range []bool{false, true} {
+		var hostname string
+		var remote net.Addr
+		conf := &ClientConfig{
+			User: "user",
+			HostKeyCallback: func(h string, r net.Addr, key PublicKey) error {
+				hostname, remote = h, r
+				return nil
+			},
+			AlternateAddrs:         []string{down, addr},
+			RaceAlternateAddrs:     race,
+			ConnectionAttemptDelay: time.Millisecond,
+			Config:                 Config{Halt: NewHalter()},
+		}
+		client, err := Dial(context.Background(), "tcp", "localhost:1", conf)
+		if err != nil {
+			t.Errorf("race %v: Dial: %v", race, err)
+			continue
+		}
+		client.Close()
+		if hostname != "localhost:1" || remote.String() != addr {
+			t.Errorf("race %v: host key of %q checked at %v, want localhost:1 at %s", race, hostname, remote, addr)
+		}
+
+		conf.AlternateAddrs = []string{down}
+		if _, err := Dial(context.Background(), "tcp", down, conf); err == nil {
+			t.Errorf("race %v: Dial succeeded with all addresses down", race)
+		}
+	}
+}
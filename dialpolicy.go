@@ -0,0 +1,322 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DialRule allows or denies tunneled connections to a set of
+// destinations.
+type DialRule struct {
+	// Allow tells what the rule does with the destinations it
+	// matches.
+	Allow bool
+
+	// Net matches destination addresses. Host, if not empty,
+	// matches destination host names instead, with '*' standing
+	// for any run of characters and '?' for any one. If both are
+	// empty, the rule matches any destination.
+	Net  *net.IPNet
+	Host string
+
+	// MinPort and MaxPort bound the destination port. Zero for
+	// both matches any port.
+	MinPort, MaxPort int
+
+	// text is the rule as parsed, for error messages.
+	text string
+}
+
+// DialPolicy decides which destinations tunneled connections may
+// reach. The first rule that matches a destination decides; if none
+// does, the destination is denied. A DialPolicy can gatekeep a Client
+// (see ClientConfig.DialPolicy) as well as the "direct-tcpip" channels a
+// server accepts (see HandleDirectTCPIP).
+type DialPolicy struct {
+	Rules []DialRule
+}
+
+// DialDeniedError is returned for destinations a DialPolicy denies.
+type DialDeniedError struct {
+	Host string
+	Port int
+
+	// Rule is the rule that denied the destination, or empty if no
+	// rule matched.
+	Rule string
+}
+
+func (e *DialDeniedError) Error() string {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+	if e.Rule == "" {
+		return fmt.Sprintf("ssh: dial policy denies %s: no rule matches", addr)
+	}
+	return fmt.Sprintf("ssh: dial policy denies %s by rule %q", addr, e.Rule)
+}
+
+// ParseDialPolicy parses rules of the form "allow|deny ADDR[:PORTS]",
+// where ADDR is an IP address, a CIDR block, a host name pattern or
+// "*", and PORTS is a port or a range like "8000-8080". IPv6
+// addresses with ports are put in brackets. For example:
+//
+//	ParseDialPolicy("allow 10.0.0.0/8:443", "allow [2001:db8::/32]:22", "deny *")
+func ParseDialPolicy(rules ...string) (*DialPolicy, error) {
+	p := &DialPolicy{}
+	for _, text := range rules {
+		r, err := ParseDialRule(text)
+		if err != nil {
+			return nil, err
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+// ParseDialRule parses a single rule, see ParseDialPolicy.
+func ParseDialRule(text string) (DialRule, error) {
+	r := DialRule{text: text}
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return r, fmt.Errorf("ssh: bad dial rule %q", text)
+	}
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("ssh: dial rule %q must start with allow or deny", text)
+	}
+
+	addr, ports := fields[1], ""
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return r, fmt.Errorf("ssh: bad dial rule %q", text)
+		}
+		switch rest := addr[end+1:]; {
+		case rest == "":
+		case strings.HasPrefix(rest, ":"):
+			ports = rest[1:]
+		default:
+			return r, fmt.Errorf("ssh: bad dial rule %q", text)
+		}
+		addr = addr[1:end]
+	} else if i := strings.LastIndex(addr, ":"); i >= 0 && strings.Count(addr, ":") == 1 {
+		addr, ports = addr[:i], addr[i+1:]
+	}
+
+	switch {
+	case addr == "*":
+	case strings.Contains(addr, "/"):
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return r, fmt.Errorf("ssh: bad dial rule %q: %v", text, err)
+		}
+		r.Net = n
+	case net.ParseIP(addr) != nil:
+		ip := net.ParseIP(addr)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.Net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		r.Host = strings.ToLower(addr)
+	}
+
+	if ports != "" && ports != "*" {
+		lo, hi := ports, ports
+		if i := strings.Index(ports, "-"); i >= 0 {
+			lo, hi = ports[:i], ports[i+1:]
+		}
+		var err error
+		if r.MinPort, err = parseRulePort(lo); err != nil {
+			return r, fmt.Errorf("ssh: bad dial rule %q: %v", text, err)
+		}
+		if r.MaxPort, err = parseRulePort(hi); err != nil {
+			return r, fmt.Errorf("ssh: bad dial rule %q: %v", text, err)
+		}
+		if r.MinPort > r.MaxPort {
+			return r, fmt.Errorf("ssh: bad port range in dial rule %q", text)
+		}
+	}
+	return r, nil
+}
+
+func parseRulePort(s string) (int, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || p == 0 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return int(p), nil
+}
+
+// String returns the rule as it was parsed.
+func (r *DialRule) String() string {
+	return r.text
+}
+
+// match reports whether the rule applies to host and port. Rules on
+// addresses never match host names, nor rules on host names
+// addresses.
+func (r *DialRule) match(host string, port int) bool {
+	if r.MinPort != 0 && (port < r.MinPort || port > r.MaxPort) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case r.Net != nil:
+		return ip != nil && r.Net.Contains(ip)
+	case r.Host != "":
+		return ip == nil && hostPatternMatch(r.Host, strings.ToLower(host))
+	}
+	return true
+}
+
+// hostPatternMatch matches s against pat, in which '*' matches any
+// run of characters and '?' any one character.
+func hostPatternMatch(pat, s string) bool {
+	for len(pat) > 0 {
+		if pat[0] == '*' {
+			pat = pat[1:]
+			for i := len(s); i >= 0; i-- {
+				if hostPatternMatch(pat, s[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(s) == 0 || (s[0] != pat[0] && pat[0] != '?') {
+			return false
+		}
+		pat, s = pat[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// Check returns a *DialDeniedError if the policy denies host and
+// port. A host name is checked as a name; see DialContext for
+// checking the addresses it resolves to.
+func (p *DialPolicy) Check(host string, port int) error {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.match(host, port) {
+			if r.Allow {
+				return nil
+			}
+			return &DialDeniedError{Host: host, Port: port, Rule: r.text}
+		}
+	}
+	return &DialDeniedError{Host: host, Port: port}
+}
+
+// DialContext connects to addr on a TCP network, if the policy allows
+// it. A host name is checked as a name, so only Host rules and "*"
+// rules can allow it. It is then connected to by the first address
+// it resolves to that the policy allows, each address being checked
+// as an address, against Net rules and "*" rules. Name rules are not
+// checked again against the resolved addresses: "allow *.example.com"
+// alone allows no connection, as no address of the name is allowed.
+// Dialing that address rather than the name keeps the name from
+// resolving elsewhere between the check and the connection.
+func (p *DialPolicy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: bad port %q", portString)
+	}
+
+	if err := p.Check(host, int(port)); err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	if net.ParseIP(host) != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err = p.Check(ip.IP.String(), int(port)); err == nil {
+			return d.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), portString))
+		}
+	}
+	return nil, err
+}
+
+// dialPolicy returns the DialPolicy of the client's config, if any.
+func (c *Client) dialPolicy() *DialPolicy {
+	if conn, ok := c.Conn.(*connection); ok && conn.clicfg != nil {
+		return conn.clicfg.DialPolicy
+	}
+	return nil
+}
+
+// rejectionReason maps the error of a dial to the reason given to the
+// peer.
+func rejectionReason(err error) RejectionReason {
+	if _, ok := err.(*DialDeniedError); ok {
+		return Prohibited
+	}
+	return ConnectionFailed
+}
+
+// HandleDirectTCPIP serves a "direct-tcpip" channel, as opened by
+// Client.Dial: it connects to the destination, if the policy allows
+// it, and copies data both ways until either side is done. Denied
+// destinations are rejected as Prohibited and failed connections as
+// ConnectionFailed, with the error as the message, and the error is
+// returned.
+func (p *DialPolicy) HandleDirectTCPIP(ctx context.Context, newCh NewChannel) error {
+	var payload DirectTCPIPPayload
+	if err := Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ConnectionFailed, "bad direct-tcpip request")
+		return err
+	}
+	addr := net.JoinHostPort(payload.DestAddr, strconv.Itoa(int(payload.DestPort)))
+	conn, err := p.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		newCh.Reject(rejectionReason(err), err.Error())
+		return err
+	}
+	defer conn.Close()
+
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	go DiscardRequests(ctx, reqs, ch.GetHalter())
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, ch)
+		if c, ok := conn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil
+		case <-ch.Done():
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseDialRule(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range []struct {
+		text       string
+		host       string
+		port       int
+		match, bad bool
+	}{
+		{text: "allow 10.0.0.0/8:443", host: "10.1.2.3", port: 443, match: true},
+		{text: "allow 10.0.0.0/8:443", host: "10.1.2.3", port: 22},
+		{text: "allow 10.0.0.0/8:443", host: "11.1.2.3", port: 443},
+		{text: "allow 10.0.0.0/8", host: "10.1.2.3", port: 22, match: true},
+		{text: "deny 192.0.2.1", host: "192.0.2.1", port: 1, match: true},
+		{text: "deny 192.0.2.1", host: "192.0.2.2", port: 1},
+		{text: "allow [2001:db8::/32]:22", host: "2001:db8::1", port: 22, match: true},
+		{text: "allow 2001:db8::1", host: "2001:db8::1", port: 22, match: true},
+		{text: "allow *.Example.com:8000-8080", host: "www.example.COM", port: 8080, match: true},
+		{text: "allow *.example.com:8000-8080", host: "www.example.com", port: 8081},
+		{text: "allow *.example.com", host: "192.0.2.1", port: 1},
+		{text: "allow 10.0.0.0/8", host: "ten.example.com", port: 1},
+		{text: "deny *", host: "anything", port: 1, match: true},
+		{text: "deny *:22", host: "192.0.2.1", port: 22, match: true},
+		{text: "permit 10.0.0.0/8", bad: true},
+		{text: "allow", bad: true},
+		{text: "allow 10.0.0.0/33", bad: true},
+		{text: "allow *:0", bad: true},
+		{text: "allow *:90-80", bad: true},
+		{text: "allow [2001:db8::1", bad: true},
+	} {
+		r, err := ParseDialRule(tt.text)
+		if tt.bad {
+			if err == nil {
+				t.Errorf("%q: parsed", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if got := r.match(tt.host, tt.port); got != tt.match {
+			t.Errorf("%q matching %s:%d: got %v, want %v", tt.text, tt.host, tt.port, got, tt.match)
+		}
+	}
+}
+
+func TestDialPolicyCheck(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	p, err := ParseDialPolicy("deny 10.0.0.1", "allow 10.0.0.0/8:443")
+	if err != nil {
+		t.Fatalf("ParseDialPolicy: %v", err)
+	}
+	if err := p.Check("10.9.9.9", 443); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	err = p.Check("10.0.0.1", 443)
+	if e, ok := err.(*DialDeniedError); !ok || e.Rule != "deny 10.0.0.1" {
+		t.Errorf("got %v, want a denial by the first rule", err)
+	}
+	err = p.Check("192.0.2.1", 443)
+	if e, ok := err.(*DialDeniedError); !ok || e.Rule != "" {
+		t.Errorf("got %v, want a denial by no rule", err)
+	}
+}
+
+func TestClientDialPolicy(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	addr, halt := listenSSH(t, "tcp", "127.0.0.1:0")
+	defer halt.RequestStop()
+
+	policy, _ := ParseDialPolicy("allow 10.0.0.0/8:443")
+	client, err := Dial(context.Background(), "tcp", addr, &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		DialPolicy:      policy,
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Dial("tcp", "192.0.2.1:443"); err == nil {
+		t.Error("Dial succeeded")
+	} else if _, ok := err.(*DialDeniedError); !ok {
+		t.Errorf("Dial: got %v, want a *DialDeniedError", err)
+	}
+	if _, err := client.DialTCP("tcp", nil, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}); err == nil {
+		t.Error("DialTCP succeeded")
+	}
+	// Allowed destinations go to the server, which refuses them.
+	_, err = client.Dial("tcp", "10.0.0.1:443")
+	if open, ok := err.(*OpenChannelError); !ok || open.Reason != Prohibited {
+		t.Errorf("Dial: got %v, want the server's rejection", err)
+	}
+}
+
+func TestHandleDirectTCPIP(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	policy, err := ParseDialPolicy("allow 127.0.0.1", "deny *")
+	if err != nil {
+		t.Fatalf("ParseDialPolicy: %v", err)
+	}
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	halt := NewHalter()
+	defer halt.RequestStop()
+	ctx := context.Background()
+	go func() {
+		defer c1.Close()
+		conf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: halt}}
+		conf.AddHostKey(testSigners["rsa"])
+		_, chans, reqs, err := NewServerConn(ctx, c1, conf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		for ch := range chans {
+			go policy.HandleDirectTCPIP(ctx, ch)
+		}
+	}()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, halt)
+
+	ch, err := client.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	got, err := ioutil.ReadAll(ch)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("read %q, %v, want hello", got, err)
+	}
+	ch.Close()
+
+	_, err = client.Dial("tcp", "192.0.2.1:22")
+	open, ok := err.(*OpenChannelError)
+	if !ok || open.Reason != Prohibited || !strings.Contains(open.Message, `"deny *"`) {
+		t.Errorf("Dial: got %v, want Prohibited by deny *", err)
+	}
+}
@@ -0,0 +1,200 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// DialSpec is what DialRetry dials: the arguments of Dial.
+type DialSpec struct {
+	Network string
+	Addr    string
+	Config  *ClientConfig
+}
+
+// RetryPolicy tells DialRetry, and the Client of a ClientConfig with
+// a ChannelOpenRetry, how often and how long to retry. Its
+// zero value retries until the context is done, with delays that
+// start at 100ms and double up to 30s, each with half of it random.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts made before giving up.
+	// Zero means no limit.
+	MaxAttempts int
+
+	// InitialDelay is the delay after the first failure. Zero
+	// means 100ms.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the delay. Zero means 30s.
+	MaxDelay time.Duration
+
+	// Multiplier is what each delay is multiplied by for the next
+	// one. Zero, or less than one, means 2.
+	Multiplier float64
+
+	// Jitter is the part of each delay that is random, from 0 to
+	// 1, so that clients that fail together do not all retry at
+	// once: the delay is cut by up to Jitter times itself. Zero
+	// means 0.5, and a negative value turns jitter off.
+	Jitter float64
+
+	// Retryable, if non-nil, decides which errors are retried,
+	// in place of IsRetryable for DialRetry, or
+	// IsTemporaryOpenError for ClientConfig.ChannelOpenRetry.
+	Retryable func(err error) bool
+
+	// OnRetry, if non-nil, is called after each failed attempt
+	// that is retried, numbered from 1, with its error and the
+	// delay before the next one.
+	OnRetry func(attempt int, err error, delay time.Duration)
+
+	// Clock, if non-nil, replaces package time for the delays.
+	// It is meant for tests.
+	Clock Clock
+}
+
+// IsRetryable reports whether a dial that failed with err may
+// succeed if made again: network errors and handshakes that broke
+// off are retryable, but failed authentication, a rejected host key,
+// an invalid configuration and a done context are not, since trying
+// again would fail the same way.
+func IsRetryable(err error) bool {
+	var cfgErr *ConfigError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrAuthFailed),
+		errors.Is(err, ErrHostKeyRejected),
+		errors.As(err, &cfgErr),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
+
+// DialRetry is Dial, that retries the dials that fail with a
+// retryable error, after delays that grow exponentially, as policy
+// says. It returns the first Client made, or the error of the last
+// attempt, once policy.MaxAttempts is reached or the error is not
+// retryable, or ctx.Err() if ctx is done while it waits.
+//
+// Each attempt runs with a Halter of its own, downstream of that of
+// spec.Config, if it has one, so that a failed attempt does not
+// leave the next one stopped; the Halter of the Client returned is
+// that of its attempt.
+func DialRetry(ctx context.Context, spec DialSpec, policy RetryPolicy) (*Client, error) {
+	if err := validateRetryConfig(spec.Config); err != nil {
+		return nil, err
+	}
+	var client *Client
+	err := policy.retry(ctx, IsRetryable, func() (err error) {
+		client, err = dialAttempt(ctx, spec)
+		return err
+	})
+	return client, err
+}
+
+// retry calls attempt until it succeeds, or fails with an error that
+// is not retryable, or policy.MaxAttempts is reached, and returns
+// its last error, or ctx.Err() once ctx is done. policy.Retryable,
+// if set, replaces retryable.
+func (policy *RetryPolicy) retry(ctx context.Context, retryable func(err error) bool, attempt func() error) error {
+	if policy.Retryable != nil {
+		retryable = policy.Retryable
+	}
+	clock := policy.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	delay := policy.InitialDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := policy.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	mult := policy.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	jitter := policy.Jitter
+	if jitter == 0 {
+		jitter = 0.5
+	} else if jitter > 1 {
+		jitter = 1
+	}
+
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !retryable(err) || (policy.MaxAttempts > 0 && n >= policy.MaxAttempts) {
+			return err
+		}
+
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		wait := delay
+		if jitter > 0 {
+			wait -= time.Duration(jitter * rand.Float64() * float64(delay))
+		}
+		if policy.OnRetry != nil {
+			policy.OnRetry(n, err, wait)
+		}
+		timer := clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		delay = time.Duration(float64(delay) * mult)
+	}
+}
+
+// validateRetryConfig checks config once, before the first attempt,
+// so that a mistake in it is not retried. Halt may be nil, as
+// DialRetry makes its own.
+func validateRetryConfig(config *ClientConfig) error {
+	if config == nil {
+		return &ConfigError{Problems: []string{"DialSpec.Config is nil"}}
+	}
+	conf := *config
+	if conf.Halt == nil {
+		conf.Halt = NewHalter()
+	}
+	return conf.Validate()
+}
+
+// dialAttempt makes one dial of DialRetry.
+func dialAttempt(ctx context.Context, spec DialSpec) (*Client, error) {
+	conf := *spec.Config
+	parent := conf.Halt
+	conf.Halt = NewHalter()
+	if parent != nil {
+		parent.AddDownstream(conf.Halt)
+	}
+	client, err := Dial(ctx, spec.Network, spec.Addr, &conf)
+	if err != nil {
+		conf.Halt.RequestStopCause(err)
+		if parent != nil {
+			parent.RemoveDownstream(conf.Halt)
+		}
+		return nil, err
+	}
+	if parent != nil {
+		client.OnDisconnect(func(error) {
+			parent.RemoveDownstream(conf.Halt)
+		})
+	}
+	return client, nil
+}
@@ -0,0 +1,192 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// droppingListener drops the first fail connections it accepts, before
+// the handshake, and counts them all.
+type droppingListener struct {
+	net.Listener
+	fail     int32
+	accepted int32
+}
+
+func (l *droppingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt32(&l.accepted, 1) > atomic.LoadInt32(&l.fail) {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	l := &droppingListener{Listener: nl, fail: 2}
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if string(password) != "right" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+		Config: Config{Halt: NewHalter()},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	go ServeListener(context.Background(), l, serverConf, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+		go DiscardRequests(ctx, reqs, nil)
+		for ch := range chans {
+			ch.Reject(Prohibited, "dial retry test")
+		}
+	})
+
+	ctx := context.Background()
+	spec := DialSpec{
+		Network: "tcp",
+		Addr:    nl.Addr().String(),
+		Config: &ClientConfig{
+			User:            "user",
+			Auth:            []AuthMethod{Password("right")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		},
+	}
+	var retries []time.Duration
+	policy := RetryPolicy{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     3 * time.Millisecond,
+		OnRetry: func(attempt int, err error, delay time.Duration) {
+			if attempt != len(retries)+1 {
+				t.Errorf("OnRetry: attempt %d after %d retries", attempt, len(retries))
+			}
+			retries = append(retries, delay)
+		},
+	}
+	client, err := DialRetry(ctx, spec, policy)
+	if err != nil {
+		t.Fatalf("DialRetry: %v", err)
+	}
+	client.Close()
+	if len(retries) != 2 {
+		t.Fatalf("retried %d times, want 2", len(retries))
+	}
+	if retries[0] < time.Millisecond/2 || retries[0] > time.Millisecond || retries[1] < time.Millisecond || retries[1] > 2*time.Millisecond {
+		t.Errorf("delays %v, want [0.5ms,1ms] then [1ms,2ms]", retries)
+	}
+
+	// MaxAttempts gives up with the error of the last attempt.
+	atomic.StoreInt32(&l.accepted, 0)
+	policy.OnRetry = nil
+	policy.MaxAttempts = 2
+	if _, err := DialRetry(ctx, spec, policy); err == nil || !IsRetryable(err) {
+		t.Errorf("DialRetry with MaxAttempts: got %v, want a retryable error", err)
+	}
+	if n := atomic.LoadInt32(&l.accepted); n != 2 {
+		t.Errorf("made %d attempts, want 2", n)
+	}
+
+	// Failed authentication and rejected host keys are not retried.
+	atomic.StoreInt32(&l.fail, 0)
+	policy.MaxAttempts = 0
+	for _, tc := range []struct {
+		name   string
+		config ClientConfig
+		want   error
+	}{
+		{"auth", ClientConfig{
+			User:            "user",
+			Auth:            []AuthMethod{Password("wrong")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+		}, ErrAuthFailed},
+		{"host key", ClientConfig{
+			User:            "user",
+			Auth:            []AuthMethod{Password("right")},
+			HostKeyCallback: FixedHostKey(testSigners["ecdsa"].PublicKey()),
+		}, ErrHostKeyRejected},
+	} {
+		atomic.StoreInt32(&l.accepted, 0)
+		spec.Config = &tc.config
+		_, err := DialRetry(ctx, spec, policy)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if n := atomic.LoadInt32(&l.accepted); n != 1 {
+			t.Errorf("%s: made %d attempts, want 1", tc.name, n)
+		}
+	}
+	var hkErr *HostKeyError
+	if _, err := DialRetry(ctx, spec, policy); !errors.As(err, &hkErr) || hkErr.Key == nil || hkErr.Hostname != spec.Addr {
+		t.Errorf("got %v, want a *HostKeyError for %s", err, spec.Addr)
+	}
+
+	// An invalid config is not even dialed.
+	atomic.StoreInt32(&l.accepted, 0)
+	spec.Config = &ClientConfig{User: "user"}
+	var cfgErr *ConfigError
+	if _, err := DialRetry(ctx, spec, policy); !errors.As(err, &cfgErr) {
+		t.Errorf("got %v, want a *ConfigError", err)
+	}
+	spec.Config = nil
+	if _, err := DialRetry(ctx, spec, policy); !errors.As(err, &cfgErr) {
+		t.Errorf("nil Config: got %v, want a *ConfigError", err)
+	}
+	if n := atomic.LoadInt32(&l.accepted); n != 0 {
+		t.Errorf("made %d attempts, want none", n)
+	}
+}
+
+func TestDialRetryContext(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// Nothing listens on the address, so each dial fails.
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	addr := nl.Addr().String()
+	nl.Close()
+
+	clock := NewFakeClock(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spec := DialSpec{Network: "tcp", Addr: addr, Config: &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := DialRetry(ctx, spec, RetryPolicy{Jitter: -1, Clock: clock})
+		done <- err
+	}()
+
+	// Without jitter, the delays double from 100ms.
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	clock.BlockUntil(1)
+	clock.Advance(199 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("DialRetry returned %v before its delay", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,85 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+)
+
+// Errors that can be matched with errors.Is, whatever the error that
+// carries them.
+var (
+	// ErrAuthFailed is matched by the error of a client that ran
+	// out of authentication methods, and by *ServerAuthError.
+	ErrAuthFailed = errors.New("ssh: unable to authenticate")
+
+	// ErrChannelRejected is matched by *OpenChannelError, which
+	// holds the reason the peer gave.
+	ErrChannelRejected = errors.New("ssh: channel rejected")
+
+	// ErrRekeyTimeout is the error of a connection whose key
+	// exchange took longer than Config.RekeyTimeout.
+	ErrRekeyTimeout = errors.New("ssh: key exchange timed out")
+
+	// ErrVersionTimeout is the error of a handshake whose exchange
+	// of version lines took longer than Config.VersionTimeout.
+	ErrVersionTimeout = errors.New("ssh: version exchange timed out")
+
+	// ErrMaxConnectionAge is the error of a connection closed for
+	// being older than Config.MaxConnectionAge, and of the channel
+	// opens it refuses in its grace period.
+	ErrMaxConnectionAge = errors.New("ssh: connection reached its maximum age")
+
+	// ErrHostKeyRejected is matched by *HostKeyError, the error of
+	// a handshake whose HostKeyCallback rejected the key of the
+	// server.
+	ErrHostKeyRejected = errors.New("ssh: host key rejected")
+
+	// ErrChannelKeepalive is the error of ChannelKeepalive.Run
+	// once the peer of the channel failed to answer a keepalive
+	// in time.
+	ErrChannelKeepalive = errors.New("ssh: channel keepalive not answered")
+)
+
+// DisconnectError is the error of a connection the peer ended with
+// an SSH_MSG_DISCONNECT, see RFC 4253, section 11.1. It can be
+// extracted with errors.As, for instance from the error of
+// NewClientConn or Conn.Wait.
+type DisconnectError = disconnectMsg
+
+// HandshakeError is returned by NewClientConn when the handshake
+// fails. Err is the cause, which errors.Is and errors.As see through
+// Unwrap.
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "ssh: handshake failed: " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// HostKeyError is the cause of the HandshakeError of a client whose
+// HostKeyCallback rejected the key of the server. Err is what the
+// callback returned, and the error reads as it does.
+type HostKeyError struct {
+	Hostname string
+	Remote   net.Addr
+	Key      PublicKey
+	Err      error
+}
+
+func (e *HostKeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HostKeyError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes HostKeyError match ErrHostKeyRejected.
+func (e *HostKeyError) Is(target error) bool {
+	return target == ErrHostKeyRejected
+}
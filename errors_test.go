@@ -0,0 +1,178 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestErrAuthFailed(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	halt := NewHalter()
+	defer halt.RequestStop()
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			return nil, errors.New("wrong password")
+		},
+		Config: Config{Halt: halt},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, _, err := NewServerConn(ctx, c1, serverConf)
+		serverErr <- err
+	}()
+
+	_, _, _, err = NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("pw")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("client: got %v, want ErrAuthFailed", err)
+	}
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) {
+		t.Errorf("client: got %T, want a *HandshakeError", err)
+	}
+
+	// The client gives up, so the server sees it leave.
+	c2.Close()
+	if err := <-serverErr; !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("server: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestDisconnectError(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	registry := &ConnRegistry{}
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Registry:     registry,
+		Config:       Config{Halt: NewHalter()},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	go func() {
+		_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, reqs, nil)
+		for newCh := range chans {
+			newCh.Reject(ResourceShortage, "busy")
+		}
+	}()
+
+	conn, _, _, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+
+	_, _, err = conn.OpenChannel(ctx, "session", nil, nil)
+	var openErr *OpenChannelError
+	if !errors.Is(err, ErrChannelRejected) || !errors.As(err, &openErr) || openErr.Reason != ResourceShortage {
+		t.Errorf("OpenChannel: got %v, want ErrChannelRejected for ResourceShortage", err)
+	}
+
+	registry.Close(registry.List()[0].ID, "bye")
+	var discErr *DisconnectError
+	if err := conn.Wait(); !errors.As(err, &discErr) || discErr.Reason != disconnectByApplication || discErr.Message != "bye" {
+		t.Errorf("Wait: got %v, want a DisconnectError", err)
+	}
+}
+
+// kexInitDropper swallows the SSH_MSG_KEXINIT packets it would write
+// once drop is set, so that the peer's rekeys never complete.
+type kexInitDropper struct {
+	keyingTransport
+	drop int32
+}
+
+func (d *kexInitDropper) writePacket(p []byte) error {
+	if p[0] == msgKexInit && atomic.LoadInt32(&d.drop) != 0 {
+		return nil
+	}
+	return d.keyingTransport.writePacket(p)
+}
+
+func TestRekeyTimeout(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	a, b, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+	halt := NewHalter()
+	defer halt.RequestStop()
+	ctx := context.Background()
+	clock := NewFakeClock(time.Now())
+
+	clientConf := &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, RekeyTimeout: time.Hour, Clock: clock},
+	}
+	clientConf.SetDefaults()
+	serverConf := &ServerConfig{Config: Config{Halt: halt}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	serverConf.SetDefaults()
+
+	dropper := &kexInitDropper{keyingTransport: newTransport(b, rand.Reader, false, &serverConf.Config)}
+	v := []byte("version")
+	client := newClientTransport(ctx, newTransport(a, rand.Reader, true, &clientConf.Config), v, v, clientConf, "addr", a.RemoteAddr())
+	server := newServerTransport(ctx, dropper, v, v, serverConf)
+	if err := server.waitSession(ctx); err != nil {
+		t.Fatalf("server.waitSession: %v", err)
+	}
+	if err := client.waitSession(ctx); err != nil {
+		t.Fatalf("client.waitSession: %v", err)
+	}
+
+	atomic.StoreInt32(&dropper.drop, 1)
+	client.requestKeyExchange()
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.readPacket(ctx)
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	select {
+	case err := <-done:
+		t.Fatalf("readPacket returned %v before the timeout", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Hour)
+	select {
+	case err := <-done:
+		if err != ErrRekeyTimeout {
+			t.Errorf("readPacket: got %v, want ErrRekeyTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rekey did not time out")
+	}
+}
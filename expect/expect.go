@@ -0,0 +1,196 @@
+// Package expect automates programs that are only driven through an
+// interactive prompt, such as the command line of a network device,
+// in the manner of expect(1): wait for output matching a pattern,
+// send a reply, and repeat, or hand the session to a human.
+//
+// A typical use over an ssh.Session is
+//
+//	e, err := expect.NewSession(session)
+//	...
+//	session.RequestPty("vt100", 24, 80, nil)
+//	session.Shell()
+//	if _, err := e.Expect(regexp.MustCompile(`[>#] $`), 10*time.Second); err != nil {
+//		...
+//	}
+//	e.Send("show version\n")
+//
+// Timeouts use the read idle timer of the ssh.Channel, so they measure
+// silence: a prompt that is slow to come, but preceded by steady
+// output, does not time out.
+package expect
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// ErrTimeout is returned by Expect when no output arrives for the
+// timeout before the pattern matches.
+var ErrTimeout = errors.New("expect: timed out waiting for a match")
+
+// idleReader is implemented by ssh.Channel.
+type idleReader interface {
+	io.Reader
+	SetReadIdleTimeout(dur time.Duration) error
+}
+
+// Match describes the output that satisfied an Expect.
+type Match struct {
+	// Before is the output that came before the match.
+	Before string
+
+	// Groups holds the text of the match, followed by that of
+	// its parenthesized subexpressions, as
+	// regexp.FindStringSubmatch returns them.
+	Groups []string
+}
+
+// An Expecter reads the output of a program and writes its input.
+// Output that no Expect has matched yet is kept for the next one.
+// An Expecter is not safe for concurrent use.
+type Expecter struct {
+	r io.Reader
+	w io.Writer
+
+	// buf is the output not yet consumed by a match.
+	buf []byte
+
+	// err is the error that ended reading, if any.
+	err error
+}
+
+// New returns an Expecter that reads the program's output from r and
+// writes its input to w. If r has a SetReadIdleTimeout method, as an
+// ssh.Channel does, timeouts are enforced with it; otherwise Expect
+// waits without one.
+func New(r io.Reader, w io.Writer) *Expecter {
+	return &Expecter{r: r, w: w}
+}
+
+// NewSession returns an Expecter connected to the standard input and
+// output of s, which must not be started yet. With a pty, as
+// interactive programs usually want, standard error arrives merged
+// into standard output; without one, it is discarded.
+func NewSession(s *ssh.Session) (*Expecter, error) {
+	w, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return New(r, w), nil
+}
+
+// Expect reads output until re matches it, and returns the match.
+// The output up to the end of the match is consumed. If no output
+// arrives for timeout, or the output ends, before a match, it
+// returns ErrTimeout or the read error, and keeps the output for
+// the next call. A timeout of zero waits without limit.
+func (e *Expecter) Expect(re *regexp.Regexp, timeout time.Duration) (*Match, error) {
+	if ir, ok := e.r.(idleReader); ok {
+		if err := ir.SetReadIdleTimeout(timeout); err != nil {
+			return nil, err
+		}
+		defer ir.SetReadIdleTimeout(0)
+	}
+	chunk := make([]byte, 4096)
+	for {
+		if loc := re.FindSubmatchIndex(e.buf); loc != nil {
+			return e.consume(loc), nil
+		}
+		if e.err != nil {
+			return nil, e.err
+		}
+		n, err := e.r.Read(chunk)
+		e.buf = append(e.buf, chunk[:n]...)
+		if err != nil {
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				if loc := re.FindSubmatchIndex(e.buf); loc != nil {
+					return e.consume(loc), nil
+				}
+				return nil, ErrTimeout
+			}
+			e.err = err
+		}
+	}
+}
+
+// consume removes the output up to the end of the match at loc, as
+// given by FindSubmatchIndex, and describes it.
+func (e *Expecter) consume(loc []int) *Match {
+	m := &Match{Before: string(e.buf[:loc[0]])}
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			m.Groups = append(m.Groups, "")
+			continue
+		}
+		m.Groups = append(m.Groups, string(e.buf[loc[i]:loc[i+1]]))
+	}
+	e.buf = append(e.buf[:0], e.buf[loc[1]:]...)
+	return m
+}
+
+// Send writes s to the program's input.
+func (e *Expecter) Send(s string) error {
+	_, err := io.WriteString(e.w, s)
+	return err
+}
+
+// Buffered returns the output read but not yet matched.
+func (e *Expecter) Buffered() string {
+	return string(e.buf)
+}
+
+// Interact hands the program over: the unmatched output is written
+// to out, then output is copied to out and in is copied to the
+// program, until the output ends. Interact returns the error that
+// ended the output, or nil at its end; in is not read further once
+// Interact returns, but a Read already under way is left to finish.
+func (e *Expecter) Interact(in io.Reader, out io.Writer) error {
+	if _, err := out.Write(e.buf); err != nil {
+		return err
+	}
+	e.buf = nil
+	if e.err != nil {
+		if e.err == io.EOF {
+			return nil
+		}
+		return e.err
+	}
+
+	var mu sync.Mutex
+	done := false
+	go func() {
+		p := make([]byte, 1024)
+		for {
+			n, err := in.Read(p)
+			mu.Lock()
+			if done {
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+			if n > 0 {
+				if _, werr := e.w.Write(p[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	_, err := io.Copy(out, e.r)
+	mu.Lock()
+	done = true
+	mu.Unlock()
+	return err
+}
@@ -0,0 +1,178 @@
+package expect
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// timeoutError is the error of idlePipe on a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "idle timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+// idlePipe is a reader fed through a channel, with an idle timeout
+// like that of ssh.Channel.
+type idlePipe struct {
+	ch   chan string
+	dur  time.Duration
+	left string
+}
+
+func (p *idlePipe) SetReadIdleTimeout(dur time.Duration) error {
+	p.dur = dur
+	return nil
+}
+
+func (p *idlePipe) Read(b []byte) (int, error) {
+	if p.left == "" {
+		var timeout <-chan time.Time
+		if p.dur > 0 {
+			timeout = time.After(p.dur)
+		}
+		select {
+		case s, ok := <-p.ch:
+			if !ok {
+				return 0, io.EOF
+			}
+			p.left = s
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+	}
+	n := copy(b, p.left)
+	p.left = p.left[n:]
+	return n, nil
+}
+
+func TestExpect(t *testing.T) {
+	out := &idlePipe{ch: make(chan string, 10)}
+	var in bytes.Buffer
+	e := New(out, &in)
+
+	out.ch <- "Welcome\nrouter"
+	out.ch <- "# "
+	m, err := e.Expect(regexp.MustCompile(`(\w+)# $`), time.Second)
+	if err != nil {
+		t.Fatalf("Expect: %v", err)
+	}
+	if m.Before != "Welcome\n" || len(m.Groups) != 2 || m.Groups[1] != "router" {
+		t.Errorf("got %+v, want the prompt of router", m)
+	}
+	if err := e.Send("show version\n"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if in.String() != "show version\n" {
+		t.Errorf("sent %q", in.String())
+	}
+
+	out.ch <- "Version 1.0\nrouter# "
+	if _, err := e.Expect(regexp.MustCompile(`never`), 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Expect of missing output: got %v, want ErrTimeout", err)
+	}
+	if m, err := e.Expect(regexp.MustCompile(`Version (\S+)`), time.Second); err != nil || m.Groups[1] != "1.0" {
+		t.Fatalf("Expect after a timeout: got %+v, %v", m, err)
+	}
+	if got := e.Buffered(); got != "\nrouter# " {
+		t.Errorf("Buffered: got %q", got)
+	}
+
+	out.ch <- "bye\n"
+	close(out.ch)
+	var term bytes.Buffer
+	if err := e.Interact(strings.NewReader("exit\n"), &term); err != nil {
+		t.Fatalf("Interact: %v", err)
+	}
+	if term.String() != "\nrouter# bye\n" {
+		t.Errorf("Interact wrote %q", term.String())
+	}
+	if _, err := e.Expect(regexp.MustCompile(`x`), time.Second); err == nil {
+		t.Error("Expect after the end of output succeeded")
+	}
+}
+
+// silentServer serves SSH on a local port, accepting "exec"
+// requests and then sending nothing, until the test ends.
+func silentServer(t *testing.T) string {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true, Config: ssh.Config{Halt: ssh.NewHalter()}}
+	config.AddHostKey(signer)
+	t.Cleanup(config.Halt.RequestStop)
+	go ssh.ServeListener(context.Background(), l, config, func(ctx context.Context, conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+		go ssh.DiscardRequests(ctx, reqs, nil)
+		for nc := range chans {
+			ch, in, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ch.Close()
+				for req := range in {
+					req.Reply(req.Type == "exec", nil)
+				}
+			}()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestExpectSessionTimeout(t *testing.T) {
+	addr := silentServer(t)
+	ctx := context.Background()
+	client, err := ssh.Dial(ctx, "tcp", addr, &ssh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config:          ssh.Config{Halt: ssh.NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	s, err := client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer s.Close()
+	e, err := NewSession(s)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := s.Start("silent"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Expect(regexp.MustCompile(`never`), 100*time.Millisecond)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Errorf("Expect against a silent server: got %v, want ErrTimeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expect against a silent server did not time out")
+	}
+}
@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultInjector damages the packets a connection sends, at random,
+// for testing how the layers above cope: key re-exchange, idle
+// timeouts, and shutdown through the Halter. It acts on packets
+// before encryption, so a corrupted packet still arrives intact at
+// the transport of the peer and trips its message parsing instead.
+//
+// A FaultInjector is set as Config.Faults. It is meant for tests
+// only; a connection with one is broken by design. The code that
+// injects the faults is only built with the sshfaults build tag, as
+// in "go test -tags sshfaults", so that it is not carried by release
+// binaries; without the tag, Config.Faults is ignored.
+type FaultInjector struct {
+	// Drop, Delay, Duplicate and Corrupt are the probabilities,
+	// between 0 and 1, that a packet is not sent, is sent late,
+	// is sent twice, or has a byte after its message type
+	// flipped. They are tried in that order, so a dropped packet
+	// is not delayed too.
+	Drop      float64
+	Delay     float64
+	Duplicate float64
+	Corrupt   float64
+
+	// MaxDelay is the longest a delayed packet is held back; each
+	// delay is picked uniformly up to it. Packets sent after a
+	// delayed one wait for it, as over TCP.
+	MaxDelay time.Duration
+
+	// Types, if non-empty, limits the faults to packets of these
+	// message types.
+	Types []byte
+
+	// Seed seeds the random choices, so that a failing run can be
+	// repeated. Zero picks a seed from the time.
+	Seed int64
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	stats FaultStats
+}
+
+// FaultStats counts the faults a FaultInjector has caused.
+type FaultStats struct {
+	Dropped    int
+	Delayed    int
+	Duplicated int
+	Corrupted  int
+}
+
+// Stats returns the faults caused so far.
+func (f *FaultInjector) Stats() FaultStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
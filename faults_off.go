@@ -0,0 +1,13 @@
+//go:build !sshfaults
+// +build !sshfaults
+
+package ssh
+
+// faultsEnabled reports whether Config.Faults is acted on.
+const faultsEnabled = false
+
+// writeWithFaults is only built with the sshfaults tag; without it,
+// writePacket never calls it.
+func (t *transport) writeWithFaults(f *FaultInjector, packet []byte) error {
+	return t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode)
+}
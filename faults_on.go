@@ -0,0 +1,107 @@
+//go:build sshfaults
+// +build sshfaults
+
+package ssh
+
+import (
+	"math/rand"
+	"time"
+)
+
+// faultsEnabled reports whether Config.Faults is acted on.
+const faultsEnabled = true
+
+// fault is what a FaultInjector does to a packet.
+type fault struct {
+	drop      bool
+	delay     time.Duration
+	duplicate bool
+	corrupt   int // index of the byte to flip, or 0 for none
+}
+
+// decide picks the fault for packet. Packets that the local key
+// exchange depends on, msgNewKeys, are left alone: losing one would
+// break this side rather than test the peer.
+func (f *FaultInjector) decide(packet []byte) (ft fault) {
+	if len(packet) == 0 || packet[0] == msgNewKeys {
+		return
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == packet[0] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rng == nil {
+		seed := f.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		f.rng = rand.New(rand.NewSource(seed))
+	}
+	if f.rng.Float64() < f.Drop {
+		f.stats.Dropped++
+		ft.drop = true
+		return
+	}
+	if f.MaxDelay > 0 && f.rng.Float64() < f.Delay {
+		f.stats.Delayed++
+		ft.delay = time.Duration(f.rng.Int63n(int64(f.MaxDelay)) + 1)
+	}
+	if f.rng.Float64() < f.Duplicate {
+		f.stats.Duplicated++
+		ft.duplicate = true
+	}
+	if len(packet) > 1 && f.rng.Float64() < f.Corrupt {
+		f.stats.Corrupted++
+		ft.corrupt = 1 + f.rng.Intn(len(packet)-1)
+	}
+	return
+}
+
+// writeWithFaults sends packet through t.writer, as changed by the
+// FaultInjector f.
+func (t *transport) writeWithFaults(f *FaultInjector, packet []byte) error {
+	ft := f.decide(packet)
+	if ft.drop {
+		return nil
+	}
+	if ft.delay > 0 {
+		clock := t.config.Clock
+		if clock == nil {
+			clock = realClock{}
+		}
+		var reqStop chan struct{}
+		if t.config.Halt != nil {
+			reqStop = t.config.Halt.ReqStopChan()
+		}
+		timer := clock.NewTimer(ft.delay)
+		select {
+		case <-timer.C():
+		case <-reqStop:
+		}
+		timer.Stop()
+	}
+	if ft.corrupt > 0 {
+		packet = append([]byte(nil), packet...)
+		packet[ft.corrupt] ^= 0xff
+	}
+	if ft.duplicate {
+		// The cipher may scramble the packet it is given.
+		again := append([]byte(nil), packet...)
+		if err := t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode); err != nil {
+			return err
+		}
+		packet = again
+	}
+	return t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode)
+}
@@ -0,0 +1,62 @@
+//go:build sshfaults
+// +build sshfaults
+
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+)
+
+func TestFaultInjector(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	buf := &closerBuffer{}
+	faults := &FaultInjector{Duplicate: 1, Types: []byte{200}, Seed: 1}
+	tr := newTransport(buf, rand.Reader, true, &Config{Faults: faults})
+	for _, p := range [][]byte{{200, 1}, {201, 2}} {
+		if err := tr.writePacket(p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	faults = &FaultInjector{Drop: 0.5, Corrupt: 1, Seed: 1}
+	tr.config.Faults = faults
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := tr.writePacket([]byte{202, 0}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+
+	rd := newTransport(buf, rand.Reader, false, nil)
+	ctx := context.Background()
+	for _, want := range [][]byte{{200, 1}, {200, 1}, {201, 2}} {
+		p, err := rd.readPacket(ctx)
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if !bytes.Equal(p, want) {
+			t.Errorf("got packet %v, want %v", p, want)
+		}
+	}
+
+	stats := faults.Stats()
+	if stats.Dropped == 0 || stats.Dropped == n || stats.Corrupted != n-stats.Dropped {
+		t.Fatalf("got %+v after %d packets, want some dropped and the rest corrupted", stats, n)
+	}
+	for i := 0; i < n-stats.Dropped; i++ {
+		p, err := rd.readPacket(ctx)
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if !bytes.Equal(p, []byte{202, 0xff}) {
+			t.Errorf("got packet %v, want it corrupted", p)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after the packets that were not dropped", buf.Len())
+	}
+}
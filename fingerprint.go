@@ -0,0 +1,161 @@
+package ssh
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// The size of the field of FingerprintRandomart, as in OpenSSH.
+const (
+	randomartWidth  = 17
+	randomartHeight = 9
+)
+
+// randomartSymbols are the marks of the field, by the number of
+// visits, ending with the start and the end of the walk.
+const randomartSymbols = " .o+=*BOX@%&#/^SE"
+
+// FingerprintRandomart returns the key's SHA256 fingerprint drawn as
+// ssh-keygen -lv and VisualHostKey draw it: the walk of a drunken
+// bishop over a 17 by 9 field, framed by the key type and size and
+// the hash name. Meant for people, who tell pictures apart better
+// than strings, it is nine lines of text, without a trailing
+// newline.
+func FingerprintRandomart(pubKey PublicKey) string {
+	sum := sha256.Sum256(pubKey.Marshal())
+
+	var field [randomartWidth][randomartHeight]int
+	top := len(randomartSymbols) - 1
+	x, y := randomartWidth/2, randomartHeight/2
+	for _, b := range sum {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, randomartWidth-1)
+			y = clamp(y, randomartHeight-1)
+			if field[x][y] < top-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomartWidth/2][randomartHeight/2] = top - 1
+	field[x][y] = top
+
+	typ, bits := keyTypeAndSize(pubKey)
+	title := fmt.Sprintf("[%s %d]", typ, bits)
+	if bits == 0 || len(title) > randomartWidth {
+		title = "[" + typ + "]"
+	}
+	var b strings.Builder
+	randomartBorder(&b, title)
+	b.WriteByte('\n')
+	for y := 0; y < randomartHeight; y++ {
+		b.WriteByte('|')
+		for x := 0; x < randomartWidth; x++ {
+			b.WriteByte(randomartSymbols[field[x][y]])
+		}
+		b.WriteString("|\n")
+	}
+	randomartBorder(&b, "[SHA256]")
+	return b.String()
+}
+
+// clamp limits n to the range [0, hi].
+func clamp(n, hi int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+// randomartBorder writes a border of the field, with label centered.
+func randomartBorder(b *strings.Builder, label string) {
+	pad := (randomartWidth - len(label)) / 2
+	if pad < 0 {
+		pad = 0
+	}
+	b.WriteByte('+')
+	b.WriteString(strings.Repeat("-", pad))
+	b.WriteString(label)
+	if n := randomartWidth - pad - len(label); n > 0 {
+		b.WriteString(strings.Repeat("-", n))
+	}
+	b.WriteByte('+')
+}
+
+// keyTypeAndSize returns the key type, as OpenSSH names it in
+// fingerprints, and the size of the key in bits, or 0 if unknown.
+func keyTypeAndSize(pubKey PublicKey) (string, int) {
+	suffix := ""
+	if cert, ok := pubKey.(*Certificate); ok {
+		pubKey = cert.Key
+		suffix = "-CERT"
+	}
+	switch k := pubKey.(type) {
+	case *rsaPublicKey:
+		return "RSA" + suffix, k.N.BitLen()
+	case *dsaPublicKey:
+		return "DSA" + suffix, k.P.BitLen()
+	case *ecdsaPublicKey:
+		return "ECDSA" + suffix, k.Curve.Params().BitSize
+	case ed25519PublicKey:
+		return "ED25519" + suffix, 256
+	}
+	return strings.ToUpper(pubKey.Type()), 0
+}
+
+// FingerprintBubbleBabble returns the key's SHA1 fingerprint in the
+// Bubble Babble encoding, as ssh-keygen -B prints it: pronounceable
+// five letter words, like xeraf-subyn-...-pixex.
+func FingerprintBubbleBabble(pubKey PublicKey) string {
+	sum := sha1.Sum(pubKey.Marshal())
+	return bubbleBabble(sum[:])
+}
+
+// bubbleBabble encodes data as described in "The Bubble Babble
+// Binary Data Encoding" by Antti Huima.
+func bubbleBabble(data []byte) string {
+	const (
+		vowels     = "aeiouy"
+		consonants = "bcdfghklmnprstvzx"
+	)
+	var b strings.Builder
+	b.WriteByte('x')
+	rounds := len(data)/2 + 1
+	seed := 1
+	for i := 0; i < rounds; i++ {
+		if i+1 < rounds || len(data)%2 != 0 {
+			d := int(data[2*i])
+			b.WriteByte(vowels[((d>>6)&3+seed)%6])
+			b.WriteByte(consonants[(d>>2)&15])
+			b.WriteByte(vowels[(d&3+seed/6)%6])
+			if i+1 < rounds {
+				e := int(data[2*i+1])
+				b.WriteByte(consonants[(e>>4)&15])
+				b.WriteByte('-')
+				b.WriteByte(consonants[e&15])
+				seed = (seed*5 + d*7 + e) % 36
+			}
+		} else {
+			b.WriteByte(vowels[seed%6])
+			b.WriteByte(consonants[16])
+			b.WriteByte(vowels[seed/6])
+		}
+	}
+	b.WriteByte('x')
+	return b.String()
+}
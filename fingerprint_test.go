@@ -0,0 +1,98 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+// The fingerprints of the test keys, as printed by ssh-keygen -lv
+// and ssh-keygen -B.
+var fingerprintTests = []struct {
+	key          string
+	randomart    []string
+	bubbleBabble string
+}{
+	{
+		key: "ed25519",
+		randomart: []string{
+			"+--[ED25519 256]--+",
+			"|                 |",
+			"|             .o. |",
+			"|            + O=.|",
+			"|         + = *o*o|",
+			"|        S . o.B..|",
+			"|            ..o=o|",
+			"|         . .oo+oo|",
+			"|        = *o=B.o.|",
+			"|       E Bo====. |",
+			"+----[SHA256]-----+",
+		},
+		bubbleBabble: "xezag-zagoz-zuced-dicon-soger-fuzoz-gikeg-dymyh-lasak-tihar-tixyx",
+	},
+	{
+		key: "rsa",
+		randomart: []string{
+			"+---[RSA 1024]----+",
+			"|                 |",
+			"|                 |",
+			"|    .            |",
+			"|   . . o      .  |",
+			"|  . o * S  . o.. |",
+			"|   o B +  . + oo.|",
+			"|    + o ...o *..E|",
+			"|   ...==. oo=o++.|",
+			"|   o+=*O=. .=+.o |",
+			"+----[SHA256]-----+",
+		},
+		bubbleBabble: "xeraf-subyn-hitat-sikos-zifol-pikev-cufap-donug-gofuc-munoh-pixex",
+	},
+	{
+		key: "ecdsa",
+		randomart: []string{
+			"+---[ECDSA 256]---+",
+			"|         .o*E.   |",
+			"|        o o.*    |",
+			"|       = = B     |",
+			"|     ...& o =    |",
+			"|   . +=BSB *     |",
+			"|    =.o+O B      |",
+			"|   . . ++=       |",
+			"|    .  ..+       |",
+			"|        .o+      |",
+			"+----[SHA256]-----+",
+		},
+		bubbleBabble: "ximob-fepys-satuz-hyzag-sehum-rybic-sicof-sypar-liguc-rapec-rexox",
+	},
+}
+
+func TestFingerprintRandomart(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range fingerprintTests {
+		want := strings.Join(tt.randomart, "\n")
+		if got := FingerprintRandomart(testPublicKeys[tt.key]); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.key, got, want)
+		}
+	}
+}
+
+func TestFingerprintBubbleBabble(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range fingerprintTests {
+		if got := FingerprintBubbleBabble(testPublicKeys[tt.key]); got != tt.bubbleBabble {
+			t.Errorf("%s: got %s, want %s", tt.key, got, tt.bubbleBabble)
+		}
+	}
+
+	// The examples of the Bubble Babble specification.
+	for in, want := range map[string]string{
+		"":           "xexax",
+		"1234567890": "xesef-disof-gytuf-katof-movif-baxux",
+		"Pineapple":  "xigak-nyryk-humil-bosek-sonax",
+	} {
+		if got := bubbleBabble([]byte(in)); got != want {
+			t.Errorf("bubbleBabble(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+//go:build go1.18
+// +build go1.18
+
+package ssh
+
+import (
+	"testing"
+
+	"github.com/glycerine/xcryptossh/testdata"
+)
+
+// The fuzz targets below feed the parsers of untrusted input with
+// arbitrary bytes; they must never panic. Run one with, for example:
+//
+//	go test -run '^$' -fuzz FuzzParsePublicKey
+
+func FuzzParseKexInit(f *testing.F) {
+	f.Add(Marshal(&kexInitMsg{
+		KexAlgos:           []string{kexAlgoCurve25519SHA256, kexStrictClient},
+		ServerHostKeyAlgos: []string{KeyAlgoED25519},
+	}))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		ParseKexInit(packet)
+	})
+}
+
+func FuzzValidatePacket(f *testing.F) {
+	f.Add(Marshal(&channelOpenMsg{ChanType: "session", PeersWindow: 1 << 14, MaxPacketSize: 1 << 15}))
+	f.Add(Marshal(&channelRequestMsg{Request: "exec", WantReply: true, RequestSpecificData: appendString(nil, "ls")}))
+	f.Add(Marshal(&globalRequestMsg{Type: "tcpip-forward", WantReply: true}))
+	f.Add(Marshal(&disconnectMsg{Reason: 11, Message: "bye"}))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		ValidatePacket(packet)
+	})
+}
+
+func FuzzParsePublicKey(f *testing.F) {
+	for _, k := range testPublicKeys {
+		f.Add(k.Marshal())
+	}
+	for _, cert := range testdata.SSHCertificates {
+		if k, _, _, _, err := ParseAuthorizedKey(cert); err == nil {
+			f.Add(k.Marshal())
+		}
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ParsePublicKey(in)
+	})
+}
+
+func FuzzParseAuthorizedKey(f *testing.F) {
+	for _, cert := range testdata.SSHCertificates {
+		f.Add(cert)
+	}
+	f.Add([]byte(`command="ls",no-pty ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOfEI/CIGpHoSoLXEyMs8Fxmt+5ixu2sNXxXSuqSkhVG user@host`))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ParseAuthorizedKey(in)
+	})
+}
+
+func FuzzParseRawPrivateKey(f *testing.F) {
+	for _, pem := range testdata.PEMBytes {
+		f.Add(pem)
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ParseRawPrivateKey(in)
+	})
+}
+
+func FuzzParseSessionRequest(f *testing.F) {
+	f.Add("exec", appendString(nil, "uptime"))
+	f.Add("env", Marshal(&setenvRequest{Name: "LANG", Value: "C"}))
+	f.Add("pty-req", Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24, Modelist: "\x35\x00\x00\x00\x01\x00"}))
+	f.Add("window-change", Marshal(&ptyWindowChangeMsg{Columns: 80, Rows: 24}))
+	f.Add("signal", appendString(nil, "INT"))
+	f.Fuzz(func(t *testing.T, reqType string, payload []byte) {
+		ParseSessionRequest(&Request{Type: reqType, Payload: payload})
+	})
+}
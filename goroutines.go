@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// goroutineLedger counts the goroutines a connection has running,
+// by their role, such as "mux loop" or "idle timer". A connection is
+// listed by DebugDump while it has any.
+type goroutineLedger struct {
+	id   uint64
+	name string
+
+	mu    sync.Mutex
+	live  map[string]int
+	total int
+}
+
+// ledgers holds the ledgers with goroutines running.
+var ledgers struct {
+	mu     sync.Mutex
+	nextID uint64
+	live   map[*goroutineLedger]bool
+}
+
+// newGoroutineLedger returns the ledger of a connection to or from
+// remote, for side "client" or "server".
+func newGoroutineLedger(side string, remote net.Addr) *goroutineLedger {
+	ledgers.mu.Lock()
+	ledgers.nextID++
+	id := ledgers.nextID
+	ledgers.mu.Unlock()
+	name := side
+	if remote != nil {
+		name += " " + remote.String()
+	}
+	return &goroutineLedger{id: id, name: name, live: map[string]int{}}
+}
+
+// spawn runs f on a goroutine of its own, counted under role while
+// it runs. A nil ledger just runs f.
+func (l *goroutineLedger) spawn(role string, f func()) {
+	if l == nil {
+		go f()
+		return
+	}
+	l.add(role, 1)
+	go func() {
+		defer l.add(role, -1)
+		f()
+	}()
+}
+
+func (l *goroutineLedger) add(role string, delta int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.live[role] += delta
+	if l.live[role] == 0 {
+		delete(l.live, role)
+	}
+	l.total += delta
+
+	// The ledger is listed from its first goroutine to the end of
+	// its last. The list is updated under l.mu, so that the updates
+	// for one ledger land in order, as when a goroutine starts just
+	// as the last one ends. Nothing locks l.mu inside ledgers.mu.
+	if delta > 0 && l.total == delta || l.total == 0 {
+		ledgers.mu.Lock()
+		if l.total == 0 {
+			delete(ledgers.live, l)
+		} else {
+			if ledgers.live == nil {
+				ledgers.live = map[*goroutineLedger]bool{}
+			}
+			ledgers.live[l] = true
+		}
+		ledgers.mu.Unlock()
+	}
+}
+
+// DebugDump writes the goroutines that the connections of this
+// package have running to w, by connection and role, one connection
+// to a paragraph, for finding the ones left behind by a connection
+// that was closed. A connection is listed from the start of its
+// handshake until its last goroutine returns.
+func DebugDump(w io.Writer) error {
+	ledgers.mu.Lock()
+	list := make([]*goroutineLedger, 0, len(ledgers.live))
+	for l := range ledgers.live {
+		list = append(list, l)
+	}
+	ledgers.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	var b bytes.Buffer
+	for _, l := range list {
+		l.mu.Lock()
+		roles := make([]string, 0, len(l.live))
+		for role := range l.live {
+			roles = append(roles, role)
+		}
+		sort.Strings(roles)
+		fmt.Fprintf(&b, "conn %d, %s: %d goroutines\n", l.id, l.name, l.total)
+		for _, role := range roles {
+			fmt.Fprintf(&b, "\t%s: %d\n", role, l.live[role])
+		}
+		l.mu.Unlock()
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// CheckGoroutineLeaks waits up to timeout for the goroutines of all
+// connections to return, as they should once the connections are
+// closed, and returns an error with the DebugDump of those left if
+// they do not. It is meant for tests of programs that use this
+// package, after closing their connections:
+//
+//	client.Close()
+//	if err := ssh.CheckGoroutineLeaks(5 * time.Second); err != nil {
+//		t.Error(err)
+//	}
+func CheckGoroutineLeaks(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ledgers.mu.Lock()
+		n := len(ledgers.live)
+		ledgers.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var b bytes.Buffer
+	DebugDump(&b)
+	if b.Len() == 0 {
+		return nil
+	}
+	return errors.New("ssh: goroutines left running:\n" + b.String())
+}
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoroutineLedger(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+
+	serverConf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	type result struct {
+		conn *ServerConn
+		err  error
+	}
+	served := make(chan result, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err == nil {
+			go DiscardRequests(ctx, reqs, nil)
+			go func() {
+				for newCh := range chans {
+					ch, in, err := newCh.Accept()
+					if err == nil {
+						go DiscardRequests(ctx, in, nil)
+						defer ch.Close()
+					}
+				}
+			}()
+		}
+		served <- result{conn, err}
+	}()
+
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, conn.(*connection).halt)
+	r := <-served
+	if r.err != nil {
+		t.Fatalf("NewServerConn: %v", r.err)
+	}
+	session, err := client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+
+	ledger := conn.(*connection).cfg.goroutines
+	id := fmt.Sprintf("conn %d, client ", ledger.id)
+	var dump bytes.Buffer
+	DebugDump(&dump)
+	if !strings.Contains(dump.String(), id) || !strings.Contains(dump.String(), "\tmux loop: 1\n") {
+		t.Errorf("DebugDump of an open connection:\n%s", dump.String())
+	}
+	if err := CheckGoroutineLeaks(10 * time.Millisecond); err == nil || !strings.Contains(err.Error(), id) {
+		t.Errorf("CheckGoroutineLeaks with the connection open: %v", err)
+	}
+
+	session.Close()
+	client.Close()
+	r.conn.Close()
+	serverConf.Halt.RequestStop()
+	for _, l := range []*goroutineLedger{ledger, r.conn.Conn.(*connection).cfg.goroutines} {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			l.mu.Lock()
+			total, live := l.total, fmt.Sprint(l.live)
+			l.mu.Unlock()
+			if total == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%s: %d goroutines left after Close: %s", l.name, total, live)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	dump.Reset()
+	DebugDump(&dump)
+	if strings.Contains(dump.String(), id) {
+		t.Errorf("closed connection still listed:\n%s", dump.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // IdemCloseChan can have Close() called on it
@@ -86,6 +87,14 @@ type Halter struct {
 	err    error
 	errmut sync.Mutex
 
+	// cause is the reason given with the first request
+	// to stop, if any, and stopAt and doneAt are when
+	// the stop was first requested and when Done was
+	// marked. They are protected by errmut.
+	cause  error
+	stopAt time.Time
+	doneAt time.Time
+
 	upstream   map[*Halter]*RunStatus // notify when done.
 	downstream map[*Halter]*RunStatus // send reqStop when we are reqStop
 	mut        sync.Mutex
@@ -153,6 +162,16 @@ type RunStatus struct {
 
 	// final error if any.
 	Err error
+
+	// Cause is the reason given with the request to
+	// stop, if any; see RequestStopCause.
+	Cause error
+
+	// StopRequestedAt and DoneAt are when the stop
+	// was first requested and when Done was marked,
+	// or zero if they have not happened yet.
+	StopRequestedAt time.Time
+	DoneAt          time.Time
 }
 
 func (h *Halter) Status() (r *RunStatus) {
@@ -165,6 +184,11 @@ func (h *Halter) Status() (r *RunStatus) {
 		r.Err = h.Err()
 	}
 	r.DoneCh = h.done.Chan
+	h.errmut.Lock()
+	r.Cause = h.cause
+	r.StopRequestedAt = h.stopAt
+	r.DoneAt = h.doneAt
+	h.errmut.Unlock()
 	return
 }
 
@@ -194,16 +218,84 @@ func (h *Halter) ReadyChan() chan struct{} {
 // if it has not already done so. Safe for
 // multiple goroutine access.
 func (h *Halter) RequestStop() {
+	h.RequestStopCause(nil)
+}
+
+// RequestStopCause is RequestStop, but records
+// cause as the reason for the stop, if this
+// is the first request to stop h. The cause
+// is passed on to the downstream Halters,
+// so that they can tell why they were
+// stopped too. Read it back with StopCause.
+func (h *Halter) RequestStopCause(cause error) {
+	cause = h.noteStop(cause)
 	h.reqStop.Close()
 
 	// recursively tell dowstream
 	h.mut.Lock()
 	for d := range h.downstream {
-		d.RequestStop()
+		d.RequestStopCause(cause)
 	}
 	h.mut.Unlock()
 }
 
+// noteStop records the time of the first request
+// to stop h, and its cause, and returns the cause
+// recorded.
+func (h *Halter) noteStop(cause error) error {
+	h.errmut.Lock()
+	defer h.errmut.Unlock()
+	if h.stopAt.IsZero() {
+		h.stopAt = time.Now()
+		h.cause = cause
+	}
+	return h.cause
+}
+
+// noteDone records when h was marked done.
+func (h *Halter) noteDone() {
+	h.errmut.Lock()
+	if h.doneAt.IsZero() {
+		h.doneAt = time.Now()
+	}
+	h.errmut.Unlock()
+}
+
+// StopCause returns the reason given with the
+// first request to stop h, which is nil for
+// RequestStop, and when that request was made.
+// The time is zero if h was not asked to stop.
+func (h *Halter) StopCause() (cause error, at time.Time) {
+	h.errmut.Lock()
+	defer h.errmut.Unlock()
+	return h.cause, h.stopAt
+}
+
+// DoneTime returns when h was marked done,
+// or zero if it has not been.
+func (h *Halter) DoneTime() time.Time {
+	h.errmut.Lock()
+	defer h.errmut.Unlock()
+	return h.doneAt
+}
+
+// WaitDone waits for h to be marked done, and
+// returns why it stopped: its Err if it has one,
+// and otherwise the cause of the stop. If ctx
+// is done first, WaitDone returns ctx.Err().
+func (h *Halter) WaitDone(ctx context.Context) error {
+	select {
+	case <-h.done.Chan:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err := h.Err(); err != nil {
+		return err
+	}
+	cause, _ := h.StopCause()
+	return cause
+}
+
 func (h *Halter) waitForDownstreamDone() {
 	h.mut.Lock()
 	for d := range h.downstream {
@@ -234,6 +326,7 @@ func (h *Halter) MarkReady() {
 func (h *Halter) MarkDone() {
 	h.RequestStop()
 	h.waitForDownstreamDone()
+	h.noteDone()
 	h.done.Close()
 }
 
@@ -242,6 +335,7 @@ func (h *Halter) MarkDone() {
 // before it returns.
 func (h *Halter) MarkDoneNoBlock() {
 	h.RequestStop()
+	h.noteDone()
 	h.done.Close()
 }
 
@@ -274,7 +368,9 @@ func MAD(ctx context.Context, cancelctx context.CancelFunc, halt *Halter) {
 		for {
 			select {
 			case <-cchan:
+				halt.noteStop(ctx.Err())
 				halt.reqStop.Close()
+				halt.noteDone()
 				halt.done.Close()
 				cDone = true
 				cchan = nil
@@ -301,3 +397,60 @@ func MAD(ctx context.Context, cancelctx context.CancelFunc, halt *Halter) {
 		}
 	}()
 }
+
+// NewHalterFromContext returns a new Halter that
+// is asked to stop, with ctx.Err() as the cause,
+// once ctx is done. Unlike MAD, it leaves Done to
+// the owner of the Halter, and stopping the
+// Halter does not cancel ctx.
+func NewHalterFromContext(ctx context.Context) *Halter {
+	h := NewHalter()
+	if ctx.Done() == nil {
+		return h
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			h.RequestStopCause(ctx.Err())
+		case <-h.reqStop.Chan:
+		}
+	}()
+	return h
+}
+
+// AsContext returns a context that is done once
+// h is asked to stop, for code written in terms
+// of context. Its Err is then context.Canceled;
+// h.StopCause tells why. It carries no values
+// and no deadline, and needs no goroutine.
+func (h *Halter) AsContext() context.Context {
+	return halterContext{h}
+}
+
+// halterContext is the context.Context of a Halter.
+type halterContext struct {
+	h *Halter
+}
+
+func (c halterContext) Deadline() (deadline time.Time, ok bool) {
+	return
+}
+
+func (c halterContext) Done() <-chan struct{} {
+	return c.h.reqStop.Chan
+}
+
+func (c halterContext) Err() error {
+	if c.h.IsStopRequested() {
+		return context.Canceled
+	}
+	return nil
+}
+
+func (c halterContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+func (c halterContext) String() string {
+	return "ssh.Halter.AsContext"
+}
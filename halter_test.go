@@ -0,0 +1,92 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHalterStopCause(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	up, down := NewHalter(), NewHalter()
+	up.AddDownstream(down)
+	if cause, at := up.StopCause(); cause != nil || !at.IsZero() {
+		t.Errorf("before a stop: cause %v at %v", cause, at)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := up.WaitDone(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitDone while running: got %v, want the context's error", err)
+	}
+
+	begin := time.Now()
+	lost := errors.New("lost the peer")
+	up.RequestStopCause(lost)
+	up.RequestStopCause(errors.New("later"))
+	for _, h := range []*Halter{up, down} {
+		cause, at := h.StopCause()
+		if cause != lost || at.Before(begin) {
+			t.Errorf("StopCause: got %v at %v, want %v after %v", cause, at, lost, begin)
+		}
+	}
+
+	go down.MarkDone()
+	go up.MarkDone()
+	if err := up.WaitDone(context.Background()); err != lost {
+		t.Errorf("WaitDone: got %v, want the cause", err)
+	}
+	if s := up.Status(); !s.Done || s.Cause != lost || s.DoneAt.Before(s.StopRequestedAt) {
+		t.Errorf("Status = %+v", s)
+	}
+
+	// The error set before Done takes precedence over the cause.
+	h := NewHalter()
+	failed := errors.New("failed")
+	h.SetErr(failed)
+	h.MarkDone()
+	if err := h.WaitDone(context.Background()); err != failed {
+		t.Errorf("WaitDone: got %v, want the Err", err)
+	}
+	if cause, at := h.StopCause(); cause != nil || at.IsZero() {
+		t.Errorf("StopCause after RequestStop: got %v at %v", cause, at)
+	}
+}
+
+func TestHalterContext(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := NewHalterFromContext(ctx)
+	if h.IsStopRequested() {
+		t.Fatal("stopped before the context was canceled")
+	}
+	cancel()
+	select {
+	case <-h.ReqStopChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("not stopped with the context")
+	}
+	if cause, _ := h.StopCause(); cause != context.Canceled {
+		t.Errorf("StopCause: got %v, want context.Canceled", cause)
+	}
+
+	h = NewHalter()
+	hctx := h.AsContext()
+	child, cancelChild := context.WithTimeout(hctx, time.Hour)
+	defer cancelChild()
+	if hctx.Err() != nil || child.Err() != nil {
+		t.Fatal("context done before the Halter was stopped")
+	}
+	h.RequestStopCause(errors.New("shutdown"))
+	select {
+	case <-child.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("derived context not done after the Halter stopped")
+	}
+	if hctx.Err() != context.Canceled || child.Err() != context.Canceled {
+		t.Errorf("Err: got %v and %v, want context.Canceled", hctx.Err(), child.Err())
+	}
+}
@@ -12,7 +12,9 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // debugHandshake, if set, prints messages sent and received.  Key
@@ -35,6 +37,21 @@ type keyingTransport interface {
 	// direction will be effected if a msgNewKeys message is sent
 	// or received.
 	prepareKeyChange(context.Context, *algorithms, *kexResult, *Config) error
+
+	// setStrictMode sets the strict KEX mode, notably triggering
+	// sequence number resets on sending or receiving msgNewKeys.
+	// If the sequence number is already > 1 when setStrictMode
+	// is called, an error is returned.
+	setStrictMode() error
+
+	// setInitialKEXDone indicates to the transport that the
+	// initial key exchange was completed.
+	setInitialKEXDone()
+
+	// releaseReader and releaseWriter return the buffers of each
+	// direction to their pools, once it is done.
+	releaseReader()
+	releaseWriter()
 }
 
 // handshakeTransport implements rekeying on top of a keyingTransport
@@ -51,6 +68,13 @@ type handshakeTransport struct {
 	// connection.
 	hostKeys []Signer
 
+	// sigAlgs is sent as server-sig-algs if we are the server.
+	sigAlgs []string
+
+	// gexGroups, if non-empty, replaces the default moduli offered
+	// by the server during group exchange.
+	gexGroups []GEXGroup
+
 	// hostKeyAlgorithms is non-empty if we are the client. In that case,
 	// we accept these key types from the server as host key.
 	hostKeyAlgorithms []string
@@ -59,12 +83,27 @@ type handshakeTransport struct {
 	incoming  chan []byte
 	readError error
 
+	// readDone is closed when the read loop ends, as when the
+	// peer hangs up.
+	readDone chan struct{}
+
 	mu             sync.Mutex
 	writeError     error
 	sentInitPacket []byte
 	sentInitMsg    *kexInitMsg
+	sentInitFinal  bool     // sentInitMsg was adjusted to the peer's kexInit
 	pendingPackets [][]byte // Used when a key exchange is in progress.
 
+	// kexTimedOut is set, atomically, when a rekey outlasts
+	// Config.RekeyTimeout, so that the errors of the connection
+	// closed under it become ErrRekeyTimeout.
+	kexTimedOut int32
+
+	// loopsRunning counts, atomically, the read and key exchange
+	// loops that have yet to return. Both read packets, so the read
+	// buffers go back to their pool once neither runs.
+	loopsRunning int32
+
 	// If the read loop wants to schedule a kex, it pings this
 	// channel, and the write loop will send out a kex
 	// message.
@@ -90,6 +129,39 @@ type handshakeTransport struct {
 
 	// The session ID or nil if first kex did not complete yet.
 	sessionID []byte
+
+	// The host key and its signature over the session ID, from
+	// the first kex.
+	sessionHostKey   []byte
+	sessionSignature []byte
+
+	// strictMode indicates if the other side of the handshake
+	// indicated that we should be following the strict KEX
+	// protocol, as described in OpenSSH's PROTOCOL file.
+	strictMode bool
+
+	// sendExtInfo is set if the peer advertised that it accepts
+	// SSH_MSG_EXT_INFO in its first kexInit.
+	sendExtInfo bool
+
+	// extMu protects peerExtensions, the extensions the peer
+	// announced in its SSH_MSG_EXT_INFO, if any, and authCert, the
+	// certificate a client authenticated with.
+	extMu          sync.Mutex
+	peerExtensions map[string][]byte
+	authCert       *Certificate
+
+	// pingMu serializes ping(), so that at most one ping is
+	// outstanding. Matching pongs are delivered on pongs, which
+	// is closed when the read loop exits.
+	pingMu  sync.Mutex
+	pingSeq uint64
+	pongs   chan []byte
+
+	// rekeyMu protects onRekey, which is called after each key
+	// exchange but the first.
+	rekeyMu sync.Mutex
+	onRekey func()
 }
 
 type pendingKex struct {
@@ -105,6 +177,8 @@ func newHandshakeTransport(ctx context.Context, conn keyingTransport, config *Co
 		incoming:      make(chan []byte, chanSize),
 		requestKex:    make(chan struct{}, 1),
 		startKex:      make(chan *pendingKex, 1),
+		pongs:         make(chan []byte, 1),
+		readDone:      make(chan struct{}),
 
 		config: config,
 	}
@@ -141,8 +215,9 @@ func newClientTransport(ctx context.Context, conn keyingTransport, clientVersion
 		t.hostKeyAlgorithms = supportedHostKeyAlgos
 	}
 	//pp("about to start kexLoop, t=%p, at '%s'", t, stacktrace())
-	go t.readLoop(ctx)
-	go t.kexLoop(ctx)
+	t.loopsRunning = 2
+	t.config.goroutines.spawn("transport read loop", func() { t.readLoop(ctx) })
+	t.config.goroutines.spawn("key exchange loop", func() { t.kexLoop(ctx) })
 	return t
 }
 
@@ -154,8 +229,19 @@ func newServerTransport(ctx context.Context, conn keyingTransport, clientVersion
 		return nil
 	}
 	t.hostKeys = config.hostKeys
-	go t.readLoop(ctx)
-	go t.kexLoop(ctx)
+	t.sigAlgs = serverSigAlgs
+	if config.PublicKeyAuthAlgorithms != nil {
+		t.sigAlgs = config.PublicKeyAuthAlgorithms
+	}
+	t.gexGroups = config.GEXGroups
+	if config.KexProposalCallback != nil {
+		// Drop the mandatory kex request, so we answer the
+		// client's kexInit and the callback gets to see it.
+		<-t.requestKex
+	}
+	t.loopsRunning = 2
+	t.config.goroutines.spawn("transport read loop", func() { t.readLoop(ctx) })
+	t.config.goroutines.spawn("key exchange loop", func() { t.kexLoop(ctx) })
 	return t
 }
 
@@ -163,6 +249,12 @@ func (t *handshakeTransport) getSessionID() []byte {
 	return t.sessionID
 }
 
+// getSessionBinding returns the host key and the signature over the
+// session ID from the first kex.
+func (t *handshakeTransport) getSessionBinding() (hostKey, signature []byte) {
+	return t.sessionHostKey, t.sessionSignature
+}
+
 // waitSession waits for the session to be established. This should be
 // the first thing to call after instantiating handshakeTransport.
 func (t *handshakeTransport) waitSession(ctx context.Context) error {
@@ -213,16 +305,25 @@ func (t *handshakeTransport) readPacket(ctx context.Context) ([]byte, error) {
 }
 
 func (t *handshakeTransport) readLoop(ctx context.Context) {
+	defer t.loopDone()
+	defer close(t.readDone)
 	first := true
 	for {
 		p, err := t.readOnePacket(ctx, first)
 		first = false
 		if err != nil {
+			if atomic.LoadInt32(&t.kexTimedOut) != 0 {
+				err = ErrRekeyTimeout
+			}
 			t.readError = err
 			close(t.incoming)
 			break
 		}
-		if p[0] == msgIgnore || p[0] == msgDebug {
+		switch p[0] {
+		case msgIgnore, msgDebug:
+			continue
+		case msgExtInfo, msgPing, msgPong:
+			t.handleTransportExtension(p)
 			continue
 		}
 		select {
@@ -237,12 +338,112 @@ func (t *handshakeTransport) readLoop(ctx context.Context) {
 	// Stop writers too.
 	t.recordWriteError(t.readError)
 
+	// Unblock any pending ping.
+	close(t.pongs)
+
 	// Unblock the writer should it wait for this.
 	close(t.startKex)
 
 	// Don't close t.requestKex; it's also written to from writePacket.
 }
 
+// handleTransportExtension processes the transport layer messages
+// that are consumed by the read loop rather than passed up: the
+// peer's extension list, and ping@openssh.com pings and pongs.
+func (t *handshakeTransport) handleTransportExtension(p []byte) {
+	switch p[0] {
+	case msgExtInfo:
+		exts, err := parseExtInfo(p)
+		if err != nil {
+			if debugHandshake {
+				log.Printf("%s ignoring malformed ext-info: %v", t.id(), err)
+			}
+			return
+		}
+		t.extMu.Lock()
+		t.peerExtensions = exts
+		t.extMu.Unlock()
+	case msgPing:
+		var ping pingMsg
+		if err := Unmarshal(p, &ping); err != nil {
+			return
+		}
+		t.writePacket(Marshal(&pongMsg{Data: ping.Data}))
+	case msgPong:
+		var pong pongMsg
+		if err := Unmarshal(p, &pong); err != nil {
+			return
+		}
+		// Don't block the read loop if nobody is waiting.
+		select {
+		case t.pongs <- []byte(pong.Data):
+		default:
+		}
+	}
+}
+
+// peerHasExtension reports whether the peer announced the named
+// extension with the given value in its SSH_MSG_EXT_INFO.
+func (t *handshakeTransport) peerHasExtension(name, value string) bool {
+	t.extMu.Lock()
+	defer t.extMu.Unlock()
+	v, ok := t.peerExtensions[name]
+	return ok && string(v) == value
+}
+
+// setAuthCert records the certificate the client authenticated with.
+func (t *handshakeTransport) setAuthCert(cert *Certificate) {
+	t.extMu.Lock()
+	t.authCert = cert
+	t.extMu.Unlock()
+}
+
+// authCertificate returns the certificate of setAuthCert, if any.
+func (t *handshakeTransport) authCertificate() *Certificate {
+	t.extMu.Lock()
+	defer t.extMu.Unlock()
+	return t.authCert
+}
+
+// peerExtension returns the value of the named extension the peer
+// announced in its SSH_MSG_EXT_INFO, if it did.
+func (t *handshakeTransport) peerExtension(name string) ([]byte, bool) {
+	t.extMu.Lock()
+	defer t.extMu.Unlock()
+	v, ok := t.peerExtensions[name]
+	return v, ok
+}
+
+// ping sends a ping@openssh.com message and waits for the matching
+// pong. The caller should check that the peer supports the
+// extension first.
+func (t *handshakeTransport) ping(ctx context.Context) error {
+	t.pingMu.Lock()
+	defer t.pingMu.Unlock()
+
+	t.pingSeq++
+	data := string(appendU64(nil, t.pingSeq))
+	if err := t.writePacket(Marshal(&pingMsg{Data: data})); err != nil {
+		return err
+	}
+	for {
+		select {
+		case pong, ok := <-t.pongs:
+			if !ok {
+				return t.readError
+			}
+			if string(pong) == data {
+				return nil
+			}
+			// a late pong from an earlier, abandoned ping.
+		case <-t.config.Halt.ReqStopChan():
+			return io.EOF
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (t *handshakeTransport) pushPacket(p []byte) error {
 	if debugHandshake {
 		t.printPacket(p, true)
@@ -250,6 +451,26 @@ func (t *handshakeTransport) pushPacket(p []byte) error {
 	return t.conn.writePacket(p)
 }
 
+// packetBatcher is a packetConn that can send several packets at
+// once.
+type packetBatcher interface {
+	writePackets(packets [][]byte) error
+}
+
+// pushPackets sends packets in order, at once if t.conn can.
+func (t *handshakeTransport) pushPackets(packets [][]byte) error {
+	b, ok := t.conn.(packetBatcher)
+	if !ok || debugHandshake {
+		for _, p := range packets {
+			if err := t.pushPacket(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return b.writePackets(packets)
+}
+
 func (t *handshakeTransport) getWriteError() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -272,6 +493,14 @@ func (t *handshakeTransport) requestKeyExchange() {
 	}
 }
 
+// rekeyForThreshold requests a key exchange for a rekey threshold
+// reached, unless the peer has QuirkNoRekey.
+func (t *handshakeTransport) rekeyForThreshold() {
+	if t.config.quirks&QuirkNoRekey == 0 {
+		t.requestKeyExchange()
+	}
+}
+
 func (t *handshakeTransport) resetWriteThresholds() {
 	t.writePacketsLeft = packetRekeyThreshold
 	if t.config.RekeyThreshold > 0 {
@@ -283,7 +512,23 @@ func (t *handshakeTransport) resetWriteThresholds() {
 	}
 }
 
+// loopDone is deferred by the read and key exchange loops.
+func (t *handshakeTransport) loopDone() {
+	if atomic.AddInt32(&t.loopsRunning, -1) == 0 {
+		t.conn.releaseReader()
+	}
+}
+
 func (t *handshakeTransport) kexLoop(ctx context.Context) {
+	defer t.loopDone()
+	// kexTimer, if non-nil, enforces Config.RekeyTimeout on the
+	// key exchange in progress.
+	var kexTimer Timer
+	defer func() {
+		if kexTimer != nil {
+			kexTimer.Stop()
+		}
+	}()
 
 write:
 	for t.getWriteError() == nil {
@@ -306,11 +551,18 @@ write:
 			}
 
 			if !sent {
-				if err := t.sendKexInit(); err != nil {
+				var otherInit []byte
+				if request != nil {
+					otherInit = request.otherInit
+				}
+				if err := t.sendKexInit(otherInit); err != nil {
 					t.recordWriteError(err)
 					break
 				}
 				sent = true
+				if d := t.config.RekeyTimeout; d > 0 && t.sessionID != nil {
+					kexTimer = t.config.Clock.AfterFunc(d, t.kexTimeout)
+				}
 			}
 		}
 
@@ -336,11 +588,19 @@ write:
 		// channel on the pendingKex request.
 
 		err := t.enterKeyExchange(ctx, request.otherInit)
+		if kexTimer != nil {
+			kexTimer.Stop()
+			kexTimer = nil
+		}
+		if err != nil && atomic.LoadInt32(&t.kexTimedOut) != 0 {
+			err = ErrRekeyTimeout
+		}
 
 		t.mu.Lock()
 		t.writeError = err
 		t.sentInitPacket = nil
 		t.sentInitMsg = nil
+		t.sentInitFinal = false
 
 		t.resetWriteThresholds()
 
@@ -372,12 +632,7 @@ write:
 		// and don't increment writtenSinceKex: if we trigger
 		// another kex while we are still busy with the last
 		// one, things will become very confusing.
-		for _, p := range t.pendingPackets {
-			t.writeError = t.pushPacket(p)
-			if t.writeError != nil {
-				break
-			}
-		}
+		t.writeError = t.pushPackets(t.pendingPackets)
 		t.pendingPackets = t.pendingPackets[:0]
 		t.mu.Unlock()
 	}
@@ -410,10 +665,22 @@ write:
 		}
 	}()
 
+	// Writes fail with t.writeError from now on.
+	t.mu.Lock()
+	t.conn.releaseWriter()
+	t.mu.Unlock()
+
 	// Unblock reader.
 	t.conn.Close()
 }
 
+// kexTimeout closes the connection when a rekey has outlasted
+// Config.RekeyTimeout, the peer having failed to complete it.
+func (t *handshakeTransport) kexTimeout() {
+	atomic.StoreInt32(&t.kexTimedOut, 1)
+	t.conn.Close()
+}
+
 // The protocol uses uint32 for packet counters, so we can't let them
 // reach 1<<32.  We will actually read and write more packets than
 // this, though: the other side may send more packets, and after we
@@ -441,13 +708,13 @@ func (t *handshakeTransport) readOnePacket(ctx context.Context, first bool) ([]b
 	if t.readPacketsLeft > 0 {
 		t.readPacketsLeft--
 	} else {
-		t.requestKeyExchange()
+		t.rekeyForThreshold()
 	}
 
 	if t.readBytesLeft > 0 {
 		t.readBytesLeft -= int64(len(p))
 	} else {
-		t.requestKeyExchange()
+		t.rekeyForThreshold()
 	}
 
 	if debugHandshake {
@@ -506,8 +773,10 @@ func (t *handshakeTransport) readOnePacket(ctx context.Context, first bool) ([]b
 	return successPacket, nil
 }
 
-// sendKexInit sends a key change message.
-func (t *handshakeTransport) sendKexInit() error {
+// sendKexInit sends our kexInit, unless it was sent already. If
+// otherInitPacket is non-nil, it is the peer's kexInit, which is
+// passed to the KexProposalCallback.
+func (t *handshakeTransport) sendKexInit(otherInitPacket []byte) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.sentInitMsg != nil {
@@ -524,8 +793,8 @@ func (t *handshakeTransport) sendKexInit() error {
 		CiphersServerClient:     t.config.Ciphers,
 		MACsClientServer:        t.config.MACs,
 		MACsServerClient:        t.config.MACs,
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: compressionNames(t.config.Compressions),
+		CompressionServerClient: compressionNames(t.config.Compressions),
 	}
 	io.ReadFull(rand.Reader, msg.Cookie[:])
 
@@ -537,6 +806,32 @@ func (t *handshakeTransport) sendKexInit() error {
 	} else {
 		msg.ServerHostKeyAlgos = t.hostKeyAlgorithms
 	}
+
+	final := false
+	if cb := t.config.KexProposalCallback; cb != nil && otherInitPacket != nil {
+		otherInit := &kexInitMsg{}
+		if err := Unmarshal(otherInitPacket, otherInit); err != nil {
+			return err
+		}
+		p, err := cb(otherInit.proposal(), msg.proposal())
+		if err != nil {
+			return err
+		}
+		msg.setProposal(p)
+		final = true
+	}
+
+	// The strict KEX and ext-info markers are only sent in the
+	// first kexInit. Copy first, so we don't append to the
+	// caller's slice.
+	if t.sessionID == nil {
+		markers := []string{extInfoClient, kexStrictClient}
+		if len(t.hostKeys) > 0 {
+			markers = []string{extInfoServer, kexStrictServer}
+		}
+		msg.KexAlgos = append(make([]string, 0, len(msg.KexAlgos)+len(markers)), msg.KexAlgos...)
+		msg.KexAlgos = append(msg.KexAlgos, markers...)
+	}
 	packet := Marshal(msg)
 
 	// writePacket destroys the contents, so save a copy.
@@ -549,6 +844,7 @@ func (t *handshakeTransport) sendKexInit() error {
 
 	t.sentInitMsg = msg
 	t.sentInitPacket = packet
+	t.sentInitFinal = final
 
 	return nil
 }
@@ -578,13 +874,13 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 	if t.writeBytesLeft > 0 {
 		t.writeBytesLeft -= int64(len(p))
 	} else {
-		t.requestKeyExchange()
+		t.rekeyForThreshold()
 	}
 
 	if t.writePacketsLeft > 0 {
 		t.writePacketsLeft--
 	} else {
-		t.requestKeyExchange()
+		t.rekeyForThreshold()
 	}
 
 	if err := t.pushPacket(p); err != nil {
@@ -594,6 +890,14 @@ func (t *handshakeTransport) writePacket(p []byte) error {
 	return nil
 }
 
+// setOnRekey sets the function called after each key re-exchange.
+// It runs on the key exchange goroutine, so it must not block.
+func (t *handshakeTransport) setOnRekey(f func()) {
+	t.rekeyMu.Lock()
+	t.onRekey = f
+	t.rekeyMu.Unlock()
+}
+
 func (t *handshakeTransport) Close() error {
 	return t.conn.Close()
 }
@@ -630,6 +934,32 @@ func (t *handshakeTransport) enterKeyExchange(ctx context.Context, otherInitPack
 		return err
 	}
 
+	// Our kexInit went out before the peer's arrived, so the
+	// callback can only veto the outcome.
+	if cb := t.config.KexProposalCallback; cb != nil && !t.sentInitFinal {
+		p, err := cb(otherInit.proposal(), t.sentInitMsg.proposal())
+		if err != nil {
+			return err
+		}
+		if err := p.allows(t.algorithms); err != nil {
+			return err
+		}
+	}
+
+	firstKeyExchange := t.sessionID == nil
+	if firstKeyExchange {
+		isClient := len(t.hostKeys) == 0
+		if (isClient && contains(serverInit.KexAlgos, kexStrictServer)) ||
+			(!isClient && contains(clientInit.KexAlgos, kexStrictClient)) {
+			t.strictMode = true
+			if err := t.conn.setStrictMode(); err != nil {
+				return err
+			}
+		}
+		t.sendExtInfo = (isClient && contains(serverInit.KexAlgos, extInfoServer)) ||
+			(!isClient && contains(clientInit.KexAlgos, extInfoClient))
+	}
+
 	// We don't send FirstKexFollows, but we handle receiving ti.
 	//
 	// RFC 4253 section 7 defines the kex and the agreement method for
@@ -666,9 +996,17 @@ func (t *handshakeTransport) enterKeyExchange(ctx context.Context, otherInitPack
 
 	if t.sessionID == nil {
 		t.sessionID = result.H
+		t.sessionHostKey = result.HostKey
+		t.sessionSignature = result.Signature
 	}
 	result.SessionID = t.sessionID
 
+	if w := t.config.KeyLogWriter; w != nil {
+		if err := writeKeyLog(w, magics.clientKexInit, t.algorithms, result, len(t.hostKeys) == 0); err != nil {
+			return err
+		}
+	}
+
 	if err := t.conn.prepareKeyChange(ctx, t.algorithms, result, t.config); err != nil {
 		return err
 	}
@@ -681,6 +1019,40 @@ func (t *handshakeTransport) enterKeyExchange(ctx context.Context, otherInitPack
 		return unexpectedMessageError(msgNewKeys, packet[0])
 	}
 
+	if !firstKeyExchange {
+		if m := t.config.Metrics; m != nil {
+			m.Counter(MetricRekeys, 1)
+		}
+		t.rekeyMu.Lock()
+		f := t.onRekey
+		t.rekeyMu.Unlock()
+		if f != nil {
+			f()
+		}
+	}
+
+	if firstKeyExchange {
+		// Indicates to the transport that the first key exchange
+		// is completed after receiving SSH_MSG_NEWKEYS.
+		t.conn.setInitialKEXDone()
+
+		// RFC 8308 wants SSH_MSG_EXT_INFO as the next packet
+		// after our first SSH_MSG_NEWKEYS. Nothing else has been
+		// sent since, as pending packets are only flushed after
+		// we return.
+		if t.sendExtInfo {
+			exts := map[string][]byte{
+				extPing: []byte("0"),
+			}
+			if len(t.hostKeys) > 0 {
+				exts[extServerSigAlgs] = []byte(strings.Join(t.sigAlgs, ","))
+			}
+			if err := t.conn.writePacket(marshalExtInfo(exts)); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -692,6 +1064,10 @@ func (t *handshakeTransport) server(ctx context.Context, kex kexAlgorithm, algs
 		}
 	}
 
+	if gex, ok := kex.(*dhGEXSHA); ok && len(t.gexGroups) > 0 {
+		kex = gex.withGroups(t.gexGroups)
+	}
+
 	r, err := kex.Server(ctx, t.conn, t.config.Rand, magics, hostKey)
 	return r, err
 }
@@ -714,7 +1090,7 @@ func (t *handshakeTransport) client(ctx context.Context, kex kexAlgorithm, algs
 	//p("t=%p about to do t.hostKeyCallback().", t)
 	err = t.hostKeyCallback(t.dialAddress, t.remoteAddr, hostKey)
 	if err != nil {
-		return nil, err
+		return nil, &HostKeyError{Hostname: t.dialAddress, Remote: t.remoteAddr, Key: hostKey, Err: err}
 	}
 
 	return result, nil
@@ -17,6 +17,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type testChecker struct {
@@ -90,6 +91,13 @@ func addNoiseTransport(t keyingTransport) keyingTransport {
 // other. If the noise argument is true, both transports will try to
 // confuse the other side by sending ignore and debug messages.
 func handshakePair(clientConf *ClientConfig, addr string, noise bool) (client *handshakeTransport, server *handshakeTransport, err error) {
+	serverConf := &ServerConfig{Config: Config{Halt: clientConf.Halt}}
+	return handshakePairConf(clientConf, serverConf, addr, noise)
+}
+
+// handshakePairConf is like handshakePair, but takes the server's
+// config too. Host keys are added to serverConf.
+func handshakePairConf(clientConf *ClientConfig, serverConf *ServerConfig, addr string, noise bool) (client *handshakeTransport, server *handshakeTransport, err error) {
 	a, b, err := netPipe()
 	if err != nil {
 		return nil, nil, err
@@ -110,7 +118,6 @@ func handshakePair(clientConf *ClientConfig, addr string, noise bool) (client *h
 
 	client = newClientTransport(ctx, trC, v, v, clientConf, addr, a.RemoteAddr())
 
-	serverConf := &ServerConfig{Config: Config{Halt: clientConf.Halt}}
 	serverConf.AddHostKey(testSigners["ecdsa"])
 	serverConf.AddHostKey(testSigners["rsa"])
 	serverConf.SetDefaults()
@@ -417,6 +424,16 @@ func (n *errorKeyingTransport) prepareKeyChange(context.Context, *algorithms, *k
 	return nil
 }
 
+func (n *errorKeyingTransport) setStrictMode() error {
+	return nil
+}
+
+func (n *errorKeyingTransport) setInitialKEXDone() {}
+
+func (n *errorKeyingTransport) releaseReader() {}
+
+func (n *errorKeyingTransport) releaseWriter() {}
+
 func (n *errorKeyingTransport) getSessionID() []byte {
 	return nil
 }
@@ -632,3 +649,302 @@ func TestHandshakeRekeyDefault(t *testing.T) {
 		t.Errorf("got rekey after %dG write, want 64G", wgb)
 	}
 }
+
+func TestStrictKEXResetSeqFirstKEX(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	checker := &testChecker{}
+	trC, trS, err := handshakePair(
+		&ClientConfig{
+			HostKeyCallback: checker.Check,
+			Config:          Config{Halt: halt},
+		}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	if !trC.strictMode || !trS.strictMode {
+		t.Fatalf("strict KEX not negotiated: client %v, server %v", trC.strictMode, trS.strictMode)
+	}
+
+	ctx := context.Background()
+	for _, pair := range [][2]*handshakeTransport{{trC, trS}, {trS, trC}} {
+		if err := pair[0].writePacket([]byte{msgRequestSuccess}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		if _, err := pair[1].readPacket(ctx); err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+	}
+
+	// Since msgNewKeys, each side has sent SSH_MSG_EXT_INFO and
+	// one packet, so the reset sequence numbers must be at 2.
+	for _, tr := range []*handshakeTransport{trC, trS} {
+		conn := tr.conn.(*transport)
+		if conn.reader.seqNum != 2 || conn.writer.seqNum != 2 {
+			t.Errorf("%s: got read seq %d, write seq %d, want 2, 2", tr.id(), conn.reader.seqNum, conn.writer.seqNum)
+		}
+	}
+}
+
+// TestStrictKEXRekey checks that sequence numbers stay in sync
+// across a strict-mode rekey; a mismatch would fail the MAC check.
+func TestStrictKEXRekey(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	checker := &syncChecker{
+		called:   make(chan int, 10),
+		waitCall: nil,
+	}
+	trC, trS, err := handshakePair(
+		&ClientConfig{
+			HostKeyCallback: checker.Check,
+			Config:          Config{Halt: halt},
+		}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+	<-checker.called
+
+	ctx := context.Background()
+	trC.requestKeyExchange()
+	<-checker.called
+
+	for i := 0; i < 3; i++ {
+		if err := trC.writePacket([]byte{msgRequestSuccess, byte(i)}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		p, err := trS.readPacket(ctx)
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if p[0] != msgRequestSuccess || p[1] != byte(i) {
+			t.Fatalf("got packet %v, want %d", p, i)
+		}
+	}
+}
+
+func TestStrictKEXUnexpectedMsg(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	// The noise transport sends msgIgnore ahead of every packet,
+	// which is a protocol violation during a strict initial kex.
+	_, _, err := handshakePair(
+		&ClientConfig{
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: halt},
+		}, "addr", true)
+	if err == nil {
+		t.Fatal("handshake with msgIgnore during strict initial kex succeeded")
+	}
+}
+
+func TestSendKexInitStrictMarker(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, isServer := range []bool{false, true} {
+		conf := Config{KeyExchanges: []string{kexAlgoCurve25519SHA256}}
+		conf.SetDefaults()
+		a, b := memPipe()
+		tr := &handshakeTransport{
+			conn:   &errorKeyingTransport{a, -1, -1},
+			config: &conf,
+		}
+		want := []string{kexAlgoCurve25519SHA256, extInfoClient, kexStrictClient}
+		if isServer {
+			tr.hostKeys = []Signer{testSigners["ecdsa"]}
+			want = []string{kexAlgoCurve25519SHA256, extInfoServer, kexStrictServer}
+		}
+		if err := tr.sendKexInit(nil); err != nil {
+			t.Fatalf("sendKexInit: %v", err)
+		}
+		if got := tr.sentInitMsg.KexAlgos; !reflect.DeepEqual(got, want) {
+			t.Errorf("got KexAlgos %v, want %v", got, want)
+		}
+		if len(conf.KeyExchanges) != 1 {
+			t.Errorf("sendKexInit modified Config.KeyExchanges: %v", conf.KeyExchanges)
+		}
+		a.Close()
+		b.Close()
+		conf.Halt.RequestStop()
+	}
+}
+
+func TestExtInfoPing(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	checker := &testChecker{}
+	trC, trS, err := handshakePair(
+		&ClientConfig{
+			HostKeyCallback: checker.Check,
+			Config:          Config{Halt: halt},
+		}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	ctx := context.Background()
+
+	// SSH_MSG_EXT_INFO is the first packet after msgNewKeys, so
+	// once another packet has come through, it has been seen.
+	for _, pair := range [][2]*handshakeTransport{{trC, trS}, {trS, trC}} {
+		from, to := pair[0], pair[1]
+		if err := from.writePacket([]byte{msgRequestSuccess}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		if _, err := to.readPacket(ctx); err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if !to.peerHasExtension(extPing, "0") {
+			t.Fatalf("%s: peer did not announce %s", to.id(), extPing)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := trC.ping(ctx); err != nil {
+			t.Fatalf("client ping %d: %v", i, err)
+		}
+		if err := trS.ping(ctx); err != nil {
+			t.Fatalf("server ping %d: %v", i, err)
+		}
+	}
+
+	// With the read loop of the server stuck on packets nobody
+	// reads, the ping is not answered before ctx is done.
+	for i := 0; i <= chanSize; i++ {
+		if err := trC.writePacket([]byte{msgRequestSuccess}); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := trC.ping(short); err != context.DeadlineExceeded {
+		t.Errorf("ping with no pong: %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestKexProposalCallbackServer(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	var peerKex []string
+	serverConf := &ServerConfig{Config: Config{
+		Halt: halt,
+		KexProposalCallback: func(peer, ours KexProposal) (KexProposal, error) {
+			peerKex = peer.KeyExchanges
+			ours.CiphersClientServer = []string{"aes256-ctr"}
+			return ours, nil
+		},
+	}}
+	clientConf := &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	}
+	trC, trS, err := handshakePairConf(clientConf, serverConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePairConf: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+
+	if contains(peerKex, kexStrictClient) || !contains(peerKex, kexAlgoCurve25519SHA256) {
+		t.Errorf("callback got peer KeyExchanges %v", peerKex)
+	}
+	for _, tr := range []*handshakeTransport{trC, trS} {
+		if got := tr.algorithms.w.Cipher; got != "aes256-ctr" {
+			t.Errorf("%s: got client to server cipher %q, want aes256-ctr", tr.id(), got)
+		}
+	}
+}
+
+func TestKexProposalCallbackClient(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	first := supportedCiphers[0]
+	trim := func(peer, ours KexProposal) (KexProposal, error) {
+		ours.CiphersClientServer = ours.CiphersClientServer[1:]
+		return ours, nil
+	}
+
+	// A server with a callback waits for the client's kexInit, so
+	// the client's proposal is on the wire before the callback
+	// runs, and it can only veto the server's choice of first.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config: Config{
+			Halt: halt,
+			KexProposalCallback: func(peer, ours KexProposal) (KexProposal, error) {
+				return ours, nil
+			},
+		},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	go newServer(ctx, c1, serverConf)
+	_, _, _, err = NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, KexProposalCallback: trim},
+	})
+	if err == nil || !strings.Contains(err.Error(), "vetoed by KexProposalCallback") {
+		t.Errorf("got %v, want the cipher vetoed", err)
+	}
+
+	// On a rekey the server starts, the server's kexInit arrives
+	// first, and the callback trims the proposal the client sends.
+	checker := &syncChecker{called: make(chan int, 10)}
+	var rekeyed bool
+	trC, trS, err := handshakePair(&ClientConfig{
+		HostKeyCallback: checker.Check,
+		Config: Config{
+			Halt: halt,
+			KexProposalCallback: func(peer, ours KexProposal) (KexProposal, error) {
+				if !rekeyed {
+					return ours, nil
+				}
+				return trim(peer, ours)
+			},
+		},
+	}, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+	<-checker.called
+	if got := trC.algorithms.w.Cipher; got != first {
+		t.Fatalf("got client to server cipher %q before the rekey, want %q", got, first)
+	}
+
+	rekeyed = true
+	trS.requestKeyExchange()
+	<-checker.called
+	if got := trC.algorithms.w.Cipher; got == first {
+		t.Errorf("got client to server cipher %q, which the callback removed", got)
+	}
+}
@@ -0,0 +1,107 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// HoneypotPolicy tells a server in honeypot mode how to answer an
+// authentication attempt.
+type HoneypotPolicy int
+
+const (
+	// HoneypotReject fails the attempt right away.
+	HoneypotReject HoneypotPolicy = iota
+
+	// HoneypotAccept lets the client in.
+	HoneypotAccept
+
+	// HoneypotTarpit fails the attempt after stalling for
+	// ServerConfig.TarpitDelay, to slow down brute forcing.
+	HoneypotTarpit
+)
+
+// defaultTarpitDelay is used if ServerConfig.TarpitDelay is zero.
+const defaultTarpitDelay = 10 * time.Second
+
+// AuthAttempt describes an authentication attempt seen by a server
+// in honeypot mode.
+type AuthAttempt struct {
+	// Conn gives the user name and the source of the attempt.
+	Conn ConnMetadata
+
+	// Method is "password", "publickey" or
+	// "keyboard-interactive".
+	Method string
+
+	// Password is the password offered, for "password", or the
+	// answer to the password prompt, for
+	// "keyboard-interactive".
+	Password []byte
+
+	// PublicKey is the key offered, for "publickey". Note that
+	// clients offer keys before proving they hold the private
+	// half.
+	PublicKey PublicKey
+}
+
+var errHoneypotReject = errors.New("ssh: rejected by honeypot policy")
+
+// setHoneypot replaces the authentication callbacks of c by ones
+// that ask c.HoneypotCallback, for the connection s. A tarpit ends
+// early when ctx is done, the server stops, or the client hangs up.
+// It is a no-op if HoneypotCallback is nil.
+func (c *ServerConfig) setHoneypot(ctx context.Context, s *connection) {
+	cb := c.HoneypotCallback
+	if cb == nil {
+		return
+	}
+	delay := c.TarpitDelay
+	if delay == 0 {
+		delay = defaultTarpitDelay
+	}
+	halt := c.Halt
+	clock := clockOr(c.Clock)
+	decide := func(ctx context.Context, a *AuthAttempt) (*Permissions, error) {
+		switch cb(a) {
+		case HoneypotAccept:
+			return nil, nil
+		case HoneypotTarpit:
+			var reqStop, hungUp chan struct{}
+			if halt != nil {
+				reqStop = halt.ReqStopChan()
+			}
+			if s.transport != nil {
+				hungUp = s.transport.readDone
+			}
+			timer := clock.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C():
+			case <-reqStop:
+			case <-hungUp:
+			case <-ctx.Done():
+			}
+		}
+		return nil, errHoneypotReject
+	}
+
+	c.PasswordCallback = func(conn ConnMetadata, password []byte) (*Permissions, error) {
+		return decide(ctx, &AuthAttempt{Conn: conn, Method: "password", Password: password})
+	}
+	c.PublicKeyCallback = func(conn ConnMetadata, key PublicKey) (*Permissions, error) {
+		return decide(ctx, &AuthAttempt{Conn: conn, Method: "publickey", PublicKey: key})
+	}
+	c.KeyboardInteractiveCallback = func(ctx context.Context, conn ConnMetadata, client KeyboardInteractiveChallenge) (*Permissions, error) {
+		answers, err := client(ctx, conn.User(), "", []string{"Password: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		a := &AuthAttempt{Conn: conn, Method: "keyboard-interactive"}
+		if len(answers) == 1 {
+			a.Password = []byte(answers[0])
+		}
+		return decide(ctx, a)
+	}
+}
@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tryHoneypot runs a handshake against a server in honeypot mode,
+// and returns the attempts seen by the server and the client's error.
+func tryHoneypot(t *testing.T, auth []AuthMethod, delay time.Duration, policy func(*AuthAttempt) HoneypotPolicy) ([]*AuthAttempt, error) {
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	var mu sync.Mutex
+	var attempts []*AuthAttempt
+	serverConfig := &ServerConfig{
+		HoneypotCallback: func(a *AuthAttempt) HoneypotPolicy {
+			mu.Lock()
+			attempts = append(attempts, a)
+			mu.Unlock()
+			return policy(a)
+		},
+		TarpitDelay: delay,
+		Config:      Config{Halt: halt},
+	}
+	serverConfig.AddHostKey(testSigners["rsa"])
+	clientConfig := &ClientConfig{
+		User:            "root",
+		Auth:            auth,
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	}
+
+	ctx := context.Background()
+	go newServer(ctx, c1, serverConfig)
+	_, _, _, err = NewClientConn(ctx, c2, "", clientConfig)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return attempts, err
+}
+
+func TestHoneypotRecordsAttempts(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	attempts, err := tryHoneypot(t,
+		[]AuthMethod{Password("123456"), PublicKeys(testSigners["rsa"])}, 0,
+		func(a *AuthAttempt) HoneypotPolicy {
+			if a.Method == "publickey" {
+				return HoneypotAccept
+			}
+			return HoneypotReject
+		})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(attempts))
+	}
+	pw, pk := attempts[0], attempts[1]
+	if pw.Method != "password" || string(pw.Password) != "123456" || pw.Conn.User() != "root" || pw.Conn.RemoteAddr() == nil {
+		t.Errorf("got password attempt %+v", pw)
+	}
+	if pk.Method != "publickey" || pk.PublicKey == nil || !bytes.Equal(pk.PublicKey.Marshal(), testPublicKeys["rsa"].Marshal()) {
+		t.Errorf("got publickey attempt %+v", pk)
+	}
+}
+
+func TestHoneypotKeyboardInteractive(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	answers := keyboardInteractive(map[string]string{"Password: ": "hunter2"})
+	attempts, err := tryHoneypot(t,
+		[]AuthMethod{KeyboardInteractive(answers.Challenge)}, 0,
+		func(a *AuthAttempt) HoneypotPolicy { return HoneypotAccept })
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if len(attempts) != 1 || attempts[0].Method != "keyboard-interactive" || string(attempts[0].Password) != "hunter2" {
+		t.Errorf("got attempts %+v", attempts)
+	}
+}
+
+func TestHoneypotTarpit(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	delay := 100 * time.Millisecond
+	start := time.Now()
+	attempts, err := tryHoneypot(t, []AuthMethod{Password("admin")}, delay,
+		func(a *AuthAttempt) HoneypotPolicy { return HoneypotTarpit })
+	if err == nil {
+		t.Fatal("tarpitted client authenticated")
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("failed after %v, want at least %v", elapsed, delay)
+	}
+	if len(attempts) != 1 {
+		t.Errorf("got %d attempts, want 1", len(attempts))
+	}
+}
+
+func TestHoneypotTarpitEndsWithConn(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, end := range []string{"hang up", "cancel"} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+
+		asked := make(chan struct{}, 1)
+		serverConfig := &ServerConfig{
+			HoneypotCallback: func(a *AuthAttempt) HoneypotPolicy {
+				asked <- struct{}{}
+				return HoneypotTarpit
+			},
+			// The fake clock never runs out.
+			TarpitDelay: time.Hour,
+			Config:      Config{Halt: NewHalter(), Clock: NewFakeClock(time.Now())},
+		}
+		serverConfig.AddHostKey(testSigners["rsa"])
+		defer serverConfig.Halt.RequestStop()
+		clientConfig := &ClientConfig{
+			User:            "root",
+			Auth:            []AuthMethod{Password("admin")},
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		}
+		defer clientConfig.Halt.RequestStop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := make(chan error, 1)
+		go func() {
+			_, _, _, err := NewServerConn(ctx, c1, serverConfig)
+			done <- err
+		}()
+		go NewClientConn(context.Background(), c2, "", clientConfig)
+
+		<-asked
+		if end == "hang up" {
+			c2.Close()
+		} else {
+			cancel()
+		}
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("%s: tarpitted client authenticated", end)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: tarpit did not end", end)
+		}
+	}
+}
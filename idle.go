@@ -34,6 +34,10 @@ type IdleTimer struct {
 	lastStart int64
 	lastOK    int64
 
+	// fakeNow is the last timestamp from a clock other than
+	// realClock. Access with atomic.
+	fakeNow int64
+
 	timeoutCallback []func()
 
 	// GetIdleTimeoutCh returns the current idle timeout duration in use.
@@ -61,6 +65,13 @@ type IdleTimer struct {
 	// shutdown after receiving an OK.
 	// access with atomic.
 	isOneshot int32
+
+	// clock runs the heartbeat, and with anything but realClock,
+	// provides the timestamps too.
+	clock Clock
+
+	// goroutines counts the goroutine of the timer, if non-nil.
+	goroutines *goroutineLedger
 }
 
 type callbacks struct {
@@ -75,7 +86,15 @@ type callbacks struct {
 // timeout, in which case the timer will be inactive until
 // SetIdleTimeout is called.
 func NewIdleTimer(callback func(), dur time.Duration) *IdleTimer {
+	return newIdleTimer(callback, dur, realClock{}, nil)
+}
+
+// newIdleTimer is NewIdleTimer, timed by clock, with its goroutine
+// counted in goroutines, which may be nil.
+func newIdleTimer(callback func(), dur time.Duration, clock Clock, goroutines *goroutineLedger) *IdleTimer {
 	t := &IdleTimer{
+		clock:            clock,
+		goroutines:       goroutines,
 		getIdleTimeoutCh: make(chan time.Duration),
 		setIdleTimeoutCh: make(chan *setTimeoutTicket),
 		setCallback:      make(chan *callbacks),
@@ -86,10 +105,32 @@ func NewIdleTimer(callback func(), dur time.Duration) *IdleTimer {
 	if callback != nil {
 		t.timeoutCallback = append(t.timeoutCallback, callback)
 	}
-	go t.backgroundStart(dur)
+	t.backgroundStart(dur)
 	return t
 }
 
+// now returns the timestamp of the IdleTimer's clock: the monotonic
+// one if it is the real clock.
+func (t *IdleTimer) now() int64 {
+	switch t.clock.(type) {
+	case nil, realClock:
+		return monoNow()
+	}
+	// A FakeClock stands still between calls to Advance, but
+	// BeginAttempt and AttemptOK must still be ordered, so the
+	// timestamps are kept increasing.
+	for {
+		last := atomic.LoadInt64(&t.fakeNow)
+		now := t.clock.Now().UnixNano()
+		if now <= last {
+			now = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&t.fakeNow, last, now) {
+			return now
+		}
+	}
+}
+
 // typically prefer addTimeoutCallback instead; using
 // this will blow away any other callbacks that are
 // already registered. Unless that is what you want,
@@ -117,12 +158,12 @@ func (t *IdleTimer) AddTimeoutCallback(timeoutFunc func()) {
 func (t *IdleTimer) LastOKLastStartAndMonoNow() (lastOK, lastStart, mnow int64) {
 	lastOK = atomic.LoadInt64(&t.lastOK)
 	lastStart = atomic.LoadInt64(&t.lastStart)
-	mnow = monoNow()
+	mnow = t.now()
 	return
 }
 
 func (t *IdleTimer) BeginAttempt() {
-	atomic.StoreInt64(&t.lastStart, monoNow()) // Reset
+	atomic.StoreInt64(&t.lastStart, t.now()) // Reset
 }
 
 // Reset stores the current monotonic timestamp
@@ -148,7 +189,7 @@ func (t *IdleTimer) AttemptOK() {
 		return
 	}
 
-	mnow := monoNow()
+	mnow := t.now()
 	atomic.StoreInt64(&t.lastOK, mnow)
 	return
 }
@@ -175,7 +216,7 @@ func (t *IdleTimer) AttemptOK() {
 //   may not be currently active.
 //
 func (t *IdleTimer) IdleStatus() (lastStart, lastOK, mnow, todur int64, timedout bool) {
-	mnow = monoNow()
+	mnow = t.now()
 	lastOK = atomic.LoadInt64(&t.lastOK)
 	lastStart = atomic.LoadInt64(&t.lastStart)
 	todur = atomic.LoadInt64(&t.atomicdur)
@@ -255,8 +296,8 @@ const factor = 10
 func (t *IdleTimer) backgroundStart(dur time.Duration) {
 	//pp("IdleTimer.backgroundStart(dur=%v) called.", dur)
 	atomic.StoreInt64(&t.atomicdur, int64(dur))
-	go func() {
-		var heartbeat *time.Ticker
+	t.goroutines.spawn("idle timer", func() {
+		var heartbeat Ticker
 		var heartch <-chan time.Time
 		if dur > 0 {
 			// we've got to sample at above niquist
@@ -266,8 +307,8 @@ func (t *IdleTimer) backgroundStart(dur time.Duration) {
 			// we go with dur/factor. This also allows for
 			// some play/some slop in the sampling, which
 			// we empirically observe.
-			heartbeat = time.NewTicker(dur / factor)
-			heartch = heartbeat.C
+			heartbeat = t.clock.NewTicker(dur / factor)
+			heartch = heartbeat.C()
 		}
 		defer func() {
 			if heartbeat != nil {
@@ -325,8 +366,8 @@ func (t *IdleTimer) backgroundStart(dur time.Duration) {
 					dur = tk.newdur
 					atomic.StoreInt64(&t.atomicdur, int64(dur))
 
-					heartbeat = time.NewTicker(dur / factor)
-					heartch = heartbeat.C
+					heartbeat = t.clock.NewTicker(dur / factor)
+					heartch = heartbeat.C()
 					atomic.StoreInt64(&t.lastStart, -1) // Reset
 					close(tk.done)
 					continue
@@ -344,8 +385,8 @@ func (t *IdleTimer) backgroundStart(dur time.Duration) {
 					dur = tk.newdur
 					atomic.StoreInt64(&t.atomicdur, int64(dur))
 
-					heartbeat = time.NewTicker(dur / factor)
-					heartch = heartbeat.C
+					heartbeat = t.clock.NewTicker(dur / factor)
+					heartch = heartbeat.C()
 					atomic.StoreInt64(&t.lastStart, -1) // Reset
 					close(tk.done)
 					continue
@@ -364,7 +405,7 @@ func (t *IdleTimer) backgroundStart(dur time.Duration) {
 					/* change state */
 					t.timeOutRaised = fmt.Sprintf("timing out dur='%v' at %v, in %p! "+
 						"since=%v  dur=%v, exceed=%v.",
-						dur, time.Now(), t, since, udur, since-udur)
+						dur, t.clock.Now(), t, since, udur, since-udur)
 
 					// After firing, disable until reactivated.
 					// Still must be a ticker and not a one-shot because it may take
@@ -389,5 +430,5 @@ func (t *IdleTimer) backgroundStart(dur time.Duration) {
 				}
 			}
 		}
-	}()
+	})
 }
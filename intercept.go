@@ -0,0 +1,113 @@
+package ssh
+
+import "fmt"
+
+// InterceptKind identifies the kind of an InterceptedMessage.
+type InterceptKind int
+
+const (
+	// InterceptChannelOpen is a channel the peer opens.
+	InterceptChannelOpen InterceptKind = iota + 1
+
+	// InterceptGlobalRequest is a global request of the peer.
+	InterceptGlobalRequest
+
+	// InterceptChannelRequest is a request of the peer on a
+	// channel.
+	InterceptChannelRequest
+)
+
+// String returns the kind in human readable form.
+func (k InterceptKind) String() string {
+	switch k {
+	case InterceptChannelOpen:
+		return "channel-open"
+	case InterceptGlobalRequest:
+		return "global-request"
+	case InterceptChannelRequest:
+		return "channel-request"
+	}
+	return fmt.Sprintf("unknown intercept kind %d", int(k))
+}
+
+// InterceptedMessage is a message from the peer, decoded, that has
+// not been dispatched yet.
+type InterceptedMessage struct {
+	Kind InterceptKind
+
+	// Conn is the connection the message arrived on.
+	Conn ConnMetadata
+
+	// Name is the channel type of a channel open, or the request
+	// type of a request.
+	Name string
+
+	// Channel is the channel of an InterceptChannelRequest.
+	Channel Channel
+
+	// ChannelType is the type of the channel of an
+	// InterceptChannelRequest.
+	ChannelType string
+
+	// WantReply tells whether the peer waits for the answer to a
+	// request.
+	WantReply bool
+
+	// Payload is the type specific data of a channel open, or the
+	// payload of a request. Interceptors must not change it.
+	Payload []byte
+}
+
+// An Interceptor is called, in the order of registration with the
+// others of its connection, for each InterceptedMessage. It runs on
+// the goroutine that reads the connection, so it must not block.
+// Returning a non-nil error vetoes the message, and no later
+// Interceptor sees it: a channel open is rejected with Prohibited and
+// the error as message, and a request is answered with a failure if
+// the peer wants a reply. A vetoed message never reaches Accept or
+// the request channels.
+type Interceptor func(msg *InterceptedMessage) error
+
+// Interceptable, if implemented by a Conn, lets Interceptors see the
+// channel opens and requests of the peer. The connections of this
+// package implement it, for example:
+//
+//	if i, ok := conn.(ssh.Interceptable); ok {
+//		i.Intercept(denyX11)
+//	}
+//
+// Messages that arrive before Intercept is called are not seen; use
+// Config.Interceptors to cover the whole connection.
+type Interceptable interface {
+	// Intercept appends interceptors to the chain of the
+	// connection.
+	Intercept(interceptors ...Interceptor)
+}
+
+// Intercept implements Interceptable for the connection.
+func (m *mux) Intercept(interceptors ...Interceptor) {
+	m.interceptMu.Lock()
+	defer m.interceptMu.Unlock()
+	// Copy, so intercept can range over the old chain unlocked.
+	chain := make([]Interceptor, 0, len(m.interceptors)+len(interceptors))
+	chain = append(chain, m.interceptors...)
+	m.interceptors = append(chain, interceptors...)
+}
+
+// intercept runs msg through the Interceptors, and returns the veto
+// of the first one that objects.
+func (m *mux) intercept(msg *InterceptedMessage) error {
+	m.interceptMu.Lock()
+	chain := m.interceptors
+	m.interceptMu.Unlock()
+	if len(chain) == 0 {
+		return nil
+	}
+	msg.Conn = m.interceptConn
+	for _, i := range chain {
+		if err := i(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	var mu sync.Mutex
+	var seen []string
+	observe := func(msg *InterceptedMessage) error {
+		mu.Lock()
+		seen = append(seen, msg.Kind.String()+" "+msg.Name)
+		mu.Unlock()
+		return nil
+	}
+	veto := func(msg *InterceptedMessage) error {
+		if msg.Name == "bad" {
+			return errors.New("bad " + msg.Kind.String())
+		}
+		return nil
+	}
+	client, server := muxPairConfig(halt, &Config{
+		MaxChannelPacket: channelMaxPacket,
+		Interceptors:     []Interceptor{observe},
+	})
+	defer server.Close()
+	defer client.Close()
+	client.Intercept(veto)
+	server.Intercept(veto)
+
+	go func() {
+		for r := range server.incomingRequests {
+			if r.Type == "bad" {
+				t.Errorf("vetoed request %q dispatched", r.Type)
+			}
+			r.Reply(true, nil)
+		}
+	}()
+	ctx := context.Background()
+	if ok, _, err := client.SendRequest(ctx, "good", true, nil); !ok || err != nil {
+		t.Errorf("SendRequest(good): %v, %v", ok, err)
+	}
+	if ok, _, err := client.SendRequest(ctx, "bad", true, nil); ok || err != nil {
+		t.Errorf("SendRequest(bad): %v, %v, want refused", ok, err)
+	}
+
+	_, err := client.openChannel(ctx, "bad", nil, nil)
+	var ocf *OpenChannelError
+	if !errors.As(err, &ocf) || ocf.Reason != Prohibited || ocf.Message != "bad channel-open" {
+		t.Errorf("openChannel(bad): got %v, want it prohibited by the interceptor", err)
+	}
+
+	go func() {
+		nc, ok := <-server.incomingChannels
+		if !ok {
+			return
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		for r := range reqs {
+			r.Reply(r.Type == "good", nil)
+		}
+		ch.Close()
+	}()
+	ch, err := client.openChannel(ctx, "good", nil, nil)
+	if err != nil {
+		t.Fatalf("openChannel(good): %v", err)
+	}
+	if ok, err := ch.SendRequest("good", true, nil); !ok || err != nil {
+		t.Errorf("channel SendRequest(good): %v, %v", ok, err)
+	}
+	if ok, err := ch.SendRequest("bad", true, nil); ok || err != nil {
+		t.Errorf("channel SendRequest(bad): %v, %v, want refused", ok, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"global-request good",
+		"global-request bad",
+		"channel-open bad",
+		"channel-open good",
+		"channel-request good",
+		"channel-request bad",
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("interceptor saw %q, want %q", seen, want)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("message %d: got %q, want %q", i, seen[i], want[i])
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package ssh
 
 import (
+	"bufio"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -12,8 +13,11 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
+	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/curve25519"
 )
@@ -21,10 +25,13 @@ import (
 const (
 	kexAlgoDH1SHA1          = "diffie-hellman-group1-sha1"
 	kexAlgoDH14SHA1         = "diffie-hellman-group14-sha1"
+	kexAlgoDH16SHA512       = "diffie-hellman-group16-sha512"
+	kexAlgoDH18SHA512       = "diffie-hellman-group18-sha512"
 	kexAlgoECDH256          = "ecdh-sha2-nistp256"
 	kexAlgoECDH384          = "ecdh-sha2-nistp384"
 	kexAlgoECDH521          = "ecdh-sha2-nistp521"
 	kexAlgoCurve25519SHA256 = "curve25519-sha256@libssh.org"
+	kexAlgoDHGEXSHA256      = "diffie-hellman-group-exchange-sha256"
 )
 
 // kexResult captures the outcome of a key exchange.
@@ -79,6 +86,11 @@ type kexAlgorithm interface {
 // dhGroup is a multiplicative group suitable for implementing Diffie-Hellman key agreement.
 type dhGroup struct {
 	g, p, pMinus1 *big.Int
+
+	// hashFunc is used for computing the exchange hash H, and for
+	// deriving keys from it. RFC 4253 groups use SHA-1; the larger
+	// RFC 8268 groups use SHA-512.
+	hashFunc crypto.Hash
 }
 
 func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int, error) {
@@ -89,7 +101,7 @@ func (group *dhGroup) diffieHellman(theirPublic, myPrivate *big.Int) (*big.Int,
 }
 
 func (group *dhGroup) Client(ctx context.Context, c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
-	hashFunc := crypto.SHA1
+	hashFunc := group.hashFunc
 
 	var x *big.Int
 	for {
@@ -139,12 +151,12 @@ func (group *dhGroup) Client(ctx context.Context, c packetConn, randSource io.Re
 		K:         K,
 		HostKey:   kexDHReply.HostKey,
 		Signature: kexDHReply.Signature,
-		Hash:      crypto.SHA1,
+		Hash:      hashFunc,
 	}, nil
 }
 
 func (group *dhGroup) Server(ctx context.Context, c packetConn, randSource io.Reader, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
-	hashFunc := crypto.SHA1
+	hashFunc := group.hashFunc
 	packet, err := c.readPacket(ctx)
 	if err != nil {
 		return
@@ -204,7 +216,304 @@ func (group *dhGroup) Server(ctx context.Context, c packetConn, randSource io.Re
 		K:         K,
 		HostKey:   hostKeyBytes,
 		Signature: sig,
-		Hash:      crypto.SHA1,
+		Hash:      hashFunc,
+	}, nil
+}
+
+// GEXGroup is a Diffie-Hellman group that a server may offer during
+// diffie-hellman-group-exchange key agreement. See RFC 4419.
+type GEXGroup struct {
+	// G is the generator.
+	G *big.Int
+
+	// P is the safe prime modulus.
+	P *big.Int
+}
+
+// ParseModuli parses Diffie-Hellman groups in the format of the
+// OpenSSH moduli(5) file, typically found at /etc/ssh/moduli.
+// Entries that are not marked as safe primes, or that failed
+// primality testing, are skipped.
+func ParseModuli(r io.Reader) ([]GEXGroup, error) {
+	var groups []GEXGroup
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 64*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// Time Type Tests Tries Size Generator Modulus
+		fields := strings.Fields(line)
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("ssh: moduli line %d: expected 7 fields, got %d", lineNum, len(fields))
+		}
+		typ, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: moduli line %d: bad type: %v", lineNum, err)
+		}
+		tests, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: moduli line %d: bad tests: %v", lineNum, err)
+		}
+		size, err := strconv.ParseUint(fields[4], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("ssh: moduli line %d: bad size: %v", lineNum, err)
+		}
+		g, ok := new(big.Int).SetString(fields[5], 16)
+		if !ok {
+			return nil, fmt.Errorf("ssh: moduli line %d: bad generator", lineNum)
+		}
+		p, ok := new(big.Int).SetString(fields[6], 16)
+		if !ok {
+			return nil, fmt.Errorf("ssh: moduli line %d: bad modulus", lineNum)
+		}
+
+		// 2 is a safe prime; tests bit 0x01 is set if the
+		// candidate was found to be composite.
+		if typ != 2 || tests&1 != 0 {
+			continue
+		}
+		// The size field is one less than the modulus bit length.
+		if uint64(p.BitLen()) != size+1 {
+			return nil, fmt.Errorf("ssh: moduli line %d: size %d does not match %d bit modulus", lineNum, size, p.BitLen())
+		}
+		groups = append(groups, GEXGroup{G: g, P: p})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// The group sizes the client asks for during group exchange. We
+// follow OpenSSH in refusing anything smaller than 2048 bits.
+const (
+	dhGEXMinBits       = 2048
+	dhGEXPreferredBits = 3072
+	dhGEXMaxBits       = 8192
+)
+
+// dhGEXSHA implements the diffie-hellman-group-exchange key
+// agreement, as described in RFC 4419.
+type dhGEXSHA struct {
+	hashFunc crypto.Hash
+
+	// groups holds the moduli the server chooses from. It is
+	// unused on the client side.
+	groups []*dhGroup
+}
+
+// withGroups returns a copy of gex that offers the given moduli
+// when acting as the server.
+func (gex *dhGEXSHA) withGroups(moduli []GEXGroup) *dhGEXSHA {
+	r := &dhGEXSHA{hashFunc: gex.hashFunc}
+	for _, m := range moduli {
+		r.groups = append(r.groups, &dhGroup{
+			g:        m.G,
+			p:        m.P,
+			pMinus1:  new(big.Int).Sub(m.P, bigOne),
+			hashFunc: gex.hashFunc,
+		})
+	}
+	return r
+}
+
+// pickGroup returns the smallest group that is at least as large
+// as the preferred size, or failing that, the largest group that
+// fits within the requested range. It returns nil if no group fits.
+func (gex *dhGEXSHA) pickGroup(req *kexDHGexRequestMsg) *dhGroup {
+	var best *dhGroup
+	for _, group := range gex.groups {
+		bits := uint32(group.p.BitLen())
+		if bits < req.MinBits || bits > req.MaxBits {
+			continue
+		}
+		if best == nil {
+			best = group
+			continue
+		}
+		bestBits := uint32(best.p.BitLen())
+		switch {
+		case bestBits < req.PreferedBits && bits > bestBits:
+			best = group
+		case bits >= req.PreferedBits && bits < bestBits:
+			best = group
+		}
+	}
+	return best
+}
+
+// hashGEX computes the exchange hash of RFC 4419, section 3.
+func (gex *dhGEXSHA) hashGEX(magics *handshakeMagics, hostKey []byte, req *kexDHGexRequestMsg, group *dhGroup, X, Y *big.Int, K []byte) []byte {
+	h := gex.hashFunc.New()
+	magics.write(h)
+	writeString(h, hostKey)
+	var sizes []byte
+	sizes = appendU32(sizes, req.MinBits)
+	sizes = appendU32(sizes, req.PreferedBits)
+	sizes = appendU32(sizes, req.MaxBits)
+	h.Write(sizes)
+	writeInt(h, group.p)
+	writeInt(h, group.g)
+	writeInt(h, X)
+	writeInt(h, Y)
+	h.Write(K)
+	return h.Sum(nil)
+}
+
+func (gex *dhGEXSHA) Client(ctx context.Context, c packetConn, randSource io.Reader, magics *handshakeMagics) (*kexResult, error) {
+	req := kexDHGexRequestMsg{
+		MinBits:      dhGEXMinBits,
+		PreferedBits: dhGEXPreferredBits,
+		MaxBits:      dhGEXMaxBits,
+	}
+	if err := c.writePacket(Marshal(&req)); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var groupMsg kexDHGexGroupMsg
+	if err = Unmarshal(packet, &groupMsg); err != nil {
+		return nil, err
+	}
+	if bits := uint32(groupMsg.P.BitLen()); bits < req.MinBits || bits > req.MaxBits {
+		return nil, fmt.Errorf("ssh: server offered a %d bit group, outside of the requested %d-%d bits", bits, req.MinBits, req.MaxBits)
+	}
+	group := &dhGroup{
+		g:        groupMsg.G,
+		p:        groupMsg.P,
+		pMinus1:  new(big.Int).Sub(groupMsg.P, bigOne),
+		hashFunc: gex.hashFunc,
+	}
+	if group.g.Cmp(bigOne) <= 0 || group.g.Cmp(group.pMinus1) >= 0 {
+		return nil, errors.New("ssh: server offered a group with a bad generator")
+	}
+
+	var x *big.Int
+	for {
+		if x, err = rand.Int(randSource, group.pMinus1); err != nil {
+			return nil, err
+		}
+		if x.Sign() > 0 {
+			break
+		}
+	}
+
+	X := new(big.Int).Exp(group.g, x, group.p)
+	if err := c.writePacket(Marshal(&kexDHGexInitMsg{X: X})); err != nil {
+		return nil, err
+	}
+
+	packet, err = c.readPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply kexDHGexReplyMsg
+	if err = Unmarshal(packet, &reply); err != nil {
+		return nil, err
+	}
+
+	kInt, err := group.diffieHellman(reply.Y, x)
+	if err != nil {
+		return nil, err
+	}
+
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+
+	return &kexResult{
+		H:         gex.hashGEX(magics, reply.HostKey, &req, group, X, reply.Y, K),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      gex.hashFunc,
+	}, nil
+}
+
+func (gex *dhGEXSHA) Server(ctx context.Context, c packetConn, randSource io.Reader, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
+	packet, err := c.readPacket(ctx)
+	if err != nil {
+		return
+	}
+	var req kexDHGexRequestMsg
+	if err = Unmarshal(packet, &req); err != nil {
+		return
+	}
+	if req.MinBits > req.PreferedBits || req.PreferedBits > req.MaxBits {
+		return nil, fmt.Errorf("ssh: invalid group exchange request %d <= %d <= %d", req.MinBits, req.PreferedBits, req.MaxBits)
+	}
+
+	group := gex.pickGroup(&req)
+	if group == nil {
+		return nil, fmt.Errorf("ssh: no group exchange moduli between %d and %d bits", req.MinBits, req.MaxBits)
+	}
+
+	if err = c.writePacket(Marshal(&kexDHGexGroupMsg{P: group.p, G: group.g})); err != nil {
+		return
+	}
+
+	packet, err = c.readPacket(ctx)
+	if err != nil {
+		return
+	}
+	var init kexDHGexInitMsg
+	if err = Unmarshal(packet, &init); err != nil {
+		return
+	}
+
+	var y *big.Int
+	for {
+		if y, err = rand.Int(randSource, group.pMinus1); err != nil {
+			return
+		}
+		if y.Sign() > 0 {
+			break
+		}
+	}
+
+	Y := new(big.Int).Exp(group.g, y, group.p)
+	kInt, err := group.diffieHellman(init.X, y)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyBytes := priv.PublicKey().Marshal()
+
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+
+	H := gex.hashGEX(magics, hostKeyBytes, &req, group, init.X, Y, K)
+
+	// H is already a hash, but the hostkey signing will apply its
+	// own key-specific hash algorithm.
+	sig, err := signAndMarshal(priv, randSource, H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexDHGexReplyMsg{
+		HostKey:   hostKeyBytes,
+		Y:         Y,
+		Signature: sig,
+	}
+	if err = c.writePacket(Marshal(&reply)); err != nil {
+		return nil, err
+	}
+	return &kexResult{
+		H:         H,
+		K:         K,
+		HostKey:   hostKeyBytes,
+		Signature: sig,
+		Hash:      gex.hashFunc,
 	}, nil
 }
 
@@ -384,9 +693,10 @@ func init() {
 	// 4253 and Oakley Group 2 in RFC 2409.
 	p, _ := new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF", 16)
 	kexAlgoMap[kexAlgoDH1SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA1,
 	}
 
 	// This is the group called diffie-hellman-group14-sha1 in RFC
@@ -394,9 +704,43 @@ func init() {
 	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
 
 	kexAlgoMap[kexAlgoDH14SHA1] = &dhGroup{
-		g:       new(big.Int).SetInt64(2),
-		p:       p,
-		pMinus1: new(big.Int).Sub(p, bigOne),
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA1,
+	}
+
+	// This is the group called diffie-hellman-group16-sha512 in RFC
+	// 8268 and 4096-bit MODP Group 16 in RFC 3526.
+	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF", 16)
+
+	kexAlgoMap[kexAlgoDH16SHA512] = &dhGroup{
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA512,
+	}
+
+	// This is the group called diffie-hellman-group18-sha512 in RFC
+	// 8268 and 8192-bit MODP Group 18 in RFC 3526.
+	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D788719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA993B4EA988D8FDDC186FFB7DC90A6C08F4DF435C93402849236C3FAB4D27C7026C1D4DCB2602646DEC9751E763DBA37BDF8FF9406AD9E530EE5DB382F413001AEB06A53ED9027D831179727B0865A8918DA3EDBEBCF9B14ED44CE6CBACED4BB1BDB7F1447E6CC254B332051512BD7AF426FB8F401378CD2BF5983CA01C64B92ECF032EA15D1721D03F482D7CE6E74FEF6D55E702F46980C82B5A84031900B1C9E59E7C97FBEC7E8F323A97A7E36CC88BE0F1D45B7FF585AC54BD407B22B4154AACC8F6D7EBF48E1D814CC5ED20F8037E0A79715EEF29BE32806A1D58BB7C5DA76F550AA3D8A1FBFF0EB19CCB1A313D55CDA56C9EC2EF29632387FE8D76E3C0468043E8F663F4860EE12BF2D5B0B7474D6E694F91E6DBE115974A3926F12FEE5E438777CB6A932DF8CD8BEC4D073B931BA3BC832B68D9DD300741FA7BF8AFC47ED2576F6936BA424663AAB639C5AE4F5683423B4742BF1C978238F16CBE39D652DE3FDB8BEFC848AD922222E04A4037C0713EB57A81A23F0C73473FC646CEA306B4BCBC8862F8385DDFA9D4B7FA2C087E879683303ED5BDD3A062B3CF5B3A278A66D2A13F83F44F82DDF310EE074AB6A364597E899A0255DC164F31CC50846851DF9AB48195DED7EA1B1D510BD7EE74D73FAF36BC31ECFA268359046F4EB879F924009438B481C6CD7889A002ED5EE382BC9190DA6FC026E479558E4475677E9AA9E3050E2765694DFC81F56E880B96E7160C980DD98EDD3DFFFFFFFFFFFFFFFFF", 16)
+
+	kexAlgoMap[kexAlgoDH18SHA512] = &dhGroup{
+		g:        new(big.Int).SetInt64(2),
+		p:        p,
+		pMinus1:  new(big.Int).Sub(p, bigOne),
+		hashFunc: crypto.SHA512,
+	}
+
+	// By default, group exchange offers the RFC 3526 groups that
+	// we also support for fixed-group key agreement.
+	kexAlgoMap[kexAlgoDHGEXSHA256] = &dhGEXSHA{
+		hashFunc: crypto.SHA256,
+		groups: []*dhGroup{
+			kexAlgoMap[kexAlgoDH14SHA1].(*dhGroup),
+			kexAlgoMap[kexAlgoDH16SHA512].(*dhGroup),
+			kexAlgoMap[kexAlgoDH18SHA512].(*dhGroup),
+		},
 	}
 
 	kexAlgoMap[kexAlgoECDH521] = &ecdh{elliptic.P521()}
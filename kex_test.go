@@ -9,7 +9,12 @@ package ssh
 import (
 	"context"
 	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"os/exec"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,3 +58,176 @@ func TestKexes(t *testing.T) {
 		}
 	}
 }
+
+func TestDHGroupParameters(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for name, bits := range map[string]int{
+		kexAlgoDH1SHA1:    1024,
+		kexAlgoDH14SHA1:   2048,
+		kexAlgoDH16SHA512: 4096,
+		kexAlgoDH18SHA512: 8192,
+	} {
+		group, ok := kexAlgoMap[name].(*dhGroup)
+		if !ok {
+			t.Fatalf("kex %q: not a dhGroup", name)
+		}
+		if got := group.p.BitLen(); got != bits {
+			t.Errorf("kex %q: got %d bit prime, want %d", name, got, bits)
+		}
+		if !group.p.ProbablyPrime(1) {
+			t.Errorf("kex %q: modulus is not prime", name)
+		}
+		if group.pMinus1.Cmp(new(big.Int).Sub(group.p, bigOne)) != 0 {
+			t.Errorf("kex %q: pMinus1 is not p-1", name)
+		}
+	}
+}
+
+// TestDHGroupOpenSSH checks the large groups against the OpenSSH
+// client, which has its own copies of the RFC 3526 primes.
+func TestDHGroupOpenSSH(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	if testing.Short() {
+		t.Skip("skipping test due to -short")
+	}
+	bin, err := exec.LookPath("ssh")
+	if err != nil {
+		t.Skip("could not find ssh")
+	}
+
+	for _, kex := range []string{kexAlgoDH16SHA512, kexAlgoDH18SHA512} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		halt := NewHalter()
+		config := &ServerConfig{
+			NoClientAuth: true,
+			Config:       Config{Halt: halt, KeyExchanges: []string{kex}},
+		}
+		config.AddHostKey(testSigners["ecdsa"])
+
+		done := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer c.Close()
+			_, _, _, err = NewServerConn(context.Background(), c, config)
+			done <- err
+		}()
+
+		host, port, _ := net.SplitHostPort(l.Addr().String())
+		cmd := exec.Command(bin, "-F", "/dev/null",
+			"-o", "BatchMode=yes",
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null",
+			"-o", "KexAlgorithms="+kex,
+			"-p", port, "user@"+host, "true")
+		// ssh fails once the server hangs up; only the handshake
+		// matters.
+		out, _ := cmd.CombinedOutput()
+		if err := <-done; err != nil {
+			t.Errorf("kex %q with OpenSSH: %v\n%s", kex, err, out)
+		}
+		l.Close()
+		halt.RequestStop()
+	}
+}
+
+func TestParseModuli(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	p14 := kexAlgoMap[kexAlgoDH14SHA1].(*dhGroup).p
+	hex := fmt.Sprintf("%X", p14)
+	moduli := "# comment\n" +
+		"\n" +
+		"20170101000000 2 6 100 2047 2 " + hex + "\n" +
+		"20170101000000 2 1 100 2047 2 " + hex + "\n" + // composite
+		"20170101000000 0 6 100 2047 5 " + hex + "\n" // not a safe prime
+
+	groups, err := ParseModuli(strings.NewReader(moduli))
+	if err != nil {
+		t.Fatalf("ParseModuli: %v", err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("got %d groups, want 1", len(groups))
+	}
+	if groups[0].P.Cmp(p14) != 0 || groups[0].G.Int64() != 2 {
+		t.Errorf("got group %v, want group14", groups[0])
+	}
+
+	for _, bad := range []string{
+		"20170101000000 2 6 100 2047 2\n",
+		"20170101000000 2 6 100 4095 2 " + hex + "\n",
+		"20170101000000 2 6 100 2047 2 XYZ\n",
+	} {
+		if _, err := ParseModuli(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseModuli(%q): expected error", bad[:40])
+		}
+	}
+}
+
+func TestGEXPickGroup(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	gex := kexAlgoMap[kexAlgoDHGEXSHA256].(*dhGEXSHA)
+	for _, tc := range []struct {
+		min, n, max uint32
+		want        int
+	}{
+		{2048, 3072, 8192, 4096},
+		{2048, 2048, 8192, 2048},
+		{2048, 8192, 8192, 8192},
+		{1024, 1024, 4096, 2048},
+		{3000, 3000, 4000, 0},
+		{1024, 1024, 1024, 0},
+	} {
+		got := 0
+		if group := gex.pickGroup(&kexDHGexRequestMsg{tc.min, tc.n, tc.max}); group != nil {
+			got = group.p.BitLen()
+		}
+		if got != tc.want {
+			t.Errorf("pickGroup(%d, %d, %d): got %d bits, want %d", tc.min, tc.n, tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestGEXCustomGroups(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	p14 := kexAlgoMap[kexAlgoDH14SHA1].(*dhGroup).p
+	gex := kexAlgoMap[kexAlgoDHGEXSHA256].(*dhGEXSHA)
+	serverKex := gex.withGroups([]GEXGroup{{G: big.NewInt(2), P: p14}})
+
+	a, b := memPipe()
+	var magics handshakeMagics
+	ctx := context.Background()
+
+	type kexResultErr struct {
+		result *kexResult
+		err    error
+	}
+	c := make(chan kexResultErr, 1)
+	go func() {
+		r, e := gex.Client(ctx, a, rand.Reader, &magics)
+		a.Close()
+		c <- kexResultErr{r, e}
+	}()
+	serverRes, err := serverKex.Server(ctx, b, rand.Reader, &magics, testSigners["ecdsa"])
+	b.Close()
+	if err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	clientRes := <-c
+	if clientRes.err != nil {
+		t.Fatalf("client: %v", clientRes.err)
+	}
+	if !reflect.DeepEqual(clientRes.result, serverRes) {
+		t.Errorf("mismatch %#v, %#v", clientRes.result, serverRes)
+	}
+}
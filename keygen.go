@@ -0,0 +1,187 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The sizes GenerateKey uses when bits is zero, as ssh-keygen does.
+const (
+	defaultRSABits   = 3072
+	defaultECDSABits = 256
+)
+
+// GeneratedKey is a key made by GenerateKey. It is a Signer, and
+// marshals to the files ssh-keygen writes.
+type GeneratedKey struct {
+	Signer
+
+	// Key is the private key, an *rsa.PrivateKey, *ecdsa.PrivateKey
+	// or ed25519.PrivateKey.
+	Key crypto.PrivateKey
+
+	// Comment is written after the public key and inside the
+	// private key, user@host by convention.
+	Comment string
+}
+
+// GenerateKey makes a new key, as ssh-keygen -t keyType -b bits
+// does. keyType is "rsa", "ecdsa" or "ed25519", or one of the
+// KeyAlgo names of those. Zero bits picks 3072 for RSA, which may
+// not have fewer than 1024, and 256 for ECDSA, which may have 256,
+// 384 or 521; Ed25519 keys have no size, and bits must be zero.
+func GenerateKey(keyType string, bits int) (*GeneratedKey, error) {
+	var key crypto.PrivateKey
+	var err error
+	switch keyType {
+	case "rsa", KeyAlgoRSA:
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		if bits < 1024 {
+			return nil, fmt.Errorf("ssh: RSA keys must have at least 1024 bits, not %d", bits)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa", KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
+		var curve elliptic.Curve
+		switch {
+		case keyType == KeyAlgoECDSA256 && bits == 0:
+			curve = elliptic.P256()
+		case keyType == KeyAlgoECDSA384 && bits == 0:
+			curve = elliptic.P384()
+		case keyType == KeyAlgoECDSA521 && bits == 0:
+			curve = elliptic.P521()
+		case keyType != "ecdsa":
+			return nil, fmt.Errorf("ssh: %s keys have a fixed size", keyType)
+		case bits == 0 || bits == 256:
+			curve = elliptic.P256()
+		case bits == 384:
+			curve = elliptic.P384()
+		case bits == 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("ssh: ECDSA keys have 256, 384 or 521 bits, not %d", bits)
+		}
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case "ed25519", KeyAlgoED25519:
+		if bits != 0 {
+			return nil, errors.New("ssh: Ed25519 keys have a fixed size")
+		}
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("ssh: cannot generate keys of type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &GeneratedKey{Signer: signer, Key: key}, nil
+}
+
+// MarshalAuthorizedKey returns the public key as a line of an
+// authorized_keys file, or of the .pub file of ssh-keygen, with the
+// comment.
+func (k *GeneratedKey) MarshalAuthorizedKey() []byte {
+	line := MarshalAuthorizedKey(k.PublicKey())
+	if k.Comment == "" {
+		return line
+	}
+	line = append(line[:len(line)-1], ' ')
+	line = append(line, k.Comment...)
+	return append(line, '\n')
+}
+
+// MarshalPrivateKey returns the private key in the unencrypted
+// OpenSSH format, as PEM.
+func (k *GeneratedKey) MarshalPrivateKey() ([]byte, error) {
+	block, err := MarshalPrivateKey(k.Key, k.Comment)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// MarshalPrivateKey returns key, an *rsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey, in the unencrypted
+// OpenSSH format of PROTOCOL.key, which ParseRawPrivateKey and
+// ssh-keygen read.
+func MarshalPrivateKey(key crypto.PrivateKey, comment string) (*pem.Block, error) {
+	var keyType string
+	var fields interface{}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("ssh: OpenSSH only holds RSA keys of two primes")
+		}
+		k.Precompute()
+		keyType = KeyAlgoRSA
+		fields = &struct {
+			N, E, D, Iqmp, P, Q *big.Int
+		}{k.N, big.NewInt(int64(k.E)), k.D, k.Precomputed.Qinv, k.Primes[0], k.Primes[1]}
+	case *ecdsa.PrivateKey:
+		pub, err := NewPublicKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keyType = pub.Type()
+		fields = &struct {
+			Curve string
+			Pub   []byte
+			D     *big.Int
+		}{pub.(*ecdsaPublicKey).nistID(), elliptic.Marshal(k.Curve, k.X, k.Y), k.D}
+	case ed25519.PrivateKey:
+		keyType = KeyAlgoED25519
+		fields = &struct {
+			Pub, Priv []byte
+		}{[]byte(k[ed25519.SeedSize:]), []byte(k)}
+	case *ed25519.PrivateKey:
+		return MarshalPrivateKey(*k, comment)
+	default:
+		return nil, fmt.Errorf("ssh: unsupported key type %T", key)
+	}
+	signer, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	private := appendU32(nil, binary.BigEndian.Uint32(check[:]))
+	private = appendU32(private, binary.BigEndian.Uint32(check[:]))
+	private = appendString(private, keyType)
+	private = append(private, Marshal(fields)...)
+	private = appendString(private, comment)
+	// Pad to the block size of the "none" cipher, 8.
+	for i := 1; len(private)%8 != 0; i++ {
+		private = append(private, byte(i))
+	}
+
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, signer.PublicKey().Marshal(), private}
+	magic := append([]byte("openssh-key-v1"), 0)
+	return &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: append(magic, Marshal(&w)...),
+	}, nil
+}
@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestGenerateKey(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range []struct {
+		keyType string
+		bits    int
+		want    string
+	}{
+		{"rsa", 1024, KeyAlgoRSA},
+		{"ecdsa", 0, KeyAlgoECDSA256},
+		{"ecdsa", 384, KeyAlgoECDSA384},
+		{KeyAlgoECDSA521, 0, KeyAlgoECDSA521},
+		{"ed25519", 0, KeyAlgoED25519},
+	} {
+		key, err := GenerateKey(tt.keyType, tt.bits)
+		if err != nil {
+			t.Fatalf("GenerateKey(%q, %d): %v", tt.keyType, tt.bits, err)
+		}
+		if got := key.PublicKey().Type(); got != tt.want {
+			t.Errorf("GenerateKey(%q, %d) made a %s key, want %s", tt.keyType, tt.bits, got, tt.want)
+		}
+		key.Comment = "gopher@example.com"
+
+		pub, comment, _, rest, err := ParseAuthorizedKey(key.MarshalAuthorizedKey())
+		if err != nil {
+			t.Fatalf("%s: ParseAuthorizedKey: %v", tt.want, err)
+		}
+		if comment != key.Comment || len(rest) != 0 {
+			t.Errorf("%s: got comment %q and rest %q", tt.want, comment, rest)
+		}
+		if !bytes.Equal(pub.Marshal(), key.PublicKey().Marshal()) {
+			t.Errorf("%s: authorized key differs", tt.want)
+		}
+
+		pemBytes, err := key.MarshalPrivateKey()
+		if err != nil {
+			t.Fatalf("%s: MarshalPrivateKey: %v", tt.want, err)
+		}
+		signer, err := ParsePrivateKey(pemBytes)
+		if err != nil {
+			t.Fatalf("%s: ParsePrivateKey: %v", tt.want, err)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), key.PublicKey().Marshal()) {
+			t.Errorf("%s: parsed private key differs", tt.want)
+		}
+		sig, err := signer.Sign(rand.Reader, []byte("data"))
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", tt.want, err)
+		}
+		if err := key.PublicKey().Verify([]byte("data"), sig); err != nil {
+			t.Errorf("%s: Verify: %v", tt.want, err)
+		}
+	}
+}
+
+func TestGenerateKeyBadSizes(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tt := range []struct {
+		keyType string
+		bits    int
+	}{
+		{"rsa", 512},
+		{"ecdsa", 255},
+		{KeyAlgoECDSA256, 384},
+		{"ed25519", 256},
+		{"dsa", 1024},
+	} {
+		if _, err := GenerateKey(tt.keyType, tt.bits); err == nil {
+			t.Errorf("GenerateKey(%q, %d) succeeded", tt.keyType, tt.bits)
+		}
+	}
+}
+
+func TestMarshalPrivateKeyTestKeys(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, name := range []string{"rsa", "ecdsa", "ed25519"} {
+		block, err := MarshalPrivateKey(testPrivateKeys[name], "comment")
+		if err != nil {
+			t.Fatalf("%s: MarshalPrivateKey: %v", name, err)
+		}
+		key, err := parseOpenSSHPrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: parseOpenSSHPrivateKey: %v", name, err)
+		}
+		signer, err := NewSignerFromKey(key)
+		if err != nil {
+			t.Fatalf("%s: NewSignerFromKey: %v", name, err)
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), testPublicKeys[name].Marshal()) {
+			t.Errorf("%s: key differs after a round trip", name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// writeKeyLog writes the secrets of a key exchange to w, in a single
+// Write, so that connections may share w. The first line is in the
+// format of Wireshark's SSH key log file:
+//
+//	<cookie> SHARED_SECRET <secret>
+//
+// where cookie is the random cookie of the client's SSH_MSG_KEXINIT,
+// and secret the shared secret K as a big-endian number, both in hex.
+// For other tools, it is followed by comment lines giving the session
+// ID and, for each direction, the algorithms and the keys derived as
+// in RFC 4253, section 7.2:
+//
+//	# <cookie> SESSION_ID <session id>
+//	# <cookie> CLIENT_ALGORITHMS <cipher> <mac>
+//	# <cookie> CLIENT_IV <iv>
+//	# <cookie> CLIENT_KEY <key>
+//	# <cookie> CLIENT_MAC_KEY <mac key>
+//
+// and the same with SERVER for the server to client direction. The
+// MAC key is empty for AEAD ciphers.
+func writeKeyLog(w io.Writer, clientKexInit []byte, algs *algorithms, result *kexResult, isClient bool) error {
+	if len(clientKexInit) < 17 {
+		return parseError(msgKexInit)
+	}
+	cookie := hex.EncodeToString(clientKexInit[1:17])
+
+	// K is an mpint; Wireshark wants the number alone.
+	secret, _, ok := parseString(result.K)
+	if !ok {
+		return fmt.Errorf("ssh: bad shared secret")
+	}
+	secret = bytes.TrimPrefix(secret, []byte{0})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s SHARED_SECRET %x\n", cookie, secret)
+	fmt.Fprintf(&buf, "# %s SESSION_ID %x\n", cookie, result.SessionID)
+
+	clientAlgs, serverAlgs := algs.w, algs.r
+	if !isClient {
+		clientAlgs, serverAlgs = algs.r, algs.w
+	}
+	for _, d := range []struct {
+		name string
+		dir  direction
+		algs directionAlgorithms
+	}{
+		{"CLIENT", clientKeys, clientAlgs},
+		{"SERVER", serverKeys, serverAlgs},
+	} {
+		iv, key, macKey := generateKeys(d.dir, d.algs, result)
+		fmt.Fprintf(&buf, "# %s %s_ALGORITHMS %s %s\n", cookie, d.name, d.algs.Cipher, d.algs.MAC)
+		fmt.Fprintf(&buf, "# %s %s_IV %x\n", cookie, d.name, iv)
+		fmt.Fprintf(&buf, "# %s %s_KEY %x\n", cookie, d.name, key)
+		fmt.Fprintf(&buf, "# %s %s_MAC_KEY %x\n", cookie, d.name, macKey)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
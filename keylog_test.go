@@ -0,0 +1,84 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestKeyLogWriter(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	var serverLog, clientLog lockedBuffer
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config:       Config{Halt: halt, KeyLogWriter: &serverLog},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := NewServerConn(ctx, c1, serverConf)
+		done <- err
+	}()
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, KeyLogWriter: &clientLog},
+	}
+	if _, _, _, err := NewClientConn(ctx, c2, "", clientConf); err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("NewServerConn: %v", err)
+	}
+
+	got := clientLog.String()
+	if got != serverLog.String() {
+		t.Errorf("client logged\n%s\nserver logged\n%s", got, serverLog.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("got %d lines, want 10:\n%s", len(lines), got)
+	}
+	if ok, _ := regexp.MatchString(`^[0-9a-f]{32} SHARED_SECRET [0-9a-f]+$`, lines[0]); !ok {
+		t.Errorf("first line %q is not a Wireshark key log line", lines[0])
+	}
+	cookie := lines[0][:32]
+	for _, l := range lines[1:] {
+		if !strings.HasPrefix(l, "# "+cookie+" ") {
+			t.Errorf("line %q is not a comment for cookie %s", l, cookie)
+		}
+	}
+}
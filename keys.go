@@ -38,6 +38,14 @@ const (
 	KeyAlgoED25519  = "ssh-ed25519"
 )
 
+// These constants represent the signature algorithms of RSA keys, see
+// RFC 8332. The others have one each, named as the key type.
+const (
+	SigAlgoRSA        = "ssh-rsa"
+	SigAlgoRSASHA2256 = "rsa-sha2-256"
+	SigAlgoRSASHA2512 = "rsa-sha2-512"
+)
+
 // parsePubKey parses a public key of the given algorithm.
 // Use ParsePublicKey for keys with prepended algorithm.
 func parsePubKey(in []byte, algo string) (pubKey PublicKey, rest []byte, err error) {
@@ -300,6 +308,40 @@ type Signer interface {
 	Sign(rand io.Reader, data []byte) (*Signature, error)
 }
 
+// An AlgorithmSigner is a Signer that can sign with an algorithm
+// other than its default, which only RSA keys have; see the SigAlgo
+// constants.
+type AlgorithmSigner interface {
+	Signer
+
+	// SignWithAlgorithm is like Sign, with the signature algorithm
+	// given. An empty algorithm is the default one.
+	SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error)
+}
+
+// A MultiAlgorithmSigner is an AlgorithmSigner that can only sign with
+// some of the algorithms of its key, as a key in a KMS may.
+type MultiAlgorithmSigner interface {
+	AlgorithmSigner
+
+	// Algorithms returns the algorithms it signs with, the default
+	// first.
+	Algorithms() []string
+}
+
+// rsaHash returns the hash of the RSA signature algorithm algo.
+func rsaHash(algo string) (crypto.Hash, bool) {
+	switch algo {
+	case SigAlgoRSA:
+		return crypto.SHA1, true
+	case SigAlgoRSASHA2256:
+		return crypto.SHA256, true
+	case SigAlgoRSASHA2512:
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
 type rsaPublicKey rsa.PublicKey
 
 func (r *rsaPublicKey) Type() string {
@@ -348,13 +390,14 @@ func (r *rsaPublicKey) Marshal() []byte {
 }
 
 func (r *rsaPublicKey) Verify(data []byte, sig *Signature) error {
-	if sig.Format != r.Type() {
+	hash, ok := rsaHash(sig.Format)
+	if !ok {
 		return fmt.Errorf("ssh: signature type %s for key type %s", sig.Format, r.Type())
 	}
-	h := crypto.SHA1.New()
+	h := hash.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), crypto.SHA1, digest, sig.Blob)
+	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), hash, digest, sig.Blob)
 }
 
 func (r *rsaPublicKey) CryptoPublicKey() crypto.PublicKey {
@@ -665,10 +708,22 @@ func (s *wrappedSigner) PublicKey() PublicKey {
 }
 
 func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *wrappedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	if algorithm == "" {
+		algorithm = s.pubKey.Type()
+	}
 	var hashFunc crypto.Hash
 
 	switch key := s.pubKey.(type) {
-	case *rsaPublicKey, *dsaPublicKey:
+	case *rsaPublicKey:
+		var ok bool
+		if hashFunc, ok = rsaHash(algorithm); !ok {
+			return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for key type %s", algorithm, key.Type())
+		}
+	case *dsaPublicKey:
 		hashFunc = crypto.SHA1
 	case *ecdsaPublicKey:
 		hashFunc = ecHash(key.Curve)
@@ -676,6 +731,9 @@ func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %T", key)
 	}
+	if _, ok := s.pubKey.(*rsaPublicKey); !ok && algorithm != s.pubKey.Type() {
+		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for key type %s", algorithm, s.pubKey.Type())
+	}
 
 	var digest []byte
 	if hashFunc != 0 {
@@ -719,7 +777,7 @@ func (s *wrappedSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
 	}
 
 	return &Signature{
-		Format: s.pubKey.Type(),
+		Format: algorithm,
 		Blob:   signature,
 	}, nil
 }
@@ -777,14 +835,15 @@ func encryptedBlock(block *pem.Block) bool {
 }
 
 // ParseRawPrivateKey returns a private key from a PEM encoded private key. It
-// supports RSA (PKCS#1), DSA (OpenSSL), and ECDSA private keys.
+// supports RSA (PKCS#1), DSA (OpenSSL), ECDSA, OpenSSH and PKCS#8 private
+// keys.
 func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, errors.New("ssh: no key found")
 	}
 
-	if encryptedBlock(block) {
+	if encryptedBlock(block) || block.Type == "ENCRYPTED PRIVATE KEY" {
 		return nil, errors.New("ssh: cannot decode encrypted private keys")
 	}
 
@@ -797,14 +856,17 @@ func ParseRawPrivateKey(pemBytes []byte) (interface{}, error) {
 		return ParseDSAPrivateKey(block.Bytes)
 	case "OPENSSH PRIVATE KEY":
 		return parseOpenSSHPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %q", block.Type)
 	}
 }
 
 // ParseRawPrivateKeyWithPassphrase returns a private key decrypted with
-// passphrase from a PEM encoded private key. If wrong passphrase, return
-// x509.IncorrectPasswordError.
+// passphrase from a PEM encoded private key, either encrypted as RFC 1421
+// describes or a PKCS#8 EncryptedPrivateKeyInfo encrypted with PBES2. If
+// wrong passphrase, return x509.IncorrectPasswordError.
 func ParseRawPrivateKeyWithPassphrase(pemBytes, passPhrase []byte) (interface{}, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
@@ -834,6 +896,19 @@ func ParseRawPrivateKeyWithPassphrase(pemBytes, passPhrase []byte) (interface{},
 		return ParseDSAPrivateKey(buf)
 	case "OPENSSH PRIVATE KEY":
 		return parseOpenSSHPrivateKey(buf)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(buf)
+	case "ENCRYPTED PRIVATE KEY":
+		der, err := decryptPKCS8(buf, passPhrase)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			// The padding checked out by chance.
+			return nil, x509.IncorrectPasswordError
+		}
+		return key, nil
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %q", block.Type)
 	}
@@ -875,7 +950,7 @@ func ParseDSAPrivateKey(der []byte) (*dsa.PrivateKey, error) {
 // https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
 func parseOpenSSHPrivateKey(key []byte) (crypto.PrivateKey, error) {
 	magic := append([]byte("openssh-key-v1"), 0)
-	if !bytes.Equal(magic, key[0:len(magic)]) {
+	if len(key) < len(magic) || !bytes.Equal(magic, key[0:len(magic)]) {
 		return nil, errors.New("ssh: invalid openssh private key format")
 	}
 	remaining := key[len(magic):]
@@ -912,7 +987,7 @@ func parseOpenSSHPrivateKey(key []byte) (crypto.PrivateKey, error) {
 		return nil, errors.New("ssh: checkint mismatch")
 	}
 
-	// we only handle ed25519 and rsa keys currently
+	// we only handle ed25519, rsa and ecdsa keys currently
 	switch pk1.Keytype {
 	case KeyAlgoRSA:
 		// https://github.com/openssh/openssh-portable/blob/master/sshkey.c#L2760-L2773
@@ -978,6 +1053,43 @@ func parseOpenSSHPrivateKey(key []byte) (crypto.PrivateKey, error) {
 		pk := ed25519.PrivateKey(make([]byte, ed25519.PrivateKeySize))
 		copy(pk, key.Priv)
 		return &pk, nil
+	case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
+		key := struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}{}
+
+		if err := Unmarshal(pk1.Rest, &key); err != nil {
+			return nil, err
+		}
+
+		for i, b := range key.Pad {
+			if int(b) != i+1 {
+				return nil, errors.New("ssh: padding not as expected")
+			}
+		}
+
+		pub, _, err := parseECDSA(Marshal(&struct {
+			Curve string
+			Pub   []byte
+		}{key.Curve, key.Pub}))
+		if err != nil {
+			return nil, err
+		}
+		pk := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey(*pub.(*ecdsaPublicKey)),
+			D:         key.D,
+		}
+		if pub.Type() != pk1.Keytype {
+			return nil, errors.New("ssh: curve does not match the key type")
+		}
+		if x, y := pk.Curve.ScalarBaseMult(key.D.Bytes()); x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+			return nil, errors.New("ssh: private key does not match its public key")
+		}
+		return pk, nil
 	default:
 		return nil, errors.New("ssh: unhandled key type")
 	}
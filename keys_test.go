@@ -13,6 +13,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"reflect"
 	"strings"
@@ -184,6 +185,35 @@ func TestParseEncryptedPrivateKeysWithPassphrase(t *testing.T) {
 	}
 }
 
+func TestParsePKCS8PrivateKeys(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+	for _, tt := range testdata.PEMEncryptedKeys[2:] {
+		s, err := ParsePrivateKeyWithPassphrase(tt.PEMBytes, []byte(tt.EncryptionKey))
+		if err != nil {
+			t.Fatalf("%s: ParsePrivateKeyWithPassphrase: %v", tt.Name, err)
+		}
+		name := strings.SplitN(tt.Name, "-", 2)[0]
+		if !bytes.Equal(s.PublicKey().Marshal(), testPublicKeys[name].Marshal()) {
+			t.Errorf("%s: got a key other than %q", tt.Name, name)
+		}
+		if _, err := ParsePrivateKeyWithPassphrase(tt.PEMBytes, []byte("incorrect")); err != x509.IncorrectPasswordError {
+			t.Errorf("%s: got %v want IncorrectPasswordError", tt.Name, err)
+		}
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(testPrivateKeys["ecdsa"])
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	s, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParsePrivateKey of PKCS#8 key: %v", err)
+	}
+	if !bytes.Equal(s.PublicKey().Marshal(), testPublicKeys["ecdsa"].Marshal()) {
+		t.Error("PKCS#8 key differs from the original")
+	}
+}
+
 func TestParseDSA(t *testing.T) {
 	defer xtestend(xtestbegin(t))
 	// We actually exercise the ParsePrivateKey codepath here, as opposed to
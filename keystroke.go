@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// After the last keystroke, chaff goes on for chaffMin and a random
+// part of chaffRange more, as in OpenSSH, so that the end of the
+// chaff does not tell when typing stopped.
+const (
+	chaffMin   = 1024 * time.Millisecond
+	chaffRange = 2048 * time.Millisecond
+)
+
+// maxKeystrokeBuffer is what a keystrokeObscurer holds back at most.
+// Past it, the writes are bulk data, such as a paste, and go out
+// right away.
+const maxKeystrokeBuffer = 4096
+
+// keystrokeObscurer is the stdin of a Session with
+// ObscureKeystrokeTiming set. It sends what is written to it only on
+// the ticks of a fixed interval, and chaff on the ticks in between,
+// so that an observer of the connection sees packets at an even pace
+// while the user types, as with OpenSSH's ObscureKeystrokeTiming.
+type keystrokeObscurer struct {
+	w        io.Writer
+	chaff    func() error
+	enabled  func() bool
+	interval time.Duration
+	clock    Clock
+
+	// mu is held while writing to w, so that Write blocks while
+	// the remote window is full.
+	mu         sync.Mutex
+	buf        []byte
+	err        error
+	running    bool
+	closed     bool
+	chaffUntil time.Time
+	done       chan struct{}
+}
+
+func newKeystrokeObscurer(w io.Writer, chaff func() error, enabled func() bool, interval time.Duration, clock Clock) *keystrokeObscurer {
+	return &keystrokeObscurer{
+		w:        w,
+		chaff:    chaff,
+		enabled:  enabled,
+		interval: interval,
+		clock:    clock,
+		done:     make(chan struct{}),
+	}
+}
+
+func (k *keystrokeObscurer) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err != nil {
+		return 0, k.err
+	}
+	if k.closed {
+		return 0, errors.New("ssh: write to closed stdin")
+	}
+	if !k.enabled() || len(k.buf)+len(p) > maxKeystrokeBuffer {
+		if err := k.flush(); err != nil {
+			return 0, err
+		}
+		return k.w.Write(p)
+	}
+	k.buf = append(k.buf, p...)
+	k.chaffUntil = k.clock.Now().Add(chaffMin + time.Duration(rand.Int63n(int64(chaffRange))))
+	if !k.running {
+		k.running = true
+		go k.loop()
+	}
+	return len(p), nil
+}
+
+// flush writes out what k holds back. k.mu must be held.
+func (k *keystrokeObscurer) flush() error {
+	if len(k.buf) == 0 {
+		return nil
+	}
+	_, err := k.w.Write(k.buf)
+	k.buf = k.buf[:0]
+	if err != nil {
+		k.err = err
+	}
+	return err
+}
+
+// loop sends the keystrokes or chaff on each tick, until the chaff
+// period after the last keystroke is over.
+func (k *keystrokeObscurer) loop() {
+	ticker := k.clock.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-k.done:
+			return
+		}
+		if !k.tick() {
+			return
+		}
+	}
+}
+
+func (k *keystrokeObscurer) tick() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.err != nil || k.closed {
+		k.running = false
+		return false
+	}
+	if len(k.buf) > 0 {
+		if k.flush() != nil {
+			k.running = false
+			return false
+		}
+		return true
+	}
+	if !k.clock.Now().Before(k.chaffUntil) {
+		k.running = false
+		return false
+	}
+	if err := k.chaff(); err != nil {
+		k.err = err
+		k.running = false
+		return false
+	}
+	return true
+}
+
+// Close sends what k holds back right away, and stops the chaff.
+func (k *keystrokeObscurer) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return nil
+	}
+	k.closed = true
+	close(k.done)
+	if k.err != nil {
+		return k.err
+	}
+	return k.flush()
+}
+
+// keystrokes returns the obscurer for the stdin of s, writing to w,
+// or nil if ObscureKeystrokeTiming is not set.
+func (s *Session) keystrokes(w io.Writer) *keystrokeObscurer {
+	if s.ObscureKeystrokeTiming <= 0 {
+		return nil
+	}
+	chaff := func() error { return nil }
+	if ch, ok := s.ch.(*channel); ok {
+		chaff = func() error {
+			// An SSH_MSG_IGNORE the size of a channel data
+			// message with one byte in it.
+			return ch.mux.conn.writePacket([]byte{msgIgnore, 0, 0, 0, 5, 0, 0, 0, 0, 0})
+		}
+	}
+	enabled := func() bool {
+		return atomic.LoadInt32(&s.pty) != 0
+	}
+	return newKeystrokeObscurer(w, chaff, enabled, s.ObscureKeystrokeTiming, realClock{})
+}
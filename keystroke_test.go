@@ -0,0 +1,156 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// chanWriter sends each write to a channel.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestKeystrokeObscurer(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Now())
+	writes := make(chanWriter, 100)
+	chaff := make(chan bool, 100)
+	interval := 20 * time.Millisecond
+	k := newKeystrokeObscurer(writes, func() error {
+		chaff <- true
+		return nil
+	}, func() bool { return true }, interval, clock)
+
+	k.Write([]byte("p"))
+	k.Write([]byte("w"))
+	clock.BlockUntil(1)
+	select {
+	case w := <-writes:
+		t.Fatalf("wrote %q before the tick", w)
+	default:
+	}
+	clock.Advance(interval)
+	if w := <-writes; w != "pw" {
+		t.Fatalf("wrote %q on the tick, want %q", w, "pw")
+	}
+
+	// Chaff goes on for 1 to 3 seconds after the last keystroke,
+	// and then stops.
+	n := 0
+	for ; n < 1000; n++ {
+		clock.Advance(interval)
+		select {
+		case <-chaff:
+			continue
+		case w := <-writes:
+			t.Fatalf("wrote %q without keystrokes", w)
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	if lo, hi := int(chaffMin/interval)-1, int((chaffMin+chaffRange)/interval); n < lo || n > hi {
+		t.Errorf("sent chaff on %d ticks, want %d to %d", n, lo, hi)
+	}
+
+	// Typing again starts the ticks again; Close sends what is
+	// held back right away.
+	k.Write([]byte("x"))
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if w := <-writes; w != "x" {
+		t.Fatalf("Close wrote %q, want %q", w, "x")
+	}
+	if _, err := k.Write([]byte("y")); err == nil {
+		t.Error("Write after Close succeeded")
+	}
+
+	// Bulk writes go out right away.
+	k = newKeystrokeObscurer(writes, func() error { return nil }, func() bool { return true }, interval, clock)
+	defer k.Close()
+	big := make([]byte, maxKeystrokeBuffer+1)
+	k.Write([]byte("a"))
+	k.Write(big)
+	if w := <-writes; w != "a" {
+		t.Fatalf("wrote %q first, want the held back %q", w, "a")
+	}
+	if w := <-writes; len(w) != len(big) {
+		t.Fatalf("wrote %d bytes, want %d", len(w), len(big))
+	}
+}
+
+// ptyEchoHandler accepts "pty-req" and "shell", and copies stdin to
+// stdout.
+func ptyEchoHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		req.Reply(true, nil)
+		if req.Type == "shell" {
+			break
+		}
+	}
+	go DiscardRequests(context.Background(), in, nil)
+	io.Copy(ch, ch)
+	sendStatus(0, ch, t)
+}
+
+func TestSessionObscureKeystrokeTiming(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	conn := dial(ptyEchoHandler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	session.ObscureKeystrokeTiming = 5 * time.Millisecond
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+
+	want := "secret\n"
+	for i := range want {
+		if _, err := stdin.Write([]byte(want[i : i+1])); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	// Let some chaff go out.
+	time.Sleep(50 * time.Millisecond)
+	if err := stdin.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	got, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("echoed %q, want %q", got, want)
+	}
+	if err := session.Wait(); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+}
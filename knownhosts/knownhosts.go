@@ -152,6 +152,10 @@ func (db *hostKeyDB) IsHostAuthority(remote ssh.PublicKey, address string) bool
 	}
 	a := addr{host: h, port: p}
 
+	if db.revoked[string(remote.Marshal())] != nil {
+		return false
+	}
+
 	for _, l := range db.lines {
 		if l.cert && keyEq(l.knownKey.Key, remote) && l.match([]addr{a}) {
 			return true
@@ -160,10 +164,25 @@ func (db *hostKeyDB) IsHostAuthority(remote ssh.PublicKey, address string) bool
 	return false
 }
 
-// IsRevoked can be used as a callback in ssh.CertChecker
+// IsRevoked can be used as a callback in ssh.CertChecker. A
+// certificate is revoked if it, the key it certifies, or the
+// authority that signed it is marked @revoked.
 func (db *hostKeyDB) IsRevoked(key *ssh.Certificate) bool {
-	_, ok := db.revoked[string(key.Marshal())]
-	return ok
+	return db.revokedKey(key) != nil
+}
+
+// revokedKey returns the @revoked entry that applies to key, or nil.
+func (db *hostKeyDB) revokedKey(key ssh.PublicKey) *KnownKey {
+	if k := db.revoked[string(key.Marshal())]; k != nil {
+		return k
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if k := db.revoked[string(cert.Key.Marshal())]; k != nil {
+			return k
+		}
+		return db.revoked[string(cert.SignatureKey.Marshal())]
+	}
+	return nil
 }
 
 const markerCert = "@cert-authority"
@@ -329,7 +348,7 @@ func (r *RevokedError) Error() string {
 // check checks a key against the host database. This should not be
 // used for verifying certificates.
 func (db *hostKeyDB) check(address string, remote net.Addr, remoteKey ssh.PublicKey) error {
-	if revoked := db.revoked[string(remoteKey.Marshal())]; revoked != nil {
+	if revoked := db.revokedKey(remoteKey); revoked != nil {
 		return &RevokedError{Revoked: *revoked}
 	}
 
@@ -365,7 +384,9 @@ func (db *hostKeyDB) checkAddrs(addrs []addr, remoteKey ssh.PublicKey) error {
 	// Algorithm => key.
 	knownKeys := map[string]KnownKey{}
 	for _, l := range db.lines {
-		if l.match(addrs) {
+		// @cert-authority keys only vouch for certificates,
+		// they are not host keys themselves.
+		if !l.cert && l.match(addrs) {
 			typ := l.knownKey.Key.Type()
 			if _, ok := knownKeys[typ]; !ok {
 				knownKeys[typ] = l.knownKey
@@ -414,7 +435,13 @@ func (db *hostKeyDB) Read(r io.Reader, filename string) error {
 
 // New creates a host key callback from the given OpenSSH host key
 // files. The returned callback is for use in
-// ssh.ClientConfig.HostKeyCallback. Hashed hostnames are not supported.
+// ssh.ClientConfig.HostKeyCallback.
+//
+// As in OpenSSH, a key marked @revoked is refused with a
+// *RevokedError, whether it is presented as a plain host key, is
+// the key of a host certificate, or signed one. Host certificates
+// are accepted if signed by a key listed as @cert-authority for the
+// host.
 func New(files ...string) (ssh.HostKeyCallback, error) {
 	db := newHostKeyDB()
 	for _, fn := range files {
@@ -433,7 +460,12 @@ func New(files ...string) (ssh.HostKeyCallback, error) {
 	certChecker.IsRevoked = db.IsRevoked
 	certChecker.HostKeyFallback = db.check
 
-	return certChecker.CheckHostKey, nil
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if revoked := db.revokedKey(key); revoked != nil {
+			return &RevokedError{Revoked: *revoked}
+		}
+		return certChecker.CheckHostKey(hostname, remote, key)
+	}, nil
 }
 
 // Normalize normalizes an address into the form used in known_hosts
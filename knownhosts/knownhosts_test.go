@@ -6,9 +6,17 @@ package knownhosts
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/glycerine/xcryptossh"
@@ -327,3 +335,169 @@ func TestHashedHostkeyCheck(t *testing.T) {
 		t.Errorf("got error %v, want %v", got, want)
 	}
 }
+
+func TestHashedLines(t *testing.T) {
+	lines := HashedLines([]string{"server.org:22", "[c629:1ec4:102:304:102:304:102:304]:23"}, edKey)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	db := testDB(t, strings.Join(lines, "\n"))
+	if err := db.check("server.org:22", testAddr, edKey); err != nil {
+		t.Errorf("check(server.org): %v", err)
+	}
+	if err := db.check("[c629:1ec4:102:304:102:304:102:304]:23", testAddr6, edKey); err != nil {
+		t.Errorf("check(ipv6): %v", err)
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "server.org") || strings.Contains(l, "c629") {
+			t.Errorf("hostname in the clear: %q", l)
+		}
+	}
+}
+
+func TestWriteKnownHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "known_hosts")
+
+	// no trailing newline, which must not glue lines together.
+	if err := ioutil.WriteFile(fn, []byte("# comment"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKnownHost(fn, []string{"server.org", "alias.org:2222"}, edKey, false); err != nil {
+		t.Fatalf("WriteKnownHost: %v", err)
+	}
+	if err := WriteKnownHost(fn, []string{"hashed.org"}, ecKey, true); err != nil {
+		t.Fatalf("WriteKnownHost(hashed): %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 || lines[1] != "server.org,[alias.org]:2222 "+edKeyStr || !strings.HasPrefix(lines[2], "|1|") {
+		t.Errorf("got contents %q", data)
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("mode not preserved: %v, %v", fi.Mode(), err)
+	}
+	if _, err := os.Stat(fn + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+
+	db := testDB(t, string(data))
+	for _, c := range []struct {
+		addr string
+		key  ssh.PublicKey
+	}{{"server.org:22", edKey}, {"alias.org:2222", edKey}, {"hashed.org:22", ecKey}} {
+		if err := db.check(c.addr, testAddr, c.key); err != nil {
+			t.Errorf("check(%s): %v", c.addr, err)
+		}
+	}
+}
+
+func TestWriteKnownHostConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "known_hosts")
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := WriteKnownHost(fn, []string{fmt.Sprintf("host%d", i)}, edKey, false); err != nil {
+				t.Errorf("WriteKnownHost: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, %v, want 0600", fi.Mode(), err)
+	}
+	db := testDB(t, string(data))
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("host%d:22", i)
+		if err := db.check(addr, testAddr, edKey); err != nil {
+			t.Errorf("check(%s): %v", addr, err)
+		}
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ssh.NewSignerFromKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCertAuthorityAndRevoked(t *testing.T) {
+	ca, host, other := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	cert := &ssh.Certificate{
+		Key:             host.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"host.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	caLine := "@cert-authority *.example.com " + serialize(ca.PublicKey())
+
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		desc    string
+		db      string
+		addr    string
+		key     ssh.PublicKey
+		good    bool
+		revoked bool
+	}{
+		{"cert from CA", caLine, "host.example.com:22", cert, true, false},
+		{"cert for other host", caLine, "host.example.org:22", cert, false, false},
+		{"CA key as host key", caLine, "host.example.com:22", ca.PublicKey(), false, false},
+		{"CA revoked", caLine + "\n@revoked * " + serialize(ca.PublicKey()), "host.example.com:22", cert, false, true},
+		{"certified key revoked", caLine + "\n@revoked * " + serialize(host.PublicKey()), "host.example.com:22", cert, false, true},
+		{"plain key revoked", "host.example.com " + serialize(other.PublicKey()) + "\n@revoked * " + serialize(other.PublicKey()), "host.example.com:22", other.PublicKey(), false, true},
+		{"unrelated revocation", caLine + "\n@revoked * " + serialize(other.PublicKey()), "host.example.com:22", cert, true, false},
+	} {
+		fn := filepath.Join(dir, "known_hosts")
+		if err := ioutil.WriteFile(fn, []byte(c.db+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cb, err := New(fn)
+		if err != nil {
+			t.Fatalf("%s: New: %v", c.desc, err)
+		}
+		err = cb(c.addr, testAddr, c.key)
+		if c.good != (err == nil) {
+			t.Errorf("%s: got error %v, want good = %v", c.desc, err, c.good)
+		}
+		if _, ok := err.(*RevokedError); ok != c.revoked {
+			t.Errorf("%s: got error %#v, want RevokedError = %v", c.desc, err, c.revoked)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package knownhosts
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// HashedLines returns the lines to append to a known_hosts file for
+// key, with each address hashed as by HashHostname. OpenSSH only
+// matches a single name per hashed entry, so there is one line per
+// address.
+func HashedLines(addresses []string, key ssh.PublicKey) []string {
+	var lines []string
+	for _, a := range addresses {
+		lines = append(lines, HashHostname(Normalize(a))+" "+serialize(key))
+	}
+	return lines
+}
+
+// ErrLocked is returned by WriteKnownHost if the lock on the
+// known_hosts file could not be taken in time.
+var ErrLocked = errors.New("knownhosts: timed out waiting for file lock")
+
+const (
+	lockRetry   = 10 * time.Millisecond
+	lockTimeout = 10 * time.Second
+
+	// A lock file older than staleLock was left behind by a
+	// crashed writer, and is removed.
+	staleLock = time.Minute
+)
+
+// WriteKnownHost appends an entry for key and addresses to the
+// known_hosts file filename, creating it with mode 0600 if needed.
+// If hash is set, the addresses are hashed, see HashedLines;
+// otherwise a single line lists them all, see Line.
+//
+// Concurrent writers are serialized with a filename.lock file, and
+// the new contents are written to a temporary file that is renamed
+// over filename, so readers never see a partial entry. If filename
+// is a symlink, its target is updated.
+func WriteKnownHost(filename string, addresses []string, key ssh.PublicKey, hash bool) error {
+	if p, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = p
+	}
+
+	lines := []string{Line(addresses, key)}
+	if hash {
+		lines = HashedLines(addresses, key)
+	}
+
+	unlock, err := lockFile(filename + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mode := os.FileMode(0600)
+	old, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if fi, err := os.Stat(filename); err == nil {
+			mode = fi.Mode().Perm()
+		}
+		if len(old) > 0 && old[len(old)-1] != '\n' {
+			old = append(old, '\n')
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	contents := append(old, strings.Join(lines, "\n")+"\n"...)
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// lockFile takes the lock file name, and returns a function to
+// release it.
+func lockFile(name string) (unlock func(), err error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(name) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > staleLock {
+			os.Remove(name)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(lockRetry)
+	}
+}
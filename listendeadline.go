@@ -0,0 +1,108 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ForwardListener is the net.Listener of Client.Listen,
+// Client.ListenTCP and Client.ListenUnix. Servers built over remote
+// forwards can use it for their own accept timeouts and shutdown.
+type ForwardListener interface {
+	net.Listener
+
+	// SetDeadline sets the deadline of Accept and AcceptContext,
+	// as net.TCPListener.SetDeadline does: past it, they fail with
+	// os.ErrDeadlineExceeded. It applies to calls already blocked
+	// too. A zero t means no deadline.
+	SetDeadline(t time.Time) error
+
+	// AcceptContext is Accept, that fails with ctx.Err() once ctx
+	// is done.
+	AcceptContext(ctx context.Context) (net.Conn, error)
+}
+
+// acceptDeadline is the deadline of a ForwardListener. Its channel
+// is closed once the deadline passes.
+type acceptDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	passed chan struct{}
+}
+
+func newAcceptDeadline() *acceptDeadline {
+	return &acceptDeadline{passed: make(chan struct{})}
+}
+
+// set sets the deadline to t, or none if t is zero.
+func (d *acceptDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired and closed passed.
+		<-d.passed
+	}
+	d.timer = nil
+	closed := false
+	select {
+	case <-d.passed:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		passed := d.passed
+		d.timer = time.AfterFunc(dur, func() { close(passed) })
+		return
+	}
+	if !closed {
+		close(d.passed)
+	}
+}
+
+// wait returns a channel that is closed once the deadline passes.
+func (d *acceptDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
+
+// acceptForward waits for the next connection on in, until client is
+// lost, or listen, the ctx of the listener, or ctx is done, or the
+// deadline passes, and accepts its channel.
+func acceptForward(ctx, listen context.Context, client *Client, in <-chan forward, deadline *acceptDeadline) (*forward, Channel, error) {
+	var s forward
+	var ok bool
+	select {
+	case <-client.Done():
+		return nil, nil, io.EOF
+	case <-listen.Done():
+		return nil, nil, io.EOF
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-deadline.wait():
+		return nil, nil, os.ErrDeadlineExceeded
+	case s, ok = <-in:
+		if !ok {
+			return nil, nil, io.EOF
+		}
+	}
+	ch, incoming, err := s.newCh.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	go DiscardRequests(listen, incoming, client.Halt)
+	return &s, ch, nil
+}
@@ -0,0 +1,378 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ForwardSpec is an end of a LocalForward.
+type ForwardSpec struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix"; if empty, it is
+	// "tcp". For the local end it may also be "fd", for a
+	// listening socket passed by a parent process, with Addr its
+	// descriptor number.
+	Network string
+
+	// Addr is the "host:port" or socket path.
+	Addr string
+
+	// Listener, if non-nil, is the listener of the local end, such
+	// as one from ActivationListeners, and Network and Addr are
+	// ignored. It is ignored for the remote end.
+	Listener net.Listener
+
+	// MaxConns, if positive, limits the connections of the local
+	// end that are tunneled at once. When that many are, the next
+	// one accepted is closed at once, unless QueueConns is set; then
+	// it waits for another to end, and no more are accepted until
+	// it does, so the rest queue in the backlog of the listener.
+	// Both are ignored for the remote end.
+	MaxConns   int
+	QueueConns bool
+}
+
+// connLimit bounds the connections that a forward handles at once.
+// A nil *connLimit does not.
+type connLimit struct {
+	slots chan struct{}
+	queue bool
+}
+
+func newConnLimit(max int, queue bool) *connLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimit{slots: make(chan struct{}, max), queue: queue}
+}
+
+// acquire takes a slot for a connection. It returns false if there
+// is none free, and l does not queue, or if stop is closed while it
+// waits for one.
+func (l *connLimit) acquire(stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	if !l.queue {
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// release frees the slot of a connection that ended.
+func (l *connLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// listen opens the listener of the local end s.
+func (s ForwardSpec) listen() (net.Listener, error) {
+	if s.Listener != nil {
+		return s.Listener, nil
+	}
+	switch s.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		network := s.Network
+		if network == "" {
+			network = "tcp"
+		}
+		return net.Listen(network, s.Addr)
+	case "unix":
+		return net.Listen("unix", s.Addr)
+	case "fd":
+		fd, err := strconv.Atoi(s.Addr)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("ssh: bad descriptor %q", s.Addr)
+		}
+		// FileListener dups the descriptor, so the original can go.
+		f := os.NewFile(uintptr(fd), "fd"+s.Addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		return l, err
+	default:
+		return nil, fmt.Errorf("ssh: unsupported protocol: %s", s.Network)
+	}
+}
+
+// LocalForwardStats counts the connections of a LocalForwarder.
+type LocalForwardStats struct {
+	// Active is the number of connections being tunneled.
+	Active int64
+
+	// Accepted counts the connections accepted, Failed those of
+	// them for which the remote end could not be dialed, and
+	// Rejected those closed for ForwardSpec.MaxConns.
+	Accepted int64
+	Failed   int64
+	Rejected int64
+
+	// BytesOut counts the bytes sent from the local connections
+	// to the remote end, and BytesIn those sent back.
+	BytesOut int64
+	BytesIn  int64
+}
+
+// LocalForwarder tunnels the connections to a local listener through
+// a Client to a remote address, as ssh -L does. Make one with
+// Client.LocalForward.
+type LocalForwarder struct {
+	stats LocalForwardStats // first, for the alignment of atomics
+
+	client  *Client
+	remote  ForwardSpec
+	l       net.Listener
+	limit   *connLimit
+	metrics MetricsSink
+
+	// goroutines counts the goroutines of the forwarder with
+	// those of the connection of client.
+	goroutines *goroutineLedger
+
+	mu         sync.Mutex
+	listenHalt *Halter // stops the accept loop
+	connHalt   *Halter // stops the tunnels
+	conns      sync.WaitGroup
+	done       chan struct{}
+	err        error
+}
+
+// LocalForward listens on local, and tunnels each connection
+// accepted to remote through c, each on goroutines of its own, until
+// ctx is done, Close or Shutdown is called, or c is closed. The
+// remote end is dialed with DialWithContext, so that
+// ClientConfig.DialPolicy and ChannelOpenRetry apply; a connection
+// whose remote end cannot be dialed is closed. The listener is closed
+// when the forwarder stops, which removes the socket of a "unix"
+// local end.
+//
+// The forwarder has a Halter of its own, downstream of c.Halt, so
+// that stopping c stops it. If c has a Config.Metrics, it is sent
+// MetricForwardedConns and MetricForwardedConnsOpen.
+func (c *Client) LocalForward(ctx context.Context, local, remote ForwardSpec) (*LocalForwarder, error) {
+	switch remote.Network {
+	case "":
+		remote.Network = "tcp"
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("ssh: unsupported protocol: %s", remote.Network)
+	}
+	l, err := local.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &LocalForwarder{
+		client:     c,
+		remote:     remote,
+		l:          l,
+		limit:      newConnLimit(local.MaxConns, local.QueueConns),
+		listenHalt: NewHalter(),
+		connHalt:   NewHalter(),
+		done:       make(chan struct{}),
+	}
+	if conn, ok := c.Conn.(*connection); ok && conn.clicfg != nil {
+		f.metrics = conn.clicfg.Metrics
+		f.goroutines = conn.cfg.goroutines
+	}
+	f.connHalt.AddDownstream(f.listenHalt)
+	if c.Halt != nil {
+		c.Halt.AddDownstream(f.connHalt)
+		if c.Halt.IsStopRequested() {
+			f.connHalt.RequestStop()
+		}
+	}
+	f.goroutines.spawn("local forward", func() { f.run(ctx) })
+	return f, nil
+}
+
+// run accepts connections until the forwarder stops, and then waits
+// for the tunnels to end.
+func (f *LocalForwarder) run(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-f.client.Done():
+			f.Close()
+		case <-stopped:
+		}
+	}()
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-f.listenHalt.ReqStopChan():
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		close(stop)
+	}()
+	err := acceptLoop(ctx, f.l, f.listenHalt.ReqStopChan(), func(nConn net.Conn) {
+		atomic.AddInt64(&f.stats.Accepted, 1)
+		if !f.limit.acquire(stop) {
+			atomic.AddInt64(&f.stats.Rejected, 1)
+			if f.metrics != nil {
+				f.metrics.Counter(MetricForwardedConns, 1, labelsResultRejected...)
+			}
+			nConn.Close()
+			return
+		}
+		// Shutdown may be waiting already.
+		f.mu.Lock()
+		if f.listenHalt.IsStopRequested() {
+			f.mu.Unlock()
+			f.limit.release()
+			nConn.Close()
+			return
+		}
+		f.conns.Add(1)
+		f.mu.Unlock()
+		f.goroutines.spawn("local forward tunnel", func() {
+			defer f.conns.Done()
+			defer f.limit.release()
+			f.tunnel(ctx, nConn)
+		})
+	})
+	close(stopped)
+	f.mu.Lock()
+	f.listenHalt.RequestStop()
+	f.mu.Unlock()
+	f.conns.Wait()
+
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	f.err = err
+	if f.client.Halt != nil {
+		f.client.Halt.RemoveDownstream(f.connHalt)
+	}
+	f.listenHalt.MarkDone()
+	f.connHalt.MarkDone()
+	close(f.done)
+}
+
+// tunnel dials the remote end for local, and copies between them
+// until both directions reach EOF, or the forwarder is closed.
+func (f *LocalForwarder) tunnel(ctx context.Context, local net.Conn) {
+	remote, err := f.client.DialWithContext(ctx, f.remote.Network, f.remote.Addr)
+	if err != nil {
+		atomic.AddInt64(&f.stats.Failed, 1)
+		if f.metrics != nil {
+			f.metrics.Counter(MetricForwardedConns, 1, labelsResultError...)
+		}
+		local.Close()
+		return
+	}
+	atomic.AddInt64(&f.stats.Active, 1)
+	if f.metrics != nil {
+		f.metrics.Counter(MetricForwardedConns, 1, labelsResultOK...)
+		f.metrics.Gauge(MetricForwardedConnsOpen, 1)
+	}
+	defer func() {
+		atomic.AddInt64(&f.stats.Active, -1)
+		if f.metrics != nil {
+			f.metrics.Gauge(MetricForwardedConnsOpen, -1)
+		}
+	}()
+
+	copied := make(chan struct{})
+	go func() {
+		select {
+		case <-f.connHalt.ReqStopChan():
+		case <-ctx.Done():
+		case <-copied:
+		}
+		local.Close()
+		remote.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(remote, countingReader{local, &f.stats.BytesOut})
+		remote.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(local, countingReader{remote, &f.stats.BytesIn})
+		if cw, ok := local.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			local.Close()
+		}
+	}()
+	wg.Wait()
+	close(copied)
+}
+
+// Addr returns the address of the local listener.
+func (f *LocalForwarder) Addr() net.Addr {
+	return f.l.Addr()
+}
+
+// Stats returns the counts of the forwarder so far.
+func (f *LocalForwarder) Stats() LocalForwardStats {
+	return LocalForwardStats{
+		Active:   atomic.LoadInt64(&f.stats.Active),
+		Accepted: atomic.LoadInt64(&f.stats.Accepted),
+		Failed:   atomic.LoadInt64(&f.stats.Failed),
+		Rejected: atomic.LoadInt64(&f.stats.Rejected),
+		BytesOut: atomic.LoadInt64(&f.stats.BytesOut),
+		BytesIn:  atomic.LoadInt64(&f.stats.BytesIn),
+	}
+}
+
+// Done returns a channel that is closed once the forwarder has
+// stopped accepting, and its tunnels have ended.
+func (f *LocalForwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait waits for Done, and returns the error that stopped the
+// forwarder: nil after Close or Shutdown, ctx.Err() once the ctx of
+// LocalForward is done, or the error of Accept.
+func (f *LocalForwarder) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// Shutdown stops accepting connections, and waits for the tunnels
+// to end. If ctx is done first, Shutdown closes them, as Close does,
+// and returns ctx.Err().
+func (f *LocalForwarder) Shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	f.listenHalt.RequestStop()
+	f.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		f.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections, and closes the tunnels.
+func (f *LocalForwarder) Close() error {
+	f.mu.Lock()
+	f.connHalt.RequestStop()
+	f.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,212 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// forwardPair starts an echo server, and an SSH server that dials
+// out for "direct-tcpip", and returns a client of the SSH server, and
+// the address of the echo server.
+func forwardPair(t *testing.T) (client *Client, echoAddr string, cleanup func()) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		echo.Close()
+		t.Skipf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	go ServeListener(ctx, l, config, (&forwardingServer{}).serve)
+
+	client, err = Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		echo.Close()
+		config.Halt.RequestStop()
+		t.Fatalf("Dial: %v", err)
+	}
+	return client, echo.Addr().String(), func() {
+		client.Close()
+		config.Halt.RequestStop()
+		echo.Close()
+	}
+}
+
+// echoThrough sends s through c, and returns what comes back.
+func echoThrough(c net.Conn, s string) string {
+	io.WriteString(c, s)
+	got := make([]byte, len(s))
+	n, _ := io.ReadFull(c, got)
+	return string(got[:n])
+}
+
+func TestLocalForward(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	client, echoAddr, cleanup := forwardPair(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "localforward")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "sock")
+
+	// A listener passed by descriptor.
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	file, err := passed.(*net.TCPListener).File()
+	passed.Close()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer file.Close()
+
+	for _, local := range []ForwardSpec{
+		{Network: "tcp", Addr: "127.0.0.1:0"},
+		{Network: "unix", Addr: socket},
+		{Network: "fd", Addr: strconv.Itoa(int(file.Fd()))},
+	} {
+		f, err := client.LocalForward(ctx, local, ForwardSpec{Addr: echoAddr})
+		if err != nil {
+			t.Fatalf("LocalForward(%s): %v", local.Network, err)
+		}
+		c, err := net.Dial(f.Addr().Network(), f.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: Dial: %v", local.Network, err)
+		}
+		got := echoThrough(c, "ping")
+		c.Close()
+		if got != "ping" {
+			t.Errorf("%s: read %q through the forward, want ping", local.Network, got)
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := f.Shutdown(sctx); err != nil {
+			t.Errorf("%s: Shutdown: %v", local.Network, err)
+		}
+		cancel()
+		if err := f.Wait(); err != nil {
+			t.Errorf("%s: Wait: %v", local.Network, err)
+		}
+		if s := f.Stats(); s.Accepted != 1 || s.Failed != 0 || s.Active != 0 || s.BytesOut != 4 || s.BytesIn != 4 {
+			t.Errorf("%s: Stats = %+v", local.Network, s)
+		}
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+
+	// A remote end that cannot be dialed closes the connection.
+	f, err := client.LocalForward(ctx, ForwardSpec{Addr: "127.0.0.1:0"}, ForwardSpec{Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("LocalForward: %v", err)
+	}
+	c, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if got, _ := ioutil.ReadAll(c); len(got) != 0 {
+		t.Errorf("read %q from a failed forward", got)
+	}
+	c.Close()
+	if s := f.Stats(); s.Accepted != 1 || s.Failed != 1 {
+		t.Errorf("Stats = %+v, want a failure", s)
+	}
+
+	// Closing the client stops the forwarder.
+	client.Close()
+	select {
+	case <-f.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the forwarder did not stop with the client")
+	}
+}
+
+func TestLocalForwardMaxConns(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	client, echoAddr, cleanup := forwardPair(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, queue := range []bool{false, true} {
+		f, err := client.LocalForward(ctx,
+			ForwardSpec{Addr: "127.0.0.1:0", MaxConns: 1, QueueConns: queue},
+			ForwardSpec{Addr: echoAddr})
+		if err != nil {
+			t.Fatalf("LocalForward: %v", err)
+		}
+		first, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if got := echoThrough(first, "one"); got != "one" {
+			t.Fatalf("queue %v: read %q through the first connection", queue, got)
+		}
+
+		second, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if !queue {
+			if got, _ := ioutil.ReadAll(second); len(got) != 0 {
+				t.Errorf("read %q from a connection past the limit", got)
+			}
+			if s := f.Stats(); s.Rejected != 1 {
+				t.Errorf("Stats = %+v, want a rejection", s)
+			}
+		} else {
+			io.WriteString(second, "two")
+			second.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			if n, err := second.Read(make([]byte, 3)); err == nil {
+				t.Errorf("read %d bytes from a queued connection", n)
+			}
+			first.Close()
+			second.SetReadDeadline(time.Time{})
+			got := make([]byte, 3)
+			if _, err := io.ReadFull(second, got); err != nil || string(got) != "two" {
+				t.Errorf("read %q (%v) once the queued connection was let in", got, err)
+			}
+			if s := f.Stats(); s.Rejected != 0 {
+				t.Errorf("Stats = %+v, want no rejections", s)
+			}
+		}
+		first.Close()
+		second.Close()
+		f.Close()
+		f.Wait()
+	}
+}
@@ -0,0 +1,204 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// LZ4Compression is the codec of CompressionLZ4. Add it to
+// Config.Compressions of both ends to compress packets with it:
+//
+//	config.Compressions = []Compression{LZ4Compression{}}
+//
+// It writes standard LZ4 blocks, found by a greedy single-pass
+// search, which trades ratio for speed, as the LZ4 fast mode does.
+type LZ4Compression struct{}
+
+// Name implements Compression.
+func (LZ4Compression) Name() string { return CompressionLZ4 }
+
+// Compress implements Compression.
+func (LZ4Compression) Compress(dst, src []byte) ([]byte, error) {
+	dst = appendU32(dst, uint32(len(src)))
+	table := lz4Tables.Get().(*lz4Table)
+	dst = lz4CompressBlock(dst, src, table)
+	lz4Tables.Put(table)
+	return dst, nil
+}
+
+// Decompress implements Compression.
+func (LZ4Compression) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	size, src, ok := parseUint32(src)
+	if !ok {
+		return nil, errLZ4Corrupt
+	}
+	if int64(size) > int64(limit) {
+		return nil, errDecompressedTooLong
+	}
+	start := len(dst)
+	dst, err := lz4DecompressBlock(dst, src, int(size))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst)-start != int(size) {
+		return nil, errLZ4Corrupt
+	}
+	return dst, nil
+}
+
+var errLZ4Corrupt = errors.New("ssh: corrupt lz4 block")
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5  // a block ends with at least this many literals
+	lz4MFLimit      = 12 // and its last match starts this far from the end
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 12
+)
+
+// lz4Table maps the hashes of 4-byte sequences to one past the
+// position they were last seen at; zero is none.
+type lz4Table [1 << lz4HashLog]int32
+
+var lz4Tables = sync.Pool{New: func() interface{} { return new(lz4Table) }}
+
+func lz4Hash(seq uint32) uint32 {
+	return (seq * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4CompressBlock appends src, as an LZ4 block, to dst.
+func lz4CompressBlock(dst, src []byte, table *lz4Table) []byte {
+	*table = lz4Table{}
+	anchor := 0
+	for i := 0; i+lz4MFLimit <= len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(seq)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends the literals lit, and then a match of n
+// bytes at offset back, to dst. The last sequence of a block has no
+// match, and n is zero.
+func lz4AppendSequence(dst, lit []byte, offset, n int) []byte {
+	token := len(dst)
+	dst = append(dst, 0)
+	if len(lit) >= 15 {
+		dst[token] = 15 << 4
+		dst = lz4AppendLength(dst, len(lit)-15)
+	} else {
+		dst[token] = byte(len(lit)) << 4
+	}
+	dst = append(dst, lit...)
+	if n == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if n -= lz4MinMatch; n >= 15 {
+		dst[token] |= 15
+		dst = lz4AppendLength(dst, n-15)
+	} else {
+		dst[token] |= byte(n)
+	}
+	return dst
+}
+
+func lz4AppendLength(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock appends the contents of the LZ4 block src to
+// dst, and fails if they are longer than limit.
+func lz4DecompressBlock(dst, src []byte, limit int) ([]byte, error) {
+	start := len(dst)
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
+
+		n := int(token >> 4)
+		if n == 15 {
+			var ok bool
+			if n, src, ok = lz4ParseLength(src, n, limit); !ok {
+				return nil, errLZ4Corrupt
+			}
+		}
+		if n > len(src) {
+			return nil, errLZ4Corrupt
+		}
+		if len(dst)-start+n > limit {
+			return nil, errDecompressedTooLong
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+		if len(src) == 0 {
+			// The last sequence has literals only.
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[0]) | int(src[1])<<8
+		src = src[2:]
+		if offset == 0 || offset > len(dst)-start {
+			return nil, errLZ4Corrupt
+		}
+		n = int(token & 15)
+		if n == 15 {
+			var ok bool
+			if n, src, ok = lz4ParseLength(src, n, limit); !ok {
+				return nil, errLZ4Corrupt
+			}
+		}
+		n += lz4MinMatch
+		if len(dst)-start+n > limit {
+			return nil, errDecompressedTooLong
+		}
+		from := len(dst) - offset
+		if offset >= n {
+			dst = append(dst, dst[from:from+n]...)
+		} else {
+			// The match overlaps the bytes it writes.
+			for j := 0; j < n; j++ {
+				dst = append(dst, dst[from+j])
+			}
+		}
+	}
+	return dst, nil
+}
+
+// lz4ParseLength adds the extra bytes of a length that starts at n
+// to it. It fails if they run past in, or past limit.
+func lz4ParseLength(in []byte, n, limit int) (int, []byte, bool) {
+	for {
+		if len(in) == 0 {
+			return 0, nil, false
+		}
+		b := in[0]
+		in = in[1:]
+		n += int(b)
+		if n > limit+lz4MinMatch {
+			return 0, nil, false
+		}
+		if b != 255 {
+			return n, in, true
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// enforceMaxAge closes the connection once it is age old, as
+// Config.MaxConnectionAge asks. From then on, channel opens fail;
+// the channels open get up to grace to close before the peer is sent
+// an SSH_MSG_DISCONNECT and the connection is closed.
+func (m *mux) enforceMaxAge(age, grace time.Duration) {
+	timer := m.clock.NewTimer(age)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-m.done:
+		return
+	}
+
+	// The grace period starts before the opens fail, so that it
+	// is running once they do.
+	if grace > 0 {
+		timer.Reset(grace)
+	}
+	atomic.StoreInt32(&m.aged, 1)
+	// Forget the channels that closed before.
+	select {
+	case <-m.chanList.emptied:
+	default:
+	}
+	if grace > 0 && !m.chanList.isEmpty() {
+		select {
+		case <-timer.C():
+		case <-m.chanList.emptied:
+		case <-m.done:
+			return
+		}
+	}
+
+	// Unless the connection ended on its own meanwhile, its end
+	// is now the age. The disconnect is best effort; the
+	// connection is closed either way.
+	if !atomic.CompareAndSwapInt32(&m.ageClose, 0, 1) {
+		return
+	}
+	m.conn.writePacket(Marshal(&disconnectMsg{
+		Reason:  disconnectByApplication,
+		Message: ErrMaxConnectionAge.Error(),
+	}))
+	m.conn.Close()
+}
+
+// isAged reports whether the connection is past
+// Config.MaxConnectionAge, and so takes no new channels.
+func (m *mux) isAged() bool {
+	return atomic.LoadInt32(&m.aged) != 0
+}
@@ -0,0 +1,182 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// agedPair connects a client to a server whose connections last at
+// most an hour, with a grace period of a minute, on clock.
+func agedPair(t *testing.T, clock *FakeClock) (client Conn, server <-chan *ServerConn, halt *Halter) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	halt = NewHalter()
+	ctx := context.Background()
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config: Config{
+			Halt:                  halt,
+			Clock:                 clock,
+			MaxConnectionAge:      time.Hour,
+			MaxConnectionAgeGrace: time.Minute,
+		},
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+	servers := make(chan *ServerConn, 1)
+	go func() {
+		conn, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			close(servers)
+			return
+		}
+		servers <- conn
+		go DiscardRequests(ctx, reqs, nil)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(ctx, in, nil)
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		}
+	}()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	go DiscardRequests(ctx, reqs, nil)
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(Prohibited, "no")
+		}
+	}()
+	return conn, servers, halt
+}
+
+// waitAged opens channels on conn until one is refused for the age
+// of the connection.
+func waitAged(t *testing.T, conn Conn) {
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ch, in, err := conn.OpenChannel(ctx, "echo", nil, nil)
+		if err == nil {
+			go DiscardRequests(ctx, in, nil)
+			ch.Close()
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		var oce *OpenChannelError
+		if !errors.As(err, &oce) || oce.Reason != Prohibited || oce.Message != ErrMaxConnectionAge.Error() {
+			t.Fatalf("OpenChannel: %v, want it refused for the age of the connection", err)
+		}
+		return
+	}
+	t.Fatal("the connection did not age")
+}
+
+func checkAgedClose(t *testing.T, client Conn, server *ServerConn) {
+	var de *DisconnectError
+	if err := client.Wait(); !errors.As(err, &de) || de.Message != ErrMaxConnectionAge.Error() {
+		t.Errorf("client Wait: %v, want a disconnect for the age of the connection", err)
+	}
+	if err := server.Wait(); err != ErrMaxConnectionAge {
+		t.Errorf("server Wait: %v, want %v", err, ErrMaxConnectionAge)
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Now())
+	client, servers, halt := agedPair(t, clock)
+	defer halt.RequestStop()
+	defer client.Close()
+	server := <-servers
+
+	ctx := context.Background()
+	ch, in, err := client.OpenChannel(ctx, "echo", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, in, nil)
+
+	clock.Advance(time.Hour)
+	waitAged(t, client)
+
+	// The channel open before works on, until it closes, which
+	// ends the connection without waiting for the grace period.
+	if _, err := ch.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(ch, b[:]); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	ch.Close()
+	checkAgedClose(t, client, server)
+}
+
+func TestMaxConnectionAgeGrace(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Now())
+	client, servers, halt := agedPair(t, clock)
+	defer halt.RequestStop()
+	defer client.Close()
+	server := <-servers
+
+	ctx := context.Background()
+	ch, in, err := client.OpenChannel(ctx, "echo", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go DiscardRequests(ctx, in, nil)
+
+	clock.Advance(time.Hour)
+	waitAged(t, client)
+	clock.Advance(time.Minute)
+	checkAgedClose(t, client, server)
+	if _, err := ch.Write([]byte("x")); err == nil {
+		t.Error("Write on a channel of the closed connection succeeded")
+	}
+}
+
+func TestMaxConnectionAgeOtherEnd(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Now())
+	client, servers, halt := agedPair(t, clock)
+	defer halt.RequestStop()
+	server := <-servers
+
+	ctx := context.Background()
+	ch, in, err := client.OpenChannel(ctx, "echo", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go DiscardRequests(ctx, in, nil)
+
+	// The client goes away during the grace period; the age did
+	// not end the connection.
+	clock.Advance(time.Hour)
+	waitAged(t, client)
+	client.Close()
+	if err := server.Wait(); err == ErrMaxConnectionAge {
+		t.Errorf("server Wait: %v, want the error of the client going away", err)
+	}
+}
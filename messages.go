@@ -12,6 +12,7 @@ import (
 	"io"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -101,6 +102,55 @@ type kexDHReplyMsg struct {
 	Signature []byte
 }
 
+// See RFC 4419, section 5.
+const msgKexDHGexGroup = 31
+
+type kexDHGexGroupMsg struct {
+	P *big.Int `sshtype:"31"`
+	G *big.Int
+}
+
+const msgKexDHGexInit = 32
+
+type kexDHGexInitMsg struct {
+	X *big.Int `sshtype:"32"`
+}
+
+const msgKexDHGexReply = 33
+
+type kexDHGexReplyMsg struct {
+	HostKey   []byte `sshtype:"33"`
+	Y         *big.Int
+	Signature []byte
+}
+
+const msgKexDHGexRequest = 34
+
+type kexDHGexRequestMsg struct {
+	MinBits      uint32 `sshtype:"34"`
+	PreferedBits uint32
+	MaxBits      uint32
+}
+
+// See RFC 8308, section 2.3. The extension list is a count
+// followed by name/value pairs, which the reflection based
+// Unmarshal cannot express, so see marshalExtInfo and
+// parseExtInfo instead.
+const msgExtInfo = 7
+
+// See OpenSSH's PROTOCOL file, section 1.9.
+const msgPing = 192
+
+type pingMsg struct {
+	Data string `sshtype:"192"`
+}
+
+const msgPong = 193
+
+type pongMsg struct {
+	Data string `sshtype:"193"`
+}
+
 // See RFC 4253, section 10.
 const msgServiceRequest = 5
 
@@ -267,6 +317,52 @@ type userAuthPubKeyOkMsg struct {
 	PubKey []byte
 }
 
+// marshalExtInfo serializes an SSH_MSG_EXT_INFO message. Extensions
+// are written in sorted order, so the output is deterministic.
+func marshalExtInfo(exts map[string][]byte) []byte {
+	names := make([]string, 0, len(exts))
+	for name := range exts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	p := []byte{msgExtInfo}
+	p = appendInt(p, len(names))
+	for _, name := range names {
+		p = appendString(p, name)
+		p = appendU32(p, uint32(len(exts[name])))
+		p = append(p, exts[name]...)
+	}
+	return p
+}
+
+// parseExtInfo parses an SSH_MSG_EXT_INFO message into a map from
+// extension name to value.
+func parseExtInfo(packet []byte) (map[string][]byte, error) {
+	if len(packet) == 0 || packet[0] != msgExtInfo {
+		return nil, parseError(msgExtInfo)
+	}
+	n, rest, ok := parseUint32(packet[1:])
+	if !ok {
+		return nil, parseError(msgExtInfo)
+	}
+	exts := make(map[string][]byte)
+	for i := uint32(0); i < n; i++ {
+		var name, value []byte
+		if name, rest, ok = parseString(rest); !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		if value, rest, ok = parseString(rest); !ok {
+			return nil, parseError(msgExtInfo)
+		}
+		exts[string(name)] = value
+	}
+	if len(rest) != 0 {
+		return nil, parseError(msgExtInfo)
+	}
+	return exts, nil
+}
+
 // typeTags returns the possible type bytes for the given reflect.Type, which
 // should be a struct. The possible values are separated by a '|' character.
 func typeTags(structType reflect.Type) (tags []byte) {
@@ -298,6 +394,15 @@ var errShortRead = errors.New("ssh: short read")
 // case of error, Unmarshal returns a ParseError or
 // UnexpectedMessageError.
 func Unmarshal(data []byte, out interface{}) error {
+	switch m := out.(type) {
+	case *channelDataMsg:
+		return m.unmarshal(data)
+	case *windowAdjustMsg:
+		return m.unmarshal(data)
+	case *channelRequestMsg:
+		return m.unmarshal(data)
+	}
+
 	v := reflect.ValueOf(out).Elem()
 	structType := v.Type()
 	expectedTypes := typeTags(structType)
@@ -421,6 +526,21 @@ func Unmarshal(data []byte, out interface{}) error {
 // number is prepended to the result. If the last of member has the
 // "ssh" tag set to "rest", its contents are appended to the output.
 func Marshal(msg interface{}) []byte {
+	switch m := msg.(type) {
+	case channelDataMsg:
+		return m.marshal()
+	case *channelDataMsg:
+		return m.marshal()
+	case windowAdjustMsg:
+		return m.marshal()
+	case *windowAdjustMsg:
+		return m.marshal()
+	case channelRequestMsg:
+		return m.marshal()
+	case *channelRequestMsg:
+		return m.marshal()
+	}
+
 	out := make([]byte, 0, 64)
 	return marshalStruct(out, msg)
 }
@@ -506,6 +626,97 @@ func marshalStruct(out []byte, msg interface{}) []byte {
 	return out
 }
 
+// The messages sent and received for every few packets of a busy
+// channel are built and parsed by hand, rather than by reflection,
+// as Marshal and Unmarshal of the other messages are. They give the
+// same results, and fail with the same errors.
+
+// checkMsgType checks that data is a message of type want.
+func checkMsgType(data []byte, want byte) error {
+	if len(data) == 0 {
+		return parseError(want)
+	}
+	if data[0] != want {
+		return fmt.Errorf("ssh: unexpected message type %d (expected one of %v)", data[0], []byte{want})
+	}
+	return nil
+}
+
+func (m *channelDataMsg) marshal() []byte {
+	out := make([]byte, 0, 9+len(m.Rest))
+	out = append(out, msgChannelData)
+	out = appendU32(out, m.PeersId)
+	out = appendU32(out, m.Length)
+	return append(out, m.Rest...)
+}
+
+func (m *channelDataMsg) unmarshal(data []byte) error {
+	if err := checkMsgType(data, msgChannelData); err != nil {
+		return err
+	}
+	if len(data) < 9 {
+		return errShortRead
+	}
+	m.PeersId = binary.BigEndian.Uint32(data[1:])
+	m.Length = binary.BigEndian.Uint32(data[5:])
+	m.Rest = data[9:]
+	return nil
+}
+
+func (m *windowAdjustMsg) marshal() []byte {
+	out := make([]byte, 0, 9)
+	out = append(out, msgChannelWindowAdjust)
+	out = appendU32(out, m.PeersId)
+	return appendU32(out, m.AdditionalBytes)
+}
+
+func (m *windowAdjustMsg) unmarshal(data []byte) error {
+	if err := checkMsgType(data, msgChannelWindowAdjust); err != nil {
+		return err
+	}
+	if len(data) < 9 {
+		return errShortRead
+	}
+	if len(data) > 9 {
+		return parseError(msgChannelWindowAdjust)
+	}
+	m.PeersId = binary.BigEndian.Uint32(data[1:])
+	m.AdditionalBytes = binary.BigEndian.Uint32(data[5:])
+	return nil
+}
+
+func (m *channelRequestMsg) marshal() []byte {
+	out := make([]byte, 0, 10+len(m.Request)+len(m.RequestSpecificData))
+	out = append(out, msgChannelRequest)
+	out = appendU32(out, m.PeersId)
+	out = appendInt(out, len(m.Request))
+	out = append(out, m.Request...)
+	out = appendBool(out, m.WantReply)
+	return append(out, m.RequestSpecificData...)
+}
+
+func (m *channelRequestMsg) unmarshal(data []byte) error {
+	if err := checkMsgType(data, msgChannelRequest); err != nil {
+		return err
+	}
+	id, data, ok := parseUint32(data[1:])
+	if !ok {
+		return errShortRead
+	}
+	req, data, ok := parseString(data)
+	if !ok {
+		return fieldError(reflect.TypeOf(*m), 1, "")
+	}
+	if len(data) < 1 {
+		return errShortRead
+	}
+	m.PeersId = id
+	m.Request = string(req)
+	m.WantReply = data[0] != 0
+	m.RequestSpecificData = data[1:]
+	return nil
+}
+
 var bigOne = big.NewInt(1)
 
 func parseString(in []byte) (out, rest []byte, ok bool) {
@@ -748,6 +959,10 @@ func decode(packet []byte) (interface{}, error) {
 		msg = new(channelRequestSuccessMsg)
 	case msgChannelFailure:
 		msg = new(channelRequestFailureMsg)
+	case msgPing:
+		msg = new(pingMsg)
+	case msgPong:
+		msg = new(pongMsg)
 	default:
 		return nil, unexpectedMessageError(0, packet[0])
 	}
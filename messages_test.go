@@ -6,9 +6,11 @@ package ssh
 
 import (
 	"bytes"
+	"fmt"
 	"math/big"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
 )
@@ -295,3 +297,89 @@ func BenchmarkUnmarshalKexDHInitMsg(b *testing.B) {
 		Unmarshal(_kexDHInit, m)
 	}
 }
+
+// The hot messages, as other types, so that Marshal and Unmarshal
+// handle them by reflection.
+type reflectChannelDataMsg struct {
+	PeersId uint32 `sshtype:"94"`
+	Length  uint32
+	Rest    []byte `ssh:"rest"`
+}
+
+type reflectWindowAdjustMsg struct {
+	PeersId         uint32 `sshtype:"93"`
+	AdditionalBytes uint32
+}
+
+type reflectChannelRequestMsg struct {
+	PeersId             uint32 `sshtype:"98"`
+	Request             string
+	WantReply           bool
+	RequestSpecificData []byte `ssh:"rest"`
+}
+
+func TestHotMessagesMatchReflection(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+	for _, tc := range []struct {
+		fast, slow interface{}
+	}{
+		{&channelDataMsg{7, 3, []byte("abc")}, &reflectChannelDataMsg{7, 3, []byte("abc")}},
+		{&windowAdjustMsg{7, 1 << 20}, &reflectWindowAdjustMsg{7, 1 << 20}},
+		{&channelRequestMsg{7, "exit-status", true, []byte{0, 0, 0, 1}}, &reflectChannelRequestMsg{7, "exit-status", true, []byte{0, 0, 0, 1}}},
+		{&channelRequestMsg{7, "eow@openssh.com", false, nil}, &reflectChannelRequestMsg{7, "eow@openssh.com", false, nil}},
+	} {
+		packet := Marshal(tc.slow)
+		if got := Marshal(tc.fast); !bytes.Equal(got, packet) {
+			t.Errorf("Marshal(%#v) = %x, want %x", tc.fast, got, packet)
+		}
+		if got := Marshal(reflect.ValueOf(tc.fast).Elem().Interface()); !bytes.Equal(got, packet) {
+			t.Errorf("Marshal of a %T value = %x, want %x", tc.fast, got, packet)
+		}
+
+		// Every truncation, the whole packet, one with a byte
+		// too many, and one of the wrong type.
+		var inputs [][]byte
+		for i := 0; i <= len(packet); i++ {
+			inputs = append(inputs, packet[:i])
+		}
+		inputs = append(inputs, append(append([]byte{}, packet...), 0))
+		inputs = append(inputs, append([]byte{msgChannelEOF}, packet[1:]...))
+		for _, in := range inputs {
+			fast := reflect.New(reflect.TypeOf(tc.fast).Elem())
+			slow := reflect.New(reflect.TypeOf(tc.slow).Elem())
+			fastErr := Unmarshal(in, fast.Interface())
+			slowErr := Unmarshal(in, slow.Interface())
+			want := strings.Replace(fmt.Sprint(slowErr), "type reflectC", "type c", 1)
+			if fmt.Sprint(fastErr) != want {
+				t.Errorf("Unmarshal(%x) into %T: %v, want %v", in, tc.fast, fastErr, want)
+				continue
+			}
+			if fastErr == nil && !bytes.Equal(Marshal(fast.Interface()), Marshal(slow.Interface())) {
+				t.Errorf("Unmarshal(%x) into %T = %#v, want %#v", in, tc.fast, fast.Interface(), slow.Interface())
+			}
+		}
+	}
+}
+
+func TestHotMessagesAllocs(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+	data := Marshal(&channelDataMsg{7, 3, []byte("abc")})
+	adjust := Marshal(&windowAdjustMsg{7, 1 << 20})
+	var dm channelDataMsg
+	var wm windowAdjustMsg
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := Unmarshal(data, &dm); err != nil {
+			t.Fatal(err)
+		}
+		if err := Unmarshal(adjust, &wm); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Unmarshal of the hot messages made %v allocations, want 0", allocs)
+	}
+	m := &windowAdjustMsg{7, 1 << 20}
+	if allocs := testing.AllocsPerRun(100, func() { Marshal(m) }); allocs != 1 {
+		t.Errorf("Marshal(%#v) made %v allocations, want 1", m, allocs)
+	}
+}
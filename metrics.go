@@ -0,0 +1,94 @@
+package ssh
+
+import "time"
+
+// MetricsSink receives the metrics of connections, in the manner of
+// Prometheus: counters that only go up, gauges that go up and down,
+// and histograms of observations. Adapt it to a metrics library of
+// choice, and set it as Config.Metrics. Give the ClientConfig and
+// ServerConfig of a program sinks of their own, or add a label, to
+// tell clients from servers.
+//
+// The labels are pairs of a label name and its value, such as
+// "direction", "in". Each metric is reported with the same label
+// names every time. The methods are called on the paths that send
+// and receive packets, so they must be fast, and they may be called
+// concurrently.
+type MetricsSink interface {
+	// Counter adds delta, which is not negative, to a counter.
+	Counter(name string, delta float64, labels ...string)
+
+	// Gauge adds delta, which may be negative, to a gauge.
+	Gauge(name string, delta float64, labels ...string)
+
+	// Histogram records an observation.
+	Histogram(name string, value float64, labels ...string)
+}
+
+// The metrics reported to a MetricsSink.
+const (
+	// MetricHandshakes counts connection setups, with the label
+	// "result" of "ok" or "error". For servers it includes user
+	// authentication.
+	MetricHandshakes = "ssh_handshakes_total"
+
+	// MetricHandshakeSeconds observes how long the setups that
+	// succeeded took.
+	MetricHandshakeSeconds = "ssh_handshake_duration_seconds"
+
+	// MetricAuthAttempts counts the authentication attempts of
+	// clients on a server, with the labels "method", and
+	// "result" of "ok" or "failure".
+	MetricAuthAttempts = "ssh_auth_attempts_total"
+
+	// MetricTransportBytes counts the bytes of the packets sent
+	// and received, before encryption and after decryption, with
+	// the label "direction" of "in" or "out".
+	MetricTransportBytes = "ssh_transport_bytes_total"
+
+	// MetricRekeys counts the key exchanges after the first.
+	MetricRekeys = "ssh_rekeys_total"
+
+	// MetricConnectionsOpen gauges the connections that are set
+	// up and not yet closed.
+	MetricConnectionsOpen = "ssh_connections_open"
+
+	// MetricChannelsOpen gauges the channels that are open, or
+	// being opened.
+	MetricChannelsOpen = "ssh_channels_open"
+
+	// MetricForwardedConns counts the connections accepted by a
+	// LocalForwarder, with the label "result" of "ok" if the
+	// remote end was dialed, "error" if not, or "rejected" if the
+	// connection was closed for ForwardSpec.MaxConns.
+	MetricForwardedConns = "ssh_forwarded_connections_total"
+
+	// MetricForwardedConnsOpen gauges the connections that a
+	// LocalForwarder is tunneling.
+	MetricForwardedConnsOpen = "ssh_forwarded_connections_open"
+)
+
+// The label sets of the metrics, made once, so that reporting does
+// not allocate.
+var (
+	labelsResultOK       = []string{"result", "ok"}
+	labelsResultError    = []string{"result", "error"}
+	labelsResultRejected = []string{"result", "rejected"}
+	labelsDirectionIn    = []string{"direction", "in"}
+	labelsDirectionOut   = []string{"direction", "out"}
+)
+
+// reportHandshake reports the outcome of a connection setup that
+// started at start.
+func reportHandshake(config *Config, start time.Time, err error) {
+	m := config.Metrics
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.Counter(MetricHandshakes, 1, labelsResultError...)
+		return
+	}
+	m.Counter(MetricHandshakes, 1, labelsResultOK...)
+	m.Histogram(MetricHandshakeSeconds, config.Clock.Now().Sub(start).Seconds())
+}
@@ -0,0 +1,155 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps the sums of what is reported to it, by metric
+// name and labels.
+type recordingSink struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (r *recordingSink) add(name string, delta float64, labels []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values == nil {
+		r.values = map[string]float64{}
+	}
+	key := name
+	if len(labels) > 0 {
+		key += "{" + strings.Join(labels, ",") + "}"
+	}
+	r.values[key] += delta
+}
+
+func (r *recordingSink) Counter(name string, delta float64, labels ...string) {
+	r.add(name, delta, labels)
+}
+
+func (r *recordingSink) Gauge(name string, delta float64, labels ...string) {
+	r.add(name, delta, labels)
+}
+
+func (r *recordingSink) Histogram(name string, value float64, labels ...string) {
+	r.add(name+"_count", 1, labels)
+}
+
+func (r *recordingSink) get(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.values[key]
+}
+
+// waitFor polls until the metric key of r has the value want.
+func (r *recordingSink) waitFor(t *testing.T, key string, want float64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for r.get(key) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %v, want %v", key, r.get(key), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMetricsSink(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverSink, clientSink := &recordingSink{}, &recordingSink{}
+	serverConf := &ServerConfig{
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+		Config: Config{Halt: NewHalter(), Metrics: serverSink},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	ctx := context.Background()
+	go func() {
+		_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, reqs, nil)
+		for ch := range chans {
+			_, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+			go DiscardRequests(ctx, reqs, nil)
+		}
+	}()
+
+	tries := 0
+	clientConf := &ClientConfig{
+		User: "user",
+		Auth: []AuthMethod{RetryableAuthMethod(PasswordCallback(func() (string, error) {
+			tries++
+			if tries == 1 {
+				return "guess", nil
+			}
+			return "secret", nil
+		}), 2)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter(), Metrics: clientSink},
+	}
+	defer clientConf.Halt.RequestStop()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, clientConf.Halt)
+
+	for _, sink := range []*recordingSink{clientSink, serverSink} {
+		sink.waitFor(t, MetricHandshakes+"{result,ok}", 1)
+		sink.waitFor(t, MetricHandshakeSeconds+"_count", 1)
+		sink.waitFor(t, MetricConnectionsOpen, 1)
+	}
+	if got := serverSink.get(MetricAuthAttempts + "{method,password,result,failure}"); got != 1 {
+		t.Errorf("%v failed password attempts, want 1", got)
+	}
+	if got := serverSink.get(MetricAuthAttempts + "{method,password,result,ok}"); got != 1 {
+		t.Errorf("%v good password attempts, want 1", got)
+	}
+
+	ch, in, err := client.OpenChannel(ctx, "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, in, nil)
+	clientSink.waitFor(t, MetricChannelsOpen, 1)
+	serverSink.waitFor(t, MetricChannelsOpen, 1)
+	ch.Close()
+	clientSink.waitFor(t, MetricChannelsOpen, 0)
+	serverSink.waitFor(t, MetricChannelsOpen, 0)
+
+	conn.(*connection).transport.requestKeyExchange()
+	clientSink.waitFor(t, MetricRekeys, 1)
+	serverSink.waitFor(t, MetricRekeys, 1)
+
+	out := clientSink.get(MetricTransportBytes + "{direction,out}")
+	in2 := serverSink.get(MetricTransportBytes + "{direction,in}")
+	if out == 0 || in2 == 0 {
+		t.Errorf("client sent %v bytes, server received %v", out, in2)
+	}
+
+	client.Close()
+	clientSink.waitFor(t, MetricConnectionsOpen, 0)
+	serverSink.waitFor(t, MetricConnectionsOpen, 0)
+}
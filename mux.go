@@ -13,6 +13,7 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // debugMux, if set, causes messages in the connection protocol to be
@@ -28,6 +29,13 @@ type chanList struct {
 	// other side should send in the PeersId field.
 	chans []*channel
 
+	// metrics, if non-nil, gauges the channels in the list.
+	metrics MetricsSink
+
+	// emptied, if non-nil, is sent to, without blocking, when
+	// the last channel is removed.
+	emptied chan struct{}
+
 	// This is a debugging aid: it offsets all IDs by this
 	// amount. This helps distinguish otherwise identical
 	// server/client muxes
@@ -38,6 +46,9 @@ type chanList struct {
 func (c *chanList) add(ch *channel) uint32 {
 	c.Lock()
 	defer c.Unlock()
+	if c.metrics != nil {
+		c.metrics.Gauge(MetricChannelsOpen, 1)
+	}
 	for i := range c.chans {
 		if c.chans[i] == nil {
 			c.chans[i] = ch
@@ -64,11 +75,50 @@ func (c *chanList) remove(id uint32) {
 	id -= c.offset
 	c.Lock()
 	if id < uint32(len(c.chans)) {
+		if c.chans[id] != nil && c.metrics != nil {
+			c.metrics.Gauge(MetricChannelsOpen, -1)
+		}
 		c.chans[id] = nil
 	}
+	if c.emptied != nil && c.empty() {
+		select {
+		case c.emptied <- struct{}{}:
+		default:
+		}
+	}
 	c.Unlock()
 }
 
+// isEmpty reports whether the list has no channels.
+func (c *chanList) isEmpty() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.empty()
+}
+
+// empty is isEmpty, with c locked.
+func (c *chanList) empty() bool {
+	for _, ch := range c.chans {
+		if ch != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// types returns the types of the channels it knows.
+func (c *chanList) types() []string {
+	c.Lock()
+	defer c.Unlock()
+	var r []string
+	for _, ch := range c.chans {
+		if ch != nil {
+			r = append(r, ch.chanType)
+		}
+	}
+	return r
+}
+
 // dropAll forgets all channels it knows, returning them in a slice.
 func (c *chanList) dropAll() []*channel {
 	c.Lock()
@@ -82,12 +132,20 @@ func (c *chanList) dropAll() []*channel {
 		r = append(r, ch)
 	}
 	c.chans = nil
+	if c.metrics != nil && len(r) > 0 {
+		c.metrics.Gauge(MetricChannelsOpen, -float64(len(r)))
+	}
 	return r
 }
 
 // mux represents the state for the SSH connection protocol, which
 // multiplexes many channels onto a single packet transport.
 type mux struct {
+	// lastContact is when the last packet arrived, in Unix
+	// nanoseconds. It is accessed atomically, so it comes first,
+	// to be aligned.
+	lastContact int64
+
 	conn     packetConn
 	chanList chanList
 
@@ -101,6 +159,64 @@ type mux struct {
 	err     error
 
 	halt *Halter
+
+	// audit, if non-nil, receives the AuditEvents of a server
+	// connection.
+	audit func(ev *AuditEvent)
+
+	// enforce, if non-nil, applies the critical options of a
+	// server connection to the channels the client opens.
+	enforce *optionEnforcer
+
+	// quota, if non-nil, limits the channels the client opens.
+	quota *Quota
+
+	// goroutines, if non-nil, counts the goroutines of the
+	// connection.
+	goroutines *goroutineLedger
+
+	// openLimit, if non-nil, limits the channel opens of the
+	// peer that are pending.
+	openLimit *openLimiter
+
+	// maxPacket is the Config.MaxChannelPacket we advertise for
+	// our side of each channel.
+	maxPacket uint32
+
+	// window is the Config.ChannelWindow we give the peer for
+	// each channel.
+	window uint32
+
+	// clock times the IdleTimers of the channels.
+	clock Clock
+
+	// quirks are the Quirks of the peer.
+	quirks Quirks
+
+	// interceptMu protects interceptors, the chain of
+	// Interceptors, which is replaced rather than changed.
+	// interceptConn, set once, is the ConnMetadata given to them.
+	interceptMu   sync.Mutex
+	interceptors  []Interceptor
+	interceptConn ConnMetadata
+
+	// limitMu protects readLimit and writeLimit, which cap the
+	// data of all channels.
+	limitMu    sync.Mutex
+	readLimit  *RateLimiter
+	writeLimit *RateLimiter
+
+	// aged is set, atomically, once the connection is past
+	// Config.MaxConnectionAge.
+	aged int32
+
+	// ageClose is 0 while the connection runs, then 1 if
+	// enforceMaxAge closed it, or 2 if loop ended first; it is
+	// changed atomically.
+	ageClose int32
+
+	// done is closed when loop exits.
+	done chan struct{}
 }
 
 // When debugging, each new chanList instantiation has a different
@@ -116,8 +232,21 @@ func (m *mux) Wait() error {
 	return m.err
 }
 
+// muxOptions are the hooks of one connection that a mux calls, on
+// top of those of its Config. Any of them may be nil.
+type muxOptions struct {
+	// meta is the ConnMetadata passed to the Interceptors.
+	meta ConnMetadata
+
+	// audit, enforce and quota are those of a server connection;
+	// see the fields of mux.
+	audit   func(ev *AuditEvent)
+	enforce *optionEnforcer
+	quota   *Quota
+}
+
 // newMux returns a mux that runs over the given connection.
-func newMux(ctx context.Context, p packetConn, halt *Halter) *mux {
+func newMux(ctx context.Context, p packetConn, halt *Halter, config *Config, opts muxOptions) *mux {
 	// idle is nil on server
 	m := &mux{
 		conn:             p,
@@ -126,16 +255,52 @@ func newMux(ctx context.Context, p packetConn, halt *Halter) *mux {
 		incomingRequests: make(chan *Request, chanSize),
 		errCond:          newCond(),
 		halt:             halt,
+		audit:            opts.audit,
+		enforce:          opts.enforce,
+		quota:            opts.quota,
+		maxPacket:        config.MaxChannelPacket,
+		window:           config.ChannelWindow,
+		clock:            config.Clock,
+		quirks:           config.quirks,
+		interceptConn:    opts.meta,
+		interceptors:     config.Interceptors,
+		goroutines:       config.goroutines,
+		done:             make(chan struct{}),
+	}
+	if m.clock == nil {
+		m.clock = realClock{}
+	}
+	if m.window == 0 {
+		m.window = channelWindowSize
+	}
+	m.openLimit = newOpenLimiter(config.ChannelOpenLimit, m.clock)
+	m.lastContact = m.clock.Now().UnixNano()
+	m.chanList.metrics = config.Metrics
+	if m.chanList.metrics != nil {
+		m.chanList.metrics.Gauge(MetricConnectionsOpen, 1)
 	}
 
 	if debugMux {
 		m.chanList.offset = atomic.AddUint32(&globalOff, 1)
 	}
 
-	go m.loop(ctx)
+	m.goroutines.spawn("mux loop", func() { m.loop(ctx) })
+	if config.MaxConnectionAge > 0 {
+		m.chanList.emptied = make(chan struct{}, 1)
+		m.goroutines.spawn("max age", func() {
+			m.enforceMaxAge(config.MaxConnectionAge, config.MaxConnectionAgeGrace)
+		})
+	}
 	return m
 }
 
+// LastContact returns when the last packet from the peer arrived,
+// or when the connection was set up if none has. Any packet counts,
+// keepalives among them.
+func (m *mux) LastContact() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.lastContact))
+}
+
 func (m *mux) sendMessage(msg interface{}) error {
 	p := Marshal(msg)
 	if debugMux {
@@ -217,21 +382,34 @@ func (m *mux) loop(ctx context.Context) {
 			}
 		}
 	}
+	// Before the channels are dropped, which lets enforceMaxAge
+	// go on.
+	if !atomic.CompareAndSwapInt32(&m.ageClose, 0, 2) {
+		err = ErrMaxConnectionAge
+	}
 	for _, ch := range m.chanList.dropAll() {
 		ch.close()
 	}
+	if m.chanList.metrics != nil {
+		m.chanList.metrics.Gauge(MetricConnectionsOpen, -1)
+	}
 
 	close(m.incomingChannels)
 	close(m.incomingRequests)
 	close(m.globalResponses)
 
 	m.conn.Close()
+	close(m.done)
 
 	m.errCond.L.Lock()
 	m.err = err
 	m.errCond.Broadcast()
 	m.errCond.L.Unlock()
 
+	if m.audit != nil {
+		m.audit(&AuditEvent{Type: AuditDisconnect, Err: err})
+	}
+
 	if debugMux {
 		log.Println("loop exit", err)
 	}
@@ -243,6 +421,7 @@ func (m *mux) onePacket(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt64(&m.lastContact, m.clock.Now().UnixNano())
 
 	if debugMux {
 		if packet[0] == msgChannelData || packet[0] == msgChannelExtendedData {
@@ -281,6 +460,18 @@ func (m *mux) handleGlobalPacket(ctx context.Context, packet []byte) error {
 
 	switch msg := msg.(type) {
 	case *globalRequestMsg:
+		m.auditGlobalRequest(msg.Type, msg.Data)
+		if err := m.intercept(&InterceptedMessage{
+			Kind:      InterceptGlobalRequest,
+			Name:      msg.Type,
+			WantReply: msg.WantReply,
+			Payload:   msg.Data,
+		}); err != nil {
+			if msg.WantReply {
+				return m.ackRequest(false, nil)
+			}
+			return nil
+		}
 		select {
 		case m.incomingRequests <- &Request{
 			Type:      msg.Type,
@@ -317,18 +508,51 @@ func (m *mux) handleChannelOpen(ctx context.Context, packet []byte) error {
 	}
 
 	if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > 1<<31 {
-		failMsg := channelOpenFailureMsg{
-			PeersId:  msg.PeersId,
-			Reason:   ConnectionFailed,
-			Message:  "invalid request",
-			Language: "en_US.UTF-8",
-		}
-		return m.sendMessage(failMsg)
+		return m.rejectOpen(msg.PeersId, ConnectionFailed, "invalid request")
 	}
 
+	m.auditChannelOpen(msg.ChanType, msg.TypeSpecificData)
+	if m.isAged() {
+		return m.rejectOpen(msg.PeersId, Prohibited, ErrMaxConnectionAge.Error())
+	}
+	if err := m.intercept(&InterceptedMessage{
+		Kind:    InterceptChannelOpen,
+		Name:    msg.ChanType,
+		Payload: msg.TypeSpecificData,
+	}); err != nil {
+		return m.rejectOpen(msg.PeersId, Prohibited, err.Error())
+	}
+	if m.enforce != nil {
+		if err := m.enforce.channelOpen(msg.ChanType, msg.TypeSpecificData); err != nil {
+			return m.rejectOpen(msg.PeersId, Prohibited, err.Error())
+		}
+	}
+	var decide func()
+	if m.openLimit != nil {
+		var err error
+		if decide, err = m.openLimit.acquire(); err != nil {
+			return m.rejectOpen(msg.PeersId, ResourceShortage, err.Error())
+		}
+	}
+	var release func()
+	if m.quota != nil {
+		var err error
+		if release, err = m.quota.acquire(msg.ChanType); err != nil {
+			if decide != nil {
+				decide()
+			}
+			return m.rejectOpen(msg.PeersId, ResourceShortage, err.Error())
+		}
+	}
 	c := m.newChannel(msg.ChanType, channelInbound, msg.TypeSpecificData)
+	c.release = release
+	c.decide = decide
+	c.audited = m.audit != nil
+	if m.quota != nil {
+		c.rate = m.quota.rate()
+	}
 	c.remoteId = msg.PeersId
-	c.maxRemotePayload = msg.MaxPacketSize
+	c.maxRemotePayload = min(maxChannelPayload, int(msg.MaxPacketSize))
 	c.remoteWin.add(msg.PeersWindow)
 	select {
 	case m.incomingChannels <- c:
@@ -340,6 +564,36 @@ func (m *mux) handleChannelOpen(ctx context.Context, packet []byte) error {
 	return nil
 }
 
+// SetRateLimit implements RateLimited for the connection. The limits
+// apply to all channels taken together, on top of the limits of each
+// channel.
+func (m *mux) SetRateLimit(read, write *RateLimiter) {
+	m.limitMu.Lock()
+	m.readLimit, m.writeLimit = read, write
+	m.limitMu.Unlock()
+}
+
+// rateLimit returns the limiter for writes, or for reads, or nil.
+func (m *mux) rateLimit(write bool) *RateLimiter {
+	m.limitMu.Lock()
+	defer m.limitMu.Unlock()
+	if write {
+		return m.writeLimit
+	}
+	return m.readLimit
+}
+
+// rejectOpen refuses a channel the peer asked to open.
+func (m *mux) rejectOpen(peersID uint32, reason RejectionReason, message string) error {
+	failMsg := channelOpenFailureMsg{
+		PeersId:  peersID,
+		Reason:   reason,
+		Message:  message,
+		Language: "en_US.UTF-8",
+	}
+	return m.sendMessage(failMsg)
+}
+
 func (m *mux) OpenChannel(ctx context.Context, chanType string, extra []byte, parentHalt *Halter) (Channel, <-chan *Request, error) {
 	ch, err := m.openChannel(ctx, chanType, extra, parentHalt)
 	if err != nil {
@@ -350,9 +604,12 @@ func (m *mux) OpenChannel(ctx context.Context, chanType string, extra []byte, pa
 }
 
 func (m *mux) openChannel(ctx context.Context, chanType string, extra []byte, parentHalt *Halter) (*channel, error) {
+	if m.isAged() {
+		return nil, ErrMaxConnectionAge
+	}
 	ch := m.newChannel(chanType, channelOutbound, extra)
 
-	ch.maxIncomingPayload = channelMaxPacket
+	ch.maxIncomingPayload = m.maxPacket
 
 	open := channelOpenMsg{
 		ChanType:         chanType,
@@ -379,6 +636,9 @@ func (m *mux) openChannel(ctx context.Context, chanType string, extra []byte, pa
 			if parentHalt != nil {
 				parentHalt.AddDownstream(ch.halt)
 			}
+			if hasChannelLifetime(ctx) {
+				m.goroutines.spawn("channel lifetime", func() { ch.closeWhenDone(ctx) })
+			}
 			return ch, nil
 		case *channelOpenFailureMsg:
 			ch.idleR.Halt.RequestStop()
@@ -5,20 +5,26 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"io/ioutil"
 	"sync"
 	"testing"
+	"time"
 )
 
 func muxPair(halt *Halter) (*mux, *mux) {
+	return muxPairConfig(halt, &Config{MaxChannelPacket: channelMaxPacket})
+}
+
+func muxPairConfig(halt *Halter, conf *Config) (*mux, *mux) {
 	a, b := memPipe()
 
 	ctx := context.Background()
 
-	s := newMux(ctx, a, halt)
-	c := newMux(ctx, b, halt)
+	s := newMux(ctx, a, halt, conf, muxOptions{})
+	c := newMux(ctx, b, halt, conf, muxOptions{})
 
 	return s, c
 }
@@ -26,7 +32,11 @@ func muxPair(halt *Halter) (*mux, *mux) {
 // Returns both ends of a channel, and the mux for the the 2nd
 // channel.
 func channelPair(t *testing.T, halt *Halter) (*channel, *channel, *mux) {
-	c, s := muxPair(halt)
+	return channelPairConfig(t, halt, &Config{MaxChannelPacket: channelMaxPacket})
+}
+
+func channelPairConfig(t *testing.T, halt *Halter, conf *Config) (*channel, *channel, *mux) {
+	c, s := muxPairConfig(halt, conf)
 
 	res := make(chan *channel, 1)
 	go func() {
@@ -168,6 +178,165 @@ func TestMuxReadWrite(t *testing.T) {
 	<-writeDone
 }
 
+func TestMuxReadSlice(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	s, c, mux := channelPair(t, halt)
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	// More than a window's worth, so the reader must give the
+	// window back for the writer to finish.
+	want := make([]byte, 2*channelWindowSize)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	go func() {
+		s.Write(want)
+		s.Close()
+	}()
+
+	var got []byte
+	for {
+		seg, err := c.ReadSlice()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadSlice: %v", err)
+		}
+		got = append(got, seg...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, not the %d written", len(got), len(want))
+	}
+}
+
+func TestMuxWindowStats(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	s, c, mux := channelPair(t, halt)
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	go func() {
+		s.Write(make([]byte, channelWindowSize+1000))
+		s.Close()
+	}()
+	// Let the writer use up the window before reading.
+	for {
+		s.remoteWin.L.Lock()
+		win := s.remoteWin.win
+		s.remoteWin.L.Unlock()
+		if win == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if st := s.WindowStats(); st.WriteStalls < 1 || st.WriteStallTime < 50*time.Millisecond {
+		t.Errorf("writer stats %+v, want a stall of at least 50ms", st)
+	}
+	if st := c.WindowStats(); st.PeerStalls < 1 || st.PeerStallTime < 50*time.Millisecond || st.WriteStalls != 0 {
+		t.Errorf("reader stats %+v, want a peer stall of at least 50ms", st)
+	}
+}
+
+func TestMuxChannelWindow(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	const size = 4 * channelWindowSize
+	s, c, mux := channelPairConfig(t, halt, &Config{MaxChannelPacket: channelMaxPacket, ChannelWindow: size})
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	for i, ch := range []*channel{s, c} {
+		ch.remoteWin.L.Lock()
+		win := ch.remoteWin.win
+		ch.remoteWin.L.Unlock()
+		if win != size {
+			t.Errorf("channel %d: window %d, want %d", i, win, size)
+		}
+	}
+
+	// The writer is not held up by the reader until the whole
+	// window is used.
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Write(make([]byte, size))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write of a window of data blocked")
+	}
+}
+
+func TestMuxExtendedStreams(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	s, c, mux := channelPair(t, halt)
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	// Data of codes past the limit is discarded, but returns the
+	// window to the peer, so the main stream keeps flowing.
+	big := make([]byte, channelWindowSize)
+	if _, err := s.Extended(2).Write([]byte("control")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for code := uint32(3); code < 2+maxExtendedStreams; code++ {
+		if _, err := s.Extended(code).Write([]byte{1}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	go func() {
+		s.Extended(100).Write(big)
+		s.Write([]byte("data"))
+		s.Close()
+	}()
+
+	var buf [64]byte
+	n, err := c.Extended(2).Read(buf[:])
+	if err != nil || string(buf[:n]) != "control" {
+		t.Fatalf("Read code 2: got %q, %v, want control", buf[:n], err)
+	}
+	got, err := ioutil.ReadAll(c)
+	if err != nil || string(got) != "data" {
+		t.Fatalf("ReadAll: got %q, %v, want data", got, err)
+	}
+	if _, err := c.Extended(100).Read(buf[:]); err == nil {
+		t.Error("Read of a discarded code succeeded")
+	}
+	if _, err := c.Extended(2).Read(buf[:]); err != io.EOF {
+		t.Errorf("Read code 2 after close: got %v, want EOF", err)
+	}
+}
+
 func TestMuxChannelOverflow(t *testing.T) {
 	defer xtestend(xtestbegin(t))
 
@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn keeps a copy of the bytes written to a net.Conn.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(p)
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func obfuscatedHandshake(t *testing.T, client, server Obfuscator) (wire []byte, err error) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	// Mismatched ends can each wait for a version line the other
+	// never sends in the clear.
+	deadline := time.Now().Add(5 * time.Second)
+	c1.SetDeadline(deadline)
+	c2.SetDeadline(deadline)
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config:       Config{Halt: halt, Obfuscator: server},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	go newServer(ctx, c1, serverConf)
+
+	rec := &recordingConn{Conn: c2}
+	_, _, _, err = NewClientConn(ctx, rec, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, Obfuscator: client},
+	})
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.written.Bytes(), err
+}
+
+func TestXORObfuscator(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	obf := XORObfuscator([]byte("not a secret"))
+	wire, err := obfuscatedHandshake(t, obf, obf)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if bytes.Contains(wire, []byte("SSH-2.0")) {
+		t.Error("version line visible on the wire")
+	}
+
+	wire, err = obfuscatedHandshake(t, nil, nil)
+	if err != nil {
+		t.Fatalf("plain handshake: %v", err)
+	}
+	if !bytes.HasPrefix(wire, []byte("SSH-2.0")) {
+		t.Error("plain handshake does not start with the version")
+	}
+
+	if _, err := obfuscatedHandshake(t, obf, nil); err == nil {
+		t.Error("handshake succeeded with only the client obfuscating")
+	}
+}
+
+func TestXORKeyPosition(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	key := []byte{1, 2, 3}
+	src := []byte{0, 0, 0, 0, 0}
+	dst := make([]byte, len(src))
+	if pos := xorKey(dst, src, key, 2); pos != 1 {
+		t.Errorf("got position %d, want 1", pos)
+	}
+	if want := []byte{3, 1, 2, 3, 1}; !bytes.Equal(dst, want) {
+		t.Errorf("got %v, want %v", dst, want)
+	}
+}
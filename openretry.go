@@ -0,0 +1,39 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+)
+
+// IsTemporaryOpenError reports whether err is the refusal of a
+// channel open that may succeed if tried again: one for a
+// ResourceShortage, such as a server at its limit of channels or
+// sessions. A server past Config.MaxConnectionAge stays refused, so
+// it refuses as Prohibited.
+func IsTemporaryOpenError(err error) bool {
+	var oce *OpenChannelError
+	if !errors.As(err, &oce) {
+		return false
+	}
+	return oce.Reason == ResourceShortage
+}
+
+// openChannel opens a channel for NewSession and the Dial methods,
+// retrying as ClientConfig.ChannelOpenRetry asks.
+func (c *Client) openChannel(ctx context.Context, chanType string, extra []byte) (Channel, <-chan *Request, error) {
+	var policy *RetryPolicy
+	if conn, ok := c.Conn.(*connection); ok && conn.clicfg != nil {
+		policy = conn.clicfg.ChannelOpenRetry
+	}
+	if policy == nil {
+		return c.OpenChannel(ctx, chanType, extra, nil)
+	}
+
+	var ch Channel
+	var in <-chan *Request
+	err := policy.retry(ctx, IsTemporaryOpenError, func() (err error) {
+		ch, in, err = c.OpenChannel(ctx, chanType, extra, nil)
+		return err
+	})
+	return ch, in, err
+}
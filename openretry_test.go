@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsTemporaryOpenError(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&OpenChannelError{Reason: ResourceShortage, Message: "busy"}, true},
+		{&OpenChannelError{Reason: Prohibited, Message: ErrMaxConnectionAge.Error()}, false},
+		{&OpenChannelError{Reason: Prohibited}, false},
+		{&OpenChannelError{Reason: ConnectionFailed}, false},
+		{ErrMaxConnectionAge, false},
+		{errors.New("other"), false},
+	} {
+		if got := IsTemporaryOpenError(test.err); got != test.want {
+			t.Errorf("IsTemporaryOpenError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestChannelOpenRetry(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	// The server is short of sessions for its first two opens,
+	// and forbids direct-tcpip.
+	var opens int32
+	serverConf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: halt}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	go func() {
+		_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		for newCh := range chans {
+			n := atomic.AddInt32(&opens, 1)
+			switch {
+			case newCh.ChannelType() != "session":
+				newCh.Reject(Prohibited, "no forwarding")
+			case n <= 2:
+				newCh.Reject(ResourceShortage, "busy")
+			default:
+				ch, in, err := newCh.Accept()
+				if err != nil {
+					t.Errorf("Accept: %v", err)
+					continue
+				}
+				go DiscardRequests(ctx, in, halt)
+				defer ch.Close()
+			}
+		}
+	}()
+
+	var retries int32
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		ChannelOpenRetry: &RetryPolicy{
+			InitialDelay: time.Millisecond,
+			OnRetry: func(attempt int, err error, delay time.Duration) {
+				atomic.AddInt32(&retries, 1)
+			},
+		},
+		Config: Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, halt)
+	defer client.Close()
+
+	session, err := client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	session.Close()
+	if n := atomic.LoadInt32(&retries); n != 2 {
+		t.Errorf("retried %d times, want 2", n)
+	}
+
+	// A permanent refusal is returned at once.
+	atomic.StoreInt32(&opens, 0)
+	atomic.StoreInt32(&retries, 0)
+	var oce *OpenChannelError
+	if _, err := client.DialWithContext(ctx, "tcp", "127.0.0.1:22"); !errors.As(err, &oce) || oce.Reason != Prohibited {
+		t.Errorf("DialWithContext: got %v, want Prohibited", err)
+	}
+	if n := atomic.LoadInt32(&opens); n != 1 {
+		t.Errorf("opened %d times, want 1", n)
+	}
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// PacketConn is an SSH transport past the key exchange and user
+// authentication, with none of the connection protocol of RFC 4254
+// over it: it sends and receives raw SSH messages, for researchers
+// and testing tools that craft message sequences of their own.
+// Key exchanges, the first and those that follow, are still run
+// underneath, and their messages are neither returned nor can be
+// sent. Nothing else is done for the caller: channels, windows,
+// global requests and disconnects are up to it.
+type PacketConn interface {
+	ConnMetadata
+
+	// WritePacket encrypts and sends p, a whole SSH message, its
+	// message number first. p may be reused once it returns.
+	WritePacket(p []byte) error
+
+	// ReadPacket returns the next message from the peer. It fails
+	// with ctx.Err() once ctx is done, and with io.EOF once the
+	// connection is closed.
+	ReadPacket(ctx context.Context) ([]byte, error)
+
+	// Close closes the connection.
+	Close() error
+}
+
+// NewClientPacketConn runs the handshake of a client connection over
+// c, as NewClientConn does, but returns a PacketConn rather than a
+// Conn, for experimenting with the protocol; use NewClientConn for
+// anything else.
+func NewClientPacketConn(ctx context.Context, c net.Conn, addr string, config *ClientConfig) (PacketConn, error) {
+	conn, _, err := newClientConnection(ctx, c, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConnection{sshConn: &conn.sshConn, conn: conn}, nil
+}
+
+// NewServerPacketConn runs the handshake of a server connection over
+// c, as NewServerConn does, but returns a PacketConn rather than a
+// ServerConn, with the Permissions the client was granted, for
+// experimenting with the protocol; use NewServerConn for anything
+// else. The connection is not added to config.Registry, and the
+// Permissions are not enforced.
+func NewServerPacketConn(ctx context.Context, c net.Conn, config *ServerConfig) (PacketConn, *Permissions, error) {
+	conn, _, perms, err := newServerConnection(ctx, c, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &packetConnection{sshConn: &conn.sshConn, conn: conn}, perms, nil
+}
+
+// packetConnection is the PacketConn of a connection without a mux.
+type packetConnection struct {
+	*sshConn
+	conn *connection
+}
+
+func (p *packetConnection) WritePacket(packet []byte) error {
+	if len(packet) == 0 {
+		return errors.New("ssh: empty packet")
+	}
+	return p.conn.transport.writePacket(packet)
+}
+
+func (p *packetConnection) ReadPacket(ctx context.Context) ([]byte, error) {
+	packet, err := p.conn.transport.readPacket(ctx)
+	if err == io.EOF && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return packet, err
+}
+
+func (p *packetConnection) Close() error {
+	return p.conn.Close()
+}
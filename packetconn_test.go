@@ -0,0 +1,141 @@
+package ssh
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPacketConn(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+
+	// A raw client against a server with the connection protocol.
+	serverConf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	served := make(chan error, 1)
+	go func() {
+		_, _, reqs, err := NewServerConn(ctx, c1, serverConf)
+		if err != nil {
+			served <- err
+			return
+		}
+		req := <-reqs
+		if req.Type != "probe" || string(req.Payload) != "data" {
+			t.Errorf("server got request %q %q", req.Type, req.Payload)
+		}
+		served <- req.Reply(true, []byte("answer"))
+	}()
+
+	pc, err := NewClientPacketConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("NewClientPacketConn: %v", err)
+	}
+	defer pc.Close()
+	if len(pc.SessionID()) == 0 {
+		t.Error("no session ID")
+	}
+
+	if err := pc.WritePacket(Marshal(&kexInitMsg{})); err == nil {
+		t.Error("WritePacket sent an SSH_MSG_KEXINIT")
+	}
+	if err := pc.WritePacket(Marshal(&globalRequestMsg{Type: "probe", WantReply: true, Data: []byte("data")})); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	packet, err := pc.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	var reply globalRequestSuccessMsg
+	if err := Unmarshal(packet, &reply); err != nil || string(reply.Data) != "answer" {
+		t.Errorf("got %x (%v), want a success with the answer", packet, err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := pc.ReadPacket(short); err != context.DeadlineExceeded {
+		t.Errorf("ReadPacket with nothing to read: got %v, want the context's error", err)
+	}
+}
+
+func TestServerPacketConn(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+
+	serverConf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	type result struct {
+		pc  PacketConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		pc, _, err := NewServerPacketConn(ctx, c1, serverConf)
+		done <- result{pc, err}
+	}()
+
+	conn, _, _, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	defer conn.Close()
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("NewServerPacketConn: %v", r.err)
+	}
+	defer r.pc.Close()
+
+	// The raw server refuses a channel open by hand.
+	opened := make(chan error, 1)
+	go func() {
+		_, _, err := conn.OpenChannel(ctx, "session", nil, nil)
+		opened <- err
+	}()
+	packet, err := r.pc.ReadPacket(ctx)
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	var open channelOpenMsg
+	if err := Unmarshal(packet, &open); err != nil || open.ChanType != "session" {
+		t.Fatalf("got %x (%v), want a session open", packet, err)
+	}
+	if err := r.pc.WritePacket(Marshal(&channelOpenFailureMsg{
+		PeersId: open.PeersId,
+		Reason:  Prohibited,
+		Message: "raw",
+	})); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+	if err := <-opened; err == nil {
+		t.Error("OpenChannel succeeded")
+	} else if oce, ok := err.(*OpenChannelError); !ok || oce.Message != "raw" {
+		t.Errorf("OpenChannel: %v, want the failure sent", err)
+	}
+}
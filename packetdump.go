@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcap file constants; see the pcap file format of libpcap.
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapLinkType  = 147 // LINKTYPE_USER0
+	pcapSnapLen   = 1 + maxPacket
+	pcapHeaderLen = 24
+	pcapRecordLen = 16
+)
+
+// PacketDump writes the SSH packets of a connection, as they are
+// after decryption and before encryption, to a pcap file, for
+// offline debugging. Each record holds a byte that is 1 for a packet
+// we sent or 0 for one we received, followed by the packet payload,
+// which starts with the message type. The link type is
+// LINKTYPE_USER0, so tools need to be told how to dissect it;
+// ReadPacketDump reads the records back.
+//
+// A PacketDump is set as Config.PacketDump of a single connection.
+// Anyone who reads the dump can read the connection, passwords
+// included.
+type PacketDump struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewPacketDump returns a PacketDump that writes to w. The pcap file
+// header is written first.
+func NewPacketDump(w io.Writer) (*PacketDump, error) {
+	var hdr [pcapHeaderLen]byte
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapLinkType)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &PacketDump{w: w}, nil
+}
+
+// Err returns the first error writing the dump, after which no more
+// packets are written. The connection is not affected.
+func (d *PacketDump) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// record writes a packet sent or received at now.
+func (d *PacketDump) record(sent bool, packet []byte, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return
+	}
+	rec := make([]byte, pcapRecordLen+1+len(packet))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(1+len(packet)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(1+len(packet)))
+	if sent {
+		rec[pcapRecordLen] = 1
+	}
+	copy(rec[pcapRecordLen+1:], packet)
+	_, d.err = d.w.Write(rec)
+}
+
+// DumpedPacket is a packet read back from a PacketDump.
+type DumpedPacket struct {
+	Time time.Time
+
+	// Sent tells whether the packet was sent, or received.
+	Sent bool
+
+	// Packet is the payload, starting with the message type.
+	Packet []byte
+}
+
+// ReadPacketDump reads the packets written by a PacketDump.
+func ReadPacketDump(r io.Reader) ([]DumpedPacket, error) {
+	var hdr [pcapHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != pcapMagic || binary.LittleEndian.Uint32(hdr[20:]) != pcapLinkType {
+		return nil, errors.New("ssh: not a packet dump")
+	}
+
+	var packets []DumpedPacket
+	for {
+		var rec [pcapRecordLen]byte
+		if _, err := io.ReadFull(r, rec[:]); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return packets, err
+		}
+		n := binary.LittleEndian.Uint32(rec[8:])
+		if n == 0 || n > pcapSnapLen {
+			return packets, fmt.Errorf("ssh: bad packet dump record length %d", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return packets, err
+		}
+		packets = append(packets, DumpedPacket{
+			Time:   time.Unix(int64(binary.LittleEndian.Uint32(rec[0:])), int64(binary.LittleEndian.Uint32(rec[4:]))*1000),
+			Sent:   data[0] == 1,
+			Packet: data[1:],
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestPacketDump(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config:       Config{Halt: halt},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := NewServerConn(ctx, c1, serverConf)
+		done <- err
+	}()
+
+	var buf bytes.Buffer
+	dump, err := NewPacketDump(&buf)
+	if err != nil {
+		t.Fatalf("NewPacketDump: %v", err)
+	}
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt, PacketDump: dump},
+	}
+	conn, _, _, err := NewClientConn(ctx, c2, "", clientConf)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("NewServerConn: %v", err)
+	}
+	conn.Close()
+	if err := dump.Err(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	packets, err := ReadPacketDump(&buf)
+	if err != nil {
+		t.Fatalf("ReadPacketDump: %v", err)
+	}
+	// The service request goes out encrypted, but is dumped in the
+	// clear.
+	var sawKexInit, sawNewKeys, sawService bool
+	for _, p := range packets {
+		switch p.Packet[0] {
+		case msgKexInit:
+			sawKexInit = sawKexInit || p.Sent
+		case msgNewKeys:
+			sawNewKeys = sawNewKeys || !p.Sent
+		case msgServiceRequest:
+			var msg serviceRequestMsg
+			if err := Unmarshal(p.Packet, &msg); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			sawService = p.Sent && msg.Service == serviceUserAuth
+		}
+		if p.Time.IsZero() {
+			t.Errorf("packet %d has no time", p.Packet[0])
+		}
+	}
+	if !sawKexInit || !sawNewKeys || !sawService {
+		t.Errorf("got kexinit %v, newkeys %v, service request %v, want all", sawKexInit, sawNewKeys, sawService)
+	}
+}
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// maxPadding is the most padding a packet can have, as its length is
+// sent in a byte.
+const maxPadding = 255
+
+// A PaddingPolicy returns how many bytes of padding to add to a
+// packet with n bytes of payload, beyond the least its cipher needs.
+// Padding hides the exact lengths of the packets, which otherwise
+// tell much about the protocol tunneled in them, such as the lengths
+// of the requests and responses of a web site. The packet is padded
+// as the cipher would pad one with n plus that many bytes of payload,
+// so payloads that the policy pads to the same length give packets of
+// the same length; the padding is cut to keep it within 255 bytes.
+// Each byte of padding costs a byte of bandwidth, so the policy trades
+// throughput for privacy.
+type PaddingPolicy func(n int) int
+
+// RandomPadding returns a PaddingPolicy that adds from 0 to max bytes
+// of padding, at random, to each packet. On average it costs max/2
+// bytes per packet; max is at most 255.
+func RandomPadding(max int) PaddingPolicy {
+	if max > maxPadding {
+		max = maxPadding
+	}
+	return func(n int) int {
+		if max <= 0 {
+			return 0
+		}
+		var b [2]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(b[:])) % (max + 1)
+	}
+}
+
+// BucketPadding returns a PaddingPolicy that pads the payload of
+// each packet up to a multiple of size bytes, so that packets whose
+// payloads fall in the same bucket of size bytes are as long. As the
+// padding of a packet is at most 255 bytes, size is at most 256.
+func BucketPadding(size int) PaddingPolicy {
+	if size > maxPadding+1 {
+		size = maxPadding + 1
+	}
+	return func(n int) int {
+		if size <= 1 {
+			return 0
+		}
+		return (size - n%size) % size
+	}
+}
+
+// pad returns the padding of a packet with n bytes of payload, whose
+// cipher needs least bytes of padding, in multiples of block bytes.
+func (p PaddingPolicy) pad(n, least, block int) int {
+	if p == nil {
+		return least
+	}
+	extra := p(n)
+	if extra <= 0 {
+		return least
+	}
+	// Pad as the cipher would a payload of n+extra bytes: the least
+	// padding of that is least-extra, modulo block, and at least 4.
+	more := ((least-extra)%block + block) % block
+	if more < 4 {
+		more += block
+	}
+	padding := extra + more
+	for padding > maxPadding {
+		padding -= block
+	}
+	if padding < least {
+		return least
+	}
+	return padding
+}
+
+// paddedCipher is a packetCipher whose padding a PaddingPolicy can
+// lengthen.
+type paddedCipher interface {
+	setPadding(p PaddingPolicy)
+}
+
+// withPadding sets the PaddingPolicy of ciph, if it takes one.
+func withPadding(ciph packetCipher, p PaddingPolicy) packetCipher {
+	if c, ok := ciph.(paddedCipher); ok && p != nil {
+		c.setPadding(p)
+	}
+	return ciph
+}
+
+func (s *streamPacketCipher) setPadding(p PaddingPolicy) { s.paddingPolicy = p }
+func (c *gcmCipher) setPadding(p PaddingPolicy)          { c.paddingPolicy = p }
+func (c *cbcCipher) setPadding(p PaddingPolicy)          { c.paddingPolicy = p }
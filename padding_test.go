@@ -0,0 +1,218 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"io"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPaddingPolicyPad(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var none PaddingPolicy
+	if got := none.pad(10, 5, 16); got != 5 {
+		t.Errorf("nil policy: pad = %d, want 5", got)
+	}
+	for _, tc := range []struct{ size, n, least, block, want int }{
+		{64, 10, 5, 16, 69},   // padded as 64 bytes of payload
+		{64, 11, 4, 16, 68},   // as long a packet as the last
+		{64, 64, 11, 16, 11},  // already on a bucket
+		{64, 60, 7, 8, 15},    // 4 extra, and 11 for 64 bytes
+		{256, 1, 14, 16, 254}, // cut to 255 bytes, less a block
+		{64, 1, 250, 16, 250}, // never less than the least
+	} {
+		if got := BucketPadding(tc.size).pad(tc.n, tc.least, tc.block); got != tc.want {
+			t.Errorf("BucketPadding(%d).pad(%d, %d, %d) = %d, want %d", tc.size, tc.n, tc.least, tc.block, got, tc.want)
+		}
+	}
+
+	random := RandomPadding(1000)
+	seen := map[int]bool{}
+	for i := 0; i < 200; i++ {
+		p := random.pad(10, 5, 16)
+		if p < 5 || p > maxPadding || (p-5)%16 != 0 {
+			t.Fatalf("RandomPadding pad = %d, out of range", p)
+		}
+		seen[p] = true
+	}
+	if len(seen) < 4 {
+		t.Errorf("RandomPadding gave %d distinct paddings in 200 packets", len(seen))
+	}
+}
+
+func TestPacketCiphersPadding(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	cipherModes[aes128cbcID] = &streamCipherMode{16, aes.BlockSize, 0, nil}
+	defer delete(cipherModes, aes128cbcID)
+
+	for cipher := range cipherModes {
+		for _, mac := range []string{"hmac-sha2-256", "hmac-sha2-256-etm@openssh.com"} {
+			kr := &kexResult{Hash: crypto.SHA1}
+			algs := directionAlgorithms{Cipher: cipher, MAC: mac, Compression: "none"}
+			plain, err := newPacketCipher(clientKeys, algs, kr)
+			if err != nil {
+				t.Fatalf("newPacketCipher(%q, %q): %v", cipher, mac, err)
+			}
+			padded, _ := newPacketCipher(clientKeys, algs, kr)
+			padded = withPadding(padded, RandomPadding(maxPadding))
+			reader, _ := newPacketCipher(clientKeys, algs, kr)
+
+			longer := 0
+			for i := 0; i < 50; i++ {
+				want := bytes.Repeat([]byte{'x'}, 1+i)
+				var short, buf bytes.Buffer
+				if err := plain.writePacket(uint32(i), &short, rand.Reader, append([]byte(nil), want...)); err != nil {
+					t.Fatalf("writePacket(%q, %q): %v", cipher, mac, err)
+				}
+				if err := padded.writePacket(uint32(i), &buf, rand.Reader, append([]byte(nil), want...)); err != nil {
+					t.Fatalf("padded writePacket(%q, %q): %v", cipher, mac, err)
+				}
+				if buf.Len() < short.Len() {
+					t.Fatalf("%q, %q: padded packet of %d bytes shorter than %d", cipher, mac, buf.Len(), short.Len())
+				}
+				if buf.Len() > short.Len() {
+					longer++
+				}
+				got, err := reader.readPacket(uint32(i), &buf)
+				if err != nil {
+					t.Fatalf("readPacket(%q, %q): %v", cipher, mac, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%q, %q: read %q, want %q", cipher, mac, got, want)
+				}
+			}
+			if longer < 25 {
+				t.Errorf("%q, %q: only %d of 50 packets padded", cipher, mac, longer)
+			}
+		}
+	}
+}
+
+func TestBucketPaddingPacketLength(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	cipherModes[aes128cbcID] = &streamCipherMode{16, aes.BlockSize, 0, nil}
+	defer delete(cipherModes, aes128cbcID)
+
+	const size = 64
+	for cipher := range cipherModes {
+		for _, mac := range []string{"hmac-sha2-256", "hmac-sha2-256-etm@openssh.com"} {
+			kr := &kexResult{Hash: crypto.SHA1}
+			algs := directionAlgorithms{Cipher: cipher, MAC: mac, Compression: "none"}
+			padded, err := newPacketCipher(clientKeys, algs, kr)
+			if err != nil {
+				t.Fatalf("newPacketCipher(%q, %q): %v", cipher, mac, err)
+			}
+			padded = withPadding(padded, BucketPadding(size))
+
+			// Every payload of a bucket gives a packet as long
+			// as the others.
+			var want [3]int
+			for n := 1; n <= 3*size; n++ {
+				var buf bytes.Buffer
+				if err := padded.writePacket(uint32(n), &buf, rand.Reader, bytes.Repeat([]byte{'x'}, n)); err != nil {
+					t.Fatalf("writePacket(%q, %q): %v", cipher, mac, err)
+				}
+				b := (n - 1) / size
+				if want[b] == 0 {
+					want[b] = buf.Len()
+				}
+				if buf.Len() != want[b] {
+					t.Fatalf("%q, %q: %d bytes of payload sent in %d bytes, %d sent in %d", cipher, mac, n, buf.Len(), b*size+1, want[b])
+				}
+			}
+		}
+	}
+}
+
+func TestConfigPadding(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	sent := func(padding PaddingPolicy) int64 {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+
+		serverConf := &ServerConfig{
+			NoClientAuth: true,
+			Config:       Config{Halt: NewHalter(), Padding: padding},
+		}
+		serverConf.AddHostKey(testSigners["ecdsa"])
+		defer serverConf.Halt.RequestStop()
+		// DiscardRequests returns only when ctx is done.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+			if err != nil {
+				return
+			}
+			go DiscardRequests(ctx, reqs, nil)
+			for newCh := range chans {
+				ch, reqs, err := newCh.Accept()
+				if err != nil {
+					continue
+				}
+				go DiscardRequests(ctx, reqs, nil)
+				go func() {
+					io.Copy(ch, ch)
+					ch.Close()
+				}()
+			}
+		}()
+
+		clientConf := &ClientConfig{
+			User:            "user",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter(), Padding: padding},
+		}
+		defer clientConf.Halt.RequestStop()
+		counted := &countingConn{Conn: c2}
+		conn, chans, reqs, err := NewClientConn(ctx, counted, "", clientConf)
+		if err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+		defer conn.Close()
+		go DiscardRequests(ctx, reqs, nil)
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(Prohibited, "no")
+			}
+		}()
+
+		ch, in, err := conn.OpenChannel(ctx, "echo", nil, nil)
+		if err != nil {
+			t.Fatalf("OpenChannel: %v", err)
+		}
+		go DiscardRequests(ctx, in, nil)
+		before := atomic.LoadInt64(&counted.written)
+		for i := 0; i < 100; i++ {
+			if _, err := ch.Write([]byte{'k'}); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			var b [1]byte
+			if _, err := io.ReadFull(ch, b[:]); err != nil || b[0] != 'k' {
+				t.Fatalf("echo: %q, %v", b, err)
+			}
+		}
+		ch.Close()
+		return atomic.LoadInt64(&counted.written) - before
+	}
+
+	plain := sent(nil)
+	padded := sent(BucketPadding(256))
+	// Each keystroke packet of the plain connection is about 64
+	// bytes on the wire; padded to 256 bytes of payload, about 300.
+	if padded < 3*plain {
+		t.Errorf("sent %d bytes with padding, %d without; want at least three times as many", padded, plain)
+	}
+}
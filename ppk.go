@@ -0,0 +1,534 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ed25519"
+)
+
+// PuTTY keeps private keys in its own format, PPK, described in
+// appendix C of the PuTTY manual. Versions 2 and 3 are supported,
+// unencrypted or encrypted with aes256-cbc; the key of the latter is
+// derived from the passphrase with SHA-1 in version 2, and with
+// Argon2 in version 3.
+
+const (
+	ppkHeader     = "PuTTY-User-Key-File-"
+	ppkCipherNone = "none"
+	ppkCipherAES  = "aes256-cbc"
+
+	// ppkMaxArgon2Memory bounds the memory, in KiB, a file may ask
+	// Argon2 to use, 1 GiB, against files made to exhaust it.
+	ppkMaxArgon2Memory = 1 << 20
+)
+
+// PPKOptions controls how MarshalPPK writes a key.
+type PPKOptions struct {
+	// Version is the PPK version, 2 or 3. Zero means 3, which
+	// PuTTY reads since version 0.75; older ones only read 2.
+	Version int
+
+	// Comment is stored in the file in clear.
+	Comment string
+
+	// Passphrase, if not empty, encrypts the key.
+	Passphrase []byte
+
+	// The Argon2id parameters of an encrypted version 3 file:
+	// memory in KiB, passes and lanes. Zero fields take PuTTY's
+	// defaults of 8192 KiB, 13 passes and 1 lane.
+	Argon2Memory      uint32
+	Argon2Passes      uint32
+	Argon2Parallelism uint8
+}
+
+// ParsePPK returns a Signer, and the comment, from a PuTTY private
+// key file. It supports the same keys as ParseRawPPK.
+func ParsePPK(in, passphrase []byte) (Signer, string, error) {
+	key, comment, err := ParseRawPPK(in, passphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return signer, comment, nil
+}
+
+// ParseRawPPK returns the private key, and the comment, from a
+// PuTTY private key file of version 2 or 3. It supports RSA, DSA,
+// ECDSA and Ed25519 keys, and returns them as ParseRawPrivateKey
+// does. The passphrase is ignored if the key is not encrypted; if it
+// is wrong, the error is x509.IncorrectPasswordError. Version 3
+// files derived with Argon2d are not supported.
+func ParseRawPPK(in, passphrase []byte) (key interface{}, comment string, err error) {
+	f, err := readPPK(in)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encrypted := f.encryption == ppkCipherAES
+	var cipherKey, iv, macKey []byte
+	var mac hash.Hash
+	switch f.version {
+	case 2:
+		cipherKey, macKey = ppkV2Keys(passphrase, encrypted)
+		iv = make([]byte, aes.BlockSize)
+		mac = hmac.New(sha1.New, macKey)
+	case 3:
+		if encrypted {
+			if cipherKey, iv, macKey, err = f.argon2Keys(passphrase); err != nil {
+				return nil, "", err
+			}
+		}
+		mac = hmac.New(sha256.New, macKey)
+	}
+
+	// The MAC covers the private blob as it is before encryption,
+	// padding included.
+	private := f.private
+	if encrypted {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, "", errors.New("ssh: PPK private key is not a whole number of blocks")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, "", err
+		}
+		private = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, f.private)
+	}
+
+	mac.Write(ppkMACData(f.algo, f.encryption, f.comment, f.public, private))
+	if subtle.ConstantTimeCompare(mac.Sum(nil), f.mac) != 1 {
+		if encrypted {
+			return nil, "", x509.IncorrectPasswordError
+		}
+		return nil, "", errors.New("ssh: PPK MAC mismatch")
+	}
+
+	key, err = parsePPKKey(f.algo, f.public, private)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, f.comment, nil
+}
+
+// ppkFile holds the fields of a PPK file.
+type ppkFile struct {
+	version    int
+	algo       string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+
+	// The key derivation of an encrypted version 3 file.
+	kdf         string
+	memory      uint32
+	passes      uint32
+	parallelism uint32
+	salt        []byte
+}
+
+// ppkReader reads the "Key: value" lines of a PPK file, in order.
+type ppkReader struct {
+	s   *bufio.Scanner
+	err error
+}
+
+// field reads the next line, which must be the field name.
+func (r *ppkReader) field(name string) string {
+	if r.err != nil {
+		return ""
+	}
+	if !r.s.Scan() {
+		r.err = fmt.Errorf("ssh: PPK file ends before %s", name)
+		return ""
+	}
+	line := strings.TrimRight(r.s.Text(), "\r")
+	value := strings.TrimPrefix(line, name+": ")
+	if value == line {
+		r.err = fmt.Errorf("ssh: PPK file has %q where %s was expected", line, name)
+		return ""
+	}
+	return value
+}
+
+// number reads the field name, a decimal number.
+func (r *ppkReader) number(name string) uint32 {
+	value := r.field(name)
+	if r.err != nil {
+		return 0
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		r.err = fmt.Errorf("ssh: PPK %s %q is not a number", name, value)
+	}
+	return uint32(n)
+}
+
+// hex reads the field name, in hexadecimal.
+func (r *ppkReader) hex(name string) []byte {
+	value := r.field(name)
+	if r.err != nil {
+		return nil
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		r.err = fmt.Errorf("ssh: PPK %s is not hexadecimal", name)
+	}
+	return b
+}
+
+// lines reads the count field name and the base64 lines that follow.
+func (r *ppkReader) lines(name string) []byte {
+	n := r.number(name)
+	if r.err != nil {
+		return nil
+	}
+	var text strings.Builder
+	for i := uint32(0); i < n; i++ {
+		if !r.s.Scan() {
+			r.err = fmt.Errorf("ssh: PPK file ends in %s", name)
+			return nil
+		}
+		text.WriteString(strings.TrimRight(r.s.Text(), "\r"))
+	}
+	b, err := base64.StdEncoding.DecodeString(text.String())
+	if err != nil {
+		r.err = fmt.Errorf("ssh: PPK %s: %v", name, err)
+	}
+	return b
+}
+
+// readPPK splits a PPK file into its fields.
+func readPPK(in []byte) (*ppkFile, error) {
+	var f ppkFile
+	if !bytes.HasPrefix(in, []byte(ppkHeader)) {
+		return nil, errors.New("ssh: not a PuTTY private key file")
+	}
+	s := bufio.NewScanner(bytes.NewReader(in))
+	if !s.Scan() {
+		return nil, errors.New("ssh: not a PuTTY private key file")
+	}
+	header := strings.TrimRight(s.Text(), "\r")
+	parts := strings.SplitN(strings.TrimPrefix(header, ppkHeader), ": ", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ssh: bad PPK header %q", header)
+	}
+	switch version := parts[0]; version {
+	case "2":
+		f.version = 2
+	case "3":
+		f.version = 3
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PPK version %q", version)
+	}
+	f.algo = parts[1]
+
+	r := &ppkReader{s: s}
+	f.encryption = r.field("Encryption")
+	f.comment = r.field("Comment")
+	f.public = r.lines("Public-Lines")
+	if r.err == nil && f.version == 3 && f.encryption != ppkCipherNone {
+		f.kdf = r.field("Key-Derivation")
+		f.memory = r.number("Argon2-Memory")
+		f.passes = r.number("Argon2-Passes")
+		f.parallelism = r.number("Argon2-Parallelism")
+		f.salt = r.hex("Argon2-Salt")
+	}
+	f.private = r.lines("Private-Lines")
+	f.mac = r.hex("Private-MAC")
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if f.encryption != ppkCipherNone && f.encryption != ppkCipherAES {
+		return nil, fmt.Errorf("ssh: unsupported PPK encryption %q", f.encryption)
+	}
+	return &f, nil
+}
+
+// ppkMACData returns what the MAC of a PPK file covers.
+func ppkMACData(algo, encryption, comment string, public, private []byte) []byte {
+	var b []byte
+	b = appendString(b, algo)
+	b = appendString(b, encryption)
+	b = appendString(b, comment)
+	b = appendU32(b, uint32(len(public)))
+	b = append(b, public...)
+	b = appendU32(b, uint32(len(private)))
+	b = append(b, private...)
+	return b
+}
+
+// ppkV2Keys derives the AES key, if encrypted, and the MAC key of a
+// version 2 file from the passphrase.
+func ppkV2Keys(passphrase []byte, encrypted bool) (cipherKey, macKey []byte) {
+	if !encrypted {
+		passphrase = nil
+	}
+	h := sha1.New()
+	h.Write([]byte("putty-private-key-file-mac-key"))
+	h.Write(passphrase)
+	macKey = h.Sum(nil)
+	if encrypted {
+		for i := uint32(0); i < 2; i++ {
+			h.Reset()
+			binary.Write(h, binary.BigEndian, i)
+			h.Write(passphrase)
+			cipherKey = h.Sum(cipherKey)
+		}
+		cipherKey = cipherKey[:32]
+	}
+	return cipherKey, macKey
+}
+
+// argon2Keys derives the AES key, IV and MAC key of an encrypted
+// version 3 file from the passphrase.
+func (f *ppkFile) argon2Keys(passphrase []byte) (cipherKey, iv, macKey []byte, err error) {
+	if f.memory > ppkMaxArgon2Memory {
+		return nil, nil, nil, fmt.Errorf("ssh: PPK Argon2-Memory %d is too large", f.memory)
+	}
+	if f.passes == 0 || f.parallelism == 0 || f.parallelism > 255 {
+		return nil, nil, nil, errors.New("ssh: bad PPK Argon2 parameters")
+	}
+	var out []byte
+	switch f.kdf {
+	case "Argon2id":
+		out = argon2.IDKey(passphrase, f.salt, f.passes, f.memory, uint8(f.parallelism), 80)
+	case "Argon2i":
+		out = argon2.Key(passphrase, f.salt, f.passes, f.memory, uint8(f.parallelism), 80)
+	default:
+		return nil, nil, nil, fmt.Errorf("ssh: unsupported PPK key derivation %q", f.kdf)
+	}
+	return out[:32], out[32:48], out[48:], nil
+}
+
+// parsePPKKey builds the private key of type algo from the public
+// and private blobs of a PPK file.
+func parsePPKKey(algo string, public, private []byte) (interface{}, error) {
+	pub, err := ParsePublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Type() != algo {
+		return nil, fmt.Errorf("ssh: PPK key type %q does not match its public key %q", algo, pub.Type())
+	}
+
+	switch pub := pub.(type) {
+	case *rsaPublicKey:
+		var k struct {
+			D, P, Q, Iqmp *big.Int
+			Rest          []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey(*pub),
+			D:         k.D,
+			Primes:    []*big.Int{k.P, k.Q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case *dsaPublicKey:
+		var k struct {
+			X    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if new(big.Int).Exp(pub.G, k.X, pub.P).Cmp(pub.Y) != 0 {
+			return nil, errors.New("ssh: PPK private key does not match its public key")
+		}
+		return &dsa.PrivateKey{PublicKey: dsa.PublicKey(*pub), X: k.X}, nil
+	case *ecdsaPublicKey:
+		var k struct {
+			D    *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		x, y := pub.Curve.ScalarBaseMult(k.D.Bytes())
+		if x.Cmp(pub.X) != 0 || y.Cmp(pub.Y) != 0 {
+			return nil, errors.New("ssh: PPK private key does not match its public key")
+		}
+		return &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey(*pub), D: k.D}, nil
+	case ed25519PublicKey:
+		var k struct {
+			Seed []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := Unmarshal(private, &k); err != nil {
+			return nil, err
+		}
+		if len(k.Seed) != ed25519.SeedSize {
+			return nil, errors.New("ssh: private key unexpected length")
+		}
+		key := ed25519.NewKeyFromSeed(k.Seed)
+		if !bytes.Equal(key[ed25519.SeedSize:], pub) {
+			return nil, errors.New("ssh: PPK private key does not match its public key")
+		}
+		return &key, nil
+	default:
+		return nil, fmt.Errorf("ssh: unsupported PPK key type %q", algo)
+	}
+}
+
+// MarshalPPK returns key, an *rsa.PrivateKey, *dsa.PrivateKey,
+// *ecdsa.PrivateKey or ed25519.PrivateKey, as a PuTTY private key
+// file, written as opts asks; nil opts writes an unencrypted
+// version 3 file without a comment.
+func MarshalPPK(key interface{}, opts *PPKOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &PPKOptions{}
+	}
+	version := opts.Version
+	if version == 0 {
+		version = 3
+	}
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("ssh: unsupported PPK version %d", version)
+	}
+
+	var private []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("ssh: PPK only holds RSA keys of two primes")
+		}
+		k.Precompute()
+		private = Marshal(&struct{ D, P, Q, Iqmp *big.Int }{k.D, k.Primes[0], k.Primes[1], k.Precomputed.Qinv})
+	case *dsa.PrivateKey:
+		private = Marshal(&struct{ X *big.Int }{k.X})
+	case *ecdsa.PrivateKey:
+		private = Marshal(&struct{ D *big.Int }{k.D})
+	case ed25519.PrivateKey:
+		private = Marshal(&struct{ Seed []byte }{k[:ed25519.SeedSize]})
+	case *ed25519.PrivateKey:
+		return MarshalPPK(*k, opts)
+	default:
+		return nil, fmt.Errorf("ssh: unsupported key type %T", key)
+	}
+	signer, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub := signer.PublicKey()
+	public := pub.Marshal()
+
+	encryption := ppkCipherNone
+	var f ppkFile
+	var cipherKey, iv, macKey []byte
+	var mac hash.Hash
+	if len(opts.Passphrase) > 0 {
+		encryption = ppkCipherAES
+		// Pad to whole blocks, with a hash of the key rather than
+		// anything guessable.
+		sum := sha1.Sum(private)
+		private = append(private, sum[:(aes.BlockSize-len(private)%aes.BlockSize)%aes.BlockSize]...)
+	}
+	switch version {
+	case 2:
+		cipherKey, macKey = ppkV2Keys(opts.Passphrase, encryption == ppkCipherAES)
+		iv = make([]byte, aes.BlockSize)
+		mac = hmac.New(sha1.New, macKey)
+	case 3:
+		if encryption == ppkCipherAES {
+			f = ppkFile{
+				kdf:         "Argon2id",
+				memory:      opts.Argon2Memory,
+				passes:      opts.Argon2Passes,
+				parallelism: uint32(opts.Argon2Parallelism),
+				salt:        make([]byte, 16),
+			}
+			if f.memory == 0 {
+				f.memory = 8192
+			}
+			if f.passes == 0 {
+				f.passes = 13
+			}
+			if f.parallelism == 0 {
+				f.parallelism = 1
+			}
+			if _, err := rand.Read(f.salt); err != nil {
+				return nil, err
+			}
+			if cipherKey, iv, macKey, err = f.argon2Keys(opts.Passphrase); err != nil {
+				return nil, err
+			}
+		}
+		mac = hmac.New(sha256.New, macKey)
+	}
+	mac.Write(ppkMACData(pub.Type(), encryption, opts.Comment, public, private))
+	if encryption == ppkCipherAES {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(private, private)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s%d: %s\n", ppkHeader, version, pub.Type())
+	fmt.Fprintf(&b, "Encryption: %s\n", encryption)
+	fmt.Fprintf(&b, "Comment: %s\n", opts.Comment)
+	writePPKLines(&b, "Public-Lines", public)
+	if f.kdf != "" {
+		fmt.Fprintf(&b, "Key-Derivation: %s\n", f.kdf)
+		fmt.Fprintf(&b, "Argon2-Memory: %d\n", f.memory)
+		fmt.Fprintf(&b, "Argon2-Passes: %d\n", f.passes)
+		fmt.Fprintf(&b, "Argon2-Parallelism: %d\n", f.parallelism)
+		fmt.Fprintf(&b, "Argon2-Salt: %x\n", f.salt)
+	}
+	writePPKLines(&b, "Private-Lines", private)
+	fmt.Fprintf(&b, "Private-MAC: %x\n", mac.Sum(nil))
+	return b.Bytes(), nil
+}
+
+// writePPKLines writes data in base64, 64 characters to the line,
+// after a count of the lines.
+func writePPKLines(b *bytes.Buffer, name string, data []byte) {
+	text := base64.StdEncoding.EncodeToString(data)
+	fmt.Fprintf(b, "%s: %d\n", name, (len(text)+63)/64)
+	for len(text) > 0 {
+		n := len(text)
+		if n > 64 {
+			n = 64
+		}
+		b.WriteString(text[:n])
+		b.WriteByte('\n')
+		text = text[n:]
+	}
+}
@@ -0,0 +1,259 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// AuthorizedPrincipal is an entry of an authorized_principals file,
+// see AuthorizedPrincipalsFile in sshd_config(5).
+type AuthorizedPrincipal struct {
+	// Name is the principal, which must be among the
+	// ValidPrincipals of a user certificate.
+	Name string
+
+	// Options are the authorized_keys options that precede the
+	// name, such as `from="10.0.0.0/8"` or "no-pty".
+	Options []string
+}
+
+// ParseAuthorizedPrincipals parses the contents of an
+// authorized_principals file: one principal per line, optionally
+// preceded by comma-separated options as in authorized_keys. Empty
+// lines and lines starting with '#' are skipped.
+func ParseAuthorizedPrincipals(in []byte) ([]AuthorizedPrincipal, error) {
+	ps := []AuthorizedPrincipal{}
+	for n, line := range bytes.Split(in, []byte("\n")) {
+		line = bytes.TrimSpace(bytes.TrimSuffix(line, []byte("\r")))
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		opts, name, err := splitPrincipalLine(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("ssh: authorized_principals line %d: %v", n+1, err)
+		}
+		ps = append(ps, AuthorizedPrincipal{Name: name, Options: opts})
+	}
+	return ps, nil
+}
+
+// splitPrincipalLine splits a line into its options and principal.
+func splitPrincipalLine(line string) (options []string, name string, err error) {
+	inQuote := false
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch b := line[i]; {
+		case b == '"' && (i == 0 || line[i-1] != '\\'):
+			inQuote = !inQuote
+		case b == ',' && !inQuote:
+			options = append(options, line[start:i])
+			start = i + 1
+		case (b == ' ' || b == '\t') && !inQuote:
+			options = append(options, line[start:i])
+			name = strings.TrimSpace(line[i:])
+			if strings.ContainsAny(name, " \t") {
+				return nil, "", fmt.Errorf("bad principal %q", name)
+			}
+			return options, name, nil
+		}
+	}
+	if inQuote {
+		return nil, "", fmt.Errorf("unmatched quote")
+	}
+	return nil, line, nil
+}
+
+// AuthorizedPrincipalsFile returns a function for
+// CertChecker.AuthorizedPrincipals that reads the file named by
+// pattern, in which %u stands for the user name and %% for a
+// percent sign. A missing file yields no principals, so that the
+// user name is checked instead, as sshd does.
+func AuthorizedPrincipalsFile(pattern string) func(user string) ([]AuthorizedPrincipal, error) {
+	return func(user string) ([]AuthorizedPrincipal, error) {
+		if strings.ContainsAny(user, "/\x00") || user == "." || user == ".." {
+			return nil, fmt.Errorf("ssh: bad user name %q", user)
+		}
+		name := strings.NewReplacer("%%", "%", "%u", user).Replace(pattern)
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ParseAuthorizedPrincipals(data)
+	}
+}
+
+// matchPrincipal returns the first entry of ps that is a principal
+// of cert.
+func matchPrincipal(ps []AuthorizedPrincipal, cert *Certificate) *AuthorizedPrincipal {
+	for i := range ps {
+		for _, p := range cert.ValidPrincipals {
+			if ps[i].Name == p {
+				return &ps[i]
+			}
+		}
+	}
+	return nil
+}
+
+// permitOptions maps the authorized_keys options that grant a
+// permission to the certificate extension for it.
+var permitOptions = map[string]string{
+	"pty":              "permit-pty",
+	"port-forwarding":  "permit-port-forwarding",
+	"agent-forwarding": "permit-agent-forwarding",
+	"x11-forwarding":   "permit-X11-forwarding",
+	"user-rc":          "permit-user-rc",
+}
+
+// carriedOptions are the authorized_keys options that permissions
+// passes on as critical options of the same name, for the
+// application to enforce, with the separator joining repeats. They
+// must be listed in CertChecker.SupportedCriticalOptions, so that
+// a restriction no one enforces refuses the login instead.
+var carriedOptions = map[string]string{
+	"environment":  "\n",
+	"permitopen":   ",",
+	"permitlisten": ",",
+	"tunnel":       ",",
+}
+
+// permissions applies the options of p to perms, the permissions
+// of the certificate, and returns the result. Options can only take
+// away what the certificate permits, except for environment, which
+// is carried to the application with permitopen, permitlisten and
+// tunnel, see carriedOptions. The login is refused after
+// expiry-time, a time in the local time zone, or UTC with a "Z"
+// suffix, and unless the client address matches from, see
+// matchAddrPatterns.
+func (p *AuthorizedPrincipal) permissions(conn ConnMetadata, perms *Permissions, now time.Time, supported []string) (*Permissions, error) {
+	out := &Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+		CertValues:      perms.CertValues,
+		Quota:           perms.Quota,
+	}
+	for k, v := range perms.CriticalOptions {
+		out.CriticalOptions[k] = v
+	}
+	for k, v := range perms.Extensions {
+		out.Extensions[k] = v
+	}
+
+	for _, opt := range p.Options {
+		name, value := strings.ToLower(opt), ""
+		if i := strings.IndexByte(opt, '='); i >= 0 {
+			name = strings.ToLower(opt[:i])
+			value = strings.Replace(strings.Trim(opt[i+1:], `"`), `\"`, `"`, -1)
+		}
+		if ext, ok := permitOptions[strings.TrimPrefix(name, "no-")]; ok {
+			if strings.HasPrefix(name, "no-") {
+				delete(out.Extensions, ext)
+			} else if v, ok := perms.Extensions[ext]; ok {
+				out.Extensions[ext] = v
+			}
+			continue
+		}
+		if sep, ok := carriedOptions[name]; ok {
+			if !contains(supported, name) {
+				return nil, fmt.Errorf("ssh: authorized_principals option %q is not in SupportedCriticalOptions", name)
+			}
+			if old, ok := out.CriticalOptions[name]; ok {
+				value = old + sep + value
+			}
+			out.CriticalOptions[name] = value
+			continue
+		}
+		switch name {
+		case "from":
+			if err := matchAddrPatterns(conn.RemoteAddr(), value); err != nil {
+				return nil, err
+			}
+		case "command":
+			if old, ok := out.CriticalOptions[forceCommandCriticalOption]; ok && old != value {
+				return nil, fmt.Errorf("ssh: certificate and authorized principal force different commands")
+			}
+			out.CriticalOptions[forceCommandCriticalOption] = value
+		case "restrict":
+			for _, ext := range permitOptions {
+				delete(out.Extensions, ext)
+			}
+		case "expiry-time":
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			if now.After(expiry) {
+				return nil, fmt.Errorf("ssh: authorized principal %q expired at %v", p.Name, expiry)
+			}
+		default:
+			return nil, fmt.Errorf("ssh: unsupported authorized_principals option %q", name)
+		}
+	}
+	return out, nil
+}
+
+// parseExpiryTime parses the YYYYMMDD[HHMM[SS]] value of an
+// expiry-time option.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		value, loc = value[:len(value)-1], time.UTC
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("ssh: bad expiry-time %q", value)
+	}
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("ssh: bad expiry-time %q", value)
+	}
+	return t, nil
+}
+
+// matchAddrPatterns checks addr against the pattern-list of a from
+// option: addresses, CIDR blocks and patterns in which '*' and '?'
+// are wildcards, any of them negated by a leading '!'. The address
+// must match an entry and no negated one. As with sshd's default of
+// UseDNS no, host names are not looked up, so patterns only match
+// the address: "*.example.com" matches no client.
+func matchAddrPatterns(addr net.Addr, patterns string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("ssh: remote address %v is not a TCP address when checking from", addr)
+	}
+	ip := tcpAddr.IP.String()
+	matched := false
+	for _, pat := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pat, "!")
+		pat = strings.TrimPrefix(pat, "!")
+		var m bool
+		if strings.Contains(pat, "/") {
+			_, ipNet, err := net.ParseCIDR(pat)
+			if err != nil {
+				return fmt.Errorf("ssh: error parsing from restriction %q: %v", pat, err)
+			}
+			m = ipNet.Contains(tcpAddr.IP)
+		} else if allowed := net.ParseIP(pat); allowed != nil {
+			m = allowed.Equal(tcpAddr.IP)
+		} else {
+			m = hostPatternMatch(strings.ToLower(pat), ip)
+		}
+		if m && negated {
+			return fmt.Errorf("ssh: remote address %v is denied by from restriction", addr)
+		}
+		matched = matched || m
+	}
+	if !matched {
+		return fmt.Errorf("ssh: remote address %v is not allowed because of from restriction", addr)
+	}
+	return nil
+}
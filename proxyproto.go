@@ -0,0 +1,253 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyProtocolPolicy tells a server whether connections start with
+// a PROXY protocol header, as sent by HAProxy and many cloud load
+// balancers, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+type ProxyProtocolPolicy int
+
+const (
+	// ProxyProtocolOff treats every connection as plain SSH.
+	ProxyProtocolOff ProxyProtocolPolicy = iota
+
+	// ProxyProtocolOptional parses a PROXY header if there is
+	// one. The server then waits for the client's first byte
+	// before sending its version, which clients that wait for
+	// the server's version first cannot handle.
+	ProxyProtocolOptional
+
+	// ProxyProtocolRequired refuses connections without a PROXY
+	// header.
+	ProxyProtocolRequired
+)
+
+// proxyV2Sig starts a version 2 PROXY header.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// maxProxyV1Line is the longest version 1 header, with CRLF.
+	maxProxyV1Line = 107
+
+	// maxProxyV2Body caps the addresses and TLVs of a version 2
+	// header; they are at most 216 bytes for AF_UNIX, plus TLVs.
+	maxProxyV2Body = 4096
+)
+
+var (
+	errNoProxyHeader      = errors.New("ssh: missing PROXY protocol header")
+	errProxyHeaderTimeout = errors.New("ssh: timeout waiting for PROXY protocol header")
+)
+
+// proxyConn is a net.Conn whose addresses come from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// defaultProxyHeaderTimeout is used if ProxyHeaderTimeout is zero.
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// readProxyHeader reads the PROXY header at the start of c, if the
+// policy calls for one, and returns a conn that reports the client
+// and destination addresses from it. The addresses of c are kept
+// for headers that carry none, such as health checks. The header
+// must arrive within timeout, as told by clock, and before ctx is
+// done; otherwise c is closed. The deadlines of c are left alone.
+func readProxyHeader(ctx context.Context, c net.Conn, policy ProxyProtocolPolicy, timeout time.Duration, clock Clock) (net.Conn, error) {
+	if policy == ProxyProtocolOff {
+		return c, nil
+	}
+	if timeout <= 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+
+	// state is 0 while the header is read, then 1 if the time ran
+	// out or ctx was done first, or 2 if the read ended first.
+	var state int32
+	expire := func() {
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			c.Close()
+		}
+	}
+	t := clockOr(clock).AfterFunc(timeout, expire)
+	defer t.Stop()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			expire()
+		case <-stop:
+		}
+	}()
+
+	pc, err := readProxyHeaderConn(c, policy)
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errProxyHeaderTimeout
+	}
+	return pc, err
+}
+
+// readProxyHeaderConn does the work of readProxyHeader, without
+// bounding it.
+func readProxyHeaderConn(c net.Conn, policy ProxyProtocolPolicy) (net.Conn, error) {
+	pc := &proxyConn{
+		Conn:   c,
+		r:      bufio.NewReaderSize(c, maxProxyV1Line),
+		remote: c.RemoteAddr(),
+		local:  c.LocalAddr(),
+	}
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		err = pc.readV1()
+	case proxyV2Sig[0]:
+		err = pc.readV2()
+	default:
+		if policy == ProxyProtocolRequired {
+			return nil, errNoProxyHeader
+		}
+		return pc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 parses a human-readable header, like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if len(line) > maxProxyV1Line {
+			return errors.New("ssh: PROXY header too long")
+		}
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return fmt.Errorf("ssh: bad PROXY header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("ssh: unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return fmt.Errorf("ssh: bad PROXY header %q", line)
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	if (src.IP.To4() != nil) != (fields[1] == "TCP4") {
+		return fmt.Errorf("ssh: PROXY address %s does not match %s", src.IP, fields[1])
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("ssh: bad PROXY address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: bad PROXY port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses a binary header.
+func (c *proxyConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) {
+		return errors.New("ssh: bad PROXY v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("ssh: unsupported PROXY version %d", hdr[12]>>4)
+	}
+	n := binary.BigEndian.Uint16(hdr[14:])
+	if n > maxProxyV2Body {
+		return errors.New("ssh: PROXY header too long")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	switch cmd := hdr[12] & 0xf; cmd {
+	case 0:
+		// LOCAL: the connection was made by the proxy itself.
+		return nil
+	case 1:
+		// PROXY
+	default:
+		return fmt.Errorf("ssh: unsupported PROXY command %d", cmd)
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// UDP or AF_UNIX: there is no TCP client to report.
+		return nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return errors.New("ssh: short PROXY v2 addresses")
+	}
+	c.remote = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	c.local = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return nil
+}
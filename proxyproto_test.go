@@ -0,0 +1,184 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufConn is a net.Conn reading from a buffer.
+type bufConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *bufConn) RemoteAddr() net.Addr       { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1} }
+func (c *bufConn) LocalAddr() net.Addr        { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 22} }
+func (c *bufConn) Close() error               { return nil }
+
+func (c *bufConn) SetReadDeadline(time.Time) error { return nil }
+
+func proxyV2Header(cmd, fam byte, addrs []byte) []byte {
+	h := append([]byte(nil), proxyV2Sig...)
+	h = append(h, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:], uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	v2addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 22}
+	for _, tt := range []struct {
+		name          string
+		policy        ProxyProtocolPolicy
+		in            string
+		remote, local string
+		wantErr       bool
+		wantRemaining string
+	}{
+		{"off", ProxyProtocolOff, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-", "10.0.0.1:1", "10.0.0.2:22", false, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-"},
+		{"v1 tcp4", ProxyProtocolRequired, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\nSSH-", "192.0.2.1:56324", "198.51.100.1:22", false, "SSH-"},
+		{"v1 tcp6", ProxyProtocolRequired, "PROXY TCP6 2001:db8::1 2001:db8::2 4000 22\r\nSSH-", "[2001:db8::1]:4000", "[2001:db8::2]:22", false, "SSH-"},
+		{"v1 unknown", ProxyProtocolRequired, "PROXY UNKNOWN\r\nSSH-", "10.0.0.1:1", "10.0.0.2:22", false, "SSH-"},
+		{"v1 family mismatch", ProxyProtocolRequired, "PROXY TCP4 2001:db8::1 2001:db8::2 4000 22\r\n", "", "", true, ""},
+		{"v1 garbage", ProxyProtocolRequired, "PROXY TCP4 nonsense\r\n", "", "", true, ""},
+		{"v2 tcp4", ProxyProtocolRequired, string(proxyV2Header(1, 0x11, v2addrs)) + "SSH-", "192.0.2.1:56324", "198.51.100.1:22", false, "SSH-"},
+		{"v2 local", ProxyProtocolRequired, string(proxyV2Header(0, 0, nil)) + "SSH-", "10.0.0.1:1", "10.0.0.2:22", false, "SSH-"},
+		{"v2 short", ProxyProtocolRequired, string(proxyV2Header(1, 0x11, v2addrs[:4])), "", "", true, ""},
+		{"missing", ProxyProtocolRequired, "SSH-2.0-x\r\n", "", "", true, ""},
+		{"optional missing", ProxyProtocolOptional, "SSH-2.0-x\r\n", "10.0.0.1:1", "10.0.0.2:22", false, "SSH-2.0-x\r\n"},
+	} {
+		c, err := readProxyHeader(context.Background(), &bufConn{r: bytes.NewReader([]byte(tt.in))}, tt.policy, 0, nil)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := c.RemoteAddr().String(); got != tt.remote {
+			t.Errorf("%s: remote %s, want %s", tt.name, got, tt.remote)
+		}
+		if got := c.LocalAddr().String(); got != tt.local {
+			t.Errorf("%s: local %s, want %s", tt.name, got, tt.local)
+		}
+		if rest, _ := ioutil.ReadAll(c); string(rest) != tt.wantRemaining {
+			t.Errorf("%s: remaining %q, want %q", tt.name, rest, tt.wantRemaining)
+		}
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	pipe := func() (net.Conn, net.Conn) {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		return c1, c2
+	}
+
+	// The client connects and sends nothing.
+	c1, c2 := pipe()
+	defer c2.Close()
+	clock := NewFakeClock(time.Now())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := readProxyHeader(context.Background(), c1, ProxyProtocolRequired, time.Minute, clock)
+		errc <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	if err := <-errc; err != errProxyHeaderTimeout {
+		t.Fatalf("readProxyHeader: %v, want %v", err, errProxyHeaderTimeout)
+	}
+	if _, err := c1.Write([]byte("x")); err == nil {
+		t.Error("conn still open after the timeout")
+	}
+
+	c1, c2 = pipe()
+	defer c1.Close()
+	defer c2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := readProxyHeader(ctx, c1, ProxyProtocolOptional, time.Minute, nil); err != context.Canceled {
+		t.Fatalf("readProxyHeader: %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("readProxyHeader took %v after ctx was canceled", d)
+	}
+
+	// The deadline of the caller is kept.
+	c1, c2 = pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c2.Write([]byte("PROXY UNKNOWN\r\nSSH-"))
+	c1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	pc, err := readProxyHeader(context.Background(), c1, ProxyProtocolRequired, time.Minute, nil)
+	if err != nil {
+		t.Fatalf("readProxyHeader: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(pc, buf); err != nil || string(buf) != "SSH-" {
+		t.Errorf("Read after the header: %q, %v", buf, err)
+	}
+	if _, err := pc.Read(buf); err == nil {
+		t.Fatal("Read succeeded with nothing sent")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read: %v, want the caller's deadline to expire", err)
+	}
+}
+
+func TestProxyProtocolRemoteAddr(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	addrs := make(chan string, 1)
+	serverConf := &ServerConfig{
+		ProxyProtocol: ProxyProtocolRequired,
+		PasswordCallback: func(conn ConnMetadata, password []byte) (*Permissions, error) {
+			addrs <- conn.RemoteAddr().String()
+			return nil, nil
+		},
+		Config: Config{Halt: NewHalter()},
+	}
+	serverConf.AddHostKey(testSigners["rsa"])
+	defer serverConf.Halt.RequestStop()
+	ctx := context.Background()
+	go newServer(ctx, c1, serverConf)
+
+	if _, err := c2.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 22\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	clientConf := &ClientConfig{
+		User:            "user",
+		Auth:            []AuthMethod{Password("pw")},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	if _, _, _, err := NewClientConn(ctx, c2, "", clientConf); err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	if got := <-addrs; got != "192.0.2.1:56324" {
+		t.Errorf("got remote address %s, want the one from the PROXY header", got)
+	}
+}
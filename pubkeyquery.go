@@ -0,0 +1,84 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// publicKeyQuery is the AuthMethod of PublicKeysQuery.
+type publicKeyQuery struct {
+	keys      []PublicKey
+	getSigner func(key PublicKey) (Signer, error)
+}
+
+// PublicKeysQuery returns an AuthMethod that asks the server which of
+// keys it would accept, with the signature-less queries of RFC 4252
+// section 7, before anything is signed, as OpenSSH does. getSigner is
+// called only for a key the server accepts, so that signing, which
+// may mean prompting for a hardware token or a passphrase, is only
+// done when it can succeed. It may return a nil Signer to pass on a
+// key, and the keys after it are queried then. Keys are queried in
+// order, until one authenticates.
+func PublicKeysQuery(keys []PublicKey, getSigner func(key PublicKey) (Signer, error)) AuthMethod {
+	return &publicKeyQuery{keys: keys, getSigner: getSigner}
+}
+
+func (q *publicKeyQuery) method() string {
+	return "publickey"
+}
+
+func (q *publicKeyQuery) auth(ctx context.Context, session []byte, user string, c packetConn, rand io.Reader) (bool, []string, error) {
+	var methods []string
+	for _, key := range q.keys {
+		algo := queryAlgorithm(key, c)
+		ok, err := validateKey(ctx, key, algo, user, c)
+		if err != nil {
+			return false, nil, err
+		}
+		if !ok {
+			continue
+		}
+		signer, err := q.getSigner(key)
+		if err != nil {
+			return false, nil, err
+		}
+		if signer == nil {
+			continue
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), key.Marshal()) {
+			return false, nil, errors.New("ssh: signer for a queried key has another key")
+		}
+		// The signer may not do the algorithm queried; the
+		// acceptance of the server holds for that one only.
+		if a := signatureAlgorithm(signer, c); a != algo {
+			algo = a
+			if ok, err = validateKey(ctx, key, algo, user, c); err != nil {
+				return false, nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		var success bool
+		success, methods, err = signPublicKeyAuth(ctx, session, user, signer, algo, c, rand)
+		if err != nil {
+			return false, nil, err
+		}
+		if success || !containsMethod(methods, q.method()) {
+			return success, methods, nil
+		}
+	}
+	return false, methods, nil
+}
+
+// queryAlgorithm returns the algorithm to query key with, that of a
+// signer that can do all the algorithms of the key.
+func queryAlgorithm(key PublicKey, c packetConn) string {
+	if key.Type() != KeyAlgoRSA {
+		return key.Type()
+	}
+	return rsaSignatureAlgorithm([]string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, SigAlgoRSA}, c)
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import "strings"
+
+// Quirks are workarounds for peers that mis-implement the protocol,
+// typically the SSH servers of embedded devices, which are rarely
+// updated. Those the peer needs are picked from a table of known
+// implementations, by the software version of its version line,
+// when the connection is set up; see Config.Quirks for overriding
+// them.
+type Quirks uint32
+
+const (
+	// QuirkNoRekey stops us from starting key exchanges after
+	// the first, for peers that hang or drop the connection when
+	// they get an SSH_MSG_KEXINIT. Key exchanges the peer starts
+	// still go through. The connection then never rekeys unless
+	// the peer does, so this weakens it over long sessions.
+	QuirkNoRekey Quirks = 1 << iota
+
+	// QuirkWindowOverflow caps the window the peer gives us at
+	// 2^32-1 bytes, for peers whose window adjustments overflow
+	// it, rather than failing the channel, as RFC 4254, section
+	// 5.2, asks.
+	QuirkWindowOverflow
+
+	// QuirkNoZeroWindowAdjust stops us from sending window
+	// adjustments of zero bytes, for peers that take them for a
+	// protocol error.
+	QuirkNoZeroWindowAdjust
+)
+
+// knownQuirks maps patterns of the software version of peers, in
+// which '*' matches any run of characters and '?' any one
+// character, to the quirks they need. The first match wins.
+var knownQuirks = []struct {
+	software string
+	quirks   Quirks
+}{
+	{"OpenSSH_2.*", QuirkNoRekey},
+	{"Cisco-1.*", QuirkNoRekey | QuirkWindowOverflow | QuirkNoZeroWindowAdjust},
+	{"dropbear_0.*", QuirkNoRekey | QuirkNoZeroWindowAdjust},
+	{"ROSSSH", QuirkNoRekey | QuirkWindowOverflow},
+}
+
+// QuirksFor returns the quirks of the table that the peer with the
+// given version needs.
+func QuirksFor(peer Version) Quirks {
+	for _, k := range knownQuirks {
+		if hostPatternMatch(k.software, peer.Software) {
+			return k.quirks
+		}
+	}
+	return 0
+}
+
+func (q Quirks) String() string {
+	if q == 0 {
+		return "none"
+	}
+	var names []string
+	for _, n := range []struct {
+		q    Quirks
+		name string
+	}{
+		{QuirkNoRekey, "no-rekey"},
+		{QuirkWindowOverflow, "window-overflow"},
+		{QuirkNoZeroWindowAdjust, "no-zero-window-adjust"},
+	} {
+		if q&n.q != 0 {
+			names = append(names, n.name)
+			q &^= n.q
+		}
+	}
+	if q != 0 {
+		names = append(names, "unknown")
+	}
+	return strings.Join(names, ",")
+}
+
+// setQuirks picks the quirks of the connection with a peer of the
+// given version, from the table and config.Quirks.
+func (c *Config) setQuirks(peer Version) {
+	c.quirks = c.Quirks
+	if !c.NoQuirkTable {
+		c.quirks |= QuirksFor(peer)
+	}
+}
@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQuirksFor(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, test := range []struct {
+		version string
+		want    Quirks
+	}{
+		{"SSH-2.0-OpenSSH_9.6", 0},
+		{"SSH-2.0-OpenSSH_2.5.2p2", QuirkNoRekey},
+		{"SSH-1.99-Cisco-1.25", QuirkNoRekey | QuirkWindowOverflow | QuirkNoZeroWindowAdjust},
+		{"SSH-2.0-dropbear_0.52", QuirkNoRekey | QuirkNoZeroWindowAdjust},
+		{"SSH-2.0-dropbear_2022.83", 0},
+		{"SSH-2.0-ROSSSH", QuirkNoRekey | QuirkWindowOverflow},
+		{"junk", 0},
+	} {
+		if got := QuirksFor(ParseVersion([]byte(test.version))); got != test.want {
+			t.Errorf("QuirksFor(%q) = %v, want %v", test.version, got, test.want)
+		}
+	}
+
+	if got, want := (QuirkNoRekey | QuirkNoZeroWindowAdjust).String(), "no-rekey,no-zero-window-adjust"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+
+	var c Config
+	c.setQuirks(ParseVersion([]byte("SSH-2.0-ROSSSH")))
+	if c.quirks != QuirkNoRekey|QuirkWindowOverflow {
+		t.Errorf("from the table: got %v", c.quirks)
+	}
+	c = Config{Quirks: QuirkNoZeroWindowAdjust, NoQuirkTable: true}
+	c.setQuirks(ParseVersion([]byte("SSH-2.0-ROSSSH")))
+	if c.quirks != QuirkNoZeroWindowAdjust {
+		t.Errorf("without the table: got %v", c.quirks)
+	}
+}
+
+func TestQuirkNoRekey(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	checker := &syncChecker{called: make(chan int, 10)}
+	clientConf := &ClientConfig{
+		HostKeyCallback: checker.Check,
+		Config:          Config{Halt: halt, quirks: QuirkNoRekey},
+	}
+	clientConf.RekeyThreshold = 500
+	trC, trS, err := handshakePair(clientConf, "addr", false)
+	if err != nil {
+		t.Fatalf("handshakePair: %v", err)
+	}
+	defer trC.Close()
+	defer trS.Close()
+	<-checker.called
+
+	input := make([]byte, 251)
+	input[0] = msgRequestSuccess
+	ctx := context.Background()
+	const numPacket = 10
+	for i := 0; i < numPacket; i++ {
+		p := make([]byte, len(input))
+		copy(p, input)
+		if err := trC.writePacket(p); err != nil {
+			t.Fatalf("writePacket: %v", err)
+		}
+		if p, err := trS.readPacket(ctx); err != nil {
+			t.Fatalf("readPacket: %v", err)
+		} else if !bytes.Equal(input, p) {
+			t.Errorf("got packet type %d, want %d", p[0], input[0])
+		}
+	}
+
+	select {
+	case <-checker.called:
+		t.Error("the client rekeyed past its threshold")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestQuirkWindowOverflow(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, quirks := range []Quirks{0, QuirkWindowOverflow} {
+		halt := NewHalter()
+		a, b, mux := channelPairConfig(t, halt, &Config{MaxChannelPacket: channelMaxPacket, quirks: quirks})
+
+		// The request is answered after the adjustment is handled.
+		a.sendMessage(windowAdjustMsg{AdditionalBytes: math.MaxUint32})
+		go func() {
+			for req := range b.incomingRequests {
+				req.Reply(true, nil)
+			}
+		}()
+		_, err := a.SendRequest("ping", true, nil)
+		if quirks == 0 && err == nil {
+			t.Error("an overflowing window adjustment was taken")
+		}
+		if quirks != 0 {
+			if err != nil {
+				t.Errorf("SendRequest with QuirkWindowOverflow: %v", err)
+			}
+			b.remoteWin.L.Lock()
+			if b.remoteWin.win != math.MaxUint32 {
+				t.Errorf("window %d, want 2^32-1", b.remoteWin.win)
+			}
+			b.remoteWin.L.Unlock()
+		}
+
+		a.Close()
+		b.Close()
+		mux.Close()
+		halt.RequestStop()
+	}
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Quota caps the resources used by the server connections whose
+// Permissions carry it. The counts live in the Quota, so connections
+// that share one share its limits: an authentication callback that
+// returns the same Quota for every login of a user limits the user,
+// however many connections they make. Zero fields are unlimited. The
+// limits must not be changed once the Quota is in use.
+type Quota struct {
+	// MaxSessions caps the "session" channels open at once.
+	MaxSessions int
+
+	// MaxForwards caps the forwarding channels open at once,
+	// "direct-tcpip" and "direct-streamlocal@openssh.com".
+	MaxForwards int
+
+	// MaxBandwidth caps the channel data read and written, taken
+	// together, in bytes per second.
+	MaxBandwidth int
+
+	mu       sync.Mutex
+	sessions int
+	forwards int
+	bucket   *RateLimiter
+}
+
+// quotaOf returns the Quota of perms, which may be nil.
+func quotaOf(perms *Permissions) *Quota {
+	if perms == nil {
+		return nil
+	}
+	return perms.Quota
+}
+
+// acquire takes a slot for a channel of type chanType, and returns
+// the function that gives it back, which may be called more than
+// once.
+func (q *Quota) acquire(chanType string) (release func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var count *int
+	var max int
+	switch chanType {
+	case "session":
+		count, max = &q.sessions, q.MaxSessions
+	case "direct-tcpip", "direct-streamlocal@openssh.com":
+		count, max = &q.forwards, q.MaxForwards
+	default:
+		return func() {}, nil
+	}
+	if max > 0 && *count >= max {
+		return nil, fmt.Errorf("ssh: too many %s channels", chanType)
+	}
+	*count++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			*count--
+			q.mu.Unlock()
+		})
+	}, nil
+}
+
+// rate returns the limiter MaxBandwidth is drawn from, or nil.
+func (q *Quota) rate() *RateLimiter {
+	if q.MaxBandwidth <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.bucket == nil {
+		q.bucket = NewRateLimiter(q.MaxBandwidth, 0)
+	}
+	return q.bucket
+}
@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQuotaSharedAcrossConnections(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	quota := &Quota{MaxSessions: 1}
+	perms := &Permissions{Quota: quota}
+	client1, halt1 := dialWithPermissions(t, perms, nil, nil)
+	defer halt1.RequestStop()
+	client2, halt2 := dialWithPermissions(t, perms, nil, nil)
+	defer halt2.RequestStop()
+	ctx := context.Background()
+
+	session, err := client1.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	_, err = client2.NewSession(ctx)
+	if open, ok := err.(*OpenChannelError); !ok || open.Reason != ResourceShortage {
+		t.Fatalf("second NewSession: got %v, want ResourceShortage", err)
+	}
+	if _, err := client1.NewSession(ctx); err == nil {
+		t.Fatal("NewSession on the same connection succeeded")
+	}
+
+	// The server handles the close before the next open.
+	session.Close()
+	session, err = client1.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession after Close: %v", err)
+	}
+	session.Close()
+}
+
+func TestQuotaIgnoresOtherChannels(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	q := &Quota{MaxSessions: 1, MaxForwards: 1}
+	for i := 0; i < 3; i++ {
+		if _, err := q.acquire("x11"); err != nil {
+			t.Fatalf("acquire x11: %v", err)
+		}
+	}
+	release, err := q.acquire("direct-tcpip")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := q.acquire("direct-streamlocal@openssh.com"); err == nil {
+		t.Fatal("second forward allowed")
+	}
+	release()
+	release()
+	if _, err := q.acquire("direct-tcpip"); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	if _, err := q.acquire("direct-tcpip"); err == nil {
+		t.Fatal("double release freed two slots")
+	}
+}
+
+func TestQuotaBandwidth(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	if r := (&Quota{MaxSessions: 1}).rate(); r != nil {
+		t.Fatal("rate limited without MaxBandwidth")
+	}
+	q := &Quota{MaxBandwidth: 100000}
+	r := q.rate()
+	if r == nil || q.rate() != r {
+		t.Fatal("channels of the Quota do not share one limiter")
+	}
+	start := time.Now()
+	// The first second's worth is a burst.
+	if err := r.wait(100000, nil, realClock{}); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if err := q.rate().wait(30000, nil, realClock{}); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("30000 bytes past the burst took %v, want about 300ms", d)
+	}
+}
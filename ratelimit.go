@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket that caps a flow of bytes to a
+// steady rate, allowing bursts. It is safe for concurrent use, and
+// can be shared by channels and connections to cap them together.
+// See RateLimited.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// RateLimited, if implemented by a Channel or a Conn, caps the data
+// read from and written to it. The channels and connections of this
+// package implement it, for example:
+//
+//	if r, ok := ch.(ssh.RateLimited); ok {
+//		r.SetRateLimit(nil, ssh.NewRateLimiter(1<<20, 0))
+//	}
+type RateLimited interface {
+	// SetRateLimit sets the limiters for reads and writes. Reads
+	// are capped by holding back the window, which slows the peer
+	// down. Either limiter may be nil for no limit, and either
+	// may be shared.
+	SetRateLimit(read, write *RateLimiter)
+}
+
+// NewRateLimiter returns a RateLimiter that lets bytesPerSec bytes
+// through every second, in bursts of up to burst bytes. A burst of
+// zero means one second's worth. It panics if bytesPerSec is not
+// positive; a nil *RateLimiter is used for no limit.
+func NewRateLimiter(bytesPerSec, burst int) *RateLimiter {
+	if bytesPerSec <= 0 {
+		panic("ssh: NewRateLimiter needs a positive rate")
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return newRateLimiter(float64(bytesPerSec), float64(burst))
+}
+
+// newRateLimiter returns a RateLimiter of rate tokens a second, in
+// bursts of up to burst, neither of which need be whole.
+func newRateLimiter(rate, burst float64) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// refill adds the tokens earned since the last refill. The bucket
+// starts full, at its first use. r.mu must be held.
+func (r *RateLimiter) refill(now time.Time) {
+	if !r.last.IsZero() && now.After(r.last) {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+}
+
+// allow takes n tokens from the bucket, if it has them, and reports
+// whether it did. Unlike wait, it never sleeps, nor runs the bucket
+// into debt.
+func (r *RateLimiter) allow(n int, clock Clock) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refill(clock.Now())
+	if r.tokens < float64(n) {
+		return false
+	}
+	r.tokens -= float64(n)
+	return true
+}
+
+// wait takes n bytes from the bucket, and sleeps, by clock, until
+// the bucket has refilled, or until stop is closed. Tokens are taken
+// up front, so that a large n waits its turn rather than starving.
+func (r *RateLimiter) wait(n int, stop <-chan struct{}, clock Clock) error {
+	r.mu.Lock()
+	r.refill(clock.Now())
+	r.tokens -= float64(n)
+	deficit := -r.tokens
+	r.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	t := clock.NewTimer(time.Duration(deficit / r.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-stop:
+		return io.EOF
+	}
+}
@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Unix(1e9, 0))
+	b := NewRateLimiter(100000, 0)
+	// The first second's worth is a burst.
+	if err := b.wait(100000, nil, clock); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- b.wait(30000, nil, clock) }()
+	clock.BlockUntil(1)
+	clock.Advance(290 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("30000 bytes past the burst went through after 290ms")
+	default:
+	}
+	clock.Advance(10 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	// The bucket refills, up to the burst.
+	clock.Advance(time.Hour)
+	if err := b.wait(100000, nil, clock); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	// allow takes tokens only while the bucket has them.
+	clock.Advance(time.Hour)
+	if !b.allow(60000, clock) || b.allow(60000, clock) {
+		t.Error("allow of 60000 bytes twice from a burst of 100000: want true, then false")
+	}
+	clock.Advance(200 * time.Millisecond)
+	if !b.allow(60000, clock) {
+		t.Error("allow after the bucket refilled: want true")
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := b.wait(1000000, stop, clock); err == nil {
+		t.Error("wait ignored stop")
+	}
+
+	for _, rate := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewRateLimiter(%d, 0) did not panic", rate)
+				}
+			}()
+			NewRateLimiter(rate, 0)
+		}()
+	}
+}
+
+// timedRead reads everything the server sends on a new channel, and
+// returns how long it took.
+func timedRead(t *testing.T, client *Client) time.Duration {
+	ch, in, err := client.OpenChannel(context.Background(), "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	defer ch.Close()
+	go DiscardRequests(context.Background(), in, client.Halt)
+	start := time.Now()
+	got, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != 150000 {
+		t.Fatalf("read %d bytes, want 150000", len(got))
+	}
+	return time.Since(start)
+}
+
+func TestChannelRateLimit(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		ch.(RateLimited).SetRateLimit(nil, NewRateLimiter(100000, 0))
+		ch.Write(make([]byte, 150000))
+	}, t, halt)
+	defer client.Close()
+
+	if d := timedRead(t, client); d < 400*time.Millisecond {
+		t.Errorf("writing 150000 bytes at 100000/s took %v", d)
+	}
+}
+
+func TestConnRateLimit(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	client := dial(func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		ch.Write(make([]byte, 150000))
+	}, t, halt)
+	defer client.Close()
+
+	if d := timedRead(t, client); d > 300*time.Millisecond {
+		t.Errorf("unlimited read took %v", d)
+	}
+	client.Conn.(RateLimited).SetRateLimit(NewRateLimiter(100000, 0), nil)
+	if d := timedRead(t, client); d < 400*time.Millisecond {
+		t.Errorf("reading 150000 bytes at 100000/s took %v", d)
+	}
+}
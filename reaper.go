@@ -0,0 +1,169 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LastContact returns when the last packet from the server arrived,
+// or when the connection was set up if none has. Any packet counts,
+// keepalives among them.
+func (c *Client) LastContact() time.Time {
+	if conn, ok := c.Conn.(*connection); ok {
+		return conn.LastContact()
+	}
+	return time.Time{}
+}
+
+// idleReason is the disconnect message of connections reaped from a
+// ConnRegistry.
+const idleReason = "idle timeout"
+
+// IdleReaper closes connections whose peers have been silent for
+// longer than MaxIdle, to keep the number of connections of a client
+// pool or a server bounded. It watches the Clients and ServerConns
+// given to Watch, and the connections of the registries given to
+// WatchRegistry. Since keepalives count as contact, peers that send
+// them are never reaped; give such fleets a MaxIdle shorter than
+// their keepalive interval only if they should all go.
+type IdleReaper struct {
+	// MaxIdle is how long a peer may be silent. If it is not
+	// positive, reaping is off: Reap closes nothing, and Run
+	// returns at once.
+	MaxIdle time.Duration
+
+	// Interval is how often Run checks the connections. If zero,
+	// it is a quarter of MaxIdle.
+	Interval time.Duration
+
+	// OnReap, if non-nil, is called before a connection is
+	// closed, with the connection, a Conn, or the ConnInfo of a
+	// connection in a registry, and how long its peer was silent.
+	OnReap func(conn interface{}, idle time.Duration)
+
+	// Clock, if non-nil, replaces package time; it is meant for
+	// tests.
+	Clock Clock
+
+	mu         sync.Mutex
+	conns      map[reapable]bool
+	registries []*ConnRegistry
+}
+
+// reapable is a connection an IdleReaper can watch.
+type reapable interface {
+	Conn
+	LastContact() time.Time
+}
+
+func (r *IdleReaper) clock() Clock {
+	if r.Clock == nil {
+		return realClock{}
+	}
+	return r.Clock
+}
+
+// Watch has r watch conn, a *Client or *ServerConn, until it is
+// closed. It returns false for connections that do not report when
+// they last had contact.
+func (r *IdleReaper) Watch(conn Conn) bool {
+	rc, ok := conn.(reapable)
+	if !ok {
+		return false
+	}
+	if c, ok := conn.(*Client); ok {
+		if _, ok := c.Conn.(*connection); !ok {
+			return false
+		}
+	}
+	r.mu.Lock()
+	if r.conns == nil {
+		r.conns = map[reapable]bool{}
+	}
+	r.conns[rc] = true
+	r.mu.Unlock()
+
+	go func() {
+		<-conn.Done()
+		r.mu.Lock()
+		delete(r.conns, rc)
+		r.mu.Unlock()
+	}()
+	return true
+}
+
+// WatchRegistry has r watch the connections in reg, now and as they
+// are added. They are closed with the reason "idle timeout".
+func (r *IdleReaper) WatchRegistry(reg *ConnRegistry) {
+	r.mu.Lock()
+	r.registries = append(r.registries, reg)
+	r.mu.Unlock()
+}
+
+// Reap closes the connections that are idle now, and returns how
+// many it closed.
+func (r *IdleReaper) Reap() int {
+	if r.MaxIdle <= 0 {
+		return 0
+	}
+	now := r.clock().Now()
+	r.mu.Lock()
+	var idle []reapable
+	for c := range r.conns {
+		if now.Sub(c.LastContact()) > r.MaxIdle {
+			idle = append(idle, c)
+			delete(r.conns, c)
+		}
+	}
+	registries := append([]*ConnRegistry(nil), r.registries...)
+	r.mu.Unlock()
+
+	n := 0
+	for _, c := range idle {
+		if r.OnReap != nil {
+			r.OnReap(c, now.Sub(c.LastContact()))
+		}
+		c.Close()
+		n++
+	}
+	for _, reg := range registries {
+		for _, info := range reg.List() {
+			d := now.Sub(info.LastContact)
+			if d <= r.MaxIdle {
+				continue
+			}
+			if r.OnReap != nil {
+				r.OnReap(info, d)
+			}
+			if reg.Close(info.ID, idleReason) == nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Run calls Reap every Interval until ctx is done.
+func (r *IdleReaper) Run(ctx context.Context) error {
+	if r.MaxIdle <= 0 {
+		return nil
+	}
+	interval := r.Interval
+	if interval <= 0 {
+		interval = r.MaxIdle / 4
+	}
+	if interval <= 0 {
+		interval = r.MaxIdle
+	}
+	ticker := r.clock().NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			r.Reap()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
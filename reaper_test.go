@@ -0,0 +1,132 @@
+package ssh
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleReaper(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	registry := &ConnRegistry{}
+	ctx := context.Background()
+
+	// alice's server connection is in the registry; bob's client
+	// is watched.
+	var clients []*Client
+	for _, user := range []string{"alice", "bob"} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+		halt := NewHalter()
+		defer halt.RequestStop()
+		serverConf := &ServerConfig{
+			NoClientAuth: true,
+			Config:       Config{Halt: halt, Clock: clock},
+		}
+		if user == "alice" {
+			serverConf.Registry = registry
+		}
+		serverConf.AddHostKey(testSigners["rsa"])
+		go func() {
+			_, _, reqs, err := NewServerConn(ctx, c1, serverConf)
+			if err == nil {
+				DiscardRequests(ctx, reqs, halt)
+			}
+		}()
+		clientConf := &ClientConfig{
+			User:            user,
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter(), Clock: clock},
+		}
+		defer clientConf.Halt.RequestStop()
+		conn, chans, reqs, err := NewClientConn(ctx, c2, "", clientConf)
+		if err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+		clients = append(clients, NewClient(ctx, conn, chans, reqs, clientConf.Halt))
+	}
+	for len(registry.List()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var reaped []interface{}
+	reaper := &IdleReaper{
+		MaxIdle: time.Minute,
+		Clock:   clock,
+		OnReap: func(conn interface{}, idle time.Duration) {
+			mu.Lock()
+			reaped = append(reaped, conn)
+			mu.Unlock()
+		},
+	}
+	if !reaper.Watch(clients[1]) {
+		t.Fatal("Watch refused a Client")
+	}
+	reaper.WatchRegistry(registry)
+	if n := reaper.Reap(); n != 0 {
+		t.Fatalf("Reap closed %d fresh connections", n)
+	}
+
+	// alice talks to her server after 50s, bob is silent.
+	clock.Advance(50 * time.Second)
+	if _, _, err := clients[0].SendRequest(ctx, "keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	clock.Advance(20 * time.Second)
+	if got := registry.List()[0].LastContact; !got.Equal(time.Unix(1700000050, 0)) {
+		t.Errorf("alice's LastContact = %v, want 50s in", got)
+	}
+	if n := reaper.Reap(); n != 1 {
+		t.Fatalf("Reap closed %d connections, want bob's", n)
+	}
+	select {
+	case <-clients[1].Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("bob's connection not closed")
+	}
+
+	clock.Advance(time.Minute)
+	if n := reaper.Reap(); n != 1 {
+		t.Fatalf("Reap closed %d connections, want alice's", n)
+	}
+	done := make(chan error, 1)
+	go func() { done <- clients[0].Wait() }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("alice's connection not closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reaped) != 2 || reaped[0] != clients[1] {
+		t.Fatalf("OnReap saw %v", reaped)
+	}
+	if info, ok := reaped[1].(ConnInfo); !ok || info.User != "alice" {
+		t.Errorf("OnReap saw %v, want alice's ConnInfo", reaped[1])
+	}
+}
+
+func TestIdleReaperDisabled(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	reaper := &IdleReaper{}
+	done := make(chan error, 1)
+	go func() { done <- reaper.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run of a reaper without MaxIdle did not return")
+	}
+}
@@ -0,0 +1,204 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RecordFormat selects the output format of a Recorder.
+type RecordFormat int
+
+const (
+	// RecordAsciicast writes an asciicast v2 file, as played
+	// back by asciinema: a JSON header line followed by one
+	// [elapsed, code, data] JSON array per chunk of data.
+	RecordAsciicast RecordFormat = iota
+
+	// RecordRaw writes one line per chunk of data: an RFC 3339
+	// timestamp, the direction "i" or "o", and the data as a Go
+	// quoted string.
+	RecordRaw
+)
+
+// Recorder tees the data of session channels, with timestamps,
+// into a log. Use Tap to record a channel. A Recorder may be
+// shared by several channels and is safe for concurrent use.
+//
+// Failing to write to the log does not interrupt the session; the
+// first write error is kept and returned by Err.
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format RecordFormat
+	start  time.Time
+	err    error
+}
+
+// NewRecorder returns a Recorder writing to w. For RecordAsciicast,
+// the header is written right away, with width and height giving
+// the terminal size, usually taken from the "pty-req" request.
+func NewRecorder(w io.Writer, format RecordFormat, width, height int) (*Recorder, error) {
+	r := &Recorder{
+		w:      w,
+		format: format,
+		start:  time.Now(),
+	}
+	switch format {
+	case RecordAsciicast:
+		hdr, err := json.Marshal(struct {
+			Version   int   `json:"version"`
+			Width     int   `json:"width"`
+			Height    int   `json:"height"`
+			Timestamp int64 `json:"timestamp"`
+		}{2, width, height, r.start.Unix()})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(append(hdr, '\n')); err != nil {
+			return nil, err
+		}
+	case RecordRaw:
+	default:
+		return nil, fmt.Errorf("ssh: unknown record format %d", int(format))
+	}
+	return r, nil
+}
+
+// Err returns the first error encountered writing the log.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Resize records a change of the terminal size, as announced by a
+// "window-change" request.
+func (r *Recorder) Resize(width, height int) {
+	r.record("r", nil, []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+// record writes one event with the given code ("i", "o" or "r").
+// Asciicast events hold text, so a UTF-8 sequence split between
+// chunks of a stream is kept in partial until the rest of it
+// arrives, rather than recorded as two invalid halves. The partial
+// of a stream is guarded by r.mu.
+func (r *Recorder) record(code string, partial *[]byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	now := time.Now()
+	var line []byte
+	switch r.format {
+	case RecordAsciicast:
+		if partial != nil {
+			data = append(*partial, data...)
+			data, *partial = splitPartialRune(data)
+			if len(data) == 0 {
+				return
+			}
+		}
+		var err error
+		line, err = json.Marshal([]interface{}{now.Sub(r.start).Seconds(), code, string(data)})
+		if err != nil {
+			r.err = err
+			return
+		}
+		line = append(line, '\n')
+	case RecordRaw:
+		line = []byte(fmt.Sprintf("%s %s %q\n", now.UTC().Format(time.RFC3339Nano), code, data))
+	}
+	_, r.err = r.w.Write(line)
+}
+
+// splitPartialRune splits data before an incomplete UTF-8 sequence
+// at its end, if there is one. The tail is copied, as data is only
+// borrowed.
+func splitPartialRune(data []byte) (full, tail []byte) {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i], append([]byte(nil), data[i:]...)
+			}
+			break
+		}
+	}
+	return data, nil
+}
+
+// Tap returns a Channel that behaves like ch and records its data.
+// On the server side, serverSide must be true: data read from ch
+// is the client's input, and data written is output. On the client
+// side the directions are reversed. Stderr traffic is recorded as
+// output.
+func (r *Recorder) Tap(ch Channel, serverSide bool) Channel {
+	t := &tappedChannel{
+		Channel:   ch,
+		rec:       r,
+		readCode:  "o",
+		writeCode: "i",
+		stderr:    &tappedStderr{rw: ch.Stderr(), rec: r},
+	}
+	if serverSide {
+		t.readCode, t.writeCode = "i", "o"
+	}
+	return t
+}
+
+// tappedChannel is a Channel whose data is copied to a Recorder.
+type tappedChannel struct {
+	Channel
+	rec                       *Recorder
+	readCode, writeCode       string
+	readPartial, writePartial []byte
+	stderr                    *tappedStderr
+}
+
+func (t *tappedChannel) Read(data []byte) (int, error) {
+	n, err := t.Channel.Read(data)
+	if n > 0 {
+		t.rec.record(t.readCode, &t.readPartial, data[:n])
+	}
+	return n, err
+}
+
+func (t *tappedChannel) Write(data []byte) (int, error) {
+	n, err := t.Channel.Write(data)
+	if n > 0 {
+		t.rec.record(t.writeCode, &t.writePartial, data[:n])
+	}
+	return n, err
+}
+
+func (t *tappedChannel) Stderr() io.ReadWriter {
+	return t.stderr
+}
+
+// tappedStderr records both directions of a channel's stderr as
+// output.
+type tappedStderr struct {
+	rw                        io.ReadWriter
+	rec                       *Recorder
+	readPartial, writePartial []byte
+}
+
+func (t *tappedStderr) Read(data []byte) (int, error) {
+	n, err := t.rw.Read(data)
+	if n > 0 {
+		t.rec.record("o", &t.readPartial, data[:n])
+	}
+	return n, err
+}
+
+func (t *tappedStderr) Write(data []byte) (int, error) {
+	n, err := t.rw.Write(data)
+	if n > 0 {
+		t.rec.record("o", &t.writePartial, data[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,157 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// bufChannel is a Channel whose data goes to and comes from buffers.
+type bufChannel struct {
+	Channel
+	in, out, stderr bytes.Buffer
+}
+
+func (c *bufChannel) Read(data []byte) (int, error)  { return c.in.Read(data) }
+func (c *bufChannel) Write(data []byte) (int, error) { return c.out.Write(data) }
+func (c *bufChannel) Stderr() io.ReadWriter          { return &c.stderr }
+
+func TestRecorderAsciicast(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var log bytes.Buffer
+	rec, err := NewRecorder(&log, RecordAsciicast, 80, 24)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+
+	ch := &bufChannel{}
+	ch.in.WriteString("ls\r")
+	tapped := rec.Tap(ch, true)
+	buf := make([]byte, 10)
+	n, err := tapped.Read(buf)
+	if err != nil || string(buf[:n]) != "ls\r" {
+		t.Fatalf("Read: %q, %v", buf[:n], err)
+	}
+	if _, err := tapped.Write([]byte("a b\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tapped.Stderr().Write([]byte("oops"))
+	rec.Resize(100, 40)
+	if ch.out.String() != "a b\r\n" || ch.stderr.String() != "oops" {
+		t.Errorf("data not passed through: %q, %q", ch.out.String(), ch.stderr.String())
+	}
+
+	sc := bufio.NewScanner(&log)
+	sc.Scan()
+	var hdr map[string]int
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		t.Fatalf("header %q: %v", sc.Text(), err)
+	}
+	if hdr["version"] != 2 || hdr["width"] != 80 || hdr["height"] != 24 || hdr["timestamp"] == 0 {
+		t.Errorf("got header %v", hdr)
+	}
+
+	want := [][2]string{{"i", "ls\r"}, {"o", "a b\r\n"}, {"o", "oops"}, {"r", "100x40"}}
+	for i, w := range want {
+		if !sc.Scan() {
+			t.Fatalf("event %d missing", i)
+		}
+		var ev []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		if _, ok := ev[0].(float64); !ok || len(ev) != 3 || ev[1] != w[0] || ev[2] != w[1] {
+			t.Errorf("event %d: got %v, want [t %q %q]", i, ev, w[0], w[1])
+		}
+	}
+	if sc.Scan() {
+		t.Errorf("trailing line %q", sc.Text())
+	}
+}
+
+func TestRecorderSplitRune(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var log bytes.Buffer
+	rec, err := NewRecorder(&log, RecordAsciicast, 80, 24)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	tapped := rec.Tap(&bufChannel{}, true)
+	text := []byte("caf\u00e9 \u20ac")
+	for _, chunk := range [][]byte{text[:4], text[4:7], text[7:8], text[8:]} {
+		tapped.Write(chunk)
+	}
+
+	var got string
+	sc := bufio.NewScanner(&log)
+	sc.Scan()
+	for sc.Scan() {
+		var ev []interface{}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q: %v", sc.Text(), err)
+		}
+		got += ev[2].(string)
+	}
+	if got != string(text) {
+		t.Errorf("recorded %q, want %q", got, text)
+	}
+}
+
+func TestRecorderRawClientSide(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var log bytes.Buffer
+	rec, err := NewRecorder(&log, RecordRaw, 0, 0)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	ch := &bufChannel{}
+	ch.in.WriteString("hello\n")
+	tapped := rec.Tap(ch, false)
+	tapped.Write([]byte("echo hello\n"))
+	ioutil.ReadAll(tapped)
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	re := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\S+Z ([io]) (".*")$`)
+	want := []string{`i "echo hello\n"`, `o "hello\n"`}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %d lines", lines, len(want))
+	}
+	for i, l := range lines {
+		m := re.FindStringSubmatch(l)
+		if m == nil || m[1]+" "+m[2] != want[i] {
+			t.Errorf("line %d: got %q, want suffix %q", i, l, want[i])
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestRecorderWriteError(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	if _, err := NewRecorder(failWriter{}, RecordAsciicast, 80, 24); err == nil {
+		t.Error("NewRecorder succeeded writing the header to a failing writer")
+	}
+	rec, err := NewRecorder(failWriter{}, RecordRaw, 0, 0)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	ch := &bufChannel{}
+	if _, err := rec.Tap(ch, true).Write([]byte("x")); err != nil {
+		t.Errorf("log error leaked into Write: %v", err)
+	}
+	if rec.Err() == nil {
+		t.Error("Err() = nil after failed log write")
+	}
+}
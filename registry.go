@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// disconnectByApplication is SSH_DISCONNECT_BY_APPLICATION, see RFC
+// 4253, section 11.1.
+const disconnectByApplication = 11
+
+// ConnInfo describes a live server connection in a ConnRegistry.
+type ConnInfo struct {
+	// ID identifies the connection for ConnRegistry.Close. IDs
+	// are not reused.
+	ID uint64
+
+	User          string
+	RemoteAddr    net.Addr
+	LocalAddr     net.Addr
+	ClientVersion string
+
+	// Start is when the connection was authenticated.
+	Start time.Time
+
+	// LastContact is when the last packet from the client
+	// arrived.
+	LastContact time.Time
+
+	// Channels are the types of the channels open, in the order
+	// of their channel IDs.
+	Channels []string
+}
+
+// ConnRegistry tracks the live connections of servers whose
+// ServerConfig.Registry it is, for an admin interface to list and
+// terminate them, as who and kill do for sshd. Connections are added
+// once authenticated, and removed when they close. The zero value is
+// ready to use, and a ConnRegistry is safe for concurrent use.
+type ConnRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*registeredConn
+}
+
+type registeredConn struct {
+	info ConnInfo
+	conn *connection
+}
+
+// add registers conn, and removes it once its mux has stopped.
+func (r *ConnRegistry) add(conn *connection) {
+	r.mu.Lock()
+	if r.conns == nil {
+		r.conns = map[uint64]*registeredConn{}
+	}
+	r.nextID++
+	id := r.nextID
+	r.conns[id] = &registeredConn{
+		info: ConnInfo{
+			ID:            id,
+			User:          conn.User(),
+			RemoteAddr:    conn.RemoteAddr(),
+			LocalAddr:     conn.LocalAddr(),
+			ClientVersion: string(conn.ClientVersion()),
+			Start:         time.Now(),
+		},
+		conn: conn,
+	}
+	r.mu.Unlock()
+
+	conn.cfg.goroutines.spawn("registry", func() {
+		conn.mux.Wait()
+		r.mu.Lock()
+		delete(r.conns, id)
+		r.mu.Unlock()
+	})
+}
+
+// List returns the live connections, ordered by ID.
+func (r *ConnRegistry) List() []ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]ConnInfo, 0, len(r.conns))
+	for _, rc := range r.conns {
+		info := rc.info
+		info.Channels = rc.conn.mux.chanList.types()
+		info.LastContact = rc.conn.LastContact()
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Close disconnects the connection with the given ID, telling the
+// client reason as the message of an SSH_MSG_DISCONNECT.
+func (r *ConnRegistry) Close(id uint64, reason string) error {
+	r.mu.Lock()
+	rc, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("ssh: no connection %d in registry", id)
+	}
+	// The disconnect is best effort; the connection is closed
+	// either way.
+	rc.conn.transport.writePacket(Marshal(&disconnectMsg{
+		Reason:  disconnectByApplication,
+		Message: reason,
+	}))
+	return rc.conn.Close()
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnRegistry(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	registry := &ConnRegistry{}
+	ctx := context.Background()
+
+	var clients []Conn
+	for _, user := range []string{"alice", "bob"} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+		// Each connection has its own Halter, as with
+		// ServeListener, so that closing one leaves the other.
+		halt := NewHalter()
+		defer halt.RequestStop()
+		serverConf := &ServerConfig{
+			NoClientAuth: true,
+			Registry:     registry,
+			Config:       Config{Halt: halt},
+		}
+		serverConf.AddHostKey(testSigners["rsa"])
+		go func() {
+			_, chans, reqs, err := NewServerConn(ctx, c1, serverConf)
+			if err != nil {
+				return
+			}
+			go DiscardRequests(ctx, reqs, halt)
+			for newCh := range chans {
+				ch, in, err := newCh.Accept()
+				if err == nil {
+					go DiscardRequests(ctx, in, halt)
+					defer ch.Close()
+				}
+			}
+		}()
+		conn, _, _, err := NewClientConn(ctx, c2, "", &ClientConfig{
+			User:            user,
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		})
+		if err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+		clients = append(clients, conn)
+	}
+	if _, _, err := clients[1].OpenChannel(ctx, "session", nil, nil); err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+
+	list := registry.List()
+	if len(list) != 2 || list[0].User != "alice" || list[1].User != "bob" {
+		t.Fatalf("List: got %+v, want alice and bob", list)
+	}
+	if len(list[0].Channels) != 0 || len(list[1].Channels) != 1 || list[1].Channels[0] != "session" {
+		t.Errorf("got channels %q and %q, want none and a session", list[0].Channels, list[1].Channels)
+	}
+	if list[0].Start.IsZero() || list[0].RemoteAddr == nil {
+		t.Errorf("incomplete info %+v", list[0])
+	}
+
+	if err := registry.Close(list[0].ID, "maintenance"); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := clients[0].Wait(); err == nil || !strings.Contains(err.Error(), "maintenance") {
+		t.Errorf("client Wait: got %v, want the disconnect reason", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(registry.List()) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("closed connection still listed: %+v", registry.List())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := registry.Close(list[0].ID, ""); err == nil {
+		t.Error("second Close succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A RemoteSigner is a private key kept elsewhere, in a cloud KMS or an
+// HSM, that signs digests on request. NewRemoteSigner makes a Signer
+// of it, for client authentication or for signing certificates.
+type RemoteSigner interface {
+	// Public returns the public key, an *rsa.PublicKey,
+	// *ecdsa.PublicKey or ed25519.PublicKey.
+	Public() crypto.PublicKey
+
+	// SignDigest signs digest, the hash of the data made with hash,
+	// and returns the signature as KMS services do: PKCS #1 v1.5 for
+	// RSA keys and ASN.1 DER for ECDSA keys. For Ed25519 keys hash is
+	// zero, and digest is the data itself.
+	SignDigest(hash crypto.Hash, digest []byte) ([]byte, error)
+}
+
+// NewRemoteSigner returns a Signer that signs with r. For RSA keys,
+// hashes lists the hashes r may sign with, in order of preference,
+// each of crypto.SHA512, crypto.SHA256 and crypto.SHA1, which picks
+// the rsa-sha2-512, rsa-sha2-256 and ssh-rsa algorithms; none means
+// SHA-512 and SHA-256, which KMS services support where they do not
+// fix the hash of a key. Sign uses the first; client authentication
+// uses the best that the server accepts. For other keys hashes must
+// be empty, as their algorithm fixes the hash.
+func NewRemoteSigner(r RemoteSigner, hashes ...crypto.Hash) (MultiAlgorithmSigner, error) {
+	pub, err := NewPublicKey(r.Public())
+	if err != nil {
+		return nil, err
+	}
+	algorithms := []string{pub.Type()}
+	if pub.Type() == KeyAlgoRSA {
+		if len(hashes) == 0 {
+			hashes = []crypto.Hash{crypto.SHA512, crypto.SHA256}
+		}
+		algorithms = nil
+		for _, h := range hashes {
+			switch h {
+			case crypto.SHA512:
+				algorithms = append(algorithms, SigAlgoRSASHA2512)
+			case crypto.SHA256:
+				algorithms = append(algorithms, SigAlgoRSASHA2256)
+			case crypto.SHA1:
+				algorithms = append(algorithms, SigAlgoRSA)
+			default:
+				return nil, fmt.Errorf("ssh: no RSA signature algorithm uses hash %v", h)
+			}
+		}
+	} else if len(hashes) > 0 {
+		return nil, fmt.Errorf("ssh: the hash of %s keys is fixed", pub.Type())
+	}
+	return &remoteSigner{
+		wrappedSigner: &wrappedSigner{signer: remoteCryptoSigner{r}, pubKey: pub},
+		algorithms:    algorithms,
+	}, nil
+}
+
+// remoteSigner signs through a RemoteSigner, with the algorithms it
+// was given.
+type remoteSigner struct {
+	*wrappedSigner
+	algorithms []string
+}
+
+func (s *remoteSigner) Algorithms() []string {
+	return append([]string(nil), s.algorithms...)
+}
+
+func (s *remoteSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *remoteSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*Signature, error) {
+	if algorithm == "" {
+		algorithm = s.algorithms[0]
+	}
+	if !contains(s.algorithms, algorithm) {
+		return nil, fmt.Errorf("ssh: remote signer does not sign with %s", algorithm)
+	}
+	return s.wrappedSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// remoteCryptoSigner makes a crypto.Signer of a RemoteSigner, for
+// wrappedSigner.
+type remoteCryptoSigner struct {
+	r RemoteSigner
+}
+
+func (s remoteCryptoSigner) Public() crypto.PublicKey {
+	return s.r.Public()
+}
+
+func (s remoteCryptoSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := s.r.SignDigest(opts.HashFunc(), digest)
+	if err == nil && len(sig) == 0 {
+		err = errors.New("ssh: remote signer returned an empty signature")
+	}
+	return sig, err
+}
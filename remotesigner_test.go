@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeKMS is a RemoteSigner over a local key, that only signs with
+// the hashes it is given and records those asked for.
+type fakeKMS struct {
+	key    crypto.Signer
+	hashes []crypto.Hash
+
+	mu   sync.Mutex
+	used []crypto.Hash
+}
+
+func (k *fakeKMS) Public() crypto.PublicKey {
+	return k.key.Public()
+}
+
+func (k *fakeKMS) SignDigest(hash crypto.Hash, digest []byte) ([]byte, error) {
+	k.mu.Lock()
+	k.used = append(k.used, hash)
+	k.mu.Unlock()
+	if k.hashes != nil {
+		ok := false
+		for _, h := range k.hashes {
+			ok = ok || h == hash
+		}
+		if !ok {
+			return nil, fmt.Errorf("fakeKMS: hash %v not allowed", hash)
+		}
+	}
+	return k.key.Sign(rand.Reader, digest, hash)
+}
+
+func TestRemoteSignerAlgorithms(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	data := []byte("sign me")
+	for _, tt := range []struct {
+		key    string
+		hashes []crypto.Hash
+		want   []string
+	}{
+		{"rsa", nil, []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256}},
+		{"rsa", []crypto.Hash{crypto.SHA256}, []string{SigAlgoRSASHA2256}},
+		{"rsa", []crypto.Hash{crypto.SHA1, crypto.SHA512}, []string{SigAlgoRSA, SigAlgoRSASHA2512}},
+		{"ecdsa", nil, []string{KeyAlgoECDSA256}},
+		{"ed25519", nil, []string{KeyAlgoED25519}},
+	} {
+		kms := &fakeKMS{key: testPrivateKeys[tt.key].(crypto.Signer), hashes: tt.hashes}
+		signer, err := NewRemoteSigner(kms, tt.hashes...)
+		if err != nil {
+			t.Fatalf("%s: NewRemoteSigner: %v", tt.key, err)
+		}
+		if got := signer.Algorithms(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s %v: got algorithms %v, want %v", tt.key, tt.hashes, got, tt.want)
+		}
+		for i, algo := range append([]string{""}, tt.want...) {
+			sig, err := signer.SignWithAlgorithm(rand.Reader, data, algo)
+			if err != nil {
+				t.Fatalf("%s: SignWithAlgorithm(%q): %v", tt.key, algo, err)
+			}
+			if want := tt.want[0]; i > 0 {
+				want = algo
+				if sig.Format != want {
+					t.Errorf("%s: got format %s, want %s", tt.key, sig.Format, want)
+				}
+			} else if sig.Format != want {
+				t.Errorf("%s: default format %s, want %s", tt.key, sig.Format, want)
+			}
+			if err := testPublicKeys[tt.key].Verify(data, sig); err != nil {
+				t.Errorf("%s: %s signature does not verify: %v", tt.key, sig.Format, err)
+			}
+		}
+	}
+
+	rsaKMS := &fakeKMS{key: testPrivateKeys["rsa"].(crypto.Signer)}
+	signer, err := NewRemoteSigner(rsaKMS, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("NewRemoteSigner: %v", err)
+	}
+	if _, err := signer.SignWithAlgorithm(rand.Reader, data, SigAlgoRSA); err == nil {
+		t.Error("signed with ssh-rsa, which the signer was not given")
+	}
+	if _, err := NewRemoteSigner(rsaKMS, crypto.MD5); err == nil {
+		t.Error("NewRemoteSigner accepted MD5")
+	}
+	if _, err := NewRemoteSigner(&fakeKMS{key: testPrivateKeys["ecdsa"].(crypto.Signer)}, crypto.SHA256); err == nil {
+		t.Error("NewRemoteSigner accepted a hash for an ECDSA key")
+	}
+}
+
+func TestRemoteSignerClientAuth(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// A KMS key bound to SHA-256, that cannot sign for ssh-rsa.
+	kms := &fakeKMS{key: testPrivateKeys["rsa"].(crypto.Signer), hashes: []crypto.Hash{crypto.SHA256}}
+	signer, err := NewRemoteSigner(kms, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("NewRemoteSigner: %v", err)
+	}
+	config := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(signer)},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("auth with a remote RSA key: %v", err)
+	}
+	kms.mu.Lock()
+	defer kms.mu.Unlock()
+	if len(kms.used) != 1 || kms.used[0] != crypto.SHA256 {
+		t.Errorf("signed with hashes %v, want just SHA-256", kms.used)
+	}
+}
+
+func TestClientAuthRSASHA2(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// A local RSA key signs with the best the server offers.
+	signer := testSigners["rsa"]
+	if _, ok := signer.(AlgorithmSigner); !ok {
+		t.Fatalf("%T is not an AlgorithmSigner", signer)
+	}
+	config := &ClientConfig{
+		User:            "testuser",
+		Auth:            []AuthMethod{PublicKeys(&recordingSigner{AlgorithmSigner: signer.(AlgorithmSigner)})},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+	if err := tryAuth(t, config); err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	rs := config.Auth[0].(publicKeyCallback)
+	signers, _ := rs()
+	if got := signers[0].(*recordingSigner).algo; got != SigAlgoRSASHA2512 {
+		t.Errorf("signed with %q, want %s", got, SigAlgoRSASHA2512)
+	}
+}
+
+// recordingSigner records the algorithm it last signed with.
+type recordingSigner struct {
+	AlgorithmSigner
+	algo string
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, data []byte) (*Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algo string) (*Signature, error) {
+	sig, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algo)
+	if err == nil {
+		s.algo = sig.Format
+	}
+	return sig, err
+}
+
+func TestRemoteSignerCertAuthority(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	kms := &fakeKMS{key: testPrivateKeys["rsa"].(crypto.Signer), hashes: []crypto.Hash{crypto.SHA256}}
+	ca, err := NewRemoteSigner(kms, crypto.SHA256)
+	if err != nil {
+		t.Fatalf("NewRemoteSigner: %v", err)
+	}
+	cert := &Certificate{
+		Key:             testPublicKeys["ecdsa"],
+		CertType:        UserCert,
+		ValidPrincipals: []string{"gopher"},
+		ValidBefore:     CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	if cert.Signature.Format != SigAlgoRSASHA2256 {
+		t.Errorf("certificate signed with %s", cert.Signature.Format)
+	}
+	checker := &CertChecker{}
+	if err := checker.CheckCert("gopher", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+}
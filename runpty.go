@@ -0,0 +1,80 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/glycerine/xcryptossh/terminal"
+)
+
+// ptyDefaultTerm is the terminal type requested when TERM is unset.
+const ptyDefaultTerm = "xterm"
+
+// RunWithPTY runs cmd on the remote host, or a login shell if cmd is
+// empty, attached to the local terminal as ssh(1) would: it
+// requests a pty of the local terminal's type and size, puts the
+// local terminal in raw mode, wires up os.Stdin, os.Stdout and
+// os.Stderr, forwards window size changes and termination signals,
+// and restores the terminal when the session ends. The error is
+// that of Session.Wait, so an *ExitError carries the exit status.
+// Standard input must be a terminal.
+func (c *Client) RunWithPTY(ctx context.Context, cmd string) error {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("ssh: RunWithPTY needs a terminal on standard input")
+	}
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = ptyDefaultTerm
+	}
+
+	session, err := c.NewSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	modes := TerminalModes{
+		ECHO:          1,
+		TTY_OP_ISPEED: 38400,
+		TTY_OP_OSPEED: 38400,
+	}
+	if err := session.RequestPty(term, height, width, modes); err != nil {
+		return err
+	}
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
+	if err != nil {
+		return err
+	}
+
+	stop := forwardTerminalEvents(session, int(os.Stdout.Fd()))
+	defer stop()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+	return session.Wait()
+}
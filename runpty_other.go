@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package ssh
+
+// forwardTerminalEvents does nothing: there is no SIGWINCH to watch
+// for here.
+func forwardTerminalEvents(s *Session, fd int) (stop func()) {
+	return func() {}
+}
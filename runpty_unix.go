@@ -0,0 +1,53 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package ssh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/glycerine/xcryptossh/terminal"
+)
+
+// forwardedSignals maps the local signals RunWithPTY passes on to
+// the remote command. In raw mode the terminal sends ^C and the like
+// as input, so these only come from elsewhere, kill(1) for instance.
+var forwardedSignals = map[os.Signal]Signal{
+	syscall.SIGHUP:  SIGHUP,
+	syscall.SIGINT:  SIGINT,
+	syscall.SIGQUIT: SIGQUIT,
+	syscall.SIGTERM: SIGTERM,
+}
+
+// forwardTerminalEvents sends the size of the terminal fd to s on
+// SIGWINCH, and forwardedSignals as signals, until stop is called.
+func forwardTerminalEvents(s *Session, fd int) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGWINCH)
+	for sig := range forwardedSignals {
+		signal.Notify(sigs, sig)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGWINCH {
+					if w, h, err := terminal.GetSize(fd); err == nil {
+						s.WindowChange(h, w)
+					}
+					continue
+				}
+				s.Signal(forwardedSignals[sig])
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
@@ -0,0 +1,288 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnHandler serves an authenticated connection. It must service
+// chans and reqs, as with NewServerConn. The connection is closed
+// when the handler returns.
+type ConnHandler func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request)
+
+// ServeListener accepts connections on l, performs the handshake on
+// each, and runs handler on the ones that authenticate, until ctx is
+// done, config.Halt is stopped, or Accept fails. Connections whose
+// handshake fails are dropped. Temporary Accept errors, such as
+// running out of file descriptors, are retried after a delay that
+// doubles up to a second, as net/http does.
+//
+// Each connection gets its own context and its own Halter, which is
+// downstream of config.Halt, so that closing one connection leaves
+// the others alone, while stopping config.Halt stops them all. If
+// config.Halt is nil, ServeListener uses a Halter of its own, and
+// only ctx stops it; config is not modified.
+// ServeListener closes l, and returns nil if it was stopped by ctx
+// or config.Halt. It does not wait for the handlers to return.
+func ServeListener(ctx context.Context, l net.Listener, config *ServerConfig, handler ConnHandler) error {
+	conf := *config
+	if conf.Halt == nil {
+		conf.Halt = NewHalter()
+	}
+	return acceptLoop(ctx, l, conf.Halt.ReqStopChan(), func(nConn net.Conn) {
+		go serveConn(ctx, nConn, &conf, conf.Halt, handler)
+	})
+}
+
+// maxAcceptDelay caps the delay between retries of Accept after
+// temporary errors.
+const maxAcceptDelay = time.Second
+
+// acceptLoop hands the connections accepted on l to serve, until
+// ctx is done, stop is closed, or Accept fails with an error that is
+// not temporary. It closes l, and returns nil if it was stopped.
+func acceptLoop(ctx context.Context, l net.Listener, stop <-chan struct{}, serve func(nConn net.Conn)) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		case <-stopped:
+		}
+		l.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		nConn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-stop:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				select {
+				case <-time.After(delay):
+					continue
+				case <-ctx.Done():
+					return nil
+				case <-stop:
+					return nil
+				}
+			}
+			return err
+		}
+		delay = 0
+		serve(nConn)
+	}
+}
+
+// serveConn runs the handshake and handler for one accepted
+// connection, with a Halter downstream of parent.
+func serveConn(ctx context.Context, nConn net.Conn, config *ServerConfig, parent *Halter, handler ConnHandler) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conf := *config
+	conf.Halt = NewHalter()
+	parent.AddDownstream(conf.Halt)
+	defer parent.RemoveDownstream(conf.Halt)
+	if parent.IsStopRequested() {
+		conf.Halt.RequestStop()
+	}
+	defer conf.Halt.MarkDoneNoBlock()
+
+	// Tear the connection down when it is stopped, so the handler
+	// and the peer notice.
+	go func() {
+		select {
+		case <-conf.Halt.ReqStopChan():
+		case <-ctx.Done():
+		}
+		cancel()
+		nConn.Close()
+	}()
+
+	conn, chans, reqs, err := NewServerConn(ctx, nConn, &conf)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	handler(ctx, conn, chans, reqs)
+}
+
+// ErrServerClosed is returned by Server.Serve and
+// Server.ListenAndServe after Shutdown or Close.
+var ErrServerClosed = errors.New("ssh: Server closed")
+
+// ChannelHandler serves a channel opened by the client of conn. It
+// must accept or reject ch.
+type ChannelHandler func(ctx context.Context, conn *ServerConn, ch NewChannel)
+
+// Server runs an SSH server, in the manner of http.Server: it owns
+// the accept loop, the handshakes, and the dispatch of channels to
+// Handler, and drains connections on Shutdown. Global requests are
+// refused. The zero value of the other fields is ready to use once
+// Config is set.
+type Server struct {
+	// Addr is the TCP address to listen on, ":22" if empty.
+	Addr string
+
+	// Config is used for every connection. Stopping Config.Halt,
+	// if set, is like calling Close.
+	Config *ServerConfig
+
+	// Handler is called in a goroutine of its own for every
+	// channel opened. If nil, channels are rejected.
+	Handler ChannelHandler
+
+	mu         sync.Mutex
+	listenHalt *Halter // stops the accept loops
+	connHalt   *Halter // stops the connections
+	conns      sync.WaitGroup
+}
+
+// init sets up the Halters, and returns them.
+func (srv *Server) init() (listenHalt, connHalt *Halter) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.connHalt == nil {
+		srv.connHalt = NewHalter()
+		if srv.Config != nil && srv.Config.Halt != nil {
+			srv.connHalt = srv.Config.Halt
+		}
+		srv.listenHalt = NewHalter()
+		srv.connHalt.AddDownstream(srv.listenHalt)
+		if srv.connHalt.IsStopRequested() {
+			srv.listenHalt.RequestStop()
+		}
+	}
+	return srv.listenHalt, srv.connHalt
+}
+
+// ListenAndServe listens on srv.Addr, and calls Serve. It returns
+// ErrServerClosed after Shutdown or Close, and ctx.Err() once ctx
+// is done.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":22"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ctx, l)
+}
+
+// Serve accepts connections on l, and serves each in a goroutine of
+// its own. It closes l, and returns ErrServerClosed after Shutdown
+// or Close, and ctx.Err() once ctx is done, which also closes the
+// connections.
+func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
+	if srv.Config == nil {
+		l.Close()
+		return errors.New("ssh: Server.Config is nil")
+	}
+	listenHalt, connHalt := srv.init()
+	if listenHalt.IsStopRequested() {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	err := acceptLoop(ctx, l, listenHalt.ReqStopChan(), func(nConn net.Conn) {
+		// Shutdown may be waiting already.
+		srv.mu.Lock()
+		if listenHalt.IsStopRequested() {
+			srv.mu.Unlock()
+			nConn.Close()
+			return
+		}
+		srv.conns.Add(1)
+		srv.mu.Unlock()
+		go func() {
+			defer srv.conns.Done()
+			serveConn(ctx, nConn, srv.Config, connHalt, srv.serveChannels)
+		}()
+	})
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrServerClosed
+}
+
+// serveChannels dispatches the channels of conn to srv.Handler, and
+// returns once the connection and the handlers are done.
+func (srv *Server) serveChannels(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	for ch := range chans {
+		if srv.Handler == nil {
+			ch.Reject(UnknownChannelType, "unknown channel type")
+			continue
+		}
+		handlers.Add(1)
+		go func(ch NewChannel) {
+			defer handlers.Done()
+			srv.Handler(ctx, conn, ch)
+		}(ch)
+	}
+}
+
+// Shutdown stops accepting connections, and waits for the open ones
+// to end. If ctx is done first, Shutdown closes them, as Close
+// does, and returns ctx.Err().
+func (srv *Server) Shutdown(ctx context.Context) error {
+	listenHalt, _ := srv.init()
+	srv.mu.Lock()
+	listenHalt.RequestStopCause(ErrServerClosed)
+	srv.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		srv.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections, and closes the open ones.
+func (srv *Server) Close() error {
+	_, connHalt := srv.init()
+	srv.mu.Lock()
+	connHalt.RequestStopCause(ErrServerClosed)
+	srv.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,303 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeListener(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	ctx := context.Background()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeListener(ctx, l, config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+			go DiscardRequests(ctx, reqs, nil)
+			for ch := range chans {
+				ch.Reject(Prohibited, "serve test")
+			}
+		})
+	}()
+
+	dial := func() *Client {
+		clientConf := &ClientConfig{
+			User:            "user",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		}
+		client, err := Dial(ctx, "tcp", l.Addr().String(), clientConf)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		return client
+	}
+	c1, c2 := dial(), dial()
+	defer c2.Close()
+	c1.Close()
+
+	// The second connection is unaffected by the first closing.
+	_, _, err = c2.OpenChannel(ctx, "x", nil, nil)
+	if _, ok := err.(*OpenChannelError); !ok {
+		t.Errorf("OpenChannel: got %v, want rejection", err)
+	}
+
+	config.Halt.RequestStop()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeListener: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListener did not return")
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- c2.Wait() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection survived stopping config.Halt")
+	}
+}
+
+// flakyListener fails its first Accepts with a temporary error, as
+// when the process is out of file descriptors.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "accept: too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeListenerTemporaryError(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	l := &flakyListener{Listener: tl, failures: 3}
+	config := &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+	ctx, cancel := context.WithCancel(context.Background())
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeListener(ctx, l, config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+			go DiscardRequests(ctx, reqs, nil)
+			for ch := range chans {
+				ch.Reject(Prohibited, "serve test")
+			}
+		})
+	}()
+
+	client, err := Dial(ctx, "tcp", tl.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial after temporary Accept errors: %v", err)
+	}
+	client.Close()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeListener: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeListener did not return")
+	}
+	if config.Halt != nil {
+		t.Error("ServeListener set config.Halt")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+	srv := &Server{
+		Config: config,
+		Handler: func(ctx context.Context, conn *ServerConn, newCh NewChannel) {
+			ch, reqs, err := newCh.Accept()
+			if err != nil {
+				return
+			}
+			go DiscardRequests(ctx, reqs, nil)
+			ch.Write([]byte("hello"))
+			ch.Close()
+		},
+	}
+	ctx := context.Background()
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, l) }()
+
+	dial := func() *Client {
+		clientConf := &ClientConfig{
+			User:            "user",
+			HostKeyCallback: InsecureIgnoreHostKey(),
+			Config:          Config{Halt: NewHalter()},
+		}
+		client, err := Dial(ctx, "tcp", l.Addr().String(), clientConf)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		return client
+	}
+	client := dial()
+	ch, reqs, err := client.OpenChannel(ctx, "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, reqs, nil)
+	if data, err := ioutil.ReadAll(ch); err != nil || string(data) != "hello" {
+		t.Errorf("got %q, %v", data, err)
+	}
+
+	// Shutdown waits for the open connection.
+	shut := make(chan error, 1)
+	go func() { shut <- srv.Shutdown(ctx) }()
+	select {
+	case err := <-shut:
+		t.Fatalf("Shutdown returned %v with a connection open", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve: got %v, want ErrServerClosed", err)
+	}
+	client.Close()
+	select {
+	case err := <-shut:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the connection closed")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	config := &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+	srv := &Server{Addr: "127.0.0.1:0", Config: config}
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ctx := context.Background()
+	go srv.Serve(ctx, l)
+
+	clientConf := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	client, err := Dial(ctx, "tcp", l.Addr().String(), clientConf)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if _, _, err := client.OpenChannel(ctx, "session", nil, nil); err == nil {
+		t.Error("channel accepted without a Handler")
+	}
+
+	sctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown: got %v, want DeadlineExceeded", err)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("connection survived the Shutdown timeout")
+	}
+	if err := srv.Serve(ctx, l); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown: got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestGetConfigForConn(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	tenant := &ServerConfig{NoClientAuth: true}
+	tenant.AddHostKey(testSigners["ecdsa"])
+
+	for _, refuse := range []bool{false, true} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		remotes := make(chan net.Addr, 1)
+		serverConf := &ServerConfig{
+			NoClientAuth: true,
+			GetConfigForConn: func(local, remote net.Addr) (*ServerConfig, error) {
+				remotes <- remote
+				if refuse {
+					return nil, errors.New("no tenant")
+				}
+				return tenant, nil
+			},
+			Config: Config{Halt: NewHalter()},
+		}
+		serverConf.AddHostKey(testSigners["rsa"])
+		ctx := context.Background()
+		go newServer(ctx, c1, serverConf)
+
+		clientConf := &ClientConfig{
+			User:            "user",
+			HostKeyCallback: FixedHostKey(testSigners["ecdsa"].PublicKey()),
+			Config:          Config{Halt: NewHalter()},
+		}
+		_, _, _, err = NewClientConn(ctx, c2, "", clientConf)
+		if refuse && err == nil {
+			t.Error("connection succeeded though GetConfigForConn failed")
+		}
+		if !refuse {
+			if err != nil {
+				t.Errorf("NewClientConn with the tenant's host key: %v", err)
+			}
+			if gotRemote := <-remotes; gotRemote.String() != c2.LocalAddr().String() {
+				t.Errorf("got remote address %v, want %v", gotRemote, c2.LocalAddr())
+			}
+		}
+		clientConf.Halt.RequestStop()
+		serverConf.Halt.RequestStop()
+		c1.Close()
+		c2.Close()
+	}
+}
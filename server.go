@@ -12,6 +12,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 )
 
 var ErrShutDown = fmt.Errorf("ssh: shutting down.")
@@ -27,13 +28,14 @@ type Permissions struct {
 	// user certificates. The standard for SSH certificates
 	// defines "force-command" (only allow the given command to
 	// execute) and "source-address" (only allow connections from
-	// the given address). The SSH package currently only enforces
-	// the "source-address" critical option. It is up to server
-	// implementations to enforce other critical options, such as
-	// "force-command", by checking them after the SSH handshake
-	// is successful. In general, SSH servers should reject
-	// connections that specify critical options that are unknown
-	// or not supported.
+	// the given address). The SSH package enforces both: channels
+	// from other addresses are rejected, and the shell, exec and
+	// subsystem requests of sessions are rewritten to exec the
+	// forced command. Other critical options can be enforced with
+	// ServerConfig.CriticalOptionHandlers, or by checking them after
+	// the SSH handshake is successful. In general, SSH servers
+	// should reject connections that specify critical options that
+	// are unknown or not supported.
 	CriticalOptions map[string]string
 
 	// Extensions are extra functionality that the server may
@@ -46,6 +48,15 @@ type Permissions struct {
 	// pass data from the authentication callbacks to the server
 	// application layer.
 	Extensions map[string]string
+
+	// CertValues holds the values that the validators of a
+	// CertChecker parsed from the critical options and extensions
+	// of the certificate, by name.
+	CertValues map[string]interface{}
+
+	// Quota, if non-nil, limits the channels and bandwidth of the
+	// connection. It may be shared with other connections.
+	Quota *Quota
 }
 
 // ServerConfig holds server specific configuration data.
@@ -79,6 +90,14 @@ type ServerConfig struct {
 	// Permissions.Extensions entry.
 	PublicKeyCallback func(conn ConnMetadata, key PublicKey) (*Permissions, error)
 
+	// PublicKeyAuthAlgorithms, if non-nil, lists the signature
+	// algorithms accepted in publickey authentication, for keys
+	// and for the keys of certificates, and sent to the client as
+	// server-sig-algs. For example, leaving out SigAlgoRSA allows
+	// RSA keys only with the SHA-2 signatures of RFC 8332. If nil,
+	// all supported algorithms are accepted.
+	PublicKeyAuthAlgorithms []string
+
 	// KeyboardInteractiveCallback, if non-nil, is called when
 	// keyboard-interactive authentication is selected (RFC
 	// 4256). The client object's Challenge function should be
@@ -92,12 +111,101 @@ type ServerConfig struct {
 	// attempts.
 	AuthLogCallback func(conn ConnMetadata, method string, err error)
 
+	// BeforeAuthCallback, if non-nil, is called before each
+	// authentication attempt, public key queries included, with
+	// the method the client asks for. An error fails the attempt
+	// without consulting the callback of the method, for
+	// policies such as geo-blocking or lockouts that apply to
+	// all methods.
+	BeforeAuthCallback func(conn ConnMetadata, method string) error
+
+	// AfterAuthCallback, if non-nil, is called after each
+	// authentication attempt but public key ones without a verified
+	// signature, that is queries and those vetoed by
+	// BeforeAuthCallback, with the outcome of the method callback
+	// or of BeforeAuthCallback. Its
+	// results replace that outcome, so it can deny an attempt the
+	// method allowed, or allow one it denied. AuthLogCallback and
+	// AuditCallback see the replaced outcome.
+	AfterAuthCallback func(conn ConnMetadata, method string, perms *Permissions, err error) (*Permissions, error)
+
 	// ServerVersion is the version identification string to announce in
 	// the public handshake.
 	// If empty, a reasonable default is used.
 	// Note that RFC 4253 section 4.2 requires that this string start with
 	// "SSH-2.0-".
 	ServerVersion string
+
+	// GEXGroups lists the Diffie-Hellman groups offered to clients
+	// that negotiate diffie-hellman-group-exchange-sha256. If
+	// empty, the RFC 3526 2048, 4096 and 8192 bit groups are
+	// used. See ParseModuli for reading an OpenSSH moduli file.
+	GEXGroups []GEXGroup
+
+	// AuditCallback, if non-nil, is called with a record of
+	// authentication attempts and their outcome, channel opens and
+	// closes, exec and forwarding requests, and the disconnect of
+	// each connection. It is called from the connection's read
+	// loop, so it must not block.
+	AuditCallback func(ev *AuditEvent)
+
+	// HoneypotCallback, if non-nil, puts the server in honeypot
+	// mode: it replaces PasswordCallback, PublicKeyCallback and
+	// KeyboardInteractiveCallback, and is called with every
+	// password, public key and keyboard-interactive attempt. The
+	// returned policy decides the outcome of the attempt.
+	HoneypotCallback func(attempt *AuthAttempt) HoneypotPolicy
+
+	// TarpitDelay is how long HoneypotTarpit stalls an attempt
+	// before rejecting it. If zero, 10 seconds is used. The stall
+	// ends early if the client hangs up, the ctx of the
+	// connection is done, or the server stops.
+	TarpitDelay time.Duration
+
+	// ProxyProtocol tells whether connections start with a PROXY
+	// protocol header, version 1 or 2, from a load balancer. If
+	// so, ConnMetadata reports the client and destination
+	// addresses from the header. Only enable it when all
+	// connections come through a trusted proxy, since clients
+	// can otherwise claim any address.
+	ProxyProtocol ProxyProtocolPolicy
+
+	// ProxyHeaderTimeout bounds the wait for the PROXY header, or
+	// for the first byte with ProxyProtocolOptional, so that a
+	// client that sends nothing cannot hold the connection; the
+	// connection is closed when it runs out. If zero, 5 seconds
+	// is used; ctx may end the wait sooner. The deadlines of the
+	// connection are left alone.
+	ProxyHeaderTimeout time.Duration
+
+	// GetConfigForConn, if non-nil, is called for each connection
+	// before the version exchange, with the addresses of the
+	// connection, after any PROXY header. If it returns a non-nil
+	// config, that config is used for the connection instead,
+	// for instance to serve different host keys or authentication
+	// callbacks to different tenants of a listener. The Halt,
+	// ProxyProtocol, ProxyHeaderTimeout, GetConfigForConn and
+	// Registry fields of the returned config are ignored. An error
+	// closes the connection.
+	GetConfigForConn func(localAddr, remoteAddr net.Addr) (*ServerConfig, error)
+
+	// Registry, if non-nil, tracks the connections once they are
+	// authenticated, see ConnRegistry.
+	Registry *ConnRegistry
+
+	// AuthFailureDelay, if positive, is the least time a failed
+	// password, public key or keyboard-interactive attempt takes
+	// before the client is told, plus a random part of up to a
+	// quarter of it. With callbacks that take about the same
+	// time for every user, this keeps clients from telling apart
+	// unknown users from wrong credentials; the replies already
+	// are the same. See PasswordsEqual.
+	AuthFailureDelay time.Duration
+
+	// CriticalOptionHandlers enforce critical options of the
+	// authenticated Permissions, keyed by option name, on the
+	// channels of each connection. See CriticalOptionHandler.
+	CriticalOptionHandlers map[string]CriticalOptionHandler
 }
 
 // AddHostKey adds a private key as a host key. If an existing host
@@ -166,19 +274,73 @@ type ServerConn struct {
 // Request and NewChannel channels must be serviced, or the connection
 // will hang.
 func NewServerConn(ctx context.Context, c net.Conn, config *ServerConfig) (*ServerConn, <-chan NewChannel, <-chan *Request, error) {
+	s, fullConf, perms, err := newServerConnection(ctx, c, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.mux = newMux(ctx, s.transport, fullConf.Halt, &fullConf.Config, muxOptions{
+		meta:    s,
+		audit:   newAuditFunc(s, fullConf.AuditCallback),
+		enforce: newOptionEnforcer(s, perms, fullConf.CriticalOptionHandlers),
+		quota:   quotaOf(perms),
+	})
+	if fullConf.Registry != nil {
+		fullConf.Registry.add(s)
+	}
+	return &ServerConn{s, perms}, s.mux.incomingChannels, s.mux.incomingRequests, nil
+}
+
+// newServerConnection runs the handshake of a server connection over
+// c, key exchange and authentication, and returns the connection,
+// the config it uses, with its defaults set, and the Permissions
+// the client was granted.
+func newServerConnection(ctx context.Context, c net.Conn, config *ServerConfig) (*connection, *ServerConfig, *Permissions, error) {
+	pc, err := readProxyHeader(ctx, c, config.ProxyProtocol, config.ProxyHeaderTimeout, config.Clock)
+	if err != nil {
+		c.Close()
+		return nil, nil, nil, err
+	}
+	c = pc
+
+	if config.GetConfigForConn != nil {
+		sel, err := config.GetConfigForConn(c.LocalAddr(), c.RemoteAddr())
+		if err != nil {
+			c.Close()
+			return nil, nil, nil, err
+		}
+		if sel != nil {
+			selected := *sel
+			selected.Halt = config.Halt
+			selected.ProxyProtocol = config.ProxyProtocol
+			selected.ProxyHeaderTimeout = config.ProxyHeaderTimeout
+			selected.GetConfigForConn = nil
+			selected.Registry = config.Registry
+			config = &selected
+		}
+	}
+
 	fullConf := *config
 	fullConf.SetDefaults()
 	if fullConf.MaxAuthTries == 0 {
 		fullConf.MaxAuthTries = 6
 	}
 
+	if c, err = wrapConn(&fullConf.Config, c, false); err != nil {
+		return nil, nil, nil, err
+	}
 	s := newConnection(c, &fullConf.Config, nil)
+	fullConf.setHoneypot(ctx, s)
+	start := fullConf.Clock.Now()
 	perms, err := s.serverHandshake(ctx, &fullConf)
+	reportHandshake(&fullConf.Config, start, err)
 	if err != nil {
+		if audit := newAuditFunc(s, fullConf.AuditCallback); audit != nil {
+			audit(&AuditEvent{Type: AuditDisconnect, Err: err})
+		}
 		c.Close()
 		return nil, nil, nil, err
 	}
-	return &ServerConn{s, perms}, s.mux.incomingChannels, s.mux.incomingRequests, nil
+	return s, &fullConf, perms, nil
 }
 
 // signAndMarshal signs the data with the appropriate algorithm,
@@ -208,10 +370,13 @@ func (s *connection) serverHandshake(ctx context.Context, config *ServerConfig)
 		s.serverVersion = []byte(packageVersion)
 	}
 	var err error
-	s.clientVersion, err = exchangeVersions(s.sshConn.conn, s.serverVersion)
+	s.clientVersion, err = exchangeVersionsConn(s.sshConn.conn, s.serverVersion, &config.Config)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkPeerVersion(&config.Config, s.clientVersion); err != nil {
+		return nil, err
+	}
 
 	tr := newTransport(s.sshConn.conn, config.Rand, false /* not client */, &config.Config)
 	s.transport = newServerTransport(ctx, tr, s.clientVersion, s.serverVersion, config)
@@ -244,23 +409,45 @@ func (s *connection) serverHandshake(ctx context.Context, config *ServerConfig)
 		return nil, err
 	}
 
-	perms, err := s.serverAuthenticate(ctx, config)
-	if err != nil {
-		return nil, err
-	}
-	s.mux = newMux(ctx, s.transport, config.Halt)
-	return perms, err
+	return s.serverAuthenticate(ctx, config)
 }
 
 func isAcceptableAlgo(algo string) bool {
 	switch algo {
 	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
+		SigAlgoRSASHA2256, SigAlgoRSASHA2512,
 		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
 		return true
 	}
 	return false
 }
 
+// serverSigAlgs lists the signature algorithms a server accepts in
+// publickey authentication, sent as the server-sig-algs extension of
+// RFC 8308 for clients to pick the rsa-sha2 ones of RFC 8332.
+var serverSigAlgs = []string{
+	KeyAlgoED25519, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	SigAlgoRSASHA2512, SigAlgoRSASHA2256, KeyAlgoRSA, KeyAlgoDSA,
+}
+
+// acceptsSigAlgo reports whether c takes signatures of algo in
+// publickey authentication.
+func (c *ServerConfig) acceptsSigAlgo(algo string) bool {
+	return c.PublicKeyAuthAlgorithms == nil || contains(c.PublicKeyAuthAlgorithms, algo)
+}
+
+// sigAlgoOf returns the signature algorithm of a publickey request
+// for the algorithm algo: that of the certified key for certificates,
+// algo itself otherwise.
+func sigAlgoOf(algo string) string {
+	for keyAlgo, certAlgo := range certAlgoNames {
+		if certAlgo == algo {
+			return keyAlgo
+		}
+	}
+	return algo
+}
+
 func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
 	if addr == nil {
 		return errors.New("ssh: no address known for client, but source-address match required")
@@ -308,6 +495,11 @@ func (l ServerAuthError) Error() string {
 	return "[" + strings.Join(errs, ", ") + "]"
 }
 
+// Is reports whether target is ErrAuthFailed.
+func (l ServerAuthError) Is(target error) bool {
+	return target == ErrAuthFailed
+}
+
 func (s *connection) serverAuthenticate(ctx context.Context, config *ServerConfig) (*Permissions, error) {
 	sessionID := s.transport.getSessionID()
 	var cache pubKeyCache
@@ -315,6 +507,7 @@ func (s *connection) serverAuthenticate(ctx context.Context, config *ServerConfi
 
 	authFailures := 0
 	var authErrs []error
+	audit := newAuditFunc(s, config.AuditCallback)
 
 userAuthLoop:
 	for {
@@ -345,11 +538,28 @@ userAuthLoop:
 			return nil, errors.New("ssh: client attempted to negotiate for unknown service: " + userAuthReq.Service)
 		}
 
+		start := config.Clock.Now()
 		s.user = userAuthReq.User
 		perms = nil
+		if audit != nil {
+			audit(&AuditEvent{Type: AuditAuthAttempt, Method: userAuthReq.Method})
+		}
 		authErr := errors.New("no auth passed yet")
+		method := userAuthReq.Method
+		isQuery := false
+		// sigVerified is set once a public key attempt has its
+		// signature checked.
+		sigVerified := false
+		if config.BeforeAuthCallback != nil {
+			if err := config.BeforeAuthCallback(s, userAuthReq.Method); err != nil {
+				authErr = err
+				method = ""
+			}
+		}
 
-		switch userAuthReq.Method {
+		switch method {
+		case "":
+			// Vetoed by BeforeAuthCallback.
 		case "none":
 			if config.NoClientAuth {
 				authErr = nil
@@ -392,14 +602,14 @@ userAuthLoop:
 			if len(payload) < 1 {
 				return nil, parseError(msgUserAuthRequest)
 			}
-			isQuery := payload[0] == 0
+			isQuery = payload[0] == 0
 			payload = payload[1:]
 			algoBytes, payload, ok := parseString(payload)
 			if !ok {
 				return nil, parseError(msgUserAuthRequest)
 			}
 			algo := string(algoBytes)
-			if !isAcceptableAlgo(algo) {
+			if !isAcceptableAlgo(algo) || !config.acceptsSigAlgo(sigAlgoOf(algo)) {
 				authErr = fmt.Errorf("ssh: algorithm %q not accepted", algo)
 				break
 			}
@@ -459,11 +669,18 @@ userAuthLoop:
 				if !isAcceptableAlgo(sig.Format) {
 					break
 				}
+				// The signature must be made with the algorithm
+				// of the request, RFC 8332 section 3.2.
+				if sig.Format != sigAlgoOf(algo) {
+					authErr = fmt.Errorf("ssh: signature algorithm %q does not match %q", sig.Format, algo)
+					break
+				}
 				signedData := buildDataSignedForAuth(sessionID, userAuthReq, algoBytes, pubKeyData)
 
 				if err := pubKey.Verify(signedData, sig); err != nil {
 					return nil, err
 				}
+				sigVerified = true
 
 				authErr = candidate.result
 				perms = candidate.perms
@@ -472,17 +689,43 @@ userAuthLoop:
 			authErr = fmt.Errorf("ssh: unknown method %q", userAuthReq.Method)
 		}
 
+		// A public key attempt without a verified signature, be it
+		// a query or one vetoed by BeforeAuthCallback before it was
+		// parsed, must stay failed: allowing it would let the
+		// client in without a signature.
+		unsigned := userAuthReq.Method == "publickey" && !sigVerified
+		if config.AfterAuthCallback != nil && !unsigned {
+			perms, authErr = config.AfterAuthCallback(s, userAuthReq.Method, perms, authErr)
+		}
+
 		authErrs = append(authErrs, authErr)
 
 		if config.AuthLogCallback != nil {
 			config.AuthLogCallback(s, userAuthReq.Method, authErr)
 		}
+		if m := config.Metrics; m != nil {
+			result := "ok"
+			if authErr != nil {
+				result = "failure"
+			}
+			m.Counter(MetricAuthAttempts, 1, "method", userAuthReq.Method, "result", result)
+		}
+		if audit != nil {
+			ev := &AuditEvent{Type: AuditAuthSuccess, Method: userAuthReq.Method}
+			if authErr != nil {
+				ev.Type, ev.Err = AuditAuthFailure, authErr
+			}
+			audit(ev)
+		}
 
 		if authErr == nil {
 			break userAuthLoop
 		}
 
 		authFailures++
+		if userAuthReq.Method != "none" {
+			padAuthFailure(ctx, config.Halt, config.Rand, config.Clock, start, config.AuthFailureDelay)
+		}
 
 		var failureMsg userAuthFailureMsg
 		if config.PasswordCallback != nil {
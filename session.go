@@ -14,7 +14,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Signal string
@@ -130,6 +134,15 @@ type Session struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// ObscureKeystrokeTiming, if positive, holds back what is
+	// written to the stdin of a session with a pty until the next
+	// tick of this interval, and sends chaff on the ticks between
+	// keystrokes, until a second or more after the last one, so
+	// that the timing of packets does not give away that of the
+	// keys typed, such as those of a password. OpenSSH's option of
+	// the same name uses 20ms. Set it before StdinPipe or Start.
+	ObscureKeystrokeTiming time.Duration
+
 	ch        Channel // the channel backing this session
 	started   bool    // true once Start, Run or Shell is invoked.
 	copyFuncs []func() error
@@ -144,12 +157,22 @@ type Session struct {
 	stdinPipeWriter io.WriteCloser
 
 	exitStatus chan error
+
+	// stats is a pointer, to keep its atomic counters aligned.
+	stats *sessionCounters
+
+	// pty is set, atomically, once a pty-req succeeds.
+	pty int32
+
+	// stderrTail keeps the end of the standard error of the
+	// command, for its ExitError, if Stderr was nil.
+	stderrTail *tailBuffer
 }
 
 // SendRequest sends an out-of-band channel request on the SSH channel
 // underlying the session.
 func (s *Session) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
-	return s.ch.SendRequest(name, wantReply, payload)
+	return s.sendRequest(name, wantReply, payload)
 }
 
 func (s *Session) Close() error {
@@ -169,13 +192,57 @@ func (s *Session) Setenv(name, value string) error {
 		Name:  name,
 		Value: value,
 	}
-	ok, err := s.ch.SendRequest("env", true, Marshal(&msg))
+	ok, err := s.sendRequest("env", true, Marshal(&msg))
 	if err == nil && !ok {
 		err = errors.New("ssh: setenv failed")
 	}
 	return err
 }
 
+// EnvRejectedError is returned by SetEnvMap when the server rejects
+// some of the variables, as sshd rejects those its AcceptEnv does
+// not list.
+type EnvRejectedError struct {
+	// Names are the names of the variables rejected, in the
+	// order they were sent.
+	Names []string
+}
+
+func (e *EnvRejectedError) Error() string {
+	return "ssh: server rejected environment variables " + strings.Join(e.Names, ", ")
+}
+
+// SetEnvMap sets the environment variables of env, as Setenv does,
+// in the order of their names, so that a server that sees the same
+// map sees the same requests. It sends them all, even after the
+// server rejects one, and returns an *EnvRejectedError naming those
+// the server rejected. Any other error ends it early.
+func (s *Session) SetEnvMap(env map[string]string) error {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var rejected []string
+	for _, name := range names {
+		msg := setenvRequest{
+			Name:  name,
+			Value: env[name],
+		}
+		ok, err := s.sendRequest("env", true, Marshal(&msg))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			rejected = append(rejected, name)
+		}
+	}
+	if len(rejected) > 0 {
+		return &EnvRejectedError{Names: rejected}
+	}
+	return nil
+}
+
 // RFC 4254 Section 6.2.
 type ptyRequestMsg struct {
 	Term     string
@@ -206,10 +273,13 @@ func (s *Session) RequestPty(term string, h, w int, termmodes TerminalModes) err
 		Height:   uint32(h * 8),
 		Modelist: string(tm),
 	}
-	ok, err := s.ch.SendRequest("pty-req", true, Marshal(&req))
+	ok, err := s.sendRequest("pty-req", true, Marshal(&req))
 	if err == nil && !ok {
 		err = errors.New("ssh: pty-req failed")
 	}
+	if err == nil {
+		atomic.StoreInt32(&s.pty, 1)
+	}
 	return err
 }
 
@@ -224,7 +294,7 @@ func (s *Session) RequestSubsystem(subsystem string) error {
 	msg := subsystemRequestMsg{
 		Subsystem: subsystem,
 	}
-	ok, err := s.ch.SendRequest("subsystem", true, Marshal(&msg))
+	ok, err := s.sendRequest("subsystem", true, Marshal(&msg))
 	if err == nil && !ok {
 		err = errors.New("ssh: subsystem request failed")
 	}
@@ -247,7 +317,7 @@ func (s *Session) WindowChange(h, w int) error {
 		Width:   uint32(w * 8),
 		Height:  uint32(h * 8),
 	}
-	_, err := s.ch.SendRequest("window-change", false, Marshal(&req))
+	_, err := s.sendRequest("window-change", false, Marshal(&req))
 	return err
 }
 
@@ -263,7 +333,7 @@ func (s *Session) Signal(sig Signal) error {
 		Signal: string(sig),
 	}
 
-	_, err := s.ch.SendRequest("signal", false, Marshal(&msg))
+	_, err := s.sendRequest("signal", false, Marshal(&msg))
 	return err
 }
 
@@ -283,7 +353,7 @@ func (s *Session) Start(cmd string) error {
 		Command: cmd,
 	}
 
-	ok, err := s.ch.SendRequest("exec", true, Marshal(&req))
+	ok, err := s.sendRequest("exec", true, Marshal(&req))
 	if err == nil && !ok {
 		err = fmt.Errorf("ssh: command %v failed", cmd)
 	}
@@ -325,6 +395,92 @@ func (s *Session) Output(cmd string) ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// OutputLimitError is returned when the output of a remote command
+// exceeds the limit set with OutputLimited or LimitReader.
+type OutputLimitError struct {
+	Limit int64
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("ssh: remote output exceeds %d bytes", e.Limit)
+}
+
+// limitWriter passes on up to n bytes, and then fails with an
+// *OutputLimitError after calling overflow.
+type limitWriter struct {
+	w        io.Writer
+	limit, n int64
+	overflow func()
+	exceeded bool
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.n {
+		w.n -= int64(len(p))
+		return w.w.Write(p)
+	}
+	n, err := w.w.Write(p[:w.n])
+	w.n = 0
+	if err != nil {
+		return n, err
+	}
+	if !w.exceeded {
+		w.exceeded = true
+		w.overflow()
+	}
+	return n, &OutputLimitError{Limit: w.limit}
+}
+
+// OutputLimited is like Output, but buffers at most n bytes of
+// output, so that a misbehaving server cannot exhaust our memory. If
+// the command writes more, the session is closed, and the first n
+// bytes are returned with an *OutputLimitError.
+func (s *Session) OutputLimited(cmd string, n int64) ([]byte, error) {
+	if s.Stdout != nil {
+		return nil, errors.New("ssh: Stdout already set")
+	}
+	var b bytes.Buffer
+	w := &limitWriter{w: &b, limit: n, n: n, overflow: func() { s.Close() }}
+	s.Stdout = w
+	err := s.Run(cmd)
+	if w.exceeded {
+		err = &OutputLimitError{Limit: n}
+	}
+	return b.Bytes(), err
+}
+
+// limitedReader is the io.Reader of LimitReader.
+type limitedReader struct {
+	r        io.Reader
+	limit, n int64
+}
+
+// LimitReader returns a Reader that reads from r, such as the pipe of
+// Session.StdoutPipe, up to n bytes. Unlike io.LimitReader, it fails
+// with an *OutputLimitError if r has more, rather than ending with
+// io.EOF, so that truncated output is not mistaken for all of it.
+func LimitReader(r io.Reader, n int64) io.Reader {
+	return &limitedReader{r: r, limit: n, n: n}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Check for more data before failing.
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, &OutputLimitError{Limit: l.limit}
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
 type singleWriter struct {
 	b  bytes.Buffer
 	mu sync.Mutex
@@ -359,7 +515,7 @@ func (s *Session) Shell() error {
 		return errors.New("ssh: session already started")
 	}
 
-	ok, err := s.ch.SendRequest("shell", true, nil)
+	ok, err := s.sendRequest("shell", true, nil)
 	if err == nil && !ok {
 		return errors.New("ssh: could not start shell")
 	}
@@ -371,6 +527,7 @@ func (s *Session) Shell() error {
 
 func (s *Session) start() error {
 	s.started = true
+	s.stats.started()
 
 	type F func(*Session)
 	for _, setupFd := range []F{(*Session).stdin, (*Session).stdout, (*Session).stderr} {
@@ -425,6 +582,9 @@ func (s *Session) Wait() error {
 			}
 		}
 		if waitErr != nil {
+			if e, ok := waitErr.(*ExitError); ok && s.stderrTail != nil {
+				e.Stderr = s.stderrTail.Bytes()
+			}
 			return waitErr
 		}
 		return copyError
@@ -438,6 +598,7 @@ func (s *Session) wait(reqs <-chan *Request) error {
 		switch msg.Type {
 		case "exit-status":
 			wm.status = int(binary.BigEndian.Uint32(msg.Payload))
+			s.stats.exit(wm.status, "")
 		case "exit-signal":
 			var sigval struct {
 				Signal     string
@@ -451,8 +612,10 @@ func (s *Session) wait(reqs <-chan *Request) error {
 
 			// Must sanitize strings?
 			wm.signal = sigval.Signal
+			wm.coreDumped = sigval.CoreDumped
 			wm.msg = sigval.Error
 			wm.lang = sigval.Lang
+			s.stats.exit(-1, wm.signal)
 		default:
 			// This handles keepalives and matches
 			// OpenSSH's behaviour.
@@ -479,7 +642,35 @@ func (s *Session) wait(reqs <-chan *Request) error {
 		}
 	}
 
-	return &ExitError{wm}
+	return &ExitError{Waitmsg: wm}
+}
+
+// stderrTailSize is how much of the standard error of a command an
+// ExitError keeps.
+const stderrTailSize = 32 << 10
+
+// tailBuffer is a Writer that keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= t.max {
+		t.buf = append(t.buf[:0], p[len(p)-t.max:]...)
+		return n, nil
+	}
+	if over := len(t.buf) + len(p) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	t.buf = append(t.buf, p...)
+	return n, nil
+}
+
+// Bytes returns a copy of what t holds.
+func (t *tailBuffer) Bytes() []byte {
+	return append([]byte(nil), t.buf...)
 }
 
 // ExitMissingError is returned if a session is torn down cleanly, but
@@ -505,8 +696,18 @@ func (s *Session) stdin() {
 		}()
 		stdin, s.stdinPipeWriter = r, w
 	}
+	var w io.Writer = countingWriter{s.ch, &s.stats.stdin}
+	keys := s.keystrokes(w)
+	if keys != nil {
+		w = keys
+	}
 	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.ch, stdin)
+		_, err := io.Copy(w, stdin)
+		if keys != nil {
+			if err1 := keys.Close(); err == nil {
+				err = err1
+			}
+		}
 		if err1 := s.ch.CloseWrite(); err == nil && err1 != io.EOF {
 			err = err1
 		}
@@ -522,7 +723,7 @@ func (s *Session) stdout() {
 		s.Stdout = ioutil.Discard
 	}
 	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.Stdout, s.ch)
+		_, err := io.Copy(s.Stdout, countingReader{s.ch, &s.stats.stdout})
 		return err
 	})
 }
@@ -532,10 +733,11 @@ func (s *Session) stderr() {
 		return
 	}
 	if s.Stderr == nil {
-		s.Stderr = ioutil.Discard
+		s.stderrTail = &tailBuffer{max: stderrTailSize}
+		s.Stderr = s.stderrTail
 	}
 	s.copyFuncs = append(s.copyFuncs, func() error {
-		_, err := io.Copy(s.Stderr, s.ch.Stderr())
+		_, err := io.Copy(s.Stderr, countingReader{s.ch.Stderr(), &s.stats.stderr})
 		return err
 	})
 }
@@ -543,10 +745,16 @@ func (s *Session) stderr() {
 // sessionStdin reroutes Close to CloseWrite.
 type sessionStdin struct {
 	io.Writer
-	ch Channel
+	ch   Channel
+	keys *keystrokeObscurer
 }
 
 func (s *sessionStdin) Close() error {
+	if s.keys != nil {
+		if err := s.keys.Close(); err != nil {
+			return err
+		}
+	}
 	return s.ch.CloseWrite()
 }
 
@@ -560,7 +768,12 @@ func (s *Session) StdinPipe() (io.WriteCloser, error) {
 		return nil, errors.New("ssh: StdinPipe after process started")
 	}
 	s.stdinpipe = true
-	return &sessionStdin{s.ch, s.ch}, nil
+	var w io.Writer = countingWriter{s.ch, &s.stats.stdin}
+	keys := s.keystrokes(w)
+	if keys != nil {
+		w = keys
+	}
+	return &sessionStdin{w, s.ch, keys}, nil
 }
 
 // StdoutPipe returns a pipe that will be connected to the
@@ -577,7 +790,7 @@ func (s *Session) StdoutPipe() (io.Reader, error) {
 		return nil, errors.New("ssh: StdoutPipe after process started")
 	}
 	s.stdoutpipe = true
-	return s.ch, nil
+	return countingChannel{s.ch, &s.stats.stdout}, nil
 }
 
 // StderrPipe returns a pipe that will be connected to the
@@ -594,13 +807,14 @@ func (s *Session) StderrPipe() (io.Reader, error) {
 		return nil, errors.New("ssh: StderrPipe after process started")
 	}
 	s.stderrpipe = true
-	return s.ch.Stderr(), nil
+	return countingReader{s.ch.Stderr(), &s.stats.stderr}, nil
 }
 
 // newSession returns a new interactive session on the remote host.
 func newSession(ch Channel, reqs <-chan *Request) (*Session, error) {
 	s := &Session{
-		ch: ch,
+		ch:    ch,
+		stats: new(sessionCounters),
 	}
 	s.exitStatus = make(chan error, 1)
 	go func() {
@@ -615,8 +829,29 @@ func newSession(ch Channel, reqs <-chan *Request) (*Session, error) {
 }
 
 // An ExitError reports unsuccessful completion of a remote command.
+// It has the ExitCode method of *exec.ExitError, so that both satisfy
+// ExitCoder.
 type ExitError struct {
 	Waitmsg
+
+	// Stderr holds the last bytes, up to 32KB, of the standard
+	// error of the command, if Session.Stderr was nil, as
+	// exec.ExitError.Stderr does for Output.
+	Stderr []byte
+}
+
+// ExitCoder is the interface of the errors of commands that ran and
+// failed, which both *ExitError and *exec.ExitError satisfy, so that
+// callers can handle the failures of local and remote commands
+// alike:
+//
+//	var ec ssh.ExitCoder
+//	if errors.As(err, &ec) && ec.ExitCode() == 1 {
+//		...
+//	}
+type ExitCoder interface {
+	error
+	ExitCode() int
 }
 
 func (e *ExitError) Error() string {
@@ -626,17 +861,47 @@ func (e *ExitError) Error() string {
 // Waitmsg stores the information about an exited remote command
 // as reported by Wait.
 type Waitmsg struct {
-	status int
-	signal string
-	msg    string
-	lang   string
+	status     int
+	signal     string
+	coreDumped bool
+	msg        string
+	lang       string
 }
 
-// ExitStatus returns the exit status of the remote command.
+// ExitStatus returns the exit status of the remote command. For a
+// command killed by a signal, without an exit status, it is 128 plus
+// the number of the signal, as shells report it.
 func (w Waitmsg) ExitStatus() int {
 	return w.status
 }
 
+// ExitCode returns the exit status of the remote command, or -1 if
+// it was killed by a signal, as exec.ExitError.ExitCode does.
+func (w Waitmsg) ExitCode() int {
+	if w.signal != "" {
+		return -1
+	}
+	return w.status
+}
+
+// Exited reports whether the remote command exited by itself, rather
+// than being killed by a signal.
+func (w Waitmsg) Exited() bool {
+	return w.signal == ""
+}
+
+// Signaled reports whether the remote command was killed by a
+// signal, which Signal names.
+func (w Waitmsg) Signaled() bool {
+	return w.signal != ""
+}
+
+// CoreDumped reports whether the remote command, killed by a signal,
+// dumped core.
+func (w Waitmsg) CoreDumped() bool {
+	return w.coreDumped
+}
+
 // Signal returns the exit signal of the remote command if
 // it was terminated violently.
 func (w Waitmsg) Signal() string {
@@ -657,6 +922,9 @@ func (w Waitmsg) String() string {
 	str := fmt.Sprintf("Process exited with status %v", w.status)
 	if w.signal != "" {
 		str += fmt.Sprintf(" from signal %v", w.signal)
+		if w.coreDumped {
+			str += " (core dumped)"
+		}
 	}
 	if w.msg != "" {
 		str += fmt.Sprintf(". Reason was: %v", w.msg)
@@ -16,6 +16,8 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"os/exec"
+	"strings"
 	"testing"
 
 	"github.com/glycerine/xcryptossh/terminal"
@@ -184,6 +186,71 @@ func TestSessionOutput(t *testing.T) {
 	}
 }
 
+// endlessOutputHandler writes to stdout until the channel is closed.
+func endlessOutputHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	req, ok := <-in
+	if !ok {
+		return
+	}
+	req.Reply(true, nil)
+	go DiscardRequests(context.Background(), in, nil)
+	buf := bytes.Repeat([]byte("x"), 4096)
+	for {
+		if _, err := ch.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+func TestSessionOutputLimited(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	ctx := context.Background()
+
+	conn := dial(fixedOutputHandler, t, halt)
+	defer conn.Close()
+	session, err := conn.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	buf, err := session.OutputLimited("", 100)
+	if err != nil || string(buf) != "this-is-stdout." {
+		t.Errorf("OutputLimited under the limit: got %q, %v", buf, err)
+	}
+
+	endless := dial(endlessOutputHandler, t, halt)
+	defer endless.Close()
+	session, err = endless.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	buf, err = session.OutputLimited("", 10000)
+	if limitErr, ok := err.(*OutputLimitError); !ok || limitErr.Limit != 10000 {
+		t.Errorf("OutputLimited: got %v, want an *OutputLimitError", err)
+	}
+	if len(buf) != 10000 {
+		t.Errorf("OutputLimited returned %d bytes, want 10000", len(buf))
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	got, err := ioutil.ReadAll(LimitReader(bytes.NewReader([]byte("hello")), 5))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("at the limit: got %q, %v", got, err)
+	}
+	got, err = ioutil.ReadAll(LimitReader(bytes.NewReader([]byte("hello world")), 5))
+	if _, ok := err.(*OutputLimitError); !ok || string(got) != "hello" {
+		t.Errorf("over the limit: got %q, %v, want an *OutputLimitError", got, err)
+	}
+}
+
 // Test that both stdout and stderr are returned
 // via the CombinedOutput helper.
 func TestSessionCombinedOutput(t *testing.T) {
@@ -246,6 +313,9 @@ func TestExitStatusNonZero(t *testing.T) {
 	if e.ExitStatus() != 15 {
 		t.Fatalf("expected command to exit with 15 but got %v", e.ExitStatus())
 	}
+	if e.ExitCode() != 15 || !e.Exited() || e.Signaled() {
+		t.Fatalf("expected exit code 15 without a signal but got %v, signaled %v", e.ExitCode(), e.Signaled())
+	}
 }
 
 // Test 0 exit status is returned correctly.
@@ -370,6 +440,67 @@ func TestUnknownExitSignal(t *testing.T) {
 	}
 }
 
+// The error of a remote command killed by a signal reads like that
+// of a local one.
+func TestExitErrorExitCoder(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	var _ ExitCoder = (*exec.ExitError)(nil)
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	conn := dial(coreDumpHandler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to request new session: %v", err)
+	}
+	defer session.Close()
+	_, err = session.Output("crash")
+	var ec ExitCoder
+	if !errors.As(err, &ec) {
+		t.Fatalf("expected an ExitCoder but got %T: %v", err, err)
+	}
+	if ec.ExitCode() != -1 {
+		t.Errorf("ExitCode = %d, want -1", ec.ExitCode())
+	}
+	e := err.(*ExitError)
+	if !e.Signaled() || e.Exited() || e.Signal() != "SEGV" || !e.CoreDumped() {
+		t.Errorf("got signal %q, signaled %v, core dumped %v; want SEGV, true, true", e.Signal(), e.Signaled(), e.CoreDumped())
+	}
+	if e.ExitStatus() != 139 {
+		t.Errorf("ExitStatus = %d, want 139", e.ExitStatus())
+	}
+	if want := "fatal: boom\n"; !bytes.HasSuffix(e.Stderr, []byte(want)) || len(e.Stderr) != stderrTailSize {
+		t.Errorf("Stderr has %d bytes ending in %q, want %d ending in %q", len(e.Stderr), e.Stderr[len(e.Stderr)-len(want):], stderrTailSize, want)
+	}
+	if !strings.Contains(e.Error(), "(core dumped)") {
+		t.Errorf("Error() = %q, want it to mention the core dump", e.Error())
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	tb := &tailBuffer{max: 4}
+	for _, tc := range []struct{ write, want string }{
+		{"ab", "ab"},
+		{"cd", "abcd"},
+		{"e", "bcde"},
+		{"fghij", "ghij"},
+		{"", "ghij"},
+	} {
+		if n, err := tb.Write([]byte(tc.write)); n != len(tc.write) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", tc.write, n, err)
+		}
+		if got := string(tb.Bytes()); got != tc.want {
+			t.Errorf("after Write(%q): %q, want %q", tc.write, got, tc.want)
+		}
+	}
+}
+
 func TestExitWithoutStatusOrSignal(t *testing.T) {
 	defer xtestend(xtestbegin(t))
 
@@ -481,17 +612,6 @@ func TestClientHandlesKeepalives(t *testing.T) {
 	}
 }
 
-type exitStatusMsg struct {
-	Status uint32
-}
-
-type exitSignalMsg struct {
-	Signal     string
-	CoreDumped bool
-	Errmsg     string
-	Lang       string
-}
-
 func handleTerminalRequests(in <-chan *Request) {
 	for req := range in {
 		ok := false
@@ -545,6 +665,24 @@ func exitSignalHandler(ch Channel, in <-chan *Request, t *testing.T) {
 	sendSignal("TERM", ch, t)
 }
 
+// coreDumpHandler writes more than the tail an ExitError keeps to
+// stderr, and reports that the command dumped core.
+func coreDumpHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		req.Reply(req.Type == "exec", nil)
+		if req.Type == "exec" {
+			break
+		}
+	}
+	go DiscardRequests(context.Background(), in, nil)
+	io.Copy(ch.Stderr(), bytes.NewReader(bytes.Repeat([]byte("noise "), stderrTailSize/4)))
+	io.WriteString(ch.Stderr(), "fatal: boom\n")
+	if err := SendExitSignal(ch, SIGSEGV, true, "Segmentation fault", ""); err != nil {
+		t.Errorf("unable to send signal: %v", err)
+	}
+}
+
 func exitSignalUnknownHandler(ch Channel, in <-chan *Request, t *testing.T) {
 	defer ch.Close()
 	shell := newServerShell(ch, in, "> ")
@@ -599,22 +737,13 @@ func readLine(shell *terminal.Terminal, t *testing.T) {
 }
 
 func sendStatus(status uint32, ch Channel, t *testing.T) {
-	msg := exitStatusMsg{
-		Status: status,
-	}
-	if _, err := ch.SendRequest("exit-status", false, Marshal(&msg)); err != nil {
+	if err := SendExitStatus(ch, status); err != nil {
 		t.Errorf("unable to send status: %v", err)
 	}
 }
 
 func sendSignal(signal string, ch Channel, t *testing.T) {
-	sig := exitSignalMsg{
-		Signal:     signal,
-		CoreDumped: false,
-		Errmsg:     "Process terminated",
-		Lang:       "en-GB-oed",
-	}
-	if _, err := ch.SendRequest("exit-signal", false, Marshal(&sig)); err != nil {
+	if err := SendExitSignal(ch, Signal(signal), false, "Process terminated", "en-GB-oed"); err != nil {
 		t.Errorf("unable to send signal: %v", err)
 	}
 }
@@ -896,3 +1025,97 @@ func TestHostKeyAlgorithms(t *testing.T) {
 		t.Fatal("succeeded connecting with unknown hostkey algorithm")
 	}
 }
+
+func TestMaxChannelPacket(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	ctx := context.Background()
+
+	want := make([]byte, 1<<20)
+	rand.Read(want)
+	go func() {
+		conf := ServerConfig{
+			NoClientAuth: true,
+			Config: Config{
+				// More than the transport can carry.
+				MaxChannelPacket: 1 << 20,
+				Halt:             NewHalter(),
+			},
+		}
+		conf.AddHostKey(testSigners["rsa"])
+		_, chans, reqs, err := NewServerConn(ctx, c1, &conf)
+		if err != nil {
+			t.Errorf("NewServerConn: %v", err)
+			return
+		}
+		go DiscardRequests(ctx, reqs, conf.Halt)
+		for newCh := range chans {
+			ch, in, err := newCh.Accept()
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			go DiscardRequests(ctx, in, conf.Halt)
+			ch.Write(want)
+			ch.Close()
+		}
+	}()
+
+	var dump bytes.Buffer
+	pd, err := NewPacketDump(&dump)
+	if err != nil {
+		t.Fatalf("NewPacketDump: %v", err)
+	}
+	halt := NewHalter()
+	defer halt.RequestStop()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "testuser",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config: Config{
+			MaxChannelPacket: 200000,
+			PacketDump:       pd,
+			Halt:             halt,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, halt)
+	defer client.Close()
+
+	ch, in, err := client.OpenChannel(ctx, "session", nil, nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(ctx, in, halt)
+	if got := ch.(*channel).maxRemotePayload; got != maxChannelPayload {
+		t.Errorf("server advertised %d, want it lowered to %d", got, maxChannelPayload)
+	}
+	got, err := ioutil.ReadAll(ch)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, not the %d written", len(got), len(want))
+	}
+
+	packets, err := ReadPacketDump(&dump)
+	if err != nil {
+		t.Fatalf("ReadPacketDump: %v", err)
+	}
+	largest := 0
+	for _, p := range packets {
+		if !p.Sent && p.Packet[0] == msgChannelData && len(p.Packet)-9 > largest {
+			largest = len(p.Packet) - 9
+		}
+	}
+	if largest != 200000 {
+		t.Errorf("largest channel data received: %d bytes, want 200000", largest)
+	}
+}
@@ -0,0 +1,330 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The requests of a "session" channel, RFC 4254 section 6, as a
+// server receives them. ParseSessionRequest decodes any of them.
+
+// ShellRequest is a "shell" request, which has no payload.
+type ShellRequest struct{}
+
+// ExecRequest is an "exec" request.
+type ExecRequest struct {
+	Command string
+}
+
+// SubsystemRequest is a "subsystem" request.
+type SubsystemRequest struct {
+	Subsystem string
+}
+
+// EnvRequest is an "env" request.
+type EnvRequest struct {
+	Name  string
+	Value string
+}
+
+// PtyRequest is a "pty-req" request. Columns and Rows are in
+// characters, Width and Height in pixels; any may be zero.
+type PtyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   TerminalModes
+}
+
+// WindowChangeRequest is a "window-change" request.
+type WindowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// SignalRequest is a "signal" request. Signal is the name without
+// the "SIG" prefix, like SIGINT.
+type SignalRequest struct {
+	Signal Signal
+}
+
+// ParseSessionRequest decodes the payload of req according to its
+// type, returning one of *ShellRequest, *ExecRequest,
+// *SubsystemRequest, *EnvRequest, *PtyRequest,
+// *WindowChangeRequest or *SignalRequest. Other types give an
+// error.
+func ParseSessionRequest(req *Request) (interface{}, error) {
+	switch req.Type {
+	case "shell":
+		return &ShellRequest{}, nil
+	case "exec":
+		return ParseExecRequest(req.Payload)
+	case "subsystem":
+		var msg subsystemRequestMsg
+		if err := Unmarshal(req.Payload, &msg); err != nil {
+			return nil, err
+		}
+		return &SubsystemRequest{Subsystem: msg.Subsystem}, nil
+	case "env":
+		return ParseEnvRequest(req.Payload)
+	case "pty-req":
+		return ParsePtyRequest(req.Payload)
+	case "window-change":
+		return ParseWindowChangeRequest(req.Payload)
+	case "signal":
+		var msg signalMsg
+		if err := Unmarshal(req.Payload, &msg); err != nil {
+			return nil, err
+		}
+		return &SignalRequest{Signal: Signal(msg.Signal)}, nil
+	}
+	return nil, fmt.Errorf("ssh: unknown session request %q", req.Type)
+}
+
+// SessionSetup is what the client of a session set up before it
+// asked for a shell, a command or a subsystem.
+type SessionSetup struct {
+	// Env holds the environment variables the server accepted.
+	// A variable set twice has its last value.
+	Env map[string]string
+
+	// Pty is the pty the client asked for, if any, with the size
+	// of its last "window-change".
+	Pty *PtyRequest
+
+	// Start is the request that started the session: a
+	// *ShellRequest, *ExecRequest or *SubsystemRequest.
+	Start interface{}
+}
+
+// ReadSessionSetup serves the requests of a "session" channel from in
+// until the client asks for a shell, a command or a subsystem, and
+// returns what the client set up by then, so that a handler gets the
+// environment as a map rather than a stream of requests. It accepts
+// "pty-req" and "window-change", and the "env" requests acceptEnv
+// accepts; a nil acceptEnv accepts all. It rejects the other
+// requests. It replies true to the request that starts the session,
+// so the handler must be ready to serve it; the requests after that,
+// such as "window-change" and "signal", are left on in, for
+// ServeSessionEvents.
+//
+// It fails if in is closed, or ctx done, before the session starts,
+// or if a request does not parse.
+func ReadSessionSetup(ctx context.Context, in <-chan *Request, acceptEnv func(name, value string) bool) (*SessionSetup, error) {
+	setup := &SessionSetup{Env: map[string]string{}}
+	for {
+		var req *Request
+		select {
+		case r, ok := <-in:
+			if !ok {
+				return nil, io.EOF
+			}
+			req = r
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		ok := false
+		var err error
+		switch req.Type {
+		case "shell", "exec", "subsystem":
+			setup.Start, err = ParseSessionRequest(req)
+			if err == nil {
+				req.Reply(true, nil)
+				return setup, nil
+			}
+		case "env":
+			var env *EnvRequest
+			if env, err = ParseEnvRequest(req.Payload); err == nil && (acceptEnv == nil || acceptEnv(env.Name, env.Value)) {
+				setup.Env[env.Name] = env.Value
+				ok = true
+			}
+		case "pty-req":
+			if setup.Pty, err = ParsePtyRequest(req.Payload); err == nil {
+				ok = true
+			}
+		case "window-change":
+			var wc *WindowChangeRequest
+			if wc, err = ParseWindowChangeRequest(req.Payload); err == nil && setup.Pty != nil {
+				setup.Pty.Columns, setup.Pty.Rows = wc.Columns, wc.Rows
+				setup.Pty.Width, setup.Pty.Height = wc.Width, wc.Height
+				ok = true
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SessionEvents are the callbacks of ServeSessionEvents, for the
+// requests a client sends while its command runs.
+type SessionEvents struct {
+	// WindowChange, if non-nil, is called with each
+	// "window-change", so that the handler can resize the pty of
+	// the command.
+	WindowChange func(*WindowChangeRequest)
+
+	// Signal, if non-nil, is called with each "signal", so that
+	// the handler can deliver it to the command.
+	Signal func(Signal)
+}
+
+// ServeSessionEvents serves the requests of a "session" channel from
+// in after the session started, as ReadSessionSetup leaves them, and
+// until in is closed or ctx is done. It calls the callbacks of ev in
+// the order the requests come, on its own goroutine, and accepts the
+// requests it has a callback for. It rejects the others, and the
+// requests that do not parse.
+func ServeSessionEvents(ctx context.Context, in <-chan *Request, ev SessionEvents) {
+	for {
+		var req *Request
+		select {
+		case r, ok := <-in:
+			if !ok {
+				return
+			}
+			req = r
+		case <-ctx.Done():
+			return
+		}
+
+		ok := false
+		switch req.Type {
+		case "window-change":
+			if ev.WindowChange != nil {
+				if wc, err := ParseWindowChangeRequest(req.Payload); err == nil {
+					ev.WindowChange(wc)
+					ok = true
+				}
+			}
+		case "signal":
+			if ev.Signal != nil {
+				var msg signalMsg
+				if err := Unmarshal(req.Payload, &msg); err == nil {
+					ev.Signal(Signal(msg.Signal))
+					ok = true
+				}
+			}
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
+
+// ParseExecRequest decodes the payload of an "exec" request.
+func ParseExecRequest(payload []byte) (*ExecRequest, error) {
+	var msg execMsg
+	if err := Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return &ExecRequest{Command: msg.Command}, nil
+}
+
+// ParseEnvRequest decodes the payload of an "env" request.
+func ParseEnvRequest(payload []byte) (*EnvRequest, error) {
+	var msg setenvRequest
+	if err := Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return &EnvRequest{Name: msg.Name, Value: msg.Value}, nil
+}
+
+// ParsePtyRequest decodes the payload of a "pty-req" request,
+// terminal modes included.
+func ParsePtyRequest(payload []byte) (*PtyRequest, error) {
+	var msg ptyRequestMsg
+	if err := Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	modes, err := parseTerminalModes([]byte(msg.Modelist))
+	if err != nil {
+		return nil, err
+	}
+	return &PtyRequest{
+		Term:    msg.Term,
+		Columns: msg.Columns,
+		Rows:    msg.Rows,
+		Width:   msg.Width,
+		Height:  msg.Height,
+		Modes:   modes,
+	}, nil
+}
+
+// parseTerminalModes decodes the encoded terminal modes of RFC 4254
+// section 8. Opcodes from 160 on are undefined and end the parse,
+// as the RFC asks.
+func parseTerminalModes(b []byte) (TerminalModes, error) {
+	modes := TerminalModes{}
+	for len(b) > 0 {
+		op := b[0]
+		if op == tty_OP_END || op >= 160 {
+			break
+		}
+		if len(b) < 5 {
+			return nil, parseError(msgChannelRequest)
+		}
+		modes[op] = binary.BigEndian.Uint32(b[1:5])
+		b = b[5:]
+	}
+	return modes, nil
+}
+
+// ParseWindowChangeRequest decodes the payload of a "window-change"
+// request.
+func ParseWindowChangeRequest(payload []byte) (*WindowChangeRequest, error) {
+	var msg ptyWindowChangeMsg
+	if err := Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	return &WindowChangeRequest{
+		Columns: msg.Columns,
+		Rows:    msg.Rows,
+		Width:   msg.Width,
+		Height:  msg.Height,
+	}, nil
+}
+
+// RFC 4254 Section 6.10.
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Errmsg     string
+	Lang       string
+}
+
+// SendExitStatus tells the client of a session that the command
+// exited with status. The server should close the channel after.
+func SendExitStatus(ch Channel, status uint32) error {
+	_, err := ch.SendRequest("exit-status", false, Marshal(&exitStatusMsg{Status: status}))
+	return err
+}
+
+// SendExitSignal tells the client of a session that the command was
+// killed by sig, with an optional error message for the user, in
+// the language given by the RFC 3066 tag lang, which may be empty.
+// The server should close the channel after.
+func SendExitSignal(ch Channel, sig Signal, coreDumped bool, errMsg, lang string) error {
+	msg := exitSignalMsg{
+		Signal:     string(sig),
+		CoreDumped: coreDumped,
+		Errmsg:     errMsg,
+		Lang:       lang,
+	}
+	_, err := ch.SendRequest("exit-signal", false, Marshal(&msg))
+	return err
+}
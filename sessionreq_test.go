@@ -0,0 +1,229 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseSessionRequest(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	modes := []byte{ECHO, 0, 0, 0, 1, TTY_OP_ISPEED, 0, 0, 0x96, 0, tty_OP_END}
+	for _, tt := range []struct {
+		req  Request
+		want interface{}
+	}{
+		{Request{Type: "shell"}, &ShellRequest{}},
+		{Request{Type: "exec", Payload: Marshal(&execMsg{Command: "ls -l"})}, &ExecRequest{Command: "ls -l"}},
+		{Request{Type: "subsystem", Payload: Marshal(&subsystemRequestMsg{Subsystem: "sftp"})}, &SubsystemRequest{Subsystem: "sftp"}},
+		{Request{Type: "env", Payload: Marshal(&setenvRequest{Name: "LANG", Value: "C"})}, &EnvRequest{Name: "LANG", Value: "C"}},
+		{
+			Request{Type: "pty-req", Payload: Marshal(&ptyRequestMsg{Term: "xterm", Columns: 80, Rows: 24, Modelist: string(modes)})},
+			&PtyRequest{Term: "xterm", Columns: 80, Rows: 24, Modes: TerminalModes{ECHO: 1, TTY_OP_ISPEED: 38400}},
+		},
+		{
+			Request{Type: "window-change", Payload: Marshal(&ptyWindowChangeMsg{Columns: 132, Rows: 43, Width: 1056, Height: 344})},
+			&WindowChangeRequest{Columns: 132, Rows: 43, Width: 1056, Height: 344},
+		},
+		{Request{Type: "signal", Payload: Marshal(&signalMsg{Signal: "INT"})}, &SignalRequest{Signal: SIGINT}},
+	} {
+		got, err := ParseSessionRequest(&tt.req)
+		if err != nil {
+			t.Errorf("%s: %v", tt.req.Type, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.req.Type, got, tt.want)
+		}
+	}
+
+	if _, err := ParseSessionRequest(&Request{Type: "x11-req"}); err == nil {
+		t.Error("x11-req parsed as a known request")
+	}
+	truncated := Marshal(&ptyRequestMsg{Term: "xterm", Modelist: string(modes[:3])})
+	if _, err := ParsePtyRequest(truncated); err == nil {
+		t.Error("truncated terminal modes parsed")
+	}
+}
+
+// setupEnvHandler reads the setup of the session, accepting LANG and
+// LC_* only, and writes the environment and the command to stdout.
+func setupEnvHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	ctx := context.Background()
+	setup, err := ReadSessionSetup(ctx, in, func(name, value string) bool {
+		return name == "LANG" || strings.HasPrefix(name, "LC_")
+	})
+	if err != nil {
+		t.Errorf("ReadSessionSetup: %v", err)
+		return
+	}
+	go DiscardRequests(ctx, in, nil)
+	var names []string
+	for name := range setup.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(ch, "%s=%s\n", name, setup.Env[name])
+	}
+	if setup.Pty != nil {
+		fmt.Fprintf(ch, "pty %s %dx%d\n", setup.Pty.Term, setup.Pty.Columns, setup.Pty.Rows)
+	}
+	if exec, ok := setup.Start.(*ExecRequest); ok {
+		fmt.Fprintf(ch, "exec %s\n", exec.Command)
+	}
+	sendStatus(0, ch, t)
+}
+
+func TestReadSessionSetup(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	conn := dial(setupEnvHandler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	err = session.SetEnvMap(map[string]string{
+		"LANG":   "C",
+		"SECRET": "hunter2",
+		"LC_ALL": "C.UTF-8",
+		"EDITOR": "vi",
+	})
+	e, ok := err.(*EnvRejectedError)
+	if !ok || !reflect.DeepEqual(e.Names, []string{"EDITOR", "SECRET"}) {
+		t.Fatalf("SetEnvMap: %v, want EDITOR and SECRET rejected", err)
+	}
+	if err := session.Setenv("LANG", "en_US.UTF-8"); err != nil {
+		t.Fatalf("Setenv: %v", err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	if err := session.WindowChange(43, 132); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+	out, err := session.Output("env")
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	want := "LANG=en_US.UTF-8\nLC_ALL=C.UTF-8\npty xterm 132x43\nexec env\n"
+	if string(out) != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestSetEnvMapOrder(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	names := make(chan string, 10)
+	handler := func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		for req := range in {
+			if req.Type == "env" {
+				env, _ := ParseEnvRequest(req.Payload)
+				names <- env.Name
+			}
+			req.Reply(true, nil)
+			if req.Type == "exec" {
+				break
+			}
+		}
+		sendStatus(0, ch, t)
+	}
+	halt := NewHalter()
+	defer halt.RequestStop()
+	conn := dial(handler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.SetEnvMap(map[string]string{"b": "2", "c": "3", "a": "1", "d": "4"}); err != nil {
+		t.Fatalf("SetEnvMap: %v", err)
+	}
+	if err := session.Run("true"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, <-names)
+	}
+	if !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("variables sent in order %v", got)
+	}
+}
+
+func TestServeSessionEvents(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	handler := func(ch Channel, in <-chan *Request, t *testing.T) {
+		defer ch.Close()
+		ctx := context.Background()
+		setup, err := ReadSessionSetup(ctx, in, nil)
+		if err != nil {
+			t.Errorf("ReadSessionSetup: %v", err)
+			return
+		}
+		pty := setup.Pty
+		signaled := make(chan Signal, 1)
+		go ServeSessionEvents(ctx, in, SessionEvents{
+			WindowChange: func(wc *WindowChangeRequest) {
+				pty.Columns, pty.Rows = wc.Columns, wc.Rows
+			},
+			Signal: func(sig Signal) {
+				signaled <- sig
+			},
+		})
+		sig := <-signaled
+		fmt.Fprintf(ch, "%dx%d %s\n", pty.Columns, pty.Rows, sig)
+		SendExitSignal(ch, sig, false, "", "")
+	}
+	halt := NewHalter()
+	defer halt.RequestStop()
+	conn := dial(handler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	var stdout strings.Builder
+	session.Stdout = &stdout
+	if err := session.RequestPty("xterm", 24, 80, nil); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	if err := session.WindowChange(50, 100); err != nil {
+		t.Fatalf("WindowChange: %v", err)
+	}
+	if ok, err := session.SendRequest("keepalive@openssh.com", true, nil); ok || err != nil {
+		t.Fatalf("keepalive: %v, %v; want it rejected", ok, err)
+	}
+	if err := session.Signal(SIGINT); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+	err = session.Wait()
+	if e, ok := err.(*ExitError); !ok || e.Signal() != "INT" {
+		t.Fatalf("Wait: %v, want killed by INT", err)
+	}
+	if got, want := stdout.String(), "100x50 INT\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
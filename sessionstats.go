@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats are the counters of a Session, see Session.Stats.
+type SessionStats struct {
+	// StdinBytes, StdoutBytes and StderrBytes count the bytes
+	// sent to the remote command, and received from it, through
+	// Stdin, Stdout and Stderr or the pipes.
+	StdinBytes  int64
+	StdoutBytes int64
+	StderrBytes int64
+
+	// Start is when the command or shell was started, and
+	// Duration how long it ran until the server reported its exit,
+	// or has run so far.
+	Start    time.Time
+	Duration time.Duration
+
+	// Exited is true once the server has reported the exit of
+	// the command, with ExitStatus, or with ExitSignal, if it was
+	// killed by a signal.
+	Exited     bool
+	ExitStatus int
+	ExitSignal string
+
+	// Requests counts the requests that wanted a reply, such as
+	// "pty-req", "env" and "exec", and RequestRTT is the average
+	// time their replies took.
+	Requests   int
+	RequestRTT time.Duration
+}
+
+// sessionCounters keeps the counters of a Session.
+type sessionCounters struct {
+	stdin, stdout, stderr int64 // atomic
+
+	mu         sync.Mutex
+	start      time.Time
+	end        time.Time
+	exited     bool
+	exitStatus int
+	exitSignal string
+	requests   int
+	rttTotal   time.Duration
+}
+
+// Stats returns the counters of s. After Wait returns they are final.
+func (s *Session) Stats() SessionStats {
+	c := s.stats
+	st := SessionStats{
+		StdinBytes:  atomic.LoadInt64(&c.stdin),
+		StdoutBytes: atomic.LoadInt64(&c.stdout),
+		StderrBytes: atomic.LoadInt64(&c.stderr),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st.Start = c.start
+	if !c.start.IsZero() {
+		end := c.end
+		if end.IsZero() {
+			end = time.Now()
+		}
+		st.Duration = end.Sub(c.start)
+	}
+	st.Exited = c.exited
+	st.ExitStatus = c.exitStatus
+	st.ExitSignal = c.exitSignal
+	st.Requests = c.requests
+	if c.requests > 0 {
+		st.RequestRTT = c.rttTotal / time.Duration(c.requests)
+	}
+	return st
+}
+
+// sendRequest is s.ch.SendRequest, timing the requests that want a
+// reply.
+func (s *Session) sendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	if !wantReply {
+		return s.ch.SendRequest(name, false, payload)
+	}
+	t0 := time.Now()
+	ok, err := s.ch.SendRequest(name, true, payload)
+	if err == nil {
+		rtt := time.Since(t0)
+		s.stats.mu.Lock()
+		s.stats.requests++
+		s.stats.rttTotal += rtt
+		s.stats.mu.Unlock()
+	}
+	return ok, err
+}
+
+func (c *sessionCounters) started() {
+	c.mu.Lock()
+	c.start = time.Now()
+	c.mu.Unlock()
+}
+
+// exit records the exit reported by the server, at most once.
+func (c *sessionCounters) exit(status int, signal string) {
+	c.mu.Lock()
+	if !c.exited {
+		c.exited = true
+		c.end = time.Now()
+	}
+	if status >= 0 {
+		c.exitStatus = status
+	}
+	if signal != "" {
+		c.exitSignal = signal
+	}
+	c.mu.Unlock()
+}
+
+// countingReader and countingWriter add the bytes they pass to n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// countingChannel is a countingReader over a Channel that keeps
+// the other methods of the Channel, so that the readers of a
+// StdoutPipe can still find SetReadIdleTimeout and ReadSlice.
+type countingChannel struct {
+	Channel
+	n *int64
+}
+
+func (c countingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// ReadSlice implements SliceReader, with a Read into a new buffer if
+// the Channel does not.
+func (c countingChannel) ReadSlice() ([]byte, error) {
+	var b []byte
+	var err error
+	if sr, ok := c.Channel.(SliceReader); ok {
+		b, err = sr.ReadSlice()
+	} else {
+		b = make([]byte, 32<<10)
+		var n int
+		n, err = c.Channel.Read(b)
+		b = b[:n]
+	}
+	atomic.AddInt64(c.n, int64(len(b)))
+	return b, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// echoStatsHandler accepts "env" and "exec", copies stdin to stdout,
+// writes to stderr, and exits with status 3.
+func echoStatsHandler(ch Channel, in <-chan *Request, t *testing.T) {
+	defer ch.Close()
+	for req := range in {
+		req.Reply(true, nil)
+		if req.Type == "exec" {
+			break
+		}
+	}
+	go DiscardRequests(context.Background(), in, nil)
+	io.Copy(ch, ch)
+	io.WriteString(ch.Stderr(), "done")
+	sendStatus(3, ch, t)
+}
+
+func TestSessionStats(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	conn := dial(echoStatsHandler, t, halt)
+	defer conn.Close()
+	ctx := context.Background()
+
+	session, err := conn.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if st := session.Stats(); st.Requests != 0 || !st.Start.IsZero() {
+		t.Errorf("stats before start: %+v", st)
+	}
+
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Fatalf("Setenv: %v", err)
+	}
+	session.Stdin = strings.NewReader("hello, world")
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run("cat")
+	if e, ok := err.(*ExitError); !ok || e.ExitStatus() != 3 {
+		t.Fatalf("Run: %v, want exit status 3", err)
+	}
+
+	st := session.Stats()
+	if st.StdinBytes != 12 || st.StdoutBytes != 12 || st.StderrBytes != 4 {
+		t.Errorf("bytes in/out/err = %d/%d/%d, want 12/12/4", st.StdinBytes, st.StdoutBytes, st.StderrBytes)
+	}
+	if !st.Exited || st.ExitStatus != 3 || st.ExitSignal != "" {
+		t.Errorf("exit = %v %d %q, want status 3", st.Exited, st.ExitStatus, st.ExitSignal)
+	}
+	if st.Requests != 2 || st.RequestRTT <= 0 {
+		t.Errorf("%d requests with RTT %v, want 2", st.Requests, st.RequestRTT)
+	}
+	if st.Start.IsZero() || st.Duration <= 0 {
+		t.Errorf("start %v, duration %v", st.Start, st.Duration)
+	}
+	if again := session.Stats(); again.Duration != st.Duration {
+		t.Errorf("duration went from %v to %v after Wait", st.Duration, again.Duration)
+	}
+}
+
+func TestSessionStatsPipes(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+
+	conn := dial(echoStatsHandler, t, halt)
+	defer conn.Close()
+
+	session, err := conn.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.Start("cat"); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	io.WriteString(stdin, "ping")
+	stdin.Close()
+	if _, err := ioutil.ReadAll(stdout); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	session.Wait()
+
+	if st := session.Stats(); st.StdinBytes != 4 || st.StdoutBytes != 4 {
+		t.Errorf("pipes counted %d bytes in, %d out, want 4 and 4", st.StdinBytes, st.StdoutBytes)
+	}
+}
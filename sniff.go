@@ -0,0 +1,218 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Protocol is what SniffConn takes a connection to speak.
+type Protocol int
+
+const (
+	// ProtocolSSH is a connection that starts with an SSH version
+	// line, or whose client sends nothing at first, waiting for the
+	// version of the server.
+	ProtocolSSH Protocol = iota
+
+	// ProtocolTLS is a connection that starts with a TLS handshake
+	// record, such as HTTPS.
+	ProtocolTLS
+
+	// ProtocolOther is any other connection, such as plain HTTP.
+	ProtocolOther
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolSSH:
+		return "ssh"
+	case ProtocolTLS:
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// sshPrefix starts the version line of every SSH client.
+var sshPrefix = []byte("SSH-")
+
+// tlsHandshake is the content type of the record that starts a TLS
+// connection.
+const tlsHandshake = 0x16
+
+// defaultSniffTimeout is used if the timeout of SniffConn is zero.
+const defaultSniffTimeout = 2 * time.Second
+
+// sniffedConn is a net.Conn whose first bytes were peeked.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// SniffConn peeks at the first bytes that the client of c sends,
+// and returns the protocol they start, and a conn that reads them
+// again, to hand on to the server of that protocol. A client may
+// wait for the version of an SSH server before sending its own, so
+// if no byte arrives within timeout, the connection is taken to be
+// SSH; OpenSSH and most clients do not wait, and are told apart at
+// once. A zero timeout means 2 seconds.
+//
+// The read deadline of c is cleared when SniffConn returns. On an
+// error, such as the client closing c before sending a byte, the
+// caller should close c.
+func SniffConn(c net.Conn, timeout time.Duration) (net.Conn, Protocol, error) {
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, 0, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	sc := &sniffedConn{Conn: c, r: bufio.NewReader(c)}
+	for n := 1; n <= len(sshPrefix); n++ {
+		b, err := sc.r.Peek(n)
+		if !bytes.HasPrefix(sshPrefix, b) {
+			if b[0] == tlsHandshake {
+				return sc, ProtocolTLS, nil
+			}
+			return sc, ProtocolOther, nil
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return sc, ProtocolSSH, nil
+			}
+			return nil, 0, err
+		}
+	}
+	return sc, ProtocolSSH, nil
+}
+
+// SplitListener lets one port serve SSH and another protocol, such
+// as HTTPS, which helps clients behind firewalls that only let
+// through the port of the other. It accepts the connections of l,
+// sniffs each with SniffConn, on a goroutine of its own, and hands
+// the SSH ones to the Accept of sshL, and the rest to that of
+// otherL. Serve sshL with Server.Serve or ServeListener, and otherL
+// with, say, http.Server.ServeTLS; its server should tell TLS from
+// other protocols itself if it must.
+//
+// Closing one of the two drops the connections sniffed for it from
+// then on. l is closed once both are, and then their Accept returns
+// io.EOF; if the Accept of l fails, theirs return its error.
+func SplitListener(l net.Listener, timeout time.Duration) (sshL, otherL net.Listener) {
+	s := &splitter{l: l, timeout: timeout, open: 2, done: make(chan struct{})}
+	s.ssh = s.newListener()
+	s.other = s.newListener()
+	go s.run()
+	return s.ssh, s.other
+}
+
+// splitter feeds the two listeners of SplitListener.
+type splitter struct {
+	l       net.Listener
+	timeout time.Duration
+
+	ssh, other *splitListener
+
+	mu   sync.Mutex
+	open int           // the listeners not closed
+	done chan struct{} // closed once l is
+	err  error
+}
+
+func (s *splitter) newListener() *splitListener {
+	return &splitListener{
+		s:      s,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// run accepts the connections of l until it fails.
+func (s *splitter) run() {
+	for {
+		nConn, err := s.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			s.mu.Lock()
+			if s.open == 0 {
+				err = io.EOF
+			}
+			s.err = err
+			s.mu.Unlock()
+			close(s.done)
+			return
+		}
+		go s.route(nConn)
+	}
+}
+
+// route sniffs nConn, and hands it to the listener of its protocol.
+func (s *splitter) route(nConn net.Conn) {
+	c, proto, err := SniffConn(nConn, s.timeout)
+	if err != nil {
+		nConn.Close()
+		return
+	}
+	sl := s.other
+	if proto == ProtocolSSH {
+		sl = s.ssh
+	}
+	select {
+	case sl.conns <- c:
+	case <-sl.closed:
+		c.Close()
+	case <-s.done:
+		c.Close()
+	}
+}
+
+// splitListener is one of the two listeners of SplitListener.
+type splitListener struct {
+	s      *splitter
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *splitListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, io.EOF
+	case <-l.s.done:
+		return nil, l.s.err
+	}
+}
+
+// Close closes the listener, and the listener it was split from
+// once the other half is closed too.
+func (l *splitListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		l.s.mu.Lock()
+		l.s.open--
+		last := l.s.open == 0
+		l.s.mu.Unlock()
+		if last {
+			err = l.s.l.Close()
+		}
+	})
+	return err
+}
+
+func (l *splitListener) Addr() net.Addr {
+	return l.s.l.Addr()
+}
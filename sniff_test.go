@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffConn(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, tc := range []struct {
+		send string
+		want Protocol
+	}{
+		{"SSH-2.0-Go\r\n", ProtocolSSH},
+		{"\x16\x03\x01\x00\x05hello", ProtocolTLS},
+		{"GET / HTTP/1.1\r\n\r\n", ProtocolOther},
+		{"SS", ProtocolSSH}, // a prefix, then silence
+		{"", ProtocolSSH},   // a client that waits for the server
+		{"SSX-", ProtocolOther},
+	} {
+		a, b := net.Pipe()
+		go io.WriteString(a, tc.send)
+		c, proto, err := SniffConn(b, 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("%q: SniffConn: %v", tc.send, err)
+		}
+		if proto != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.send, proto, tc.want)
+		}
+		a.Close()
+		got, _ := ioutil.ReadAll(c)
+		if string(got) != tc.send {
+			t.Errorf("%q: read %q after sniffing", tc.send, got)
+		}
+		c.Close()
+	}
+
+	// A client that hangs up before sending anything is an error.
+	a, b := net.Pipe()
+	a.Close()
+	if _, _, err := SniffConn(b, time.Second); err == nil {
+		t.Error("SniffConn of a closed conn succeeded")
+	}
+}
+
+func TestSplitListener(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	sshL, otherL := SplitListener(l, time.Second)
+
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	defer config.Halt.RequestStop()
+	ctx := context.Background()
+	go ServeListener(ctx, sshL, config, (&forwardingServer{}).serve)
+
+	other := make(chan string, 1)
+	go func() {
+		c, err := otherL.Accept()
+		if err != nil {
+			other <- err.Error()
+			return
+		}
+		buf := make([]byte, 5)
+		io.ReadFull(c, buf)
+		c.Close()
+		other <- string(buf)
+	}()
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial through the split listener: %v", err)
+	}
+	client.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	io.WriteString(c, "GET /")
+	select {
+	case got := <-other:
+		if got != "GET /" {
+			t.Errorf("the other listener read %q", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the other listener got no connection")
+	}
+	c.Close()
+
+	// l is closed once both halves are.
+	otherL.Close()
+	if _, err := otherL.Accept(); err != io.EOF {
+		t.Errorf("Accept of a closed half: %v, want EOF", err)
+	}
+	sshL.Close()
+	if _, err := net.DialTimeout("tcp", l.Addr().String(), time.Second); err == nil {
+		t.Error("the split listener is still open")
+	}
+}
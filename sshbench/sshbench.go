@@ -0,0 +1,322 @@
+// Package sshbench measures the throughput of the ssh package
+// between a client and a server over loopback TCP. Downstream users
+// can run it against their own configurations, and the package's
+// own benchmarks use it to catch regressions in the channel and
+// transport code.
+//
+// A benchmark of a configuration looks like
+//
+//	func BenchmarkMyConfig(b *testing.B) {
+//		sshbench.Benchmark(b, sshbench.Params{Cipher: "aes256-ctr", Channels: 4})
+//	}
+package sshbench
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/glycerine/xcryptossh"
+)
+
+// Params describe a transfer. The zero value is a 16MB transfer on
+// one channel, with the ssh package's defaults.
+type Params struct {
+	// Cipher and MAC, if set, are the only algorithms the client
+	// offers.
+	Cipher string
+	MAC    string
+
+	// MaxChannelPacket and ChannelWindow are set on both ends;
+	// see ssh.Config.
+	MaxChannelPacket uint32
+	ChannelWindow    uint32
+
+	// Channels is the number of channels sending at once. It
+	// defaults to 1.
+	Channels int
+
+	// Bytes is the amount of data sent on each channel. It
+	// defaults to 16MB.
+	Bytes int64
+
+	// WriteSize is the size of the sender's writes. It defaults
+	// to 32KB.
+	WriteSize int
+}
+
+func (p Params) withDefaults() Params {
+	if p.Channels <= 0 {
+		p.Channels = 1
+	}
+	if p.Bytes <= 0 {
+		p.Bytes = 16 << 20
+	}
+	if p.WriteSize <= 0 {
+		p.WriteSize = 32 << 10
+	}
+	return p
+}
+
+// Result is the outcome of a transfer.
+type Result struct {
+	// Bytes is the data received, over all channels.
+	Bytes int64
+
+	// Elapsed runs from opening the first channel to reading
+	// the end of the last.
+	Elapsed time.Duration
+}
+
+// Throughput returns the bytes received per second.
+func (r Result) Throughput() float64 {
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d bytes in %v (%.1f MB/s)", r.Bytes, r.Elapsed, r.Throughput()/1e6)
+}
+
+// Case is a named Params, for use as a sub-benchmark.
+type Case struct {
+	Name   string
+	Params Params
+}
+
+// Suite returns the standard cases: each common cipher, the default
+// and the largest channel packets, a smaller and a larger channel
+// window than the default, and several channel counts.
+func Suite() []Case {
+	return []Case{
+		{"cipher=aes128-ctr", Params{Cipher: "aes128-ctr", MAC: "hmac-sha2-256"}},
+		{"cipher=aes256-ctr", Params{Cipher: "aes256-ctr", MAC: "hmac-sha2-256"}},
+		{"cipher=aes128-gcm", Params{Cipher: "aes128-gcm@openssh.com"}},
+		{"cipher=arcfour256", Params{Cipher: "arcfour256", MAC: "hmac-sha1"}},
+		{"packet=32KB", Params{MaxChannelPacket: 32 << 10}},
+		{"packet=252KB", Params{MaxChannelPacket: 252 << 10, WriteSize: 252 << 10}},
+		{"window=256KB", Params{ChannelWindow: 256 << 10}},
+		{"window=16MB", Params{ChannelWindow: 16 << 20}},
+		{"channels=4", Params{Channels: 4, Bytes: 4 << 20}},
+		{"channels=16", Params{Channels: 16, Bytes: 256 << 10}},
+	}
+}
+
+// Run connects a client to a server, and transfers p.Bytes from the
+// server on each of p.Channels channels.
+func Run(p Params) (Result, error) {
+	pr, err := newPair(p.withDefaults())
+	if err != nil {
+		return Result{}, err
+	}
+	defer pr.close()
+	return pr.transfer()
+}
+
+// Benchmark measures transfers of p over a single connection, one
+// per iteration of b, and reports the throughput.
+func Benchmark(b *testing.B, p Params) {
+	p = p.withDefaults()
+	pr, err := newPair(p)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pr.close()
+
+	b.SetBytes(p.Bytes * int64(p.Channels))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pr.transfer(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// RunSuite runs Benchmark on each case of Suite as a sub-benchmark.
+func RunSuite(b *testing.B) {
+	for _, c := range Suite() {
+		p := c.Params
+		b.Run(c.Name, func(b *testing.B) { Benchmark(b, p) })
+	}
+}
+
+// pair is a connected client and server.
+type pair struct {
+	p          Params
+	client     ssh.Conn
+	clientHalt *ssh.Halter
+	serverHalt *ssh.Halter
+	server     chan error
+}
+
+func newPair(p Params) (*pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	pr := &pair{
+		p:          p,
+		clientHalt: ssh.NewHalter(),
+		serverHalt: ssh.NewHalter(),
+		server:     make(chan error, 1),
+	}
+	serverConf := &ssh.ServerConfig{
+		NoClientAuth: true,
+		Config: ssh.Config{
+			MaxChannelPacket: p.MaxChannelPacket,
+			ChannelWindow:    p.ChannelWindow,
+			Halt:             pr.serverHalt,
+		},
+	}
+	serverConf.AddHostKey(signer)
+	go pr.serve(l, serverConf)
+
+	clientConf := &ssh.ClientConfig{
+		User:            "sshbench",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config: ssh.Config{
+			MaxChannelPacket: p.MaxChannelPacket,
+			ChannelWindow:    p.ChannelWindow,
+			Halt:             pr.clientHalt,
+		},
+	}
+	if p.Cipher != "" {
+		clientConf.Ciphers = []string{p.Cipher}
+	}
+	if p.MAC != "" {
+		clientConf.MACs = []string{p.MAC}
+	}
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		pr.serverHalt.RequestStop()
+		return nil, err
+	}
+	ctx := context.Background()
+	conn, chans, reqs, err := ssh.NewClientConn(ctx, c, "", clientConf)
+	if err != nil {
+		c.Close()
+		pr.serverHalt.RequestStop()
+		return nil, err
+	}
+	go ssh.DiscardRequests(ctx, reqs, pr.clientHalt)
+	go func() {
+		for newCh := range chans {
+			newCh.Reject(ssh.Prohibited, "sshbench client")
+		}
+	}()
+	pr.client = conn
+	return pr, nil
+}
+
+// serve accepts one connection, and sends p.Bytes on each channel
+// the client opens.
+func (pr *pair) serve(l net.Listener, conf *ssh.ServerConfig) {
+	c, err := l.Accept()
+	if err != nil {
+		pr.server <- err
+		return
+	}
+	ctx := context.Background()
+	_, chans, reqs, err := ssh.NewServerConn(ctx, c, conf)
+	if err != nil {
+		c.Close()
+		pr.server <- err
+		return
+	}
+	go ssh.DiscardRequests(ctx, reqs, pr.serverHalt)
+	buf := make([]byte, pr.p.WriteSize)
+	for newCh := range chans {
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(ctx, in, pr.serverHalt)
+		go func() {
+			defer ch.Close()
+			for left := pr.p.Bytes; left > 0; {
+				n := int64(len(buf))
+				if n > left {
+					n = left
+				}
+				if _, err := ch.Write(buf[:n]); err != nil {
+					return
+				}
+				left -= n
+			}
+		}()
+	}
+	pr.server <- nil
+}
+
+// transfer opens p.Channels channels and reads each to its end.
+func (pr *pair) transfer() (Result, error) {
+	ctx := context.Background()
+	start := time.Now()
+	chans := make([]ssh.Channel, pr.p.Channels)
+	for i := range chans {
+		ch, in, err := pr.client.OpenChannel(ctx, "sshbench", nil, nil)
+		if err != nil {
+			for _, ch := range chans[:i] {
+				ch.Close()
+			}
+			return Result{}, err
+		}
+		go ssh.DiscardRequests(ctx, in, pr.clientHalt)
+		chans[i] = ch
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int64
+		first error
+	)
+	for _, ch := range chans {
+		wg.Add(1)
+		go func(ch ssh.Channel) {
+			defer wg.Done()
+			defer ch.Close()
+			n, err := io.Copy(ioutil.Discard, ch)
+			if err == nil && n != pr.p.Bytes {
+				err = fmt.Errorf("sshbench: read %d bytes of %d", n, pr.p.Bytes)
+			}
+			mu.Lock()
+			total += n
+			if first == nil {
+				first = err
+			}
+			mu.Unlock()
+		}(ch)
+	}
+	wg.Wait()
+	return Result{Bytes: total, Elapsed: time.Since(start)}, first
+}
+
+func (pr *pair) close() error {
+	err := pr.client.Close()
+	pr.clientHalt.RequestStop()
+	pr.serverHalt.RequestStop()
+	if serr := <-pr.server; err == nil && serr != nil && !errors.Is(serr, io.EOF) {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package sshbench
+
+import "testing"
+
+func TestRun(t *testing.T) {
+	for _, c := range Suite() {
+		p := c.Params
+		p.Bytes = 256 << 10
+		r, err := Run(p)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Name, err)
+		}
+		if want := p.Bytes * int64(p.withDefaults().Channels); r.Bytes != want {
+			t.Errorf("%s: got %v, want %d bytes", c.Name, r, want)
+		}
+	}
+}
+
+func BenchmarkSuite(b *testing.B) {
+	RunSuite(b)
+}
@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// The algorithm numbers of SSHFP records, RFC 4255, 6594 and 7479.
+const (
+	SSHFPAlgoRSA     = 1
+	SSHFPAlgoDSA     = 2
+	SSHFPAlgoECDSA   = 3
+	SSHFPAlgoED25519 = 4
+)
+
+// The fingerprint types of SSHFP records, RFC 4255 and 6594.
+const (
+	SSHFPTypeSHA1   = 1
+	SSHFPTypeSHA256 = 2
+)
+
+// SSHFPRecord is the RDATA of a DNS SSHFP record, which publishes the
+// fingerprint of a host key, RFC 4255.
+type SSHFPRecord struct {
+	Algorithm       uint8
+	FingerprintType uint8
+	Fingerprint     []byte
+}
+
+// String returns the record in the presentation format of zone
+// files, as in "4 2 a6564c...".
+func (r SSHFPRecord) String() string {
+	return fmt.Sprintf("%d %d %s", r.Algorithm, r.FingerprintType, hex.EncodeToString(r.Fingerprint))
+}
+
+// Matches reports whether r is a record of key, or of the key of a
+// certificate. Records of unknown algorithms or fingerprint types do
+// not match.
+func (r SSHFPRecord) Matches(key PublicKey) bool {
+	got, err := sshfpRecord(key, r.FingerprintType)
+	return err == nil && got.Algorithm == r.Algorithm && bytes.Equal(got.Fingerprint, r.Fingerprint)
+}
+
+// sshfpAlgo returns the SSHFP algorithm number of key.
+func sshfpAlgo(key PublicKey) (uint8, error) {
+	if cert, ok := key.(*Certificate); ok {
+		key = cert.Key
+	}
+	switch key.Type() {
+	case KeyAlgoRSA:
+		return SSHFPAlgoRSA, nil
+	case KeyAlgoDSA:
+		return SSHFPAlgoDSA, nil
+	case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
+		return SSHFPAlgoECDSA, nil
+	case KeyAlgoED25519:
+		return SSHFPAlgoED25519, nil
+	}
+	return 0, fmt.Errorf("ssh: no SSHFP algorithm for %s keys", key.Type())
+}
+
+func sshfpRecord(key PublicKey, fpType uint8) (SSHFPRecord, error) {
+	algo, err := sshfpAlgo(key)
+	if err != nil {
+		return SSHFPRecord{}, err
+	}
+	if cert, ok := key.(*Certificate); ok {
+		key = cert.Key
+	}
+	r := SSHFPRecord{Algorithm: algo, FingerprintType: fpType}
+	switch fpType {
+	case SSHFPTypeSHA1:
+		sum := sha1.Sum(key.Marshal())
+		r.Fingerprint = sum[:]
+	case SSHFPTypeSHA256:
+		sum := sha256.Sum256(key.Marshal())
+		r.Fingerprint = sum[:]
+	default:
+		return SSHFPRecord{}, fmt.Errorf("ssh: unknown SSHFP fingerprint type %d", fpType)
+	}
+	return r, nil
+}
+
+// SSHFPRecords returns the SSHFP records to publish for the host
+// keys, a SHA-1 and a SHA-256 record for each, as ssh-keygen -r
+// prints them. Certificates give the records of their keys, since
+// SSHFP records cannot name a CA.
+func SSHFPRecords(keys ...PublicKey) ([]SSHFPRecord, error) {
+	var records []SSHFPRecord
+	for _, key := range keys {
+		for _, fpType := range []uint8{SSHFPTypeSHA1, SSHFPTypeSHA256} {
+			r, err := sshfpRecord(key, fpType)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+	}
+	return records, nil
+}
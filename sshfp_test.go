@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestSSHFPRecords(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	// The keys and records are from ssh-keygen and ssh-keygen -r.
+	var keys []PublicKey
+	for _, line := range []string{
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKmr6whOc//b8PRhwpduyYm/F9cOzV92NgHCoSPnYv32",
+		"ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBMUiOFqPlqDHgKqMz+FWJEZKhcI9wALB7iodylDgKvPvvHTF+mMa+B5AHQd2gMIHQ3fBY+zwDv0Vs9aFa++YA3cXmjvM//fJq3BOm1/EwuG+i5yalJbIeKwOMsoTuVRNXw==",
+	} {
+		key, _, _, _, err := ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			t.Fatalf("ParseAuthorizedKey: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	want := []string{
+		"4 1 ec99101cdb2536a2577c95e9421e6f42e65eba90",
+		"4 2 a6564c937338de7a9ac66e1d0a21bc99f1d8213dbb2b223db3c9a84c93b09eb9",
+		"3 1 e0d4b9b2c8ee4903e580413ed9ebf28a5c6a16bb",
+		"3 2 16be272d2d8b726eb7605d0add86adb90a4eaccf2c8c02304641a67252b48cc8",
+	}
+
+	records, err := SSHFPRecords(keys...)
+	if err != nil {
+		t.Fatalf("SSHFPRecords: %v", err)
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		if r.String() != want[i] {
+			t.Errorf("record %d is %q, want %q", i, r, want[i])
+		}
+		if !r.Matches(keys[i/2]) || r.Matches(keys[1-i/2]) {
+			t.Errorf("record %q matches the wrong keys", r)
+		}
+	}
+
+	cert := &Certificate{Key: keys[0], CertType: HostCert, ValidBefore: CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, testSigners["ecdsa"]); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	if !records[1].Matches(cert) {
+		t.Error("record of a key does not match its certificate")
+	}
+}
@@ -3,28 +3,10 @@ package ssh
 import (
 	"context"
 	"errors"
-	"io"
 	"net"
+	"time"
 )
 
-// streamLocalChannelOpenDirectMsg is a struct used for SSH_MSG_CHANNEL_OPEN message
-// with "direct-streamlocal@openssh.com" string.
-//
-// See openssh-portable/PROTOCOL, section 2.4. connection: Unix domain socket forwarding
-// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL#L235
-type streamLocalChannelOpenDirectMsg struct {
-	socketPath string
-	reserved0  string
-	reserved1  uint32
-}
-
-// forwardedStreamLocalPayload is a struct used for SSH_MSG_CHANNEL_OPEN message
-// with "forwarded-streamlocal@openssh.com" string.
-type forwardedStreamLocalPayload struct {
-	SocketPath string
-	Reserved0  string
-}
-
 // streamLocalChannelForwardMsg is a struct used for SSH2_MSG_GLOBAL_REQUEST message
 // with "streamlocal-forward@openssh.com"/"cancel-streamlocal-forward@openssh.com" string.
 type streamLocalChannelForwardMsg struct {
@@ -32,6 +14,7 @@ type streamLocalChannelForwardMsg struct {
 }
 
 // ListenUnix is similar to ListenTCP but uses a Unix domain socket.
+// The listener is a ForwardListener.
 func (c *Client) ListenUnix(ctx context.Context, socketPath string) (net.Listener, error) {
 	m := streamLocalChannelForwardMsg{
 		socketPath,
@@ -50,15 +33,16 @@ func (c *Client) ListenUnix(ctx context.Context, socketPath string) (net.Listene
 		socketPath: socketPath,
 		conn:       c,
 		in:         ch,
-		TmpCtx:     ctx,
+		ctx:        ctx,
+		deadline:   newAcceptDeadline(),
 	}, nil
 }
 
 func (c *Client) dialStreamLocal(ctx context.Context, socketPath string) (Channel, error) {
-	msg := streamLocalChannelOpenDirectMsg{
-		socketPath: socketPath,
+	msg := DirectStreamLocalPayload{
+		SocketPath: socketPath,
 	}
-	ch, in, err := c.OpenChannel(ctx, "direct-streamlocal@openssh.com", Marshal(&msg), nil)
+	ch, in, err := c.openChannel(ctx, "direct-streamlocal@openssh.com", Marshal(&msg))
 	if err != nil {
 		return nil, err
 	}
@@ -72,27 +56,23 @@ type unixListener struct {
 	conn *Client
 	in   <-chan forward
 
-	// must be set before calling Close()/Accept()
-	TmpCtx context.Context
+	// ctx is used by Accept and Close.
+	ctx context.Context
+
+	deadline *acceptDeadline
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *unixListener) Accept() (net.Conn, error) {
-	var ok bool
-	var s forward
-	select {
-	case <-l.conn.Done():
-		return nil, io.EOF
-	case s, ok = <-l.in:
-		if !ok {
-			return nil, io.EOF
-		}
-	}
-	ch, incoming, err := s.newCh.Accept()
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext implements ForwardListener.
+func (l *unixListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	_, ch, err := acceptForward(ctx, l.ctx, l.conn, l.in, l.deadline)
 	if err != nil {
 		return nil, err
 	}
-	go DiscardRequests(l.TmpCtx, incoming, l.conn.Halt)
 
 	return &chanConn{
 		Channel: ch,
@@ -114,7 +94,7 @@ func (l *unixListener) Close() error {
 	m := streamLocalChannelForwardMsg{
 		l.socketPath,
 	}
-	ok, _, err := l.conn.SendRequest(l.TmpCtx, "cancel-streamlocal-forward@openssh.com", true, Marshal(&m))
+	ok, _, err := l.conn.SendRequest(l.ctx, "cancel-streamlocal-forward@openssh.com", true, Marshal(&m))
 	if err == nil && !ok {
 		err = errors.New("ssh: cancel-streamlocal-forward@openssh.com failed")
 	}
@@ -128,3 +108,9 @@ func (l *unixListener) Addr() net.Addr {
 		Net:  "unix",
 	}
 }
+
+// SetDeadline implements ForwardListener.
+func (l *unixListener) SetDeadline(t time.Time) error {
+	l.deadline.set(t)
+	return nil
+}
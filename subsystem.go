@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"context"
+	"io"
+)
+
+// SubsystemSFTP is the name of the SFTP subsystem.
+const SubsystemSFTP = "sftp"
+
+// A SubsystemHandler serves a subsystem on the session channel ch,
+// of the client of conn, until it is done; ch is closed after it
+// returns. Requests on ch after the "subsystem" one are refused.
+type SubsystemHandler func(ctx context.Context, conn *ServerConn, ch Channel, req *SubsystemRequest)
+
+// Subsystems maps subsystem names to their handlers. Its
+// HandleChannel method serves "session" channels that ask for one of
+// them, which makes a server for subsystems only, sftp-server for
+// instance, take no more than:
+//
+//	srv := &ssh.Server{
+//		Config: config,
+//		Handler: ssh.Subsystems{
+//			ssh.SubsystemSFTP: ssh.SFTPSubsystem(newSFTPServer),
+//		}.HandleChannel,
+//	}
+type Subsystems map[string]SubsystemHandler
+
+// HandleChannel is a ChannelHandler that accepts "session" channels,
+// rejecting the others, and hands each to the handler of the first
+// subsystem requested on it that s has. Other requests, shells and
+// commands among them, are refused.
+func (s Subsystems) HandleChannel(ctx context.Context, conn *ServerConn, newCh NewChannel) {
+	if newCh.ChannelType() != "session" {
+		newCh.Reject(UnknownChannelType, "unknown channel type")
+		return
+	}
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "subsystem" {
+			req.Reply(false, nil)
+			continue
+		}
+		parsed, err := ParseSessionRequest(req)
+		if err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		sub := parsed.(*SubsystemRequest)
+		handler, ok := s[sub.Subsystem]
+		if !ok {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go func() {
+			for req := range reqs {
+				req.Reply(false, nil)
+			}
+		}()
+		handler(ctx, conn, ch, sub)
+		return
+	}
+}
+
+// SFTPServer is what SFTPSubsystem needs of an SFTP server. The
+// *sftp.Server of github.com/pkg/sftp is one.
+type SFTPServer interface {
+	// Serve serves requests until the client is done.
+	Serve() error
+
+	// Close stops the server.
+	Close() error
+}
+
+// SFTPSubsystem returns a SubsystemHandler, for SubsystemSFTP, that
+// runs the SFTP server newServer makes for the channel, and closes
+// it when ctx is done. With github.com/pkg/sftp, newServer would be:
+//
+//	func(rwc io.ReadWriteCloser) (ssh.SFTPServer, error) {
+//		return sftp.NewServer(rwc)
+//	}
+func SFTPSubsystem(newServer func(rwc io.ReadWriteCloser) (SFTPServer, error)) SubsystemHandler {
+	return func(ctx context.Context, conn *ServerConn, ch Channel, req *SubsystemRequest) {
+		server, err := newServer(ch)
+		if err != nil {
+			return
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				server.Close()
+			case <-done:
+			}
+		}()
+		server.Serve()
+	}
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// fakeSFTPServer greets the client, and is done.
+type fakeSFTPServer struct {
+	rwc io.ReadWriteCloser
+}
+
+func (s *fakeSFTPServer) Serve() error {
+	_, err := io.WriteString(s.rwc, "sftp ready")
+	return err
+}
+
+func (s *fakeSFTPServer) Close() error {
+	return s.rwc.Close()
+}
+
+func TestSubsystems(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["rsa"])
+	srv := &Server{
+		Config: config,
+		Handler: Subsystems{
+			SubsystemSFTP: SFTPSubsystem(func(rwc io.ReadWriteCloser) (SFTPServer, error) {
+				return &fakeSFTPServer{rwc}, nil
+			}),
+		}.HandleChannel,
+	}
+	ctx := context.Background()
+	go srv.Serve(ctx, l)
+	defer srv.Close()
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if _, _, err := client.OpenChannel(ctx, "direct-tcpip", nil, nil); err == nil {
+		t.Errorf("OpenChannel(direct-tcpip) succeeded")
+	}
+
+	session, err := client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.Shell(); err == nil {
+		t.Errorf("Shell succeeded on a subsystem server")
+	}
+	session.Close()
+
+	session, err = client.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+	if err := session.RequestSubsystem("nosuch"); err == nil {
+		t.Errorf("RequestSubsystem(nosuch) succeeded")
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := session.RequestSubsystem(SubsystemSFTP); err != nil {
+		t.Fatalf("RequestSubsystem(sftp): %v", err)
+	}
+	out, err := ioutil.ReadAll(stdout)
+	if err != nil || string(out) != "sftp ready" {
+		t.Errorf("got %q, %v from the sftp subsystem, want %q", out, err, "sftp ready")
+	}
+}
@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// TapChannel returns a Channel that reads and writes through ch, and
+// mirrors the data it reads and writes to w, for debugging the
+// protocol a channel carries. Each read or write is written to w as
+// a line that tells its direction, "<-" for data read and "->" for
+// data written, its stream, and its length, followed by a hex dump of
+// the data, as hex.Dump formats it:
+//
+//	-> stdout 5 bytes
+//	00000000  68 65 6c 6c 6f                                    |hello|
+//	<- stderr 3 bytes
+//	00000000  62 61 64                                          |bad|
+//
+// Writes to w are serialized, so w need not be safe for concurrent
+// use; an error writing to w stops the mirroring, not the channel.
+// The returned Channel implements ExtendedStreams too, its Extended
+// returning nil if ch does not.
+func TapChannel(ch Channel, w io.Writer) Channel {
+	return &tapChannel{Channel: ch, tap: &tap{w: w}}
+}
+
+// tap writes the data of a tapped Channel to w.
+type tap struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// record mirrors the data of a read, if sent is false, or of a write
+// on the stream with the given extended code.
+func (t *tap) record(sent bool, code uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	dir := "<-"
+	if sent {
+		dir = "->"
+	}
+	var stream string
+	switch code {
+	case 0:
+		stream = "stdout"
+	case 1:
+		stream = "stderr"
+	default:
+		stream = fmt.Sprintf("extended(%d)", code)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if _, t.err = fmt.Fprintf(t.w, "%s %s %d bytes\n", dir, stream, len(data)); t.err != nil {
+		return
+	}
+	_, t.err = io.WriteString(t.w, hex.Dump(data))
+}
+
+// tapChannel is the Channel of TapChannel.
+type tapChannel struct {
+	Channel
+	tap *tap
+}
+
+func (c *tapChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	c.tap.record(false, 0, data[:n])
+	return n, err
+}
+
+func (c *tapChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	c.tap.record(true, 0, data[:n])
+	return n, err
+}
+
+func (c *tapChannel) Stderr() io.ReadWriter {
+	return c.Extended(1)
+}
+
+// Extended implements ExtendedStreams.
+func (c *tapChannel) Extended(code uint32) io.ReadWriter {
+	var rw io.ReadWriter
+	if code == 1 {
+		rw = c.Channel.Stderr()
+	} else if x, ok := c.Channel.(ExtendedStreams); ok {
+		rw = x.Extended(code)
+	}
+	if rw == nil {
+		return nil
+	}
+	return &tapStream{rw: rw, code: code, tap: c.tap}
+}
+
+// tapStream is a tapped extended stream.
+type tapStream struct {
+	rw   io.ReadWriter
+	code uint32
+	tap  *tap
+}
+
+func (s *tapStream) Read(data []byte) (int, error) {
+	n, err := s.rw.Read(data)
+	s.tap.record(false, s.code, data[:n])
+	return n, err
+}
+
+func (s *tapStream) Write(data []byte) (int, error) {
+	n, err := s.rw.Write(data)
+	s.tap.record(true, s.code, data[:n])
+	return n, err
+}
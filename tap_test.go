@@ -0,0 +1,48 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestTapChannel(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	halt := NewHalter()
+	defer halt.RequestStop()
+	s, c, mux := channelPair(t, halt)
+	defer s.Close()
+	defer c.Close()
+	defer mux.Close()
+
+	var log bytes.Buffer
+	tapped := TapChannel(c, &log)
+	if _, err := tapped.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(s, b); err != nil || string(b) != "hello" {
+		t.Fatalf("peer read %q, %v", b, err)
+	}
+	if _, err := s.Stderr().Write([]byte("bad")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(tapped.Stderr(), b[:3]); err != nil || string(b[:3]) != "bad" {
+		t.Fatalf("Stderr read %q, %v", b[:3], err)
+	}
+	if _, err := s.Extended(2).Write([]byte("ctl")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(tapped.(ExtendedStreams).Extended(2), b[:3]); err != nil || string(b[:3]) != "ctl" {
+		t.Fatalf("Extended(2) read %q, %v", b[:3], err)
+	}
+
+	want := "-> stdout 5 bytes\n" + hex.Dump([]byte("hello")) +
+		"<- stderr 3 bytes\n" + hex.Dump([]byte("bad")) +
+		"<- extended(2) 3 bytes\n" + hex.Dump([]byte("ctl"))
+	if got := log.String(); got != want {
+		t.Errorf("tap got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -20,13 +20,11 @@ import (
 // Listen requests the remote peer open a listening socket on
 // addr. Incoming connections will be available by calling Accept on
 // the returned net.Listener. The listener must be serviced, or the
-// SSH connection may hang.
+// SSH connection may hang. The listener is a ForwardListener, for
+// deadlines and contexts on Accept.
 // N must be "tcp", "tcp4", "tcp6", or "unix".
 func (c *Client) Listen(n, addr string) (net.Listener, error) {
-	ctx := c.TmpCtx
-	if ctx == nil {
-		ctx = context.Background()
-	}
+	ctx := c.Context()
 
 	switch n {
 	case "tcp", "tcp4", "tcp6":
@@ -133,10 +131,11 @@ func (c *Client) ListenTCP(ctx context.Context, laddr *net.TCPAddr) (*tcpListene
 	ch := c.Forwards.add(laddr)
 
 	return &tcpListener{
-		laddr:  laddr,
-		conn:   c,
-		in:     ch,
-		TmpCtx: c.TmpCtx}, nil
+		laddr:    laddr,
+		conn:     c,
+		in:       ch,
+		ctx:      ctx,
+		deadline: newAcceptDeadline()}, nil
 }
 
 // forwardList stores a mapping between remote
@@ -172,14 +171,6 @@ func (l *ForwardList) add(addr net.Addr) chan forward {
 	return f.c
 }
 
-// See RFC 4254, section 7.2
-type forwardedTCPPayload struct {
-	Addr       string
-	Port       uint32
-	OriginAddr string
-	OriginPort uint32
-}
-
 // parseTCPAddr parses the originating address from the remote into a *net.TCPAddr.
 func parseTCPAddr(addr string, port uint32) (*net.TCPAddr, error) {
 	if port == 0 || port > 65535 {
@@ -194,13 +185,17 @@ func parseTCPAddr(addr string, port uint32) (*net.TCPAddr, error) {
 
 func (l *ForwardList) HandleChannels(ctx context.Context, in <-chan NewChannel, conn Conn) {
 	var ch NewChannel
+	var ok bool
 	for {
 		select {
 		case <-conn.Done():
 			return
 		case <-ctx.Done():
 			return
-		case ch = <-in:
+		case ch, ok = <-in:
+			if !ok {
+				return
+			}
 			var (
 				laddr net.Addr
 				raddr net.Addr
@@ -208,7 +203,7 @@ func (l *ForwardList) HandleChannels(ctx context.Context, in <-chan NewChannel,
 			)
 			switch channelType := ch.ChannelType(); channelType {
 			case "forwarded-tcpip":
-				var payload forwardedTCPPayload
+				var payload ForwardedTCPIPPayload
 				if err = Unmarshal(ch.ExtraData(), &payload); err != nil {
 					ch.Reject(ConnectionFailed, "could not parse forwarded-tcpip payload: "+err.Error())
 					continue
@@ -231,7 +226,7 @@ func (l *ForwardList) HandleChannels(ctx context.Context, in <-chan NewChannel,
 				}
 
 			case "forwarded-streamlocal@openssh.com":
-				var payload forwardedStreamLocalPayload
+				var payload ForwardedStreamLocalPayload
 				if err = Unmarshal(ch.ExtraData(), &payload); err != nil {
 					ch.Reject(ConnectionFailed, "could not parse forwarded-streamlocal@openssh.com payload: "+err.Error())
 					continue
@@ -309,30 +304,23 @@ type tcpListener struct {
 	conn *Client
 	in   <-chan forward
 
-	// must be set for Accept() and Close() call.
-	TmpCtx context.Context
+	// ctx is used by Accept and Close.
+	ctx context.Context
+
+	deadline *acceptDeadline
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *tcpListener) Accept() (net.Conn, error) {
-	var ok bool
-	var s forward
-	select {
-	case <-l.conn.Done():
-		return nil, io.EOF
-	case <-l.TmpCtx.Done():
-		return nil, io.EOF
-	case s, ok = <-l.in:
-		if !ok {
-			return nil, io.EOF
-		}
-	}
-	ch, incoming, err := s.newCh.Accept()
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext implements ForwardListener.
+func (l *tcpListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	s, ch, err := acceptForward(ctx, l.ctx, l.conn, l.in, l.deadline)
 	if err != nil {
 		return nil, err
 	}
-	go DiscardRequests(l.TmpCtx, incoming, l.conn.Halt)
-
 	return &chanConn{
 		Channel: ch,
 		laddr:   l.laddr,
@@ -349,7 +337,7 @@ func (l *tcpListener) Close() error {
 
 	// this also closes the listener.
 	l.conn.Forwards.Remove(l.laddr)
-	ok, _, err := l.conn.SendRequest(l.TmpCtx, "cancel-tcpip-forward", true, Marshal(&m))
+	ok, _, err := l.conn.SendRequest(l.ctx, "cancel-tcpip-forward", true, Marshal(&m))
 	if err == nil && !ok {
 		err = errors.New("ssh: cancel-tcpip-forward failed")
 	}
@@ -361,14 +349,17 @@ func (l *tcpListener) Addr() net.Addr {
 	return l.laddr
 }
 
+// SetDeadline implements ForwardListener.
+func (l *tcpListener) SetDeadline(t time.Time) error {
+	l.deadline.set(t)
+	return nil
+}
+
 // Dial initiates a connection to the addr from the remote host.
 // The n argument is the network: "tcp", "tcp4", "tcp6", "unix".
 // The resulting connection has a zero LocalAddr() and RemoteAddr().
 func (c *Client) Dial(n, addr string) (Channel, error) {
-	ctx := c.TmpCtx
-	if ctx == nil {
-		ctx = context.Background()
-	}
+	ctx := c.Context()
 	return c.DialWithContext(ctx, n, addr)
 }
 
@@ -388,6 +379,11 @@ func (c *Client) DialWithContext(ctx context.Context, n, addr string) (Channel,
 		if err != nil {
 			return nil, err
 		}
+		if p := c.dialPolicy(); p != nil {
+			if err := p.Check(host, int(port)); err != nil {
+				return nil, err
+			}
+		}
 		ch, err = c.dial(ctx, net.IPv4zero.String(), 0, host, int(port))
 		if err != nil {
 			return nil, err
@@ -424,15 +420,50 @@ func (c *Client) DialWithContext(ctx context.Context, n, addr string) (Channel,
 	}
 }
 
+// DialSSH connects to the SSH server at addr through the remote
+// host, as a jump host, and returns a Client for it. config is used
+// as for Dial; if its Halt is nil, a new Halter is made. Either way
+// the Halter of the nested Client is put downstream of c.Halt, so
+// that stopping c stops it too.
+func (c *Client) DialSSH(ctx context.Context, addr string, config *ClientConfig) (*Client, error) {
+	ch, err := c.DialWithContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conf := *config
+	if conf.Halt == nil {
+		conf.Halt = NewHalter()
+	}
+	if c.Halt != nil {
+		c.Halt.AddDownstream(conf.Halt)
+	}
+	conn, chans, reqs, err := NewClientConn(ctx, ch.(net.Conn), addr, &conf)
+	if err != nil {
+		if c.Halt != nil {
+			c.Halt.RemoveDownstream(conf.Halt)
+		}
+		return nil, err
+	}
+	inner := NewClient(ctx, conn, chans, reqs, conf.Halt)
+	if c.Halt != nil {
+		inner.OnDisconnect(func(error) {
+			c.Halt.RemoveDownstream(conf.Halt)
+		})
+	}
+	return inner, nil
+}
+
 // DialTCP connects to the remote address raddr on the network net,
 // which must be "tcp", "tcp4", or "tcp6".  If laddr is not nil, it is used
 // as the local address for the connection.
 func (c *Client) DialTCP(n string, laddr, raddr *net.TCPAddr) (net.Conn, error) {
-	ctx := c.TmpCtx
-	if ctx == nil {
-		ctx = context.Background()
-	}
+	ctx := c.Context()
 
+	if p := c.dialPolicy(); p != nil {
+		if err := p.Check(raddr.IP.String(), raddr.Port); err != nil {
+			return nil, err
+		}
+	}
 	if laddr == nil {
 		laddr = &net.TCPAddr{
 			IP:   net.IPv4zero,
@@ -450,22 +481,14 @@ func (c *Client) DialTCP(n string, laddr, raddr *net.TCPAddr) (net.Conn, error)
 	}, nil
 }
 
-// RFC 4254 7.2
-type channelOpenDirectMsg struct {
-	raddr string
-	rport uint32
-	laddr string
-	lport uint32
-}
-
 func (c *Client) dial(ctx context.Context, laddr string, lport int, raddr string, rport int) (Channel, error) {
-	msg := channelOpenDirectMsg{
-		raddr: raddr,
-		rport: uint32(rport),
-		laddr: laddr,
-		lport: uint32(lport),
+	msg := DirectTCPIPPayload{
+		DestAddr:   raddr,
+		DestPort:   uint32(rport),
+		OriginAddr: laddr,
+		OriginPort: uint32(lport),
 	}
-	ch, in, err := c.OpenChannel(ctx, "direct-tcpip", Marshal(&msg), nil)
+	ch, in, err := c.openChannel(ctx, "direct-tcpip", Marshal(&msg))
 	if err != nil {
 		return nil, err
 	}
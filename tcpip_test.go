@@ -5,7 +5,13 @@
 package ssh
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestAutoPortListenBroken(t *testing.T) {
@@ -19,3 +25,152 @@ func TestAutoPortListenBroken(t *testing.T) {
 		t.Errorf("version %q marked as broken", works)
 	}
 }
+
+func TestDialSSH(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	innerAddr, innerHalt := listenSSH(t, "tcp", "127.0.0.1:0")
+	defer innerHalt.RequestStop()
+
+	policy, err := ParseDialPolicy("allow 127.0.0.1", "deny *")
+	if err != nil {
+		t.Fatalf("ParseDialPolicy: %v", err)
+	}
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	halt := NewHalter()
+	defer halt.RequestStop()
+	ctx := context.Background()
+	go func() {
+		defer c1.Close()
+		conf := &ServerConfig{NoClientAuth: true, Config: Config{Halt: halt}}
+		conf.AddHostKey(testSigners["rsa"])
+		_, chans, reqs, err := NewServerConn(ctx, c1, conf)
+		if err != nil {
+			return
+		}
+		go DiscardRequests(ctx, reqs, halt)
+		for ch := range chans {
+			go policy.HandleDirectTCPIP(ctx, ch)
+		}
+	}()
+	conn, chans, reqs, err := NewClientConn(ctx, c2, "", &ClientConfig{
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: halt},
+	})
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	client := NewClient(ctx, conn, chans, reqs, halt)
+
+	inner, err := client.DialSSH(ctx, innerAddr, &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("DialSSH: %v", err)
+	}
+	if _, _, err := inner.SendRequest(ctx, "ping", true, nil); err != nil {
+		t.Fatalf("SendRequest on nested client: %v", err)
+	}
+	if _, err := client.DialSSH(ctx, "10.0.0.1:22", &ClientConfig{}); err == nil {
+		t.Errorf("DialSSH to a denied address succeeded")
+	}
+
+	halt.RequestStop()
+	done := make(chan struct{})
+	go func() {
+		inner.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("nested client still running after the jump host stopped")
+	}
+}
+
+func TestForwardListenerDeadline(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	defer config.Halt.RequestStop()
+	ctx := context.Background()
+	go ServeListener(ctx, l, config, (&forwardingServer{}).serve)
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	nl, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer nl.Close()
+	fl, ok := nl.(ForwardListener)
+	if !ok {
+		t.Fatalf("%T is not a ForwardListener", nl)
+	}
+
+	// A deadline set while Accept blocks ends it.
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := fl.Accept()
+		accepted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fl.SetDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Accept: %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Accept error %v is not a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return at its deadline")
+	}
+	if _, err := fl.Accept(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Accept past the deadline: %v", err)
+	}
+
+	actx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	fl.SetDeadline(time.Time{})
+	if _, err := fl.AcceptContext(actx); err != context.DeadlineExceeded {
+		t.Fatalf("AcceptContext: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Without a deadline, connections come through.
+	go func() {
+		c, err := net.Dial("tcp", nl.Addr().String())
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "hi")
+		c.Close()
+	}()
+	conn, err := fl.AcceptContext(ctx)
+	if err != nil {
+		t.Fatalf("AcceptContext: %v", err)
+	}
+	defer conn.Close()
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil || string(b[:]) != "hi" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
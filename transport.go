@@ -10,6 +10,9 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
 // debugTransport if set, will print packet types as they go over the
@@ -44,11 +47,22 @@ type transport struct {
 	writer connectionState
 
 	bufReader *bufio.Reader
-	bufWriter *bufio.Writer
+	bufWriter packetWriter
 	rand      io.Reader
 	isClient  bool
 	io.Closer
 
+	// batch gathers the packets of writePackets.
+	batch batchWriter
+
+	// strictMode is set once both sides have advertised the
+	// kex-strict extension. See handshakeTransport.enterKeyExchange.
+	strictMode bool
+
+	// initialKEXDone is set after the first key exchange has
+	// completed.
+	initialKEXDone bool
+
 	config *Config
 }
 
@@ -63,6 +77,12 @@ type packetCipher interface {
 	// returned packet may be overwritten by future calls of
 	// readPacket.
 	readPacket(seqnum uint32, r io.Reader) ([]byte, error)
+
+	// release returns the cipher's buffers to packetBufPools. It
+	// is called once the cipher has been replaced by a key change,
+	// or its direction of the transport is done. A cipher used
+	// after it takes buffers again.
+	release()
 }
 
 // connectionState represents one side (read or write) of the
@@ -82,6 +102,8 @@ func (t *transport) prepareKeyChange(ctx context.Context, algs *algorithms, kexR
 
 	if ciph, err := newPacketCipher(t.reader.dir, algs.r, kexResult); err != nil {
 		return err
+	} else if ciph, err = withCompression(ciph, config.Compressions, algs.r.Compression); err != nil {
+		return err
 	} else {
 		select {
 		case t.reader.pendingKeyChange <- ciph:
@@ -94,6 +116,8 @@ func (t *transport) prepareKeyChange(ctx context.Context, algs *algorithms, kexR
 
 	if ciph, err := newPacketCipher(t.writer.dir, algs.w, kexResult); err != nil {
 		return err
+	} else if ciph, err = withCompression(withPadding(ciph, config.Padding), config.Compressions, algs.w.Compression); err != nil {
+		return err
 	} else {
 		select {
 		case t.writer.pendingKeyChange <- ciph:
@@ -107,6 +131,38 @@ func (t *transport) prepareKeyChange(ctx context.Context, algs *algorithms, kexR
 	return nil
 }
 
+// releaseReader returns the buffers of the read direction to their
+// pools. It is called by the reader once it reads no more.
+func (t *transport) releaseReader() {
+	t.reader.release()
+}
+
+// releaseWriter returns the buffers of the write direction to their
+// pools. It is called once nothing writes to t any more.
+func (t *transport) releaseWriter() {
+	t.writer.release()
+	t.batch.buf = nil
+}
+
+// setStrictMode enables the OpenSSH strict key exchange
+// countermeasure: sequence numbers are reset on every msgNewKeys,
+// and no msgIgnore or msgDebug is tolerated during the initial key
+// exchange. It may only be called before the first msgNewKeys.
+func (t *transport) setStrictMode() error {
+	if t.reader.seqNum != 1 {
+		return errors.New("ssh: sequence number != 1 when strict KEX mode requested")
+	}
+	t.strictMode = true
+	return nil
+}
+
+// setInitialKEXDone records that the first key exchange has
+// completed, after which msgIgnore and msgDebug are silently
+// discarded again.
+func (t *transport) setInitialKEXDone() {
+	t.initialKEXDone = true
+}
+
 func (t *transport) printPacket(p []byte, write bool) {
 	if len(p) == 0 {
 		return
@@ -123,14 +179,42 @@ func (t *transport) printPacket(p []byte, write bool) {
 	log.Println(what, who, p[0])
 }
 
+// packetDump returns the PacketDump of the config, if any.
+func (t *transport) packetDump() *PacketDump {
+	if t.config == nil {
+		return nil
+	}
+	return t.config.PacketDump
+}
+
+// metrics returns the MetricsSink of the config, if any.
+func (t *transport) metrics() MetricsSink {
+	if t.config == nil {
+		return nil
+	}
+	return t.config.Metrics
+}
+
 // Read and decrypt next packet.
 func (t *transport) readPacket(ctx context.Context) (p []byte, err error) {
 	for {
-		p, err = t.reader.readPacket(t.bufReader)
+		p, err = t.reader.readPacket(t.bufReader, t.strictMode)
+		if m := t.metrics(); m != nil && err == nil {
+			m.Counter(MetricTransportBytes, float64(len(p)), labelsDirectionIn...)
+		}
+		if d := t.packetDump(); d != nil {
+			if msg, ok := err.(*disconnectMsg); ok {
+				d.record(false, Marshal(msg), time.Now())
+			} else if err == nil {
+				d.record(false, p, time.Now())
+			}
+		}
 		if err != nil {
 			break
 		}
-		if len(p) == 0 || (p[0] != msgIgnore && p[0] != msgDebug) {
+		// In strict mode, pass msgIgnore and msgDebug up during the
+		// initial key exchange, so the kex rejects them.
+		if len(p) == 0 || (t.strictMode && !t.initialKEXDone) || (p[0] != msgIgnore && p[0] != msgDebug) {
 			break
 		}
 	}
@@ -141,7 +225,7 @@ func (t *transport) readPacket(ctx context.Context) (p []byte, err error) {
 	return p, err
 }
 
-func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
+func (s *connectionState) readPacket(r *bufio.Reader, strictMode bool) ([]byte, error) {
 	packet, err := s.packetCipher.readPacket(s.seqNum, r)
 	s.seqNum++
 	if err == nil && len(packet) == 0 {
@@ -153,7 +237,13 @@ func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 		case msgNewKeys:
 			select {
 			case cipher := <-s.pendingKeyChange:
+				// packet points into the old cipher's buffer,
+				// so it is released after the copy below.
+				defer s.packetCipher.release()
 				s.packetCipher = cipher
+				if strictMode {
+					s.seqNum = 0
+				}
 			default:
 				return nil, errors.New("ssh: got bogus newkeys message.")
 			}
@@ -181,13 +271,97 @@ func (s *connectionState) readPacket(r *bufio.Reader) ([]byte, error) {
 }
 
 func (t *transport) writePacket(packet []byte) error {
+	t.noteWrite(packet)
+	if faultsEnabled && t.config != nil && t.config.Faults != nil {
+		return t.writeWithFaults(t.config.Faults, packet)
+	}
+	return t.writer.writePacket(t.bufWriter, t.rand, packet, t.strictMode)
+}
+
+// noteWrite passes a packet about to be sent to the debug log, the
+// PacketDump and the metrics.
+func (t *transport) noteWrite(packet []byte) {
 	if debugTransport {
 		t.printPacket(packet, true)
 	}
-	return t.writer.writePacket(t.bufWriter, t.rand, packet)
+	if d := t.packetDump(); d != nil {
+		d.record(true, packet, time.Now())
+	}
+	if m := t.metrics(); m != nil {
+		m.Counter(MetricTransportBytes, float64(len(packet)), labelsDirectionOut...)
+	}
+}
+
+// maxBatch is the most a batch of packets gathers before it is sent,
+// and keepBatch the largest buffer a transport keeps for the next.
+const (
+	maxBatch  = 256 << 10
+	keepBatch = 64 << 10
+)
+
+// writePackets sends packets, as writePacket does, but encrypts them
+// one after the other into a single buffer, sent with one write per
+// maxBatch bytes, rather than one per packet. The packets queued
+// during a key exchange go out this way.
+func (t *transport) writePackets(packets [][]byte) error {
+	if faultsEnabled && t.config != nil && t.config.Faults != nil {
+		for _, p := range packets {
+			if err := t.writePacket(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	b := &t.batch
+	b.w = t.bufWriter
+	for _, p := range packets {
+		t.noteWrite(p)
+		if err := t.writer.writePacket(b, t.rand, p, t.strictMode); err != nil {
+			return err
+		}
+	}
+	err := b.send()
+	if cap(b.buf) > keepBatch {
+		// Do not hold on to the buffer of a large batch.
+		b.buf = nil
+	}
+	return err
+}
+
+// batchWriter is a packetWriter that gathers packets, and sends them
+// on to w once it holds maxBatch bytes, or on send.
+type batchWriter struct {
+	w   packetWriter
+	buf []byte
+}
+
+func (b *batchWriter) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	return len(p), nil
 }
 
-func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []byte) error {
+// Flush is called after each packet, and only sends a full batch.
+func (b *batchWriter) Flush() error {
+	if len(b.buf) < maxBatch {
+		return nil
+	}
+	return b.send()
+}
+
+func (b *batchWriter) send() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf)
+	if err == nil {
+		err = b.w.Flush()
+	}
+	// w may hold on to buf until its Flush, which is done.
+	b.buf = b.buf[:0]
+	return err
+}
+
+func (s *connectionState) writePacket(w packetWriter, rand io.Reader, packet []byte, strictMode bool) error {
 	changeKeys := len(packet) > 0 && packet[0] == msgNewKeys
 
 	err := s.packetCipher.writePacket(s.seqNum, w, rand, packet)
@@ -201,7 +375,11 @@ func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []
 	if changeKeys {
 		select {
 		case cipher := <-s.pendingKeyChange:
+			s.packetCipher.release()
 			s.packetCipher = cipher
+			if strictMode {
+				s.seqNum = 0
+			}
 		default:
 			panic("ssh: no key material for msgNewKeys")
 		}
@@ -209,11 +387,54 @@ func (s *connectionState) writePacket(w *bufio.Writer, rand io.Reader, packet []
 	return err
 }
 
+// packetWriter receives the pieces of each encrypted packet and sends
+// them when flushed.
+type packetWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// newPacketWriter returns a packetWriter for w. Connections that
+// support it get the pieces of a packet in a single writev, rather
+// than copied into a bufio.Writer.
+func newPacketWriter(w io.Writer) packetWriter {
+	switch w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		return &vectorWriter{w: w}
+	}
+	return bufio.NewWriter(w)
+}
+
+// vectorWriter is a packetWriter that holds on to the slices it is
+// given, which must not change before Flush, and writes them all
+// with net.Buffers.
+type vectorWriter struct {
+	w    io.Writer
+	bufs net.Buffers
+	arr  [4][]byte
+}
+
+func (v *vectorWriter) Write(p []byte) (int, error) {
+	if v.bufs == nil {
+		v.bufs = v.arr[:0]
+	}
+	v.bufs = append(v.bufs, p)
+	return len(p), nil
+}
+
+func (v *vectorWriter) Flush() error {
+	// WriteTo consumes v.bufs, so the pieces are cleared through arr.
+	_, err := v.bufs.WriteTo(v.w)
+	v.arr = [4][]byte{}
+	v.bufs = v.arr[:0]
+	return err
+}
+
 func newTransport(rwc io.ReadWriteCloser, rand io.Reader, isClient bool,
 	config *Config) *transport {
 	t := &transport{
 		bufReader: bufio.NewReader(rwc),
-		bufWriter: bufio.NewWriter(rwc),
+		bufWriter: newPacketWriter(rwc),
 		rand:      rand,
 		reader: connectionState{
 			packetCipher:     &streamPacketCipher{cipher: noneCipher{}},
@@ -329,8 +550,9 @@ const packageVersion = "SSH-2.0-Go"
 
 // Sends and receives a version line.  The versionLine string should
 // be US ASCII, start with "SSH-2.0-", and should not include a
-// newline. exchangeVersions returns the other side's version line.
-func exchangeVersions(rw io.ReadWriter, versionLine []byte) (them []byte, err error) {
+// newline. exchangeVersions returns the other side's version line,
+// which may be up to maxBytes long.
+func exchangeVersions(rw io.ReadWriter, versionLine []byte, maxBytes int) (them []byte, err error) {
 	// Contrary to the RFC, we do not ignore lines that don't
 	// start with "SSH-2.0-" to make the library usable with
 	// nonconforming servers.
@@ -345,22 +567,51 @@ func exchangeVersions(rw io.ReadWriter, versionLine []byte) (them []byte, err er
 		return
 	}
 
-	them, err = readVersion(rw)
+	them, err = readVersion(rw, maxBytes)
 	return them, err
 }
 
 // maxVersionStringBytes is the maximum number of bytes that we'll
-// accept as a version string. RFC 4253 section 4.2 limits this at 255
-// chars
+// accept as a version string, unless Config.MaxVersionBytes says
+// otherwise. RFC 4253 section 4.2 limits this at 255 chars
 const maxVersionStringBytes = 255
 
-// Read version string as specified by RFC 4253, section 4.2.
-func readVersion(r io.Reader) ([]byte, error) {
+// exchangeVersionsConn is exchangeVersions over c, bounded by the
+// VersionTimeout and MaxVersionBytes of config. The timeout closes c,
+// timed by config.Clock; the deadlines of c are left to the caller.
+func exchangeVersionsConn(c net.Conn, versionLine []byte, config *Config) ([]byte, error) {
+	maxBytes := config.MaxVersionBytes
+	if maxBytes <= 0 {
+		maxBytes = maxVersionStringBytes
+	}
+	if config.VersionTimeout <= 0 {
+		return exchangeVersions(c, versionLine, maxBytes)
+	}
+
+	// state is 0 while the exchange runs, then 1 if the time ran
+	// out first, or 2 if the exchange ended first.
+	var state int32
+	t := clockOr(config.Clock).AfterFunc(config.VersionTimeout, func() {
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			c.Close()
+		}
+	})
+	defer t.Stop()
+	them, err := exchangeVersions(c, versionLine, maxBytes)
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		return nil, ErrVersionTimeout
+	}
+	return them, err
+}
+
+// Read version string as specified by RFC 4253, section 4.2, of up
+// to maxBytes.
+func readVersion(r io.Reader, maxBytes int) ([]byte, error) {
 	versionString := make([]byte, 0, 64)
 	var ok bool
 	var buf [1]byte
 
-	for len(versionString) < maxVersionStringBytes {
+	for len(versionString) < maxBytes {
 		_, err := io.ReadFull(r, buf[:])
 		if err != nil {
 			return nil, err
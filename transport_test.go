@@ -7,6 +7,7 @@ package ssh
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"encoding/binary"
 	"strings"
@@ -23,7 +24,7 @@ func TestReadVersion(t *testing.T) {
 	}
 
 	for in, want := range cases {
-		result, err := readVersion(bytes.NewBufferString(in))
+		result, err := readVersion(bytes.NewBufferString(in), maxVersionStringBytes)
 		if err != nil {
 			t.Errorf("readVersion(%q): %s", in, err)
 		}
@@ -42,7 +43,7 @@ func TestReadVersionError(t *testing.T) {
 		longversion + "too-long\r\n",
 	}
 	for _, in := range cases {
-		if _, err := readVersion(bytes.NewBufferString(in)); err == nil {
+		if _, err := readVersion(bytes.NewBufferString(in), maxVersionStringBytes); err == nil {
 			t.Errorf("readVersion(%q) should have failed", in)
 		}
 	}
@@ -53,7 +54,7 @@ func TestExchangeVersionsBasic(t *testing.T) {
 
 	v := "SSH-2.0-bla"
 	buf := bytes.NewBufferString(v + "\r\n")
-	them, err := exchangeVersions(buf, []byte("xyz"))
+	them, err := exchangeVersions(buf, []byte("xyz"), maxVersionStringBytes)
 	if err != nil {
 		t.Errorf("exchangeVersions: %v", err)
 	}
@@ -72,7 +73,7 @@ func TestExchangeVersions(t *testing.T) {
 	}
 	for _, c := range cases {
 		buf := bytes.NewBufferString("SSH-2.0-bla\r\n")
-		if _, err := exchangeVersions(buf, []byte(c)); err == nil {
+		if _, err := exchangeVersions(buf, []byte(c), maxVersionStringBytes); err == nil {
 			t.Errorf("exchangeVersions(%q): should have failed", c)
 		}
 	}
@@ -120,3 +121,131 @@ func TestTransportMaxPacketReader(t *testing.T) {
 		t.Errorf("got %q, should mention %q", err.Error(), "large")
 	}
 }
+
+func TestTransportVectorWrite(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	trC := newTransport(c1, rand.Reader, true, nil)
+	trS := newTransport(c2, rand.Reader, false, nil)
+	if _, ok := trC.bufWriter.(*vectorWriter); !ok {
+		t.Fatalf("TCP transport writes with %T, want *vectorWriter", trC.bufWriter)
+	}
+
+	sizes := []int{1, 100, 40000}
+	go func() {
+		for i, n := range sizes {
+			trC.writePacket(bytes.Repeat([]byte{byte(200 + i)}, n))
+		}
+	}()
+	for i, n := range sizes {
+		p, err := trS.readPacket(context.Background())
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if !bytes.Equal(p, bytes.Repeat([]byte{byte(200 + i)}, n)) {
+			t.Errorf("packet %d: got %d bytes, want %d", i, len(p), n)
+		}
+	}
+}
+
+// gcmTransports returns transports over a TCP connection that
+// encrypt from c to s with AES-GCM, as after a key exchange.
+func gcmTransports(tb testing.TB) (c, s *transport, closer func()) {
+	c1, c2, err := netPipe()
+	if err != nil {
+		tb.Fatalf("netPipe: %v", err)
+	}
+	c = newTransport(c1, rand.Reader, true, nil)
+	s = newTransport(c2, rand.Reader, false, nil)
+	kr := &kexResult{Hash: crypto.SHA256}
+	algs := directionAlgorithms{Cipher: gcmCipherID, MAC: "hmac-sha2-256", Compression: "none"}
+	if c.writer.packetCipher, err = newPacketCipher(clientKeys, algs, kr); err != nil {
+		tb.Fatalf("newPacketCipher: %v", err)
+	}
+	s.reader.packetCipher, _ = newPacketCipher(clientKeys, algs, kr)
+	return c, s, func() {
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestTransportWritePackets(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	trC, trS, closer := gcmTransports(t)
+	defer closer()
+
+	// Enough to fill several batches.
+	var packets [][]byte
+	for i := 0; i < 40; i++ {
+		packets = append(packets, bytes.Repeat([]byte{byte(200 + i)}, 1+i*1000))
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- trC.writePackets(packets)
+	}()
+	for i, want := range packets {
+		p, err := trS.readPacket(context.Background())
+		if err != nil {
+			t.Fatalf("readPacket %d: %v", i, err)
+		}
+		if !bytes.Equal(p, want) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, len(p), len(want))
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writePackets: %v", err)
+	}
+	if trC.writer.seqNum != uint32(len(packets)) {
+		t.Errorf("sequence number %d after %d packets", trC.writer.seqNum, len(packets))
+	}
+}
+
+// BenchmarkTransportWritePackets sends 16 packets of 1KB at a time
+// over TCP, one by one and as a batch.
+func BenchmarkTransportWritePackets(b *testing.B) {
+	packets := make([][]byte, 16)
+	for i := range packets {
+		packets[i] = make([]byte, 1024)
+		packets[i][0] = msgChannelData
+	}
+	for _, batch := range []bool{false, true} {
+		name := "single"
+		if batch {
+			name = "batch"
+		}
+		b.Run(name, func(b *testing.B) {
+			trC, trS, closer := gcmTransports(b)
+			defer closer()
+			go func() {
+				for {
+					if _, err := trS.readPacket(context.Background()); err != nil {
+						return
+					}
+				}
+			}()
+			b.SetBytes(int64(len(packets) * 1024))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if batch {
+					if err := trC.writePackets(packets); err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				for _, p := range packets {
+					if err := trC.writePacket(p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RemoteForward is a forward that a TunnelSupervisor keeps up:
+// connections to RemoteAddr on the server are served by Handle.
+type RemoteForward struct {
+	// RemoteAddr is the "host:port" the server listens on. Port
+	// 0 lets the server pick one; ForwardHealth.Addr reports it.
+	RemoteAddr string
+
+	// Handle serves each connection that comes through the
+	// forward, on a goroutine of its own. It must close conn.
+	Handle func(conn net.Conn)
+
+	// MaxConns, if positive, limits the calls of Handle in flight
+	// at once; the limit spans the requests of the forward. When
+	// that many are, the next connection is closed at once, unless
+	// QueueConns is set; then it waits, off the accept path, for
+	// another to end. Connections keep being accepted either way:
+	// the channels of every remote forward arrive on the one
+	// client, and a forward that stopped accepting would stall them
+	// all.
+	MaxConns   int
+	QueueConns bool
+}
+
+// ForwardHealth is the state of a RemoteForward, as a
+// TunnelSupervisor last saw it.
+type ForwardHealth struct {
+	RemoteAddr string
+
+	// Up is true while the forward is set up and passed its last
+	// check.
+	Up bool
+
+	// Addr is the address the server listens on, if Up.
+	Addr net.Addr
+
+	// LastCheck is when the forward was last requested or
+	// checked, and Err the reason it is down, if it is.
+	LastCheck time.Time
+	Err       error
+
+	// Failures counts the checks and requests that failed since
+	// the forward was last up.
+	Failures int
+
+	// Requests counts the times the forward was requested from
+	// the server.
+	Requests int
+}
+
+// TunnelSupervisor keeps a set of remote forwards up on a Client, as
+// an agent that phones home needs. Run requests the forwards, checks
+// them every Interval by dialing through each tunnel from the server
+// end, and requests them again when a check fails, and after each
+// rekey. When the Client is lost, Run returns; call it again with a
+// new Client to request all forwards on it.
+//
+// A check opens a connection through the forward and closes it
+// without sending data, as the health checks of load balancers do,
+// so Handle sees it as a connection that ends right away.
+type TunnelSupervisor struct {
+	Forwards []RemoteForward
+
+	// Interval is the time between checks. If zero, it is 30
+	// seconds.
+	Interval time.Duration
+
+	// CheckTimeout bounds each check. If zero, it is 10 seconds.
+	CheckTimeout time.Duration
+
+	// OnHealth, if non-nil, is called with the health of a
+	// forward after each request and check of it.
+	OnHealth func(ForwardHealth)
+
+	// Clock, if non-nil, replaces package time; it is meant for
+	// tests.
+	Clock Clock
+
+	mu     sync.Mutex
+	health map[string]*ForwardHealth
+}
+
+// supervisedForward is a RemoteForward that Run has requested.
+type supervisedForward struct {
+	RemoteForward
+	listener net.Listener
+	limit    *connLimit
+}
+
+func (s *TunnelSupervisor) clock() Clock {
+	if s.Clock == nil {
+		return realClock{}
+	}
+	return s.Clock
+}
+
+// Health returns the health of the forwards, in the order of
+// Forwards.
+func (s *TunnelSupervisor) Health() []ForwardHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ForwardHealth, 0, len(s.Forwards))
+	for _, f := range s.Forwards {
+		if h, ok := s.health[f.RemoteAddr]; ok {
+			list = append(list, *h)
+		} else {
+			list = append(list, ForwardHealth{RemoteAddr: f.RemoteAddr})
+		}
+	}
+	return list
+}
+
+// report records the outcome of a request or check of f.
+func (s *TunnelSupervisor) report(f *supervisedForward, requested bool, err error) {
+	s.mu.Lock()
+	if s.health == nil {
+		s.health = map[string]*ForwardHealth{}
+	}
+	h, ok := s.health[f.RemoteAddr]
+	if !ok {
+		h = &ForwardHealth{RemoteAddr: f.RemoteAddr}
+		s.health[f.RemoteAddr] = h
+	}
+	h.LastCheck = s.clock().Now()
+	if requested {
+		h.Requests++
+	}
+	h.Up, h.Err = err == nil, err
+	h.Addr = nil
+	if err == nil {
+		h.Addr = f.listener.Addr()
+		h.Failures = 0
+	} else {
+		h.Failures++
+	}
+	snapshot := *h
+	s.mu.Unlock()
+	if s.OnHealth != nil {
+		s.OnHealth(snapshot)
+	}
+}
+
+// Run keeps the forwards up on client until ctx is done, or the
+// connection of client is lost. It then cancels the forwards, if it
+// still can, and returns ctx.Err() or the error that ended the
+// connection.
+func (s *TunnelSupervisor) Run(ctx context.Context, client *Client) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	forwards := make([]*supervisedForward, len(s.Forwards))
+	for i, f := range s.Forwards {
+		forwards[i] = &supervisedForward{
+			RemoteForward: f,
+			limit:         newConnLimit(f.MaxConns, f.QueueConns),
+		}
+	}
+	defer func() {
+		for _, f := range forwards {
+			if f.listener != nil {
+				f.listener.Close()
+				f.listener = nil
+				s.report(f, false, errors.New("ssh: supervisor stopped"))
+			}
+		}
+	}()
+
+	rekeyed := make(chan struct{}, 1)
+	client.OnRekey(func() {
+		select {
+		case rekeyed <- struct{}{}:
+		default:
+		}
+	})
+
+	ticker := s.clock().NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, f := range forwards {
+			s.keepUp(ctx, client, f)
+		}
+		select {
+		case <-ticker.C():
+		case <-rekeyed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-client.Done():
+			return client.Wait()
+		}
+	}
+}
+
+// keepUp requests f if it is not set up, and checks it otherwise,
+// requesting it again if the check fails.
+func (s *TunnelSupervisor) keepUp(ctx context.Context, client *Client, f *supervisedForward) {
+	if f.listener != nil {
+		err := s.check(ctx, client, f)
+		s.report(f, false, err)
+		if err == nil {
+			return
+		}
+		f.listener.Close()
+		f.listener = nil
+	}
+
+	l, err := client.Listen("tcp", f.RemoteAddr)
+	if err != nil {
+		s.report(f, true, err)
+		return
+	}
+	f.listener = l
+	go func() {
+		// closed stops the connections still waiting for a slot
+		// once the listener is gone.
+		closed := make(chan struct{})
+		defer close(closed)
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-closed:
+			}
+			close(stop)
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if !f.limit.acquire(stop) {
+					conn.Close()
+					return
+				}
+				defer f.limit.release()
+				f.Handle(conn)
+			}()
+		}
+	}()
+	s.report(f, true, nil)
+}
+
+// check dials through the tunnel of f from the server end.
+func (s *TunnelSupervisor) check(ctx context.Context, client *Client, f *supervisedForward) error {
+	timeout := s.CheckTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addr := f.listener.Addr().(*net.TCPAddr)
+	ip := addr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	ch, err := client.DialWithContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port)))
+	if err != nil {
+		return err
+	}
+	return ch.Close()
+}
@@ -0,0 +1,314 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// forwardingServer is a server that handles "tcpip-forward",
+// "cancel-tcpip-forward" and "direct-tcpip", as sshd does.
+type forwardingServer struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+// dropAll closes the listeners of the forwards, as if the server
+// lost them.
+func (s *forwardingServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, l := range s.listeners {
+		l.Close()
+		delete(s.listeners, addr)
+	}
+}
+
+func pipeConns(a, b io.ReadWriteCloser) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+func (s *forwardingServer) serve(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+	go func() {
+		for req := range reqs {
+			var m struct {
+				Addr string
+				Port uint32
+			}
+			if err := Unmarshal(req.Payload, &m); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			switch req.Type {
+			case "tcpip-forward":
+				l, err := net.Listen("tcp", net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port))))
+				if err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				port := uint32(l.Addr().(*net.TCPAddr).Port)
+				s.mu.Lock()
+				if s.listeners == nil {
+					s.listeners = map[string]net.Listener{}
+				}
+				s.listeners[net.JoinHostPort(m.Addr, strconv.Itoa(int(port)))] = l
+				s.mu.Unlock()
+				req.Reply(true, Marshal(&struct{ Port uint32 }{port}))
+				go func() {
+					for {
+						c, err := l.Accept()
+						if err != nil {
+							return
+						}
+						// sshd opens the channel of each connection
+						// without waiting for the last one.
+						go func() {
+							ch, in, err := conn.OpenChannel(ctx, "forwarded-tcpip", Marshal(&ForwardedTCPIPPayload{
+								Addr: m.Addr, Port: port, OriginAddr: "127.0.0.1", OriginPort: 1,
+							}), nil)
+							if err != nil {
+								c.Close()
+								return
+							}
+							go DiscardRequests(ctx, in, nil)
+							pipeConns(c, ch)
+						}()
+					}
+				}()
+			case "cancel-tcpip-forward":
+				s.mu.Lock()
+				l, ok := s.listeners[net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port)))]
+				if ok {
+					l.Close()
+					delete(s.listeners, net.JoinHostPort(m.Addr, strconv.Itoa(int(m.Port))))
+				}
+				s.mu.Unlock()
+				req.Reply(ok, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	for newCh := range chans {
+		p, err := ParseChannelOpen(newCh)
+		d, ok := p.(*DirectTCPIPPayload)
+		if err != nil || !ok {
+			newCh.Reject(UnknownChannelType, "not supported")
+			continue
+		}
+		c, err := net.Dial("tcp", net.JoinHostPort(d.DestAddr, strconv.Itoa(int(d.DestPort))))
+		if err != nil {
+			newCh.Reject(ConnectionFailed, err.Error())
+			continue
+		}
+		ch, in, err := newCh.Accept()
+		if err != nil {
+			c.Close()
+			continue
+		}
+		go DiscardRequests(ctx, in, nil)
+		go pipeConns(c, ch)
+	}
+}
+
+func TestTunnelSupervisor(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	srv := &forwardingServer{}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	defer config.Halt.RequestStop()
+	ctx := context.Background()
+	go ServeListener(ctx, l, config, srv.serve)
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "phonehome",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	clock := NewFakeClock(time.Now())
+	health := make(chan ForwardHealth, 10)
+	sup := &TunnelSupervisor{
+		Forwards: []RemoteForward{{
+			RemoteAddr: "127.0.0.1:0",
+			Handle: func(conn net.Conn) {
+				io.WriteString(conn, "hello")
+				conn.Close()
+			},
+		}},
+		Interval: time.Minute,
+		Clock:    clock,
+		OnHealth: func(h ForwardHealth) { health <- h },
+	}
+	done := make(chan error, 1)
+	go func() { done <- sup.Run(ctx, client) }()
+
+	next := func() ForwardHealth {
+		select {
+		case h := <-health:
+			return h
+		case <-time.After(10 * time.Second):
+			t.Fatal("no health report")
+		}
+		panic("unreachable")
+	}
+	h := next()
+	if !h.Up || h.Requests != 1 || h.Addr == nil {
+		t.Fatalf("after start: %+v", h)
+	}
+	c, err := net.Dial("tcp", h.Addr.String())
+	if err != nil {
+		t.Fatalf("Dial through tunnel: %v", err)
+	}
+	got, _ := ioutil.ReadAll(c)
+	c.Close()
+	if string(got) != "hello" {
+		t.Errorf("read %q through the tunnel, want hello", got)
+	}
+
+	// A passing check keeps the forward.
+	clock.Advance(time.Minute)
+	if h := next(); !h.Up || h.Requests != 1 {
+		t.Fatalf("after a check: %+v", h)
+	}
+
+	// The server loses the forward; the check fails, and the
+	// forward is requested again.
+	srv.dropAll()
+	clock.Advance(time.Minute)
+	if h := next(); h.Up || h.Err == nil || h.Failures != 1 {
+		t.Fatalf("after losing the forward: %+v", h)
+	}
+	if h := next(); !h.Up || h.Requests != 2 {
+		t.Fatalf("after requesting again: %+v", h)
+	}
+	if hs := sup.Health(); len(hs) != 1 || !hs[0].Up {
+		t.Errorf("Health = %+v", hs)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after the client closed")
+	}
+	if hs := sup.Health(); hs[0].Up {
+		t.Errorf("forward up after Run returned: %+v", hs[0])
+	}
+}
+
+func TestTunnelSupervisorQueueKeepsAccepting(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	srv := &forwardingServer{}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	defer config.Halt.RequestStop()
+	ctx := context.Background()
+	go ServeListener(ctx, l, config, srv.serve)
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "phonehome",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	release := make(chan struct{})
+	handled := make(chan struct{}, 10)
+	health := make(chan ForwardHealth, 10)
+	sup := &TunnelSupervisor{
+		Forwards: []RemoteForward{{
+			RemoteAddr: "127.0.0.1:0",
+			Handle: func(conn net.Conn) {
+				handled <- struct{}{}
+				<-release
+				conn.Close()
+			},
+			MaxConns:   1,
+			QueueConns: true,
+		}, {
+			RemoteAddr: "localhost:0",
+			Handle: func(conn net.Conn) {
+				io.WriteString(conn, "hello")
+				conn.Close()
+			},
+		}},
+		Interval: time.Minute,
+		Clock:    NewFakeClock(time.Now()),
+		OnHealth: func(h ForwardHealth) { health <- h },
+	}
+	go sup.Run(ctx, client)
+
+	addrs := map[string]net.Addr{}
+	for len(addrs) < 2 {
+		select {
+		case h := <-health:
+			if !h.Up {
+				t.Fatalf("after start: %+v", h)
+			}
+			addrs[h.RemoteAddr] = h.Addr
+		case <-time.After(10 * time.Second):
+			t.Fatal("no health report")
+		}
+	}
+
+	// One connection takes the only slot of the first forward; the
+	// rest queue.
+	const n = 4
+	for i := 0; i < n; i++ {
+		c, err := net.Dial("tcp", addrs["127.0.0.1:0"].String())
+		if err != nil {
+			t.Fatalf("Dial through tunnel: %v", err)
+		}
+		defer c.Close()
+	}
+	<-handled
+
+	// The second forward is not stalled by the first.
+	c, err := net.Dial("tcp", addrs["localhost:0"].String())
+	if err != nil {
+		t.Fatalf("Dial through tunnel: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, _ := ioutil.ReadAll(c)
+	c.Close()
+	if string(got) != "hello" {
+		t.Errorf("read %q through the second forward, want hello", got)
+	}
+
+	close(release)
+	for i := 1; i < n; i++ {
+		select {
+		case <-handled:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d of %d queued connections handled", i-1, n-1)
+		}
+	}
+}
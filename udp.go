@@ -0,0 +1,266 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDPChannelType is the type of the channels that carry datagrams,
+// opened by Client.DialUDP. It is not part of any standard, so only
+// servers of this package that route it to ForwardUDP or AcceptUDP
+// take it; others refuse it as an unknown channel type.
+//
+// The extra data of the channel open is a DirectUDPPayload. Each
+// datagram is sent in the channel data as a frame: its length, as a
+// uint32, and then its bytes.
+const UDPChannelType = "direct-udp@glycerine.github.io"
+
+// maxDatagram is the largest datagram that is framed, the most that
+// UDP over IPv4 carries.
+const maxDatagram = 65535
+
+// DirectUDPPayload is the extra data of a UDPChannelType channel:
+// datagrams to DestAddr, which may be a host name, sent on behalf of
+// the originator, as DirectTCPIPPayload is for a connection.
+type DirectUDPPayload struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// udpConn is the net.PacketConn over a UDPChannelType channel. Its
+// only peer is the other end of the channel.
+type udpConn struct {
+	ch           Channel
+	laddr, raddr net.Addr
+
+	rmu  sync.Mutex // serializes ReadFrom
+	rhdr [4]byte
+	wmu  sync.Mutex // serializes WriteTo
+	wbuf []byte
+}
+
+// ReadFrom reads the next datagram into p, and returns the address
+// of the peer. As with UDP, a datagram longer than p is truncated.
+func (u *udpConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
+	if _, err := io.ReadFull(u.ch, u.rhdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(u.rhdr[:]))
+	if size > maxDatagram {
+		u.ch.Close()
+		return 0, nil, fmt.Errorf("ssh: datagram of %d bytes", size)
+	}
+	n := size
+	if n > len(p) {
+		n = len(p)
+	}
+	if _, err := io.ReadFull(u.ch, p[:n]); err != nil {
+		return 0, nil, err
+	}
+	if n < size {
+		if _, err := io.CopyN(ioutil.Discard, u.ch, int64(size-n)); err != nil {
+			return 0, nil, err
+		}
+	}
+	return n, u.raddr, nil
+}
+
+// WriteTo sends p as one datagram to the peer. addr is ignored, for
+// the channel has one peer.
+func (u *udpConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > maxDatagram {
+		return 0, fmt.Errorf("ssh: datagram of %d bytes is too long", len(p))
+	}
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
+	u.wbuf = append(u.wbuf[:0], 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(u.wbuf, uint32(len(p)))
+	u.wbuf = append(u.wbuf, p...)
+	if _, err := u.ch.Write(u.wbuf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (u *udpConn) Close() error {
+	return u.ch.Close()
+}
+
+func (u *udpConn) LocalAddr() net.Addr {
+	return u.laddr
+}
+
+// SetDeadline, SetReadDeadline and SetWriteDeadline exist to satisfy
+// the net.PacketConn interface, but are not implemented, as for the
+// connections of Client.Dial. They always return an error.
+func (u *udpConn) SetDeadline(t time.Time) error {
+	return errors.New("ssh: udp channel: deadline not supported")
+}
+
+func (u *udpConn) SetReadDeadline(t time.Time) error {
+	return u.SetDeadline(t)
+}
+
+func (u *udpConn) SetWriteDeadline(t time.Time) error {
+	return u.SetDeadline(t)
+}
+
+// DialUDP opens a UDPChannelType channel to the "host:port" addr,
+// and returns a net.PacketConn whose datagrams the server relays to
+// and from addr. The server must route the channel type to
+// ForwardUDP. ClientConfig.DialPolicy applies, as it does to Dial.
+func (c *Client) DialUDP(ctx context.Context, addr string) (net.PacketConn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if p := c.dialPolicy(); p != nil {
+		if err := p.Check(host, int(port)); err != nil {
+			return nil, err
+		}
+	}
+	msg := DirectUDPPayload{
+		DestAddr:   host,
+		DestPort:   uint32(port),
+		OriginAddr: net.IPv4zero.String(),
+	}
+	ch, in, err := c.openChannel(ctx, UDPChannelType, Marshal(&msg))
+	if err != nil {
+		return nil, err
+	}
+	go DiscardRequests(ctx, in, c.Halt)
+	raddr := &net.UDPAddr{IP: net.ParseIP(host), Port: int(port)}
+	if raddr.IP == nil {
+		raddr.IP = net.IPv4zero
+	}
+	return &udpConn{
+		ch:    ch,
+		laddr: &net.UDPAddr{IP: net.IPv4zero},
+		raddr: raddr,
+	}, nil
+}
+
+// AcceptUDP accepts newCh, a UDPChannelType channel, and returns a
+// net.PacketConn for the datagrams of the client, whose address is
+// the originator of the payload, for servers that answer datagrams
+// themselves. Use ForwardUDP to relay them to their destination.
+func AcceptUDP(ctx context.Context, newCh NewChannel) (net.PacketConn, *DirectUDPPayload, error) {
+	var p DirectUDPPayload
+	if newCh.ChannelType() != UDPChannelType {
+		return nil, nil, fmt.Errorf("ssh: channel type %q is not %q", newCh.ChannelType(), UDPChannelType)
+	}
+	if err := Unmarshal(newCh.ExtraData(), &p); err != nil {
+		newCh.Reject(ConnectionFailed, "bad payload")
+		return nil, nil, err
+	}
+	ch, in, err := newCh.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	go DiscardRequests(ctx, in, nil)
+	raddr := &net.UDPAddr{IP: net.ParseIP(p.OriginAddr), Port: int(p.OriginPort)}
+	return &udpConn{
+		ch:    ch,
+		laddr: &net.UDPAddr{IP: net.ParseIP(p.DestAddr), Port: int(p.DestPort)},
+		raddr: raddr,
+	}, &p, nil
+}
+
+// ForwardUDP serves newCh, a UDPChannelType channel, as sshd serves
+// "direct-tcpip": it dials the destination of the payload over UDP,
+// rejecting the channel if that fails, and relays datagrams both ways
+// until the channel is closed, or ctx is done. It returns once it
+// stops relaying. Servers call it for the channels of the type that
+// they choose to forward; ParseChannelOpen decodes the payload for
+// checks of their own first.
+func ForwardUDP(ctx context.Context, newCh NewChannel) error {
+	var p DirectUDPPayload
+	if newCh.ChannelType() != UDPChannelType {
+		return fmt.Errorf("ssh: channel type %q is not %q", newCh.ChannelType(), UDPChannelType)
+	}
+	if err := Unmarshal(newCh.ExtraData(), &p); err != nil {
+		newCh.Reject(ConnectionFailed, "bad payload")
+		return err
+	}
+	var d net.Dialer
+	uc, err := d.DialContext(ctx, "udp", net.JoinHostPort(p.DestAddr, strconv.Itoa(int(p.DestPort))))
+	if err != nil {
+		newCh.Reject(ConnectionFailed, err.Error())
+		return err
+	}
+	defer uc.Close()
+	ch, in, err := newCh.Accept()
+	if err != nil {
+		return err
+	}
+	go DiscardRequests(ctx, in, nil)
+	pc := &udpConn{ch: ch, laddr: uc.LocalAddr(), raddr: uc.RemoteAddr()}
+	defer pc.Close()
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ch.Done():
+		case <-stopped:
+		}
+		uc.Close()
+	}()
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				// uc is closed once the relay ends; until then
+				// errors, such as the ICMP port unreachable
+				// reply to a datagram, are for that datagram.
+				select {
+				case <-ctx.Done():
+					return
+				case <-ch.Done():
+					return
+				case <-stopped:
+					return
+				default:
+					continue
+				}
+			}
+			if _, err := pc.WriteTo(buf[:n], nil); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		// Datagrams may be lost, so a failed send is not fatal.
+		uc.Write(buf[:n])
+	}
+}
@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestDialUDP(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("ListenPacket: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen: %v", err)
+	}
+	config := &ServerConfig{NoClientAuth: true, Config: Config{Halt: NewHalter()}}
+	config.AddHostKey(testSigners["rsa"])
+	defer config.Halt.RequestStop()
+	ctx := context.Background()
+
+	// The server forwards datagrams, except to port 1, which it
+	// answers itself with one long datagram per datagram.
+	go ServeListener(ctx, l, config, func(ctx context.Context, conn *ServerConn, chans <-chan NewChannel, reqs <-chan *Request) {
+		go DiscardRequests(ctx, reqs, nil)
+		for newCh := range chans {
+			p, err := ParseChannelOpen(newCh)
+			d, ok := p.(*DirectUDPPayload)
+			if err != nil || !ok {
+				newCh.Reject(UnknownChannelType, "not supported")
+				continue
+			}
+			if d.DestPort != 1 {
+				go ForwardUDP(ctx, newCh)
+				continue
+			}
+			pc, _, err := AcceptUDP(ctx, newCh)
+			if err != nil {
+				t.Errorf("AcceptUDP: %v", err)
+				continue
+			}
+			go func() {
+				defer pc.Close()
+				buf := make([]byte, 16)
+				for {
+					_, addr, err := pc.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					pc.WriteTo([]byte("0123456789"), addr)
+				}
+			}()
+		}
+	})
+
+	client, err := Dial(ctx, "tcp", l.Addr().String(), &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	pc, err := client.DialUDP(ctx, echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	buf := make([]byte, 2048)
+	for _, msg := range []string{"ping", "", "pong"} {
+		if _, err := pc.WriteTo([]byte(msg), nil); err != nil {
+			t.Fatalf("WriteTo: %v", err)
+		}
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		if string(buf[:n]) != msg || addr.String() != echo.LocalAddr().String() {
+			t.Errorf("got %q from %v, want %q from %v", buf[:n], addr, msg, echo.LocalAddr())
+		}
+	}
+	if _, err := pc.WriteTo(make([]byte, maxDatagram+1), nil); err == nil {
+		t.Error("WriteTo sent a datagram longer than UDP carries")
+	}
+	pc.Close()
+
+	// A datagram longer than the buffer is truncated, and the
+	// next one is read whole.
+	pc, err = client.DialUDP(ctx, "127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer pc.Close()
+	pc.WriteTo([]byte("a"), nil)
+	pc.WriteTo([]byte("b"), nil)
+	if n, _, err := pc.ReadFrom(buf[:4]); err != nil || string(buf[:n]) != "0123" {
+		t.Errorf("ReadFrom short buffer: %q, %v", buf[:n], err)
+	}
+	if n, _, err := pc.ReadFrom(buf); err != nil || string(buf[:n]) != "0123456789" {
+		t.Errorf("ReadFrom: %q, %v", buf[:n], err)
+	}
+
+	// The policy of the client applies.
+	policy, err := ParseDialPolicy("deny 127.0.0.1")
+	if err != nil {
+		t.Fatalf("ParseDialPolicy: %v", err)
+	}
+	client.Conn.(*connection).clicfg.DialPolicy = policy
+	if _, err := client.DialUDP(ctx, echo.LocalAddr().String()); err == nil {
+		t.Error("DialUDP ignored DialPolicy")
+	}
+}
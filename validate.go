@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigError lists the problems Validate found in a configuration,
+// all at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "ssh: invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// configProblems gathers the problems of a configuration.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// err returns the problems as a *ConfigError, or nil if there are
+// none.
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ConfigError{Problems: p}
+}
+
+// checkAlgorithms reports the names in list, the field of that
+// name, that are not supported. A nil list picks the defaults, but
+// an empty one leaves nothing to negotiate.
+func (p *configProblems) checkAlgorithms(field string, list, supported []string) {
+	if list == nil {
+		return
+	}
+	if len(list) == 0 {
+		p.add("%s is empty; leave it nil for the defaults", field)
+		return
+	}
+	var unknown []string
+	for _, name := range list {
+		if !contains(supported, name) {
+			unknown = append(unknown, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(unknown) > 0 {
+		p.add("%s has unsupported %s; supported are %s", field, strings.Join(unknown, ", "), strings.Join(supported, ", "))
+	}
+}
+
+// algorithmNames sorts names, gathered from a map of algorithms,
+// and returns them.
+func algorithmNames(names []string) []string {
+	sort.Strings(names)
+	return names
+}
+
+// problems returns what is wrong with the fields of c.
+func (c *Config) problems() configProblems {
+	var p configProblems
+	var ciphers, kexes, macs []string
+	for name := range cipherModes {
+		ciphers = append(ciphers, name)
+	}
+	for name := range kexAlgoMap {
+		kexes = append(kexes, name)
+	}
+	for name := range macModes {
+		macs = append(macs, name)
+	}
+	p.checkAlgorithms("Ciphers", c.Ciphers, algorithmNames(ciphers))
+	p.checkAlgorithms("KeyExchanges", c.KeyExchanges, algorithmNames(kexes))
+	p.checkAlgorithms("MACs", c.MACs, algorithmNames(macs))
+	seen := map[string]bool{compressionNone: true}
+	for _, comp := range c.Compressions {
+		if comp == nil {
+			p.add("Compressions has a nil entry")
+			continue
+		}
+		if seen[comp.Name()] {
+			p.add("Compressions has %q twice", comp.Name())
+		}
+		seen[comp.Name()] = true
+	}
+	if c.RekeyThreshold < 0 {
+		p.add("RekeyThreshold is negative")
+	}
+	return p
+}
+
+// checkVersion reports a version identification that RFC 4253,
+// section 4.2, does not allow.
+func (p *configProblems) checkVersion(field, version string) {
+	if version == "" {
+		return
+	}
+	if !strings.HasPrefix(version, "SSH-2.0-") {
+		p.add("%s %q must start with \"SSH-2.0-\"", field, version)
+	}
+	if len(version) > 253 || strings.ContainsAny(version, "\r\n") {
+		p.add("%s must be a single line of at most 253 bytes", field)
+	}
+}
+
+// Validate checks c for the mistakes that would otherwise only show
+// up as failures of NewClientConn, some of them in the middle of the
+// handshake, and returns a *ConfigError listing all of them, or nil.
+// It checks that HostKeyCallback and Halt are set, and that the
+// algorithms named are ones this package implements.
+func (c *ClientConfig) Validate() error {
+	p := c.Config.problems()
+	if c.HostKeyCallback == nil {
+		p.add("HostKeyCallback is nil; use a knownhosts callback, FixedHostKey, or InsecureIgnoreHostKey for tests")
+	}
+	if c.Halt == nil {
+		p.add("Halt is nil; set it to NewHalter()")
+	}
+	p.checkAlgorithms("HostKeyAlgorithms", c.HostKeyAlgorithms, supportedHostKeyAlgos)
+	p.checkVersion("ClientVersion", c.ClientVersion)
+	for i, a := range c.Auth {
+		if a == nil {
+			p.add("Auth[%d] is nil", i)
+		}
+	}
+	return p.err()
+}
+
+// Validate checks c for the mistakes that would otherwise only show
+// up as failures of NewServerConn, and returns a *ConfigError
+// listing all of them, or nil. It checks that there are host keys
+// and a way to authenticate clients, and that the algorithms named
+// are ones this package implements.
+func (c *ServerConfig) Validate() error {
+	p := c.Config.problems()
+	// A GetConfigForConn may supply the keys and callbacks.
+	if len(c.hostKeys) == 0 && c.GetConfigForConn == nil {
+		p.add("no host keys; call AddHostKey")
+	}
+	if c.GetConfigForConn == nil && !c.NoClientAuth && c.PasswordCallback == nil && c.PublicKeyCallback == nil && c.KeyboardInteractiveCallback == nil {
+		p.add("no authentication callback is set, and NoClientAuth is false, so no client can log in")
+	}
+	p.checkAlgorithms("PublicKeyAuthAlgorithms", c.PublicKeyAuthAlgorithms, serverSigAlgs)
+	p.checkVersion("ServerVersion", c.ServerVersion)
+	return p.err()
+}
@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClientConfigValidate(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	good := &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter()},
+	}
+	if err := good.Validate(); err != nil {
+		t.Errorf("Validate of a good config: %v", err)
+	}
+
+	bad := &ClientConfig{
+		Config: Config{
+			Ciphers: []string{"aes128-ctr", "blowfish-cbc"},
+			MACs:    []string{},
+		},
+		HostKeyAlgorithms: []string{"ssh-foo"},
+		ClientVersion:     "OpenSSH_9.0",
+	}
+	err := bad.Validate()
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Validate of a bad config: got %v, want a *ConfigError", err)
+	}
+	for _, want := range []string{`"blowfish-cbc"`, "MACs is empty", "HostKeyCallback", "Halt", `"ssh-foo"`, "SSH-2.0-"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+	if len(ce.Problems) != 6 {
+		t.Errorf("got %d problems, want 6: %q", len(ce.Problems), ce.Problems)
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	config := &ServerConfig{
+		Config:                  Config{KeyExchanges: []string{"diffie-hellman-group-exchange-sha1"}},
+		PublicKeyAuthAlgorithms: []string{"rsa-sha2-384"},
+	}
+	err := config.Validate()
+	var ce *ConfigError
+	if !errors.As(err, &ce) || len(ce.Problems) != 4 {
+		t.Fatalf("Validate: got %v, want 4 problems", err)
+	}
+
+	config = &ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigners["ecdsa"])
+	if err := config.Validate(); err != nil {
+		t.Errorf("Validate of a good config: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package ssh
+
+import "strings"
+
+// Version is an SSH version line, as RFC 4253, section 4.2, lays it
+// out: "SSH-protoversion-softwareversion SP comments".
+type Version struct {
+	// Raw is the line as sent, without its line ending.
+	Raw string
+
+	// Proto is the protocol version, normally "2.0", and Software
+	// the name and version of the implementation, such as
+	// "OpenSSH_9.6". Both are empty if Raw is not laid out as
+	// the RFC says.
+	Proto    string
+	Software string
+
+	// Comments is what follows the first space, if anything.
+	Comments string
+}
+
+// ParseVersion splits the version line raw into its parts.
+func ParseVersion(raw []byte) Version {
+	v := Version{Raw: string(raw)}
+	ident := v.Raw
+	if i := strings.IndexByte(ident, ' '); i >= 0 {
+		ident, v.Comments = ident[:i], ident[i+1:]
+	}
+	if !strings.HasPrefix(ident, "SSH-") {
+		return v
+	}
+	ident = ident[len("SSH-"):]
+	i := strings.IndexByte(ident, '-')
+	if i < 0 {
+		return v
+	}
+	v.Proto, v.Software = ident[:i], ident[i+1:]
+	return v
+}
+
+func (v Version) String() string {
+	return v.Raw
+}
+
+// ConnVersions returns the version lines of the client and the
+// server of conn, parsed.
+func ConnVersions(conn ConnMetadata) (client, server Version) {
+	return ParseVersion(conn.ClientVersion()), ParseVersion(conn.ServerVersion())
+}
+
+// PeerVersionCallback is called with the version line of the peer
+// once it is read, before the key exchange starts. Returning an
+// error ends the handshake with it, to refuse implementations known
+// to be broken or unsafe.
+//
+// config is the Config of the connection, a copy of the one passed
+// to NewClientConn or NewServerConn, which the callback may change
+// to work around the quirks of the peer: the settings the key
+// exchange and the connection use from then on, such as the
+// algorithms, rekey settings and Quirks, take the changes, but the
+// Obfuscator, Faults and Halt do not. Its slices are shared with the
+// original, so they must be replaced rather than changed in place.
+type PeerVersionCallback func(peer Version, config *Config) error
+
+// checkPeerVersion runs the PeerVersionCallback of config, if any,
+// on the version line of the peer, and picks the Quirks it needs.
+func checkPeerVersion(config *Config, peer []byte) error {
+	v := ParseVersion(peer)
+	if config.PeerVersionCallback != nil {
+		if err := config.PeerVersionCallback(v, config); err != nil {
+			return err
+		}
+	}
+	config.setQuirks(v)
+	return nil
+}
@@ -0,0 +1,194 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	for _, test := range []struct {
+		raw  string
+		want Version
+	}{
+		{"SSH-2.0-OpenSSH_9.6", Version{Proto: "2.0", Software: "OpenSSH_9.6"}},
+		{"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6", Version{Proto: "2.0", Software: "OpenSSH_8.9p1", Comments: "Ubuntu-3ubuntu0.6"}},
+		{"SSH-1.99-Cisco-1.25", Version{Proto: "1.99", Software: "Cisco-1.25"}},
+		{"SSH-2.0-", Version{Proto: "2.0"}},
+		{"SSH-2.0", Version{}},
+		{"junk line", Version{Comments: "line"}},
+	} {
+		test.want.Raw = test.raw
+		if got := ParseVersion([]byte(test.raw)); got != test.want {
+			t.Errorf("ParseVersion(%q) = %+v, want %+v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestPeerVersionCallback(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	ctx := context.Background()
+	handshake := func(clientConf *ClientConfig, serverConf *ServerConfig) (Conn, error, error) {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		defer c1.Close()
+		defer c2.Close()
+		serverConf.NoClientAuth = true
+		serverConf.AddHostKey(testSigners["rsa"])
+		serverErr := make(chan error, 1)
+		go func() {
+			_, _, _, err := NewServerConn(ctx, c1, serverConf)
+			if err != nil {
+				c1.Close()
+			}
+			serverErr <- err
+		}()
+		clientConf.User = "user"
+		clientConf.HostKeyCallback = InsecureIgnoreHostKey()
+		conn, _, _, err := NewClientConn(ctx, c2, "", clientConf)
+		if err != nil {
+			c2.Close()
+		}
+		return conn, err, <-serverErr
+	}
+
+	// The server refuses a client by its version.
+	refused := errors.New("refused")
+	var seen Version
+	serverConf := &ServerConfig{Config: Config{
+		Halt: NewHalter(),
+		PeerVersionCallback: func(peer Version, config *Config) error {
+			seen = peer
+			if peer.Software == "BadImpl_1.0" {
+				return refused
+			}
+			return nil
+		},
+	}}
+	defer serverConf.Halt.RequestStop()
+	clientConf := &ClientConfig{
+		ClientVersion: "SSH-2.0-BadImpl_1.0 build 7",
+		Config:        Config{Halt: NewHalter()},
+	}
+	defer clientConf.Halt.RequestStop()
+	if _, clientErr, serverErr := handshake(clientConf, serverConf); clientErr == nil || serverErr != refused {
+		t.Errorf("handshake with a refused version: client %v, server %v", clientErr, serverErr)
+	}
+	if want := (Version{Raw: "SSH-2.0-BadImpl_1.0 build 7", Proto: "2.0", Software: "BadImpl_1.0", Comments: "build 7"}); seen != want {
+		t.Errorf("callback saw %+v, want %+v", seen, want)
+	}
+
+	clientConf.ClientVersion = "SSH-2.0-GoodImpl"
+	conn, clientErr, serverErr := handshake(clientConf, serverConf)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake: client %v, server %v", clientErr, serverErr)
+	}
+	client, server := ConnVersions(conn)
+	if client.Software != "GoodImpl" || server.Raw != packageVersion {
+		t.Errorf("ConnVersions: %+v, %+v", client, server)
+	}
+	conn.Close()
+
+	// The client adjusts its config for the server; here it asks
+	// for a cipher the server lacks, so the key exchange fails.
+	serverConf.PeerVersionCallback = nil
+	serverConf.Ciphers = []string{gcmCipherID}
+	clientConf.PeerVersionCallback = func(peer Version, config *Config) error {
+		if peer.Software == "Go" {
+			config.Ciphers = []string{"aes128-ctr"}
+		}
+		return nil
+	}
+	if _, clientErr, _ := handshake(clientConf, serverConf); clientErr == nil {
+		t.Error("handshake succeeded without the cipher the callback chose")
+	}
+	if clientConf.Ciphers != nil {
+		t.Errorf("callback changed the ClientConfig: %v", clientConf.Ciphers)
+	}
+}
+
+func TestVersionExchangeLimits(t *testing.T) {
+	defer xtestend(xtestbegin(t))
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		name    string
+		send    string
+		config  Config
+		wantErr error
+	}{
+		{"silent", "", Config{VersionTimeout: 50 * time.Millisecond}, ErrVersionTimeout},
+		{"slow junk", "SSH-2.0-", Config{VersionTimeout: 50 * time.Millisecond}, ErrVersionTimeout},
+		{"long", "SSH-2.0-" + strings.Repeat("x", 40) + "\r\n", Config{MaxVersionBytes: 32}, nil},
+	} {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		go io.Copy(ioutil.Discard, c2)
+		io.WriteString(c2, test.send)
+
+		serverConf := &ServerConfig{NoClientAuth: true, Config: test.config}
+		serverConf.Halt = NewHalter()
+		serverConf.AddHostKey(testSigners["rsa"])
+		start := time.Now()
+		_, _, _, err = NewServerConn(ctx, c1, serverConf)
+		if err == nil {
+			t.Errorf("%s: handshake succeeded", test.name)
+		} else if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.wantErr)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: took %v", test.name, d)
+		}
+		c1.Close()
+		c2.Close()
+		serverConf.Halt.RequestStop()
+	}
+
+	// A deadline of the caller is kept, rather than replaced by
+	// VersionTimeout.
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	go io.Copy(ioutil.Discard, c2)
+	c1.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err = exchangeVersionsConn(c1, []byte("SSH-2.0-Go"), &Config{VersionTimeout: time.Hour})
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("exchange past the deadline of the caller: got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("exchange past the deadline of the caller took %v", d)
+	}
+	c1.Close()
+	c2.Close()
+
+	// The client is bounded too.
+	c1, c2, err = netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c1)
+	_, _, _, err = NewClientConn(ctx, c2, "", &ClientConfig{
+		User:            "user",
+		HostKeyCallback: InsecureIgnoreHostKey(),
+		Config:          Config{Halt: NewHalter(), VersionTimeout: 50 * time.Millisecond},
+	})
+	if !errors.Is(err, ErrVersionTimeout) {
+		t.Errorf("NewClientConn against a silent server: got %v, want ErrVersionTimeout", err)
+	}
+}
@@ -0,0 +1,27 @@
+package ssh
+
+import "errors"
+
+// ParseKexInit decodes packet, an SSH_MSG_KEXINIT, into the
+// algorithms it proposes. Like the other Parse functions of this
+// package, it is safe to call on untrusted or arbitrary input.
+func ParseKexInit(packet []byte) (KexProposal, error) {
+	var msg kexInitMsg
+	if err := Unmarshal(packet, &msg); err != nil {
+		return KexProposal{}, err
+	}
+	return msg.proposal(), nil
+}
+
+// ValidatePacket checks that packet, a decrypted SSH message, decodes
+// as a message of its type, as the connection would decode it.
+// Message types this package does not handle are reported as
+// errors too. It is meant for tools that inspect traffic, and for
+// fuzzing.
+func ValidatePacket(packet []byte) error {
+	if len(packet) == 0 {
+		return errors.New("ssh: empty packet")
+	}
+	_, err := decode(packet)
+	return err
+}